@@ -12,7 +12,9 @@ then
         export BRANCH=""
     fi
 
-    export FLAGS="-X github.com/matrix-org/dendrite/internal.branch=$BRANCH -X github.com/matrix-org/dendrite/internal.build=$BUILD"
+    export COMMIT=`git rev-parse HEAD || ""`
+
+    export FLAGS="-X github.com/matrix-org/dendrite/internal.branch=$BRANCH -X github.com/matrix-org/dendrite/internal.build=$BUILD -X github.com/matrix-org/dendrite/internal.commit=$COMMIT"
 else
     export FLAGS=""
 fi
@@ -115,6 +115,7 @@ func (m *DendriteMonolith) Start() {
 	keyAPI := keyserver.NewInternalAPI(&base.Cfg.KeyServer, federation)
 	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, cfg.Derived.ApplicationServices, keyAPI)
 	keyAPI.SetUserAPI(userAPI)
+	base.SetupAdminAudit(accountDB, userAPI)
 
 	rsAPI := roomserver.NewInternalAPI(
 		base, keyRing,
@@ -146,11 +147,12 @@ func (m *DendriteMonolith) Start() {
 	rsAPI.SetFederationSenderAPI(fsAPI)
 
 	monolith := setup.Monolith{
-		Config:    base.Cfg,
-		AccountDB: accountDB,
-		Client:    ygg.CreateClient(base),
-		FedClient: federation,
-		KeyRing:   keyRing,
+		Config:     base.Cfg,
+		MessageBus: base.MessageBus(),
+		AccountDB:  accountDB,
+		Client:     ygg.CreateClient(base),
+		FedClient:  federation,
+		KeyRing:    keyRing,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -167,6 +169,7 @@ func (m *DendriteMonolith) Start() {
 		base.PublicFederationAPIMux,
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
+		base.DendriteAdminMux,
 	)
 
 	httpRouter := mux.NewRouter()
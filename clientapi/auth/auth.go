@@ -78,6 +78,12 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.SoftLogout {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.SoftLoggedOut("Access token has been revoked"),
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
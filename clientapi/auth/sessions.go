@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// ErrSessionExpired is returned when a user-interactive auth session took
+// longer than the configured lifetime to complete.
+var ErrSessionExpired = errors.New("user-interactive auth session has expired")
+
+// UIASessionDatabase stores user-interactive auth sessions. It is implemented
+// by the account database.
+type UIASessionDatabase interface {
+	GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error)
+	SaveUIASession(ctx context.Context, session *api.UIASession) error
+	RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error
+}
+
+// UIASessions keeps track of the completed stages of user-interactive auth
+// sessions. Sessions are stored in the database so that they survive restarts,
+// and expire once they are older than the configured lifetime.
+type UIASessions struct {
+	db       UIASessionDatabase
+	lifetime time.Duration
+}
+
+// NewUIASessions returns a UIASessions which stores sessions in the given
+// database. A lifetime of 0 means that sessions never expire.
+func NewUIASessions(db UIASessionDatabase, lifetime time.Duration) *UIASessions {
+	return &UIASessions{
+		db:       db,
+		lifetime: lifetime,
+	}
+}
+
+// New starts a new session and returns its ID.
+func (s *UIASessions) New(ctx context.Context) (string, error) {
+	sessionID, err := GenerateAccessToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if s.lifetime > 0 {
+		// Sessions which expired recently are kept, so that clients trying
+		// to continue them are told why they can't.
+		if err = s.db.RemoveUIASessionsBefore(ctx, toMS(now.Add(-2*s.lifetime))); err != nil {
+			return "", err
+		}
+	}
+	err = s.db.SaveUIASession(ctx, &api.UIASession{
+		ID:        sessionID,
+		Completed: []string{},
+		CreatedTS: toMS(now),
+	})
+	return sessionID, err
+}
+
+// get returns the session with the given ID, or nil if there is no such
+// session. Returns ErrSessionExpired if the session has expired.
+func (s *UIASessions) get(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	session, err := s.db.GetUIASession(ctx, sessionID)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	if s.lifetime > 0 && session.CreatedTS+int64(s.lifetime/time.Millisecond) < toMS(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+// Exists returns true if the session has been started and hasn't expired.
+// Returns ErrSessionExpired if the session has expired.
+func (s *UIASessions) Exists(ctx context.Context, sessionID string) (bool, error) {
+	session, err := s.get(ctx, sessionID)
+	return session != nil, err
+}
+
+// CompletedStages returns the stages which have been completed in the session,
+// which is never nil. Returns ErrSessionExpired if the session has expired.
+func (s *UIASessions) CompletedStages(ctx context.Context, sessionID string) ([]string, error) {
+	session, err := s.get(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return []string{}, nil
+	}
+	return session.Completed, nil
+}
+
+// AddCompletedStage records that a stage has been completed in the session,
+// starting the session if needed. Returns ErrSessionExpired if the session
+// has expired.
+func (s *UIASessions) AddCompletedStage(ctx context.Context, sessionID, stage string) error {
+	session, err := s.get(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		session = &api.UIASession{
+			ID:        sessionID,
+			CreatedTS: toMS(time.Now()),
+		}
+	}
+	for _, completed := range session.Completed {
+		if completed == stage {
+			return nil
+		}
+	}
+	session.Completed = append(session.Completed, stage)
+	return s.db.SaveUIASession(ctx, session)
+}
+
+// SessionErrorResponse returns the response to send to the client for an
+// error from UIASessions.
+func SessionErrorResponse(ctx context.Context, err error) *util.JSONResponse {
+	if err == ErrSessionExpired {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.SessionExpired("The auth session has expired, start a new one"),
+		}
+	}
+	util.GetLogger(ctx).WithError(err).Error("Failed to access user-interactive auth session")
+	res := jsonerror.InternalServerError()
+	return &res
+}
+
+func toMS(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type fakeSessionDB struct {
+	sync.Mutex
+	sessions map[string]api.UIASession
+}
+
+func newFakeSessionDB() *fakeSessionDB {
+	return &fakeSessionDB{
+		sessions: make(map[string]api.UIASession),
+	}
+}
+
+func (d *fakeSessionDB) GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	d.Lock()
+	defer d.Unlock()
+	session, ok := d.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	session.Completed = append([]string{}, session.Completed...)
+	return &session, nil
+}
+
+func (d *fakeSessionDB) SaveUIASession(ctx context.Context, session *api.UIASession) error {
+	d.Lock()
+	defer d.Unlock()
+	if existing, ok := d.sessions[session.ID]; ok {
+		existing.Completed = append([]string{}, session.Completed...)
+		d.sessions[session.ID] = existing
+		return nil
+	}
+	d.sessions[session.ID] = *session
+	return nil
+}
+
+func (d *fakeSessionDB) RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error {
+	d.Lock()
+	defer d.Unlock()
+	for id, session := range d.sessions {
+		if session.CreatedTS < createdTS {
+			delete(d.sessions, id)
+		}
+	}
+	return nil
+}
+
+func TestUIASessionsCompletedStages(t *testing.T) {
+	sessions := NewUIASessions(newFakeSessionDB(), time.Hour)
+	sessionID, err := sessions.New(ctx)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	stages, err := sessions.CompletedStages(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("CompletedStages failed: %s", err)
+	}
+	if stages == nil || len(stages) != 0 {
+		t.Errorf("expected no completed stages for a new session, got %v", stages)
+	}
+	for _, stage := range []string{"m.login.dummy", "m.login.recaptcha", "m.login.dummy"} {
+		if err = sessions.AddCompletedStage(ctx, sessionID, stage); err != nil {
+			t.Fatalf("AddCompletedStage failed: %s", err)
+		}
+	}
+	stages, err = sessions.CompletedStages(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("CompletedStages failed: %s", err)
+	}
+	if len(stages) != 2 || stages[0] != "m.login.dummy" || stages[1] != "m.login.recaptcha" {
+		t.Errorf("expected each completed stage once, got %v", stages)
+	}
+}
+
+func TestUIASessionsExpire(t *testing.T) {
+	db := newFakeSessionDB()
+	sessions := NewUIASessions(db, time.Hour)
+	db.sessions["old"] = api.UIASession{
+		ID:        "old",
+		Completed: []string{"m.login.dummy"},
+		CreatedTS: toMS(time.Now().Add(-90 * time.Minute)),
+	}
+	if _, err := sessions.CompletedStages(ctx, "old"); err != ErrSessionExpired {
+		t.Errorf("expected ErrSessionExpired for an old session, got %v", err)
+	}
+	if err := sessions.AddCompletedStage(ctx, "old", "m.login.recaptcha"); err != ErrSessionExpired {
+		t.Errorf("expected ErrSessionExpired when continuing an old session, got %v", err)
+	}
+	if res := SessionErrorResponse(ctx, ErrSessionExpired); res.Code != 400 {
+		t.Errorf("expected HTTP 400 for an expired session, got %d", res.Code)
+	}
+
+	// Sessions which never expire
+	sessions = NewUIASessions(db, 0)
+	if _, err := sessions.CompletedStages(ctx, "old"); err != nil {
+		t.Errorf("expected session to be usable when sessions don't expire, got %v", err)
+	}
+}
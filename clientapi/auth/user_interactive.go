@@ -71,6 +71,9 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// Whether the client supports refresh tokens (MSC2918)
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -107,11 +110,11 @@ type UserInteractive struct {
 	Flows     []userInteractiveFlow
 	// Map of login type to implementation
 	Types map[string]Type
-	// Map of session ID to completed login types, will need to be extended in future
-	Sessions map[string][]string
+	// The sessions, which record the completed login types
+	Sessions *UIASessions
 }
 
-func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.ClientAPI) *UserInteractive {
+func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.ClientAPI, sessions *UIASessions) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: getAccByPass,
 		Config:               cfg,
@@ -127,7 +130,7 @@ func NewUserInteractive(getAccByPass GetAccountByPassword, cfg *config.ClientAPI
 		Types: map[string]Type{
 			typePassword.Name(): typePassword,
 		},
-		Sessions: make(map[string][]string),
+		Sessions: sessions,
 	}
 }
 
@@ -140,10 +143,14 @@ func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
 	return false
 }
 
-func (u *UserInteractive) AddCompletedStage(sessionID, authType string) {
+func (u *UserInteractive) AddCompletedStage(ctx context.Context, sessionID, authType string) error {
 	// TODO: Handle multi-stage flows
 	u.Completed = append(u.Completed, authType)
-	delete(u.Sessions, sessionID)
+	if sessionID == "" {
+		// Single stage flows can be completed without a session.
+		return nil
+	}
+	return u.Sessions.AddCompletedStage(ctx, sessionID, authType)
 }
 
 // Challenge returns an HTTP 401 with the supported flows for authenticating
@@ -166,14 +173,13 @@ func (u *UserInteractive) Challenge(sessionID string) *util.JSONResponse {
 }
 
 // NewSession returns a challenge with a new session ID and remembers the session ID
-func (u *UserInteractive) NewSession() *util.JSONResponse {
-	sessionID, err := GenerateAccessToken()
+func (u *UserInteractive) NewSession(ctx context.Context) *util.JSONResponse {
+	sessionID, err := u.Sessions.New(ctx)
 	if err != nil {
-		logrus.WithError(err).Error("failed to generate session ID")
+		logrus.WithError(err).Error("failed to start session")
 		res := jsonerror.InternalServerError()
 		return &res
 	}
-	u.Sessions[sessionID] = []string{}
 	return u.Challenge(sessionID)
 }
 
@@ -211,7 +217,7 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	// https://matrix.org/docs/spec/client_server/r0.6.1#user-interactive-api-in-the-rest-api
 	hasResponse := gjson.GetBytes(bodyBytes, "auth").Exists()
 	if !hasResponse {
-		return nil, u.NewSession()
+		return nil, u.NewSession(ctx)
 	}
 
 	// extract the type so we know which login type to use
@@ -226,7 +232,11 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 
 	// retrieve the session
 	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
-	if _, ok = u.Sessions[sessionID]; !ok {
+	exists, err := u.Sessions.Exists(ctx, sessionID)
+	if err != nil {
+		return nil, SessionErrorResponse(ctx, err)
+	}
+	if !exists {
 		// if the login type is part of a single stage flow then allow them to omit the session ID
 		if !u.IsSingleStageFlow(authType) {
 			return nil, &util.JSONResponse{
@@ -237,7 +247,7 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	}
 
 	r := loginType.Request()
-	if err := json.Unmarshal([]byte(gjson.GetBytes(bodyBytes, "auth").Raw), r); err != nil {
+	if err = json.Unmarshal([]byte(gjson.GetBytes(bodyBytes, "auth").Raw), r); err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
@@ -245,7 +255,9 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	}
 	login, resErr := loginType.Login(ctx, r)
 	if resErr == nil {
-		u.AddCompletedStage(sessionID, authType)
+		if err = u.AddCompletedStage(ctx, sessionID, authType); err != nil {
+			return nil, SessionErrorResponse(ctx, err)
+		}
 		// TODO: Check if there's more stages to go and return an error
 		return login, nil
 	}
@@ -18,24 +18,27 @@ import (
 	"github.com/gorilla/mux"
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/api"
+	"github.com/matrix-org/dendrite/clientapi/consumers"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
-	"github.com/matrix-org/dendrite/internal/setup/kafka"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the ClientAPI component.
 func AddPublicRoutes(
 	router *mux.Router,
 	cfg *config.ClientAPI,
+	bus internal.MessageBus,
 	accountsDB accounts.Database,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
@@ -47,11 +50,20 @@ func AddPublicRoutes(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 ) {
-	_, producer := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
-
 	syncProducer := &producers.SyncAPIProducer{
-		Producer: producer,
-		Topic:    cfg.Matrix.Kafka.TopicFor(config.TopicOutputClientData),
+		Bus:   bus,
+		Topic: cfg.Matrix.Kafka.TopicFor(config.TopicOutputClientData),
+	}
+
+	// The room server consumer only accepts invites, so it isn't needed
+	// unless invites are accepted automatically.
+	if cfg.AutoAcceptInvites.Enabled {
+		roomConsumer := consumers.NewOutputRoomEventConsumer(
+			cfg, bus, accountsDB, rsAPI,
+		)
+		if err := roomConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start room server consumer")
+		}
 	}
 
 	routing.Setup(
@@ -60,3 +72,16 @@ func AddPublicRoutes(
 		syncProducer, transactionsCache, fsAPI, keyAPI, extRoomsProvider,
 	)
 }
+
+// AddAdminRoutes registers the ClientAPI admin HTTP handlers with the given
+// admin router.
+func AddAdminRoutes(
+	adminMux *mux.Router,
+	cfg *config.ClientAPI,
+	accountsDB accounts.Database,
+	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keyAPI keyserverAPI.KeyInternalAPI,
+) {
+	routing.SetupAdmin(adminMux, cfg, accountsDB, userAPI, rsAPI, keyAPI)
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// acceptInvitesAccountDataType is the global account data type that users
+// can set to override client_api.auto_accept_invites for themselves.
+const acceptInvitesAccountDataType = "m.accept_invites"
+
+// autoAcceptTimeout is how long to spend trying to join a room that a user
+// was invited to before giving up.
+const autoAcceptTimeout = time.Minute * 2
+
+// OutputRoomEventConsumer consumes events that originated in the room server,
+// accepting invites on behalf of users who automatically accept them.
+type OutputRoomEventConsumer struct {
+	cfg        *config.ClientAPI
+	rsAPI      api.RoomserverInternalAPI
+	bus        internal.MessageBus
+	rsConsumer internal.Subscriber
+	accountDB  accounts.Database
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	cfg *config.ClientAPI,
+	bus internal.MessageBus,
+	accountDB accounts.Database,
+	rsAPI api.RoomserverInternalAPI,
+) *OutputRoomEventConsumer {
+	return &OutputRoomEventConsumer{
+		cfg:       cfg,
+		rsAPI:     rsAPI,
+		bus:       bus,
+		accountDB: accountDB,
+	}
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() (err error) {
+	s.rsConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "clientapi/roomserver",
+		Topic:          s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent),
+		PartitionStore: s.accountDB,
+		// Only invites sent from now on are accepted, rather than every
+		// invite in the history of the server.
+		StartFromNewest: true,
+		Process:         s.onMessage,
+	})
+	return err
+}
+
+// onMessage is called when the clientapi receives a new event from the room
+// server output log. Only new invites are of interest.
+func (s *OutputRoomEventConsumer) onMessage(msg *internal.Message) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewInviteEvent {
+		return nil
+	}
+	return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
+}
+
+func (s *OutputRoomEventConsumer) onNewInviteEvent(
+	ctx context.Context, msg api.OutputNewInviteEvent,
+) error {
+	event := msg.Event
+	if event.StateKey() == nil {
+		return nil
+	}
+	userID := *event.StateKey()
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != s.cfg.Matrix.ServerName {
+		return nil
+	}
+
+	policy := s.cfg.AutoAcceptInvites
+	data, err := s.accountDB.GetAccountDataByType(ctx, localpart, "", acceptInvitesAccountDataType)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to get m.accept_invites account data")
+		return nil
+	}
+	if data != nil {
+		// Fields that the user hasn't set are left as the server default.
+		if err = json.Unmarshal(data, &policy); err != nil {
+			log.WithError(err).WithField("user_id", userID).Warn("Invalid m.accept_invites account data")
+			return nil
+		}
+	}
+
+	var content struct {
+		IsDirect bool `json:"is_direct"`
+	}
+	_ = json.Unmarshal(event.Content(), &content)
+	if !policy.Accepts(event.Sender(), content.IsDirect) {
+		return nil
+	}
+
+	// Invites are accepted one at a time, as this consumer doesn't do
+	// anything else that a slow remote join could hold up.
+	s.acceptInvite(ctx, event, localpart)
+	return nil
+}
+
+// acceptInvite joins the invited user to the room on their behalf, using
+// their profile for the membership event. Nothing is done if the user is no
+// longer invited, e.g. because they have already rejected the invite.
+func (s *OutputRoomEventConsumer) acceptInvite(ctx context.Context, event gomatrixserverlib.HeaderedEvent, localpart string) {
+	ctx, cancel := context.WithTimeout(ctx, autoAcceptTimeout)
+	defer cancel()
+
+	userID := *event.StateKey()
+	logger := log.WithFields(log.Fields{
+		"user_id": userID,
+		"room_id": event.RoomID(),
+		"sender":  event.Sender(),
+	})
+
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := s.rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: event.RoomID(),
+		UserID: userID,
+	}, &membershipRes); err != nil {
+		logger.WithError(err).Warn("Failed to query membership, not accepting invite")
+		return
+	}
+	if membershipRes.Membership != gomatrixserverlib.Invite {
+		return
+	}
+
+	joinReq := api.PerformJoinRequest{
+		RoomIDOrAlias: event.RoomID(),
+		UserID:        userID,
+		Content:       map[string]interface{}{},
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', event.Sender()); err == nil && domain != s.cfg.Matrix.ServerName {
+		joinReq.ServerNames = []gomatrixserverlib.ServerName{domain}
+	}
+	if profile, err := s.accountDB.GetProfileByLocalpart(ctx, localpart); err == nil {
+		joinReq.Content["displayname"] = profile.DisplayName
+		joinReq.Content["avatar_url"] = profile.AvatarURL
+	}
+
+	var joinRes api.PerformJoinResponse
+	s.rsAPI.PerformJoin(ctx, &joinReq, &joinRes)
+	if joinRes.Error != nil {
+		logger.WithError(joinRes.Error).Warn("Failed to automatically accept invite")
+		return
+	}
+	logger.Info("Automatically accepted invite")
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testInviteRoomID = "!room:kaer.morhen"
+	testInvitee      = "@ciri:kaer.morhen"
+)
+
+type testInviteRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	sync.Mutex
+	membership string
+	joins      []string
+}
+
+func (r *testInviteRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse) error {
+	res.Membership = r.membership
+	return nil
+}
+
+func (r *testInviteRoomserverAPI) PerformJoin(ctx context.Context, req *api.PerformJoinRequest, res *api.PerformJoinResponse) {
+	r.Lock()
+	defer r.Unlock()
+	r.joins = append(r.joins, req.UserID)
+}
+
+func (r *testInviteRoomserverAPI) joinCount() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.joins)
+}
+
+type testInviteAccountDB struct {
+	accounts.Database
+}
+
+func (d *testInviteAccountDB) GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (json.RawMessage, error) {
+	return nil, nil
+}
+
+func (d *testInviteAccountDB) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{Localpart: localpart, DisplayName: "Ciri"}, nil
+}
+
+func (d *testInviteAccountDB) PartitionOffsets(ctx context.Context, topic string) ([]sqlutil.PartitionOffset, error) {
+	return nil, nil
+}
+
+func (d *testInviteAccountDB) SetPartitionOffset(ctx context.Context, topic string, partition int32, offset int64) error {
+	return nil
+}
+
+// testInviteKafkaConsumer is a sarama.Consumer for a topic with a single
+// partition holding the given message.
+type testInviteKafkaConsumer struct {
+	sarama.Consumer
+	message []byte
+}
+
+func (c *testInviteKafkaConsumer) Partitions(topic string) ([]int32, error) {
+	return []int32{0}, nil
+}
+
+func (c *testInviteKafkaConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	pc := &testInvitePartitionConsumer{messages: make(chan *sarama.ConsumerMessage, 1)}
+	if offset != sarama.OffsetNewest {
+		pc.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Value: c.message}
+	}
+	return pc, nil
+}
+
+type testInvitePartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages  chan *sarama.ConsumerMessage
+	closeOnce sync.Once
+}
+
+func (pc *testInvitePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+
+func (pc *testInvitePartitionConsumer) AsyncClose() {
+	pc.closeOnce.Do(func() { close(pc.messages) })
+}
+
+func (pc *testInvitePartitionConsumer) Close() error {
+	pc.AsyncClose()
+	return nil
+}
+
+func testInviteConfig() *config.ClientAPI {
+	return &config.ClientAPI{
+		Matrix:            &config.Global{ServerName: "kaer.morhen"},
+		AutoAcceptInvites: config.AutoAcceptInvites{Enabled: true},
+	}
+}
+
+func mustBuildInvite(t *testing.T) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKey := testInvitee
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   "@geralt:kaer.morhen",
+		RoomID:   testInviteRoomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &stateKey,
+	}
+	if err := eb.SetContent(map[string]interface{}{"membership": gomatrixserverlib.Invite}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), "kaer.morhen", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func TestAcceptInviteOnlyWhenStillInvited(t *testing.T) {
+	invite := mustBuildInvite(t)
+	for _, tt := range []struct {
+		membership string
+		wantJoin   bool
+	}{
+		{gomatrixserverlib.Invite, true},
+		{gomatrixserverlib.Leave, false},
+		{gomatrixserverlib.Join, false},
+		{gomatrixserverlib.Ban, false},
+	} {
+		rsAPI := &testInviteRoomserverAPI{membership: tt.membership}
+		s := NewOutputRoomEventConsumer(testInviteConfig(), nil, &testInviteAccountDB{}, rsAPI)
+		if err := s.onNewInviteEvent(context.Background(), api.OutputNewInviteEvent{
+			RoomVersion: gomatrixserverlib.RoomVersionV6,
+			Event:       invite,
+		}); err != nil {
+			t.Fatalf("onNewInviteEvent failed: %s", err)
+		}
+		if joined := rsAPI.joinCount() == 1; joined != tt.wantJoin {
+			t.Errorf("membership %q: got join %v, want %v", tt.membership, joined, tt.wantJoin)
+		}
+	}
+}
+
+func TestNewConsumerDoesNotReplayInvites(t *testing.T) {
+	message, err := json.Marshal(api.OutputEvent{
+		Type: api.OutputTypeNewInviteEvent,
+		NewInviteEvent: &api.OutputNewInviteEvent{
+			RoomVersion: gomatrixserverlib.RoomVersionV6,
+			Event:       mustBuildInvite(t),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal output event: %s", err)
+	}
+	rsAPI := &testInviteRoomserverAPI{membership: gomatrixserverlib.Invite}
+	kafkaConsumer := &testInviteKafkaConsumer{message: message}
+	bus := internal.NewSaramaMessageBus(func() sarama.Consumer { return kafkaConsumer }, nil)
+	s := NewOutputRoomEventConsumer(testInviteConfig(), bus, &testInviteAccountDB{}, rsAPI)
+	if err = s.Start(); err != nil {
+		t.Fatalf("failed to start consumer: %s", err)
+	}
+	defer s.rsConsumer.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if n := rsAPI.joinCount(); n != 0 {
+		t.Errorf("a new consumer accepted %d invites from before it started, want 0", n)
+	}
+}
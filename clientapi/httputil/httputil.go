@@ -21,19 +21,38 @@ import (
 	"unicode/utf8"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	internalHTTPUtil "github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/util"
 )
 
+// ReadRequestBody reads the whole request body. Returns M_TOO_LARGE if the
+// body is larger than the limit for the endpoint, or an error JSON response
+// if the body couldn't be read for any other reason.
+func ReadRequestBody(req *http.Request) ([]byte, *util.JSONResponse) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err == internalHTTPUtil.ErrRequestBodyTooLarge {
+		return nil, &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge("The request body is too large"),
+		}
+	}
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	return body, nil
+}
+
 // UnmarshalJSONRequest into the given interface pointer. Returns an error JSON response if
 // there was a problem unmarshalling. Calling this function consumes the request body.
 func UnmarshalJSONRequest(req *http.Request, iface interface{}) *util.JSONResponse {
 	// encoding/json allows invalid utf-8, matrix does not
 	// https://matrix.org/docs/spec/client_server/r0.6.1#api-standards
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
-		resp := jsonerror.InternalServerError()
-		return &resp
+	body, resErr := ReadRequestBody(req)
+	if resErr != nil {
+		return resErr
 	}
 
 	if !utf8.Valid(body) {
@@ -15,6 +15,9 @@
 package jsonerror
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -42,6 +45,55 @@ func InternalServerError() util.JSONResponse {
 	}
 }
 
+// errCodeStatus is the HTTP status code to use for each error code when a
+// MatrixError is turned into a response by ErrorResponse. Error codes which
+// aren't listed here are sent with 400 Bad Request.
+var errCodeStatus = map[string]int{
+	"M_UNKNOWN":         http.StatusInternalServerError,
+	"M_FORBIDDEN":       http.StatusForbidden,
+	"M_NOT_FOUND":       http.StatusNotFound,
+	"M_MISSING_TOKEN":   http.StatusUnauthorized,
+	"M_UNKNOWN_TOKEN":   http.StatusUnauthorized,
+	"M_TOO_LARGE":       http.StatusRequestEntityTooLarge,
+	"M_LIMIT_EXCEEDED":  http.StatusTooManyRequests,
+	"M_USER_IN_USE":     http.StatusBadRequest,
+	"M_SESSION_EXPIRED": http.StatusBadRequest,
+}
+
+// ErrorResponse turns an error returned while handling a request into a
+// response in the standard error format, with a suitable HTTP status code.
+// Errors which know how to respond, such as roomserver PerformErrors, are
+// sent as they ask, MatrixErrors are sent as they are and sql.ErrNoRows is
+// sent as M_NOT_FOUND. Any other error is logged and sent as a 500 Internal
+// Server Error, so that no internal details are leaked to the client.
+func ErrorResponse(ctx context.Context, err error) util.JSONResponse {
+	var responder interface {
+		JSONResponse() util.JSONResponse
+	}
+	if errors.As(err, &responder) {
+		return responder.JSONResponse()
+	}
+	var matrixErr *MatrixError
+	if errors.As(err, &matrixErr) {
+		code, ok := errCodeStatus[matrixErr.ErrCode]
+		if !ok {
+			code = http.StatusBadRequest
+		}
+		return util.JSONResponse{
+			Code: code,
+			JSON: matrixErr,
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: NotFound("The requested resource was not found"),
+		}
+	}
+	util.GetLogger(ctx).WithError(err).Error("Request failed")
+	return InternalServerError()
+}
+
 // Unknown is an unexpected error
 func Unknown(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN", msg}
@@ -64,6 +116,12 @@ func NotJSON(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_JSON", msg}
 }
 
+// TooLarge is an error when the client tries to send an event or request
+// which is too large.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
 // NotFound is an error when the client tries to access an unknown resource.
 func NotFound(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_FOUND", msg}
@@ -81,6 +139,18 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when a parameter in the request was invalid,
+// e.g. a key which isn't properly formed.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
+// InvalidSignature is an error when a signature in the request could not be
+// verified.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -93,6 +163,35 @@ func UnknownToken(msg string) *MatrixError {
 	return &MatrixError{"M_UNKNOWN_TOKEN", msg}
 }
 
+// UnknownTokenError is an unknown token error which tells the client whether
+// it has been soft logged out.
+type UnknownTokenError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// SoftLoggedOut is an error when the client supplies an access token which has
+// been revoked, but its device still exists. The client can log in again to
+// the same device without losing its end-to-end encryption keys.
+func SoftLoggedOut(msg string) *UnknownTokenError {
+	return &UnknownTokenError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
+// SessionExpired is an error when the client continues a user-interactive auth
+// session which took too long to complete. The client must start a new one.
+func SessionExpired(msg string) *MatrixError {
+	return &MatrixError{"M_SESSION_EXPIRED", msg}
+}
+
+// RoomInUse is an error when the client tries to create a room with an alias
+// which is already taken.
+func RoomInUse(msg string) *MatrixError {
+	return &MatrixError{"M_ROOM_IN_USE", msg}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) *MatrixError {
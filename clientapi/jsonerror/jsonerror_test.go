@@ -15,8 +15,15 @@
 package jsonerror
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"testing"
+
+	"github.com/matrix-org/util"
 )
 
 func TestLimitExceeded(t *testing.T) {
@@ -42,3 +49,45 @@ func TestForbidden(t *testing.T) {
 		t.Errorf("TestForbidden: want %s, got %s", want, string(jsonBytes))
 	}
 }
+
+type respondingError struct{}
+
+func (respondingError) Error() string {
+	return "responding error"
+}
+
+func (respondingError) JSONResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusConflict,
+		JSON: Unknown("conflict"),
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantJSON string
+	}{
+		{"matrix error", Forbidden("no"), http.StatusForbidden, `{"errcode":"M_FORBIDDEN","error":"no"}`},
+		{"wrapped matrix error", fmt.Errorf("wrapped: %w", NotFound("gone")), http.StatusNotFound, `{"errcode":"M_NOT_FOUND","error":"gone"}`},
+		{"unmapped matrix error", BadJSON("bad"), http.StatusBadRequest, `{"errcode":"M_BAD_JSON","error":"bad"}`},
+		{"responding error", respondingError{}, http.StatusConflict, `{"errcode":"M_UNKNOWN","error":"conflict"}`},
+		{"no rows", fmt.Errorf("select: %w", sql.ErrNoRows), http.StatusNotFound, `{"errcode":"M_NOT_FOUND","error":"The requested resource was not found"}`},
+		{"other error", errors.New("database is on fire"), http.StatusInternalServerError, `{"errcode":"M_UNKNOWN","error":"Internal Server Error"}`},
+	}
+	for _, tt := range tests {
+		res := ErrorResponse(context.Background(), tt.err)
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: want code %d, got %d", tt.name, tt.wantCode, res.Code)
+		}
+		jsonBytes, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal response: %s", tt.name, err)
+		}
+		if string(jsonBytes) != tt.wantJSON {
+			t.Errorf("%s: want %s, got %s", tt.name, tt.wantJSON, string(jsonBytes))
+		}
+	}
+}
@@ -17,21 +17,19 @@ package producers
 import (
 	"encoding/json"
 
-	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	log "github.com/sirupsen/logrus"
 )
 
 // SyncAPIProducer produces events for the sync API server to consume
 type SyncAPIProducer struct {
-	Topic    string
-	Producer sarama.SyncProducer
+	Topic string
+	Bus   internal.MessageBus
 }
 
 // SendData sends account data to the sync API server
 func (p *SyncAPIProducer) SendData(userID string, roomID string, dataType string) error {
-	var m sarama.ProducerMessage
-
 	data := eventutil.AccountData{
 		RoomID: roomID,
 		Type:   dataType,
@@ -41,15 +39,12 @@ func (p *SyncAPIProducer) SendData(userID string, roomID string, dataType string
 		return err
 	}
 
-	m.Topic = string(p.Topic)
-	m.Key = sarama.StringEncoder(userID)
-	m.Value = sarama.ByteEncoder(value)
 	log.WithFields(log.Fields{
 		"user_id":   userID,
 		"room_id":   roomID,
 		"data_type": dataType,
 	}).Infof("Producing to topic '%s'", p.Topic)
 
-	_, _, err = p.Producer.SendMessage(&m)
+	_, _, err = p.Bus.Publish(p.Topic, []byte(userID), value)
 	return err
 }
@@ -17,7 +17,6 @@ package routing
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -48,8 +47,7 @@ func GetAccountData(
 	}
 	dataRes := api.QueryAccountDataResponse{}
 	if err := userAPI.QueryAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountData failed")
-		return util.ErrorResponse(fmt.Errorf("userAPI.QueryAccountData: %w", err))
+		return jsonerror.ErrorResponse(req.Context(), fmt.Errorf("userAPI.QueryAccountData: %w", err))
 	}
 
 	var data json.RawMessage
@@ -100,10 +98,9 @@ func SaveAccountData(
 		}
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
-		return jsonerror.InternalServerError()
+	body, resErr := httputil.ReadRequestBody(req)
+	if resErr != nil {
+		return *resErr
 	}
 
 	if !json.Valid(body) {
@@ -121,8 +118,7 @@ func SaveAccountData(
 	}
 	dataRes := api.InputAccountDataResponse{}
 	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
-		return util.ErrorResponse(err)
+		return jsonerror.ErrorResponse(req.Context(), fmt.Errorf("userAPI.InputAccountData: %w", err))
 	}
 
 	// TODO: user API should do this since it's account data
@@ -183,8 +179,7 @@ func SaveReadMarker(
 	}
 	dataRes := api.InputAccountDataResponse{}
 	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
-		return util.ErrorResponse(err)
+		return jsonerror.ErrorResponse(req.Context(), fmt.Errorf("userAPI.InputAccountData: %w", err))
 	}
 
 	if err := syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
@@ -0,0 +1,272 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// adminAuditMaxBodySize is the largest request body that will be recorded
+// in the parameters of an admin audit entry.
+const adminAuditMaxBodySize = 64 * 1024
+
+// adminAuditMaxLimit is the largest number of audit entries that can be
+// requested at once.
+const adminAuditMaxLimit = 1000
+
+// adminAuditTargetVars are the route variables, in order of preference, that
+// identify the target of an admin action.
+var adminAuditTargetVars = []string{"userID", "roomID", "peerID"}
+
+type adminAuditParams struct {
+	Query map[string][]string `json:"query,omitempty"`
+	Body  json.RawMessage     `json:"body,omitempty"`
+}
+
+// AdminAuditMiddleware returns the middleware which rate limits, authorises
+// and records every request to the admin API. It is installed on the admin
+// router by the base, so that it covers the admin routes of every component.
+func AdminAuditMiddleware(
+	cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+) mux.MiddlewareFunc {
+	return adminAuditMiddleware(cfg.Matrix.AdminToken, accountDB, userAPI, newRateLimits(cfg, accountDB))
+}
+
+// adminAuditMiddleware rate limits requests to the admin API, checks that they
+// carry the admin token or were made by a server admin, and records every
+// authorised request in the admin audit log before it is handled. If the audit
+// entry can't be written then the request is refused, so that no admin action
+// goes unrecorded.
+func adminAuditMiddleware(
+	adminToken string, accountDB accounts.Database, userAPI userapi.UserInternalAPI, rateLimits *rateLimits,
+) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if resErr := rateLimits.rateLimit(req, nil); resErr != nil {
+				writeJSONResponse(w, req, *resErr)
+				return
+			}
+			req, resErr := verifyAdmin(req, adminToken, accountDB, userAPI)
+			if resErr != nil {
+				writeJSONResponse(w, req, *resErr)
+				return
+			}
+			entry, err := newAdminAuditEntry(req)
+			if err == nil {
+				err = accountDB.InsertAdminAuditEntry(req.Context(), entry)
+			}
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("Failed to write admin audit entry")
+				writeJSONResponse(w, req, jsonerror.InternalServerError())
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// verifyAdmin checks that the request carries the admin token or the access
+// token of a server admin. Requests made by a server admin are returned with
+// their device recorded, so that the admin handlers accept them and the audit
+// entry names the admin.
+func verifyAdmin(
+	req *http.Request, adminToken string, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+) (*http.Request, *util.JSONResponse) {
+	tokenErr := httputil.VerifyAdminToken(req, adminToken)
+	if tokenErr == nil || adminToken == "" || tokenErr.Code != http.StatusForbidden {
+		return req, tokenErr
+	}
+	device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+	if resErr != nil {
+		if resErr.Code == http.StatusInternalServerError {
+			return req, resErr
+		}
+		// The token is neither the admin token nor a user's access token.
+		return req, tokenErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		jsonErr := jsonerror.InternalServerError()
+		return req, &jsonErr
+	}
+	account, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && !account.IsAdmin):
+		return req, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	case err != nil:
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		jsonErr := jsonerror.InternalServerError()
+		return req, &jsonErr
+	}
+	return httputil.WithAdminDevice(req, device), nil
+}
+
+func writeJSONResponse(w http.ResponseWriter, req *http.Request, res util.JSONResponse) {
+	util.MakeJSONAPI(util.NewJSONRequestHandler(func(*http.Request) util.JSONResponse {
+		return res
+	})).ServeHTTP(w, req)
+}
+
+// newAdminAuditEntry builds an audit entry describing the given request. The
+// request body is read in order to record it, and then replaced so that the
+// handler can still read it in full.
+func newAdminAuditEntry(req *http.Request) (*userapi.AdminAuditEntry, error) {
+	action := req.URL.Path
+	if route := mux.CurrentRoute(req); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			action = tpl
+		}
+	}
+	action = req.Method + " " + strings.TrimPrefix(action, strings.TrimSuffix(httputil.DendriteAdminPathPrefix, "/"))
+
+	var target string
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range adminAuditTargetVars {
+		if v, ok := vars[name]; ok {
+			target = v
+			break
+		}
+	}
+
+	var params adminAuditParams
+	query := req.URL.Query()
+	query.Del("access_token")
+	if len(query) > 0 {
+		params.Query = query
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, adminAuditMaxBodySize))
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		params.Body = redactAdminAuditBody(body)
+	}
+	var paramsJSON json.RawMessage
+	if params.Query != nil || params.Body != nil {
+		if paramsJSON, err = json.Marshal(params); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &userapi.AdminAuditEntry{
+		Actor:     userapi.AdminAuditActorToken,
+		IP:        httputil.ClientIP(req),
+		Action:    action,
+		Target:    target,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+		Params:    paramsJSON,
+	}
+	if device := httputil.AdminDevice(req); device != nil {
+		entry.Actor = device.UserID
+		entry.DeviceID = device.ID
+	}
+	return entry, nil
+}
+
+// redactAdminAuditBody returns the request body as it should be recorded in
+// the audit log. Bodies that aren't JSON objects are not recorded, and any
+// password fields are removed.
+func redactAdminAuditBody(body []byte) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if len(body) == 0 || json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+	for name := range fields {
+		if strings.Contains(strings.ToLower(name), "password") {
+			delete(fields, name)
+		}
+	}
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// GetAdminAudit implements GET /_dendrite/admin/v1/audit. The audit log is
+// returned newest first and can be paged through using the "from" parameter.
+func GetAdminAudit(req *http.Request, accountDB accounts.Database) util.JSONResponse {
+	var from int64
+	var err error
+	if s := req.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be an integer"),
+			}
+		}
+	}
+	limit := 100
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	if limit > adminAuditMaxLimit {
+		limit = adminAuditMaxLimit
+	}
+
+	entries, err := accountDB.GetAdminAuditEntries(req.Context(), from, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAdminAuditEntries failed")
+		return jsonerror.InternalServerError()
+	}
+	res := struct {
+		Entries []userapi.AdminAuditEntry `json:"entries"`
+		Next    int64                     `json:"next,omitempty"`
+	}{
+		Entries: entries,
+	}
+	if len(entries) == limit {
+		res.Next = entries[len(entries)-1].ID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+const testAdminToken = "admin_secret"
+
+type testAdminAuditAccountDB struct {
+	testWhoamiAccountDB
+	entries []userapi.AdminAuditEntry
+	failing bool
+}
+
+func (d *testAdminAuditAccountDB) InsertAdminAuditEntry(ctx context.Context, entry *userapi.AdminAuditEntry) error {
+	if d.failing {
+		return errors.New("database is unavailable")
+	}
+	d.entries = append(d.entries, *entry)
+	return nil
+}
+
+// testAdminRouter returns an admin router with a single route, and the
+// request bodies that the route has handled.
+func testAdminRouter(adminToken string, accountDB *testAdminAuditAccountDB) (*mux.Router, *[]string) {
+	var handled []string
+	r := mux.NewRouter().UseEncodedPath()
+	r.Use(adminAuditMiddleware(adminToken, accountDB, &testWhoamiUserAPI{}, &rateLimits{}))
+	r.Handle("/_dendrite/admin/v1/users/{userID}/admin",
+		httputil.MakeAdminAPI("test_admin", adminToken, func(req *http.Request) util.JSONResponse {
+			body, _ := ioutil.ReadAll(req.Body)
+			handled = append(handled, string(body))
+			return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+		}),
+	).Methods(http.MethodPut)
+	return r, &handled
+}
+
+func adminRequest(r *mux.Router, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(
+		http.MethodPut, "/_dendrite/admin/v1/users/%40ciri%3Akaer.morhen/admin",
+		strings.NewReader(`{"admin":true,"password":"hunter2"}`),
+	)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuditRecordsActor(t *testing.T) {
+	for _, tt := range []struct {
+		token    string
+		actor    string
+		deviceID string
+	}{
+		{testAdminToken, userapi.AdminAuditActorToken, ""},
+		{"geralt_token", "@geralt:kaer.morhen", "GERALT"},
+	} {
+		accountDB := &testAdminAuditAccountDB{}
+		r, handled := testAdminRouter(testAdminToken, accountDB)
+		if rec := adminRequest(r, tt.token); rec.Code != http.StatusOK {
+			t.Fatalf("%s: got HTTP %d, want %d: %s", tt.token, rec.Code, http.StatusOK, rec.Body)
+		}
+		if len(*handled) != 1 || (*handled)[0] != `{"admin":true,"password":"hunter2"}` {
+			t.Errorf("%s: expected the handler to read the whole body, got %q", tt.token, *handled)
+		}
+		if len(accountDB.entries) != 1 {
+			t.Fatalf("%s: got %d audit entries, want 1", tt.token, len(accountDB.entries))
+		}
+		entry := accountDB.entries[0]
+		if entry.Actor != tt.actor || entry.DeviceID != tt.deviceID {
+			t.Errorf("%s: got actor %q device %q, want actor %q device %q", tt.token, entry.Actor, entry.DeviceID, tt.actor, tt.deviceID)
+		}
+		if entry.IP != "192.0.2.1" {
+			t.Errorf("%s: got IP %q, want 192.0.2.1", tt.token, entry.IP)
+		}
+		if entry.Action != "PUT /v1/users/{userID}/admin" || entry.Target != "@ciri:kaer.morhen" {
+			t.Errorf("%s: got action %q target %q", tt.token, entry.Action, entry.Target)
+		}
+		if params := string(entry.Params); params != `{"body":{"admin":true}}` {
+			t.Errorf("%s: got params %s, want the body without the password", tt.token, params)
+		}
+	}
+}
+
+func TestAdminAuditRefusesRequests(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		adminToken string
+		token      string
+		failing    bool
+		code       int
+	}{
+		{"unknown token", testAdminToken, "not_a_token", false, http.StatusForbidden},
+		{"not a server admin", testAdminToken, "ciri_token", false, http.StatusForbidden},
+		{"admin API disabled", "", "geralt_token", false, http.StatusForbidden},
+		{"audit log unavailable", testAdminToken, testAdminToken, true, http.StatusInternalServerError},
+	} {
+		accountDB := &testAdminAuditAccountDB{failing: tt.failing}
+		r, handled := testAdminRouter(tt.adminToken, accountDB)
+		if rec := adminRequest(r, tt.token); rec.Code != tt.code {
+			t.Errorf("%s: got HTTP %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		if len(*handled) != 0 {
+			t.Errorf("%s: expected the request not to be handled", tt.name)
+		}
+		if len(accountDB.entries) != 0 {
+			t.Errorf("%s: expected no audit entries, got %+v", tt.name, accountDB.entries)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// DeviceLimitOverride implements GET, PUT and DELETE on
+// /_dendrite/admin/v1/users/{userID}/devicelimit, which manage the maximum
+// number of devices of a local user. A max_devices of 0 means unlimited.
+// Lowering the limit doesn't log out any devices until the user next logs in.
+func DeviceLimitOverride(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userID string,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can have device limit overrides"),
+		}
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		override, err := accountDB.GetDeviceLimitOverride(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetDeviceLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		if override == nil {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The user has no device limit override"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: override,
+		}
+
+	case http.MethodPut:
+		var override userapi.DeviceLimitOverride
+		if reqErr := httputil.UnmarshalJSONRequest(req, &override); reqErr != nil {
+			return *reqErr
+		}
+		if override.MaxDevices < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("max_devices must not be negative"),
+			}
+		}
+		if _, err = accountDB.GetAccountByLocalpart(req.Context(), localpart); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("The user does not exist"),
+			}
+		}
+		if err = accountDB.SetDeviceLimitOverride(req.Context(), localpart, &override); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetDeviceLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: override,
+		}
+
+	case http.MethodDelete:
+		if err = accountDB.RemoveDeviceLimitOverride(req.Context(), localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveDeviceLimitOverride failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusMethodNotAllowed,
+		JSON: jsonerror.NotFound("Bad method"),
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type adminLogoutRequest struct {
+	// The devices to log out. If empty, all of the user's devices are logged out.
+	DeviceIDs []string `json:"device_ids"`
+	// If true, the access tokens are revoked but the devices are kept, so the
+	// clients are told they have been soft logged out and can log in again
+	// without losing their end-to-end encryption keys. Otherwise the devices
+	// are deleted.
+	Soft bool `json:"soft"`
+}
+
+// AdminLogout implements POST /_dendrite/admin/v1/users/{userID}/logout,
+// which forces some or all of a local user's devices to log out.
+func AdminLogout(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI, userID string,
+) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be logged out"),
+		}
+	}
+
+	var r adminLogoutRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &r); reqErr != nil {
+		return *reqErr
+	}
+
+	var res userapi.PerformDeviceDeletionResponse
+	if err = userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+		UserID:     userID,
+		DeviceIDs:  r.DeviceIDs,
+		SoftLogout: r.Soft,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
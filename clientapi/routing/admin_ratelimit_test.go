@@ -0,0 +1,70 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRateLimitOverrideAdminEndpoint(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "kaer.morhen"},
+	}
+	accountDB := newTestRateLimitAccountDB()
+	request := func(method, userID, body string) int {
+		req := httptest.NewRequest(method, "/_dendrite/admin/v1/users/"+userID+"/ratelimit", strings.NewReader(body))
+		return RateLimitOverride(req, cfg, accountDB, userID).Code
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		userID string
+		body   string
+		want   int
+	}{
+		{"no override yet", http.MethodGet, "@ciri:kaer.morhen", "", http.StatusNotFound},
+		{"remote user", http.MethodPut, "@ciri:novigrad", `{"exempt":true}`, http.StatusBadRequest},
+		{"invalid user ID", http.MethodPut, "ciri", `{"exempt":true}`, http.StatusBadRequest},
+		{"missing threshold", http.MethodPut, "@ciri:kaer.morhen", `{"cooloff_ms":1000}`, http.StatusBadRequest},
+		{"missing cooloff", http.MethodPut, "@ciri:kaer.morhen", `{"threshold":10}`, http.StatusBadRequest},
+		{"unknown user", http.MethodPut, "@dandelion:kaer.morhen", `{"exempt":true}`, http.StatusNotFound},
+		{"set override", http.MethodPut, "@ciri:kaer.morhen", `{"threshold":10,"cooloff_ms":1000}`, http.StatusOK},
+		{"get override", http.MethodGet, "@ciri:kaer.morhen", "", http.StatusOK},
+		{"remove override", http.MethodDelete, "@ciri:kaer.morhen", "", http.StatusOK},
+		{"override removed", http.MethodGet, "@ciri:kaer.morhen", "", http.StatusNotFound},
+	} {
+		if code := request(tt.method, tt.userID, tt.body); code != tt.want {
+			t.Fatalf("%s: got HTTP %d, want %d", tt.name, code, tt.want)
+		}
+		switch tt.name {
+		case "set override":
+			want := userapi.RateLimitOverride{Threshold: 10, CooloffMS: 1000}
+			if got := accountDB.overrides["ciri"]; got == nil || *got != want {
+				t.Fatalf("got stored override %+v, want %+v", got, want)
+			}
+		case "unknown user", "missing threshold", "missing cooloff":
+			if len(accountDB.overrides) != 0 {
+				t.Fatalf("%s: expected nothing to be stored, got %+v", tt.name, accountDB.overrides)
+			}
+		}
+	}
+}
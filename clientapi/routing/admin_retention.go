@@ -0,0 +1,43 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// GetRetentionRooms implements GET /_dendrite/admin/v1/retention/rooms,
+// returning the rooms whose events expire under a message retention policy
+// and how long their events are kept for.
+func GetRetentionRooms(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var queryRes roomserverAPI.QueryRetentionRoomsResponse
+	if err := rsAPI.QueryRetentionRooms(req.Context(), &roomserverAPI.QueryRetentionRoomsRequest{}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryRetentionRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Rooms == nil {
+		queryRes.Rooms = []roomserverAPI.RoomRetention{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: queryRes,
+	}
+}
@@ -17,10 +17,13 @@ package routing
 import (
 	"html/template"
 	"net/http"
+	"sort"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/util"
 )
 
@@ -65,6 +68,33 @@ function captchaDone() {
 </html>
 `
 
+// termsTemplate is an HTML webpage template for terms auth
+const termsTemplate = `
+<html>
+<head>
+<title>Authentication</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+<form id="registrationForm" method="post" action="{{.myUrl}}">
+    <div>
+        <p>
+        Please read and accept the following policies to continue:
+        </p>
+        <ul>
+        {{range .policies}}
+            <li><a href="{{.URL}}" target="_blank">{{.Name}}</a></li>
+        {{end}}
+        </ul>
+        <input type="hidden" name="session" value="{{.session}}" />
+        <input type="submit" value="Accept" />
+    </div>
+</form>
+</body>
+</html>
+`
+
 // successTemplate is an HTML template presented to the user after successful
 // recaptcha completion
 const successTemplate = `
@@ -91,7 +121,7 @@ if (window.onAuthDone) {
 `
 
 // serveTemplate fills template data and serves it using http.ResponseWriter
-func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]string) {
+func serveTemplate(w http.ResponseWriter, templateHTML string, data interface{}) {
 	t := template.Must(template.New("response").Parse(templateHTML))
 	if err := t.Execute(w, data); err != nil {
 		panic(err)
@@ -101,7 +131,7 @@ func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]s
 // AuthFallback implements GET and POST /auth/{authType}/fallback/web?session={sessionID}
 func AuthFallback(
 	w http.ResponseWriter, req *http.Request, authType string,
-	cfg *config.ClientAPI,
+	uiaSessions *auth.UIASessions, cfg *config.ClientAPI,
 ) *util.JSONResponse {
 	sessionID := req.URL.Query().Get("session")
 
@@ -111,6 +141,14 @@ func AuthFallback(
 			http.StatusBadRequest,
 		)
 	}
+	if _, err := uiaSessions.Exists(req.Context(), sessionID); err == auth.ErrSessionExpired {
+		return writeHTTPMessage(w, req,
+			"This session has expired. Please start again from the application.",
+			http.StatusBadRequest,
+		)
+	} else if err != nil {
+		return auth.SessionErrorResponse(req.Context(), err)
+	}
 
 	serveRecaptcha := func() {
 		data := map[string]string{
@@ -121,6 +159,15 @@ func AuthFallback(
 		serveTemplate(w, recaptchaTemplate, data)
 	}
 
+	serveTerms := func() {
+		data := map[string]interface{}{
+			"myUrl":    req.URL.String(),
+			"session":  sessionID,
+			"policies": termsDocuments(cfg),
+		}
+		serveTemplate(w, termsTemplate, data)
+	}
+
 	serveSuccess := func() {
 		data := map[string]string{}
 		serveTemplate(w, successTemplate, data)
@@ -136,6 +183,11 @@ func AuthFallback(
 			serveRecaptcha()
 			return nil
 		}
+		// Handle Terms
+		if authType == authtypes.LoginTypeTerms && len(cfg.Terms) > 0 {
+			serveTerms()
+			return nil
+		}
 		return &util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Unknown auth stage type"),
@@ -147,7 +199,7 @@ func AuthFallback(
 				return err
 			}
 
-			clientIP := req.RemoteAddr
+			clientIP := httputil.ClientIP(req)
 			err := req.ParseForm()
 			if err != nil {
 				util.GetLogger(req.Context()).WithError(err).Error("req.ParseForm failed")
@@ -162,7 +214,20 @@ func AuthFallback(
 			}
 
 			// Success. Add recaptcha as a completed login flow
-			AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
+			if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeRecaptcha); err != nil {
+				return auth.SessionErrorResponse(req.Context(), err)
+			}
+
+			serveSuccess()
+			return nil
+		}
+
+		// Handle Terms
+		if authType == authtypes.LoginTypeTerms && len(cfg.Terms) > 0 {
+			// Submitting the form means that the policies were accepted
+			if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeTerms); err != nil {
+				return auth.SessionErrorResponse(req.Context(), err)
+			}
 
 			serveSuccess()
 			return nil
@@ -194,6 +259,29 @@ func checkRecaptchaEnabled(
 	return nil
 }
 
+// termsDocuments returns the document to show for each policy in the
+// fallback page. English documents are preferred, since we don't know the
+// user's language.
+func termsDocuments(cfg *config.ClientAPI) []config.TermsDocument {
+	docs := make([]config.TermsDocument, 0, len(cfg.Terms))
+	for _, policy := range cfg.Terms {
+		if doc, ok := policy.Languages["en"]; ok {
+			docs = append(docs, doc)
+			continue
+		}
+		langs := make([]string, 0, len(policy.Languages))
+		for lang := range policy.Languages {
+			langs = append(langs, lang)
+		}
+		if len(langs) == 0 {
+			continue
+		}
+		sort.Strings(langs)
+		docs = append(docs, policy.Languages[langs[0]])
+	}
+	return docs
+}
+
 // writeHTTPMessage writes the given header and message to the HTTP response writer.
 // Returns an error JSONResponse obtained through httputil.LogThenError if the writing failed, otherwise nil.
 func writeHTTPMessage(
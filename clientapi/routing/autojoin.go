@@ -0,0 +1,60 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// autoJoinRooms joins a newly registered user to the rooms listed in
+// client_api.auto_join_rooms, if the registration response shows that an
+// account was created. Rooms that don't exist or can't be joined are logged
+// and skipped, as they shouldn't stop the user from registering.
+func autoJoinRooms(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	res util.JSONResponse,
+) {
+	if len(cfg.AutoJoinRooms) == 0 || res.Code != http.StatusOK {
+		return
+	}
+	regRes, ok := res.JSON.(registerResponse)
+	if !ok || regRes.UserID == "" {
+		return
+	}
+	for _, roomIDOrAlias := range cfg.AutoJoinRooms {
+		logger := util.GetLogger(ctx).WithFields(log.Fields{
+			"user_id": regRes.UserID,
+			"room":    roomIDOrAlias,
+		})
+		joinReq := roomserverAPI.PerformJoinRequest{
+			RoomIDOrAlias: roomIDOrAlias,
+			UserID:        regRes.UserID,
+			Content:       map[string]interface{}{},
+		}
+		var joinRes roomserverAPI.PerformJoinResponse
+		rsAPI.PerformJoin(ctx, &joinReq, &joinRes)
+		if joinRes.Error != nil {
+			logger.WithError(joinRes.Error).Warn("Failed to auto-join room on registration")
+			continue
+		}
+		logger.WithField("room_id", joinRes.RoomID).Info("Auto-joined room on registration")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// Event types and content fields from MSC2716.
+const (
+	msc2716InsertionType   = "org.matrix.msc2716.insertion"
+	msc2716BatchType       = "org.matrix.msc2716.batch"
+	msc2716MarkerType      = "org.matrix.msc2716.marker"
+	msc2716NextBatchID     = "org.matrix.msc2716.next_batch_id"
+	msc2716BatchID         = "org.matrix.msc2716.batch_id"
+	msc2716MarkerInsertion = "org.matrix.msc2716.marker.insertion"
+	msc2716Historical      = "org.matrix.msc2716.historical"
+)
+
+type batchSendEvent struct {
+	Type           string                      `json:"type"`
+	Sender         string                      `json:"sender"`
+	StateKey       *string                     `json:"state_key,omitempty"`
+	Content        map[string]interface{}      `json:"content"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+type batchSendRequest struct {
+	StateEventsAtStart []batchSendEvent `json:"state_events_at_start"`
+	Events             []batchSendEvent `json:"events"`
+}
+
+type batchSendResponse struct {
+	StateEventIDs        []string `json:"state_event_ids"`
+	EventIDs             []string `json:"event_ids"`
+	NextBatchID          string   `json:"next_batch_id"`
+	InsertionEventID     string   `json:"insertion_event_id"`
+	BatchEventID         string   `json:"batch_event_id"`
+	BaseInsertionEventID string   `json:"base_insertion_event_id,omitempty"`
+}
+
+// historyBuilder builds historical events which are inserted into a room
+// after a given event. Every historical event has the same depth as that
+// event, so that the roomserver orders them before the live events which
+// follow it.
+type historyBuilder struct {
+	cfg         *config.ClientAPI
+	roomID      string
+	roomVersion gomatrixserverlib.RoomVersion
+	depth       int64
+	authEvents  gomatrixserverlib.AuthEvents
+	stateIDs    map[gomatrixserverlib.StateKeyTuple]string
+	inputs      []roomserverAPI.InputRoomEvent
+}
+
+// add builds a historical event, checks that it is allowed by the state at
+// the point it is inserted, and queues it to be sent to the roomserver.
+// State events are added as outliers which don't belong to the room graph,
+// and change the state for the historical events added after them.
+func (h *historyBuilder) add(
+	e batchSendEvent, prevEvents []gomatrixserverlib.EventReference,
+) (*gomatrixserverlib.Event, error) {
+	if e.Content == nil {
+		e.Content = map[string]interface{}{}
+	}
+	if e.StateKey == nil {
+		e.Content[msc2716Historical] = true
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     e.Sender,
+		RoomID:     h.roomID,
+		Type:       e.Type,
+		StateKey:   e.StateKey,
+		Depth:      h.depth,
+		PrevEvents: prevEvents,
+	}
+	if err := builder.SetContent(e.Content); err != nil {
+		return nil, err
+	}
+	ev, err := buildEvent(&builder, &h.authEvents, h.cfg, e.OriginServerTS.Time(), h.roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err = eventutil.CheckEventSize(ev.JSON(), h.cfg.Matrix.MaxEventFieldLengths); err != nil {
+		return nil, err
+	}
+	if err = gomatrixserverlib.Allowed(*ev, &h.authEvents); err != nil {
+		return nil, err
+	}
+
+	if e.StateKey != nil {
+		h.inputs = append(h.inputs, roomserverAPI.InputRoomEvent{
+			Kind:         roomserverAPI.KindOutlier,
+			Event:        ev.Headered(h.roomVersion),
+			AuthEventIDs: ev.AuthEventIDs(),
+		})
+		h.stateIDs[gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: *e.StateKey}] = ev.EventID()
+		return ev, h.authEvents.AddEvent(ev)
+	}
+
+	stateEventIDs := make([]string, 0, len(h.stateIDs))
+	for _, id := range h.stateIDs {
+		stateEventIDs = append(stateEventIDs, id)
+	}
+	h.inputs = append(h.inputs, roomserverAPI.InputRoomEvent{
+		Kind:          roomserverAPI.KindOld,
+		Event:         ev.Headered(h.roomVersion),
+		AuthEventIDs:  ev.AuthEventIDs(),
+		HasState:      true,
+		StateEventIDs: stateEventIDs,
+		Historical:    true,
+	})
+	return ev, nil
+}
+
+// BatchSend implements POST /rooms/{roomID}/batch_send (MSC2716), which lets
+// application services import history into a room. The events are inserted
+// after prev_event_id, between an insertion event and a batch event. The
+// batch event connects the events to the insertion event of the batch which
+// was sent before, given by batch_id, so that clients can paginate through
+// every batch.
+func BatchSend(
+	req *http.Request, device *userapi.Device, roomID string,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	accessToken, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	var appservice *config.ApplicationService
+	for i := range cfg.Derived.ApplicationServices {
+		if cfg.Derived.ApplicationServices[i].ASToken == accessToken {
+			appservice = &cfg.Derived.ApplicationServices[i]
+			break
+		}
+	}
+	if appservice == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Only application services can batch send events"),
+		}
+	}
+
+	prevEventID := req.URL.Query().Get("prev_event_id")
+	if prevEventID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing prev_event_id"),
+		}
+	}
+	batchID := req.URL.Query().Get("batch_id")
+
+	var r batchSendRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if len(r.Events) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("No events to send"),
+		}
+	}
+	for _, e := range r.StateEventsAtStart {
+		if e.Type != gomatrixserverlib.MRoomMember || e.StateKey == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("state_events_at_start can only contain membership events"),
+			}
+		}
+	}
+	for _, e := range r.Events {
+		if e.StateKey != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("events can't contain state events, use state_events_at_start instead"),
+			}
+		}
+	}
+	appserviceUserID := userutil.MakeUserID(appservice.SenderLocalpart, cfg.Matrix.ServerName)
+	for _, e := range append(r.StateEventsAtStart, r.Events...) {
+		if e.Sender != appserviceUserID && !UserIDIsWithinApplicationServiceNamespace(cfg, e.Sender, appservice) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("Sender %s is not in the application service's namespace", e.Sender)),
+			}
+		}
+	}
+
+	// The historical events are inserted with the state at prev_event_id.
+	prevEvent := roomserverAPI.GetEvent(req.Context(), rsAPI, prevEventID)
+	if prevEvent == nil || prevEvent.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("prev_event_id was not found in the room"),
+		}
+	}
+	// The batch event connects the events to the insertion event which
+	// accepts batch_id, so it has to be one that is already in the room.
+	if batchID != "" {
+		var insertionRes roomserverAPI.QueryInsertionEventResponse
+		err = rsAPI.QueryInsertionEvent(req.Context(), &roomserverAPI.QueryInsertionEventRequest{
+			RoomID:  roomID,
+			BatchID: batchID,
+		}, &insertionRes)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryInsertionEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		if insertionRes.EventID == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("No insertion event in the room accepts batch_id"),
+			}
+		}
+	}
+
+	var stateRes roomserverAPI.QueryStateAfterEventsResponse
+	err = rsAPI.QueryStateAfterEvents(req.Context(), &roomserverAPI.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{prevEventID},
+	}, &stateRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The state at prev_event_id is not known"),
+		}
+	}
+
+	h := historyBuilder{
+		cfg:         cfg,
+		roomID:      roomID,
+		roomVersion: stateRes.RoomVersion,
+		depth:       prevEvent.Depth(),
+		authEvents:  gomatrixserverlib.NewAuthEvents(nil),
+		stateIDs:    make(map[gomatrixserverlib.StateKeyTuple]string, len(stateRes.StateEvents)),
+	}
+	for i := range stateRes.StateEvents {
+		ev := stateRes.StateEvents[i].Unwrap()
+		h.stateIDs[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev.EventID()
+		if err = h.authEvents.AddEvent(&ev); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	notAllowed := func(what string, err error) util.JSONResponse {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("%s is not allowed: %s", what, err)),
+		}
+	}
+
+	res := batchSendResponse{
+		StateEventIDs: []string{},
+		EventIDs:      []string{},
+	}
+	for i, e := range r.StateEventsAtStart {
+		ev, err := h.add(e, nil)
+		if err != nil {
+			return notAllowed(fmt.Sprintf("state_events_at_start[%d]", i), err)
+		}
+		res.StateEventIDs = append(res.StateEventIDs, ev.EventID())
+	}
+
+	prevEvents := []gomatrixserverlib.EventReference{prevEvent.EventReference()}
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+
+	// The first batch sent after an event also needs an insertion event for
+	// it to connect to. Other servers find out about it from a marker event
+	// in the live timeline.
+	if batchID == "" {
+		batchID = util.RandomString(16)
+		baseInsertion, err := h.add(batchSendEvent{
+			Type:           msc2716InsertionType,
+			Sender:         device.UserID,
+			Content:        map[string]interface{}{msc2716NextBatchID: batchID},
+			OriginServerTS: now,
+		}, prevEvents)
+		if err != nil {
+			return notAllowed("The base insertion event", err)
+		}
+		res.BaseInsertionEventID = baseInsertion.EventID()
+	}
+
+	// The events in the batch are chained together in the order they were
+	// given, starting with an insertion event that the next batch, of older
+	// events, connects to, and ending with a batch event that connects this
+	// batch to the one given by batch_id.
+	res.NextBatchID = util.RandomString(16)
+	insertion, err := h.add(batchSendEvent{
+		Type:           msc2716InsertionType,
+		Sender:         device.UserID,
+		Content:        map[string]interface{}{msc2716NextBatchID: res.NextBatchID},
+		OriginServerTS: r.Events[0].OriginServerTS,
+	}, prevEvents)
+	if err != nil {
+		return notAllowed("The insertion event", err)
+	}
+	res.InsertionEventID = insertion.EventID()
+	prevEvents = []gomatrixserverlib.EventReference{insertion.EventReference()}
+	for i, e := range r.Events {
+		ev, err := h.add(e, prevEvents)
+		if err != nil {
+			return notAllowed(fmt.Sprintf("events[%d]", i), err)
+		}
+		res.EventIDs = append(res.EventIDs, ev.EventID())
+		prevEvents = []gomatrixserverlib.EventReference{ev.EventReference()}
+	}
+	batch, err := h.add(batchSendEvent{
+		Type:           msc2716BatchType,
+		Sender:         device.UserID,
+		Content:        map[string]interface{}{msc2716BatchID: batchID},
+		OriginServerTS: r.Events[len(r.Events)-1].OriginServerTS,
+	}, prevEvents)
+	if err != nil {
+		return notAllowed("The batch event", err)
+	}
+	res.BatchEventID = batch.EventID()
+
+	if err = roomserverAPI.SendInputRoomEvents(req.Context(), rsAPI, h.inputs); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.SendInputRoomEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if res.BaseInsertionEventID != "" {
+		if err = sendHistoryMarker(req, device, roomID, res.BaseInsertionEventID, cfg, rsAPI); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to send marker event for imported history")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// sendHistoryMarker sends a marker event to the live timeline which points
+// to the insertion event that history was imported after.
+func sendHistoryMarker(
+	req *http.Request, device *userapi.Device, roomID, insertionEventID string,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+) error {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     msc2716MarkerType,
+		StateKey: &insertionEventID,
+	}
+	err := builder.SetContent(map[string]interface{}{msc2716MarkerInsertion: insertionEventID})
+	if err != nil {
+		return err
+	}
+	event, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, nil)
+	if err != nil {
+		return err
+	}
+	return roomserverAPI.SendEvents(
+		req.Context(), rsAPI, roomserverAPI.KindNew,
+		[]gomatrixserverlib.HeaderedEvent{*event}, cfg.Matrix.ServerName, nil,
+	)
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testBatchSendRoomID  = "!history:kaer.morhen"
+	testBatchSendBridge  = "@bridge:kaer.morhen"
+	testBatchSendASToken = "bridge_as_token"
+	testBatchSendBatchID = "known_batch_id"
+)
+
+type testBatchSendRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	state  []gomatrixserverlib.HeaderedEvent
+	inputs []roomserverAPI.InputRoomEvent
+}
+
+func (r *testBatchSendRoomserverAPI) QueryEventsByID(ctx context.Context, req *roomserverAPI.QueryEventsByIDRequest, res *roomserverAPI.QueryEventsByIDResponse) error {
+	for _, eventID := range req.EventIDs {
+		for _, ev := range r.state {
+			if ev.EventID() == eventID {
+				res.Events = append(res.Events, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *testBatchSendRoomserverAPI) QueryInsertionEvent(ctx context.Context, req *roomserverAPI.QueryInsertionEventRequest, res *roomserverAPI.QueryInsertionEventResponse) error {
+	if req.RoomID == testBatchSendRoomID && req.BatchID == testBatchSendBatchID {
+		res.EventID = "$insertion:kaer.morhen"
+	}
+	return nil
+}
+
+func (r *testBatchSendRoomserverAPI) QueryStateAfterEvents(ctx context.Context, req *roomserverAPI.QueryStateAfterEventsRequest, res *roomserverAPI.QueryStateAfterEventsResponse) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	res.StateEvents = r.state
+	return nil
+}
+
+func (r *testBatchSendRoomserverAPI) InputRoomEvents(ctx context.Context, req *roomserverAPI.InputRoomEventsRequest, res *roomserverAPI.InputRoomEventsResponse) {
+	r.inputs = append(r.inputs, req.InputRoomEvents...)
+}
+
+func mustBuildBatchSendStateEvent(t *testing.T, evType string, depth int64, content map[string]interface{}, key ed25519.PrivateKey) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKey := ""
+	if evType == gomatrixserverlib.MRoomMember {
+		stateKey = testBatchSendBridge
+	}
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   testBatchSendBridge,
+		RoomID:   testBatchSendRoomID,
+		Type:     evType,
+		StateKey: &stateKey,
+		Depth:    depth,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "kaer.morhen", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func TestBatchSend(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			ServerName: "kaer.morhen",
+			KeyID:      "ed25519:test",
+			PrivateKey: key,
+		},
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{{
+				ID:              "bridge",
+				ASToken:         testBatchSendASToken,
+				SenderLocalpart: "bridge",
+			}},
+		},
+	}
+	rsAPI := &testBatchSendRoomserverAPI{
+		state: []gomatrixserverlib.HeaderedEvent{
+			mustBuildBatchSendStateEvent(t, gomatrixserverlib.MRoomCreate, 1, map[string]interface{}{"creator": testBatchSendBridge}, key),
+			mustBuildBatchSendStateEvent(t, gomatrixserverlib.MRoomMember, 2, map[string]interface{}{"membership": gomatrixserverlib.Join}, key),
+		},
+	}
+	prevEventID := rsAPI.state[1].EventID()
+	device := &userapi.Device{ID: "BRIDGE", UserID: testBatchSendBridge}
+	batchSend := func(accessToken, batchID string) int {
+		query := url.Values{"prev_event_id": {prevEventID}, "batch_id": {batchID}}
+		body := `{"events":[{"type":"m.room.message","sender":"` + testBatchSendBridge + `","content":{"body":"hello"},"origin_server_ts":1}]}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/unstable/org.matrix.msc2716/rooms/"+testBatchSendRoomID+"/batch_send?"+query.Encode(), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return BatchSend(req, device, testBatchSendRoomID, cfg, rsAPI).Code
+	}
+
+	if code := batchSend("user_access_token", testBatchSendBatchID); code != http.StatusForbidden {
+		t.Errorf("batch send from a user: got HTTP %d, want %d", code, http.StatusForbidden)
+	}
+	if code := batchSend(testBatchSendASToken, "unknown_batch_id"); code != http.StatusBadRequest {
+		t.Errorf("batch send with an unknown batch_id: got HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(rsAPI.inputs) != 0 {
+		t.Fatalf("rejected batches sent %d events to the roomserver", len(rsAPI.inputs))
+	}
+
+	if code := batchSend(testBatchSendASToken, testBatchSendBatchID); code != http.StatusOK {
+		t.Fatalf("batch send with a known batch_id: got HTTP %d, want %d", code, http.StatusOK)
+	}
+	// The insertion event, the message and the batch event, without a base
+	// insertion event since the batch connects to an existing one.
+	wantTypes := []string{msc2716InsertionType, "m.room.message", msc2716BatchType}
+	if len(rsAPI.inputs) != len(wantTypes) {
+		t.Fatalf("got %d events sent to the roomserver, want %d", len(rsAPI.inputs), len(wantTypes))
+	}
+	for i, input := range rsAPI.inputs {
+		if input.Event.Type() != wantTypes[i] {
+			t.Errorf("event %d: got type %s, want %s", i, input.Event.Type(), wantTypes[i])
+		}
+	}
+}
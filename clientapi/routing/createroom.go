@@ -28,6 +28,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -38,16 +39,26 @@ import (
 
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type createRoomRequest struct {
-	Invite          []string                      `json:"invite"`
-	Name            string                        `json:"name"`
-	Visibility      string                        `json:"visibility"`
-	Topic           string                        `json:"topic"`
-	Preset          string                        `json:"preset"`
-	CreationContent map[string]interface{}        `json:"creation_content"`
-	InitialState    []fledglingEvent              `json:"initial_state"`
-	RoomAliasName   string                        `json:"room_alias_name"`
-	GuestCanJoin    bool                          `json:"guest_can_join"`
-	RoomVersion     gomatrixserverlib.RoomVersion `json:"room_version"`
+	Invite                    []string                      `json:"invite"`
+	Invite3PID                []invite3PID                  `json:"invite_3pid"`
+	Name                      string                        `json:"name"`
+	Visibility                string                        `json:"visibility"`
+	Topic                     string                        `json:"topic"`
+	Preset                    string                        `json:"preset"`
+	CreationContent           map[string]interface{}        `json:"creation_content"`
+	InitialState              []fledglingEvent              `json:"initial_state"`
+	RoomAliasName             string                        `json:"room_alias_name"`
+	GuestCanJoin              bool                          `json:"guest_can_join"`
+	RoomVersion               gomatrixserverlib.RoomVersion `json:"room_version"`
+	PowerLevelContentOverride json.RawMessage               `json:"power_level_content_override"`
+	IsDirect                  bool                          `json:"is_direct"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-createroom
+type invite3PID struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
 }
 
 const (
@@ -63,6 +74,11 @@ const (
 	// historyVisibilityInvited       = "invited"
 )
 
+const (
+	guestAccessCanJoin   = "can_join"
+	guestAccessForbidden = "forbidden"
+)
+
 func (r createRoomRequest) Validate() *util.JSONResponse {
 	whitespace := "\t\n\x0b\x0c\r " // https://docs.python.org/2/library/string.html#string.whitespace
 	// https://github.com/matrix-org/synapse/blob/v0.19.2/synapse/handlers/room.py#L81
@@ -86,6 +102,14 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	for _, invite := range r.Invite3PID {
+		if invite.IDServer == "" || invite.Medium == "" || invite.Address == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("invite_3pid entries must all have 'id_server', 'medium' and 'address'"),
+			}
+		}
+	}
 	switch r.Preset {
 	case presetPrivateChat, presetTrustedPrivateChat, presetPublicChat, "":
 	default:
@@ -94,6 +118,37 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			JSON: jsonerror.BadJSON("preset must be any of 'private_chat', 'trusted_private_chat', 'public_chat'"),
 		}
 	}
+	for i, e := range r.InitialState {
+		if e.Type == "" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("initial_state[%d] must have a type", i)),
+			}
+		}
+		// The create event and the creator's membership are always generated
+		// by us, so they can't be supplied as initial state.
+		if e.Type == gomatrixserverlib.MRoomCreate || e.Type == gomatrixserverlib.MRoomMember {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("initial_state cannot contain %s events", e.Type)),
+			}
+		}
+		if _, ok := e.Content.(map[string]interface{}); !ok {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("initial_state[%d] content must be a JSON object", i)),
+			}
+		}
+	}
+	if len(r.PowerLevelContentOverride) > 0 {
+		var override map[string]json.RawMessage
+		if err := json.Unmarshal(r.PowerLevelContentOverride, &override); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("power_level_content_override must be a JSON object"),
+			}
+		}
+	}
 
 	// Validate creation_content fields defined in the spec by marshalling the
 	// creation_content map into bytes and then unmarshalling the bytes into
@@ -132,6 +187,25 @@ type fledglingEvent struct {
 	Content  interface{} `json:"content"`
 }
 
+// lastInitialState drops the initial_state entries which are followed by
+// another with the same type and state key, so that the last one wins, and
+// returns the index in initial_state of each entry that is kept.
+func lastInitialState(initialState []fledglingEvent) ([]fledglingEvent, []int) {
+	last := make(map[gomatrixserverlib.StateKeyTuple]int, len(initialState))
+	for i, e := range initialState {
+		last[gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: e.StateKey}] = i
+	}
+	events := make([]fledglingEvent, 0, len(last))
+	indices := make([]int, 0, len(last))
+	for i, e := range initialState {
+		if last[gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: e.StateKey}] == i {
+			events = append(events, e)
+			indices = append(indices, i)
+		}
+	}
+	return events, indices
+}
+
 // CreateRoom implements /createRoom
 func CreateRoom(
 	req *http.Request, device *api.Device,
@@ -166,6 +240,10 @@ func createRoom(
 		return *resErr
 	}
 
+	if resErr = checkRoomLimits(req.Context(), cfg, rsAPI, userID, ""); resErr != nil {
+		return *resErr
+	}
+
 	evTime, err := httputil.ParseTSParam(req)
 	if err != nil {
 		return util.JSONResponse{
@@ -195,7 +273,6 @@ func createRoom(
 	}
 	r.CreationContent["room_version"] = roomVersion
 
-	// TODO: visibility/presets/raw initial state
 	// TODO: Create room alias association
 	// Make sure this doesn't fall into an application service's namespace though!
 
@@ -226,7 +303,10 @@ func createRoom(
 			return jsonerror.InternalServerError()
 		}
 		if aliasResp.RoomID != "" {
-			return util.MessageResponse(400, "Alias already exists")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Alias already exists"),
+			}
 		}
 	}
 
@@ -236,41 +316,78 @@ func createRoom(
 		AvatarURL:   profile.AvatarURL,
 	}
 
-	var joinRules, historyVisibility string
+	if r.Preset == "" {
+		// The spec says that the preset defaults to public_chat for public
+		// rooms and private_chat otherwise.
+		if r.Visibility == "public" {
+			r.Preset = presetPublicChat
+		} else {
+			r.Preset = presetPrivateChat
+		}
+	}
+
+	// The power levels are the defaults from the spec, then the defaults
+	// configured for this server, then power_level_content_override.
+	powerLevelContent := eventutil.InitialPowerLevelsContent(userID)
+	cfg.DefaultPowerLevels.Apply(&powerLevelContent)
+	var joinRules, historyVisibility, guestAccess string
 	switch r.Preset {
 	case presetPrivateChat:
 		joinRules = gomatrixserverlib.Invite
 		historyVisibility = historyVisibilityShared
+		guestAccess = guestAccessCanJoin
 	case presetTrustedPrivateChat:
 		joinRules = gomatrixserverlib.Invite
 		historyVisibility = historyVisibilityShared
-		// TODO If trusted_private_chat, all invitees are given the same power level as the room creator.
+		guestAccess = guestAccessCanJoin
+		// All invitees are given the same power level as the room creator.
+		for _, invitee := range r.Invite {
+			powerLevelContent.Users[invitee] = powerLevelContent.Users[userID]
+		}
 	case presetPublicChat:
 		joinRules = gomatrixserverlib.Public
 		historyVisibility = historyVisibilityShared
-	default:
-		// Default room rules, r.Preset was previously checked for valid values so
-		// only a request with no preset should end up here.
-		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+		guestAccess = guestAccessForbidden
+	}
+	if r.GuestCanJoin {
+		guestAccess = guestAccessCanJoin
 	}
 
-	var builtEvents []gomatrixserverlib.HeaderedEvent
+	var powerLevels interface{} = powerLevelContent
+	if len(r.PowerLevelContentOverride) > 0 {
+		// Overlay the top-level keys of the override onto the generated
+		// power levels. Validate has already checked it is a JSON object.
+		powerLevels, err = overridePowerLevels(powerLevelContent, r.PowerLevelContentOverride)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("overridePowerLevels failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Events given in initial_state take precedence over the ones that the
+	// preset would otherwise generate.
+	inInitialState := func(eventType string) bool {
+		for _, e := range r.InitialState {
+			if e.Type == eventType && e.StateKey == "" {
+				return true
+			}
+		}
+		return false
+	}
 
 	// send events into the room in order of:
 	//  1- m.room.create
 	//  2- room creator join member
-	//  3- m.room.power_levels
-	//  4- m.room.join_rules
-	//  5- m.room.history_visibility
+	//  3- m.room.power_levels (unless in initial_state)
+	//  4- m.room.join_rules (unless in initial_state)
+	//  5- m.room.history_visibility (unless in initial_state)
 	//  6- m.room.canonical_alias (opt)
-	//  7- m.room.guest_access (opt)
-	//  8- other initial state items
+	//  7- m.room.guest_access (unless in initial_state)
+	//  8- other initial state items, in the order given
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
-	//  11- invite events (opt) - with is_direct flag if applicable TODO
-	//  12- 3pid invite events (opt) TODO
-	//  13- m.room.aliases event for HS (if alias specified) TODO
+	// followed by invites and 3pid invites once the room exists. The aliases
+	// event for this server is handled by roomserver.SetRoomAlias.
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
@@ -278,9 +395,15 @@ func createRoom(
 	eventsToMake := []fledglingEvent{
 		{"m.room.create", "", r.CreationContent},
 		{"m.room.member", userID, membershipContent},
-		{"m.room.power_levels", "", eventutil.InitialPowerLevelsContent(userID)},
-		{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}},
-		{"m.room.history_visibility", "", eventutil.HistoryVisibilityContent{HistoryVisibility: historyVisibility}},
+	}
+	if !inInitialState(gomatrixserverlib.MRoomPowerLevels) {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.power_levels", "", powerLevels})
+	}
+	if !inInitialState(gomatrixserverlib.MRoomJoinRules) {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.join_rules", "", gomatrixserverlib.JoinRuleContent{JoinRule: joinRules}})
+	}
+	if !inInitialState(gomatrixserverlib.MRoomHistoryVisibility) {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.history_visibility", "", eventutil.HistoryVisibilityContent{HistoryVisibility: historyVisibility}})
 	}
 	if roomAlias != "" {
 		// TODO: bit of a chicken and egg problem here as the alias doesn't exist and cannot until we have made the room.
@@ -288,19 +411,36 @@ func createRoom(
 		// m.room.aliases is handled when we call roomserver.SetRoomAlias
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.canonical_alias", "", eventutil.CanonicalAlias{Alias: roomAlias}})
 	}
-	if r.GuestCanJoin {
-		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", eventutil.GuestAccessContent{GuestAccess: "can_join"}})
+	if !inInitialState("m.room.guest_access") {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.guest_access", "", eventutil.GuestAccessContent{GuestAccess: guestAccess}})
 	}
-	eventsToMake = append(eventsToMake, r.InitialState...)
+	initialState, initialStateIndices := lastInitialState(r.InitialState)
+	initialStateStart := len(eventsToMake)
+	eventsToMake = append(eventsToMake, initialState...)
 	if r.Name != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.name", "", eventutil.NameContent{Name: r.Name}})
 	}
 	if r.Topic != "" {
 		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", eventutil.TopicContent{Topic: r.Topic}})
 	}
-	// TODO: invite events
-	// TODO: 3pid invite events
 
+	// describe names an event in error messages, pointing at the entry in
+	// initial_state that it came from if there is one.
+	describe := func(i int) string {
+		e := eventsToMake[i]
+		if i >= initialStateStart && i < initialStateStart+len(initialState) {
+			return fmt.Sprintf("initial_state[%d] (%s with state key %q)", initialStateIndices[i-initialStateStart], e.Type, e.StateKey)
+		}
+		return fmt.Sprintf("Initial %s event", e.Type)
+	}
+
+	// Build and auth all of the events before sending any of them, so that a
+	// request which would produce an invalid room doesn't create anything.
+	// Each event is authed against the state proposed by the events before
+	// it, so initial_state can rely on e.g. power levels set earlier on.
+	var builtEvents []gomatrixserverlib.HeaderedEvent
+	inputs := make([]roomserverAPI.InputRoomEvent, 0, len(eventsToMake))
+	stateIDs := map[gomatrixserverlib.StateKeyTuple]string{}
 	authEvents := gomatrixserverlib.NewAuthEvents(nil)
 	for i, e := range eventsToMake {
 		depth := i + 1 // depth starts at 1
@@ -327,34 +467,46 @@ func createRoom(
 			return jsonerror.InternalServerError()
 		}
 
+		if err = eventutil.CheckEventSize(ev.JSON(), cfg.Matrix.MaxEventFieldLengths); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge(fmt.Sprintf("%s is too large: %s", describe(i), err)),
+			}
+		}
 		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.Allowed failed")
-			return jsonerror.InternalServerError()
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON(fmt.Sprintf("%s is not allowed: %s", describe(i), err)),
+			}
 		}
 
-		// Add the event to the list of auth events
+		stateEventIDs := make([]string, 0, len(stateIDs))
+		for _, id := range stateIDs {
+			stateEventIDs = append(stateEventIDs, id)
+		}
+		inputs = append(inputs, roomserverAPI.InputRoomEvent{
+			Kind:          roomserverAPI.KindNew,
+			Event:         ev.Headered(roomVersion),
+			AuthEventIDs:  ev.AuthEventIDs(),
+			HasState:      true,
+			StateEventIDs: stateEventIDs,
+		})
+
+		// Add the event to the list of auth events and to the room state
 		builtEvents = append(builtEvents, (*ev).Headered(roomVersion))
+		stateIDs[gomatrixserverlib.StateKeyTuple{EventType: e.Type, StateKey: e.StateKey}] = ev.EventID()
 		err = authEvents.AddEvent(ev)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("authEvents.AddEvent failed")
 			return jsonerror.InternalServerError()
 		}
+	}
 
-		accumulated := gomatrixserverlib.UnwrapEventHeaders(builtEvents)
-		if err = roomserverAPI.SendEventWithState(
-			req.Context(),
-			rsAPI,
-			roomserverAPI.KindNew,
-			&gomatrixserverlib.RespState{
-				StateEvents: accumulated,
-				AuthEvents:  accumulated,
-			},
-			ev.Headered(roomVersion),
-			nil,
-		); err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("SendEventWithState failed")
-			return jsonerror.InternalServerError()
-		}
+	// Send the whole initial state to the roomserver as a single batch, which
+	// is processed in order.
+	if err = roomserverAPI.SendInputRoomEventsBatch(req.Context(), rsAPI, inputs); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("SendInputRoomEventsBatch failed")
+		return jsonerror.InternalServerError()
 	}
 
 	// TODO(#269): Reserve room alias while we create the room. This stops us
@@ -375,7 +527,10 @@ func createRoom(
 		}
 
 		if aliasResp.AliasExists {
-			return util.MessageResponse(400, "Alias already exists")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.RoomInUse("Alias already exists"),
+			}
 		}
 	}
 
@@ -407,7 +562,7 @@ func createRoom(
 			// Build the invite event.
 			inviteEvent, err := buildMembershipEvent(
 				req.Context(), invitee, "", accountDB, device, gomatrixserverlib.Invite,
-				roomID, true, cfg, evTime, rsAPI, asAPI,
+				roomID, r.IsDirect, cfg, evTime, rsAPI, asAPI,
 			)
 			if err != nil {
 				util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
@@ -440,6 +595,43 @@ func createRoom(
 		}
 	}
 
+	// Process the third party invites. If the identity server knows the Matrix
+	// ID for the address then the user is invited as normal, otherwise an
+	// m.room.third_party_invite event is sent into the room. The first invite
+	// that can't be processed fails the request, in the same way as it would
+	// for a single invite sent to /invite.
+	for _, invite := range r.Invite3PID {
+		body := threepid.MembershipRequest{
+			IDServer: invite.IDServer,
+			Medium:   invite.Medium,
+			Address:  invite.Address,
+		}
+		if _, errRes := checkAndProcessThreepid(
+			req, device, &body, cfg, rsAPI, accountDB, roomID, evTime,
+		); errRes != nil {
+			return *errRes
+		}
+		if body.UserID == "" {
+			continue
+		}
+		inviteEvent, err := buildMembershipEvent(
+			req.Context(), body.UserID, "", accountDB, device, gomatrixserverlib.Invite,
+			roomID, r.IsDirect, cfg, evTime, rsAPI, asAPI,
+		)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("buildMembershipEvent failed")
+			return jsonerror.InternalServerError()
+		}
+		if err = roomserverAPI.SendEvents(
+			req.Context(), rsAPI, roomserverAPI.KindNew,
+			[]gomatrixserverlib.HeaderedEvent{inviteEvent.Headered(roomVersion)},
+			cfg.Matrix.ServerName, nil,
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.SendEvents failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	if r.Visibility == "public" {
 		// expose this room in the published room list
 		var pubRes roomserverAPI.PerformPublishResponse
@@ -464,6 +656,29 @@ func createRoom(
 	}
 }
 
+// overridePowerLevels replaces the top-level keys of the generated power
+// levels with those given in power_level_content_override.
+func overridePowerLevels(
+	content gomatrixserverlib.PowerLevelContent, override json.RawMessage,
+) (map[string]json.RawMessage, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var merged map[string]json.RawMessage
+	if err = json.Unmarshal(contentJSON, &merged); err != nil {
+		return nil, err
+	}
+	var overrides map[string]json.RawMessage
+	if err = json.Unmarshal(override, &overrides); err != nil {
+		return nil, err
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
 // buildEvent fills out auth_events for the builder then builds the event
 func buildEvent(
 	builder *gomatrixserverlib.EventBuilder,
@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateRoomAllowsDuplicateInitialState(t *testing.T) {
+	r := createRoomRequest{
+		InitialState: []fledglingEvent{
+			{"m.room.name", "", map[string]interface{}{"name": "first"}},
+			{"m.room.name", "", map[string]interface{}{"name": "second"}},
+		},
+	}
+	if res := r.Validate(); res != nil {
+		t.Fatalf("expected duplicate initial_state entries to be allowed, got %+v", res.JSON)
+	}
+}
+
+func TestLastInitialStateWins(t *testing.T) {
+	initialState := []fledglingEvent{
+		{"m.room.name", "", map[string]interface{}{"name": "first"}},
+		{"m.room.topic", "", map[string]interface{}{"topic": "topic"}},
+		{"m.room.name", "", map[string]interface{}{"name": "second"}},
+		{"org.example.custom", "a", map[string]interface{}{}},
+		{"org.example.custom", "b", map[string]interface{}{}},
+	}
+	events, indices := lastInitialState(initialState)
+	wantEvents := []fledglingEvent{initialState[1], initialState[2], initialState[3], initialState[4]}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("got initial state %+v, want %+v", events, wantEvents)
+	}
+	if wantIndices := []int{1, 2, 3, 4}; !reflect.DeepEqual(indices, wantIndices) {
+		t.Errorf("got indices %v, want %v", indices, wantIndices)
+	}
+}
@@ -15,11 +15,14 @@
 package routing
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -267,10 +270,10 @@ func GetVisibility(
 }
 
 // SetVisibility implements PUT /directory/list/room/{roomID}
-// TODO: Allow admin users to edit the room visibility
+// Server admins can publish rooms regardless of permissions using SetVisibilityAsAdmin.
 func SetVisibility(
 	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, dev *userapi.Device,
-	roomID string,
+	roomID string, cfg *config.ClientAPI,
 ) util.JSONResponse {
 	resErr := checkMemberInRoom(req.Context(), rsAPI, dev.UserID, roomID)
 	if resErr != nil {
@@ -305,10 +308,116 @@ func SetVisibility(
 		return *reqErr
 	}
 
+	if v.Visibility == gomatrixserverlib.Public {
+		if !cfg.RoomDirectory.PublishAllowedForAll {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Only server admins can publish rooms to the room directory"),
+			}
+		}
+		if resErr = checkJoinRuleAllowedInDirectory(req, rsAPI, roomID, cfg); resErr != nil {
+			return *resErr
+		}
+	}
+
+	return publishRoom(req, rsAPI, roomID, "", dev.UserID, v.Visibility)
+}
+
+// SetVisibilityAsAdmin implements the admin API
+// PUT /_dendrite/admin/v1/directory/list/room/{roomID}. Unlike SetVisibility
+// there are no permission checks.
+func SetVisibilityAsAdmin(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	return setVisibilityInNetwork(req, rsAPI, roomID, "", "")
+}
+
+// SetVisibilityAsAppService implements
+// PUT /directory/list/appservice/{networkID}/{roomID}, which application
+// services use to publish rooms in the directories of their third party
+// networks. The request must be made with the as_token of an application
+// service, which is recorded as the publisher of the room.
+func SetVisibilityAsAppService(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, cfg *config.ClientAPI,
+	roomID, networkID string,
+) util.JSONResponse {
+	token, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		if appservice.ASToken == token {
+			userID := userutil.MakeUserID(appservice.SenderLocalpart, cfg.Matrix.ServerName)
+			return setVisibilityInNetwork(req, rsAPI, roomID, networkID, userID)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("Only application services can publish rooms in third party network directories"),
+	}
+}
+
+// setVisibilityInNetwork publishes or unpublishes the room in the directory
+// of the given third party network, or the server's own directory if the
+// network ID is empty, without any permission checks.
+func setVisibilityInNetwork(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID, networkID, userID string,
+) util.JSONResponse {
+	var verRes roomserverAPI.QueryRoomVersionForRoomResponse
+	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &roomserverAPI.QueryRoomVersionForRoomRequest{
+		RoomID: roomID,
+	}, &verRes); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+
+	var v roomVisibility
+	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
+		return *reqErr
+	}
+
+	return publishRoom(req, rsAPI, roomID, networkID, userID, v.Visibility)
+}
+
+// GetPublications implements GET /_dendrite/admin/v1/directory/publications,
+// returning who published which rooms, most recent first.
+func GetPublications(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var queryRes roomserverAPI.QueryPublishedRoomsResponse
+	if err := rsAPI.QueryPublishedRooms(req.Context(), &roomserverAPI.QueryPublishedRoomsRequest{
+		IncludePublications: true,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("QueryPublishedRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.Publications == nil {
+		queryRes.Publications = []roomserverAPI.Publication{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Publications []roomserverAPI.Publication `json:"publications"`
+		}{queryRes.Publications},
+	}
+}
+
+func publishRoom(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID, networkID, userID, visibility string,
+) util.JSONResponse {
 	var publishRes roomserverAPI.PerformPublishResponse
 	rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
 		RoomID:     roomID,
-		Visibility: v.Visibility,
+		Visibility: visibility,
+		NetworkID:  networkID,
+		UserID:     userID,
 	}, &publishRes)
 	if publishRes.Error != nil {
 		util.GetLogger(req.Context()).WithError(publishRes.Error).Error("PerformPublish failed")
@@ -320,3 +429,36 @@ func SetVisibility(
 		JSON: struct{}{},
 	}
 }
+
+// checkJoinRuleAllowedInDirectory returns an error response if the join rule
+// of the room is one which the config blocks from the room directory.
+func checkJoinRuleAllowedInDirectory(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID string, cfg *config.ClientAPI,
+) *util.JSONResponse {
+	if len(cfg.RoomDirectory.BlockedJoinRules) == 0 {
+		return nil
+	}
+	joinRule := gomatrixserverlib.Invite
+	if ev := roomserverAPI.GetStateEvent(req.Context(), rsAPI, roomID, gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomJoinRules,
+		StateKey:  "",
+	}); ev != nil {
+		var content gomatrixserverlib.JoinRuleContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal join rules")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		joinRule = content.JoinRule
+	}
+	for _, blocked := range cfg.RoomDirectory.BlockedJoinRules {
+		if joinRule == blocked {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("Rooms with the %q join rule can't be published to the room directory", joinRule)),
+			}
+		}
+	}
+	return nil
+}
@@ -33,15 +33,32 @@ import (
 )
 
 var (
-	cacheMu          sync.Mutex
-	publicRoomsCache []gomatrixserverlib.PublicRoom
+	cacheMu sync.Mutex
+	// The public rooms of each room directory that has been requested.
+	publicRoomsCache = map[directoryKey][]gomatrixserverlib.PublicRoom{}
 )
 
+// directoryKey identifies a room directory: the server's own directory, the
+// directory of a third party network, or all of them together.
+type directoryKey struct {
+	networkID   string
+	allNetworks bool
+}
+
 type PublicRoomReq struct {
-	Since  string `json:"since,omitempty"`
-	Limit  int16  `json:"limit,omitempty"`
-	Filter filter `json:"filter,omitempty"`
-	Server string `json:"server,omitempty"`
+	Since                string `json:"since,omitempty"`
+	Limit                int16  `json:"limit,omitempty"`
+	Filter               filter `json:"filter,omitempty"`
+	Server               string `json:"server,omitempty"`
+	IncludeAllNetworks   bool   `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string `json:"third_party_instance_id,omitempty"`
+}
+
+func (r *PublicRoomReq) directory() directoryKey {
+	return directoryKey{
+		networkID:   r.ThirdPartyInstanceID,
+		allNetworks: r.IncludeAllNetworks,
+	}
 }
 
 type filter struct {
@@ -63,11 +80,22 @@ func GetPostPublicRooms(
 	serverName := gomatrixserverlib.ServerName(request.Server)
 
 	if serverName != "" && serverName != cfg.Matrix.ServerName {
-		res, err := federation.GetPublicRooms(req.Context(), serverName, int(request.Limit), request.Since, false, "")
+		// Pagination tokens are passed through untouched, as they belong to the
+		// remote server.
+		res, err := federation.GetPublicRooms(
+			req.Context(), serverName, int(request.Limit), request.Since,
+			request.IncludeAllNetworks, request.ThirdPartyInstanceID,
+		)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("failed to get public rooms")
-			return jsonerror.InternalServerError()
+			util.GetLogger(req.Context()).WithError(err).WithField("server", serverName).Error("failed to get public rooms")
+			return util.JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: jsonerror.Unknown("Failed to fetch the public rooms of " + string(serverName)),
+			}
 		}
+		// The filter can't be sent over federation, so apply it to the page
+		// of rooms that the remote server returned instead.
+		res.Chunk = filterRooms(res.Chunk, request.Filter.SearchTerms)
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: res,
@@ -98,6 +126,10 @@ func publicRooms(
 	if limit == 0 {
 		limit = 50
 	}
+	// strip the 'T' which is only required because when sytest does pagination tests it stops
+	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
+	// make it truthy not falsey.
+	request.Since = strings.TrimPrefix(request.Since, "T")
 	offset, err := strconv.ParseInt(request.Since, 10, 64)
 	// ParseInt returns 0 and an error when trying to parse an empty string
 	// In that case, we want to assign 0 so we ignore the error
@@ -109,9 +141,9 @@ func publicRooms(
 
 	var rooms []gomatrixserverlib.PublicRoom
 	if request.Since == "" {
-		rooms = refreshPublicRoomCache(ctx, rsAPI, extRoomsProvider)
+		rooms = refreshPublicRoomCache(ctx, request.directory(), rsAPI, extRoomsProvider)
 	} else {
-		rooms = getPublicRoomsFromCache()
+		rooms = getPublicRoomsFromCache(request.directory())
 	}
 
 	response.TotalRoomCountEstimate = len(rooms)
@@ -174,6 +206,8 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
 		request.Server = httpReq.FormValue("server")
+		request.IncludeAllNetworks = httpReq.FormValue("include_all_networks") == "true"
+		request.ThirdPartyInstanceID = httpReq.FormValue("third_party_instance_id")
 	} else {
 		resErr := httputil.UnmarshalJSONRequest(httpReq, request)
 		if resErr != nil {
@@ -181,11 +215,12 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		}
 		request.Server = httpReq.FormValue("server")
 	}
-
-	// strip the 'T' which is only required because when sytest does pagination tests it stops
-	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
-	// make it truthy not falsey.
-	request.Since = strings.TrimPrefix(request.Since, "T")
+	if request.IncludeAllNetworks && request.ThirdPartyInstanceID != "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("include_all_networks can't be used with third_party_instance_id"),
+		}
+	}
 	return nil
 }
 
@@ -224,42 +259,48 @@ func sliceInto(slice []gomatrixserverlib.PublicRoom, since int64, limit int16) (
 }
 
 func refreshPublicRoomCache(
-	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
+	ctx context.Context, directory directoryKey,
+	rsAPI roomserverAPI.RoomserverInternalAPI, extRoomsProvider api.ExtraPublicRoomsProvider,
 ) []gomatrixserverlib.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
+	// The extra rooms aren't in any third party network.
 	var extraRooms []gomatrixserverlib.PublicRoom
-	if extRoomsProvider != nil {
+	if extRoomsProvider != nil && directory.networkID == "" {
 		extraRooms = extRoomsProvider.Rooms()
 	}
 
 	var queryRes roomserverAPI.QueryPublishedRoomsResponse
-	err := rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{}, &queryRes)
+	err := rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{
+		NetworkID:          directory.networkID,
+		IncludeAllNetworks: directory.allNetworks,
+	}, &queryRes)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
-		return publicRoomsCache
+		return publicRoomsCache[directory]
 	}
 	pubRooms, err := roomserverAPI.PopulatePublicRooms(ctx, queryRes.RoomIDs, rsAPI)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
-		return publicRoomsCache
+		return publicRoomsCache[directory]
 	}
-	publicRoomsCache = []gomatrixserverlib.PublicRoom{}
-	publicRoomsCache = append(publicRoomsCache, pubRooms...)
-	publicRoomsCache = append(publicRoomsCache, extraRooms...)
-	publicRoomsCache = dedupeAndShuffle(publicRoomsCache)
+	rooms := []gomatrixserverlib.PublicRoom{}
+	rooms = append(rooms, pubRooms...)
+	rooms = append(rooms, extraRooms...)
+	rooms = dedupeAndShuffle(rooms)
 
 	// sort by total joined member count (big to small)
-	sort.SliceStable(publicRoomsCache, func(i, j int) bool {
-		return publicRoomsCache[i].JoinedMembersCount > publicRoomsCache[j].JoinedMembersCount
+	sort.SliceStable(rooms, func(i, j int) bool {
+		return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
 	})
-	return publicRoomsCache
+	publicRoomsCache[directory] = rooms
+	return rooms
 }
 
-func getPublicRoomsFromCache() []gomatrixserverlib.PublicRoom {
+func getPublicRoomsFromCache(directory directoryKey) []gomatrixserverlib.PublicRoom {
 	cacheMu.Lock()
 	defer cacheMu.Unlock()
-	return publicRoomsCache
+	return publicRoomsCache[directory]
 }
 
 func dedupeAndShuffle(in []gomatrixserverlib.PublicRoom) []gomatrixserverlib.PublicRoom {
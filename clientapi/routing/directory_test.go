@@ -0,0 +1,146 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type directoryRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	published []roomserverAPI.PerformPublishRequest
+	queried   []roomserverAPI.QueryPublishedRoomsRequest
+	networks  map[string][]string
+}
+
+func (r *directoryRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	return nil
+}
+
+func (r *directoryRoomserverAPI) PerformPublish(
+	ctx context.Context, req *roomserverAPI.PerformPublishRequest, res *roomserverAPI.PerformPublishResponse,
+) {
+	r.published = append(r.published, *req)
+}
+
+func (r *directoryRoomserverAPI) QueryPublishedRooms(
+	ctx context.Context, req *roomserverAPI.QueryPublishedRoomsRequest, res *roomserverAPI.QueryPublishedRoomsResponse,
+) error {
+	r.queried = append(r.queried, *req)
+	res.RoomIDs = r.networks[req.NetworkID]
+	return nil
+}
+
+func (r *directoryRoomserverAPI) QueryBulkStateContent(
+	ctx context.Context, req *roomserverAPI.QueryBulkStateContentRequest, res *roomserverAPI.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = make(map[string]map[gomatrixserverlib.StateKeyTuple]string)
+	for _, roomID := range req.RoomIDs {
+		res.Rooms[roomID] = map[gomatrixserverlib.StateKeyTuple]string{}
+	}
+	return nil
+}
+
+func TestSetVisibilityAsAppService(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "test"},
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{
+				{ID: "irc", ASToken: "as_token", SenderLocalpart: "ircbot"},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"user token", "user_token", http.StatusForbidden},
+		{"appservice token", "as_token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rsAPI := &directoryRoomserverAPI{}
+		req := httptest.NewRequest(http.MethodPut, "/directory/list/appservice/irc/!room:test", strings.NewReader(`{"visibility":"public"}`))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		res := SetVisibilityAsAppService(req, rsAPI, cfg, "!room:test", "irc")
+		if res.Code != tt.wantCode {
+			t.Errorf("%s: expected code %d, got %d", tt.name, tt.wantCode, res.Code)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			if len(rsAPI.published) != 0 {
+				t.Errorf("%s: expected the room not to be published", tt.name)
+			}
+			continue
+		}
+		want := roomserverAPI.PerformPublishRequest{
+			RoomID:     "!room:test",
+			Visibility: "public",
+			NetworkID:  "irc",
+			UserID:     "@ircbot:test",
+		}
+		if len(rsAPI.published) != 1 || rsAPI.published[0] != want {
+			t.Errorf("%s: expected publish request %+v, got %+v", tt.name, want, rsAPI.published)
+		}
+	}
+}
+
+func TestPublicRoomsThirdPartyNetwork(t *testing.T) {
+	rsAPI := &directoryRoomserverAPI{
+		networks: map[string][]string{
+			"":    {"!local:test"},
+			"irc": {"!irc:test"},
+		},
+	}
+	res, err := publicRooms(context.Background(), PublicRoomReq{ThirdPartyInstanceID: "irc"}, rsAPI, nil)
+	if err != nil {
+		t.Fatalf("publicRooms: %s", err)
+	}
+	if len(res.Chunk) != 1 || res.Chunk[0].RoomID != "!irc:test" {
+		t.Errorf("expected only the room in the irc network, got %+v", res.Chunk)
+	}
+	if len(rsAPI.queried) != 1 || rsAPI.queried[0].NetworkID != "irc" {
+		t.Errorf("expected the published rooms to be queried for the irc network, got %+v", rsAPI.queried)
+	}
+
+	// The network's rooms must not be served from the cache of the server's
+	// own directory.
+	res, err = publicRooms(context.Background(), PublicRoomReq{Since: "T0"}, rsAPI, nil)
+	if err != nil {
+		t.Fatalf("publicRooms: %s", err)
+	}
+	for _, room := range res.Chunk {
+		if room.RoomID == "!irc:test" {
+			t.Errorf("room in the irc network was returned for the server's own directory")
+		}
+	}
+}
+
+func TestPublicRoomsNetworkParams(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/publicRooms?include_all_networks=true&third_party_instance_id=irc", nil)
+	var request PublicRoomReq
+	if res := fillPublicRoomsReq(req, &request); res == nil || res.Code != http.StatusBadRequest {
+		t.Errorf("expected include_all_networks with third_party_instance_id to be rejected")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/publicRooms?third_party_instance_id=irc", nil)
+	request = PublicRoomReq{}
+	if res := fillPublicRoomsReq(req, &request); res != nil {
+		t.Fatalf("expected request to be accepted, got %+v", res)
+	}
+	if request.ThirdPartyInstanceID != "irc" || request.IncludeAllNetworks {
+		t.Errorf("network parameters weren't parsed, got %+v", request)
+	}
+}
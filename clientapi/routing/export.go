@@ -0,0 +1,289 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// exportEventsPageSize is the number of room events that are requested
+// from the roomserver at a time when exporting sent events.
+const exportEventsPageSize = 500
+
+// exportMemberships are the memberships for which rooms are included in
+// an account export.
+var exportMemberships = []string{
+	gomatrixserverlib.Join, gomatrixserverlib.Invite,
+	gomatrixserverlib.Leave, gomatrixserverlib.Ban,
+}
+
+type exportProfile struct {
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+type exportAccountData struct {
+	Global map[string]json.RawMessage            `json:"global"`
+	Rooms  map[string]map[string]json.RawMessage `json:"rooms"`
+}
+
+// exportDevice deliberately leaves out the access token of the device.
+type exportDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	// The signed device keys, so that cross-signing signatures survive
+	DeviceKeys json.RawMessage `json:"device_keys,omitempty"`
+}
+
+type exportCrossSigningKeys struct {
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+	UserSigningKey json.RawMessage `json:"user_signing_key,omitempty"`
+}
+
+// exportWriter writes the export document to the response incrementally,
+// flushing as it goes so that large exports are not buffered in memory.
+// After the first error all further writes are skipped.
+type exportWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	err     error
+}
+
+func (e *exportWriter) raw(s string) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write([]byte(s))
+}
+
+func (e *exportWriter) value(v interface{}) {
+	if e.err != nil {
+		return
+	}
+	var b []byte
+	if b, e.err = json.Marshal(v); e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *exportWriter) field(name string, v interface{}) {
+	e.value(name)
+	e.raw(":")
+	e.value(v)
+}
+
+func (e *exportWriter) flush() {
+	if e.err == nil && e.flusher != nil {
+		e.flusher.Flush()
+	}
+}
+
+// ExportAccount implements GET /unstable/org.matrix.dendrite/export and the
+// equivalent admin endpoint. It streams a JSON document containing the profile,
+// account data, devices and their keys, cross-signing keys, room memberships
+// and sent events of the given local
+// user. Errors are only reported as a JSON response if nothing has been written
+// yet, otherwise the stream is cut short and the error is logged.
+func ExportAccount(
+	w http.ResponseWriter, req *http.Request, userID string,
+	cfg *config.ClientAPI,
+	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keyserverAPI keyAPI.KeyInternalAPI,
+) *util.JSONResponse {
+	ctx := req.Context()
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be exported"),
+		}
+	}
+
+	var profileRes userapi.QueryProfileResponse
+	if err = userAPI.QueryProfile(ctx, &userapi.QueryProfileRequest{UserID: userID}, &profileRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryProfile failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !profileRes.UserExists {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist"),
+		}
+	}
+
+	var dataRes userapi.QueryAccountDataResponse
+	if err = userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{UserID: userID}, &dataRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	var devicesRes userapi.QueryDevicesResponse
+	if err = userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{UserID: userID}, &devicesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryDevices failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	// query the keys as the user themselves, so that the user-signing key
+	// is included
+	var keysRes keyAPI.QueryKeysResponse
+	keyserverAPI.QueryKeys(ctx, &keyAPI.QueryKeysRequest{
+		UserID:        userID,
+		UserToDevices: map[string][]string{userID: {}},
+	}, &keysRes)
+	if keysRes.Error != nil {
+		util.GetLogger(ctx).WithError(keysRes.Error).Error("keyAPI.QueryKeys failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	devices := make([]exportDevice, 0, len(devicesRes.Devices))
+	for _, dev := range devicesRes.Devices {
+		devices = append(devices, exportDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenTS:  dev.LastSeenTS,
+			LastSeenIP:  dev.LastSeenIP,
+			UserAgent:   dev.UserAgent,
+			DeviceKeys:  keysRes.DeviceKeys[userID][dev.ID],
+		})
+	}
+
+	memberships := make(map[string][]string, len(exportMemberships))
+	for _, membership := range exportMemberships {
+		var roomsRes roomserverAPI.QueryRoomsForUserResponse
+		if err = rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+			UserID:         userID,
+			WantMembership: membership,
+		}, &roomsRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		memberships[membership] = roomsRes.RoomIDs
+		if memberships[membership] == nil {
+			memberships[membership] = []string{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", userID+".json"))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	ew := &exportWriter{w: w, flusher: flusher}
+	ew.raw("{")
+	ew.field("user_id", userID)
+	ew.raw(",")
+	ew.field("profile", exportProfile{
+		DisplayName: profileRes.DisplayName,
+		AvatarURL:   profileRes.AvatarURL,
+	})
+	ew.raw(",")
+	ew.field("account_data", exportAccountData{
+		Global: dataRes.GlobalAccountData,
+		Rooms:  dataRes.RoomAccountData,
+	})
+	ew.raw(",")
+	ew.field("devices", devices)
+	ew.raw(",")
+	ew.field("cross_signing_keys", exportCrossSigningKeys{
+		MasterKey:      keysRes.MasterKeys[userID],
+		SelfSigningKey: keysRes.SelfSigningKeys[userID],
+		UserSigningKey: keysRes.UserSigningKeys[userID],
+	})
+	ew.raw(",")
+	ew.field("rooms", memberships)
+	ew.raw(`,"events":[`)
+	ew.flush()
+
+	first := true
+	for _, membership := range exportMemberships {
+		for _, roomID := range memberships[membership] {
+			if err = exportRoomEvents(ctx, ew, rsAPI, roomID, userID, &first); err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to export room events")
+				return nil
+			}
+		}
+	}
+	ew.raw("]}")
+	ew.flush()
+
+	if ew.err != nil {
+		util.GetLogger(ctx).WithError(ew.err).Error("Failed to write account export")
+	}
+	return nil
+}
+
+// exportRoomEvents pages through the events in the given room, writing out
+// each event that was sent by the given user.
+func exportRoomEvents(
+	ctx context.Context, ew *exportWriter,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID, userID string, first *bool,
+) error {
+	var from int64
+	for {
+		var res roomserverAPI.QueryEventsBySenderResponse
+		if err := rsAPI.QueryEventsBySender(ctx, &roomserverAPI.QueryEventsBySenderRequest{
+			RoomID: roomID,
+			Sender: userID,
+			From:   from,
+			Limit:  exportEventsPageSize,
+		}, &res); err != nil {
+			return err
+		}
+		for _, ev := range res.Events {
+			if !*first {
+				ew.raw(",")
+			}
+			*first = false
+			ew.raw(string(ev.Unwrap().JSON()))
+		}
+		ew.flush()
+		if ew.err != nil {
+			return ew.err
+		}
+		if res.Next == 0 {
+			return nil
+		}
+		from = res.Next
+	}
+}
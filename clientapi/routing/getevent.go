@@ -19,6 +19,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -44,6 +45,7 @@ func GetEvent(
 	eventID string,
 	cfg *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
 	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
 	eventsReq := api.QueryEventsByIDRequest{
@@ -56,7 +58,10 @@ func GetEvent(
 		return jsonerror.InternalServerError()
 	}
 
-	if len(eventsResp.Events) == 0 {
+	// Treat an event from a different room the same as a missing event, so
+	// that the room ID in the path can't be used to find out about events in
+	// rooms that the user can't see.
+	if len(eventsResp.Events) == 0 || eventsResp.Events[0].RoomID() != roomID {
 		// Event not found locally
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
@@ -76,47 +81,31 @@ func GetEvent(
 		requestedEvent: requestedEvent,
 	}
 
-	stateReq := api.QueryStateAfterEventsRequest{
-		RoomID:       r.requestedEvent.RoomID(),
-		PrevEventIDs: r.requestedEvent.PrevEventIDs(),
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
-			EventType: gomatrixserverlib.MRoomMember,
-			StateKey:  device.UserID,
-		}},
-	}
-	var stateResp api.QueryStateAfterEventsResponse
-	if err := rsAPI.QueryStateAfterEvents(req.Context(), &stateReq, &stateResp); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryStateAfterEvents failed")
-		return jsonerror.InternalServerError()
-	}
-
-	if !stateResp.RoomExists {
-		util.GetLogger(req.Context()).Errorf("Expected to find room for event %s but failed", r.requestedEvent.EventID())
+	// Only return the event if the user is allowed to see it according to
+	// the history visibility of the room when the event was sent.
+	visible, err := api.FilterVisibleEvents(req.Context(), rsAPI, device.UserID, eventsResp.Events[:1])
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("api.FilterVisibleEvents failed")
 		return jsonerror.InternalServerError()
 	}
-
-	if !stateResp.PrevEventsExist {
-		// Missing some events locally; stateResp.StateEvents unavailable.
-		return util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
-		}
-	}
-
-	for _, stateEvent := range stateResp.StateEvents {
-		if !stateEvent.StateKeyEquals(device.UserID) {
-			continue
+	if len(visible) == 1 {
+		// The original event is returned even if it has been edited, with
+		// the latest edit referenced from its bundled relations.
+		clientEvents := []gomatrixserverlib.ClientEvent{
+			gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
 		}
-		membership, err := stateEvent.Membership()
+		ignoredUsers, err := eventutil.IgnoredUsers(req.Context(), userAPI, device.UserID)
 		if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("stateEvent.Membership failed")
+			util.GetLogger(req.Context()).WithError(err).Error("eventutil.IgnoredUsers failed")
 			return jsonerror.InternalServerError()
 		}
-		if membership == gomatrixserverlib.Join {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
-			}
+		if err = eventutil.BundleAggregations(req.Context(), rsAPI, device.UserID, ignoredUsers, clientEvents); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("eventutil.BundleAggregations failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: clientEvents[0],
 		}
 	}
 
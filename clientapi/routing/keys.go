@@ -19,10 +19,12 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -97,7 +99,7 @@ func (r *queryKeysRequest) GetTimeout() time.Duration {
 	return time.Duration(r.Timeout) * time.Millisecond
 }
 
-func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
+func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
 	var r queryKeysRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
@@ -105,15 +107,141 @@ func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
 	}
 	queryRes := api.QueryKeysResponse{}
 	keyAPI.QueryKeys(req.Context(), &api.QueryKeysRequest{
+		UserID:        device.UserID,
 		UserToDevices: r.DeviceKeys,
 		Timeout:       r.GetTimeout(),
 		// TODO: Token?
 	}, &queryRes)
+	res := map[string]interface{}{
+		"device_keys": queryRes.DeviceKeys,
+		"failures":    queryRes.Failures,
+	}
+	if queryRes.MasterKeys != nil {
+		res["master_keys"] = queryRes.MasterKeys
+	}
+	if queryRes.SelfSigningKeys != nil {
+		res["self_signing_keys"] = queryRes.SelfSigningKeys
+	}
+	if queryRes.UserSigningKeys != nil {
+		res["user_signing_keys"] = queryRes.UserSigningKeys
+	}
 	return util.JSONResponse{
 		Code: 200,
+		JSON: res,
+	}
+}
+
+type uploadCrossSigningKeysRequest struct {
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+	UserSigningKey json.RawMessage `json:"user_signing_key,omitempty"`
+}
+
+// UploadCrossSigningKeys handles POST /keys/device_signing/upload. Replacing
+// cross-signing keys requires user-interactive auth.
+func UploadCrossSigningKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive,
+	keyAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, resErr := httputil.ReadRequestBody(req)
+	if resErr != nil {
+		return *resErr
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot upload another user's cross-signing keys"),
+		}
+	}
+
+	var r uploadCrossSigningKeysRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	uploadReq := &api.PerformUploadCrossSigningKeysRequest{
+		UserID: device.UserID,
+		Keys:   make(map[string]json.RawMessage),
+	}
+	if len(r.MasterKey) > 0 {
+		uploadReq.Keys[api.CrossSigningKeyPurposeMaster] = r.MasterKey
+	}
+	if len(r.SelfSigningKey) > 0 {
+		uploadReq.Keys[api.CrossSigningKeyPurposeSelfSigning] = r.SelfSigningKey
+	}
+	if len(r.UserSigningKey) > 0 {
+		uploadReq.Keys[api.CrossSigningKeyPurposeUserSigning] = r.UserSigningKey
+	}
+
+	var uploadRes api.PerformUploadCrossSigningKeysResponse
+	keyAPI.PerformUploadCrossSigningKeys(ctx, uploadReq, &uploadRes)
+	if keyErr := uploadRes.Error; keyErr != nil {
+		switch {
+		case keyErr.IsInvalidSignature:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidSignature(keyErr.Error()),
+			}
+		case keyErr.IsInvalidParam:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(keyErr.Error()),
+			}
+		}
+		util.GetLogger(ctx).WithError(keyErr).Error("Failed to PerformUploadCrossSigningKeys")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningSignatures handles POST /keys/signatures/upload.
+func UploadCrossSigningSignatures(req *http.Request, keyAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
+	var r map[string]map[string]json.RawMessage
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	var uploadRes api.PerformUploadDeviceSignaturesResponse
+	keyAPI.PerformUploadDeviceSignatures(req.Context(), &api.PerformUploadDeviceSignaturesRequest{
+		UserID:     device.UserID,
+		Signatures: r,
+	}, &uploadRes)
+	if uploadRes.Error != nil {
+		util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("Failed to PerformUploadDeviceSignatures")
+		return jsonerror.InternalServerError()
+	}
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	for userID, keys := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError)
+		for keyID, err := range keys {
+			if err.IsInvalidSignature {
+				failures[userID][keyID] = jsonerror.InvalidSignature(err.Error())
+			} else {
+				failures[userID][keyID] = jsonerror.InvalidParam(err.Error())
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
 		JSON: map[string]interface{}{
-			"device_keys": queryRes.DeviceKeys,
-			"failures":    queryRes.Failures,
+			"failures": failures,
 		},
 	}
 }
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
+	internalHTTPUtil "github.com/matrix-org/dendrite/internal/httputil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -34,6 +35,16 @@ type loginResponse struct {
 	AccessToken string                       `json:"access_token"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id"`
+	// Only set if the client asked for a refresh token (MSC2918).
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// loginRequest is a password login, which may also complete the
+// m.login.terms stage if the user hasn't accepted the server's policies.
+type loginRequest struct {
+	auth.PasswordRequest
+	Auth termsAuth `json:"auth"`
 }
 
 type flows struct {
@@ -56,7 +67,7 @@ func passwordLogin() flows {
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
-	cfg *config.ClientAPI,
+	uiaSessions *auth.UIASessions, cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
 		// TODO: support other forms of login other than password, depending on config options
@@ -69,17 +80,27 @@ func Login(
 			GetAccountByPassword: accountDB.GetAccountByPassword,
 			Config:               cfg,
 		}
-		r := typePassword.Request()
-		resErr := httputil.UnmarshalJSONRequest(req, r)
+		var r loginRequest
+		resErr := httputil.UnmarshalJSONRequest(req, &r)
 		if resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		login, authErr := typePassword.Login(req.Context(), &r.PasswordRequest)
 		if authErr != nil {
 			return *authErr
 		}
+		// Users can't log in until they have accepted the current versions
+		// of the server's policies.
+		localpart, err := userutil.ParseUsernameParam(login.Username(), &cfg.Matrix.ServerName)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userutil.ParseUsernameParam failed")
+			return jsonerror.InternalServerError()
+		}
+		if res := requireTerms(req.Context(), accountDB, uiaSessions, cfg, localpart, r.Auth); res != nil {
+			return *res
+		}
 		// make a device/access token
-		return completeAuth(req.Context(), cfg.Matrix.ServerName, userAPI, login, req.RemoteAddr, req.UserAgent())
+		return completeAuth(req.Context(), cfg, userAPI, login, internalHTTPUtil.ClientIP(req), req.UserAgent())
 	}
 	return util.JSONResponse{
 		Code: http.StatusMethodNotAllowed,
@@ -88,9 +109,10 @@ func Login(
 }
 
 func completeAuth(
-	ctx context.Context, serverName gomatrixserverlib.ServerName, userAPI userapi.UserInternalAPI, login *auth.Login,
+	ctx context.Context, cfg *config.ClientAPI, userAPI userapi.UserInternalAPI, login *auth.Login,
 	ipAddr, userAgent string,
 ) util.JSONResponse {
+	serverName := cfg.Matrix.ServerName
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
@@ -103,21 +125,36 @@ func completeAuth(
 		return jsonerror.InternalServerError()
 	}
 
+	devReq := &userapi.PerformDeviceCreationRequest{
+		DeviceDisplayName:     login.InitialDisplayName,
+		DeviceID:              login.DeviceID,
+		AccessToken:           token,
+		Localpart:             localpart,
+		IPAddr:                ipAddr,
+		UserAgent:             userAgent,
+		MaxDevices:            cfg.MaxDevicesPerUser,
+		EvictDevicesOverLimit: cfg.EvictDevicesOverLimit,
+	}
+	refreshToken, expiresInMS, err := addRefreshToken(cfg, login.RefreshToken, devReq)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+
 	var performRes userapi.PerformDeviceCreationResponse
-	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
-		DeviceDisplayName: login.InitialDisplayName,
-		DeviceID:          login.DeviceID,
-		AccessToken:       token,
-		Localpart:         localpart,
-		IPAddr:            ipAddr,
-		UserAgent:         userAgent,
-	}, &performRes)
+	err = userAPI.PerformDeviceCreation(ctx, devReq, &performRes)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
 			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
 		}
 	}
+	if performRes.TooManyDevices {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("You have too many devices, log out of one before logging in again", 0),
+		}
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -126,6 +163,9 @@ func completeAuth(
 			AccessToken: performRes.Device.AccessToken,
 			HomeServer:  serverName,
 			DeviceID:    performRes.Device.ID,
+
+			RefreshToken: refreshToken,
+			ExpiresInMS:  expiresInMS,
 		},
 	}
 }
@@ -118,7 +118,7 @@ func SendKick(
 		UserID: body.UserID,
 	}, &queryRes)
 	if err != nil {
-		return util.ErrorResponse(err)
+		return jsonerror.ErrorResponse(req.Context(), err)
 	}
 	// kick is only valid if the user is not currently banned or left (that is, they are joined or invited)
 	if queryRes.Membership != "join" && queryRes.Membership != "invite" {
@@ -153,7 +153,7 @@ func SendUnban(
 		UserID: body.UserID,
 	}, &queryRes)
 	if err != nil {
-		return util.ErrorResponse(err)
+		return jsonerror.ErrorResponse(req.Context(), err)
 	}
 	// unban is only valid if the user is currently banned
 	if queryRes.Membership != "ban" {
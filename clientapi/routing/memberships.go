@@ -15,78 +15,51 @@
 package routing
 
 import (
-	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-type getMembershipResponse struct {
-	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
-}
-
 type getJoinedRoomsResponse struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
 
 // https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-joined-members
 type getJoinedMembersResponse struct {
-	Joined map[string]joinedMember `json:"joined"`
-}
-
-type joinedMember struct {
-	DisplayName string `json:"display_name"`
-	AvatarURL   string `json:"avatar_url"`
+	Joined map[string]api.JoinedMember `json:"joined"`
 }
 
-// GetMemberships implements GET /rooms/{roomId}/members
-func GetMemberships(
-	req *http.Request, device *userapi.Device, roomID string, joinedOnly bool,
+// GetJoinedMembers implements GET /rooms/{roomId}/joined_members. The full
+// member list at /rooms/{roomId}/members is served by the sync API.
+func GetJoinedMembers(
+	req *http.Request, device *userapi.Device, roomID string,
 	_ *config.ClientAPI,
 	rsAPI api.RoomserverInternalAPI,
 ) util.JSONResponse {
-	queryReq := api.QueryMembershipsForRoomRequest{
-		JoinedOnly: joinedOnly,
-		RoomID:     roomID,
-		Sender:     device.UserID,
+	queryReq := api.QueryJoinedMembersRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
 	}
-	var queryRes api.QueryMembershipsForRoomResponse
-	if err := rsAPI.QueryMembershipsForRoom(req.Context(), &queryReq, &queryRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+	var queryRes api.QueryJoinedMembersResponse
+	if err := rsAPI.QueryJoinedMembers(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryJoinedMembers failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if !queryRes.HasBeenInRoom {
+	if !queryRes.IsJoined {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
 		}
 	}
 
-	if joinedOnly {
-		var res getJoinedMembersResponse
-		res.Joined = make(map[string]joinedMember)
-		for _, ev := range queryRes.JoinEvents {
-			var content joinedMember
-			if err := json.Unmarshal(ev.Content, &content); err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal event content")
-				return jsonerror.InternalServerError()
-			}
-			res.Joined[ev.Sender] = content
-		}
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: res,
-		}
-	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: getMembershipResponse{queryRes.JoinEvents},
+		JSON: getJoinedMembersResponse{queryRes.Members},
 	}
 }
 
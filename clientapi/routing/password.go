@@ -31,6 +31,7 @@ func Password(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
 	accountDB accounts.Database,
+	uiaSessions *auth.UIASessions,
 	device *api.Device,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
@@ -44,15 +45,21 @@ func Password(
 		return *resErr
 	}
 
-	// Retrieve or generate the sessionID
+	// Retrieve or start the session
 	sessionID := r.Auth.Session
 	if sessionID == "" {
-		// Generate a new, random session ID
-		sessionID = util.RandomString(sessionIDLength)
+		var err error
+		if sessionID, err = uiaSessions.New(req.Context()); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
 	}
 
 	// Require password auth to change the password.
 	if r.Auth.Type != authtypes.LoginTypePassword {
+		completedStages, err := getCompletedStages(req.Context(), uiaSessions, sessionID)
+		if err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
 		return util.JSONResponse{
 			Code: http.StatusUnauthorized,
 			JSON: newUserInteractiveResponse(
@@ -62,6 +69,7 @@ func Password(
 						Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
 					},
 				},
+				completedStages,
 				nil,
 			),
 		}
@@ -75,7 +83,9 @@ func Password(
 	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
 		return *authErr
 	}
-	AddCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
+	if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypePassword); err != nil {
+		return *auth.SessionErrorResponse(req.Context(), err)
+	}
 
 	// Check the new password strength.
 	if resErr = validatePassword(r.NewPassword); resErr != nil {
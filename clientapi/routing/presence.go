@@ -0,0 +1,125 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type presenceContentJSON struct {
+	Presence  string `json:"presence"`
+	StatusMsg string `json:"status_msg,omitempty"`
+}
+
+type presenceResponse struct {
+	Presence      string `json:"presence"`
+	StatusMsg     string `json:"status_msg,omitempty"`
+	LastActiveAgo int64  `json:"last_active_ago,omitempty"`
+}
+
+// SetPresence implements PUT /presence/{userID}/status
+func SetPresence(
+	req *http.Request, device *userapi.Device, userID string,
+	cfg *config.ClientAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	if device.UserID != userID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot set another user's presence"),
+		}
+	}
+
+	var r presenceContentJSON
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	switch r.Presence {
+	case "online", "offline", "unavailable":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("presence must be one of 'online', 'offline' or 'unavailable'"),
+		}
+	}
+
+	// Virtual users of application services, such as bridge puppets, only
+	// change presence when the application service says so, not when some
+	// client that has logged in as them does.
+	if isAppServiceVirtualUser(cfg, userID) && !isAppServiceDevice(device) {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SetPresence(req.Context(), localpart, &userapi.Presence{
+		Presence:     r.Presence,
+		StatusMsg:    r.StatusMsg,
+		LastActiveTS: int64(gomatrixserverlib.AsTimestamp(time.Now())),
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPresence failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetPresence implements GET /presence/{userID}/status. Users who have never
+// set their presence, and users on other servers, are reported as offline.
+func GetPresence(
+	req *http.Request, userID string,
+	cfg *config.ClientAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	res := presenceResponse{Presence: "offline"}
+	if domain == cfg.Matrix.ServerName {
+		presence, err := accountDB.GetPresence(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetPresence failed")
+			return jsonerror.InternalServerError()
+		}
+		if presence != nil {
+			res.Presence = presence.Presence
+			res.StatusMsg = presence.StatusMsg
+			res.LastActiveAgo = int64(gomatrixserverlib.AsTimestamp(time.Now())) - presence.LastActiveTS
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	appserviceTypes "github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type testPresenceAccountDB struct {
+	accounts.Database
+	presence map[string]userapi.Presence
+}
+
+func (d *testPresenceAccountDB) GetPresence(ctx context.Context, localpart string) (*userapi.Presence, error) {
+	presence, ok := d.presence[localpart]
+	if !ok {
+		return nil, nil
+	}
+	return &presence, nil
+}
+
+func (d *testPresenceAccountDB) SetPresence(ctx context.Context, localpart string, presence *userapi.Presence) error {
+	d.presence[localpart] = *presence
+	return nil
+}
+
+func testPresenceConfig() *config.ClientAPI {
+	return &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "kaer.morhen"},
+		Derived: &config.Derived{
+			ExclusiveApplicationServicesUsernameRegexp: regexp.MustCompile(`@_bridge_.*:kaer\.morhen`),
+		},
+	}
+}
+
+func TestSetPresence(t *testing.T) {
+	cfg := testPresenceConfig()
+	accountDB := &testPresenceAccountDB{presence: map[string]userapi.Presence{}}
+	setPresence := func(device *userapi.Device, userID, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/client/r0/presence/"+userID+"/status", strings.NewReader(body))
+		return SetPresence(req, device, userID, cfg, accountDB).Code
+	}
+	ciri := &userapi.Device{ID: "CIRI", UserID: "@ciri:kaer.morhen"}
+
+	if code := setPresence(ciri, "@geralt:kaer.morhen", `{"presence":"online"}`); code != http.StatusForbidden {
+		t.Errorf("setting another user's presence: got HTTP %d, want %d", code, http.StatusForbidden)
+	}
+	if code := setPresence(ciri, ciri.UserID, `{"presence":"busy"}`); code != http.StatusBadRequest {
+		t.Errorf("setting an invalid presence: got HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(accountDB.presence) != 0 {
+		t.Fatalf("rejected requests stored presence: %+v", accountDB.presence)
+	}
+
+	if code := setPresence(ciri, ciri.UserID, `{"presence":"unavailable","status_msg":"training"}`); code != http.StatusOK {
+		t.Fatalf("setting own presence: got HTTP %d, want %d", code, http.StatusOK)
+	}
+	if got := accountDB.presence["ciri"]; got.Presence != "unavailable" || got.StatusMsg != "training" || got.LastActiveTS == 0 {
+		t.Errorf("got stored presence %+v, want unavailable with status message", got)
+	}
+
+	// A client that has logged in as a virtual user can't change its
+	// presence, but the application service can.
+	puppet := "@_bridge_eskel:kaer.morhen"
+	if code := setPresence(&userapi.Device{ID: "PUPPET", UserID: puppet}, puppet, `{"presence":"online"}`); code != http.StatusOK {
+		t.Fatalf("setting virtual user presence from a device: got HTTP %d, want %d", code, http.StatusOK)
+	}
+	if _, ok := accountDB.presence["_bridge_eskel"]; ok {
+		t.Errorf("presence was stored for a virtual user from a device")
+	}
+	appservice := &userapi.Device{ID: appserviceTypes.AppServiceDeviceID, UserID: puppet}
+	if code := setPresence(appservice, puppet, `{"presence":"online"}`); code != http.StatusOK {
+		t.Fatalf("setting virtual user presence from the application service: got HTTP %d, want %d", code, http.StatusOK)
+	}
+	if got := accountDB.presence["_bridge_eskel"]; got.Presence != "online" {
+		t.Errorf("got stored presence %+v for the virtual user, want online", got)
+	}
+}
+
+func TestGetPresence(t *testing.T) {
+	cfg := testPresenceConfig()
+	accountDB := &testPresenceAccountDB{presence: map[string]userapi.Presence{
+		"ciri": {Presence: "unavailable", StatusMsg: "training", LastActiveTS: 1},
+	}}
+	getPresence := func(userID string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/presence/"+userID+"/status", nil)
+		res := GetPresence(req, userID, cfg, accountDB)
+		return res.Code, res.JSON
+	}
+
+	code, res := getPresence("@ciri:kaer.morhen")
+	if code != http.StatusOK {
+		t.Fatalf("got HTTP %d, want %d", code, http.StatusOK)
+	}
+	if got := res.(presenceResponse); got.Presence != "unavailable" || got.StatusMsg != "training" || got.LastActiveAgo <= 0 {
+		t.Errorf("got presence %+v, want unavailable with status message", got)
+	}
+
+	for _, userID := range []string{"@geralt:kaer.morhen", "@ciri:vengerberg"} {
+		code, res = getPresence(userID)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got HTTP %d, want %d", userID, code, http.StatusOK)
+		}
+		if got := res.(presenceResponse); got != (presenceResponse{Presence: "offline"}) {
+			t.Errorf("%s: got presence %+v, want offline", userID, got)
+		}
+	}
+
+	if code, _ = getPresence("ciri"); code != http.StatusBadRequest {
+		t.Errorf("invalid user ID: got HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+}
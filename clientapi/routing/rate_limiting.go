@@ -1,15 +1,30 @@
 package routing
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+// rateLimitOverrideCacheTime is how long the rate limit override of a user is
+// cached for, and therefore how long a change to it can take to apply.
+const rateLimitOverrideCacheTime = time.Minute
+
+type cachedRateLimitOverride struct {
+	override *userapi.RateLimitOverride // nil if the user has no override
+	expires  time.Time
+}
+
 type rateLimits struct {
 	limits           map[string]chan struct{}
 	limitsMutex      sync.RWMutex
@@ -17,14 +32,28 @@ type rateLimits struct {
 	enabled          bool
 	requestThreshold int64
 	cooloffDuration  time.Duration
+	serverName       gomatrixserverlib.ServerName
+	appServices      []config.ApplicationService
+	accountDB        accounts.Database
+	overrides        map[string]cachedRateLimitOverride // user ID -> override
+	overridesMutex   sync.Mutex
+	// whether authenticated requests are limited per user rather than per
+	// IP address, in which case only exemptions are taken from overrides
+	perUser bool
 }
 
-func newRateLimits(cfg *config.RateLimiting) *rateLimits {
+func newRateLimits(cfg *config.ClientAPI, accountDB accounts.Database) *rateLimits {
 	l := &rateLimits{
 		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
-		requestThreshold: cfg.Threshold,
-		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
+		enabled:          cfg.RateLimiting.Enabled,
+		requestThreshold: cfg.RateLimiting.Threshold,
+		cooloffDuration:  time.Duration(cfg.RateLimiting.CooloffMS) * time.Millisecond,
+		serverName:       cfg.Matrix.ServerName,
+		accountDB:        accountDB,
+		overrides:        make(map[string]cachedRateLimitOverride),
+	}
+	if cfg.Derived != nil {
+		l.appServices = cfg.Derived.ApplicationServices
 	}
 	if l.enabled {
 		go l.clean()
@@ -32,6 +61,17 @@ func newRateLimits(cfg *config.RateLimiting) *rateLimits {
 	return l
 }
 
+// newRoomCreationRateLimits returns the rate limits for creating rooms, which
+// are stricter than the limits for other requests and apply to each user.
+func newRoomCreationRateLimits(cfg *config.ClientAPI, accountDB accounts.Database) *rateLimits {
+	roomCfg := *cfg
+	roomCfg.RateLimiting.Threshold = cfg.RateLimiting.RoomCreation.Threshold
+	roomCfg.RateLimiting.CooloffMS = cfg.RateLimiting.RoomCreation.CooloffMS
+	l := newRateLimits(&roomCfg, accountDB)
+	l.perUser = true
+	return l
+}
+
 func (l *rateLimits) clean() {
 	for {
 		// On a 30 second interval, we'll take an exclusive write
@@ -49,15 +89,101 @@ func (l *rateLimits) clean() {
 		}
 		l.limitsMutex.Unlock()
 		l.cleanMutex.Unlock()
+
+		now := time.Now()
+		l.overridesMutex.Lock()
+		for userID, cached := range l.overrides {
+			if now.After(cached.expires) {
+				delete(l.overrides, userID)
+			}
+		}
+		l.overridesMutex.Unlock()
 	}
 }
 
-func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
+// isUnlimitedAppService returns true if the user is the sender of, or in the
+// exclusive user namespace of, an application service which has asked not to
+// be rate limited.
+func (l *rateLimits) isUnlimitedAppService(userID string) bool {
+	for i := range l.appServices {
+		as := &l.appServices[i]
+		if as.RateLimited {
+			continue
+		}
+		if userID == fmt.Sprintf("@%s:%s", as.SenderLocalpart, l.serverName) || as.OwnsNamespaceCoveringUserId(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitOverride returns the rate limit override for a local user, or nil
+// if they don't have one and the default rate limits apply.
+func (l *rateLimits) rateLimitOverride(ctx context.Context, userID string) *userapi.RateLimitOverride {
+	if l.accountDB == nil {
+		return nil
+	}
+	l.overridesMutex.Lock()
+	cached, ok := l.overrides[userID]
+	l.overridesMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.override
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != l.serverName {
+		return nil
+	}
+	override, err := l.accountDB.GetRateLimitOverride(ctx, localpart)
+	if err != nil {
+		// Fall back to the default rate limits rather than failing the request.
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetRateLimitOverride failed")
+		return nil
+	}
+	l.overridesMutex.Lock()
+	l.overrides[userID] = cachedRateLimitOverride{
+		override: override,
+		expires:  time.Now().Add(rateLimitOverrideCacheTime),
+	}
+	l.overridesMutex.Unlock()
+	return override
+}
+
+// rateLimit applies the rate limits to the request. The device should be
+// given for authenticated requests, so that the rate limit overrides of the
+// user are taken into account, and can be nil otherwise.
+func (l *rateLimits) rateLimit(req *http.Request, device *userapi.Device) *util.JSONResponse {
 	// If rate limiting is disabled then do nothing.
 	if !l.enabled {
 		return nil
 	}
 
+	// Rate limit by the IP address of the caller. This is only taken from
+	// X-Forwarded-For or Forwarded if the request came from a trusted proxy.
+	caller := httputil.ClientIP(req)
+	threshold, cooloff := l.requestThreshold, l.cooloffDuration
+	if device != nil {
+		if l.isUnlimitedAppService(device.UserID) {
+			return nil
+		}
+		if l.perUser {
+			caller = device.UserID
+		}
+		if override := l.rateLimitOverride(req.Context(), device.UserID); override != nil {
+			if override.Exempt {
+				return nil
+			}
+			if !l.perUser {
+				// Users with an override get a bucket of their own, rather than
+				// sharing one with everyone else at the same IP address. The
+				// limits are part of the key so that changes to them apply.
+				caller = fmt.Sprintf("%s/%d/%d", device.UserID, override.Threshold, override.CooloffMS)
+				threshold = override.Threshold
+				cooloff = time.Duration(override.CooloffMS) * time.Millisecond
+			}
+		}
+	}
+
 	// Take a read lock out on the cleaner mutex. The cleaner expects to
 	// be able to take a write lock, which isn't possible while there are
 	// readers, so this has the effect of blocking the cleaner goroutine
@@ -65,13 +191,6 @@ func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
 	l.cleanMutex.RLock()
 	defer l.cleanMutex.RUnlock()
 
-	// First of all, work out if X-Forwarded-For was sent to us. If not
-	// then we'll just use the IP address of the caller.
-	caller := req.RemoteAddr
-	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		caller = forwardedFor
-	}
-
 	// Look up the caller's channel, if they have one.
 	l.limitsMutex.RLock()
 	rateLimit, ok := l.limits[caller]
@@ -80,7 +199,7 @@ func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
 	// If the caller doesn't have a channel, create one and write it
 	// back to the map.
 	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
+		rateLimit = make(chan struct{}, threshold)
 
 		l.limitsMutex.Lock()
 		l.limits[caller] = rateLimit
@@ -95,14 +214,14 @@ func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
 		// We hit the rate limit. Tell the client to back off.
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", cooloff.Milliseconds()),
 		}
 	}
 
 	// After the time interval, drain a resource from the rate limiting
 	// channel. This will free up space in the channel for new requests.
 	go func() {
-		<-time.After(l.cooloffDuration)
+		<-time.After(cooloff)
 		<-rateLimit
 	}()
 	return nil
@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRoomCreationRateLimits(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "kaer.morhen"},
+	}
+	cfg.RateLimiting.Enabled = true
+	cfg.RateLimiting.Threshold = 100
+	cfg.RateLimiting.CooloffMS = 60000
+	cfg.RateLimiting.RoomCreation.Threshold = 2
+	cfg.RateLimiting.RoomCreation.CooloffMS = 60000
+	l := newRoomCreationRateLimits(cfg, nil)
+
+	geralt := &userapi.Device{UserID: "@geralt:kaer.morhen"}
+	ciri := &userapi.Device{UserID: "@ciri:kaer.morhen"}
+	createRoom := func(device *userapi.Device) int {
+		// All of the requests come from the same IP address, so that only
+		// the user tells them apart.
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/createRoom", nil)
+		if res := l.rateLimit(req, device); res != nil {
+			return res.Code
+		}
+		return http.StatusOK
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := createRoom(geralt); code != http.StatusOK {
+			t.Fatalf("room %d: got HTTP %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if code := createRoom(geralt); code != http.StatusTooManyRequests {
+		t.Errorf("got HTTP %d for a room over the threshold, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := createRoom(ciri); code != http.StatusOK {
+		t.Errorf("got HTTP %d for another user, want %d", code, http.StatusOK)
+	}
+}
+
+type testRateLimitAccountDB struct {
+	testWhoamiAccountDB
+	overrides map[string]*userapi.RateLimitOverride // localpart -> override
+	lookups   map[string]int
+	failing   bool
+}
+
+func newTestRateLimitAccountDB() *testRateLimitAccountDB {
+	return &testRateLimitAccountDB{
+		overrides: make(map[string]*userapi.RateLimitOverride),
+		lookups:   make(map[string]int),
+	}
+}
+
+func (d *testRateLimitAccountDB) GetRateLimitOverride(ctx context.Context, localpart string) (*userapi.RateLimitOverride, error) {
+	d.lookups[localpart]++
+	if d.failing {
+		return nil, errors.New("database is unavailable")
+	}
+	return d.overrides[localpart], nil
+}
+
+func (d *testRateLimitAccountDB) SetRateLimitOverride(ctx context.Context, localpart string, override *userapi.RateLimitOverride) error {
+	d.overrides[localpart] = override
+	return nil
+}
+
+func (d *testRateLimitAccountDB) RemoveRateLimitOverride(ctx context.Context, localpart string) error {
+	delete(d.overrides, localpart)
+	return nil
+}
+
+// testRateLimitRequests makes requests from the same IP address as the given
+// user, or unauthenticated if the user is empty, and returns the HTTP status
+// code of each.
+func testRateLimitRequests(l *rateLimits, userID string, count int) []int {
+	codes := make([]int, count)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/profile/x", nil)
+		var device *userapi.Device
+		if userID != "" {
+			device = &userapi.Device{UserID: userID}
+		}
+		codes[i] = http.StatusOK
+		if res := l.rateLimit(req, device); res != nil {
+			codes[i] = res.Code
+		}
+	}
+	return codes
+}
+
+func testRateLimitConfig() *config.ClientAPI {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "kaer.morhen"},
+	}
+	cfg.RateLimiting.Enabled = true
+	cfg.RateLimiting.Threshold = 1
+	cfg.RateLimiting.CooloffMS = 60000
+	return cfg
+}
+
+func TestRateLimitOverrides(t *testing.T) {
+	accountDB := newTestRateLimitAccountDB()
+	accountDB.overrides["geralt"] = &userapi.RateLimitOverride{Exempt: true}
+	accountDB.overrides["ciri"] = &userapi.RateLimitOverride{Threshold: 3, CooloffMS: 60000}
+	l := newRateLimits(testRateLimitConfig(), accountDB)
+
+	if codes := testRateLimitRequests(l, "@geralt:kaer.morhen", 5); codes[4] != http.StatusOK {
+		t.Errorf("expected an exempt user not to be limited, got %v", codes)
+	}
+	want := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	if codes := testRateLimitRequests(l, "@ciri:kaer.morhen", 4); !reflect.DeepEqual(codes, want) {
+		t.Errorf("expected the user's own threshold of 3 to apply, got %v", codes)
+	}
+	// Users without an override share the default per-IP bucket, which the
+	// users with overrides haven't used up.
+	want = []int{http.StatusOK, http.StatusTooManyRequests}
+	if codes := testRateLimitRequests(l, "@yennefer:kaer.morhen", 2); !reflect.DeepEqual(codes, want) {
+		t.Errorf("expected the default threshold of 1 to apply, got %v", codes)
+	}
+	if codes := testRateLimitRequests(l, "", 1); codes[0] != http.StatusTooManyRequests {
+		t.Errorf("expected unauthenticated requests to share the default bucket, got %v", codes)
+	}
+	for _, localpart := range []string{"geralt", "ciri", "yennefer"} {
+		if accountDB.lookups[localpart] != 1 {
+			t.Errorf("expected the override of %s to be looked up once and cached, got %d lookups", localpart, accountDB.lookups[localpart])
+		}
+	}
+	if accountDB.lookups[""] != 0 {
+		t.Errorf("expected no override lookups for unauthenticated requests")
+	}
+}
+
+func TestRateLimitOverrideLookupFailure(t *testing.T) {
+	accountDB := newTestRateLimitAccountDB()
+	accountDB.overrides["geralt"] = &userapi.RateLimitOverride{Exempt: true}
+	accountDB.failing = true
+	l := newRateLimits(testRateLimitConfig(), accountDB)
+
+	want := []int{http.StatusOK, http.StatusTooManyRequests}
+	if codes := testRateLimitRequests(l, "@geralt:kaer.morhen", 2); !reflect.DeepEqual(codes, want) {
+		t.Errorf("expected the default limits when the override can't be looked up, got %v", codes)
+	}
+}
+
+func TestRateLimitUnlimitedAppService(t *testing.T) {
+	cfg := testRateLimitConfig()
+	cfg.Derived = &config.Derived{
+		ApplicationServices: []config.ApplicationService{
+			{ID: "limited", SenderLocalpart: "limited_bot", RateLimited: true},
+			{ID: "unlimited", SenderLocalpart: "unlimited_bot", RateLimited: false},
+		},
+	}
+	l := newRateLimits(cfg, newTestRateLimitAccountDB())
+
+	if codes := testRateLimitRequests(l, "@unlimited_bot:kaer.morhen", 5); codes[4] != http.StatusOK {
+		t.Errorf("expected an application service with rate_limited false not to be limited, got %v", codes)
+	}
+	want := []int{http.StatusOK, http.StatusTooManyRequests}
+	if codes := testRateLimitRequests(l, "@limited_bot:kaer.morhen", 2); !reflect.DeepEqual(codes, want) {
+		t.Errorf("expected an application service with rate_limited true to be limited, got %v", codes)
+	}
+}
@@ -17,12 +17,14 @@ package routing
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -38,10 +40,25 @@ type redactionResponse struct {
 	EventID string `json:"event_id"`
 }
 
+// SendRedaction implements:
+//   /rooms/{roomID}/redact/{eventID}
+//   /rooms/{roomID}/redact/{eventID}/{txnID}
 func SendRedaction(
-	req *http.Request, device *userapi.Device, roomID, eventID string, cfg *config.ClientAPI,
-	rsAPI roomserverAPI.RoomserverInternalAPI,
+	req *http.Request, device *userapi.Device, roomID, eventID string, txnID *string, cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, txnCache *transactions.Cache,
 ) util.JSONResponse {
+	// Use the same mutex as SendEvent so that retries of the same transaction
+	// are serialised, and ordering is preserved with other sent events.
+	mutex, _ := userRoomSendMutexes.LoadOrStore(roomID+device.UserID, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	if txnID != nil {
+		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
+			return *res
+		}
+	}
+
 	resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomID)
 	if resErr != nil {
 		return *resErr
@@ -121,14 +138,26 @@ func SendRedaction(
 			JSON: jsonerror.NotFound("Room does not exist"),
 		}
 	}
-	if err = roomserverAPI.SendEvents(context.Background(), rsAPI, api.KindNew, []gomatrixserverlib.HeaderedEvent{*e}, cfg.Matrix.ServerName, nil); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Errorf("failed to SendEvents")
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+	redactionEventID, err := roomserverAPI.SendEventWithTransactionID(context.Background(), rsAPI, *e, cfg.Matrix.ServerName, txnAndSessionID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Errorf("failed to SendEventWithTransactionID")
 		return jsonerror.InternalServerError()
 	}
-	return util.JSONResponse{
+	res := util.JSONResponse{
 		Code: 200,
 		JSON: redactionResponse{
-			EventID: e.EventID(),
+			EventID: redactionEventID,
 		},
 	}
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+	}
+	return res
 }
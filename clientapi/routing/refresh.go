@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh implements POST /refresh (MSC2918), which exchanges a refresh token
+// for a new access token and refresh token. The old tokens stop working.
+func Refresh(
+	req *http.Request, userAPI userapi.UserInternalAPI, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing refresh_token"),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	expiresTS, refreshExpiresTS := tokenExpiry(cfg)
+
+	var res userapi.PerformTokenRefreshResponse
+	err = userAPI.PerformTokenRefresh(req.Context(), &userapi.PerformTokenRefreshRequest{
+		RefreshToken:          r.RefreshToken,
+		NewAccessToken:        accessToken,
+		NewRefreshToken:       refreshToken,
+		AccessTokenExpiresTS:  expiresTS,
+		RefreshTokenExpiresTS: refreshExpiresTS,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTokenRefresh failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Device == nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown or expired refresh token"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  res.Device.AccessToken,
+			ExpiresInMS:  int64(cfg.AccessTokenLifetime / time.Millisecond),
+			RefreshToken: refreshToken,
+		},
+	}
+}
+
+// addRefreshToken gives the new device a refresh token and makes its access
+// token expire, if the client asked for a refresh token and they are enabled.
+// Returns the refresh token and how many milliseconds the access token is
+// valid for, or an empty token if no refresh token was added.
+func addRefreshToken(
+	cfg *config.ClientAPI, requested bool, devReq *userapi.PerformDeviceCreationRequest,
+) (refreshToken string, expiresInMS int64, err error) {
+	if !requested || cfg.AccessTokenLifetime == 0 {
+		return "", 0, nil
+	}
+	refreshToken, err = auth.GenerateAccessToken()
+	if err != nil {
+		return "", 0, err
+	}
+	devReq.RefreshToken = refreshToken
+	devReq.AccessTokenExpiresTS, devReq.RefreshTokenExpiresTS = tokenExpiry(cfg)
+	return refreshToken, int64(cfg.AccessTokenLifetime / time.Millisecond), nil
+}
+
+// tokenExpiry returns when newly issued access and refresh tokens expire, as
+// unix timestamps (ms resolution), or 0 if they don't.
+func tokenExpiry(cfg *config.ClientAPI) (expiresTS, refreshExpiresTS int64) {
+	now := time.Now()
+	if cfg.AccessTokenLifetime > 0 {
+		expiresTS = now.Add(cfg.AccessTokenLifetime).UnixNano() / int64(time.Millisecond)
+	}
+	if cfg.RefreshTokenLifetime > 0 {
+		refreshExpiresTS = now.Add(cfg.RefreshTokenLifetime).UnixNano() / int64(time.Millisecond)
+	}
+	return
+}
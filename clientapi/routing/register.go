@@ -23,23 +23,26 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	appserviceTypes "github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	internalHTTPUtil "github.com/matrix-org/dendrite/internal/httputil"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -63,7 +66,6 @@ const (
 	minPasswordLength = 8   // http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 	maxPasswordLength = 512 // https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/rest/client/v2_alpha/register.py#L161
 	maxUsernameLength = 254 // http://matrix.org/speculator/spec/HEAD/intro.html#user-identifiers TODO account for domain
-	sessionIDLength   = 24
 )
 
 func init() {
@@ -71,48 +73,23 @@ func init() {
 	prometheus.MustRegister(amtRegUsers)
 }
 
-// sessionsDict keeps track of completed auth stages for each session.
-// It shouldn't be passed by value because it contains a mutex.
-type sessionsDict struct {
-	sync.Mutex
-	sessions map[string][]authtypes.LoginType
-}
-
-// GetCompletedStages returns the completed stages for a session.
-func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginType {
-	d.Lock()
-	defer d.Unlock()
-
-	if completedStages, ok := d.sessions[sessionID]; ok {
-		return completedStages
+// getCompletedStages returns the completed auth stages for a session.
+func getCompletedStages(
+	ctx context.Context, sessions *auth.UIASessions, sessionID string,
+) ([]authtypes.LoginType, error) {
+	stages, err := sessions.CompletedStages(ctx, sessionID)
+	if err != nil {
+		return nil, err
 	}
 	// Ensure that a empty slice is returned and not nil. See #399.
-	return make([]authtypes.LoginType, 0)
-}
-
-func newSessionsDict() *sessionsDict {
-	return &sessionsDict{
-		sessions: make(map[string][]authtypes.LoginType),
-	}
-}
-
-// AddCompletedSessionStage records that a session has completed an auth stage.
-func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
-	sessions.Lock()
-	defer sessions.Unlock()
-
-	for _, completedStage := range sessions.sessions[sessionID] {
-		if completedStage == stage {
-			return
-		}
+	completedStages := make([]authtypes.LoginType, 0, len(stages))
+	for _, stage := range stages {
+		completedStages = append(completedStages, authtypes.LoginType(stage))
 	}
-	sessions.sessions[sessionID] = append(sessions.sessions[sessionID], stage)
+	return completedStages, nil
 }
 
 var (
-	// TODO: Remove old sessions. Need to do so on a session-specific timeout.
-	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
-	sessions           = newSessionsDict()
 	validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-./]+$`)
 )
 
@@ -138,6 +115,9 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens (MSC2918)
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -175,10 +155,11 @@ type legacyRegisterRequest struct {
 func newUserInteractiveResponse(
 	sessionID string,
 	fs []authtypes.Flow,
+	completed []authtypes.LoginType,
 	params map[string]interface{},
 ) userInteractiveResponse {
 	return userInteractiveResponse{
-		fs, sessions.GetCompletedStages(sessionID), params, sessionID,
+		fs, completed, params, sessionID,
 	}
 }
 
@@ -188,6 +169,9 @@ type registerResponse struct {
 	AccessToken string                       `json:"access_token,omitempty"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
 	DeviceID    string                       `json:"device_id,omitempty"`
+	// Only set if the client asked for a refresh token (MSC2918).
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -381,6 +365,21 @@ func UsernameMatchesExclusiveNamespaces(
 	return cfg.Derived.ExclusiveApplicationServicesUsernameRegexp.MatchString(userID)
 }
 
+// isAppServiceVirtualUser returns true if the user is in the exclusive users
+// namespace of an application service, e.g. a puppet user of a bridge.
+func isAppServiceVirtualUser(cfg *config.ClientAPI, userID string) bool {
+	if cfg.Derived == nil || cfg.Derived.ExclusiveApplicationServicesUsernameRegexp == nil {
+		return false
+	}
+	return cfg.Derived.ExclusiveApplicationServicesUsernameRegexp.MatchString(userID)
+}
+
+// isAppServiceDevice returns true if the request was authenticated with the
+// access token of an application service rather than of a device.
+func isAppServiceDevice(device *userapi.Device) bool {
+	return device.ID == appserviceTypes.AppServiceDeviceID
+}
+
 // validateApplicationService checks if a provided application service token
 // corresponds to one that is registered. If so, then it checks if the desired
 // username is within that application service's namespace. As long as these
@@ -441,7 +440,9 @@ func validateApplicationService(
 func Register(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 	accountDB accounts.Database,
+	uiaSessions *auth.UIASessions,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	var r registerRequest
@@ -450,16 +451,12 @@ func Register(
 		return *resErr
 	}
 	if req.URL.Query().Get("kind") == "guest" {
+		if resErr = checkRegistrationIP(req, cfg); resErr != nil {
+			return *resErr
+		}
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
 
-	// Retrieve or generate the sessionID
-	sessionID := r.Auth.Session
-	if sessionID == "" {
-		// Generate a new, random session ID
-		sessionID = util.RandomString(sessionIDLength)
-	}
-
 	// Don't allow numeric usernames less than MAX_INT64.
 	if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
 		return util.JSONResponse{
@@ -506,7 +503,16 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	// Retrieve or start the session
+	sessionID := r.Auth.Session
+	if sessionID == "" {
+		var err error
+		if sessionID, err = uiaSessions.New(req.Context()); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
+	}
+
+	return handleRegistrationFlow(req, r, sessionID, uiaSessions, cfg, userAPI, accountDB, rsAPI)
 }
 
 func handleGuestRegistration(
@@ -538,14 +544,22 @@ func handleGuestRegistration(
 		}
 	}
 	//we don't allow guests to specify their own device_id
-	var devRes userapi.PerformDeviceCreationResponse
-	err = userAPI.PerformDeviceCreation(req.Context(), &userapi.PerformDeviceCreationRequest{
+	devReq := &userapi.PerformDeviceCreationRequest{
 		Localpart:         res.Account.Localpart,
 		DeviceDisplayName: r.InitialDisplayName,
 		AccessToken:       token,
-		IPAddr:            req.RemoteAddr,
+		IPAddr:            internalHTTPUtil.ClientIP(req),
 		UserAgent:         req.UserAgent(),
-	}, &devRes)
+	}
+	newRefreshToken, expiresInMS, err := addRefreshToken(cfg, r.RefreshToken, devReq)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to generate refresh token"),
+		}
+	}
+	var devRes userapi.PerformDeviceCreationResponse
+	err = userAPI.PerformDeviceCreation(req.Context(), devReq, &devRes)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -559,10 +573,45 @@ func handleGuestRegistration(
 			AccessToken: devRes.Device.AccessToken,
 			HomeServer:  res.Account.ServerName,
 			DeviceID:    devRes.Device.ID,
+
+			RefreshToken: newRefreshToken,
+			ExpiresInMS:  expiresInMS,
 		},
 	}
 }
 
+// checkRegistrationIP returns an error response if open registration isn't
+// allowed from the client's IP address, because the address is in one of the
+// denied ranges or there are allowed ranges and it isn't in any of them.
+func checkRegistrationIP(req *http.Request, cfg *config.ClientAPI) *util.JSONResponse {
+	if len(cfg.RegistrationAllowedCIDRs) == 0 && len(cfg.RegistrationDeniedCIDRs) == 0 {
+		return nil
+	}
+	clientIP := internalHTTPUtil.ClientIP(req)
+	ip := net.ParseIP(clientIP)
+	allowed := ip != nil && !cidrsContain(cfg.RegistrationDeniedCIDRs, ip) &&
+		(len(cfg.RegistrationAllowedCIDRs) == 0 || cidrsContain(cfg.RegistrationAllowedCIDRs, ip))
+	if allowed {
+		return nil
+	}
+	util.GetLogger(req.Context()).WithField("client_ip", clientIP).Warn("Rejected registration from a disallowed IP address")
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("Registration is not allowed from your network"),
+	}
+}
+
+// cidrsContain returns true if the IP address is in any of the CIDR ranges.
+// Invalid ranges are ignored, as they are rejected when the config is loaded.
+func cidrsContain(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleRegistrationFlow will direct and complete registration flow stages
 // that the client has requested.
 // nolint: gocyclo
@@ -570,32 +619,49 @@ func handleRegistrationFlow(
 	req *http.Request,
 	r registerRequest,
 	sessionID string,
+	uiaSessions *auth.UIASessions,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
 	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
 	// TODO: Guest account upgrading
 
-	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
 	// TODO: email / msisdn auth types.
 
 	if cfg.RegistrationDisabled && r.Auth.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
+	}
+
+	// Shared secret and application service registrations aren't open
+	// registration, so they aren't restricted to the allowed IP ranges.
+	_, tokenErr := auth.ExtractAccessToken(req)
+	isAppService := r.Auth.Type == authtypes.LoginTypeApplicationService || (r.Auth.Type == "" && tokenErr == nil)
+	if r.Auth.Type != authtypes.LoginTypeSharedSecret && !isAppService {
+		if resErr := checkRegistrationIP(req, cfg); resErr != nil {
+			return *resErr
+		}
 	}
 
 	switch r.Auth.Type {
 	case authtypes.LoginTypeRecaptcha:
 		// Check given captcha response
-		resErr := validateRecaptcha(cfg, r.Auth.Response, req.RemoteAddr)
+		resErr := validateRecaptcha(cfg, r.Auth.Response, internalHTTPUtil.ClientIP(req))
 		if resErr != nil {
 			return *resErr
 		}
 
 		// Add Recaptcha to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
+		if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeRecaptcha); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
 
 	case authtypes.LoginTypeSharedSecret:
 		// Check shared secret against config
@@ -605,11 +671,16 @@ func handleRegistrationFlow(
 			util.GetLogger(req.Context()).WithError(err).Error("isValidMacLogin failed")
 			return jsonerror.InternalServerError()
 		} else if !valid {
-			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("HMAC incorrect"),
+			}
 		}
 
 		// Add SharedSecret to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeSharedSecret)
+		if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeSharedSecret); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
 
 	case "":
 		// Extract the access token from the request, if there's one to extract
@@ -636,10 +707,20 @@ func handleRegistrationFlow(
 			accessToken, err, req, r, cfg, userAPI,
 		)
 
+	case authtypes.LoginTypeTerms:
+		// Submitting this stage means that the user accepted the policies
+		// given in the stage parameters. The accepted versions are recorded
+		// once the account has been created.
+		if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeTerms); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
+
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
 		// Add Dummy to the list of completed registration stages
-		AddCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
+		if err := uiaSessions.AddCompletedStage(req.Context(), sessionID, authtypes.LoginTypeDummy); err != nil {
+			return *auth.SessionErrorResponse(req.Context(), err)
+		}
 
 	default:
 		return util.JSONResponse{
@@ -651,8 +732,12 @@ func handleRegistrationFlow(
 	// Check if the user's registration flow has been completed successfully
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
-	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+	completedStages, err := getCompletedStages(req.Context(), uiaSessions, sessionID)
+	if err != nil {
+		return *auth.SessionErrorResponse(req.Context(), err)
+	}
+	return checkAndCompleteFlow(completedStages,
+		req, r, sessionID, cfg, userAPI, accountDB, rsAPI)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -693,8 +778,8 @@ func handleApplicationServiceRegistration(
 	// Don't need to worry about appending to registration stages as
 	// application service registration is entirely separate.
 	return completeRegistration(
-		req.Context(), userAPI, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		req.Context(), cfg, userAPI, r.Username, "", appserviceID, internalHTTPUtil.ClientIP(req), req.UserAgent(),
+		r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 	)
 }
 
@@ -708,13 +793,18 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
-			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		res := completeRegistration(
+			req.Context(), cfg, userAPI, r.Username, r.Password, "", internalHTTPUtil.ClientIP(req), req.UserAgent(),
+			r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 		)
+		recordAcceptedTerms(req.Context(), cfg, accountDB, flow, res)
+		autoJoinRooms(req.Context(), cfg, rsAPI, res)
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -722,7 +812,7 @@ func checkAndCompleteFlow(
 	return util.JSONResponse{
 		Code: http.StatusUnauthorized,
 		JSON: newUserInteractiveResponse(sessionID,
-			cfg.Derived.Registration.Flows, cfg.Derived.Registration.Params),
+			cfg.Derived.Registration.Flows, flow, cfg.Derived.Registration.Params),
 	}
 }
 
@@ -730,6 +820,7 @@ func checkAndCompleteFlow(
 func LegacyRegister(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	var r legacyRegisterRequest
@@ -745,13 +836,19 @@ func LegacyRegister(
 	}).Info("Processing registration request")
 
 	if cfg.RegistrationDisabled && r.Type != authtypes.LoginTypeSharedSecret {
-		return util.MessageResponse(http.StatusForbidden, "Registration has been disabled")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration has been disabled"),
+		}
 	}
 
 	switch r.Type {
 	case authtypes.LoginTypeSharedSecret:
 		if cfg.RegistrationSharedSecret == "" {
-			return util.MessageResponse(http.StatusBadRequest, "Shared secret registration is disabled")
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("Shared secret registration is disabled"),
+			}
 		}
 
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Mac)
@@ -761,13 +858,23 @@ func LegacyRegister(
 		}
 
 		if !valid {
-			return util.MessageResponse(http.StatusForbidden, "HMAC incorrect")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("HMAC incorrect"),
+			}
 		}
 
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		res := completeRegistration(req.Context(), cfg, userAPI, r.Username, r.Password, "", internalHTTPUtil.ClientIP(req), req.UserAgent(), false, false, nil, nil)
+		autoJoinRooms(req.Context(), cfg, rsAPI, res)
+		return res
 	case authtypes.LoginTypeDummy:
+		if resErr = checkRegistrationIP(req, cfg); resErr != nil {
+			return *resErr
+		}
 		// there is nothing to do
-		return completeRegistration(req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(), false, nil, nil)
+		res := completeRegistration(req.Context(), cfg, userAPI, r.Username, r.Password, "", internalHTTPUtil.ClientIP(req), req.UserAgent(), false, false, nil, nil)
+		autoJoinRooms(req.Context(), cfg, rsAPI, res)
+		return res
 	default:
 		return util.JSONResponse{
 			Code: http.StatusNotImplemented,
@@ -813,9 +920,11 @@ func parseAndValidateLegacyLogin(req *http.Request, r *legacyRegisterRequest) *u
 // not all
 func completeRegistration(
 	ctx context.Context,
+	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
 	username, password, appserviceID, ipAddr, userAgent string,
 	inhibitLogin eventutil.WeakBoolean,
+	refreshToken bool,
 	displayName, deviceID *string,
 ) util.JSONResponse {
 	if username == "" {
@@ -876,15 +985,24 @@ func completeRegistration(
 		}
 	}
 
-	var devRes userapi.PerformDeviceCreationResponse
-	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
+	devReq := &userapi.PerformDeviceCreationRequest{
 		Localpart:         username,
 		AccessToken:       token,
 		DeviceDisplayName: displayName,
 		DeviceID:          deviceID,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
-	}, &devRes)
+	}
+	newRefreshToken, expiresInMS, err := addRefreshToken(cfg, refreshToken, devReq)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("Failed to generate refresh token"),
+		}
+	}
+
+	var devRes userapi.PerformDeviceCreationResponse
+	err = userAPI.PerformDeviceCreation(ctx, devReq, &devRes)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -899,6 +1017,9 @@ func completeRegistration(
 			AccessToken: devRes.Device.AccessToken,
 			HomeServer:  accRes.Account.ServerName,
 			DeviceID:    devRes.Device.ID,
+
+			RefreshToken: newRefreshToken,
+			ExpiresInMS:  expiresInMS,
 		},
 	}
 }
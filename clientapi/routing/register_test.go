@@ -15,11 +15,16 @@
 package routing
 
 import (
+	"context"
+	"net/http/httptest"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
 var (
@@ -135,12 +140,29 @@ func TestFlowCheckingExtraneousIncorrectInput(t *testing.T) {
 	}
 }
 
+type emptySessionDB struct{}
+
+func (emptySessionDB) GetUIASession(ctx context.Context, sessionID string) (*userapi.UIASession, error) {
+	return nil, nil
+}
+
+func (emptySessionDB) SaveUIASession(ctx context.Context, session *userapi.UIASession) error {
+	return nil
+}
+
+func (emptySessionDB) RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error {
+	return nil
+}
+
 // Completed flows stages should always be a valid slice header.
-// TestEmptyCompletedFlows checks that sessionsDict returns a slice & not nil.
+// TestEmptyCompletedFlows checks that getCompletedStages returns a slice & not nil.
 func TestEmptyCompletedFlows(t *testing.T) {
-	fakeEmptySessions := newSessionsDict()
+	fakeEmptySessions := auth.NewUIASessions(emptySessionDB{}, time.Hour)
 	fakeSessionID := "aRandomSessionIDWhichDoesNotExist"
-	ret := fakeEmptySessions.GetCompletedStages(fakeSessionID)
+	ret, err := getCompletedStages(context.Background(), fakeEmptySessions, fakeSessionID)
+	if err != nil {
+		t.Fatal("getCompletedStages failed:", err)
+	}
 
 	// check for []
 	if ret == nil || len(ret) != 0 {
@@ -208,3 +230,27 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+func TestCheckRegistrationIP(t *testing.T) {
+	cfg := &config.ClientAPI{
+		RegistrationAllowedCIDRs: []string{"10.0.0.0/8"},
+		RegistrationDeniedCIDRs:  []string{"10.1.0.0/16"},
+	}
+	tests := map[string]bool{
+		"10.2.3.4:1234":    true,
+		"10.1.2.3:1234":    false,
+		"192.0.2.1:1234":   false,
+		"[2001:db8::1]:80": false,
+	}
+	for remoteAddr, wantAllowed := range tests {
+		req := httptest.NewRequest("POST", "/register", nil)
+		req.RemoteAddr = remoteAddr
+		if resErr := checkRegistrationIP(req, cfg); (resErr == nil) != wantAllowed {
+			t.Errorf("%s: got allowed %v, want %v", remoteAddr, resErr == nil, wantAllowed)
+		}
+	}
+
+	if resErr := checkRegistrationIP(httptest.NewRequest("POST", "/register", nil), &config.ClientAPI{}); resErr != nil {
+		t.Errorf("registration should be allowed from anywhere without any CIDR ranges")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// checkRoomLimits returns an error response if the user can't be in another
+// room, either because they are already joined to as many rooms as
+// client_api.max_rooms_per_user allows, or because the server knows about as
+// many rooms as room_server.max_rooms allows and this room would be a new one.
+// roomIDOrAlias is the room being joined, or empty if a room is being created.
+// Users can always rejoin a room that they have been in before, so that
+// leaving a room by mistake when at the limit doesn't lock them out of it.
+func checkRoomLimits(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, roomIDOrAlias string,
+) *util.JSONResponse {
+	if isExemptFromRoomLimits(cfg, userID) {
+		return nil
+	}
+
+	roomExists, hasBeenInRoom, err := roomLimitsTarget(ctx, rsAPI, userID, roomIDOrAlias)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("roomLimitsTarget failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if hasBeenInRoom {
+		return nil
+	}
+
+	var countsRes roomserverAPI.QueryRoomCountsResponse
+	if err = rsAPI.QueryRoomCounts(ctx, &roomserverAPI.QueryRoomCountsRequest{
+		UserID: userID,
+	}, &countsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomCounts failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	if cfg.MaxRoomsPerUser > 0 && countsRes.JoinedRoomCount >= cfg.MaxRoomsPerUser {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(fmt.Sprintf("You can't be in more than %d rooms", cfg.MaxRoomsPerUser), 0),
+		}
+	}
+
+	if countsRes.AtMaxRooms && !roomExists {
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("This server can't be in any more rooms", 0),
+		}
+	}
+	return nil
+}
+
+// isExemptFromRoomLimits returns true if the user is listed in
+// client_api.room_limit_exempt_users, or belongs to an application service.
+func isExemptFromRoomLimits(cfg *config.ClientAPI, userID string) bool {
+	for _, exempt := range cfg.RoomLimitExemptUsers {
+		if exempt == userID {
+			return true
+		}
+	}
+	if cfg.Derived == nil {
+		return false
+	}
+	for i := range cfg.Derived.ApplicationServices {
+		as := &cfg.Derived.ApplicationServices[i]
+		if userID == fmt.Sprintf("@%s:%s", as.SenderLocalpart, cfg.Matrix.ServerName) || as.OwnsNamespaceCoveringUserId(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomLimitsTarget returns whether the server already knows about the room
+// being joined, so that joining it doesn't add to the number of known rooms,
+// and whether the user has been in it before, i.e. is joined to it or has
+// left it. Both are false when a room is being created.
+func roomLimitsTarget(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID, roomIDOrAlias string,
+) (roomExists, hasBeenInRoom bool, err error) {
+	if roomIDOrAlias == "" {
+		return false, false, nil
+	}
+	roomID := roomIDOrAlias
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		var aliasRes roomserverAPI.GetRoomIDForAliasResponse
+		if err = rsAPI.GetRoomIDForAlias(ctx, &roomserverAPI.GetRoomIDForAliasRequest{
+			Alias: roomIDOrAlias,
+		}, &aliasRes); err != nil {
+			return false, false, fmt.Errorf("rsAPI.GetRoomIDForAlias: %w", err)
+		}
+		if aliasRes.RoomID == "" {
+			// The alias isn't known locally, so the room will be joined
+			// over federation.
+			return false, false, nil
+		}
+		roomID = aliasRes.RoomID
+	}
+	var joinedRes roomserverAPI.QueryServerJoinedToRoomResponse
+	if err = rsAPI.QueryServerJoinedToRoom(ctx, &roomserverAPI.QueryServerJoinedToRoomRequest{
+		RoomID: roomID,
+	}, &joinedRes); err != nil {
+		return false, false, fmt.Errorf("rsAPI.QueryServerJoinedToRoom: %w", err)
+	}
+	if !joinedRes.RoomExists {
+		return false, false, nil
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err = rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: userID,
+	}, &membershipRes); err != nil {
+		return false, false, fmt.Errorf("rsAPI.QueryMembershipForUser: %w", err)
+	}
+	// An invite or a ban doesn't mean that the user has been in the room.
+	switch membershipRes.Membership {
+	case gomatrixserverlib.Join, gomatrixserverlib.Leave:
+		return true, true, nil
+	}
+	return true, false, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+type testRoomLimitsRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	joinedRoomCount int
+	atMaxRooms      bool
+	aliases         map[string]string            // alias -> room ID
+	memberships     map[string]map[string]string // room ID -> user ID -> membership
+}
+
+func (r *testRoomLimitsRoomserverAPI) QueryRoomCounts(ctx context.Context, req *roomserverAPI.QueryRoomCountsRequest, res *roomserverAPI.QueryRoomCountsResponse) error {
+	res.JoinedRoomCount = r.joinedRoomCount
+	res.AtMaxRooms = r.atMaxRooms
+	return nil
+}
+
+func (r *testRoomLimitsRoomserverAPI) GetRoomIDForAlias(ctx context.Context, req *roomserverAPI.GetRoomIDForAliasRequest, res *roomserverAPI.GetRoomIDForAliasResponse) error {
+	res.RoomID = r.aliases[req.Alias]
+	return nil
+}
+
+func (r *testRoomLimitsRoomserverAPI) QueryServerJoinedToRoom(ctx context.Context, req *roomserverAPI.QueryServerJoinedToRoomRequest, res *roomserverAPI.QueryServerJoinedToRoomResponse) error {
+	_, res.RoomExists = r.memberships[req.RoomID]
+	return nil
+}
+
+func (r *testRoomLimitsRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse) error {
+	res.Membership = r.memberships[req.RoomID][req.UserID]
+	res.HasBeenInRoom = res.Membership != ""
+	res.IsInRoom = res.Membership == "join"
+	return nil
+}
+
+func TestRoomLimits(t *testing.T) {
+	const user = "@ciri:kaer.morhen"
+	cfg := &config.ClientAPI{
+		Matrix:               &config.Global{ServerName: "kaer.morhen"},
+		MaxRoomsPerUser:      2,
+		RoomLimitExemptUsers: []string{"@geralt:kaer.morhen"},
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{{ID: "bridge", SenderLocalpart: "bridge"}},
+		},
+	}
+	rsAPI := &testRoomLimitsRoomserverAPI{
+		aliases: map[string]string{"#left:kaer.morhen": "!left:kaer.morhen"},
+		memberships: map[string]map[string]string{
+			"!joined:kaer.morhen":  {user: "join"},
+			"!left:kaer.morhen":    {user: "leave"},
+			"!invited:kaer.morhen": {user: "invite"},
+			"!banned:kaer.morhen":  {user: "ban"},
+			"!other:kaer.morhen":   {"@yennefer:kaer.morhen": "join"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name            string
+		userID          string
+		room            string
+		joinedRoomCount int
+		atMaxRooms      bool
+		want            int
+	}{
+		{"create under the user limit", user, "", 1, false, http.StatusOK},
+		{"create at the user limit", user, "", 2, false, http.StatusTooManyRequests},
+		{"join at the user limit", user, "!other:kaer.morhen", 2, false, http.StatusTooManyRequests},
+		{"join unknown room at the user limit", user, "!unknown:kaer.morhen", 2, false, http.StatusTooManyRequests},
+		{"rejoin a left room at the user limit", user, "!left:kaer.morhen", 2, false, http.StatusOK},
+		{"rejoin a left room by alias at the user limit", user, "#left:kaer.morhen", 2, false, http.StatusOK},
+		{"join an already joined room at the user limit", user, "!joined:kaer.morhen", 2, false, http.StatusOK},
+		{"accept an invite at the user limit", user, "!invited:kaer.morhen", 2, false, http.StatusTooManyRequests},
+		{"join a room banned from at the user limit", user, "!banned:kaer.morhen", 2, false, http.StatusTooManyRequests},
+		{"create at the server limit", user, "", 0, true, http.StatusTooManyRequests},
+		{"join unknown room at the server limit", user, "!unknown:kaer.morhen", 0, true, http.StatusTooManyRequests},
+		{"join unknown alias at the server limit", user, "#unknown:kaer.morhen", 0, true, http.StatusTooManyRequests},
+		{"join known room at the server limit", user, "!other:kaer.morhen", 0, true, http.StatusOK},
+		{"exempt user at both limits", "@geralt:kaer.morhen", "", 2, true, http.StatusOK},
+		{"application service at both limits", "@bridge:kaer.morhen", "", 2, true, http.StatusOK},
+	} {
+		rsAPI.joinedRoomCount = tt.joinedRoomCount
+		rsAPI.atMaxRooms = tt.atMaxRooms
+		code := http.StatusOK
+		if res := checkRoomLimits(context.Background(), cfg, rsAPI, tt.userID, tt.room); res != nil {
+			code = res.Code
+		}
+		if code != tt.want {
+			t.Errorf("%s: got HTTP %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// roomSummaryResponse uses the same keys for the member counts and heroes as
+// the room summary in /sync.
+type roomSummaryResponse struct {
+	RoomID             string                         `json:"room_id"`
+	Heroes             []string                       `json:"m.heroes"`
+	JoinedMemberCount  int                            `json:"m.joined_member_count"`
+	InvitedMemberCount int                            `json:"m.invited_member_count"`
+	RoomVersion        string                         `json:"room_version"`
+	Name               string                         `json:"name,omitempty"`
+	CanonicalAlias     string                         `json:"canonical_alias,omitempty"`
+	AvatarURL          string                         `json:"avatar_url,omitempty"`
+	JoinRule           string                         `json:"join_rule,omitempty"`
+	LatestEvent        *gomatrixserverlib.ClientEvent `json:"latest_event,omitempty"`
+}
+
+// GetRoomSummary implements GET /rooms/{roomID}/summary, which returns enough
+// about a room for clients to show it in their room list before they fetch
+// its timeline and state.
+func GetRoomSummary(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var res roomserverAPI.QueryRoomSummaryResponse
+	if err := rsAPI.QueryRoomSummary(req.Context(), &roomserverAPI.QueryRoomSummaryRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomSummary failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.IsJoined {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
+		}
+	}
+
+	summary := roomSummaryResponse{
+		RoomID:             roomID,
+		Heroes:             res.Heroes,
+		JoinedMemberCount:  res.JoinedMemberCount,
+		InvitedMemberCount: res.InvitedMemberCount,
+		RoomVersion:        string(res.RoomVersion),
+		Name:               res.Name,
+		CanonicalAlias:     res.CanonicalAlias,
+		AvatarURL:          res.AvatarURL,
+		JoinRule:           res.JoinRule,
+	}
+	if summary.Heroes == nil {
+		summary.Heroes = []string{}
+	}
+	if res.LatestEvent != nil {
+		ev := gomatrixserverlib.HeaderedToClientEvent(*res.LatestEvent, gomatrixserverlib.FormatAll)
+		summary.LatestEvent = &ev
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: summary,
+	}
+}
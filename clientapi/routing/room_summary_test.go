@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomSummaryRoomID = "!summary:kaer.morhen"
+
+type testRoomSummaryRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	members map[string]bool
+}
+
+func (r *testRoomSummaryRoomserverAPI) QueryRoomSummary(ctx context.Context, req *roomserverAPI.QueryRoomSummaryRequest, res *roomserverAPI.QueryRoomSummaryResponse) error {
+	res.RoomExists = true
+	res.IsJoined = r.members[req.UserID]
+	if res.IsJoined {
+		res.JoinedMemberCount = len(r.members)
+		res.RoomVersion = gomatrixserverlib.RoomVersionV6
+	}
+	return nil
+}
+
+func TestGetRoomSummary(t *testing.T) {
+	rsAPI := &testRoomSummaryRoomserverAPI{
+		members: map[string]bool{"@geralt:kaer.morhen": true},
+	}
+	getRoomSummary := func(userID string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.dendrite/rooms/"+testRoomSummaryRoomID+"/summary", nil)
+		res := GetRoomSummary(req, &userapi.Device{UserID: userID}, testRoomSummaryRoomID, rsAPI)
+		return res.Code, res.JSON
+	}
+
+	if code, _ := getRoomSummary("@yennefer:kaer.morhen"); code != http.StatusForbidden {
+		t.Errorf("summary for a non-member: got HTTP %d, want %d", code, http.StatusForbidden)
+	}
+
+	code, body := getRoomSummary("@geralt:kaer.morhen")
+	if code != http.StatusOK {
+		t.Fatalf("summary for a member: got HTTP %d, want %d", code, http.StatusOK)
+	}
+	summary, ok := body.(roomSummaryResponse)
+	if !ok {
+		t.Fatalf("got response %+v, want a room summary", body)
+	}
+	want := roomSummaryResponse{
+		RoomID:            testRoomSummaryRoomID,
+		Heroes:            []string{},
+		JoinedMemberCount: 1,
+		RoomVersion:       string(gomatrixserverlib.RoomVersionV6),
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("got summary %+v, want %+v", summary, want)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
@@ -59,8 +60,10 @@ func Setup(
 	keyAPI keyserverAPI.KeyInternalAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 ) {
-	rateLimits := newRateLimits(&cfg.RateLimiting)
-	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
+	rateLimits := newRateLimits(cfg, accountDB)
+	roomCreationRateLimits := newRoomCreationRateLimits(cfg, accountDB)
+	uiaSessions := auth.NewUIASessions(accountDB, cfg.UIASessionLifetime)
+	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg, uiaSessions)
 
 	publicAPIMux.Handle("/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
@@ -84,23 +87,30 @@ func Setup(
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/api/v1").Subrouter()
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
+	requireDatabases := httputil.RequireDatabases(cfg.AccountDatabase, cfg.DeviceDatabase)
+	r0mux.Use(requireDatabases)
+	v1mux.Use(requireDatabases)
+	unstableMux.Use(requireDatabases)
 
 	r0mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := roomCreationRateLimits.rateLimit(req, device); r != nil {
+				return *r
+			}
 			return CreateRoom(req, device, cfg, accountDB, rsAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return JoinRoomByIDOrAlias(
-				req, device, rsAPI, accountDB, vars["roomIDOrAlias"],
+				req, device, cfg, rsAPI, accountDB, vars["roomIDOrAlias"],
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -108,13 +118,24 @@ func Setup(
 		httputil.MakeAuthAPI(gomatrixserverlib.Peek, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return PeekRoomByIDOrAlias(
 				req, device, rsAPI, accountDB, vars["roomIDOrAlias"],
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/unpeek/{roomID}",
+		httputil.MakeAuthAPI("unpeek", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return UnpeekRoomByID(
+				req, device, rsAPI, vars["roomID"],
+			)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, rsAPI)
@@ -122,26 +143,26 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return JoinRoomByIDOrAlias(
-				req, device, rsAPI, accountDB, vars["roomID"],
+				req, device, cfg, rsAPI, accountDB, vars["roomID"],
 			)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return LeaveRoomByID(
 				req, device, rsAPI, vars["roomID"],
@@ -152,19 +173,19 @@ func Setup(
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SendBan(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SendInvite(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
 		}),
@@ -173,7 +194,7 @@ func Setup(
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SendKick(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
 		}),
@@ -182,7 +203,7 @@ func Setup(
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SendUnban(req, accountDB, device, vars["roomID"], cfg, rsAPI, asAPI)
 		}),
@@ -191,7 +212,7 @@ func Setup(
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, nil, cfg, rsAPI, nil)
 		}),
@@ -200,7 +221,7 @@ func Setup(
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			txnID := vars["txnID"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], &txnID,
@@ -211,16 +232,16 @@ func Setup(
 		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, federation)
+			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, userAPI, federation)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
-			return util.ErrorResponse(err)
+			return jsonerror.ErrorResponse(req.Context(), err)
 		}
 		return OnIncomingStateRequest(req.Context(), device, rsAPI, vars["roomID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
@@ -228,7 +249,7 @@ func Setup(
 	r0mux.Handle("/rooms/{roomID}/state/{type:[^/]+/?}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
-			return util.ErrorResponse(err)
+			return jsonerror.ErrorResponse(req.Context(), err)
 		}
 		// If there's a trailing slash, remove it
 		eventType := vars["type"]
@@ -242,17 +263,19 @@ func Setup(
 	r0mux.Handle("/rooms/{roomID}/state/{type}/{stateKey}", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
-			return util.ErrorResponse(err)
+			return jsonerror.ErrorResponse(req.Context(), err)
 		}
 		eventFormat := req.URL.Query().Get("format") == "event"
 		return OnIncomingStateTypeRequest(req.Context(), device, rsAPI, vars["roomID"], vars["type"], vars["stateKey"], eventFormat)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	// The content of a state event can't be larger than the event itself, so
+	// don't bother reading bodies larger than the maximum event size.
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
-		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.LimitRequestBody(eventutil.MaxEventSize, httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			emptyString := ""
 			eventType := vars["eventType"]
@@ -261,36 +284,36 @@ func Setup(
 				eventType = eventType[:len(eventType)-1]
 			}
 			return SendEvent(req, device, vars["roomID"], eventType, nil, &emptyString, cfg, rsAPI, nil)
-		}),
+		})),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
-		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.LimitRequestBody(eventutil.MaxEventSize, httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			stateKey := vars["stateKey"]
 			return SendEvent(req, device, vars["roomID"], vars["eventType"], nil, &stateKey, cfg, rsAPI, nil)
-		}),
+		})),
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
-		return Register(req, userAPI, accountDB, cfg)
+		return Register(req, userAPI, rsAPI, accountDB, uiaSessions, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	v1mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
-		return LegacyRegister(req, userAPI, cfg)
+		return LegacyRegister(req, userAPI, rsAPI, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil); r != nil {
 			return *r
 		}
 		return RegisterAvailable(req, cfg, accountDB)
@@ -300,7 +323,7 @@ func Setup(
 		httputil.MakeExternalAPI("directory_room", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return DirectoryRoom(req, vars["roomAlias"], federation, cfg, rsAPI, federationSender)
 		}),
@@ -310,7 +333,7 @@ func Setup(
 		httputil.MakeAuthAPI("directory_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SetLocalAlias(req, device, vars["roomAlias"], cfg, rsAPI)
 		}),
@@ -320,7 +343,7 @@ func Setup(
 		httputil.MakeAuthAPI("directory_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return RemoveLocalAlias(req, device, vars["roomAlias"], rsAPI)
 		}),
@@ -329,7 +352,7 @@ func Setup(
 		httputil.MakeExternalAPI("directory_list", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetVisibility(req, rsAPI, vars["roomID"])
 		}),
@@ -339,9 +362,18 @@ func Setup(
 		httputil.MakeAuthAPI("directory_list", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return SetVisibility(req, rsAPI, device, vars["roomID"])
+			return SetVisibility(req, rsAPI, device, vars["roomID"], cfg)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/directory/list/appservice/{networkID}/{roomID}",
+		httputil.MakeExternalAPI("directory_list_appservice", func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return SetVisibilityAsAppService(req, rsAPI, cfg, vars["roomID"], vars["networkID"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/publicRooms",
@@ -364,32 +396,33 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
 		httputil.MakeAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return SendTyping(req, device, vars["roomID"], vars["userID"], accountDB, eduAPI, rsAPI)
+			return SendTyping(req, device, vars["roomID"], vars["userID"], cfg, accountDB, eduAPI, rsAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI)
+			return SendRedaction(req, device, vars["roomID"], vars["eventID"], nil, cfg, rsAPI, nil)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}/{txnId}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return SendRedaction(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI)
+			txnID := vars["txnId"]
+			return SendRedaction(req, device, vars["roomID"], vars["eventID"], &txnID, cfg, rsAPI, transactionsCache)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -397,7 +430,7 @@ func Setup(
 		httputil.MakeAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			txnID := vars["txnID"]
 			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
@@ -411,34 +444,32 @@ func Setup(
 		httputil.MakeAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			txnID := vars["txnID"]
 			return SendToDevice(req, device, eduAPI, transactionsCache, vars["eventType"], &txnID)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	whoamiCache := newWhoamiCache()
 	r0mux.Handle("/account/whoami",
-		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
-				return *r
-			}
-			return Whoami(req, device)
+		httputil.MakeExternalAPI("whoami", func(req *http.Request) util.JSONResponse {
+			return Whoami(req, userAPI, accountDB, whoamiCache, rateLimits)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/account/password",
 		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
-			return Password(req, userAPI, accountDB, device, cfg)
+			return Password(req, userAPI, accountDB, uiaSessions, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/account/deactivate",
 		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return Deactivate(req, userInteractiveAuth, userAPI, device)
@@ -449,17 +480,26 @@ func Setup(
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, nil); r != nil {
 				return *r
 			}
-			return Login(req, accountDB, userAPI, cfg)
+			return Login(req, accountDB, userAPI, uiaSessions, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	unstableMux.Handle("/org.matrix.msc2918.refresh_token/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil); r != nil {
+				return *r
+			}
+			return Refresh(req, userAPI, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
-			return AuthFallback(w, req, vars["authType"], cfg)
+			return AuthFallback(w, req, vars["authType"], uiaSessions, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
@@ -488,7 +528,7 @@ func Setup(
 		httputil.MakeExternalAPI("profile", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetProfile(req, accountDB, cfg, vars["userID"], asAPI, federation)
 		}),
@@ -498,7 +538,7 @@ func Setup(
 		httputil.MakeExternalAPI("profile_avatar_url", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetAvatarURL(req, accountDB, cfg, vars["userID"], asAPI, federation)
 		}),
@@ -506,12 +546,12 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
 		httputil.MakeAuthAPI("profile_avatar_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SetAvatarURL(req, accountDB, device, vars["userID"], cfg, rsAPI)
 		}),
@@ -523,7 +563,7 @@ func Setup(
 		httputil.MakeExternalAPI("profile_displayname", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetDisplayName(req, accountDB, cfg, vars["userID"], asAPI, federation)
 		}),
@@ -531,12 +571,12 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/displayname",
 		httputil.MakeAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SetDisplayName(req, accountDB, device, vars["userID"], cfg, rsAPI)
 		}),
@@ -562,29 +602,76 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	unstableMux.Handle("/org.matrix.msc2716/rooms/{roomID}/batch_send",
+		httputil.MakeAuthAPI("batch_send", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return BatchSend(req, device, vars["roomID"], cfg, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/account/terms",
+		httputil.MakeAuthAPI("account_terms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetTerms(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/account/terms",
+		httputil.MakeAuthAPI("account_terms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device); r != nil {
+				return *r
+			}
+			return AcceptTerms(req, accountDB, uiaSessions, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/export",
+		httputil.MakeHTMLAPI("export_account", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			device, err := auth.VerifyUserFromRequest(req, userAPI)
+			if err != nil {
+				return err
+			}
+			return ExportAccount(w, req, device.UserID, cfg, userAPI, rsAPI, keyAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
 			return RequestEmailToken(req, accountDB, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	// Riot logs get flooded unless this is handled
 	r0mux.Handle("/presence/{userID}/status",
-		httputil.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+		httputil.MakeAuthAPI("presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
-			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
+			return SetPresence(req, device, vars["userID"], cfg, accountDB)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	r0mux.Handle("/presence/{userID}/status",
+		httputil.MakeAuthAPI("get_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return GetPresence(req, vars["userID"], cfg, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return RequestTurnServer(req, device, cfg)
@@ -615,7 +702,7 @@ func Setup(
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SaveAccountData(req, userAPI, device, vars["userID"], "", vars["type"], syncProducer)
 		}),
@@ -625,7 +712,7 @@ func Setup(
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SaveAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
 		}),
@@ -635,7 +722,7 @@ func Setup(
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], "", vars["type"])
 		}),
@@ -645,7 +732,7 @@ func Setup(
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"])
 		}),
@@ -653,7 +740,7 @@ func Setup(
 
 	r0mux.Handle("/user_directory/search",
 		httputil.MakeAuthAPI("userdirectory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			postContent := struct {
@@ -676,34 +763,34 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/members",
+	r0mux.Handle("/rooms/{roomID}/joined_members",
 		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return GetMemberships(req, device, vars["roomID"], false, cfg, rsAPI)
+			return GetJoinedMembers(req, device, vars["roomID"], cfg, rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/joined_members",
-		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+	unstableMux.Handle("/org.matrix.dendrite/rooms/{roomID}/summary",
+		httputil.MakeAuthAPI("rooms_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
-			return GetMemberships(req, device, vars["roomID"], true, cfg, rsAPI)
+			return GetRoomSummary(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		httputil.MakeAuthAPI("rooms_read_markers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return SaveReadMarker(req, userAPI, rsAPI, syncProducer, device, vars["roomID"])
 		}),
@@ -719,7 +806,7 @@ func Setup(
 		httputil.MakeAuthAPI("get_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetDeviceByID(req, userAPI, device, vars["deviceID"])
 		}),
@@ -729,7 +816,7 @@ func Setup(
 		httputil.MakeAuthAPI("device_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return UpdateDeviceByID(req, userAPI, device, vars["deviceID"])
 		}),
@@ -739,7 +826,7 @@ func Setup(
 		httputil.MakeAuthAPI("delete_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return DeleteDeviceById(req, userInteractiveAuth, userAPI, device, vars["deviceID"])
 		}),
@@ -752,16 +839,6 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	// Stub implementations for sytest
-	r0mux.Handle("/events",
-		httputil.MakeExternalAPI("events", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"chunk": []interface{}{},
-				"start": "",
-				"end":   "",
-			}}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/initialSync",
 		httputil.MakeExternalAPI("initial_sync", func(req *http.Request) util.JSONResponse {
 			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
@@ -774,7 +851,7 @@ func Setup(
 		httputil.MakeAuthAPI("get_tags", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return GetTags(req, userAPI, device, vars["userId"], vars["roomId"], syncProducer)
 		}),
@@ -784,7 +861,7 @@ func Setup(
 		httputil.MakeAuthAPI("put_tag", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return PutTag(req, userAPI, device, vars["userId"], vars["roomId"], vars["tag"], syncProducer)
 		}),
@@ -794,7 +871,7 @@ func Setup(
 		httputil.MakeAuthAPI("delete_tag", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
-				return util.ErrorResponse(err)
+				return jsonerror.ErrorResponse(req.Context(), err)
 			}
 			return DeleteTag(req, userAPI, device, vars["userId"], vars["roomId"], vars["tag"], syncProducer)
 		}),
@@ -802,7 +879,7 @@ func Setup(
 
 	r0mux.Handle("/capabilities",
 		httputil.MakeAuthAPI("capabilities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device); r != nil {
 				return *r
 			}
 			return GetCapabilities(req, rsAPI)
@@ -822,7 +899,17 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/query",
 		httputil.MakeAuthAPI("keys_query", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return QueryKeys(req, keyAPI)
+			return QueryKeys(req, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/keys/device_signing/upload",
+		httputil.MakeAuthAPI("keys_device_signing_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningKeys(req, userInteractiveAuth, keyAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/keys/signatures/upload",
+		httputil.MakeAuthAPI("keys_signatures_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return UploadCrossSigningSignatures(req, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/claim",
@@ -831,3 +918,101 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 }
+
+// SetupAdmin registers the ClientAPI admin HTTP handlers with the given admin
+// router. All of these handlers require the admin token or a server admin's
+// access token. Requests are recorded in the admin audit log by the
+// middleware which the base installs on the admin router.
+func SetupAdmin(
+	adminMux *mux.Router, cfg *config.ClientAPI,
+	accountDB accounts.Database,
+	userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	keyAPI keyserverAPI.KeyInternalAPI,
+) {
+	v1mux := adminMux.PathPrefix("/v1").Subrouter()
+
+	v1mux.Handle("/audit",
+		httputil.MakeAdminAPI("admin_audit", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			return GetAdminAudit(req, accountDB)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/users/{userID}/export",
+		httputil.MakeHTMLAPI("admin_export_account", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if err := httputil.VerifyAdminToken(req, cfg.Matrix.AdminToken); err != nil {
+				return err
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(err.Error()),
+				}
+			}
+			return ExportAccount(w, req, vars["userID"], cfg, userAPI, rsAPI, keyAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/directory/list/room/{roomID}",
+		httputil.MakeAdminAPI("admin_directory_list", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return SetVisibilityAsAdmin(req, rsAPI, vars["roomID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	v1mux.Handle("/users/{userID}/ratelimit",
+		httputil.MakeAdminAPI("admin_ratelimit_override", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return RateLimitOverride(req, cfg, accountDB, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	v1mux.Handle("/users/{userID}/devicelimit",
+		httputil.MakeAdminAPI("admin_devicelimit_override", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return DeviceLimitOverride(req, cfg, accountDB, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	v1mux.Handle("/users/{userID}/admin",
+		httputil.MakeAdminAPI("admin_user_admin", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return UserAdmin(req, cfg, accountDB, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	v1mux.Handle("/users/{userID}/logout",
+		httputil.MakeAdminAPI("admin_logout", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return jsonerror.ErrorResponse(req.Context(), err)
+			}
+			return AdminLogout(req, cfg, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v1mux.Handle("/directory/publications",
+		httputil.MakeAdminAPI("admin_directory_publications", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			return GetPublications(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/retention/rooms",
+		httputil.MakeAdminAPI("admin_retention_rooms", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			return GetRetentionRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+}
@@ -52,6 +52,13 @@ func SendEvent(
 	rsAPI api.RoomserverInternalAPI,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
+	if !cfg.EventTypeFilter.IsEventTypeAllowed(eventType) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Events of type " + eventType + " are not allowed on this server"),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -61,13 +68,6 @@ func SendEvent(
 		}
 	}
 
-	if txnID != nil {
-		// Try to fetch response from transactionsCache
-		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
-			return *res
-		}
-	}
-
 	// create a mutex for the specific user in the specific room
 	// this avoids a situation where events that are received in quick succession are sent to the roomserver in a jumbled order
 	userID := device.UserID
@@ -75,6 +75,15 @@ func SendEvent(
 	mutex.(*sync.Mutex).Lock()
 	defer mutex.(*sync.Mutex).Unlock()
 
+	if txnID != nil {
+		// Try to fetch response from transactionsCache. This is done while
+		// holding the mutex so that a retry which arrives while the original
+		// request is still being processed waits for its response.
+		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
+			return *res
+		}
+	}
+
 	e, resErr := generateSendEvent(req, device, roomID, eventType, stateKey, cfg, rsAPI)
 	if resErr != nil {
 		return *resErr
@@ -88,29 +97,28 @@ func SendEvent(
 		}
 	}
 
-	// pass the new event to the roomserver and receive the correct event ID
-	// event ID in case of duplicate transaction is discarded
-	if err := api.SendEvents(
+	// pass the new event to the roomserver and receive the correct event ID,
+	// which is the ID of the original event in case of a duplicate transaction
+	// that has fallen out of the transactions cache, e.g. after a restart
+	eventID, err := api.SendEventWithTransactionID(
 		req.Context(), rsAPI,
-		api.KindNew,
-		[]gomatrixserverlib.HeaderedEvent{
-			e.Headered(verRes.RoomVersion),
-		},
+		e.Headered(verRes.RoomVersion),
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
-	); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("SendEventWithTransactionID failed")
 		return jsonerror.InternalServerError()
 	}
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
-		"event_id":     e.EventID(),
+		"event_id":     eventID,
 		"room_id":      roomID,
 		"room_version": verRes.RoomVersion,
 	}).Info("Sent event to roomserver")
 
 	res := util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: sendEventResponse{e.EventID()},
+		JSON: sendEventResponse{eventID},
 	}
 	// Add response to transactionsCache
 	if txnID != nil {
@@ -173,7 +181,7 @@ func generateSendEvent(
 		if e.Code == gomatrixserverlib.EventValidationTooLarge {
 			return nil, &util.JSONResponse{
 				Code: http.StatusRequestEntityTooLarge,
-				JSON: jsonerror.BadJSON(e.Error()),
+				JSON: jsonerror.TooLarge(e.Error()),
 			}
 		}
 		return nil, &util.JSONResponse{
@@ -185,6 +193,12 @@ func generateSendEvent(
 		resErr := jsonerror.InternalServerError()
 		return nil, &resErr
 	}
+	if err = eventutil.CheckEventSize(e.JSON(), cfg.Matrix.MaxEventFieldLengths); err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(err.Error()),
+		}
+	}
 
 	// check to see if this user can perform this operation
 	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
@@ -192,6 +206,12 @@ func generateSendEvent(
 		stateEvents[i] = &queryRes.StateEvents[i].Event
 	}
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = eventutil.CheckPowerLevelsChange(&e.Event, &provider); err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
 	if err = gomatrixserverlib.Allowed(e.Event, &provider); err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusForbidden,
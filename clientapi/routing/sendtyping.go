@@ -18,12 +18,20 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/util"
 )
 
+// The typing timeout used when a client doesn't give one, and the longest
+// typing timeout that a client can ask for.
+const (
+	defaultTypingTimeoutMS = 30 * 1000
+	maxTypingTimeoutMS     = 120 * 1000
+)
+
 type typingContentJSON struct {
 	Typing  bool  `json:"typing"`
 	Timeout int64 `json:"timeout"`
@@ -33,7 +41,7 @@ type typingContentJSON struct {
 // sends the typing events to client API typingProducer
 func SendTyping(
 	req *http.Request, device *userapi.Device, roomID string,
-	userID string, accountDB accounts.Database,
+	userID string, cfg *config.ClientAPI, accountDB accounts.Database,
 	eduAPI api.EDUServerInputAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
@@ -57,6 +65,24 @@ func SendTyping(
 		return *resErr
 	}
 
+	if r.Typing {
+		if r.Timeout <= 0 {
+			r.Timeout = defaultTypingTimeoutMS
+		} else if r.Timeout > maxTypingTimeoutMS {
+			r.Timeout = maxTypingTimeoutMS
+		}
+	}
+
+	// Virtual users of application services, such as bridge puppets, only
+	// type when the application service says so, not when some client that
+	// has logged in as them does.
+	if isAppServiceVirtualUser(cfg, userID) && !isAppServiceDevice(device) {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	if err := api.SendTyping(
 		req.Context(), eduAPI, userID, roomID, r.Typing, r.Timeout,
 	); err != nil {
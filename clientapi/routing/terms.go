@@ -0,0 +1,224 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type termsResponse struct {
+	// The accepted version of each policy, keyed by policy ID.
+	Accepted map[string]string `json:"accepted"`
+	// The policies which the user hasn't accepted the current version of,
+	// in the same form as the m.login.terms parameters.
+	Pending map[string]interface{} `json:"pending"`
+}
+
+// termsAuth is the auth dict of a request which may complete the
+// m.login.terms stage.
+type termsAuth struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+}
+
+type acceptTermsRequest struct {
+	Auth termsAuth `json:"auth"`
+}
+
+// GetTerms implements GET /account/terms, which returns the versions of the
+// server's policies that the user has accepted, and the policies which they
+// still need to accept.
+func GetTerms(
+	req *http.Request, accountDB accounts.Database, device *userapi.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	accepted, err := accountDB.GetAcceptedPolicies(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAcceptedPolicies failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: termsResponse{
+			Accepted: accepted,
+			Pending:  pendingPolicies(cfg, accepted),
+		},
+	}
+}
+
+// AcceptTerms implements POST /account/terms, which asks the user to accept
+// the current versions of the server's policies using the m.login.terms
+// auth stage. Users who are already logged in can use it to accept a policy
+// which has changed, before they are made to when they next log in.
+func AcceptTerms(
+	req *http.Request, accountDB accounts.Database, uiaSessions *auth.UIASessions,
+	device *userapi.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var r acceptTermsRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if res := requireTerms(req.Context(), accountDB, uiaSessions, cfg, localpart, r.Auth); res != nil {
+		return *res
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// requireTerms makes sure that the user has accepted the current versions of
+// the server's policies. If they haven't, it returns a user-interactive auth
+// response asking them to complete the m.login.terms stage. Once they have
+// completed it, their acceptance is recorded and nil is returned.
+func requireTerms(
+	ctx context.Context, accountDB accounts.Database, uiaSessions *auth.UIASessions,
+	cfg *config.ClientAPI, localpart string, r termsAuth,
+) *util.JSONResponse {
+	if len(cfg.Terms) == 0 {
+		return nil
+	}
+	accepted, err := accountDB.GetAcceptedPolicies(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAcceptedPolicies failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	pending := pendingPolicies(cfg, accepted)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Retrieve or start the session
+	sessionID := r.Session
+	if sessionID == "" {
+		if sessionID, err = uiaSessions.New(ctx); err != nil {
+			return auth.SessionErrorResponse(ctx, err)
+		}
+	} else if _, err = uiaSessions.Exists(ctx, sessionID); err != nil {
+		return auth.SessionErrorResponse(ctx, err)
+	}
+
+	if r.Type != authtypes.LoginTypeTerms {
+		completedStages, err := getCompletedStages(ctx, uiaSessions, sessionID)
+		if err != nil {
+			return auth.SessionErrorResponse(ctx, err)
+		}
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(
+				sessionID,
+				[]authtypes.Flow{
+					{
+						Stages: []authtypes.LoginType{authtypes.LoginTypeTerms},
+					},
+				},
+				completedStages,
+				map[string]interface{}{
+					authtypes.LoginTypeTerms: map[string]interface{}{"policies": pending},
+				},
+			),
+		}
+	}
+	if err = uiaSessions.AddCompletedStage(ctx, sessionID, authtypes.LoginTypeTerms); err != nil {
+		return auth.SessionErrorResponse(ctx, err)
+	}
+
+	if err = accountDB.SetAcceptedPolicies(ctx, localpart, currentPolicyVersions(cfg), int64(gomatrixserverlib.AsTimestamp(time.Now()))); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SetAcceptedPolicies failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	return nil
+}
+
+// recordAcceptedTerms records that a newly registered user accepted the
+// current versions of the server's policies, if they completed the
+// m.login.terms stage. Failing to do so doesn't fail the registration: the
+// user will just be asked to accept the policies again.
+func recordAcceptedTerms(
+	ctx context.Context, cfg *config.ClientAPI, accountDB accounts.Database,
+	completedStages []authtypes.LoginType, res util.JSONResponse,
+) {
+	if len(cfg.Terms) == 0 || res.Code != http.StatusOK {
+		return
+	}
+	regRes, ok := res.JSON.(registerResponse)
+	if !ok || regRes.UserID == "" {
+		return
+	}
+	completedTerms := false
+	for _, stage := range completedStages {
+		if stage == authtypes.LoginTypeTerms {
+			completedTerms = true
+		}
+	}
+	if !completedTerms {
+		return
+	}
+	logger := util.GetLogger(ctx).WithField("user_id", regRes.UserID)
+	localpart, _, err := gomatrixserverlib.SplitID('@', regRes.UserID)
+	if err != nil {
+		logger.WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return
+	}
+	if err = accountDB.SetAcceptedPolicies(ctx, localpart, currentPolicyVersions(cfg), int64(gomatrixserverlib.AsTimestamp(time.Now()))); err != nil {
+		logger.WithError(err).Error("Failed to record accepted policies on registration")
+	}
+}
+
+// pendingPolicies returns the policies which the user hasn't accepted the
+// current version of, in the same form as the m.login.terms parameters.
+func pendingPolicies(cfg *config.ClientAPI, accepted map[string]string) map[string]interface{} {
+	pending := make(map[string]interface{})
+	for i := range cfg.Terms {
+		policy := &cfg.Terms[i]
+		if accepted[policy.ID] != policy.Version {
+			pending[policy.ID] = policy.Params()
+		}
+	}
+	return pending
+}
+
+// currentPolicyVersions returns the current version of each policy, keyed by
+// policy ID.
+func currentPolicyVersions(cfg *config.ClientAPI) map[string]string {
+	versions := make(map[string]string, len(cfg.Terms))
+	for _, policy := range cfg.Terms {
+		versions[policy.ID] = policy.Version
+	}
+	return versions
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/internal/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+type testTermsAccountDB struct {
+	accounts.Database
+	accepted map[string]map[string]string // localpart -> policy ID -> version
+	sessions map[string]userapi.UIASession
+}
+
+func (d *testTermsAccountDB) GetAccountByPassword(ctx context.Context, localpart, password string) (*userapi.Account, error) {
+	if password != "password" {
+		return nil, errors.New("wrong password")
+	}
+	return &userapi.Account{Localpart: localpart}, nil
+}
+
+func (d *testTermsAccountDB) GetAcceptedPolicies(ctx context.Context, localpart string) (map[string]string, error) {
+	return d.accepted[localpart], nil
+}
+
+func (d *testTermsAccountDB) SetAcceptedPolicies(ctx context.Context, localpart string, versions map[string]string, acceptedTS int64) error {
+	d.accepted[localpart] = versions
+	return nil
+}
+
+func (d *testTermsAccountDB) GetUIASession(ctx context.Context, sessionID string) (*userapi.UIASession, error) {
+	session, ok := d.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (d *testTermsAccountDB) SaveUIASession(ctx context.Context, session *userapi.UIASession) error {
+	d.sessions[session.ID] = *session
+	return nil
+}
+
+func (d *testTermsAccountDB) RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error {
+	return nil
+}
+
+type testTermsUserAPI struct {
+	userapi.UserInternalAPI
+	devices int
+}
+
+func (u *testTermsUserAPI) PerformDeviceCreation(ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse) error {
+	u.devices++
+	res.DeviceCreated = true
+	res.Device = &userapi.Device{ID: "CIRI", UserID: "@" + req.Localpart + ":kaer.morhen", AccessToken: req.AccessToken}
+	return nil
+}
+
+func testTermsConfig() *config.ClientAPI {
+	return &config.ClientAPI{
+		Matrix: &config.Global{ServerName: "kaer.morhen"},
+		Terms: []config.TermsPolicy{{
+			ID:      "privacy_policy",
+			Version: "2.0",
+			Languages: map[string]config.TermsDocument{
+				"en": {Name: "Privacy Policy", URL: "https://kaer.morhen/privacy_policy-2.0.html"},
+			},
+		}},
+	}
+}
+
+func newTestTermsAccountDB() *testTermsAccountDB {
+	return &testTermsAccountDB{
+		accepted: map[string]map[string]string{
+			"ciri": {"privacy_policy": "1.0"},
+		},
+		sessions: map[string]userapi.UIASession{},
+	}
+}
+
+func TestLoginRequiresTerms(t *testing.T) {
+	cfg := testTermsConfig()
+	accountDB := newTestTermsAccountDB()
+	userAPI := &testTermsUserAPI{}
+	uiaSessions := auth.NewUIASessions(accountDB, time.Hour)
+	login := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/r0/login", strings.NewReader(body))
+		return Login(req, accountDB, userAPI, uiaSessions, cfg)
+	}
+	const password = `"type":"m.login.password","identifier":{"type":"m.id.user","user":"ciri"},"password":"password"`
+
+	// A user who accepted an older version of the policy can't log in
+	// without accepting the current one.
+	res := login(`{` + password + `}`)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("login with an outdated policy: got HTTP %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+	uiaRes, ok := res.JSON.(userInteractiveResponse)
+	if !ok || uiaRes.Session == "" || len(uiaRes.Flows) != 1 || uiaRes.Flows[0].Stages[0] != "m.login.terms" {
+		t.Fatalf("got %+v, want a user-interactive auth response with the m.login.terms stage", res.JSON)
+	}
+	if userAPI.devices != 0 {
+		t.Fatalf("a device was created before the policy was accepted")
+	}
+
+	// A wrong password doesn't reveal the policies or accept them.
+	if res = login(`{"type":"m.login.password","user":"ciri","password":"wrong","auth":{"type":"m.login.terms","session":"` + uiaRes.Session + `"}}`); res.Code != http.StatusForbidden {
+		t.Errorf("login with a wrong password: got HTTP %d, want %d", res.Code, http.StatusForbidden)
+	}
+	if got := accountDB.accepted["ciri"]["privacy_policy"]; got != "1.0" {
+		t.Errorf("a failed login accepted policy version %s", got)
+	}
+
+	res = login(`{` + password + `,"auth":{"type":"m.login.terms","session":"` + uiaRes.Session + `"}}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("login accepting the policy: got HTTP %d, want %d: %+v", res.Code, http.StatusOK, res.JSON)
+	}
+	if got := accountDB.accepted["ciri"]["privacy_policy"]; got != "2.0" {
+		t.Errorf("got accepted policy version %q, want 2.0", got)
+	}
+
+	// Once accepted, logging in doesn't ask again.
+	if res = login(`{` + password + `}`); res.Code != http.StatusOK {
+		t.Errorf("login after accepting the policy: got HTTP %d, want %d", res.Code, http.StatusOK)
+	}
+	if userAPI.devices != 2 {
+		t.Errorf("got %d devices created, want 2", userAPI.devices)
+	}
+}
+
+func TestAcceptTerms(t *testing.T) {
+	cfg := testTermsConfig()
+	accountDB := newTestTermsAccountDB()
+	uiaSessions := auth.NewUIASessions(accountDB, time.Hour)
+	device := &userapi.Device{ID: "CIRI", UserID: "@ciri:kaer.morhen"}
+	acceptTerms := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/unstable/org.matrix.dendrite/account/terms", strings.NewReader(body))
+		return AcceptTerms(req, accountDB, uiaSessions, device, cfg)
+	}
+	getTerms := func() termsResponse {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.dendrite/account/terms", nil)
+		return GetTerms(req, accountDB, device, cfg).JSON.(termsResponse)
+	}
+
+	if pending := getTerms().Pending; len(pending) != 1 || pending["privacy_policy"] == nil {
+		t.Fatalf("got pending policies %+v, want privacy_policy", pending)
+	}
+	res := acceptTerms(`{}`)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("got HTTP %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+	session := res.JSON.(userInteractiveResponse).Session
+	if res = acceptTerms(`{"auth":{"type":"m.login.terms","session":"` + session + `"}}`); res.Code != http.StatusOK {
+		t.Fatalf("accepting the policy: got HTTP %d, want %d", res.Code, http.StatusOK)
+	}
+	if terms := getTerms(); len(terms.Pending) != 0 || terms.Accepted["privacy_policy"] != "2.0" {
+		t.Errorf("got %+v, want version 2.0 accepted and nothing pending", terms)
+	}
+	if res = acceptTerms(`{}`); res.Code != http.StatusOK {
+		t.Errorf("with nothing pending: got HTTP %d, want %d", res.Code, http.StatusOK)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -57,7 +58,7 @@ func SearchUserDirectory(
 	}
 	userRes := &userapi.QuerySearchProfilesResponse{}
 	if err := userAPI.QuerySearchProfiles(ctx, userReq, userRes); err != nil {
-		errRes := util.ErrorResponse(fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
+		errRes := jsonerror.ErrorResponse(ctx, fmt.Errorf("userAPI.QuerySearchProfiles: %w", err))
 		return &errRes
 	}
 
@@ -88,7 +89,7 @@ func SearchUserDirectory(
 		}
 		stateRes := &api.QueryKnownUsersResponse{}
 		if err := rsAPI.QueryKnownUsers(ctx, stateReq, stateRes); err != nil {
-			errRes := util.ErrorResponse(fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
+			errRes := jsonerror.ErrorResponse(ctx, fmt.Errorf("rsAPI.QueryKnownUsers: %w", err))
 			return &errRes
 		}
 
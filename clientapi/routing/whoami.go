@@ -13,22 +13,137 @@
 package routing
 
 import (
+	"database/sql"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+// whoamiCacheTime is how long the identity behind an access token is cached
+// for by /account/whoami, which some clients call repeatedly on startup. An
+// access token which has been logged out keeps working for /account/whoami,
+// and only that, for up to this long.
+const whoamiCacheTime = 10 * time.Second
+
 // whoamiResponse represents an response for a `whoami` request
 type whoamiResponse struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id,omitempty"`
+	IsGuest  bool   `json:"is_guest"`
+	// Whether the user is a server admin. This isn't in the spec.
+	IsAdmin bool `json:"org.matrix.dendrite.is_admin"`
+}
+
+type cachedWhoami struct {
+	device   *api.Device
+	response whoamiResponse
+	expires  time.Time
+}
+
+// whoamiCache caches the identities behind access tokens for /account/whoami.
+type whoamiCache struct {
+	entries     map[string]cachedWhoami // access token and application service user ID -> identity
+	mutex       sync.Mutex
+	lastCleaned time.Time
+}
+
+func newWhoamiCache() *whoamiCache {
+	return &whoamiCache{
+		entries:     make(map[string]cachedWhoami),
+		lastCleaned: time.Now(),
+	}
+}
+
+// lookup authenticates the request and returns the identity of the user
+// which made it, from the cache if possible. Only successful lookups are
+// cached, so that clients are always told straight away when their access
+// token has been soft logged out.
+func (c *whoamiCache) lookup(
+	req *http.Request, userAPI api.UserInternalAPI, accountDB accounts.Database,
+) (*cachedWhoami, *util.JSONResponse) {
+	var key string
+	if token, err := auth.ExtractAccessToken(req); err == nil {
+		key = token + "\x00" + req.URL.Query().Get("user_id")
+		c.mutex.Lock()
+		cached, ok := c.entries[key]
+		c.mutex.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return &cached, nil
+		}
+	}
+
+	device, resErr := auth.VerifyUserFromRequest(req, userAPI)
+	if resErr != nil {
+		return nil, resErr
+	}
+	identity := cachedWhoami{
+		device: device,
+		response: whoamiResponse{
+			UserID: device.UserID,
+		},
+		expires: time.Now().Add(whoamiCacheTime),
+	}
+	// Application services don't have real devices.
+	if device.ID != types.AppServiceDeviceID {
+		identity.response.DeviceID = device.ID
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+	account, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	switch err {
+	case nil:
+		identity.response.IsGuest = account.IsGuest
+		identity.response.IsAdmin = account.IsAdmin
+	case sql.ErrNoRows:
+		// Users in the namespace of an application service don't need to
+		// have been registered.
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		jsonErr := jsonerror.InternalServerError()
+		return nil, &jsonErr
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now := time.Now(); now.Sub(c.lastCleaned) > whoamiCacheTime {
+		for k, cached := range c.entries {
+			if now.After(cached.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastCleaned = now
+	}
+	c.entries[key] = identity
+	return &identity, nil
 }
 
 // Whoami implements `/account/whoami` which enables client to query their account user id.
-// https://matrix.org/docs/spec/client_server/r0.3.0.html#get-matrix-client-r0-account-whoami
-func Whoami(req *http.Request, device *api.Device) util.JSONResponse {
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-account-whoami
+func Whoami(
+	req *http.Request, userAPI api.UserInternalAPI, accountDB accounts.Database,
+	cache *whoamiCache, rateLimits *rateLimits,
+) util.JSONResponse {
+	identity, resErr := cache.lookup(req, userAPI, accountDB)
+	if resErr != nil {
+		return *resErr
+	}
+	if r := rateLimits.rateLimit(req, identity.device); r != nil {
+		return *r
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: whoamiResponse{UserID: device.UserID},
+		JSON: identity.response,
 	}
 }
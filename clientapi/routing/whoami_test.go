@@ -0,0 +1,120 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+type testWhoamiUserAPI struct {
+	userapi.UserInternalAPI
+	queries int
+}
+
+func (u *testWhoamiUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
+	u.queries++
+	switch req.AccessToken {
+	case "geralt_token":
+		res.Device = &userapi.Device{ID: "GERALT", UserID: "@geralt:kaer.morhen"}
+	case "ciri_token":
+		res.Device = &userapi.Device{ID: "CIRI", UserID: "@ciri:kaer.morhen"}
+	case "logged_out_token":
+		res.SoftLogout = true
+	}
+	return nil
+}
+
+type testWhoamiAccountDB struct {
+	accounts.Database
+}
+
+func (d *testWhoamiAccountDB) GetAccountByLocalpart(ctx context.Context, localpart string) (*userapi.Account, error) {
+	switch localpart {
+	case "geralt":
+		return &userapi.Account{Localpart: localpart, IsAdmin: true}, nil
+	case "ciri":
+		return &userapi.Account{Localpart: localpart, IsGuest: true}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func TestWhoami(t *testing.T) {
+	userAPI := &testWhoamiUserAPI{}
+	cache := newWhoamiCache()
+	whoami := func(token string) (int, interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/account/whoami", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := Whoami(req, userAPI, &testWhoamiAccountDB{}, cache, &rateLimits{})
+		return res.Code, res.JSON
+	}
+
+	for _, tt := range []struct {
+		token string
+		want  whoamiResponse
+	}{
+		{"geralt_token", whoamiResponse{UserID: "@geralt:kaer.morhen", DeviceID: "GERALT", IsAdmin: true}},
+		{"ciri_token", whoamiResponse{UserID: "@ciri:kaer.morhen", DeviceID: "CIRI", IsGuest: true}},
+	} {
+		code, res := whoami(tt.token)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got HTTP %d, want %d", tt.token, code, http.StatusOK)
+		}
+		if res != tt.want {
+			t.Errorf("%s: got response %+v, want %+v", tt.token, res, tt.want)
+		}
+	}
+
+	queries := userAPI.queries
+	if code, _ := whoami("geralt_token"); code != http.StatusOK {
+		t.Fatalf("got HTTP %d for a cached token, want %d", code, http.StatusOK)
+	}
+	if userAPI.queries != queries {
+		t.Errorf("the access token was looked up again while it was cached")
+	}
+
+	// Soft logouts aren't cached, so that clients find out about them
+	// straight away.
+	for i := 0; i < 2; i++ {
+		if code, _ := whoami("logged_out_token"); code != http.StatusUnauthorized {
+			t.Errorf("got HTTP %d for a soft logged out token, want %d", code, http.StatusUnauthorized)
+		}
+	}
+	if userAPI.queries != queries+2 {
+		t.Errorf("got %d lookups of a soft logged out token, want 2", userAPI.queries-queries)
+	}
+
+	// Expired entries are looked up again.
+	cache.mutex.Lock()
+	for key, cached := range cache.entries {
+		cached.expires = time.Now().Add(-time.Second)
+		cache.entries[key] = cached
+	}
+	cache.mutex.Unlock()
+	queries = userAPI.queries
+	if code, _ := whoami("geralt_token"); code != http.StatusOK {
+		t.Fatalf("got HTTP %d for an expired token, want %d", code, http.StatusOK)
+	}
+	if userAPI.queries != queries+1 {
+		t.Errorf("the access token wasn't looked up again after the cache expired")
+	}
+}
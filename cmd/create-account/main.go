@@ -40,6 +40,7 @@ var (
 	password      = flag.String("password", "", "Optional. The password to register with. If not specified, this account will be password-less.")
 	serverNameStr = flag.String("servername", "localhost", "The Matrix server domain which will form the domain part of the user ID.")
 	accessToken   = flag.String("token", "", "Optional. The desired access_token to have. If not specified, a random access_token will be made.")
+	isAdmin       = flag.Bool("admin", false, "Optional. Make the user a server admin.")
 )
 
 func main() {
@@ -78,6 +79,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *isAdmin {
+		if err = accountDB.SetAccountAdmin(context.Background(), *username, true); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(*database),
 	}, serverName)
@@ -37,9 +37,10 @@ func main() {
 	keyAPI := base.KeyServerHTTPClient()
 
 	clientapi.AddPublicRoutes(
-		base.PublicClientAPIMux, &base.Cfg.ClientAPI, accountDB, federation,
+		base.PublicClientAPIMux, &base.Cfg.ClientAPI, base.MessageBus(), accountDB, federation,
 		rsAPI, eduInputAPI, asQuery, transactions.New(), fsAPI, userAPI, keyAPI, nil,
 	)
+	clientapi.AddAdminRoutes(base.DendriteAdminMux, &base.Cfg.ClientAPI, accountDB, userAPI, rsAPI, keyAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.ClientAPI.InternalAPI.Listen,
@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/util"
+)
+
+type p2pPeer struct {
+	ID            string   `json:"id"`
+	Addresses     []string `json:"addresses"`
+	Connectedness string   `json:"connectedness"`
+}
+
+type p2pPeersResponse struct {
+	Peers []p2pPeer `json:"peers"`
+}
+
+type p2pInfoResponse struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+}
+
+// connectedness returns a friendly name for the libp2p connectedness.
+func connectedness(c network.Connectedness) string {
+	switch c {
+	case network.Connected:
+		return "connected"
+	case network.CanConnect:
+		return "can_connect"
+	case network.CannotConnect:
+		return "cannot_connect"
+	default:
+		return "not_connected"
+	}
+}
+
+// addP2PAdminRoutes adds the admin endpoints for inspecting the libp2p node.
+func addP2PAdminRoutes(router *mux.Router, h host.Host, adminToken string) {
+	router.Handle("/v1/p2p/peers",
+		httputil.MakeAdminAPI("admin_p2p_peers", adminToken, func(req *http.Request) util.JSONResponse {
+			res := p2pPeersResponse{
+				Peers: []p2pPeer{},
+			}
+			for _, id := range h.Peerstore().Peers() {
+				if id == h.ID() {
+					continue
+				}
+				peer := p2pPeer{
+					ID:            id.String(),
+					Addresses:     []string{},
+					Connectedness: connectedness(h.Network().Connectedness(id)),
+				}
+				for _, addr := range h.Peerstore().Addrs(id) {
+					peer.Addresses = append(peer.Addresses, addr.String())
+				}
+				res.Peers = append(res.Peers, peer)
+			}
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}),
+	).Methods(http.MethodGet)
+	router.Handle("/v1/p2p/info",
+		httputil.MakeAdminAPI("admin_p2p_info", adminToken, func(req *http.Request) util.JSONResponse {
+			res := p2pInfoResponse{
+				ID:        h.ID().String(),
+				Addresses: []string{},
+			}
+			for _, addr := range h.Addrs() {
+				res.Addresses = append(res.Addresses, addr.String())
+			}
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}),
+	).Methods(http.MethodGet)
+}
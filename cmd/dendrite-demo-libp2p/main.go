@@ -15,12 +15,14 @@
 package main
 
 import (
+	"context"
 	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -31,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/cmd/dendrite-demo-yggdrasil/embed"
 	"github.com/matrix-org/dendrite/eduserver"
 	"github.com/matrix-org/dendrite/federationsender"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/setup"
@@ -50,8 +53,9 @@ func createKeyDB(
 	db gomatrixserverlib.KeyDatabase,
 ) {
 	mdns := mDNSListener{
-		host:  base.LibP2P,
-		keydb: db,
+		host:          base.LibP2P,
+		keydb:         db,
+		logPeerEvents: base.Base.Cfg.P2P.LogPeerEvents,
 	}
 	serv, err := p2pdisc.NewMdnsService(
 		base.LibP2PContext,
@@ -68,12 +72,12 @@ func createKeyDB(
 func createFederationClient(
 	base *P2PDendrite,
 ) *gomatrixserverlib.FederationClient {
-	fmt.Println("Running in libp2p federation mode")
-	fmt.Println("Warning: Federation with non-libp2p homeservers will not work in this mode yet!")
+	logrus.Info("Running in libp2p federation mode")
+	logrus.Info("Federation with non-libp2p homeservers will use HTTPS")
 	tr := &http.Transport{}
 	tr.RegisterProtocol(
 		"matrix",
-		p2phttp.NewTransport(base.LibP2P, p2phttp.ProtocolOption("/matrix")),
+		newDualRoundTripper(p2phttp.NewTransport(base.LibP2P, p2phttp.ProtocolOption("/matrix"))),
 	)
 	return gomatrixserverlib.NewFederationClientWithTransport(
 		base.Base.Cfg.Global.ServerName, base.Base.Cfg.Global.KeyID,
@@ -95,6 +99,16 @@ func createClient(
 func main() {
 	instanceName := flag.String("name", "dendrite-p2p", "the name of this P2P demo instance")
 	instancePort := flag.Int("port", 8080, "the port that the client API will listen on")
+	enableNATPortMap := flag.Bool("nat-port-map", true, "try to make this node reachable from behind a NAT using UPnP or NAT-PMP")
+	enableNATService := flag.Bool("nat-service", false, "help other nodes to work out whether they are behind a NAT")
+	staticRelays := flag.String("relays", "", "comma-separated multiaddrs of relays to use, instead of discovering them")
+	connLowWater := flag.Int("conn-low-water", 100, "the number of connections to trim down to when there are too many")
+	connHighWater := flag.Int("conn-high-water", 400, "the number of connections above which idle connections are trimmed")
+	logPeerEvents := flag.Bool("log-peers", false, "log peer discovery at info level rather than debug")
+	listenAddresses := flag.String("listen", "", "comma-separated multiaddrs to listen on for libp2p, instead of the defaults")
+	announceAddresses := flag.String("announce", "", "comma-separated public multiaddrs to advertise in addition to the detected ones")
+	transports := flag.String("transports", "tcp,ws", "comma-separated libp2p transports to enable (tcp, ws)")
+	adminToken := flag.String("admin-token", "", "the token to use the admin API, which is disabled if empty")
 	flag.Parse()
 
 	filename := fmt.Sprintf("%s-private.key", *instanceName)
@@ -103,12 +117,12 @@ func main() {
 	if os.IsNotExist(err) {
 		_, privKey, _ = ed25519.GenerateKey(nil)
 		if err = ioutil.WriteFile(filename, privKey, 0600); err != nil {
-			fmt.Printf("Couldn't write private key to file '%s': %s\n", filename, err)
+			logrus.WithError(err).Errorf("Couldn't write private key to file '%s'", filename)
 		}
 	} else {
 		privKey, err = ioutil.ReadFile(filename)
 		if err != nil {
-			fmt.Printf("Couldn't read private key from file '%s': %s\n", filename, err)
+			logrus.WithError(err).Errorf("Couldn't read private key from file '%s'", filename)
 			_, privKey, _ = ed25519.GenerateKey(nil)
 		}
 	}
@@ -119,6 +133,22 @@ func main() {
 	cfg.Global.PrivateKey = privKey
 	cfg.Global.KeyID = gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:%s", *instanceName))
 	cfg.Global.Kafka.UseNaffka = true
+	cfg.Global.AdminToken = *adminToken
+	cfg.P2P.LogPeerEvents = *logPeerEvents
+	if *listenAddresses != "" {
+		cfg.P2P.ListenAddresses = strings.Split(*listenAddresses, ",")
+	}
+	cfg.P2P.Transports = strings.Split(*transports, ",")
+	if *announceAddresses != "" {
+		cfg.P2P.AnnounceAddresses = strings.Split(*announceAddresses, ",")
+	}
+	cfg.P2P.EnableNATPortMap = *enableNATPortMap
+	cfg.P2P.EnableNATService = *enableNATService
+	cfg.P2P.ConnMgr.LowWater = *connLowWater
+	cfg.P2P.ConnMgr.HighWater = *connHighWater
+	if *staticRelays != "" {
+		cfg.P2P.StaticRelays = strings.Split(*staticRelays, ",")
+	}
 	cfg.FederationSender.FederationMaxRetries = 6
 	cfg.UserAPI.AccountDatabase.ConnectionString = config.DataSource(fmt.Sprintf("file:%s-account.db", *instanceName))
 	cfg.UserAPI.DeviceDatabase.ConnectionString = config.DataSource(fmt.Sprintf("file:%s-device.db", *instanceName))
@@ -142,6 +172,7 @@ func main() {
 	keyAPI := keyserver.NewInternalAPI(&base.Base.Cfg.KeyServer, federation)
 	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, nil, keyAPI)
 	keyAPI.SetUserAPI(userAPI)
+	base.Base.SetupAdminAudit(accountDB, userAPI)
 
 	serverKeyAPI := signingkeyserver.NewInternalAPI(
 		&base.Base.Cfg.SigningKeyServer, federation, base.Base.Caches,
@@ -169,11 +200,12 @@ func main() {
 	}
 
 	monolith := setup.Monolith{
-		Config:    base.Base.Cfg,
-		AccountDB: accountDB,
-		Client:    createClient(base),
-		FedClient: federation,
-		KeyRing:   keyRing,
+		Config:     base.Base.Cfg,
+		MessageBus: base.Base.MessageBus(),
+		AccountDB:  accountDB,
+		Client:     createClient(base),
+		FedClient:  federation,
+		KeyRing:    keyRing,
 
 		AppserviceAPI:          asAPI,
 		EDUInternalAPI:         eduInputAPI,
@@ -183,18 +215,25 @@ func main() {
 		UserAPI:                userAPI,
 		KeyAPI:                 keyAPI,
 		ExtPublicRoomsProvider: provider,
+		Shutdown:               base.Base.Shutdown,
 	}
 	monolith.AddAllPublicRoutes(
 		base.Base.PublicClientAPIMux,
 		base.Base.PublicFederationAPIMux,
 		base.Base.PublicKeyAPIMux,
 		base.Base.PublicMediaAPIMux,
+		base.Base.DendriteAdminMux,
 	)
+	monolith.AddAllAdminRoutes(base.Base.DendriteAdminMux)
+
+	addP2PAdminRoutes(base.Base.DendriteAdminMux, base.LibP2P, cfg.Global.AdminToken)
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	httpRouter.Use(httputil.ClientIPMiddleware(cfg.HTTPServer.TrustedProxies))
 	httpRouter.PathPrefix(httputil.InternalPathPrefix).Handler(base.Base.InternalAPIMux)
 	httpRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(base.Base.PublicClientAPIMux)
 	httpRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(base.Base.PublicMediaAPIMux)
+	httpRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(base.Base.DendriteAdminMux)
 	embed.Embed(httpRouter, *instancePort, "Yggdrasil Demo")
 
 	libp2pRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
@@ -223,6 +262,10 @@ func main() {
 		}()
 	}
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	// Serve the APIs until we are asked to stop, and then shut everything
+	// down, leaving the libp2p host until last.
+	base.Base.Shutdown.Register(internal.ShutdownStageP2P, "libp2p host", func(ctx context.Context) error {
+		return base.LibP2P.Close()
+	})
+	base.Base.WaitForShutdown()
 }
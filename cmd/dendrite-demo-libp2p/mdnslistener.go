@@ -16,22 +16,24 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"math"
 
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 type mDNSListener struct {
 	keydb gomatrixserverlib.KeyDatabase
 	host  host.Host
+	// Whether to log peer discovery at info level rather than debug.
+	logPeerEvents bool
 }
 
 func (n *mDNSListener) HandlePeerFound(p peer.AddrInfo) {
 	if err := n.host.Connect(context.Background(), p); err != nil {
-		fmt.Println("Error adding peer", p.ID.String(), "via mDNS:", err)
+		logrus.WithError(err).WithField("peer", p.ID.String()).Warn("Failed to add peer via mDNS")
 	}
 	if pubkey, err := p.ID.ExtractPublicKey(); err == nil {
 		raw, _ := pubkey.Raw()
@@ -50,13 +52,16 @@ func (n *mDNSListener) HandlePeerFound(p peer.AddrInfo) {
 				},
 			},
 		); err != nil {
-			fmt.Println("Failed to store keys:", err)
+			logrus.WithError(err).WithField("peer", p.ID.String()).Warn("Failed to store keys for peer")
 		}
 	}
-	fmt.Println("Discovered", len(n.host.Peerstore().Peers())-1, "other libp2p peer(s):")
-	for _, peer := range n.host.Peerstore().Peers() {
-		if peer != n.host.ID() {
-			fmt.Println("-", peer)
-		}
+	logger := logrus.WithFields(logrus.Fields{
+		"peer":  p.ID.String(),
+		"peers": len(n.host.Peerstore().Peers()) - 1,
+	})
+	if n.logPeerEvents {
+		logger.Info("Discovered libp2p peer via mDNS")
+	} else {
+		logger.Debug("Discovered libp2p peer via mDNS")
 	}
 }
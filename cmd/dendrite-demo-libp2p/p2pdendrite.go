@@ -26,8 +26,16 @@ import (
 
 	"github.com/libp2p/go-libp2p"
 	circuit "github.com/libp2p/go-libp2p-circuit"
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/peer"
 	routing "github.com/libp2p/go-libp2p-core/routing"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 
 	host "github.com/libp2p/go-libp2p-core/host"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -63,13 +71,14 @@ func NewP2PDendrite(cfg *config.Dendrite, componentName string) *P2PDendrite {
 		panic(err)
 	}
 
-	//defaultIP6ListenAddr, _ := multiaddr.NewMultiaddr("/ip6/::/tcp/0")
+	listenOpts, err := listenOptions(&cfg.P2P)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid libp2p listen configuration")
+	}
+
 	var libp2pdht *dht.IpfsDHT
-	libp2p, err := libp2p.New(ctx,
+	options := []libp2p.Option{
 		libp2p.Identity(privKey),
-		libp2p.DefaultListenAddrs,
-		//libp2p.ListenAddrs(defaultIP6ListenAddr),
-		libp2p.DefaultTransports,
 		libp2p.Routing(func(h host.Host) (r routing.PeerRouting, err error) {
 			libp2pdht, err = dht.New(ctx, h)
 			if err != nil {
@@ -81,10 +90,22 @@ func NewP2PDendrite(cfg *config.Dendrite, componentName string) *P2PDendrite {
 		}),
 		libp2p.EnableAutoRelay(),
 		libp2p.EnableRelay(circuit.OptHop),
-	)
+		libp2p.ConnectionManager(connmgr.NewConnManager(
+			cfg.P2P.ConnMgr.LowWater, cfg.P2P.ConnMgr.HighWater, cfg.P2P.ConnMgr.GracePeriod,
+		)),
+	}
+	options = append(options, listenOpts...)
+	natOpts, err := natOptions(&cfg.P2P)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid libp2p NAT traversal configuration")
+	}
+	options = append(options, natOpts...)
+	libp2p, err := libp2p.New(ctx, options...)
 	if err != nil {
 		panic(err)
 	}
+	go logExternalAddrs(ctx, libp2p)
+	registerConnectionMetrics(libp2p)
 
 	libp2ppubsub, err := pubsub.NewFloodSub(context.Background(), libp2p, []pubsub.Option{
 		pubsub.WithMessageSigning(true),
@@ -93,9 +114,11 @@ func NewP2PDendrite(cfg *config.Dendrite, componentName string) *P2PDendrite {
 		panic(err)
 	}
 
-	fmt.Println("Our public key:", privKey.GetPublic())
-	fmt.Println("Our node ID:", libp2p.ID())
-	fmt.Println("Our addresses:", libp2p.Addrs())
+	logrus.WithFields(logrus.Fields{
+		"component": componentName,
+		"node_id":   libp2p.ID().String(),
+		"addresses": libp2p.Addrs(),
+	}).Info("Started libp2p node")
 
 	cfg.Global.ServerName = gomatrixserverlib.ServerName(libp2p.ID().String())
 
@@ -109,6 +132,133 @@ func NewP2PDendrite(cfg *config.Dendrite, componentName string) *P2PDendrite {
 	}
 }
 
+// listenOptions returns the libp2p options for the configured listen
+// addresses and transports.
+func listenOptions(cfg *config.P2P) ([]libp2p.Option, error) {
+	addrs := make([]multiaddr.Multiaddr, 0, len(cfg.ListenAddresses))
+	for _, addr := range cfg.ListenAddresses {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		addrs = append(addrs, ma)
+	}
+	options := []libp2p.Option{
+		libp2p.ListenAddrs(addrs...),
+	}
+	if len(cfg.AnnounceAddresses) > 0 {
+		announce := make([]multiaddr.Multiaddr, 0, len(cfg.AnnounceAddresses))
+		for _, addr := range cfg.AnnounceAddresses {
+			ma, err := multiaddr.NewMultiaddr(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid announce address %q: %w", addr, err)
+			}
+			announce = append(announce, ma)
+		}
+		options = append(options, libp2p.AddrsFactory(func(detected []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return mergeAddrs(detected, announce)
+		}))
+	}
+	for _, transport := range cfg.Transports {
+		switch transport {
+		case "tcp":
+			options = append(options, libp2p.Transport(tcp.NewTCPTransport))
+		case "ws":
+			options = append(options, libp2p.Transport(ws.New))
+		default:
+			return nil, fmt.Errorf("unsupported transport %q, must be one of %v", transport, config.P2PTransports)
+		}
+	}
+	return options, nil
+}
+
+// mergeAddrs returns the detected addresses followed by any of the announced
+// addresses which weren't detected.
+func mergeAddrs(detected, announce []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	addrs := make([]multiaddr.Multiaddr, 0, len(detected)+len(announce))
+	addrs = append(addrs, detected...)
+	for _, a := range announce {
+		found := false
+		for _, d := range detected {
+			if a.Equal(d) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// natOptions returns the libp2p options for relaying and NAT traversal.
+func natOptions(cfg *config.P2P) ([]libp2p.Option, error) {
+	var options []libp2p.Option
+	if cfg.EnableHolePunching {
+		return nil, fmt.Errorf("DCUtR hole punching is not supported by this version of libp2p")
+	}
+	if cfg.EnableNATPortMap {
+		options = append(options, libp2p.NATPortMap())
+	}
+	if cfg.EnableNATService {
+		options = append(options, libp2p.EnableNATService())
+	}
+	if len(cfg.StaticRelays) > 0 {
+		relays := make([]peer.AddrInfo, 0, len(cfg.StaticRelays))
+		for _, relay := range cfg.StaticRelays {
+			addr, err := multiaddr.NewMultiaddr(relay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid static relay %q: %w", relay, err)
+			}
+			info, err := peer.AddrInfoFromP2pAddr(addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid static relay %q: %w", relay, err)
+			}
+			relays = append(relays, *info)
+		}
+		options = append(options, libp2p.StaticRelays(relays))
+	}
+	return options, nil
+}
+
+// registerConnectionMetrics exposes the number of open libp2p connections.
+func registerConnectionMetrics(h host.Host) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "p2p",
+			Name:      "connections",
+			Help:      "Number of open libp2p connections",
+		},
+		func() float64 {
+			return float64(len(h.Network().Conns()))
+		},
+	))
+}
+
+// logExternalAddrs logs our addresses whenever they change, e.g. once our
+// external addresses have been identified or a relay has been found.
+func logExternalAddrs(ctx context.Context, h host.Host) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to subscribe to address updates")
+		return
+	}
+	defer sub.Close() // nolint: errcheck
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			logrus.Infof("Our addresses: %v", h.Addrs())
+		}
+	}
+}
+
 type libP2PValidator struct {
 	KeyBook pstore.KeyBook
 }
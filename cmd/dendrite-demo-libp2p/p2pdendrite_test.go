@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestNATOptions(t *testing.T) {
+	var cfg config.P2P
+	cfg.Defaults()
+	cfg.EnableNATService = true
+	cfg.StaticRelays = []string{"/ip4/203.0.113.1/tcp/4001/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"}
+	options, err := natOptions(&cfg)
+	if err != nil {
+		t.Fatalf("natOptions: %s", err)
+	}
+	if len(options) != 3 {
+		t.Errorf("got %d options, want 3", len(options))
+	}
+
+	for _, relay := range []string{"not a multiaddr", "/ip4/203.0.113.1/tcp/4001"} {
+		cfg.StaticRelays = []string{relay}
+		if _, err = natOptions(&cfg); err == nil {
+			t.Errorf("expected static relay %q to be rejected", relay)
+		}
+	}
+
+	cfg.StaticRelays = nil
+	cfg.EnableHolePunching = true
+	if _, err = natOptions(&cfg); err == nil {
+		t.Errorf("expected hole punching to be rejected")
+	}
+}
@@ -17,7 +17,6 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,6 +26,7 @@ import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 const MaintenanceInterval = time.Second * 10
@@ -86,11 +86,11 @@ func (p *publicRoomsProvider) Interval() {
 	}
 	p.foundRoomsMutex.Unlock()
 	if err := p.AdvertiseRooms(); err != nil {
-		fmt.Println("Failed to advertise room in DHT:", err)
+		logrus.WithError(err).Warn("Failed to advertise rooms in DHT")
 	}
 	p.foundRoomsMutex.RLock()
 	defer p.foundRoomsMutex.RUnlock()
-	fmt.Println("Found", len(p.foundRooms), "room(s), advertised", p.roomsAdvertised.Load(), "room(s)")
+	logrus.Debugf("Found %d room(s), advertised %d room(s)", len(p.foundRooms), p.roomsAdvertised.Load())
 	p.maintenanceTimer = time.AfterFunc(MaintenanceInterval, p.Interval)
 }
 
@@ -112,7 +112,7 @@ func (p *publicRoomsProvider) AdvertiseRooms() error {
 	for _, room := range ourRooms {
 		if j, err := json.Marshal(room); err == nil {
 			if err := p.topic.Publish(context.TODO(), j); err != nil {
-				fmt.Println("Failed to publish public room:", err)
+				logrus.WithError(err).Warn("Failed to publish public room")
 			} else {
 				advertised++
 			}
@@ -133,10 +133,10 @@ func (p *publicRoomsProvider) FindRooms() {
 			time: time.Now(),
 		}
 		if err := json.Unmarshal(msg.Data, &received.room); err != nil {
-			fmt.Println("Unmarshal error:", err)
+			logrus.WithError(err).Warn("Failed to unmarshal discovered room")
 			continue
 		}
-		fmt.Printf("received %+v \n", received)
+		logrus.WithField("room_id", received.room.RoomID).Debug("Discovered public room")
 		p.foundRoomsMutex.Lock()
 		p.foundRooms[received.room.RoomID] = received
 		p.foundRoomsMutex.Unlock()
@@ -0,0 +1,185 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// How long the results of resolving a server name are used for before
+	// the server name is resolved again.
+	resolutionCacheDuration = 30 * time.Minute
+	// How long an HTTPS transport is kept for after it was last used.
+	transportIdleDuration = 10 * time.Minute
+	// How often expired resolutions and idle transports are removed.
+	sweepInterval = time.Minute
+)
+
+// dualRoundTripper sends requests for "matrix://" URLs over libp2p if the
+// server name is a libp2p peer ID, and otherwise over HTTPS to the server
+// found using the normal Matrix server discovery, so that we can federate
+// with both other p2p nodes and regular homeservers.
+type dualRoundTripper struct {
+	p2p         http.RoundTripper
+	resolve     func(gomatrixserverlib.ServerName) ([]gomatrixserverlib.ResolutionResult, error)
+	tlsConfig   *tls.Config // copied for each transport, nil for the defaults
+	mutex       sync.Mutex
+	resolutions map[gomatrixserverlib.ServerName]*cachedResolution
+	transports  map[string]*cachedTransport // TLS server name -> transport
+	nextSweep   time.Time
+}
+
+type cachedResolution struct {
+	results []gomatrixserverlib.ResolutionResult
+	expires time.Time
+}
+
+type cachedTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+func newDualRoundTripper(p2p http.RoundTripper) *dualRoundTripper {
+	return &dualRoundTripper{
+		p2p:         p2p,
+		resolve:     gomatrixserverlib.ResolveServer,
+		resolutions: map[gomatrixserverlib.ServerName]*cachedResolution{},
+		transports:  map[string]*cachedTransport{},
+	}
+}
+
+// isPeerID returns true if the server name is a libp2p peer ID.
+func isPeerID(serverName string) bool {
+	_, err := peer.Decode(serverName)
+	return err == nil
+}
+
+func (d *dualRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isPeerID(req.URL.Host) {
+		return d.p2p.RoundTrip(req)
+	}
+	serverName := gomatrixserverlib.ServerName(req.URL.Host)
+	results, err := d.resolveServer(serverName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", serverName, err)
+	}
+	for _, result := range results {
+		// Make a copy of the request so that the original isn't modified by
+		// a failed attempt.
+		r := req.Clone(req.Context())
+		r.URL.Scheme = "https"
+		r.URL.Host = result.Destination
+		r.Host = string(result.Host)
+		if req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		var resp *http.Response
+		resp, err = d.transport(result.TLSServerName).RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	// None of the addresses worked, so the server may have moved. Resolve it
+	// again next time.
+	d.mutex.Lock()
+	delete(d.resolutions, serverName)
+	d.mutex.Unlock()
+	if err == nil {
+		err = fmt.Errorf("no addresses found for %q", serverName)
+	}
+	return nil, err
+}
+
+// resolveServer returns the addresses for the server name, resolving it only
+// if it hasn't been resolved in the last resolutionCacheDuration.
+func (d *dualRoundTripper) resolveServer(serverName gomatrixserverlib.ServerName) ([]gomatrixserverlib.ResolutionResult, error) {
+	d.mutex.Lock()
+	cached, ok := d.resolutions[serverName]
+	d.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.results, nil
+	}
+	results, err := d.resolve(serverName)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.sweepLocked()
+	d.resolutions[serverName] = &cachedResolution{
+		results: results,
+		expires: time.Now().Add(resolutionCacheDuration),
+	}
+	return results, nil
+}
+
+// transport returns the HTTPS transport for the given TLS server name. There
+// is one transport per server name since the SNI can't be set per request.
+func (d *dualRoundTripper) transport(tlsServerName string) *http.Transport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	cached, ok := d.transports[tlsServerName]
+	if !ok {
+		d.sweepLocked()
+		tlsConfig := &tls.Config{}
+		if d.tlsConfig != nil {
+			tlsConfig = d.tlsConfig.Clone()
+		}
+		tlsConfig.ServerName = tlsServerName
+		cached = &cachedTransport{
+			transport: &http.Transport{
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				IdleConnTimeout:       30 * time.Second,
+				TLSClientConfig:       tlsConfig,
+			},
+		}
+		d.transports[tlsServerName] = cached
+	}
+	cached.lastUsed = time.Now()
+	return cached.transport
+}
+
+// sweepLocked removes expired resolutions and transports which haven't been
+// used for transportIdleDuration, so that the maps don't grow with every
+// server that we have ever talked to. The mutex must be held.
+func (d *dualRoundTripper) sweepLocked() {
+	now := time.Now()
+	if now.Before(d.nextSweep) {
+		return
+	}
+	d.nextSweep = now.Add(sweepInterval)
+	for serverName, cached := range d.resolutions {
+		if !now.Before(cached.expires) {
+			delete(d.resolutions, serverName)
+		}
+	}
+	for tlsServerName, cached := range d.transports {
+		if now.Sub(cached.lastUsed) >= transportIdleDuration {
+			cached.transport.CloseIdleConnections()
+			delete(d.transports, tlsServerName)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// newTestRoundTripper returns a dualRoundTripper which resolves every server
+// name to the given HTTPS server, and the number of times that it has done so.
+func newTestRoundTripper(server *httptest.Server) (*dualRoundTripper, *int) {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	resolves := 0
+	d := newDualRoundTripper(nil)
+	d.tlsConfig = &tls.Config{RootCAs: roots}
+	d.resolve = func(serverName gomatrixserverlib.ServerName) ([]gomatrixserverlib.ResolutionResult, error) {
+		resolves++
+		return []gomatrixserverlib.ResolutionResult{{
+			Destination:   server.Listener.Addr().String(),
+			Host:          serverName,
+			TLSServerName: "example.com", // in the httptest certificate
+		}}, nil
+	}
+	return d, &resolves
+}
+
+func roundTrip(t *testing.T, d *dualRoundTripper, url string) error {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	resp, err := d.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	return nil
+}
+
+func TestDualRoundTripperCachesResolution(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "example.com" {
+			t.Errorf("got Host %q, want example.com", req.Host)
+		}
+	}))
+	defer server.Close()
+	d, resolves := newTestRoundTripper(server)
+
+	for i := 0; i < 3; i++ {
+		if err := roundTrip(t, d, "matrix://example.com/_matrix/key/v2/server"); err != nil {
+			t.Fatalf("request %d failed: %s", i, err)
+		}
+	}
+	if *resolves != 1 {
+		t.Errorf("resolved the server name %d times, want 1", *resolves)
+	}
+
+	d.resolutions["example.com"].expires = time.Now()
+	if err := roundTrip(t, d, "matrix://example.com/_matrix/key/v2/server"); err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	if *resolves != 2 {
+		t.Errorf("resolved the server name %d times after the resolution expired, want 2", *resolves)
+	}
+}
+
+func TestDualRoundTripperResolvesAgainAfterFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	d, resolves := newTestRoundTripper(server)
+	server.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := roundTrip(t, d, "matrix://example.com/_matrix/key/v2/server"); err == nil {
+			t.Fatalf("expected request %d to a closed server to fail", i)
+		}
+	}
+	if *resolves != 2 {
+		t.Errorf("resolved the server name %d times, want 2", *resolves)
+	}
+}
+
+func TestDualRoundTripperExpiresTransports(t *testing.T) {
+	d := newDualRoundTripper(nil)
+	idle := d.transport("idle.example.com")
+	d.transport("busy.example.com")
+	d.resolutions["expired.example.com"] = &cachedResolution{expires: time.Now()}
+	d.resolutions["current.example.com"] = &cachedResolution{expires: time.Now().Add(time.Minute)}
+	d.transports["idle.example.com"].lastUsed = time.Now().Add(-transportIdleDuration)
+
+	// Sweeps only happen once every sweepInterval.
+	d.transport("new.example.com")
+	if len(d.transports) != 3 {
+		t.Fatalf("expected no transports to be removed before the next sweep, got %d", len(d.transports))
+	}
+
+	d.nextSweep = time.Now()
+	d.transport("another.example.com")
+	if _, ok := d.transports["idle.example.com"]; ok {
+		t.Errorf("expected the idle transport to be removed")
+	}
+	if len(d.transports) != 3 {
+		t.Errorf("got %d transports, want 3", len(d.transports))
+	}
+	if _, ok := d.resolutions["expired.example.com"]; ok {
+		t.Errorf("expected the expired resolution to be removed")
+	}
+	if _, ok := d.resolutions["current.example.com"]; !ok {
+		t.Errorf("expected the current resolution to be kept")
+	}
+	if d.transport("idle.example.com") == idle {
+		t.Errorf("expected a new transport for a server name after its transport was removed")
+	}
+}
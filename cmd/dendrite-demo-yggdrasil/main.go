@@ -99,6 +99,7 @@ func main() {
 	keyAPI := keyserver.NewInternalAPI(&base.Cfg.KeyServer, federation)
 	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, nil, keyAPI)
 	keyAPI.SetUserAPI(userAPI)
+	base.SetupAdminAudit(accountDB, userAPI)
 
 	rsComponent := roomserver.NewInternalAPI(
 		base, keyRing,
@@ -129,11 +130,12 @@ func main() {
 	rsComponent.SetFederationSenderAPI(fsAPI)
 
 	monolith := setup.Monolith{
-		Config:    base.Cfg,
-		AccountDB: accountDB,
-		Client:    ygg.CreateClient(base),
-		FedClient: federation,
-		KeyRing:   keyRing,
+		Config:     base.Cfg,
+		MessageBus: base.MessageBus(),
+		AccountDB:  accountDB,
+		Client:     ygg.CreateClient(base),
+		FedClient:  federation,
+		KeyRing:    keyRing,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -150,6 +152,7 @@ func main() {
 		base.PublicFederationAPIMux,
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
+		base.DendriteAdminMux,
 	)
 
 	httpRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
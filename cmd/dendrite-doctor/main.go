@@ -0,0 +1,327 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	federationsenderpostgres "github.com/matrix-org/dendrite/federationsender/storage/postgres"
+	federationsendersqlite3 "github.com/matrix-org/dendrite/federationsender/storage/sqlite3"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	roomserverpostgres "github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	roomserversqlite3 "github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	keydbpostgres "github.com/matrix-org/dendrite/signingkeyserver/storage/postgres"
+	keydbsqlite3 "github.com/matrix-org/dendrite/signingkeyserver/storage/sqlite3"
+	accountspostgres "github.com/matrix-org/dendrite/userapi/storage/accounts/postgres"
+	accountssqlite3 "github.com/matrix-org/dendrite/userapi/storage/accounts/sqlite3"
+	devicespostgres "github.com/matrix-org/dendrite/userapi/storage/devices/postgres"
+	devicessqlite3 "github.com/matrix-org/dendrite/userapi/storage/devices/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+	nats "github.com/nats-io/nats.go"
+	"golang.org/x/crypto/ed25519"
+)
+
+const usage = `Usage: %s
+
+Check that a Dendrite deployment is set up correctly. Every check is run and
+the results are printed, and the exit status is non-zero if any check failed.
+
+Arguments:
+
+`
+
+var (
+	configPath = flag.String("config", "dendrite.yaml", "The path to the config file")
+	monolith   = flag.Bool("monolith", true, "Whether the config is for a monolith rather than a polylith deployment")
+	tlsCert    = flag.String("tls-cert", "", "The PEM formatted X509 certificate used for TLS, if any")
+	tlsKey     = flag.String("tls-key", "", "The PEM private key used for TLS, if any")
+	federation = flag.Bool("federation", true, "Whether to check that this server can be reached over federation")
+	timeout    = flag.Duration("timeout", 30*time.Second, "How long to wait for each network check")
+)
+
+// check is a single diagnostic. It returns a short description of what was
+// found if it passes.
+type check struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath, *monolith)
+	if err != nil {
+		report("config", "", err)
+		os.Exit(1)
+	}
+
+	checks := []check{
+		{"config", func(context.Context) (string, error) { return checkConfig(cfg) }},
+		{"signing key", func(context.Context) (string, error) { return checkSigningKey(cfg) }},
+	}
+	for _, db := range databases(cfg) {
+		db := db
+		checks = append(checks, check{"database " + db.name, func(ctx context.Context) (string, error) {
+			return checkDatabase(ctx, db.options, db.migrations)
+		}})
+	}
+	checks = append(checks, check{"kafka", func(ctx context.Context) (string, error) {
+		return checkKafka(ctx, &cfg.Global.Kafka)
+	}})
+	if *tlsCert != "" || *tlsKey != "" {
+		checks = append(checks, check{"tls certificate", func(context.Context) (string, error) {
+			return checkTLSCertificate(cfg.Global.ServerName, *tlsCert, *tlsKey)
+		}})
+	}
+	if *federation {
+		checks = append(checks, check{"federation", func(ctx context.Context) (string, error) {
+			return checkFederation(ctx, cfg)
+		}})
+	}
+
+	failed := 0
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		result, err := c.run(ctx)
+		cancel()
+		report(c.name, result, err)
+		if err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed\n", failed, len(checks))
+		os.Exit(1)
+	}
+	fmt.Printf("\nAll %d checks passed\n", len(checks))
+}
+
+func report(name, result string, err error) {
+	if err != nil {
+		fmt.Printf("[FAIL] %s: %s\n", name, err)
+		return
+	}
+	fmt.Printf("[ OK ] %s: %s\n", name, result)
+}
+
+func checkConfig(cfg *config.Dendrite) (string, error) {
+	configErrs := &config.ConfigErrors{}
+	cfg.Verify(configErrs, *monolith)
+	if len(*configErrs) > 0 {
+		return "", fmt.Errorf("%d problems: %s", len(*configErrs), configErrs.Error())
+	}
+	return "valid", nil
+}
+
+// checkSigningKey makes sure that the signing key can produce signatures
+// which verify with its public key.
+func checkSigningKey(cfg *config.Dendrite) (string, error) {
+	if cfg.Global.PrivateKey == nil {
+		return "", fmt.Errorf("no signing key was loaded from %q", cfg.Global.PrivateKeyPath)
+	}
+	message := []byte("dendrite-doctor")
+	publicKey := cfg.Global.PrivateKey.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(publicKey, message, ed25519.Sign(cfg.Global.PrivateKey, message)) {
+		return "", fmt.Errorf("signatures made with the key in %q don't verify", cfg.Global.PrivateKeyPath)
+	}
+	return fmt.Sprintf("%s with public key %s", cfg.Global.KeyID, base64.RawStdEncoding.EncodeToString(publicKey)), nil
+}
+
+// migrations are the schema migrations of a component for each database
+// engine, which tell us the newest schema version that this binary knows.
+type migrations struct {
+	postgres func() *sqlutil.Migrations
+	sqlite3  func() *sqlutil.Migrations
+}
+
+type namedDatabase struct {
+	name       string
+	options    *config.DatabaseOptions
+	migrations []migrations
+}
+
+// databases returns the databases used by the components, with databases
+// that are shared between components only listed once.
+func databases(cfg *config.Dendrite) []namedDatabase {
+	all := []namedDatabase{
+		{"account", &cfg.UserAPI.AccountDatabase, []migrations{{accountspostgres.Migrations, accountssqlite3.Migrations}}},
+		{"device", &cfg.UserAPI.DeviceDatabase, []migrations{{devicespostgres.Migrations, devicessqlite3.Migrations}}},
+		{"appservice", &cfg.AppServiceAPI.Database, nil},
+		{"federationsender", &cfg.FederationSender.Database, []migrations{{federationsenderpostgres.Migrations, federationsendersqlite3.Migrations}}},
+		{"keyserver", &cfg.KeyServer.Database, nil},
+		{"mediaapi", &cfg.MediaAPI.Database, nil},
+		{"roomserver", &cfg.RoomServer.Database, []migrations{{roomserverpostgres.Migrations, roomserversqlite3.Migrations}}},
+		{"signingkeyserver", &cfg.SigningKeyServer.Database, []migrations{{keydbpostgres.Migrations, keydbsqlite3.Migrations}}},
+		{"syncapi", &cfg.SyncAPI.Database, nil},
+	}
+	var unique []namedDatabase
+	seen := map[config.DataSource]int{}
+	for _, db := range all {
+		if i, ok := seen[db.options.ConnectionString]; ok {
+			unique[i].name += ", " + db.name
+			unique[i].migrations = append(unique[i].migrations, db.migrations...)
+			continue
+		}
+		seen[db.options.ConnectionString] = len(unique)
+		unique = append(unique, db)
+	}
+	return unique
+}
+
+// checkDatabase connects to the database and reports the schema version of
+// each component that has recorded one. It fails if a component's schema is
+// newer than the given migrations, as Dendrite would refuse to start.
+func checkDatabase(ctx context.Context, options *config.DatabaseOptions, known []migrations) (string, error) {
+	db, err := sqlutil.Open(options)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close() // nolint: errcheck
+	if err = db.PingContext(ctx); err != nil {
+		return "", fmt.Errorf("failed to connect: %w", err)
+	}
+	versions, err := sqlutil.SchemaVersions(ctx, db, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to read schema versions: %w", err)
+	}
+	for _, k := range known {
+		m := k.postgres()
+		if options.ConnectionString.IsSQLite() {
+			m = k.sqlite3()
+		}
+		if version, ok := versions[m.Component()]; ok && version > m.Latest() {
+			return "", fmt.Errorf(
+				"the %q schema is at version %d but this version of Dendrite only knows about version %d",
+				m.Component(), version, m.Latest(),
+			)
+		}
+	}
+	if len(versions) == 0 {
+		return "connected", nil
+	}
+	var components []string
+	for component, version := range versions {
+		components = append(components, fmt.Sprintf("%s %d", component, version))
+	}
+	sort.Strings(components)
+	return "connected, schema versions " + strings.Join(components, ", "), nil
+}
+
+func checkKafka(ctx context.Context, cfg *config.Kafka) (string, error) {
+	switch cfg.ProviderName() {
+	case config.ProviderNATS:
+		if len(cfg.NATS.Addresses) == 0 {
+			return "using NATS server started by dendrite", nil
+		}
+		nc, err := nats.Connect(strings.Join(cfg.NATS.Addresses, ","), nats.Timeout(*timeout))
+		if err != nil {
+			return "", fmt.Errorf("failed to connect to %v: %w", cfg.NATS.Addresses, err)
+		}
+		defer nc.Close()
+		return fmt.Sprintf("connected to NATS server %s", nc.ConnectedServerId()), nil
+	case config.ProviderNaffka:
+		if cfg.NaffkaInMemory {
+			return "using in-memory naffka", nil
+		}
+		result, err := checkDatabase(ctx, &cfg.Database, nil)
+		if err != nil {
+			return "", fmt.Errorf("naffka database: %w", err)
+		}
+		return "naffka database " + result, nil
+	}
+	sc := sarama.NewConfig()
+	sc.Net.DialTimeout = *timeout
+	client, err := sarama.NewClient(cfg.Addresses, sc)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %v: %w", cfg.Addresses, err)
+	}
+	defer client.Close() // nolint: errcheck
+	topics, err := client.Topics()
+	if err != nil {
+		return "", fmt.Errorf("failed to list topics: %w", err)
+	}
+	return fmt.Sprintf("connected to %d brokers, %d topics", len(client.Brokers()), len(topics)), nil
+}
+
+// checkTLSCertificate makes sure that the certificate and key match, that the
+// certificate is currently valid and that it covers the server name.
+func checkTLSCertificate(serverName gomatrixserverlib.ServerName, certFile, keyFile string) (string, error) {
+	if certFile == "" || keyFile == "" {
+		return "", fmt.Errorf("both --tls-cert and --tls-key must be supplied")
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("certificate isn't valid until %s", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return "", fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+	if err = cert.VerifyHostname(string(serverName)); err != nil {
+		return "", fmt.Errorf("%w (this is expected if federation is delegated with .well-known or SRV records)", err)
+	}
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return fmt.Sprintf("self-signed, valid until %s", cert.NotAfter), nil
+	}
+	return fmt.Sprintf("valid until %s", cert.NotAfter), nil
+}
+
+// checkFederation fetches our own server keys over federation, in the same
+// way as other servers would, and makes sure they match our signing key.
+func checkFederation(ctx context.Context, cfg *config.Dendrite) (string, error) {
+	client := gomatrixserverlib.NewFederationClient(
+		cfg.Global.ServerName, cfg.Global.KeyID, cfg.Global.PrivateKey,
+		cfg.FederationSender.DisableTLSValidation,
+	)
+	keys, err := client.GetServerKeys(ctx, cfg.Global.ServerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch keys for %s: %w", cfg.Global.ServerName, err)
+	}
+	if keys.ServerName != cfg.Global.ServerName {
+		return "", fmt.Errorf("keys were returned for %s instead of %s", keys.ServerName, cfg.Global.ServerName)
+	}
+	verifyKey, ok := keys.VerifyKeys[cfg.Global.KeyID]
+	if !ok {
+		return "", fmt.Errorf("the key %s is not being served, is another server answering for %s?", cfg.Global.KeyID, cfg.Global.ServerName)
+	}
+	if !bytes.Equal(verifyKey.Key, cfg.Global.PrivateKey.Public().(ed25519.PublicKey)) {
+		return "", fmt.Errorf("the key %s being served doesn't match the signing key", cfg.Global.KeyID)
+	}
+	return fmt.Sprintf("%s serves the key %s", cfg.Global.ServerName, cfg.Global.KeyID), nil
+}
@@ -37,6 +37,7 @@ func main() {
 		&base.Cfg.FederationAPI, userAPI, federation, keyRing,
 		rsAPI, fsAPI, base.EDUServerClient(), keyAPI,
 	)
+	federationapi.AddAdminRoutes(base.DendriteAdminMux, &base.Cfg.FederationAPI, fsAPI)
 
 	base.SetupAndServeHTTP(
 		base.Cfg.FederationAPI.InternalAPI.Listen,
@@ -111,6 +111,7 @@ func main() {
 	keyAPI := keyserver.NewInternalAPI(&base.Cfg.KeyServer, fsAPI)
 	userAPI := userapi.NewInternalAPI(accountDB, &cfg.UserAPI, cfg.Derived.ApplicationServices, keyAPI)
 	keyAPI.SetUserAPI(userAPI)
+	base.SetupAdminAudit(accountDB, userAPI)
 
 	eduInputAPI := eduserver.NewInternalAPI(
 		base, cache.New(), userAPI,
@@ -127,11 +128,12 @@ func main() {
 	}
 
 	monolith := setup.Monolith{
-		Config:    base.Cfg,
-		AccountDB: accountDB,
-		Client:    base.CreateClient(),
-		FedClient: federation,
-		KeyRing:   keyRing,
+		Config:     base.Cfg,
+		MessageBus: base.MessageBus(),
+		AccountDB:  accountDB,
+		Client:     base.CreateClient(),
+		FedClient:  federation,
+		KeyRing:    keyRing,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -140,13 +142,16 @@ func main() {
 		ServerKeyAPI:        skAPI,
 		UserAPI:             userAPI,
 		KeyAPI:              keyAPI,
+		Shutdown:            base.Shutdown,
 	}
 	monolith.AddAllPublicRoutes(
 		base.PublicClientAPIMux,
 		base.PublicFederationAPIMux,
 		base.PublicKeyAPIMux,
 		base.PublicMediaAPIMux,
+		base.DendriteAdminMux,
 	)
+	monolith.AddAllAdminRoutes(base.DendriteAdminMux)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
 	go func() {
@@ -167,6 +172,7 @@ func main() {
 		}()
 	}
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	// Let the HTTP and HTTPS handlers serve the APIs until we are asked to
+	// stop, and then shut everything down in order.
+	base.WaitForShutdown()
 }
@@ -31,9 +31,9 @@ func main() {
 	rsAPI := base.RoomserverHTTPClient()
 
 	syncapi.AddPublicRoutes(
-		base.PublicClientAPIMux, userAPI, rsAPI,
+		base.PublicClientAPIMux, base.DendriteAdminMux, userAPI, rsAPI,
 		base.KeyServerHTTPClient(),
-		federation, &cfg.SyncAPI,
+		federation, &cfg.SyncAPI, base.MessageBus(), base.Shutdown,
 	)
 
 	base.SetupAndServeHTTP(
@@ -5,20 +5,40 @@ import (
 	"fmt"
 
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
 	"gopkg.in/yaml.v2"
 )
 
+// header is written before the generated config. yaml.Marshal can't keep
+// comments, so point people at the sample config which documents everything.
+const header = `# Dendrite configuration, generated by generate-config.
+#
+# Every option is described in dendrite-config.yaml in the Dendrite repository.
+# The signing key referenced by global.private_key can be generated with:
+#
+#   generate-keys --private-key %s
+#
+`
+
 func main() {
 	defaultsForCI := flag.Bool("ci", false, "sane defaults for CI testing")
+	serverName := flag.String("server", "", "The domain name of the server, if not 'localhost'")
+	privateKey := flag.String("private-key", "", "The path to the server signing key, if not 'matrix_key.pem'")
 	flag.Parse()
 
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
+	if *serverName != "" {
+		cfg.Global.ServerName = gomatrixserverlib.ServerName(*serverName)
+	}
+	if *privateKey != "" {
+		cfg.Global.PrivateKeyPath = config.Path(*privateKey)
+	}
 	cfg.Global.TrustedIDServers = []string{
 		"matrix.org",
 		"vector.im",
 	}
-	cfg.Logging = []config.LogrusHook{
+	cfg.Logging.Hooks = []config.LogrusHook{
 		{
 			Type:  "file",
 			Level: "info",
@@ -70,5 +90,6 @@ func main() {
 		panic(err)
 	}
 
+	fmt.Printf(header, cfg.Global.PrivateKeyPath)
 	fmt.Println(string(j))
 }
@@ -35,8 +35,21 @@ var (
 	tlsCertFile    = flag.String("tls-cert", "", "An X509 certificate file to generate for use for TLS")
 	tlsKeyFile     = flag.String("tls-key", "", "An RSA private key file to generate for use for TLS")
 	privateKeyFile = flag.String("private-key", "", "An Ed25519 private key to generate for use for object signing")
+	force          = flag.Bool("force", false, "Overwrite key files which already exist")
 )
 
+// checkNotExists exits if the file exists, so that keys aren't overwritten by
+// accident. Replacing the signing key of a server which is already federating
+// causes other servers to reject its events until they see the new key.
+func checkNotExists(path string) {
+	if *force {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		log.Fatalf("%s already exists, use --force to overwrite it", path)
+	}
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, usage, os.Args[0])
@@ -50,6 +63,12 @@ func main() {
 		return
 	}
 
+	for _, path := range []string{*tlsCertFile, *tlsKeyFile, *privateKeyFile} {
+		if path != "" {
+			checkNotExists(path)
+		}
+	}
+
 	if *tlsCertFile != "" || *tlsKeyFile != "" {
 		if *tlsCertFile == "" || *tlsKeyFile == "" {
 			log.Fatal("Zero or both of --tls-key and --tls-cert must be supplied")
@@ -62,9 +81,11 @@ func main() {
 	}
 
 	if *privateKeyFile != "" {
-		if err := test.NewMatrixKey(*privateKeyFile); err != nil {
+		keyID, err := test.GenerateMatrixKey(*privateKeyFile)
+		if err != nil {
 			panic(err)
 		}
 		fmt.Printf("Created private key file: %s\n", *privateKeyFile)
+		fmt.Printf("Private key ID:           %s\n", keyID)
 	}
 }
@@ -45,7 +45,7 @@ func NewInternalAPI(
 
 	_, producer := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
 
-	return &input.EDUServerInputAPI{
+	inputAPI := &input.EDUServerInputAPI{
 		Cache:                        eduCache,
 		UserAPI:                      userAPI,
 		Producer:                     producer,
@@ -53,4 +53,8 @@ func NewInternalAPI(
 		OutputSendToDeviceEventTopic: string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent)),
 		ServerName:                   cfg.Matrix.ServerName,
 	}
+	// Tell everyone else when local users stop typing because they timed out,
+	// as well as when they stop typing explicitly.
+	eduCache.SetTimeoutCallback(inputAPI.OnTypingTimeout)
+	return inputAPI
 }
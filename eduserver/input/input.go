@@ -65,6 +65,27 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	return t.sendTypingEvent(ite)
 }
 
+// OnTypingTimeout is called by the typing cache when a user's typing timeout
+// expires. Local users are sent out as having stopped typing, so that the
+// other servers in the room stop showing them as typing too.
+func (t *EDUServerInputAPI) OnTypingTimeout(userID, roomID string, latestSyncPosition int64) {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil || domain != t.ServerName {
+		return
+	}
+	if err = t.sendTypingEvent(&api.InputTypingEvent{
+		UserID:         userID,
+		RoomID:         roomID,
+		Typing:         false,
+		OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"room_id": roomID,
+			"user_id": userID,
+		}).Error("Failed to send typing timeout")
+	}
+}
+
 // InputTypingEvent implements api.EDUServerInputAPI
 func (t *EDUServerInputAPI) InputSendToDeviceEvent(
 	ctx context.Context,
@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testProducer struct {
+	events chan api.OutputTypingEvent
+}
+
+func (p *testProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	var ote api.OutputTypingEvent
+	if err = json.Unmarshal(value, &ote); err != nil {
+		return 0, 0, err
+	}
+	p.events <- ote
+	return 0, 0, nil
+}
+
+func (p *testProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *testProducer) Close() error {
+	return nil
+}
+
+func TestTypingTimeoutSendsStoppedTyping(t *testing.T) {
+	producer := &testProducer{events: make(chan api.OutputTypingEvent, 10)}
+	eduCache := cache.New()
+	inputAPI := &EDUServerInputAPI{
+		Cache:      eduCache,
+		Producer:   producer,
+		ServerName: "kaer.morhen",
+	}
+	eduCache.SetTimeoutCallback(inputAPI.OnTypingTimeout)
+
+	for _, userID := range []string{"@geralt:kaer.morhen", "@ciri:white.orchard"} {
+		if err := inputAPI.InputTypingEvent(context.Background(), &api.InputTypingEventRequest{
+			InputTypingEvent: api.InputTypingEvent{
+				UserID:         userID,
+				RoomID:         "!room:kaer.morhen",
+				Typing:         true,
+				TimeoutMS:      50,
+				OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+			},
+		}, &api.InputTypingEventResponse{}); err != nil {
+			t.Fatalf("InputTypingEvent failed: %s", err)
+		}
+		if ote := <-producer.events; !ote.Event.Typing {
+			t.Fatalf("got a stopped typing event for %s, want a typing event", userID)
+		}
+	}
+
+	// Only local users are sent out as having stopped typing, since the
+	// servers of remote users tell everyone about them.
+	select {
+	case ote := <-producer.events:
+		if ote.Event.Typing || ote.Event.UserID != "@geralt:kaer.morhen" || ote.Event.RoomID != "!room:kaer.morhen" {
+			t.Errorf("got typing event %+v, want @geralt:kaer.morhen to stop typing", ote.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the typing timeout")
+	}
+	select {
+	case ote := <-producer.events:
+		t.Errorf("got unexpected typing event %+v", ote.Event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// algorithmVerifier is a gomatrixserverlib.JSONVerifier which only accepts
+// JSON that the server signed with a key using one of the allowed
+// algorithms. Everything else is passed on to the wrapped verifier. This
+// covers both inbound events and the X-Matrix auth of inbound requests.
+type algorithmVerifier struct {
+	gomatrixserverlib.JSONVerifier
+	allowed map[string]bool
+}
+
+func newAlgorithmVerifier(keys gomatrixserverlib.JSONVerifier, algorithms []string) gomatrixserverlib.JSONVerifier {
+	allowed := make(map[string]bool, len(algorithms))
+	for _, alg := range algorithms {
+		allowed[alg] = true
+	}
+	return &algorithmVerifier{
+		JSONVerifier: keys,
+		allowed:      allowed,
+	}
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (v *algorithmVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	toVerify := make([]gomatrixserverlib.VerifyJSONRequest, 0, len(requests))
+	indices := make([]int, 0, len(requests))
+	for i := range requests {
+		if err := v.checkAlgorithms(&requests[i]); err != nil {
+			results[i].Error = err
+			continue
+		}
+		toVerify = append(toVerify, requests[i])
+		indices = append(indices, i)
+	}
+	if len(toVerify) == 0 {
+		return results, nil
+	}
+	verified, err := v.JSONVerifier.VerifyJSONs(ctx, toVerify)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range indices {
+		results[i] = verified[j]
+	}
+	return results, nil
+}
+
+// checkAlgorithms returns an error unless the server signed the JSON with
+// at least one key using an allowed algorithm.
+func (v *algorithmVerifier) checkAlgorithms(request *gomatrixserverlib.VerifyJSONRequest) error {
+	var message struct {
+		Signatures map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(request.Message, &message); err != nil {
+		return err
+	}
+	for keyID := range message.Signatures[request.ServerName] {
+		algorithm := strings.SplitN(string(keyID), ":", 2)[0]
+		if v.allowed[algorithm] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s didn't sign the JSON with an allowed signing key algorithm", request.ServerName)
+}
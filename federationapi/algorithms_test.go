@@ -0,0 +1,55 @@
+package federationapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type acceptAllVerifier struct {
+	verified int
+}
+
+func (v *acceptAllVerifier) VerifyJSONs(
+	_ context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	v.verified += len(requests)
+	return make([]gomatrixserverlib.VerifyJSONResult, len(requests)), nil
+}
+
+func TestAlgorithmVerifier(t *testing.T) {
+	inner := &acceptAllVerifier{}
+	verifier := newAlgorithmVerifier(inner, []string{"ed25519"})
+	requests := []gomatrixserverlib.VerifyJSONRequest{
+		{
+			ServerName: "remote.example.com",
+			Message:    []byte(`{"signatures":{"remote.example.com":{"ed25519:auto":"sig"}}}`),
+		},
+		{
+			ServerName: "remote.example.com",
+			Message:    []byte(`{"signatures":{"remote.example.com":{"ed448:auto":"sig"}}}`),
+		},
+		{
+			ServerName: "remote.example.com",
+			Message:    []byte(`{"signatures":{"remote.example.com":{"ed448:auto":"sig","ed25519:auto":"sig"}}}`),
+		},
+		{
+			ServerName: "remote.example.com",
+			Message:    []byte(`{"signatures":{"other.example.com":{"ed25519:auto":"sig"}}}`),
+		},
+	}
+	results, err := verifier.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatalf("VerifyJSONs failed: %s", err)
+	}
+	wantAccepted := []bool{true, false, true, false}
+	for i, want := range wantAccepted {
+		if accepted := results[i].Error == nil; accepted != want {
+			t.Errorf("request %d: got accepted %v, want %v (error: %v)", i, accepted, want, results[i].Error)
+		}
+	}
+	if inner.verified != 2 {
+		t.Errorf("expected 2 requests to be passed on for verification, got %d", inner.verified)
+	}
+}
@@ -41,7 +41,17 @@ func AddPublicRoutes(
 ) {
 	routing.Setup(
 		fedRouter, keyRouter, cfg, rsAPI,
-		eduAPI, federationSenderAPI, keyRing,
+		eduAPI, federationSenderAPI,
+		newAlgorithmVerifier(newVerifyKeyRing(keyRing), cfg.AllowedSignatureAlgorithms),
 		federation, userAPI, keyAPI,
 	)
 }
+
+// AddAdminRoutes sets up and registers the FederationAPI admin HTTP handlers.
+func AddAdminRoutes(
+	adminMux *mux.Router,
+	cfg *config.FederationAPI,
+	federationSenderAPI federationSenderAPI.FederationSenderInternalAPI,
+) {
+	routing.SetupAdmin(adminMux, cfg, federationSenderAPI)
+}
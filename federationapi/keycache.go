@@ -0,0 +1,186 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+)
+
+// VerifyKeyCacheTTL is how long a server key that was used to verify an
+// inbound federation request is kept in memory. Keys are never kept beyond
+// their own validity period.
+const VerifyKeyCacheTTL = time.Minute
+
+var (
+	verifyKeyCacheHits   atomic.Int64
+	verifyKeyCacheMisses atomic.Int64
+)
+
+var verifyKeyCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "verify_key_cache_lookups_total",
+		Help:      "Number of server key lookups made when verifying federation requests, by cache result",
+	},
+	[]string{"result"},
+)
+
+var verifyKeyCacheHitRatio = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "verify_key_cache_hit_ratio",
+		Help:      "Ratio of server key lookups made when verifying federation requests that were served from the cache",
+	},
+	func() float64 {
+		hits, misses := verifyKeyCacheHits.Load(), verifyKeyCacheMisses.Load()
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	},
+)
+
+func init() {
+	prometheus.MustRegister(verifyKeyCacheLookups, verifyKeyCacheHitRatio)
+}
+
+type verifyKeyCacheEntry struct {
+	result  gomatrixserverlib.PublicKeyLookupResult
+	expires time.Time
+}
+
+// verifyKeyCache is a gomatrixserverlib.KeyDatabase which keeps recently used
+// server keys in memory for a short time, so that a burst of requests from
+// the same server doesn't look up the same key over and over again.
+type verifyKeyCache struct {
+	gomatrixserverlib.KeyDatabase
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[gomatrixserverlib.PublicKeyLookupRequest]verifyKeyCacheEntry
+}
+
+// newVerifyKeyRing returns a copy of the given key verifier which caches keys
+// for VerifyKeyCacheTTL. Verifiers other than a *gomatrixserverlib.KeyRing are
+// returned unchanged.
+func newVerifyKeyRing(keys gomatrixserverlib.JSONVerifier) gomatrixserverlib.JSONVerifier {
+	keyRing, ok := keys.(*gomatrixserverlib.KeyRing)
+	if !ok || keyRing.KeyDatabase == nil {
+		return keys
+	}
+	return &gomatrixserverlib.KeyRing{
+		KeyFetchers: keyRing.KeyFetchers,
+		KeyDatabase: &verifyKeyCache{
+			KeyDatabase: keyRing.KeyDatabase,
+			ttl:         VerifyKeyCacheTTL,
+			entries:     make(map[gomatrixserverlib.PublicKeyLookupRequest]verifyKeyCacheEntry),
+		},
+	}
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (c *verifyKeyCache) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	now := time.Now()
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
+	misses := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp)
+
+	c.mutex.Lock()
+	for req, ts := range requests {
+		entry, ok := c.entries[req]
+		switch {
+		case ok && now.After(entry.expires):
+			delete(c.entries, req)
+			misses[req] = ts
+		case ok && entry.result.WasValidAt(ts, true):
+			results[req] = entry.result
+		default:
+			misses[req] = ts
+		}
+	}
+	c.mutex.Unlock()
+
+	verifyKeyCacheHits.Add(int64(len(results)))
+	verifyKeyCacheMisses.Add(int64(len(misses)))
+	verifyKeyCacheLookups.WithLabelValues("hit").Add(float64(len(results)))
+	verifyKeyCacheLookups.WithLabelValues("miss").Add(float64(len(misses)))
+
+	if len(misses) == 0 {
+		return results, nil
+	}
+	fetched, err := c.KeyDatabase.FetchKeys(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	c.store(fetched)
+	for req, res := range fetched {
+		results[req] = res
+	}
+	return results, nil
+}
+
+// StoreKeys implements gomatrixserverlib.KeyDatabase
+func (c *verifyKeyCache) StoreKeys(
+	ctx context.Context,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	if err := c.KeyDatabase.StoreKeys(ctx, results); err != nil {
+		return err
+	}
+	c.store(results)
+	return nil
+}
+
+// store caches the given keys until the TTL passes or the key stops being
+// valid, whichever is sooner. Keys which have already expired are not cached.
+func (c *verifyKeyCache) store(
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for req, res := range results {
+		expires := now.Add(c.ttl)
+		if res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired {
+			delete(c.entries, req)
+			continue
+		}
+		if validUntil := res.ValidUntilTS.Time(); validUntil.Before(expires) {
+			expires = validUntil
+		}
+		if !expires.After(now) {
+			delete(c.entries, req)
+			continue
+		}
+		c.entries[req] = verifyKeyCacheEntry{
+			result:  res,
+			expires: expires,
+		}
+	}
+	for req, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, req)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package federationapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type countingKeyDatabase struct {
+	result  gomatrixserverlib.PublicKeyLookupResult
+	fetches int
+}
+
+func (d *countingKeyDatabase) FetcherName() string {
+	return "countingKeyDatabase"
+}
+
+func (d *countingKeyDatabase) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	d.fetches++
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for req := range requests {
+		results[req] = d.result
+	}
+	return results, nil
+}
+
+func (d *countingKeyDatabase) StoreKeys(
+	_ context.Context,
+	_ map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+func TestVerifyKeyCache(t *testing.T) {
+	now := time.Now()
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "remote.example.com",
+		KeyID:      "ed25519:auto",
+	}
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		req: gomatrixserverlib.AsTimestamp(now),
+	}
+
+	db := &countingKeyDatabase{
+		result: gomatrixserverlib.PublicKeyLookupResult{
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(now.Add(time.Hour)),
+		},
+	}
+	cache := &verifyKeyCache{
+		KeyDatabase: db,
+		ttl:         time.Minute,
+		entries:     make(map[gomatrixserverlib.PublicKeyLookupRequest]verifyKeyCacheEntry),
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.FetchKeys(context.Background(), requests); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+	if db.fetches != 1 {
+		t.Errorf("expected 1 fetch from the key database, got %d", db.fetches)
+	}
+
+	// A key whose validity ends before the TTL must not outlive its validity.
+	db.fetches = 0
+	db.result.ValidUntilTS = gomatrixserverlib.AsTimestamp(now.Add(-time.Second))
+	cache.entries = make(map[gomatrixserverlib.PublicKeyLookupRequest]verifyKeyCacheEntry)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.FetchKeys(context.Background(), requests); err != nil {
+			t.Fatalf("FetchKeys failed: %s", err)
+		}
+	}
+	if db.fetches != 2 {
+		t.Errorf("expected expired key not to be cached, got %d fetches", db.fetches)
+	}
+}
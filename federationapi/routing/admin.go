@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// SetupAdmin registers the FederationAPI admin HTTP handlers with the given
+// admin router. These require the admin token.
+func SetupAdmin(
+	adminMux *mux.Router, cfg *config.FederationAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+) {
+	v1mux := adminMux.PathPrefix("/v1").Subrouter()
+
+	v1mux.Handle("/federation/servers/{serverName}/approve",
+		httputil.MakeAdminAPI("admin_federation_approve_server", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ApproveServer(req, cfg, fsAPI, gomatrixserverlib.ServerName(vars["serverName"]))
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+}
+
+// ApproveServer implements POST /_dendrite/admin/v1/federation/servers/{serverName}/approve,
+// which takes a server out of quarantine so that its events are no longer
+// soft-failed. The approval is remembered, and can be given before the server
+// has been seen.
+func ApproveServer(
+	req *http.Request, cfg *config.FederationAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if serverName == "" || serverName == cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid server name"),
+		}
+	}
+	if err := fsAPI.PerformApproveServer(req.Context(), &federationSenderAPI.PerformApproveServerRequest{
+		ServerName: serverName,
+	}, &federationSenderAPI.PerformApproveServerResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("fsAPI.PerformApproveServer failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -14,8 +14,13 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -29,15 +34,74 @@ func GetEventAuth(
 	roomID string,
 	eventID string,
 ) util.JSONResponse {
-	// TODO: Optimisation: we shouldn't be querying all the room state
-	// that is in state.StateEvents - we just ignore it.
-	state, err := getState(ctx, request, rsAPI, roomID, eventID)
+	event, resErr := fetchEvent(ctx, rsAPI, eventID)
+	if resErr != nil {
+		return *resErr
+	}
+	if event.RoomID() != roomID {
+		return util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("event does not belong to this room")}
+	}
+	resErr = allowedToSeeEvent(ctx, request.Origin(), rsAPI, eventID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var response api.QueryAuthChainResponse
+	err := rsAPI.QueryAuthChain(ctx, &api.QueryAuthChainRequest{
+		RoomID:   roomID,
+		EventIDs: event.AuthEventIDs(),
+	}, &response)
 	if err != nil {
-		return *err
+		return util.ErrorResponse(err)
+	}
+	if !response.RoomExists {
+		return util.JSONResponse{Code: http.StatusNotFound, JSON: nil}
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: gomatrixserverlib.RespEventAuth{AuthEvents: state.AuthEvents},
+		JSON: gomatrixserverlib.RespEventAuth{
+			AuthEvents: gomatrixserverlib.UnwrapEventHeaders(response.AuthChain),
+		},
+	}
+}
+
+// txnFederation adds requests that gomatrixserverlib doesn't make for us to
+// a FederationClient.
+type txnFederation struct {
+	*gomatrixserverlib.FederationClient
+	cfg *config.Global
+}
+
+// LookupEventAuth requests the auth chain of an event from a remote server.
+// The events are not verified.
+func (f *txnFederation) LookupEventAuth(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string,
+	roomVersion gomatrixserverlib.RoomVersion,
+) ([]gomatrixserverlib.Event, error) {
+	req := gomatrixserverlib.NewFederationRequest(
+		"GET", s, "/_matrix/federation/v1/event_auth/"+url.PathEscape(roomID)+"/"+url.PathEscape(eventID),
+	)
+	if err := req.Sign(f.cfg.ServerName, f.cfg.KeyID, f.cfg.PrivateKey); err != nil {
+		return nil, fmt.Errorf("req.Sign: %w", err)
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, fmt.Errorf("req.HTTPRequest: %w", err)
+	}
+	var res struct {
+		AuthChain []json.RawMessage `json:"auth_chain"`
+	}
+	if err = f.DoRequestAndParseResponse(ctx, httpReq, &res); err != nil {
+		return nil, err
+	}
+	events := make([]gomatrixserverlib.Event, 0, len(res.AuthChain))
+	for _, js := range res.AuthChain {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(js, roomVersion)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.NewEventFromUntrustedJSON: %w", err)
+		}
+		events = append(events, event)
 	}
+	return events, nil
 }
@@ -26,6 +26,7 @@ import (
 	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 // InviteV2 implements /_matrix/federation/v2/invite/{roomID}/{eventID}
@@ -85,9 +86,11 @@ func InviteV1(
 		}
 	}
 	var strippedState []gomatrixserverlib.InviteV2StrippedState
-	if err := json.Unmarshal(event.Unsigned(), &strippedState); err != nil {
-		// just warn, they may not have added any.
-		util.GetLogger(httpReq.Context()).Warnf("failed to extract stripped state from invite event")
+	if inviteRoomState := gjson.GetBytes(event.Unsigned(), "invite_room_state"); inviteRoomState.Exists() {
+		if err = json.Unmarshal([]byte(inviteRoomState.Raw), &strippedState); err != nil {
+			// just warn, the invite is still valid without it.
+			util.GetLogger(httpReq.Context()).WithError(err).Warn("failed to extract stripped state from invite event")
+		}
 	}
 	return processInvite(
 		httpReq.Context(), false, event, roomVer, strippedState, roomID, eventID, cfg, rsAPI, keys,
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -308,6 +309,18 @@ func SendJoin(
 	sort.Sort(eventsByDepth(stateAndAuthChainResponse.StateEvents))
 	sort.Sort(eventsByDepth(stateAndAuthChainResponse.AuthChainEvents))
 
+	// The joining server can ask for a partial state response, in which case
+	// we leave out most of the membership events. This is MSC3706.
+	if omitMembers, _ := strconv.ParseBool(httpReq.URL.Query().Get("omit_members")); omitMembers {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: partialStateSendJoinResponse(
+				cfg.Matrix.ServerName, *event.StateKey(), event.AuthEventIDs(),
+				stateAndAuthChainResponse.StateEvents, stateAndAuthChainResponse.AuthChainEvents,
+			),
+		}
+	}
+
 	// https://matrix.org/docs/spec/server_server/latest#put-matrix-federation-v1-send-join-roomid-eventid
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -319,6 +332,116 @@ func SendJoin(
 	}
 }
 
+// respPartialStateSendJoin is the response to /send_join when the joining
+// server asked for the membership events to be omitted.
+type respPartialStateSendJoin struct {
+	StateEvents    []gomatrixserverlib.Event    `json:"state"`
+	AuthEvents     []gomatrixserverlib.Event    `json:"auth_chain"`
+	Origin         gomatrixserverlib.ServerName `json:"origin"`
+	MembersOmitted bool                         `json:"members_omitted"`
+	ServersInRoom  []string                     `json:"servers_in_room"`
+}
+
+// maxPartialStateHeroes is the number of membership events which are kept in
+// a partial state response so that the joining server can name the room.
+const maxPartialStateHeroes = 5
+
+// partialStateSendJoinResponse builds a /send_join response without the
+// membership events of the room, other than those of the joining user and
+// of the room heroes if the room has no name or canonical alias. The auth
+// chain is reduced to the events needed to auth the remaining state and the
+// join event, leaving out any events which are already in the state.
+func partialStateSendJoinResponse(
+	origin gomatrixserverlib.ServerName, joiningUserID string, joinAuthEventIDs []string,
+	stateEvents, authChainEvents []gomatrixserverlib.HeaderedEvent,
+) respPartialStateSendJoin {
+	named := false
+	servers := make(map[string]struct{})
+	var members []gomatrixserverlib.HeaderedEvent
+	for _, ev := range stateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias:
+			named = true
+		case gomatrixserverlib.MRoomMember:
+			membership, err := ev.Membership()
+			if err != nil || ev.StateKey() == nil {
+				continue
+			}
+			if membership == gomatrixserverlib.Join {
+				if _, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey()); err == nil {
+					servers[string(domain)] = struct{}{}
+				}
+			}
+			if *ev.StateKey() != joiningUserID && (membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite) {
+				members = append(members, ev)
+			}
+		}
+	}
+
+	// Pick the heroes in the same way as the room summary in /sync would,
+	// by sorting the members by user ID.
+	keep := map[string]bool{}
+	if !named {
+		sort.Slice(members, func(i, j int) bool {
+			return *members[i].StateKey() < *members[j].StateKey()
+		})
+		for i := 0; i < len(members) && i < maxPartialStateHeroes; i++ {
+			keep[members[i].EventID()] = true
+		}
+	}
+	state := []gomatrixserverlib.Event{}
+	inState := make(map[string]bool)
+	for _, ev := range stateEvents {
+		if ev.Type() == gomatrixserverlib.MRoomMember && !ev.StateKeyEquals(joiningUserID) && !keep[ev.EventID()] {
+			continue
+		}
+		state = append(state, ev.Unwrap())
+		inState[ev.EventID()] = true
+	}
+
+	// Walk the auth chain from the remaining state and the join event.
+	authChain := make(map[string]gomatrixserverlib.Event, len(authChainEvents))
+	for _, ev := range authChainEvents {
+		authChain[ev.EventID()] = ev.Unwrap()
+	}
+	needed := make(map[string]bool)
+	queue := append([]string{}, joinAuthEventIDs...)
+	for _, ev := range state {
+		queue = append(queue, ev.AuthEventIDs()...)
+	}
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		if needed[eventID] {
+			continue
+		}
+		needed[eventID] = true
+		if ev, ok := authChain[eventID]; ok {
+			queue = append(queue, ev.AuthEventIDs()...)
+		}
+	}
+	auth := []gomatrixserverlib.Event{}
+	for _, ev := range authChainEvents {
+		if needed[ev.EventID()] && !inState[ev.EventID()] {
+			auth = append(auth, ev.Unwrap())
+		}
+	}
+
+	serversInRoom := make([]string, 0, len(servers))
+	for server := range servers {
+		serversInRoom = append(serversInRoom, server)
+	}
+	sort.Strings(serversInRoom)
+
+	return respPartialStateSendJoin{
+		StateEvents:    state,
+		AuthEvents:     auth,
+		Origin:         origin,
+		MembersOmitted: true,
+		ServersInRoom:  serversInRoom,
+	}
+}
+
 type eventsByDepth []gomatrixserverlib.HeaderedEvent
 
 func (e eventsByDepth) Len() int {
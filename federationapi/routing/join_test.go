@@ -0,0 +1,53 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPartialStateSendJoinResponse(t *testing.T) {
+	// testEvents[:5] are the create, membership, join rules, history
+	// visibility and power levels events of the room.
+	state := append([]gomatrixserverlib.HeaderedEvent{}, testEvents[:5]...)
+	member := testEvents[1]
+
+	res := partialStateSendJoinResponse("kaer.morhen", "@bob:remote", nil, state, state)
+	if !res.MembersOmitted {
+		t.Errorf("members_omitted is not set")
+	}
+	if len(res.ServersInRoom) != 1 || res.ServersInRoom[0] != "kaer.morhen" {
+		t.Errorf("got servers_in_room %v want [kaer.morhen]", res.ServersInRoom)
+	}
+	if len(res.StateEvents) != len(state) {
+		t.Errorf("unnamed room: got %d state events want %d, heroes should be kept", len(res.StateEvents), len(state))
+	}
+	if len(res.AuthEvents) != 0 {
+		t.Errorf("got %d auth chain events want 0, events in the state should be left out", len(res.AuthEvents))
+	}
+
+	name, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"name":"Kaer Morhen"},"depth":5,"event_id":"$name:kaer.morhen","origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","state_key":"","type":"m.room.name"}`), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create name event: %s", err)
+	}
+	state = append(state, name.Headered(testRoomVersion))
+
+	res = partialStateSendJoinResponse("kaer.morhen", "@bob:remote", nil, state, state)
+	for _, ev := range res.StateEvents {
+		if ev.EventID() == member.EventID() {
+			t.Errorf("named room: membership event %s should have been omitted", member.EventID())
+		}
+	}
+	if len(res.StateEvents) != len(state)-1 {
+		t.Errorf("named room: got %d state events want %d", len(res.StateEvents), len(state)-1)
+	}
+	// The membership event is still needed to auth the remaining state.
+	if len(res.AuthEvents) != 1 || res.AuthEvents[0].EventID() != member.EventID() {
+		t.Errorf("named room: auth chain should contain only the omitted membership event, got %d events", len(res.AuthEvents))
+	}
+
+	res = partialStateSendJoinResponse("kaer.morhen", "@userid:kaer.morhen", nil, state, state)
+	if len(res.StateEvents) != len(state) {
+		t.Errorf("the joining user's own membership event should be kept")
+	}
+}
@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
@@ -71,8 +74,10 @@ func QueryDeviceKeys(
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
-			DeviceKeys interface{} `json:"device_keys"`
-		}{queryRes.DeviceKeys},
+			DeviceKeys      interface{}                `json:"device_keys"`
+			MasterKeys      map[string]json.RawMessage `json:"master_keys,omitempty"`
+			SelfSigningKeys map[string]json.RawMessage `json:"self_signing_keys,omitempty"`
+		}{queryRes.DeviceKeys, queryRes.MasterKeys, queryRes.SelfSigningKeys},
 	}
 }
 
@@ -171,9 +176,105 @@ func localKeys(cfg *config.FederationAPI, validUntil time.Time) (*gomatrixserver
 	return &keys, nil
 }
 
+const (
+	// The most servers whose keys the notary keeps cached. The least
+	// recently used are forgotten first.
+	notaryKeyCacheMaxEntries = 1024
+	// How long keys are served from the cache before they are fetched again,
+	// even if they are valid for longer, so that revoked keys don't linger.
+	notaryKeyCacheTTL = time.Hour
+)
+
+// notaryKeyCache holds the keys of remote servers that have been fetched on
+// behalf of notary requests, along with the origin server's signatures. Keys
+// are only served from the cache while they are still valid and for no
+// longer than the TTL after they were fetched.
+type notaryKeyCache struct {
+	keys *lru.Cache // gomatrixserverlib.ServerName -> notaryKeyCacheEntry
+	ttl  time.Duration
+}
+
+type notaryKeyCacheEntry struct {
+	keys      gomatrixserverlib.ServerKeys
+	fetchedAt time.Time
+}
+
+func newNotaryKeyCache(maxEntries int, ttl time.Duration) (*notaryKeyCache, error) {
+	keys, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &notaryKeyCache{keys: keys, ttl: ttl}, nil
+}
+
+// get returns the cached keys for the server if they are valid until at
+// least the given time.
+func (c *notaryKeyCache) get(serverName gomatrixserverlib.ServerName, validUntil gomatrixserverlib.Timestamp) (gomatrixserverlib.ServerKeys, bool) {
+	value, ok := c.keys.Get(serverName)
+	if !ok {
+		return gomatrixserverlib.ServerKeys{}, false
+	}
+	entry := value.(notaryKeyCacheEntry)
+	if time.Since(entry.fetchedAt) > c.ttl {
+		c.keys.Remove(serverName)
+		return gomatrixserverlib.ServerKeys{}, false
+	}
+	if entry.keys.ValidUntilTS < validUntil {
+		return gomatrixserverlib.ServerKeys{}, false
+	}
+	return entry.keys, true
+}
+
+func (c *notaryKeyCache) store(keys gomatrixserverlib.ServerKeys) {
+	c.keys.Add(keys.ServerName, notaryKeyCacheEntry{keys: keys, fetchedAt: time.Now()})
+}
+
+// fetchNotaryKeys returns the keys of a remote server, from the cache if they
+// are valid until at least minimumValidUntil, otherwise from the server
+// itself. Keys which aren't signed by the server with every one of its
+// current keys, or which have expired, are never returned.
+func fetchNotaryKeys(
+	ctx context.Context, fsAPI federationSenderAPI.FederationSenderInternalAPI, cache *notaryKeyCache,
+	serverName gomatrixserverlib.ServerName, minimumValidUntil gomatrixserverlib.Timestamp,
+) (*gomatrixserverlib.ServerKeys, error) {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	if minimumValidUntil < now {
+		minimumValidUntil = now
+	}
+	if keys, ok := cache.get(serverName, minimumValidUntil); ok {
+		return &keys, nil
+	}
+	keys, err := fsAPI.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if keys.ServerName != serverName {
+		return nil, fmt.Errorf("keys are for %q instead", keys.ServerName)
+	}
+	if keys.ValidUntilTS < now {
+		return nil, fmt.Errorf("keys expired at %d", keys.ValidUntilTS)
+	}
+	if len(keys.VerifyKeys) == 0 {
+		return nil, fmt.Errorf("no verify keys")
+	}
+	for keyID, verifyKey := range keys.VerifyKeys {
+		if err = gomatrixserverlib.VerifyJSON(
+			string(serverName), keyID, ed25519.PublicKey(verifyKey.Key), keys.Raw,
+		); err != nil {
+			return nil, fmt.Errorf("keys not signed with %q: %w", keyID, err)
+		}
+	}
+	cache.store(keys)
+	return &keys, nil
+}
+
+// NotaryKeys implements /_matrix/key/v2/query, returning the keys of the
+// requested servers countersigned by this server. Keys of remote servers are
+// only returned if this server is configured to act as a key notary.
 func NotaryKeys(
 	httpReq *http.Request, cfg *config.FederationAPI,
 	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	cache *notaryKeyCache,
 	req *gomatrixserverlib.PublicKeyNotaryLookupRequest,
 ) util.JSONResponse {
 	if req == nil {
@@ -188,7 +289,7 @@ func NotaryKeys(
 	}
 	response.ServerKeys = []json.RawMessage{}
 
-	for serverName := range req.ServerKeys {
+	for serverName, criteria := range req.ServerKeys {
 		var keys *gomatrixserverlib.ServerKeys
 		if serverName == cfg.Matrix.ServerName {
 			if k, err := localKeys(cfg, time.Now().Add(cfg.Matrix.KeyValidityPeriod)); err == nil {
@@ -197,14 +298,23 @@ func NotaryKeys(
 				return util.ErrorResponse(err)
 			}
 		} else {
-			if k, err := fsAPI.GetServerKeys(httpReq.Context(), serverName); err == nil {
-				keys = &k
-			} else {
-				return util.ErrorResponse(err)
+			if !cfg.KeyNotary {
+				continue
 			}
-		}
-		if keys == nil {
-			continue
+			// Use the latest minimum validity asked for across the key IDs.
+			var minimumValidUntil gomatrixserverlib.Timestamp
+			for _, c := range criteria {
+				if c.MinimumValidUntilTS > minimumValidUntil {
+					minimumValidUntil = c.MinimumValidUntilTS
+				}
+			}
+			k, err := fetchNotaryKeys(httpReq.Context(), fsAPI, cache, serverName, minimumValidUntil)
+			if err != nil {
+				// Leave this server out rather than failing the whole request.
+				logrus.WithError(err).Warnf("Failed to fetch keys for %q", serverName)
+				continue
+			}
+			keys = k
 		}
 
 		j, err := json.Marshal(keys)
@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func testNotaryKeys(serverName gomatrixserverlib.ServerName, validFor time.Duration) gomatrixserverlib.ServerKeys {
+	var keys gomatrixserverlib.ServerKeys
+	keys.ServerName = serverName
+	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(time.Now().Add(validFor))
+	return keys
+}
+
+func TestNotaryKeyCacheValidity(t *testing.T) {
+	cache, err := newNotaryKeyCache(10, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	cache.store(testNotaryKeys("a.test", time.Minute))
+	if _, ok := cache.get("a.test", gomatrixserverlib.AsTimestamp(time.Now())); !ok {
+		t.Errorf("expected valid keys to be cached")
+	}
+	if _, ok := cache.get("a.test", gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))); ok {
+		t.Errorf("expected keys which aren't valid for long enough not to be returned")
+	}
+}
+
+func TestNotaryKeyCacheExpiresAfterTTL(t *testing.T) {
+	cache, err := newNotaryKeyCache(10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	cache.store(testNotaryKeys("a.test", time.Hour))
+	if _, ok := cache.get("a.test", gomatrixserverlib.AsTimestamp(time.Now())); !ok {
+		t.Fatalf("expected keys to be cached")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.get("a.test", gomatrixserverlib.AsTimestamp(time.Now())); ok {
+		t.Errorf("expected keys to be fetched again once the TTL has passed, even though they are still valid")
+	}
+	if cache.keys.Len() != 0 {
+		t.Errorf("expected expired keys to be removed from the cache")
+	}
+}
+
+func TestNotaryKeyCacheIsBounded(t *testing.T) {
+	cache, err := newNotaryKeyCache(2, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	cache.store(testNotaryKeys("a.test", time.Hour))
+	cache.store(testNotaryKeys("b.test", time.Hour))
+	// Use a.test, so that b.test is the least recently used.
+	if _, ok := cache.get("a.test", 0); !ok {
+		t.Fatalf("expected keys for a.test to be cached")
+	}
+	cache.store(testNotaryKeys("c.test", time.Hour))
+	if cache.keys.Len() != 2 {
+		t.Errorf("expected 2 cached servers, got %d", cache.keys.Len())
+	}
+	if _, ok := cache.get("b.test", 0); ok {
+		t.Errorf("expected the least recently used server to be evicted")
+	}
+	for _, serverName := range []gomatrixserverlib.ServerName{"a.test", "c.test"} {
+		if _, ok := cache.get(serverName, 0); !ok {
+			t.Errorf("expected keys for %s to be cached", serverName)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
-	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -23,16 +25,19 @@ type filter struct {
 }
 
 // GetPostPublicRooms implements GET and POST /publicRooms
-func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI) util.JSONResponse {
+func GetPostPublicRooms(
+	req *http.Request, fedReq *gomatrixserverlib.FederationRequest, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
 	var request PublicRoomReq
-	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+	if fillErr := fillPublicRoomsReq(req, fedReq, &request); fillErr != nil {
 		return *fillErr
 	}
-	if request.Limit == 0 {
+	if request.Limit <= 0 {
 		request.Limit = 50
 	}
-	response, err := publicRooms(req.Context(), request, rsAPI)
+	response, err := publicRooms(req.Context(), request, fedReq.Origin(), rsAPI)
 	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("failed to work out public rooms")
 		return jsonerror.InternalServerError()
 	}
 	return util.JSONResponse{
@@ -42,137 +47,127 @@ func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.RoomserverInterna
 }
 
 func publicRooms(
-	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.RoomserverInternalAPI,
+	ctx context.Context, request PublicRoomReq, origin gomatrixserverlib.ServerName, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) (*gomatrixserverlib.RespPublicRooms, error) {
-
-	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
+	response := gomatrixserverlib.RespPublicRooms{
+		Chunk: []gomatrixserverlib.PublicRoom{},
+	}
+	offset, err := strconv.Atoi(request.Since)
+	// Atoi returns 0 and an error when trying to parse an empty string
 	// In that case, we want to assign 0 so we ignore the error
 	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
 		return nil, err
 	}
+	if offset < 0 {
+		offset = 0
+	}
 
 	var queryRes roomserverAPI.QueryPublishedRoomsResponse
 	err = rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{}, &queryRes)
 	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
 		return nil, err
 	}
-	response.TotalRoomCountEstimate = len(queryRes.RoomIDs)
+	// Don't advertise rooms that the requesting server isn't allowed to
+	// join, either because of server ACLs or because they aren't federated.
+	roomIDs := make([]string, 0, len(queryRes.RoomIDs))
+	for _, roomID := range queryRes.RoomIDs {
+		if !roomserverAPI.IsServerBannedFromRoom(ctx, rsAPI, roomID, origin) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	rooms, err := roomserverAPI.PopulatePublicRooms(ctx, roomIDs, rsAPI)
+	if err != nil {
+		return nil, err
+	}
+	response.TotalRoomCountEstimate = len(rooms)
+
+	// Sort the rooms so that pagination tokens refer to the same position
+	// between requests, busiest rooms first.
+	sort.SliceStable(rooms, func(i, j int) bool {
+		if rooms[i].JoinedMembersCount != rooms[j].JoinedMembersCount {
+			return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	rooms = filterRooms(rooms, request.Filter.SearchTerms)
 
+	// The tokens are prefixed with 'T' in the same way as the client API.
+	limit := int(request.Limit)
 	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		response.PrevBatch = "T" + strconv.Itoa(prev)
 	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
+	nextIndex := offset + limit
+	if len(rooms) > nextIndex {
+		response.NextBatch = "T" + strconv.Itoa(nextIndex)
+	} else {
+		nextIndex = len(rooms)
 	}
+	if offset < nextIndex {
+		response.Chunk = rooms[offset:nextIndex]
+	}
+	return &response, nil
+}
 
-	if offset < 0 {
-		offset = 0
+func filterRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
+	if searchTerm == "" {
+		return rooms
 	}
-	if nextIndex > len(queryRes.RoomIDs) {
-		nextIndex = len(queryRes.RoomIDs)
+
+	normalizedTerm := strings.ToLower(searchTerm)
+
+	result := make([]gomatrixserverlib.PublicRoom, 0)
+	for _, room := range rooms {
+		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
+			result = append(result, room)
+		}
 	}
-	roomIDs := queryRes.RoomIDs[offset:nextIndex]
-	response.Chunk, err = fillInRooms(ctx, roomIDs, rsAPI)
-	return &response, err
+
+	return result
 }
 
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
 // on /publicRooms by parsing the incoming HTTP request
 // Filter is only filled for POST requests
-func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSONResponse {
-	if httpReq.Method == http.MethodGet {
+func fillPublicRoomsReq(
+	httpReq *http.Request, fedReq *gomatrixserverlib.FederationRequest, request *PublicRoomReq,
+) *util.JSONResponse {
+	switch httpReq.Method {
+	case http.MethodGet:
 		limit, err := strconv.Atoi(httpReq.FormValue("limit"))
 		// Atoi returns 0 and an error when trying to parse an empty string
 		// In that case, we want to assign 0 so we ignore the error
 		if err != nil && len(httpReq.FormValue("limit")) > 0 {
-			util.GetLogger(httpReq.Context()).WithError(err).Error("strconv.Atoi failed")
-			reqErr := jsonerror.InternalServerError()
-			return &reqErr
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("limit param is not a number"),
+			}
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
-		return nil
-	} else if httpReq.Method == http.MethodPost {
-		return httputil.UnmarshalJSONRequest(httpReq, request)
-	}
-
-	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
-	}
-}
-
-// due to lots of switches
-// nolint:gocyclo
-func fillInRooms(ctx context.Context, roomIDs []string, rsAPI roomserverAPI.RoomserverInternalAPI) ([]gomatrixserverlib.PublicRoom, error) {
-	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar", StateKey: ""}
-	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.name", StateKey: ""}
-	canonicalTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
-	topicTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.topic", StateKey: ""}
-	guestTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.guest_access", StateKey: ""}
-	visibilityTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
-	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
-
-	var stateRes roomserverAPI.QueryBulkStateContentResponse
-	err := rsAPI.QueryBulkStateContent(ctx, &roomserverAPI.QueryBulkStateContentRequest{
-		RoomIDs:        roomIDs,
-		AllowWildcards: true,
-		StateTuples: []gomatrixserverlib.StateKeyTuple{
-			nameTuple, canonicalTuple, topicTuple, guestTuple, visibilityTuple, joinRuleTuple, avatarTuple,
-			{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
-		},
-	}, &stateRes)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("QueryBulkStateContent failed")
-		return nil, err
-	}
-	util.GetLogger(ctx).Infof("room IDs: %+v", roomIDs)
-	util.GetLogger(ctx).Infof("State res: %+v", stateRes.Rooms)
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
-	i := 0
-	for roomID, data := range stateRes.Rooms {
-		pub := gomatrixserverlib.PublicRoom{
-			RoomID: roomID,
-		}
-		joinCount := 0
-		var joinRule, guestAccess string
-		for tuple, contentVal := range data {
-			if tuple.EventType == gomatrixserverlib.MRoomMember && contentVal == "join" {
-				joinCount++
-				continue
-			}
-			switch tuple {
-			case avatarTuple:
-				pub.AvatarURL = contentVal
-			case nameTuple:
-				pub.Name = contentVal
-			case topicTuple:
-				pub.Topic = contentVal
-			case canonicalTuple:
-				pub.CanonicalAlias = contentVal
-			case visibilityTuple:
-				pub.WorldReadable = contentVal == "world_readable"
-			// need both of these to determine whether guests can join
-			case joinRuleTuple:
-				joinRule = contentVal
-			case guestTuple:
-				guestAccess = contentVal
+	case http.MethodPost:
+		// The request body has already been read to check the signature.
+		if err := json.Unmarshal(fedReq.Content(), request); err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 			}
 		}
-		if joinRule == gomatrixserverlib.Public && guestAccess == "can_join" {
-			pub.GuestCanJoin = true
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
 		}
-		pub.JoinedMembersCount = joinCount
-		chunk[i] = pub
-		i++
 	}
-	return chunk, nil
+
+	// strip the 'T' which is only required because when sytest does pagination tests it stops
+	// iterating when !prev_batch which then fails if prev_batch==0, so add arbitrary text to
+	// make it truthy not falsey.
+	request.Since = strings.TrimPrefix(request.Since, "T")
+	return nil
 }
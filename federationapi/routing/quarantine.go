@@ -0,0 +1,75 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// serverQuarantine records the servers which send us transactions and decides
+// whether their events should be soft-failed because they are new to us.
+type serverQuarantine struct {
+	fsAPI           federationSenderAPI.FederationSenderInternalAPI
+	enabled         bool
+	probationPeriod time.Duration
+	// servers which don't need to be recorded or checked again, because
+	// they are trusted, or have been recorded while quarantine is disabled
+	known sync.Map // gomatrixserverlib.ServerName -> struct{}
+}
+
+func newServerQuarantine(
+	cfg *config.FederationAPI, fsAPI federationSenderAPI.FederationSenderInternalAPI,
+) *serverQuarantine {
+	return &serverQuarantine{
+		fsAPI:           fsAPI,
+		enabled:         cfg.QuarantineNewServers.Enabled,
+		probationPeriod: cfg.QuarantineNewServers.ProbationPeriod,
+	}
+}
+
+// isQuarantined records that the server has sent us a transaction and returns
+// whether its events should be soft-failed. The quarantine is only a spam
+// mitigation, so servers aren't quarantined if we fail to look them up.
+func (q *serverQuarantine) isQuarantined(ctx context.Context, serverName gomatrixserverlib.ServerName) bool {
+	if q == nil {
+		return false
+	}
+	if _, ok := q.known.Load(serverName); ok {
+		return false
+	}
+	var res federationSenderAPI.PerformServerSeenResponse
+	if err := q.fsAPI.PerformServerSeen(ctx, &federationSenderAPI.PerformServerSeenRequest{
+		ServerName: serverName,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Errorf("Failed to record that server %q was seen", serverName)
+		return false
+	}
+	if !q.enabled || res.Approved {
+		q.known.Store(serverName, struct{}{})
+		return false
+	}
+	if q.probationPeriod > 0 && time.Since(res.FirstSeen.Time()) >= q.probationPeriod {
+		q.known.Store(serverName, struct{}{})
+		return false
+	}
+	return true
+}
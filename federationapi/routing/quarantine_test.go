@@ -0,0 +1,119 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testServerSeenAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	firstSeen map[gomatrixserverlib.ServerName]time.Time
+	approved  map[gomatrixserverlib.ServerName]bool
+	calls     int
+	fail      bool
+}
+
+func (a *testServerSeenAPI) PerformServerSeen(
+	ctx context.Context,
+	request *federationSenderAPI.PerformServerSeenRequest,
+	response *federationSenderAPI.PerformServerSeenResponse,
+) error {
+	a.calls++
+	if a.fail {
+		return fmt.Errorf("database is down")
+	}
+	if _, ok := a.firstSeen[request.ServerName]; !ok {
+		a.firstSeen[request.ServerName] = time.Now()
+	}
+	response.FirstSeen = gomatrixserverlib.AsTimestamp(a.firstSeen[request.ServerName])
+	response.Approved = a.approved[request.ServerName]
+	return nil
+}
+
+func newTestServerSeenAPI() *testServerSeenAPI {
+	return &testServerSeenAPI{
+		firstSeen: map[gomatrixserverlib.ServerName]time.Time{},
+		approved:  map[gomatrixserverlib.ServerName]bool{},
+	}
+}
+
+func TestServerQuarantine(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.FederationAPI{}
+	cfg.QuarantineNewServers.Enabled = true
+	fsAPI := newTestServerSeenAPI()
+	q := newServerQuarantine(cfg, fsAPI)
+
+	if !q.isQuarantined(ctx, "new.server") {
+		t.Errorf("expected a new server to be quarantined")
+	}
+	if !q.isQuarantined(ctx, "new.server") {
+		t.Errorf("expected a new server to stay quarantined until approved")
+	}
+	fsAPI.approved["new.server"] = true
+	if q.isQuarantined(ctx, "new.server") {
+		t.Errorf("expected an approved server not to be quarantined")
+	}
+	calls := fsAPI.calls
+	if q.isQuarantined(ctx, "new.server"); fsAPI.calls != calls {
+		t.Errorf("expected an approved server not to be looked up again")
+	}
+
+	fsAPI.fail = true
+	if q.isQuarantined(ctx, "unknown.server") {
+		t.Errorf("expected a server not to be quarantined when it can't be looked up")
+	}
+}
+
+func TestServerQuarantineProbationPeriod(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.FederationAPI{}
+	cfg.QuarantineNewServers.Enabled = true
+	cfg.QuarantineNewServers.ProbationPeriod = time.Hour
+	fsAPI := newTestServerSeenAPI()
+	fsAPI.firstSeen["old.server"] = time.Now().Add(-2 * time.Hour)
+	q := newServerQuarantine(cfg, fsAPI)
+
+	if !q.isQuarantined(ctx, "new.server") {
+		t.Errorf("expected a server in its probation period to be quarantined")
+	}
+	if q.isQuarantined(ctx, "old.server") {
+		t.Errorf("expected a server past its probation period not to be quarantined")
+	}
+}
+
+func TestServerQuarantineDisabled(t *testing.T) {
+	ctx := context.Background()
+	fsAPI := newTestServerSeenAPI()
+	q := newServerQuarantine(&config.FederationAPI{}, fsAPI)
+
+	if q.isQuarantined(ctx, "new.server") {
+		t.Errorf("expected no server to be quarantined when disabled")
+	}
+	if _, ok := fsAPI.firstSeen["new.server"]; !ok {
+		t.Errorf("expected the server to be recorded when disabled")
+	}
+	if q.isQuarantined(ctx, "new.server"); fsAPI.calls != 1 {
+		t.Errorf("expected the server to be recorded once, got %d calls", fsAPI.calls)
+	}
+}
@@ -22,15 +22,17 @@ import (
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
-	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-// RoomAliasToID converts the queried alias into a room ID and returns it
+// RoomAliasToID converts the queried alias into a room ID and returns it,
+// along with the servers which are currently resident in the room. Only
+// aliases belonging to this server are resolved, as remote servers should
+// ask the server named in the alias directly.
 func RoomAliasToID(
 	httpReq *http.Request,
-	federation *gomatrixserverlib.FederationClient,
+	request *gomatrixserverlib.FederationRequest,
 	cfg *config.FederationAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	senderAPI federationSenderAPI.FederationSenderInternalAPI,
@@ -49,57 +51,49 @@ func RoomAliasToID(
 			JSON: jsonerror.BadJSON("Room alias must be in the form '#localpart:domain'"),
 		}
 	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room alias %s is not local to this server", roomAlias)),
+		}
+	}
 
-	var resp gomatrixserverlib.RespDirectory
-
-	if domain == cfg.Matrix.ServerName {
-		queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomAlias}
-		var queryRes roomserverAPI.GetRoomIDForAliasResponse
-		if err = rsAPI.GetRoomIDForAlias(httpReq.Context(), &queryReq, &queryRes); err != nil {
-			util.GetLogger(httpReq.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
-			return jsonerror.InternalServerError()
+	queryReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomAlias}
+	var queryRes roomserverAPI.GetRoomIDForAliasResponse
+	if err = rsAPI.GetRoomIDForAlias(httpReq.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+		return jsonerror.InternalServerError()
+	}
+	if queryRes.RoomID == "" || roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, queryRes.RoomID, request.Origin()) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room alias %s not found", roomAlias)),
 		}
+	}
 
-		if queryRes.RoomID != "" {
-			serverQueryReq := federationSenderAPI.QueryJoinedHostServerNamesInRoomRequest{RoomID: queryRes.RoomID}
-			var serverQueryRes federationSenderAPI.QueryJoinedHostServerNamesInRoomResponse
-			if err = senderAPI.QueryJoinedHostServerNamesInRoom(httpReq.Context(), &serverQueryReq, &serverQueryRes); err != nil {
-				util.GetLogger(httpReq.Context()).WithError(err).Error("senderAPI.QueryJoinedHostServerNamesInRoom failed")
-				return jsonerror.InternalServerError()
-			}
+	serverQueryReq := federationSenderAPI.QueryJoinedHostServerNamesInRoomRequest{RoomID: queryRes.RoomID}
+	var serverQueryRes federationSenderAPI.QueryJoinedHostServerNamesInRoomResponse
+	if err = senderAPI.QueryJoinedHostServerNamesInRoom(httpReq.Context(), &serverQueryReq, &serverQueryRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("senderAPI.QueryJoinedHostServerNamesInRoom failed")
+		return jsonerror.InternalServerError()
+	}
 
-			resp = gomatrixserverlib.RespDirectory{
-				RoomID:  queryRes.RoomID,
-				Servers: serverQueryRes.ServerNames,
-			}
+	// List ourselves first if we are in the room, as we can certainly be
+	// joined through.
+	servers := []gomatrixserverlib.ServerName{}
+	for _, serverName := range serverQueryRes.ServerNames {
+		if serverName == cfg.Matrix.ServerName {
+			servers = append([]gomatrixserverlib.ServerName{serverName}, servers...)
 		} else {
-			// If no alias was found, return an error
-			return util.JSONResponse{
-				Code: http.StatusNotFound,
-				JSON: jsonerror.NotFound(fmt.Sprintf("Room alias %s not found", roomAlias)),
-			}
-		}
-	} else {
-		resp, err = federation.LookupRoomAlias(httpReq.Context(), domain, roomAlias)
-		if err != nil {
-			switch x := err.(type) {
-			case gomatrix.HTTPError:
-				if x.Code == http.StatusNotFound {
-					return util.JSONResponse{
-						Code: http.StatusNotFound,
-						JSON: jsonerror.NotFound("Room alias not found"),
-					}
-				}
-			}
-			// TODO: Return 502 if the remote server errored.
-			// TODO: Return 504 if the remote server timed out.
-			util.GetLogger(httpReq.Context()).WithError(err).Error("federation.LookupRoomAlias failed")
-			return jsonerror.InternalServerError()
+			servers = append(servers, serverName)
 		}
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: resp,
+		JSON: gomatrixserverlib.RespDirectory{
+			RoomID:  queryRes.RoomID,
+			Servers: servers,
+		},
 	}
 }
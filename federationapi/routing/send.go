@@ -16,23 +16,74 @@ package routing
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+var pdusReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "pdus_received_total",
+		Help:      "Number of PDUs received in inbound federation transactions",
+	},
+	[]string{"room_version", "origin"},
+)
+
+var pdusRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "pdus_rejected_total",
+		Help:      "Number of PDUs received in inbound federation transactions that failed validation, by reason. PDUs failing the content hash check are redacted rather than dropped",
+	},
+	[]string{"reason", "room_version", "origin"},
+)
+
+var missingEventFetches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "missing_event_fetches_total",
+		Help:      "Number of times that an inbound federation PDU referred to unknown events which had to be fetched, by whether they were prev_events or auth_events",
+	},
+	[]string{"type", "origin"},
+)
+
+var edusReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "edus_received_total",
+		Help:      "Number of EDUs received in inbound federation transactions, by type and whether they were processed, invalid, failed or of a type that isn't handled",
+	},
+	[]string{"type", "outcome", "origin"},
+)
+
+func init() {
+	prometheus.MustRegister(pdusReceived, pdusRejected, missingEventFetches, edusReceived)
+}
+
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
 	httpReq *http.Request,
@@ -44,15 +95,24 @@ func Send(
 	keyAPI keyapi.KeyInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	federation *gomatrixserverlib.FederationClient,
+	quarantine *serverQuarantine,
 ) util.JSONResponse {
 	t := txnReq{
 		rsAPI:      rsAPI,
 		eduAPI:     eduAPI,
 		keys:       keys,
-		federation: federation,
+		federation: &txnFederation{federation, cfg.Matrix},
 		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:  make(map[string]bool),
 		keyAPI:     keyAPI,
+
+		logRejectedEvents: cfg.LogRejectedEvents,
+		maxPrevEvents:     cfg.MaxPrevEvents,
+		maxAuthEvents:     cfg.MaxAuthEvents,
+		maxDepthSkew:      cfg.MaxDepthSkew,
+	}
+	if cfg.EventTypeFilter != nil && cfg.EventTypeFilter.FilterFederated {
+		t.eventTypeFilter = cfg.EventTypeFilter
 	}
 
 	var txnEvents struct {
@@ -84,6 +144,10 @@ func Send(
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q from %q containing %d PDUs, %d EDUs", txnID, request.Origin(), len(t.PDUs), len(t.EDUs))
 
+	if t.quarantined = quarantine.isQuarantined(httpReq.Context(), t.Origin); t.quarantined {
+		util.GetLogger(httpReq.Context()).Infof("Soft-failing events in transaction %q from quarantined server %q", txnID, t.Origin)
+	}
+
 	resp, jsonErr := t.processTransaction(httpReq.Context())
 	if jsonErr != nil {
 		util.GetLogger(httpReq.Context()).WithField("jsonErr", jsonErr).Error("t.processTransaction failed")
@@ -112,6 +176,18 @@ type txnReq struct {
 	haveEvents map[string]*gomatrixserverlib.HeaderedEvent
 	// new events which the roomserver does not know about
 	newEvents map[string]bool
+	// whether to log the details of events which we reject
+	logRejectedEvents bool
+	// the maximum number of prev_events and auth_events an event can refer
+	// to, and how far ahead of the room its depth can be when we're missing
+	// its prev_events, or 0 for no limit
+	maxPrevEvents int
+	maxAuthEvents int
+	maxDepthSkew  int64
+	// which types of message events to drop, or nil to accept them all
+	eventTypeFilter *config.EventTypeFilter
+	// whether the origin is new to us, so its events should be soft-failed
+	quarantined bool
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -121,17 +197,24 @@ type txnFederationClient interface {
 	)
 	LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error)
 	GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error)
+	LookupEventAuth(ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+		[]gomatrixserverlib.Event, error,
+	)
 	LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents,
 		roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error)
 }
 
 func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.RespSend, *util.JSONResponse) {
 	results := make(map[string]gomatrixserverlib.PDUResult)
+	origin := internal.OriginLabel(string(t.Origin))
 
 	pdus := []gomatrixserverlib.HeaderedEvent{}
 	for _, pdu := range t.PDUs {
+		// The event ID is only in the JSON for room versions 1 and 2, so we
+		// can only report a result for a PDU that we can't parse in those.
 		var header struct {
-			RoomID string `json:"room_id"`
+			RoomID  string `json:"room_id"`
+			EventID string `json:"event_id"`
 		}
 		if err := json.Unmarshal(pdu, &header); err != nil {
 			util.GetLogger(ctx).WithError(err).Warn("Transaction: Failed to extract room ID from event")
@@ -142,37 +225,73 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 		verReq := api.QueryRoomVersionForRoomRequest{RoomID: header.RoomID}
 		verRes := api.QueryRoomVersionForRoomResponse{}
 		if err := t.rsAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
+			pdusReceived.WithLabelValues("unknown", origin).Inc()
 			util.GetLogger(ctx).WithError(err).Warn("Transaction: Failed to query room version for room", verReq.RoomID)
-			// We don't know the event ID at this point so we can't return the
-			// failure in the PDU results
+			if header.EventID != "" {
+				results[header.EventID] = gomatrixserverlib.PDUResult{
+					Error: "Unknown room",
+				}
+			}
 			continue
 		}
+		roomVersion := string(verRes.RoomVersion)
+		pdusReceived.WithLabelValues(roomVersion, origin).Inc()
 		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, verRes.RoomVersion)
 		if err != nil {
-			if _, ok := err.(gomatrixserverlib.BadJSONError); ok {
-				// Room version 6 states that homeservers should strictly enforce canonical JSON
-				// on PDUs.
-				//
-				// This enforces that the entire transaction is rejected if a single bad PDU is
-				// sent. It is unclear if this is the correct behaviour or not.
-				//
-				// See https://github.com/matrix-org/synapse/issues/7543
-				return nil, &util.JSONResponse{
-					Code: 400,
-					JSON: jsonerror.BadJSON("PDU contains bad JSON"),
+			// Room version 6 states that homeservers should strictly enforce
+			// canonical JSON on PDUs. Only the bad PDU is dropped, rather than
+			// the whole transaction, so that the other PDUs in it still get
+			// through and the sender doesn't retry the transaction forever.
+			// See https://github.com/matrix-org/synapse/issues/7543
+			pdusRejected.WithLabelValues("bad_json", roomVersion, origin).Inc()
+			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
+			t.logRejectedEvent(ctx, header.RoomID, pdu, err)
+			if header.EventID != "" {
+				results[header.EventID] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
 				}
 			}
-			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
+			continue
+		}
+		if computed, claimed, hashErr := contentHashes(pdu); hashErr == nil && computed != claimed {
+			pdusRejected.WithLabelValues("hash", roomVersion, origin).Inc()
+		}
+		if err = eventutil.CheckEventSize(pdu, nil); err != nil {
+			pdusRejected.WithLabelValues("too_large", roomVersion, origin).Inc()
+			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Event %q is too large", event.EventID())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: err.Error(),
+			}
+			continue
+		}
+		if err = t.checkEventRelayLimits(event); err != nil {
+			pdusRejected.WithLabelValues("relay_limits", roomVersion, origin).Inc()
+			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Event %q exceeds relay limits", event.EventID())
+			t.logRejectedEvent(ctx, header.RoomID, pdu, err)
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: err.Error(),
+			}
+			continue
+		}
+		if event.StateKey() == nil && !t.eventTypeFilter.IsEventTypeAllowed(event.Type()) {
+			pdusRejected.WithLabelValues("event_type", roomVersion, origin).Inc()
+			util.GetLogger(ctx).Debugf("Transaction: Dropping event %q of denied type %q", event.EventID(), event.Type())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: "Event type not allowed on this server",
+			}
 			continue
 		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID(), t.Origin) {
+			pdusRejected.WithLabelValues("acl", roomVersion, origin).Inc()
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: "Forbidden by server ACLs",
 			}
 			continue
 		}
 		if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []gomatrixserverlib.Event{event}, t.keys); err != nil {
+			pdusRejected.WithLabelValues("signature", roomVersion, origin).Inc()
 			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
+			t.logRejectedEvent(ctx, header.RoomID, pdu, err)
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: err.Error(),
 			}
@@ -183,7 +302,7 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 
 	// Process the events.
 	for _, e := range pdus {
-		if err := t.processEvent(ctx, e.Unwrap()); err != nil {
+		if err := t.processEventRecovering(ctx, e.Unwrap()); err != nil {
 			// If the error is due to the event itself being bad then we skip
 			// it and move onto the next event. We report an error so that the
 			// sender knows that we have skipped processing it.
@@ -215,6 +334,10 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 				util.GetLogger(ctx).WithError(err).WithField("event_id", e.EventID()).WithField("rejected", rejected).Warn(
 					"Failed to process incoming federation event, skipping",
 				)
+				if rejected {
+					pdusRejected.WithLabelValues("auth", string(e.RoomVersion), origin).Inc()
+					t.logRejectedEvent(ctx, e.RoomID(), e.JSON(), err)
+				}
 				results[e.EventID()] = gomatrixserverlib.PDUResult{
 					Error: errMsg,
 				}
@@ -231,16 +354,103 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
+// processEventRecovering processes an event, turning a panic while doing so
+// into an error for that event, so that one malformed event can't fail the
+// whole transaction and have the sender retry it forever.
+func (t *txnReq) processEventRecovering(ctx context.Context, e gomatrixserverlib.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			util.GetLogger(ctx).WithField("event_id", e.EventID()).Errorf("Transaction: Panic while processing event: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("failed to process event: %v", r)
+		}
+	}()
+	return t.processEvent(ctx, e)
+}
+
+// logRejectedEvent logs the full JSON of an event that we rejected, along
+// with its computed and claimed content hashes and the reason it was
+// rejected, if enabled in the config. A mismatched content hash causes
+// the event to be redacted, which then usually shows up as a bad signature.
+func (t *txnReq) logRejectedEvent(ctx context.Context, roomID string, eventJSON []byte, reason error) {
+	if !t.logRejectedEvents {
+		return
+	}
+	fields := logrus.Fields{
+		"room_id":    roomID,
+		"origin":     t.Origin,
+		"event_json": string(eventJSON),
+	}
+	computed, claimed, err := contentHashes(eventJSON)
+	if err != nil {
+		fields["hash_error"] = err.Error()
+	} else {
+		fields["computed_hash"] = computed
+		fields["claimed_hash"] = claimed
+	}
+	util.GetLogger(ctx).WithError(reason).WithFields(fields).Debug("Rejected inbound federation event")
+}
+
+// contentHashes returns the SHA-256 content hash of the event JSON, worked
+// out as in https://matrix.org/docs/spec/server_server/r0.1.4#calculating-the-content-hash-for-an-event,
+// and the content hash that the event claims to have.
+func contentHashes(eventJSON []byte) (computed, claimed string, err error) {
+	var event map[string]json.RawMessage
+	if err = json.Unmarshal(eventJSON, &event); err != nil {
+		return "", "", fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	var hashes struct {
+		SHA256 string `json:"sha256"`
+	}
+	if raw, ok := event["hashes"]; ok {
+		if err = json.Unmarshal(raw, &hashes); err != nil {
+			return "", "", fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	delete(event, "unsigned")
+	delete(event, "signatures")
+	delete(event, "hashes")
+	hashableJSON, err := json.Marshal(event)
+	if err != nil {
+		return "", "", fmt.Errorf("json.Marshal: %w", err)
+	}
+	hashableJSON, err = gomatrixserverlib.CanonicalJSON(hashableJSON)
+	if err != nil {
+		return "", "", fmt.Errorf("gomatrixserverlib.CanonicalJSON: %w", err)
+	}
+	sum := sha256.Sum256(hashableJSON)
+	return base64.RawStdEncoding.EncodeToString(sum[:]), hashes.SHA256, nil
+}
+
 // isProcessingErrorFatal returns true if the error is really bad and
 // we should stop processing the transaction, and returns false if it
 // is just some less serious error about a specific event.
-func isProcessingErrorFatal(err error) bool {
-	switch err {
-	case sql.ErrConnDone:
-	case sql.ErrTxDone:
-		return true
+// checkEventRelayLimits checks that an event doesn't refer to more
+// prev_events or auth_events than allowed. This is done before fetching any
+// of them, so that a single event can't make us fetch an unbounded number of
+// other events.
+func (t *txnReq) checkEventRelayLimits(e gomatrixserverlib.Event) error {
+	if n := len(e.PrevEventIDs()); t.maxPrevEvents > 0 && n > t.maxPrevEvents {
+		return eventRelayLimitError{e.EventID(), fmt.Sprintf("%d prev_events exceeds the limit of %d", n, t.maxPrevEvents)}
+	}
+	if n := len(e.AuthEventIDs()); t.maxAuthEvents > 0 && n > t.maxAuthEvents {
+		return eventRelayLimitError{e.EventID(), fmt.Sprintf("%d auth_events exceeds the limit of %d", n, t.maxAuthEvents)}
 	}
-	return false
+	return nil
+}
+
+// checkDepthSkew checks that an event isn't further ahead of the current
+// depth of the room than allowed. This is done before fetching its missing
+// prev_events, so that an event with a made up depth can't make us walk an
+// arbitrarily long chain of events.
+func (t *txnReq) checkDepthSkew(e gomatrixserverlib.Event, roomDepth int64) error {
+	if skew := e.Depth() - roomDepth; t.maxDepthSkew > 0 && skew > t.maxDepthSkew {
+		return eventRelayLimitError{e.EventID(), fmt.Sprintf("depth %d is %d ahead of the room, which exceeds the limit of %d", e.Depth(), skew, t.maxDepthSkew)}
+	}
+	return nil
+}
+
+func isProcessingErrorFatal(err error) bool {
+	return errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone)
 }
 
 type roomNotFoundError struct {
@@ -254,6 +464,10 @@ type missingPrevEventsError struct {
 	eventID string
 	err     error
 }
+type eventRelayLimitError struct {
+	eventID string
+	reason  string
+}
 
 func (e roomNotFoundError) Error() string { return fmt.Sprintf("room %q not found", e.roomID) }
 func (e verifySigError) Error() string {
@@ -262,6 +476,9 @@ func (e verifySigError) Error() string {
 func (e missingPrevEventsError) Error() string {
 	return fmt.Sprintf("unable to get prev_events for event %q: %s", e.eventID, e.err)
 }
+func (e eventRelayLimitError) Error() string {
+	return fmt.Sprintf("event %q rejected: %s", e.eventID, e.reason)
+}
 
 func (t *txnReq) haveEventIDs() map[string]bool {
 	result := make(map[string]bool, len(t.haveEvents))
@@ -274,65 +491,142 @@ func (t *txnReq) haveEventIDs() map[string]bool {
 	return result
 }
 
-// nolint:gocyclo
+// processEDUs hands each EDU to the component which handles EDUs of its type.
+// Bad EDUs are dropped without affecting the rest of the transaction.
 func (t *txnReq) processEDUs(ctx context.Context) {
+	origin := internal.OriginLabel(string(t.Origin))
 	for _, e := range t.EDUs {
-		switch e.Type {
-		case gomatrixserverlib.MTyping:
-			// https://matrix.org/docs/spec/server_server/latest#typing-notifications
-			var typingPayload struct {
-				RoomID string `json:"room_id"`
-				UserID string `json:"user_id"`
-				Typing bool   `json:"typing"`
-			}
-			if err := json.Unmarshal(e.Content, &typingPayload); err != nil {
-				util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal typing event")
-				continue
-			}
-			_, domain, err := gomatrixserverlib.SplitID('@', typingPayload.UserID)
-			if err != nil {
-				util.GetLogger(ctx).WithError(err).Error("Failed to split domain from typing event sender")
-				continue
-			}
-			if domain != t.Origin {
-				util.GetLogger(ctx).Warnf("Dropping typing event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
-				continue
-			}
-			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
-				util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to edu server")
+		eduType := e.Type
+		switch eduType {
+		case gomatrixserverlib.MTyping, gomatrixserverlib.MDirectToDevice, gomatrixserverlib.MDeviceListUpdate, "m.presence", "m.receipt":
+		default:
+			eduType = "other"
+		}
+		edusReceived.WithLabelValues(eduType, t.processEDU(ctx, e), origin).Inc()
+	}
+}
+
+// processEDU processes a single EDU and returns the outcome for metrics.
+// Dendrite doesn't support presence or read receipts yet, so there is no
+// subsystem to pass those on to: they are checked against the origin so
+// that forged ones show up as invalid, and are otherwise dropped.
+// nolint:gocyclo
+func (t *txnReq) processEDU(ctx context.Context, e gomatrixserverlib.EDU) string {
+	switch e.Type {
+	case gomatrixserverlib.MTyping:
+		// https://matrix.org/docs/spec/server_server/latest#typing-notifications
+		var typingPayload struct {
+			RoomID string `json:"room_id"`
+			UserID string `json:"user_id"`
+			Typing bool   `json:"typing"`
+		}
+		if err := json.Unmarshal(e.Content, &typingPayload); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal typing event")
+			return "invalid"
+		}
+		if !t.isFromOrigin(ctx, e.Type, typingPayload.UserID) {
+			return "invalid"
+		}
+		if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to edu server")
+			return "error"
+		}
+	case gomatrixserverlib.MDirectToDevice:
+		// https://matrix.org/docs/spec/server_server/r0.1.3#m-direct-to-device-schema
+		var directPayload gomatrixserverlib.ToDeviceMessage
+		if err := json.Unmarshal(e.Content, &directPayload); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal send-to-device events")
+			return "invalid"
+		}
+		if !t.isFromOrigin(ctx, e.Type, directPayload.Sender) {
+			return "invalid"
+		}
+		outcome := "processed"
+		for userID, byUser := range directPayload.Messages {
+			for deviceID, message := range byUser {
+				// TODO: check that the user and the device actually exist here
+				if err := eduserverAPI.SendToDevice(ctx, t.eduAPI, directPayload.Sender, userID, deviceID, directPayload.Type, message); err != nil {
+					util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+						"sender":    directPayload.Sender,
+						"user_id":   userID,
+						"device_id": deviceID,
+					}).Error("Failed to send send-to-device event to edu server")
+					outcome = "error"
+				}
 			}
-		case gomatrixserverlib.MDirectToDevice:
-			// https://matrix.org/docs/spec/server_server/r0.1.3#m-direct-to-device-schema
-			var directPayload gomatrixserverlib.ToDeviceMessage
-			if err := json.Unmarshal(e.Content, &directPayload); err != nil {
-				util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal send-to-device events")
-				continue
+		}
+		return outcome
+	case gomatrixserverlib.MDeviceListUpdate:
+		return t.processDeviceListUpdate(ctx, e)
+	case "m.presence":
+		// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+		var presencePayload struct {
+			Push []struct {
+				UserID string `json:"user_id"`
+			} `json:"push"`
+		}
+		if err := json.Unmarshal(e.Content, &presencePayload); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal presence event")
+			return "invalid"
+		}
+		for _, update := range presencePayload.Push {
+			if !t.isFromOrigin(ctx, e.Type, update.UserID) {
+				return "invalid"
 			}
-			for userID, byUser := range directPayload.Messages {
-				for deviceID, message := range byUser {
-					// TODO: check that the user and the device actually exist here
-					if err := eduserverAPI.SendToDevice(ctx, t.eduAPI, directPayload.Sender, userID, deviceID, directPayload.Type, message); err != nil {
-						util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
-							"sender":    directPayload.Sender,
-							"user_id":   userID,
-							"device_id": deviceID,
-						}).Error("Failed to send send-to-device event to edu server")
-					}
+		}
+		// TODO: Pass presence on once there is a presence server.
+		util.GetLogger(ctx).Debug("Dropping presence EDU as presence isn't supported")
+		return "unhandled"
+	case "m.receipt":
+		// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
+		var receiptPayload map[string]struct {
+			Read map[string]json.RawMessage `json:"m.read"`
+		}
+		if err := json.Unmarshal(e.Content, &receiptPayload); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal receipt event")
+			return "invalid"
+		}
+		for _, receipts := range receiptPayload {
+			for userID := range receipts.Read {
+				if !t.isFromOrigin(ctx, e.Type, userID) {
+					return "invalid"
 				}
 			}
-		case gomatrixserverlib.MDeviceListUpdate:
-			t.processDeviceListUpdate(ctx, e)
-		default:
-			util.GetLogger(ctx).WithField("type", e.Type).Debug("Unhandled EDU")
 		}
+		// TODO: Pass receipts on once the sync API stores them.
+		util.GetLogger(ctx).Debug("Dropping receipt EDU as read receipts aren't supported")
+		return "unhandled"
+	default:
+		util.GetLogger(ctx).WithField("type", e.Type).Debug("Unhandled EDU")
+		return "unhandled"
 	}
+	return "processed"
 }
 
-func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverlib.EDU) {
+// isFromOrigin returns whether the user who an EDU is about belongs to the
+// server which sent the transaction. Servers can't send EDUs for other
+// servers' users.
+func (t *txnReq) isFromOrigin(ctx context.Context, eduType, userID string) bool {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Errorf("Failed to split domain from %s event sender", eduType)
+		return false
+	}
+	if domain != t.Origin {
+		util.GetLogger(ctx).Warnf("Dropping %s event where sender domain (%q) doesn't match origin (%q)", eduType, domain, t.Origin)
+		return false
+	}
+	return true
+}
+
+func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverlib.EDU) string {
 	var payload gomatrixserverlib.DeviceListUpdateEvent
 	if err := json.Unmarshal(e.Content, &payload); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal device list update event")
-		return
+		return "invalid"
+	}
+	if !t.isFromOrigin(ctx, e.Type, payload.UserID) {
+		return "invalid"
 	}
 	var inputRes keyapi.InputDeviceListUpdateResponse
 	t.keyAPI.InputDeviceListUpdate(context.Background(), &keyapi.InputDeviceListUpdateRequest{
@@ -340,7 +634,9 @@ func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverli
 	}, &inputRes)
 	if inputRes.Error != nil {
 		util.GetLogger(ctx).WithError(inputRes.Error).WithField("user_id", payload.UserID).Error("failed to InputDeviceListUpdate")
+		return "error"
 	}
+	return "processed"
 }
 
 func (t *txnReq) getServers(ctx context.Context, roomID string) []gomatrixserverlib.ServerName {
@@ -400,15 +696,18 @@ func (t *txnReq) processEvent(ctx context.Context, e gomatrixserverlib.Event) er
 	// pass the event to the roomserver which will do auth checks
 	// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
 	// discarded by the caller of this function
-	return api.SendEvents(
+	return api.SendInputRoomEvents(
 		context.Background(),
 		t.rsAPI,
-		api.KindNew,
-		[]gomatrixserverlib.HeaderedEvent{
-			e.Headered(stateResp.RoomVersion),
+		[]api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        e.Headered(stateResp.RoomVersion),
+				AuthEventIDs: e.AuthEventIDs(),
+				SendAsServer: api.DoNotSendToOtherServers,
+				SoftFail:     t.quarantined,
+			},
 		},
-		api.DoNotSendToOtherServers,
-		nil,
 	)
 }
 
@@ -416,6 +715,16 @@ func (t *txnReq) retrieveMissingAuthEvents(
 	ctx context.Context, e gomatrixserverlib.Event, stateResp *api.QueryMissingAuthPrevEventsResponse,
 ) error {
 	logger := util.GetLogger(ctx).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
+	missingEventFetches.WithLabelValues("auth_events", internal.OriginLabel(string(t.Origin))).Inc()
+
+	// Try to fetch the whole auth chain of the event from the server that
+	// sent it, as the missing auth events may have auth events which we
+	// don't know about either. Otherwise fetch the missing events one by one.
+	err := t.retrieveAuthChain(ctx, e, stateResp)
+	if err == nil {
+		return nil
+	}
+	logger.WithError(err).Warnf("Failed to retrieve auth chain from %q", t.Origin)
 
 	missingAuthEvents := make(map[string]struct{})
 	for _, missingAuthEventID := range stateResp.MissingAuthEventIDs {
@@ -466,6 +775,44 @@ withNextEvent:
 	return nil
 }
 
+// retrieveAuthChain fetches the auth chain of the event using /event_auth and
+// sends it to the roomserver as outliers, oldest first.
+func (t *txnReq) retrieveAuthChain(
+	ctx context.Context, e gomatrixserverlib.Event, stateResp *api.QueryMissingAuthPrevEventsResponse,
+) error {
+	authChain, err := t.federation.LookupEventAuth(ctx, t.Origin, e.RoomID(), e.EventID(), stateResp.RoomVersion)
+	if err != nil {
+		return fmt.Errorf("t.federation.LookupEventAuth: %w", err)
+	}
+	if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, authChain, t.keys); err != nil {
+		return fmt.Errorf("gomatrixserverlib.VerifyAllEventSignatures: %w", err)
+	}
+	haveEvents := make(map[string]bool, len(authChain))
+	for _, ev := range authChain {
+		haveEvents[ev.EventID()] = true
+	}
+	for _, missingAuthEventID := range stateResp.MissingAuthEventIDs {
+		if !haveEvents[missingAuthEventID] {
+			return fmt.Errorf("auth chain does not contain auth event %q", missingAuthEventID)
+		}
+	}
+
+	authChain = gomatrixserverlib.ReverseTopologicalOrdering(authChain, gomatrixserverlib.TopologicalOrderByAuthEvents)
+	ires := make([]api.InputRoomEvent, len(authChain))
+	for i, ev := range authChain {
+		ires[i] = api.InputRoomEvent{
+			Kind:         api.KindOutlier,
+			Event:        ev.Headered(stateResp.RoomVersion),
+			AuthEventIDs: ev.AuthEventIDs(),
+			SendAsServer: api.DoNotSendToOtherServers,
+		}
+	}
+	if err = api.SendInputRoomEvents(context.Background(), t.rsAPI, ires); err != nil {
+		return fmt.Errorf("api.SendInputRoomEvents: %w", err)
+	}
+	return nil
+}
+
 func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserverlib.Event) error {
 	authUsingState := gomatrixserverlib.NewAuthEvents(nil)
 	for i := range stateEvents {
@@ -781,6 +1128,7 @@ retryAllowedState:
 // nolint:gocyclo
 func (t *txnReq) getMissingEvents(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (newEvents []gomatrixserverlib.Event, err error) {
 	logger := util.GetLogger(ctx).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
+	missingEventFetches.WithLabelValues("prev_events", internal.OriginLabel(string(t.Origin))).Inc()
 	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
 	// query latest events (our trusted forward extremities)
 	req := api.QueryLatestEventsAndStateRequest{
@@ -792,6 +1140,10 @@ func (t *txnReq) getMissingEvents(ctx context.Context, e gomatrixserverlib.Event
 		logger.WithError(err).Warn("Failed to query latest events")
 		return nil, err
 	}
+	if err = t.checkDepthSkew(e, res.Depth); err != nil {
+		logger.WithError(err).Warn("Not fetching missing events")
+		return nil, err
+	}
 	latestEvents := make([]string, len(res.LatestEvents))
 	for i := range res.LatestEvents {
 		latestEvents[i] = res.LatestEvents[i].EventID
@@ -848,6 +1200,18 @@ func (t *txnReq) getMissingEvents(ctx context.Context, e gomatrixserverlib.Event
 	// For now, we do not allow Case B, so reject the event.
 	logger.Infof("get_missing_events returned %d events", len(missingResp.Events))
 
+	// The returned events are subject to the same limits as events pushed to
+	// us, otherwise they could be used to make us fetch even more events.
+	withinLimits := missingResp.Events[:0]
+	for _, ev := range missingResp.Events {
+		if lerr := t.checkEventRelayLimits(ev); lerr != nil {
+			logger.WithError(lerr).Warn("Dropping event returned by /get_missing_events")
+			continue
+		}
+		withinLimits = append(withinLimits, ev)
+	}
+	missingResp.Events = withinLimits
+
 	// topologically sort and sanity check that we are making forward progress
 	newEvents = gomatrixserverlib.ReverseTopologicalOrdering(missingResp.Events, gomatrixserverlib.TopologicalOrderByPrevEvents)
 	shouldHaveSomeEventIDs := e.PrevEventIDs()
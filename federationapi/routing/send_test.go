@@ -1,6 +1,7 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -119,6 +120,13 @@ func (t *testRoomserverAPI) PerformPeek(
 ) {
 }
 
+func (t *testRoomserverAPI) PerformUnpeek(
+	ctx context.Context,
+	req *api.PerformUnpeekRequest,
+	res *api.PerformUnpeekResponse,
+) {
+}
+
 func (t *testRoomserverAPI) PerformPublish(
 	ctx context.Context,
 	req *api.PerformPublishRequest,
@@ -214,6 +222,15 @@ func (t *testRoomserverAPI) QueryMembershipsForRoom(
 	return fmt.Errorf("not implemented")
 }
 
+// Query the joined members of a room
+func (t *testRoomserverAPI) QueryJoinedMembers(
+	ctx context.Context,
+	request *api.QueryJoinedMembersRequest,
+	response *api.QueryJoinedMembersResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query if a server is joined to a room
 func (t *testRoomserverAPI) QueryServerJoinedToRoom(
 	ctx context.Context,
@@ -232,6 +249,24 @@ func (t *testRoomserverAPI) QueryServerAllowedToSeeEvent(
 	return fmt.Errorf("not implemented")
 }
 
+// Query the auth chain of a set of events
+func (t *testRoomserverAPI) QueryAuthChain(
+	ctx context.Context,
+	request *api.QueryAuthChainRequest,
+	response *api.QueryAuthChainResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+// Query which of a set of events a local user is allowed to see
+func (t *testRoomserverAPI) QueryEventsVisibleToUser(
+	ctx context.Context,
+	request *api.QueryEventsVisibleToUserRequest,
+	response *api.QueryEventsVisibleToUserResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query missing events for a room from roomserver
 func (t *testRoomserverAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -349,6 +384,38 @@ func (t *testRoomserverAPI) QueryServerBannedFromRoom(ctx context.Context, req *
 	return nil
 }
 
+func (t *testRoomserverAPI) QueryEventsBySender(ctx context.Context, req *api.QueryEventsBySenderRequest, res *api.QueryEventsBySenderResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRelations(ctx context.Context, req *api.QueryRelationsRequest, res *api.QueryRelationsResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryAggregations(ctx context.Context, req *api.QueryAggregationsRequest, res *api.QueryAggregationsResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryThreads(ctx context.Context, req *api.QueryThreadsRequest, res *api.QueryThreadsResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRoomCounts(ctx context.Context, req *api.QueryRoomCountsRequest, res *api.QueryRoomCountsResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRetentionRooms(ctx context.Context, req *api.QueryRetentionRoomsRequest, res *api.QueryRetentionRoomsResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRoomSummary(ctx context.Context, req *api.QueryRoomSummaryRequest, res *api.QueryRoomSummaryResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryInsertionEvent(ctx context.Context, req *api.QueryInsertionEventRequest, res *api.QueryInsertionEventResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
 type txnFedClient struct {
 	state            map[string]gomatrixserverlib.RespState    // event_id to response
 	stateIDs         map[string]gomatrixserverlib.RespStateIDs // event_id to response
@@ -378,6 +445,11 @@ func (c *txnFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.S
 	res = r
 	return
 }
+func (c *txnFedClient) LookupEventAuth(ctx context.Context, s gomatrixserverlib.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	[]gomatrixserverlib.Event, error,
+) {
+	return nil, fmt.Errorf("txnFedClient: no /event_auth for event ID %s", eventID)
+}
 func (c *txnFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
 	fmt.Println("testFederationClient.GetEvent", eventID)
 	r, ok := c.getEvent[eventID]
@@ -773,3 +845,240 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	mustProcessTransaction(t, txn, nil)
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
+
+func TestContentHashes(t *testing.T) {
+	computed, claimed, err := contentHashes(testData[0])
+	if err != nil {
+		t.Fatalf("contentHashes returned error: %s", err)
+	}
+	if claimed != "17kPoH+h0Dk4Omn7Sus0qMb6+oGcf+CZFEgDhv7UKWs" {
+		t.Errorf("wrong claimed hash: %s", claimed)
+	}
+	if computed != claimed {
+		t.Errorf("computed hash %s doesn't match claimed hash %s", computed, claimed)
+	}
+
+	// Changing the content should change the computed hash but not the
+	// claimed one.
+	tampered := bytes.Replace(testData[0], []byte("@userid:kaer.morhen"), []byte("@other:kaer.morhen"), 1)
+	computed, claimed, err = contentHashes(tampered)
+	if err != nil {
+		t.Fatalf("contentHashes returned error: %s", err)
+	}
+	if computed == claimed {
+		t.Errorf("expected computed hash of tampered event not to match claimed hash %s", claimed)
+	}
+}
+
+// mustCreatePathologicalEvent makes a message event which refers to the given
+// number of prev_events and auth_events, all of which are unknown, at the
+// given depth. Events are limited to 64KiB, so the number of references has
+// to stay in the hundreds.
+func mustCreatePathologicalEvent(t *testing.T, eventID string, prevEvents, authEvents int, depth int64) json.RawMessage {
+	var ev map[string]interface{}
+	if err := json.Unmarshal(testData[len(testData)-1], &ev); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	refs := func(prefix string, n int) [][]interface{} {
+		r := make([][]interface{}, n)
+		for i := range r {
+			r[i] = []interface{}{fmt.Sprintf("$%s%d:kaer.morhen", prefix, i), map[string]string{"sha256": "sWCi6Ckp9rDimQON+MrUlNRkyfZ2tjbPbWfg2NMB18Q"}}
+		}
+		return r
+	}
+	ev["event_id"] = eventID
+	ev["prev_events"] = refs("prev", prevEvents)
+	ev["auth_events"] = refs("auth", authEvents)
+	ev["depth"] = depth
+	j, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("json.Marshal: %s", err)
+	}
+	return j
+}
+
+// The purpose of this test is to check that events which refer to too many prev_events or auth_events, or which claim
+// to be too far ahead of the room, are rejected without asking the roomserver or the remote server about the events
+// they refer to.
+func TestTransactionRejectsEventsOverRelayLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		prevEvents int
+		authEvents int
+		depth      int64
+	}{
+		{"too many prev_events", 200, 2, 9},
+		{"too many auth_events", 1, 200, 9},
+		{"too far ahead", 1, 2, 1 << 40},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			eventID := "$pathological:kaer.morhen"
+			rsAPI := &testRoomserverAPI{
+				queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+					return api.QueryMissingAuthPrevEventsResponse{
+						RoomExists:          true,
+						MissingAuthEventIDs: []string{},
+						MissingPrevEventIDs: req.PrevEventIDs,
+					}
+				},
+				queryLatestEventsAndState: func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+					return api.QueryLatestEventsAndStateResponse{
+						RoomExists: true,
+						Depth:      testEvents[len(testEvents)-1].Depth() + 1,
+					}
+				},
+			}
+			cli := &txnFedClient{
+				getMissingEvents: func(missing gomatrixserverlib.MissingEvents) (res gomatrixserverlib.RespMissingEvents, err error) {
+					t.Fatalf("unexpected call to /get_missing_events for %v", missing.LatestEvents)
+					return
+				},
+			}
+			pdus := []json.RawMessage{
+				mustCreatePathologicalEvent(t, eventID, tc.prevEvents, tc.authEvents, tc.depth),
+			}
+			txn := mustCreateTransaction(rsAPI, cli, pdus)
+			txn.maxPrevEvents = 20
+			txn.maxAuthEvents = 10
+			txn.maxDepthSkew = 100
+			res, jsonErr := txn.processTransaction(context.Background())
+			if jsonErr != nil {
+				t.Fatalf("txn.processTransaction returned an error: %v", jsonErr)
+			}
+			if res.PDUs[eventID].Error == "" {
+				t.Errorf("expected event to be rejected, got %+v", res.PDUs)
+			}
+			assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+		})
+	}
+}
+
+// The purpose of this test is to check that events returned by /get_missing_events are subject to the relay limits too.
+// The remote server returns a prev_event which refers to a huge number of prev_events itself, which should be dropped,
+// leaving the original event without its prev_events.
+func TestTransactionDropsMissingEventsOverRelayLimits(t *testing.T) {
+	haveEvent := testEvents[len(testEvents)-3]
+	inputEvent := testEvents[len(testEvents)-1]
+	prevEventJSON := mustCreatePathologicalEvent(t, inputEvent.PrevEventIDs()[0], 200, 2, inputEvent.Depth()-1)
+	prevEvent, err := gomatrixserverlib.NewEventFromUntrustedJSON(prevEventJSON, testRoomVersion)
+	if err != nil {
+		t.Fatalf("gomatrixserverlib.NewEventFromUntrustedJSON: %s", err)
+	}
+
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{},
+				MissingPrevEventIDs: req.PrevEventIDs,
+			}
+		},
+		queryLatestEventsAndState: func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+			return api.QueryLatestEventsAndStateResponse{
+				RoomExists: true,
+				Depth:      haveEvent.Depth() + 1,
+				LatestEvents: []gomatrixserverlib.EventReference{
+					haveEvent.EventReference(),
+				},
+			}
+		},
+	}
+	cli := &txnFedClient{
+		getMissingEvents: func(missing gomatrixserverlib.MissingEvents) (res gomatrixserverlib.RespMissingEvents, err error) {
+			return gomatrixserverlib.RespMissingEvents{
+				Events: []gomatrixserverlib.Event{prevEvent},
+			}, nil
+		},
+	}
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{inputEvent.JSON()})
+	txn.maxPrevEvents = 20
+	txn.maxAuthEvents = 10
+	res, jsonErr := txn.processTransaction(context.Background())
+	if jsonErr != nil {
+		t.Fatalf("txn.processTransaction returned an error: %v", jsonErr)
+	}
+	if res.PDUs[inputEvent.EventID()].Error == "" {
+		t.Errorf("expected event to be rejected, got %+v", res.PDUs)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+func TestTransactionDropsBadPDUsIndividually(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{},
+				MissingPrevEventIDs: []string{},
+			}
+		},
+	}
+	badEventID := "$bad:kaer.morhen"
+	pdus := []json.RawMessage{
+		[]byte(`{"room_id":"!roomid:kaer.morhen","event_id":"` + badEventID + `","type":5}`),
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	res, jsonErr := txn.processTransaction(context.Background())
+	if jsonErr != nil {
+		t.Fatalf("txn.processTransaction returned an error: %v", jsonErr)
+	}
+	if res.PDUs[badEventID].Error == "" {
+		t.Errorf("expected bad PDU to be rejected, got %+v", res.PDUs)
+	}
+	goodEventID := testEvents[len(testEvents)-1].EventID()
+	if result, ok := res.PDUs[goodEventID]; !ok || result.Error != "" {
+		t.Errorf("expected event %s to be accepted, got %+v", goodEventID, res.PDUs)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+}
+
+func TestTransactionDropsEDUsForOtherServersUsers(t *testing.T) {
+	eduProducer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduAPI = eduProducer
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@geralt:kaer.morhen","typing":true}`),
+		},
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@ciri:white.orchard","typing":true}`),
+		},
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`not json`),
+		},
+	}
+	txn.processEDUs(context.Background())
+	if len(eduProducer.invocations) != 1 {
+		t.Fatalf("got %d typing notifications, want 1", len(eduProducer.invocations))
+	}
+	if got := eduProducer.invocations[0].InputTypingEvent.UserID; got != "@geralt:kaer.morhen" {
+		t.Errorf("got typing notification for %s, want @geralt:kaer.morhen", got)
+	}
+}
+
+func TestTransactionSoftFailsEventsFromQuarantinedServers(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{},
+				MissingPrevEventIDs: []string{},
+			}
+		},
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.quarantined = true
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+	if len(rsAPI.inputRoomEvents) == 1 && !rsAPI.inputRoomEvents[0].SoftFail {
+		t.Errorf("expected event from quarantined server to be soft-failed")
+	}
+}
@@ -111,13 +111,16 @@ func getState(
 		return nil, resErr
 	}
 
+	// The state "at" an event is the state before it, not including the
+	// event itself. This is what we expect of other servers too, see
+	// lookupStateAfterEvent.
 	var response api.QueryStateAndAuthChainResponse
 	err := rsAPI.QueryStateAndAuthChain(
 		ctx,
 		&api.QueryStateAndAuthChainRequest{
-			RoomID:       roomID,
-			PrevEventIDs: []string{eventID},
-			AuthEventIDs: event.AuthEventIDs(),
+			RoomID:             roomID,
+			StateBeforeEventID: eventID,
+			AuthEventIDs:       event.AuthEventIDs(),
 		},
 		&response,
 	)
@@ -129,6 +132,12 @@ func getState(
 	if !response.RoomExists {
 		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: nil}
 	}
+	if !response.PrevEventsExist {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("the state at this event is not known"),
+		}
+	}
 
 	return &gomatrixserverlib.RespState{
 		StateEvents: gomatrixserverlib.UnwrapEventHeaders(response.StateEvents),
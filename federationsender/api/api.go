@@ -83,6 +83,19 @@ type FederationSenderInternalAPI interface {
 		request *PerformBroadcastEDURequest,
 		response *PerformBroadcastEDUResponse,
 	) error
+	// Records that a server has sent us a transaction, and returns when it
+	// first did so and whether it has been approved by an admin.
+	PerformServerSeen(
+		ctx context.Context,
+		request *PerformServerSeenRequest,
+		response *PerformServerSeenResponse,
+	) error
+	// Approves a server, so that events from it are no longer quarantined.
+	PerformApproveServer(
+		ctx context.Context,
+		request *PerformApproveServerRequest,
+		response *PerformApproveServerResponse,
+	) error
 }
 
 type PerformDirectoryLookupRequest struct {
@@ -148,3 +161,19 @@ type PerformBroadcastEDURequest struct {
 
 type PerformBroadcastEDUResponse struct {
 }
+
+type PerformServerSeenRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+type PerformServerSeenResponse struct {
+	FirstSeen gomatrixserverlib.Timestamp `json:"first_seen"`
+	Approved  bool                        `json:"approved"`
+}
+
+type PerformApproveServerRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+type PerformApproveServerResponse struct {
+}
@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
@@ -32,8 +31,9 @@ import (
 
 // OutputEDUConsumer consumes events that originate in EDU server.
 type OutputEDUConsumer struct {
-	typingConsumer       *internal.ContinualConsumer
-	sendToDeviceConsumer *internal.ContinualConsumer
+	bus                  internal.MessageBus
+	typingConsumer       internal.Subscriber
+	sendToDeviceConsumer internal.Subscriber
 	db                   storage.Database
 	queues               *queue.OutgoingQueues
 	ServerName           gomatrixserverlib.ServerName
@@ -44,49 +44,47 @@ type OutputEDUConsumer struct {
 // NewOutputEDUConsumer creates a new OutputEDUConsumer. Call Start() to begin consuming from EDU servers.
 func NewOutputEDUConsumer(
 	cfg *config.FederationSender,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 ) *OutputEDUConsumer {
-	c := &OutputEDUConsumer{
-		typingConsumer: &internal.ContinualConsumer{
-			ComponentName:  "eduserver/typing",
-			Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent)),
-			Consumer:       kafkaConsumer,
-			PartitionStore: store,
-		},
-		sendToDeviceConsumer: &internal.ContinualConsumer{
-			ComponentName:  "eduserver/sendtodevice",
-			Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent)),
-			Consumer:       kafkaConsumer,
-			PartitionStore: store,
-		},
+	return &OutputEDUConsumer{
+		bus:               bus,
 		queues:            queues,
 		db:                store,
 		ServerName:        cfg.Matrix.ServerName,
 		TypingTopic:       string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent)),
 		SendToDeviceTopic: string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent)),
 	}
-	c.typingConsumer.ProcessMessage = c.onTypingEvent
-	c.sendToDeviceConsumer.ProcessMessage = c.onSendToDeviceEvent
-
-	return c
 }
 
 // Start consuming from EDU servers
 func (t *OutputEDUConsumer) Start() error {
-	if err := t.typingConsumer.Start(); err != nil {
-		return fmt.Errorf("t.typingConsumer.Start: %w", err)
-	}
-	if err := t.sendToDeviceConsumer.Start(); err != nil {
-		return fmt.Errorf("t.sendToDeviceConsumer.Start: %w", err)
+	var err error
+	t.typingConsumer, err = t.bus.Subscribe(internal.Subscription{
+		ComponentName:  "eduserver/typing",
+		Topic:          t.TypingTopic,
+		PartitionStore: t.db,
+		Process:        t.onTypingEvent,
+	})
+	if err != nil {
+		return fmt.Errorf("t.bus.Subscribe: %w", err)
+	}
+	t.sendToDeviceConsumer, err = t.bus.Subscribe(internal.Subscription{
+		ComponentName:  "eduserver/sendtodevice",
+		Topic:          t.SendToDeviceTopic,
+		PartitionStore: t.db,
+		Process:        t.onSendToDeviceEvent,
+	})
+	if err != nil {
+		return fmt.Errorf("t.bus.Subscribe: %w", err)
 	}
 	return nil
 }
 
 // onSendToDeviceEvent is called in response to a message received on the
 // send-to-device events topic from the EDU server.
-func (t *OutputEDUConsumer) onSendToDeviceEvent(msg *sarama.ConsumerMessage) error {
+func (t *OutputEDUConsumer) onSendToDeviceEvent(msg *internal.Message) error {
 	// Extract the send-to-device event from msg.
 	var ote api.OutputSendToDeviceEvent
 	if err := json.Unmarshal(msg.Value, &ote); err != nil {
@@ -136,7 +134,7 @@ func (t *OutputEDUConsumer) onSendToDeviceEvent(msg *sarama.ConsumerMessage) err
 
 // onTypingEvent is called in response to a message received on the typing
 // events topic from the EDU server.
-func (t *OutputEDUConsumer) onTypingEvent(msg *sarama.ConsumerMessage) error {
+func (t *OutputEDUConsumer) onTypingEvent(msg *internal.Message) error {
 	// Extract the typing event from msg.
 	var ote api.OutputTypingEvent
 	if err := json.Unmarshal(msg.Value, &ote); err != nil {
@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/internal"
@@ -32,7 +31,9 @@ import (
 
 // KeyChangeConsumer consumes events that originate in key server.
 type KeyChangeConsumer struct {
-	consumer   *internal.ContinualConsumer
+	cfg        *config.KeyServer
+	bus        internal.MessageBus
+	consumer   internal.Subscriber
 	db         storage.Database
 	queues     *queue.OutgoingQueues
 	serverName gomatrixserverlib.ServerName
@@ -42,39 +43,39 @@ type KeyChangeConsumer struct {
 // NewKeyChangeConsumer creates a new KeyChangeConsumer. Call Start() to begin consuming from key servers.
 func NewKeyChangeConsumer(
 	cfg *config.KeyServer,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) *KeyChangeConsumer {
-	c := &KeyChangeConsumer{
-		consumer: &internal.ContinualConsumer{
-			ComponentName:  "federationsender/keychange",
-			Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputKeyChangeEvent)),
-			Consumer:       kafkaConsumer,
-			PartitionStore: store,
-		},
+	return &KeyChangeConsumer{
+		cfg:        cfg,
+		bus:        bus,
 		queues:     queues,
 		db:         store,
 		serverName: cfg.Matrix.ServerName,
 		rsAPI:      rsAPI,
 	}
-	c.consumer.ProcessMessage = c.onMessage
-
-	return c
 }
 
 // Start consuming from key servers
 func (t *KeyChangeConsumer) Start() error {
-	if err := t.consumer.Start(); err != nil {
-		return fmt.Errorf("t.consumer.Start: %w", err)
+	var err error
+	t.consumer, err = t.bus.Subscribe(internal.Subscription{
+		ComponentName:  "federationsender/keychange",
+		Topic:          string(t.cfg.Matrix.Kafka.TopicFor(config.TopicOutputKeyChangeEvent)),
+		PartitionStore: t.db,
+		Process:        t.onMessage,
+	})
+	if err != nil {
+		return fmt.Errorf("t.bus.Subscribe: %w", err)
 	}
 	return nil
 }
 
 // onMessage is called in response to a message received on the
 // key change events topic from the key server.
-func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (t *KeyChangeConsumer) onMessage(msg *internal.Message) error {
 	var m api.DeviceMessage
 	if err := json.Unmarshal(msg.Value, &m); err != nil {
 		log.WithError(err).Errorf("failed to read device message from key change topic")
@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/federationsender/queue"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
@@ -34,7 +33,8 @@ import (
 type OutputRoomEventConsumer struct {
 	cfg        *config.FederationSender
 	rsAPI      api.RoomserverInternalAPI
-	rsConsumer *internal.ContinualConsumer
+	bus        internal.MessageBus
+	rsConsumer internal.Subscriber
 	db         storage.Database
 	queues     *queue.OutgoingQueues
 }
@@ -42,39 +42,36 @@ type OutputRoomEventConsumer struct {
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
 func NewOutputRoomEventConsumer(
 	cfg *config.FederationSender,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	queues *queue.OutgoingQueues,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
 ) *OutputRoomEventConsumer {
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "federationsender/roomserver",
-		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
-	}
-	s := &OutputRoomEventConsumer{
-		cfg:        cfg,
-		rsConsumer: &consumer,
-		db:         store,
-		queues:     queues,
-		rsAPI:      rsAPI,
+	return &OutputRoomEventConsumer{
+		cfg:    cfg,
+		bus:    bus,
+		db:     store,
+		queues: queues,
+		rsAPI:  rsAPI,
 	}
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from room servers
-func (s *OutputRoomEventConsumer) Start() error {
-	return s.rsConsumer.Start()
+func (s *OutputRoomEventConsumer) Start() (err error) {
+	s.rsConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "federationsender/roomserver",
+		Topic:          string(s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+	})
+	return err
 }
 
 // onMessage is called when the federation server receives a new event from the room server output log.
 // It is unsafe to call this with messages for the same room in multiple gorountines
 // because updates it will likely fail with a types.EventIDMismatchError when it
 // realises that it cannot update the room state using the deltas.
-func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputRoomEventConsumer) onMessage(msg *internal.Message) error {
 	// Parse out the event JSON
 	var output api.OutputEvent
 	if err := json.Unmarshal(msg.Value, &output); err != nil {
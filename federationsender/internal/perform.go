@@ -489,3 +489,28 @@ func setDefaultRoomVersionFromJoinEvent(joinEvent gomatrixserverlib.EventBuilder
 	}
 	return gomatrixserverlib.RoomVersionV4
 }
+
+// PerformServerSeen implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformServerSeen(
+	ctx context.Context,
+	request *api.PerformServerSeenRequest,
+	response *api.PerformServerSeenResponse,
+) (err error) {
+	response.FirstSeen, response.Approved, err = r.db.RecordServerSeen(ctx, request.ServerName)
+	if err != nil {
+		return fmt.Errorf("r.db.RecordServerSeen: %w", err)
+	}
+	return nil
+}
+
+// PerformApproveServer implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformApproveServer(
+	ctx context.Context,
+	request *api.PerformApproveServerRequest,
+	response *api.PerformApproveServerResponse,
+) error {
+	if err := r.db.ApproveServer(ctx, request.ServerName); err != nil {
+		return fmt.Errorf("r.db.ApproveServer: %w", err)
+	}
+	return nil
+}
@@ -22,6 +22,8 @@ const (
 	FederationSenderPerformInviteRequestPath          = "/federationsender/performInviteRequest"
 	FederationSenderPerformServersAlivePath           = "/federationsender/performServersAlive"
 	FederationSenderPerformBroadcastEDUPath           = "/federationsender/performBroadcastEDU"
+	FederationSenderPerformServerSeenPath             = "/federationsender/performServerSeen"
+	FederationSenderPerformApproveServerPath          = "/federationsender/performApproveServer"
 
 	FederationSenderGetUserDevicesPath   = "/federationsender/client/getUserDevices"
 	FederationSenderClaimKeysPath        = "/federationsender/client/claimKeys"
@@ -145,6 +147,32 @@ func (h *httpFederationSenderInternalAPI) PerformBroadcastEDU(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// PerformServerSeen implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) PerformServerSeen(
+	ctx context.Context,
+	request *api.PerformServerSeenRequest,
+	response *api.PerformServerSeenResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformServerSeen")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformServerSeenPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformApproveServer implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) PerformApproveServer(
+	ctx context.Context,
+	request *api.PerformApproveServerRequest,
+	response *api.PerformApproveServerResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformApproveServer")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformApproveServerPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 type getUserDevices struct {
 	S      gomatrixserverlib.ServerName
 	UserID string
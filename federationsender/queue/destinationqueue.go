@@ -33,8 +33,8 @@ import (
 )
 
 const (
-	maxPDUsPerTransaction = 50
-	maxEDUsPerTransaction = 50
+	maxPDUsPerTransaction = 50  // the most PDUs that the spec allows in a transaction
+	maxEDUsPerTransaction = 100 // the most EDUs that the spec allows in a transaction
 	queueIdleTimeout      = time.Second * 30
 )
 
@@ -55,9 +55,13 @@ type destinationQueue struct {
 	transactionIDMutex sync.Mutex                          // protects transactionID
 	transactionID      gomatrixserverlib.TransactionID     // last transaction ID
 	transactionCount   atomic.Int32                        // how many events in this transaction so far
+	maxPDUs            int32                               // the most PDUs to send in a transaction
+	maxEDUs            int                                 // the most EDUs to send in a transaction
 	notifyPDUs         chan bool                           // interrupts idle wait for PDUs
 	notifyEDUs         chan bool                           // interrupts idle wait for EDUs
 	interruptBackoff   chan bool                           // interrupts backoff
+	stop               <-chan struct{}                     // closed when the queues are stopped
+	startWorker        func(worker func())                 // runs the queue worker unless stopped
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -69,7 +73,7 @@ func (oq *destinationQueue) sendEvent(receipt *shared.Receipt) {
 	// events allowed in a single tranaction. We'll reset the counter
 	// when we do.
 	oq.transactionIDMutex.Lock()
-	if oq.transactionID == "" || oq.transactionCount.Load() >= maxPDUsPerTransaction {
+	if oq.transactionID == "" || oq.transactionCount.Load() >= oq.maxPDUs {
 		now := gomatrixserverlib.AsTimestamp(time.Now())
 		oq.transactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, oq.statistics.SuccessCount()))
 		oq.transactionCount.Store(0)
@@ -148,7 +152,7 @@ func (oq *destinationQueue) wakeQueueIfNeeded() {
 	// If we aren't running then wake up the queue.
 	if !oq.running.Load() {
 		// Start the queue.
-		go oq.backgroundSend()
+		oq.startWorker(oq.backgroundSend)
 	}
 }
 
@@ -209,6 +213,13 @@ func (oq *destinationQueue) backgroundSend() {
 	for {
 		pendingPDUs, pendingEDUs := false, false
 
+		// Don't start another transaction if we're shutting down.
+		select {
+		case <-oq.stop:
+			return
+		default:
+		}
+
 		// If we have nothing to do then wait either for incoming events, or
 		// until we hit an idle timeout.
 		select {
@@ -226,6 +237,10 @@ func (oq *destinationQueue) backgroundSend() {
 			// send.
 			log.Tracef("Queue %q has been idle for %s, going to sleep", oq.destination, queueIdleTimeout)
 			return
+		case <-oq.stop:
+			// We're shutting down. Anything still pending stays in the
+			// database until the next time we start.
+			return
 		}
 
 		// If we are backing off this server then wait for the
@@ -247,6 +262,8 @@ func (oq *destinationQueue) backgroundSend() {
 			select {
 			case <-time.After(duration):
 			case <-oq.interruptBackoff:
+			case <-oq.stop:
+				return
 			}
 		}
 
@@ -291,14 +308,15 @@ func (oq *destinationQueue) nextTransaction() (bool, error) {
 	t.OriginServerTS = gomatrixserverlib.AsTimestamp(time.Now())
 
 	// Ask the database for any pending PDUs from the next transaction.
-	// maxPDUsPerTransaction is an upper limit but we probably won't
-	// actually retrieve that many events.
+	// maxPDUs is an upper limit but we probably won't actually
+	// retrieve that many events. If there are more PDUs in the
+	// transaction than that, then the database splits it up.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 	txid, pdus, pduReceipt, err := oq.db.GetNextTransactionPDUs(
-		ctx,                   // context
-		oq.destination,        // server name
-		maxPDUsPerTransaction, // max events to retrieve
+		ctx,             // context
+		oq.destination,  // server name
+		int(oq.maxPDUs), // max events to retrieve
 	)
 	if err != nil {
 		log.WithError(err).Errorf("failed to get next transaction PDUs for server %q", oq.destination)
@@ -306,9 +324,9 @@ func (oq *destinationQueue) nextTransaction() (bool, error) {
 	}
 
 	edus, eduReceipt, err := oq.db.GetNextTransactionEDUs(
-		ctx,                   // context
-		oq.destination,        // server name
-		maxEDUsPerTransaction, // max events to retrieve
+		ctx,            // context
+		oq.destination, // server name
+		oq.maxEDUs,     // max events to retrieve
 	)
 	if err != nil {
 		log.WithError(err).Errorf("failed to get next transaction EDUs for server %q", oq.destination)
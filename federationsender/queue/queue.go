@@ -24,6 +24,7 @@ import (
 
 	"github.com/matrix-org/dendrite/federationsender/statistics"
 	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
@@ -34,6 +35,7 @@ import (
 // matrix servers
 type OutgoingQueues struct {
 	db          storage.Database
+	cfg         *config.FederationSender
 	rsAPI       api.RoomserverInternalAPI
 	origin      gomatrixserverlib.ServerName
 	client      *gomatrixserverlib.FederationClient
@@ -41,11 +43,16 @@ type OutgoingQueues struct {
 	signing     *SigningInfo
 	queuesMutex sync.Mutex // protects the below
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
+	stopMutex   sync.Mutex    // protects stopped
+	stopped     bool          // true once Stop has been called
+	stop        chan struct{} // closed by Stop
+	workers     sync.WaitGroup
 }
 
 // NewOutgoingQueues makes a new OutgoingQueues
 func NewOutgoingQueues(
 	db storage.Database,
+	cfg *config.FederationSender,
 	origin gomatrixserverlib.ServerName,
 	client *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
@@ -54,12 +61,14 @@ func NewOutgoingQueues(
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		db:         db,
+		cfg:        cfg,
 		rsAPI:      rsAPI,
 		origin:     origin,
 		client:     client,
 		statistics: statistics,
 		signing:    signing,
 		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
+		stop:       make(chan struct{}),
 	}
 	// Look up which servers we have pending items for and then rehydrate those queues.
 	time.AfterFunc(time.Second*5, func() {
@@ -100,6 +109,13 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 	defer oqs.queuesMutex.Unlock()
 	oq := oqs.queues[destination]
 	if oq == nil {
+		maxPDUs, maxEDUs := oqs.cfg.MaxPDUsPerTransaction, oqs.cfg.MaxEDUsPerTransaction
+		if maxPDUs <= 0 || maxPDUs > maxPDUsPerTransaction {
+			maxPDUs = maxPDUsPerTransaction
+		}
+		if maxEDUs <= 0 || maxEDUs > maxEDUsPerTransaction {
+			maxEDUs = maxEDUsPerTransaction
+		}
 		oq = &destinationQueue{
 			db:               oqs.db,
 			rsAPI:            oqs.rsAPI,
@@ -111,12 +127,54 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 			notifyEDUs:       make(chan bool, 1),
 			interruptBackoff: make(chan bool),
 			signing:          oqs.signing,
+			maxPDUs:          int32(maxPDUs),
+			maxEDUs:          maxEDUs,
+			stop:             oqs.stop,
+			startWorker:      oqs.startWorker,
 		}
 		oqs.queues[destination] = oq
 	}
 	return oq
 }
 
+// startWorker runs a destination queue worker in the background, unless the
+// queues have been stopped.
+func (oqs *OutgoingQueues) startWorker(worker func()) {
+	oqs.stopMutex.Lock()
+	defer oqs.stopMutex.Unlock()
+	if oqs.stopped {
+		return
+	}
+	oqs.workers.Add(1)
+	go func() {
+		defer oqs.workers.Done()
+		worker()
+	}()
+}
+
+// Stop stops the destination queues, waiting for the transactions being sent
+// to finish or for the context to be done. Events which haven't been sent yet
+// stay in the database, and are sent once the queues start up again.
+func (oqs *OutgoingQueues) Stop(ctx context.Context) error {
+	oqs.stopMutex.Lock()
+	if !oqs.stopped {
+		oqs.stopped = true
+		close(oqs.stop)
+	}
+	oqs.stopMutex.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		oqs.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // SendEvent sends an event to the destinations
 func (oqs *OutgoingQueues) SendEvent(
 	ev *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName,
@@ -197,6 +255,14 @@ func (oqs *OutgoingQueues) SendEDU(
 	}
 	delete(destmap, oqs.origin)
 
+	// Typing notifications and presence may be turned off for some or all
+	// destinations.
+	for destination := range destmap {
+		if !oqs.cfg.SendsEDU(destination, e.Type) {
+			delete(destmap, destination)
+		}
+	}
+
 	// There is absolutely no guarantee that the EDU will have a room_id
 	// field, as it is not required by the spec. However, if it *does*
 	// (e.g. typing notifications) then we should try to make sure we don't
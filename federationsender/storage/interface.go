@@ -53,4 +53,9 @@ type Database interface {
 	AddServerToBlacklist(serverName gomatrixserverlib.ServerName) error
 	RemoveServerFromBlacklist(serverName gomatrixserverlib.ServerName) error
 	IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error)
+
+	// RecordServerSeen records that a server has sent us a transaction and
+	// returns when it first did so and whether it has been approved.
+	RecordServerSeen(ctx context.Context, serverName gomatrixserverlib.ServerName) (firstSeen gomatrixserverlib.Timestamp, approved bool, err error)
+	ApproveServer(ctx context.Context, serverName gomatrixserverlib.ServerName) error
 }
@@ -0,0 +1,35 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadKnownServers(m *sqlutil.Migrations) {
+	m.AddMigration(UpKnownServers, DownKnownServers)
+}
+
+// UpKnownServers approves the servers that we already share rooms with, so
+// that turning on quarantine_new_servers after upgrading doesn't soft-fail
+// events from every existing peer. They are recorded as first seen at 0 as
+// we don't know when that was.
+func UpKnownServers(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+INSERT INTO federationsender_known_servers (server_name, first_seen_ts, approved)
+	SELECT DISTINCT server_name, 0, true FROM federationsender_joined_hosts
+	ON CONFLICT (server_name) DO NOTHING;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownKnownServers(tx *sql.Tx) error {
+	_, err := tx.Exec(`DELETE FROM federationsender_known_servers WHERE first_seen_ts = 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const knownServersSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_known_servers (
+    -- The name of a server which has sent us a transaction
+	server_name TEXT NOT NULL PRIMARY KEY,
+    -- When the server first sent us a transaction
+	first_seen_ts BIGINT NOT NULL,
+    -- Whether an admin has approved the server, taking it out of quarantine
+	approved BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+const insertKnownServerSQL = "" +
+	"INSERT INTO federationsender_known_servers (server_name, first_seen_ts) VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectKnownServerSQL = "" +
+	"SELECT first_seen_ts, approved FROM federationsender_known_servers WHERE server_name = $1"
+
+const upsertApprovedServerSQL = "" +
+	"INSERT INTO federationsender_known_servers (server_name, first_seen_ts, approved) VALUES ($1, $2, TRUE)" +
+	" ON CONFLICT (server_name) DO UPDATE SET approved = TRUE"
+
+type knownServersStatements struct {
+	db                       *sql.DB
+	insertKnownServerStmt    *sql.Stmt
+	selectKnownServerStmt    *sql.Stmt
+	upsertApprovedServerStmt *sql.Stmt
+}
+
+func NewPostgresKnownServersTable(db *sql.DB) (s *knownServersStatements, err error) {
+	s = &knownServersStatements{
+		db: db,
+	}
+	_, err = db.Exec(knownServersSchema)
+	if err != nil {
+		return
+	}
+
+	if s.insertKnownServerStmt, err = db.Prepare(insertKnownServerSQL); err != nil {
+		return
+	}
+	if s.selectKnownServerStmt, err = db.Prepare(selectKnownServerSQL); err != nil {
+		return
+	}
+	if s.upsertApprovedServerStmt, err = db.Prepare(upsertApprovedServerSQL); err != nil {
+		return
+	}
+	return
+}
+
+// InsertKnownServer records when a server was first seen, if it hasn't been
+// seen before.
+func (s *knownServersStatements) InsertKnownServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	firstSeen gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertKnownServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName, firstSeen)
+	return err
+}
+
+// SelectKnownServer returns when a server was first seen and whether it has
+// been approved. Returns sql.ErrNoRows if the server has never been seen.
+func (s *knownServersStatements) SelectKnownServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+) (firstSeen gomatrixserverlib.Timestamp, approved bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectKnownServerStmt)
+	err = stmt.QueryRowContext(ctx, serverName).Scan(&firstSeen, &approved)
+	return
+}
+
+// UpsertApprovedServer marks a server as approved, recording it as first
+// seen at the given time if it hasn't been seen before.
+func (s *knownServersStatements) UpsertApprovedServer(
+	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
+	firstSeen gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertApprovedServerStmt)
+	_, err := stmt.ExecContext(ctx, serverName, firstSeen)
+	return err
+}
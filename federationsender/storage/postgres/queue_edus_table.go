@@ -48,6 +48,7 @@ const deleteQueueEDUSQL = "" +
 const selectQueueEDUSQL = "" +
 	"SELECT json_nid FROM federationsender_queue_edus" +
 	" WHERE server_name = $1" +
+	" ORDER BY json_nid ASC" +
 	" LIMIT $2"
 
 const selectQueueEDUReferenceJSONCountSQL = "" +
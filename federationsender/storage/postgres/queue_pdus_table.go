@@ -54,6 +54,7 @@ const selectQueuePDUNextTransactionIDSQL = "" +
 const selectQueuePDUsByTransactionSQL = "" +
 	"SELECT json_nid FROM federationsender_queue_pdus" +
 	" WHERE server_name = $1 AND transaction_id = $2" +
+	" ORDER BY json_nid ASC" +
 	" LIMIT $3"
 
 const selectQueuePDUReferenceJSONCountSQL = "" +
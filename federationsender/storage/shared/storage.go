@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/storage/tables"
 	"github.com/matrix-org/dendrite/federationsender/types"
@@ -27,14 +28,15 @@ import (
 )
 
 type Database struct {
-	DB                          *sql.DB
-	Writer                      sqlutil.Writer
-	FederationSenderQueuePDUs   tables.FederationSenderQueuePDUs
-	FederationSenderQueueEDUs   tables.FederationSenderQueueEDUs
-	FederationSenderQueueJSON   tables.FederationSenderQueueJSON
-	FederationSenderJoinedHosts tables.FederationSenderJoinedHosts
-	FederationSenderRooms       tables.FederationSenderRooms
-	FederationSenderBlacklist   tables.FederationSenderBlacklist
+	DB                           *sql.DB
+	Writer                       sqlutil.Writer
+	FederationSenderQueuePDUs    tables.FederationSenderQueuePDUs
+	FederationSenderQueueEDUs    tables.FederationSenderQueueEDUs
+	FederationSenderQueueJSON    tables.FederationSenderQueueJSON
+	FederationSenderJoinedHosts  tables.FederationSenderJoinedHosts
+	FederationSenderRooms        tables.FederationSenderRooms
+	FederationSenderBlacklist    tables.FederationSenderBlacklist
+	FederationSenderKnownServers tables.FederationSenderKnownServers
 }
 
 // An Receipt contains the NIDs of a call to GetNextTransactionPDUs/EDUs.
@@ -163,3 +165,26 @@ func (d *Database) RemoveServerFromBlacklist(serverName gomatrixserverlib.Server
 func (d *Database) IsServerBlacklisted(serverName gomatrixserverlib.ServerName) (bool, error) {
 	return d.FederationSenderBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
+
+// RecordServerSeen records that a server has been seen now, unless it has
+// been seen before, and returns when it was first seen and whether it has
+// been approved.
+func (d *Database) RecordServerSeen(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) (firstSeen gomatrixserverlib.Timestamp, approved bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err = d.FederationSenderKnownServers.InsertKnownServer(ctx, txn, serverName, gomatrixserverlib.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		firstSeen, approved, err = d.FederationSenderKnownServers.SelectKnownServer(ctx, txn, serverName)
+		return err
+	})
+	return
+}
+
+// ApproveServer marks a server as approved, whether or not it has been seen.
+func (d *Database) ApproveServer(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationSenderKnownServers.UpsertApprovedServer(ctx, txn, serverName, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+}
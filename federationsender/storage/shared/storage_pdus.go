@@ -76,10 +76,21 @@ func (d *Database) GetNextTransactionPDUs(
 			return nil
 		}
 
-		nids, err := d.FederationSenderQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, transactionID, limit)
+		// Select one more PDU than the limit to find out whether the
+		// transaction has more PDUs than can be sent at once, e.g. if the
+		// limit has been lowered since the PDUs were queued.
+		nids, err := d.FederationSenderQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, transactionID, limit+1)
 		if err != nil {
 			return fmt.Errorf("SelectQueuePDUs: %w", err)
 		}
+		if len(nids) > limit {
+			// Split the transaction. The remote server ignores transaction
+			// IDs that it has seen before, so the first part gets its own ID.
+			// The ID only depends on which PDUs are in it, so it stays the
+			// same if sending it has to be retried.
+			nids = nids[:limit]
+			transactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%s-%d", transactionID, nids[0]))
+		}
 
 		receipt = &Receipt{
 			nids: nids,
@@ -90,7 +101,12 @@ func (d *Database) GetNextTransactionPDUs(
 			return fmt.Errorf("SelectQueueJSON: %w", err)
 		}
 
-		for _, blob := range blobs {
+		// Keep the PDUs in the order that they were queued in.
+		for _, nid := range nids {
+			blob, ok := blobs[nid]
+			if !ok {
+				continue
+			}
 			var event gomatrixserverlib.HeaderedEvent
 			if err := json.Unmarshal(blob, &event); err != nil {
 				return fmt.Errorf("json.Unmarshal: %w", err)
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestKnownServersSeededFromJoinedHosts(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "federationsender_known_servers_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	dbProperties := &config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	}
+	d, err := NewDatabase(dbProperties)
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	ctx := context.Background()
+
+	// Pretend that the database was created before the known servers
+	// migration, when we already shared a room with kaer.morhen.
+	if _, err = d.db.Exec(
+		"INSERT INTO federationsender_joined_hosts (room_id, event_id, server_name) VALUES ($1, $2, $3)",
+		"!room:kaer.morhen", "$join:kaer.morhen", "kaer.morhen",
+	); err != nil {
+		t.Fatalf("failed to insert joined host: %s", err)
+	}
+	if _, err = d.db.Exec("UPDATE schema_versions SET version = 0 WHERE component = 'federationsender'"); err != nil {
+		t.Fatalf("failed to reset the schema version: %s", err)
+	}
+	if err = Migrations().RunDeltas(d.db, dbProperties); err != nil {
+		t.Fatalf("failed to run migrations: %s", err)
+	}
+
+	if _, approved, err := d.RecordServerSeen(ctx, "kaer.morhen"); err != nil || !approved {
+		t.Errorf("joined host: got approved %v and error %v, want it approved", approved, err)
+	}
+	if _, approved, err := d.RecordServerSeen(ctx, "novigrad.example"); err != nil || approved {
+		t.Errorf("new server: got approved %v and error %v, want it not approved", approved, err)
+	}
+}
@@ -56,6 +56,7 @@ const selectQueueNextTransactionIDSQL = "" +
 const selectQueuePDUsByTransactionSQL = "" +
 	"SELECT json_nid FROM federationsender_queue_pdus" +
 	" WHERE server_name = $1 AND transaction_id = $2" +
+	" ORDER BY json_nid ASC" +
 	" LIMIT $3"
 
 const selectQueuePDUsReferenceJSONCountSQL = "" +
@@ -21,6 +21,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/matrix-org/dendrite/federationsender/storage/shared"
+	"github.com/matrix-org/dendrite/federationsender/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
@@ -33,6 +34,13 @@ type Database struct {
 	writer sqlutil.Writer
 }
 
+// Migrations returns the schema migrations of the federation sender database.
+func Migrations() *sqlutil.Migrations {
+	m := sqlutil.NewMigrations("federationsender")
+	deltas.LoadKnownServers(m)
+	return m
+}
+
 // NewDatabase opens a new database
 func NewDatabase(dbProperties *config.DatabaseOptions) (*Database, error) {
 	var d Database
@@ -65,15 +73,25 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	knownServers, err := NewSQLiteKnownServersTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	// The known servers are seeded from the joined hosts, so both tables
+	// have to exist before the migrations run.
+	if err = Migrations().RunDeltas(d.db, dbProperties); err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
-		DB:                          d.db,
-		Writer:                      d.writer,
-		FederationSenderJoinedHosts: joinedHosts,
-		FederationSenderQueuePDUs:   queuePDUs,
-		FederationSenderQueueEDUs:   queueEDUs,
-		FederationSenderQueueJSON:   queueJSON,
-		FederationSenderRooms:       rooms,
-		FederationSenderBlacklist:   blacklist,
+		DB:                           d.db,
+		Writer:                       d.writer,
+		FederationSenderJoinedHosts:  joinedHosts,
+		FederationSenderQueuePDUs:    queuePDUs,
+		FederationSenderQueueEDUs:    queueEDUs,
+		FederationSenderQueueJSON:    queueJSON,
+		FederationSenderRooms:        rooms,
+		FederationSenderBlacklist:    blacklist,
+		FederationSenderKnownServers: knownServers,
 	}
 	if err = d.PartitionOffsetStatements.Prepare(d.db, d.writer, "federationsender"); err != nil {
 		return nil, err
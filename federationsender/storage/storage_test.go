@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestGetNextTransactionPDUsSplitsTransactions(t *testing.T) {
+	ctx := context.Background()
+	db, err := NewDatabase(&config.DatabaseOptions{
+		ConnectionString:   "file::memory:",
+		MaxOpenConnections: 1,
+		MaxIdleConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	const destination = gomatrixserverlib.ServerName("white.orchard")
+	const transactionID = gomatrixserverlib.TransactionID("1600000000000-0")
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	var queued []string
+	for i := 0; i < 5; i++ {
+		eb := gomatrixserverlib.EventBuilder{
+			Sender: "@geralt:kaer.morhen",
+			RoomID: "!room:kaer.morhen",
+			Type:   "m.room.message",
+			Depth:  int64(i + 1),
+		}
+		if err = eb.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), "kaer.morhen", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		js, err := json.Marshal(ev.Headered(gomatrixserverlib.RoomVersionV6))
+		if err != nil {
+			t.Fatalf("failed to marshal event: %s", err)
+		}
+		receipt, err := db.StoreJSON(ctx, string(js))
+		if err != nil {
+			t.Fatalf("StoreJSON failed: %s", err)
+		}
+		if err = db.AssociatePDUWithDestination(ctx, transactionID, destination, receipt); err != nil {
+			t.Fatalf("AssociatePDUWithDestination failed: %s", err)
+		}
+		queued = append(queued, ev.EventID())
+	}
+
+	// The five PDUs were queued in one transaction, but only two can be sent
+	// at once, so they are sent in three transactions in the order that they
+	// were queued in.
+	seenIDs := map[gomatrixserverlib.TransactionID]bool{}
+	var sent []string
+	for i, wantCount := range []int{2, 2, 1} {
+		txnID, events, receipt, err := db.GetNextTransactionPDUs(ctx, destination, 2)
+		if err != nil {
+			t.Fatalf("transaction %d: GetNextTransactionPDUs failed: %s", i, err)
+		}
+		if len(events) != wantCount {
+			t.Fatalf("transaction %d: got %d PDUs, want %d", i, len(events), wantCount)
+		}
+		if seenIDs[txnID] {
+			t.Errorf("transaction %d: transaction ID %q was already used", i, txnID)
+		}
+		seenIDs[txnID] = true
+
+		// Retrying a transaction must not change its ID.
+		retryID, _, _, err := db.GetNextTransactionPDUs(ctx, destination, 2)
+		if err != nil {
+			t.Fatalf("transaction %d: GetNextTransactionPDUs failed: %s", i, err)
+		}
+		if retryID != txnID {
+			t.Errorf("transaction %d: got transaction ID %q when retrying, want %q", i, retryID, txnID)
+		}
+
+		for _, ev := range events {
+			sent = append(sent, ev.EventID())
+		}
+		if err = db.CleanPDUs(ctx, destination, receipt); err != nil {
+			t.Fatalf("transaction %d: CleanPDUs failed: %s", i, err)
+		}
+	}
+	for i := range queued {
+		if sent[i] != queued[i] {
+			t.Errorf("PDU %d: got event %s, want %s", i, sent[i], queued[i])
+		}
+	}
+}
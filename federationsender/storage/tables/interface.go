@@ -67,3 +67,9 @@ type FederationSenderBlacklist interface {
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (bool, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
 }
+
+type FederationSenderKnownServers interface {
+	InsertKnownServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, firstSeen gomatrixserverlib.Timestamp) error
+	SelectKnownServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (firstSeen gomatrixserverlib.Timestamp, approved bool, err error)
+	UpsertApprovedServer(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName, firstSeen gomatrixserverlib.Timestamp) error
+}
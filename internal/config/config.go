@@ -65,6 +65,8 @@ type Dendrite struct {
 	SigningKeyServer SigningKeyServer `yaml:"signing_key_server"`
 	SyncAPI          SyncAPI          `yaml:"sync_api"`
 	UserAPI          UserAPI          `yaml:"user_api"`
+	P2P              P2P              `yaml:"p2p"`
+	HTTPServer       HTTPServer       `yaml:"http_server"`
 
 	// The config for tracing the dendrite servers.
 	Tracing struct {
@@ -74,8 +76,8 @@ type Dendrite struct {
 		Jaeger jaegerconfig.Configuration `yaml:"jaeger"`
 	} `yaml:"tracing"`
 
-	// The config for logging informations. Each hook will be added to logrus.
-	Logging []LogrusHook `yaml:"logging"`
+	// The config for logging informations.
+	Logging Logging `yaml:"logging"`
 
 	// Any information derived from the configuration options for later use.
 	Derived Derived `yaml:"-"`
@@ -169,6 +171,48 @@ type ThumbnailSize struct {
 	ResizeMethod string `yaml:"method,omitempty"`
 }
 
+// Logging configures the format and levels of the logs, and any hooks which
+// write them somewhere other than stderr.
+type Logging struct {
+	// The format of the logs, either "text" or "json".
+	Format string `yaml:"format"`
+
+	// The level of the logs written to stderr.
+	Level string `yaml:"level"`
+
+	// Levels which override Level for specific components, keyed by the
+	// component name, e.g. "SyncAPI" or "Monolith".
+	Components map[string]string `yaml:"components"`
+
+	// Each hook will be added to logrus.
+	Hooks []LogrusHook `yaml:"hooks"`
+}
+
+func (c *Logging) Defaults() {
+	c.Format = "text"
+	c.Level = "info"
+}
+
+// UnmarshalYAML accepts either the logging options or, as older config files
+// have, just a list of hooks.
+func (c *Logging) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var hooks []LogrusHook
+	if err := unmarshal(&hooks); err == nil {
+		c.Hooks = hooks
+		return nil
+	}
+	type logging Logging
+	return unmarshal((*logging)(c))
+}
+
+// LevelFor returns the level of the logs written to stderr by a component.
+func (c *Logging) LevelFor(componentName string) string {
+	if level, ok := c.Components[componentName]; ok {
+		return level
+	}
+	return c.Level
+}
+
 // LogrusHook represents a single logrus hook. At this point, only parsing and
 // verification of the proper values for type and level are done.
 // Validity/integrity checks on the parameters are done when configuring logrus.
@@ -282,6 +326,19 @@ func (config *Dendrite) Derive() error {
 			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
 	}
 
+	// Users must accept the configured policies whichever flow they follow.
+	if len(config.ClientAPI.Terms) > 0 {
+		policies := make(map[string]interface{}, len(config.ClientAPI.Terms))
+		for i := range config.ClientAPI.Terms {
+			policies[config.ClientAPI.Terms[i].ID] = config.ClientAPI.Terms[i].Params()
+		}
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = map[string]interface{}{"policies": policies}
+		for i := range config.Derived.Registration.Flows {
+			flow := &config.Derived.Registration.Flows[i]
+			flow.Stages = append(flow.Stages, authtypes.LoginTypeTerms)
+		}
+	}
+
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
 		return err
@@ -306,6 +363,9 @@ func (c *Dendrite) Defaults() {
 	c.SyncAPI.Defaults()
 	c.UserAPI.Defaults()
 	c.AppServiceAPI.Defaults()
+	c.P2P.Defaults()
+	c.HTTPServer.Defaults()
+	c.Logging.Defaults()
 
 	c.Wiring()
 }
@@ -319,7 +379,7 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		&c.EDUServer, &c.FederationAPI, &c.FederationSender,
 		&c.KeyServer, &c.MediaAPI, &c.RoomServer,
 		&c.SigningKeyServer, &c.SyncAPI, &c.UserAPI,
-		&c.AppServiceAPI,
+		&c.AppServiceAPI, &c.P2P, &c.HTTPServer,
 	} {
 		c.Verify(configErrs, isMonolith)
 	}
@@ -340,6 +400,16 @@ func (c *Dendrite) Wiring() {
 
 	c.ClientAPI.Derived = &c.Derived
 	c.AppServiceAPI.Derived = &c.Derived
+
+	c.FederationAPI.RoomDirectory = &c.ClientAPI.RoomDirectory.Federation
+	c.ClientAPI.DefaultPowerLevels = &c.RoomServer.DefaultPowerLevels
+	c.ClientAPI.EventTypeFilter = &c.RoomServer.EventTypeFilter
+	c.FederationAPI.EventTypeFilter = &c.RoomServer.EventTypeFilter
+	c.ClientAPI.AccountDatabase = &c.UserAPI.AccountDatabase
+	c.ClientAPI.DeviceDatabase = &c.UserAPI.DeviceDatabase
+	c.FederationAPI.RoomServerDatabase = &c.RoomServer.Database
+	c.SyncAPI.PageLimits = &c.ClientAPI.PageLimits
+	c.RoomServer.PageLimits = &c.ClientAPI.PageLimits
 }
 
 // Error returns a string detailing how many errors were contained within a
@@ -408,12 +478,28 @@ func checkURL(configErrs *ConfigErrors, key, value string) {
 
 // checkLogging verifies the parameters logging.* are valid.
 func (config *Dendrite) checkLogging(configErrs *ConfigErrors) {
-	for _, logrusHook := range config.Logging {
+	switch config.Logging.Format {
+	case "text", "json":
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "logging.format", config.Logging.Format))
+	}
+	checkLogLevel(configErrs, "logging.level", config.Logging.Level)
+	for component, level := range config.Logging.Components {
+		checkLogLevel(configErrs, fmt.Sprintf("logging.components.%s", component), level)
+	}
+	for _, logrusHook := range config.Logging.Hooks {
 		checkNotEmpty(configErrs, "logging.type", string(logrusHook.Type))
 		checkNotEmpty(configErrs, "logging.level", string(logrusHook.Level))
 	}
 }
 
+// checkLogLevel verifies that a log level is one which logrus understands.
+func checkLogLevel(configErrs *ConfigErrors, key, value string) {
+	if _, err := logrus.ParseLevel(value); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key, value))
+	}
+}
+
 // check returns an error type containing all errors found within the config
 // file.
 func (config *Dendrite) check(_ bool) error { // monolithic
@@ -84,7 +84,9 @@ type ApplicationService struct {
 	// Information about an application service's namespaces. Key is either
 	// "users", "aliases" or "rooms"
 	NamespaceMap map[string][]ApplicationServiceNamespace `yaml:"namespaces"`
-	// Whether rate limiting is applied to each application service user
+	// Whether rate limiting is applied to each application service user. If
+	// false then the sender and the users in exclusive namespaces aren't rate
+	// limited by the client API.
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
@@ -298,10 +300,6 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		idMap[appservice.ID] = true
 		tokenMap[appservice.ASToken] = true
 
-		// TODO: Remove once rate_limited is implemented
-		if appservice.RateLimited {
-			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
-		}
 		// TODO: Remove once protocols is implemented
 		if len(appservice.Protocols) > 0 {
 			log.Warn("WARNING: Application service option protocols is currently unimplemented")
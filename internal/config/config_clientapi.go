@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"strings"
 	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type ClientAPI struct {
@@ -18,6 +22,12 @@ type ClientAPI struct {
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+	// If set, open registration is only allowed from client IP addresses in
+	// these CIDR ranges.
+	RegistrationAllowedCIDRs []string `yaml:"registration_allowed_cidrs"`
+	// Open registration is never allowed from client IP addresses in these
+	// CIDR ranges, even if they are also in RegistrationAllowedCIDRs.
+	RegistrationDeniedCIDRs []string `yaml:"registration_denied_cidrs"`
 
 	// Boolean stating whether catpcha registration is enabled
 	// and required
@@ -37,6 +47,70 @@ type ClientAPI struct {
 
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
+	// Room directory publishing options
+	RoomDirectory RoomDirectory `yaml:"room_directory"`
+
+	// Limits on the size of request bodies
+	RequestBodyLimits RequestBodyLimits `yaml:"request_body_limits"`
+
+	// Limits on the number of events returned in a page
+	PageLimits PageLimits `yaml:"page_limits"`
+
+	// The most rooms that a user can be joined to before they are stopped
+	// from creating or joining more. 0 means unlimited.
+	MaxRoomsPerUser int `yaml:"max_rooms_per_user"`
+
+	// Users who aren't subject to max_rooms_per_user or room_server.max_rooms.
+	// Application service users are always exempt.
+	RoomLimitExemptUsers []string `yaml:"room_limit_exempt_users"`
+
+	// The most devices that a user can have. Logging in on another device
+	// once reached either fails or, if EvictDevicesOverLimit is set, logs out
+	// the user's least recently used devices. 0 means unlimited. Admins can
+	// override this for individual users.
+	MaxDevicesPerUser int `yaml:"max_devices_per_user"`
+
+	// Whether logging in on a new device once max_devices_per_user has been
+	// reached logs out the least recently used devices instead of failing.
+	EvictDevicesOverLimit bool `yaml:"evict_devices_over_limit"`
+
+	// Rooms, by ID or alias, that newly registered users are joined to.
+	// Failing to join one of them doesn't fail the registration.
+	AutoJoinRooms []string `yaml:"auto_join_rooms"`
+
+	// Whether invites are automatically accepted on behalf of local users.
+	// Users can override this with m.accept_invites account data.
+	AutoAcceptInvites AutoAcceptInvites `yaml:"auto_accept_invites"`
+
+	// How long access tokens are valid for if the client asked for a refresh
+	// token when logging in or registering. 0 means that refresh tokens are
+	// not issued and access tokens never expire.
+	AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+
+	// How long refresh tokens are valid for. 0 means that they never expire.
+	RefreshTokenLifetime time.Duration `yaml:"refresh_token_lifetime"`
+
+	// How long a user-interactive auth session, e.g. for registration, can
+	// take to complete. 0 means that sessions never expire.
+	UIASessionLifetime time.Duration `yaml:"uia_session_lifetime"`
+
+	// Policies, such as terms of service, which users must accept before
+	// they can register.
+	Terms []TermsPolicy `yaml:"terms"`
+
+	// The power levels that new rooms start with. This is configured in
+	// room_server.default_power_levels, alongside the other room options.
+	DefaultPowerLevels *DefaultPowerLevels `yaml:"-"`
+
+	// Which event types local users can send. This is configured in
+	// room_server.allowed_event_types and room_server.denied_event_types.
+	EventTypeFilter *EventTypeFilter `yaml:"-"`
+
+	// The user API databases, which almost every request depends on. These
+	// are configured in user_api.account_database and user_api.device_database.
+	AccountDatabase *DatabaseOptions `yaml:"-"`
+	DeviceDatabase  *DatabaseOptions `yaml:"-"`
 }
 
 func (c *ClientAPI) Defaults() {
@@ -50,7 +124,15 @@ func (c *ClientAPI) Defaults() {
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = false
+	c.RegistrationAllowedCIDRs = []string{}
+	c.RegistrationDeniedCIDRs = []string{}
+	c.AutoJoinRooms = []string{}
+	c.Terms = []TermsPolicy{}
+	c.UIASessionLifetime = time.Hour
 	c.RateLimiting.Defaults()
+	c.RoomDirectory.Defaults()
+	c.RequestBodyLimits.Defaults()
+	c.PageLimits.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -64,8 +146,127 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
 	}
+	for _, cidr := range c.RegistrationAllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid CIDR for config key %q: %s", "client_api.registration_allowed_cidrs", cidr))
+		}
+	}
+	for _, cidr := range c.RegistrationDeniedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid CIDR for config key %q: %s", "client_api.registration_denied_cidrs", cidr))
+		}
+	}
+	for _, room := range c.AutoJoinRooms {
+		if !strings.HasPrefix(room, "!") && !strings.HasPrefix(room, "#") {
+			configErrs.Add(fmt.Sprintf("invalid room ID or alias for config key %q: %s", "client_api.auto_join_rooms", room))
+		}
+	}
+	c.AutoAcceptInvites.Verify(configErrs)
+	policyIDs := make(map[string]bool, len(c.Terms))
+	for i := range c.Terms {
+		c.Terms[i].Verify(configErrs)
+		if policyIDs[c.Terms[i].ID] {
+			configErrs.Add(fmt.Sprintf("duplicate policy ID for config key %q: %s", "client_api.terms", c.Terms[i].ID))
+		}
+		policyIDs[c.Terms[i].ID] = true
+	}
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.RoomDirectory.Verify(configErrs)
+	c.RequestBodyLimits.Verify(configErrs)
+	c.PageLimits.Verify(configErrs)
+	checkPositive(configErrs, "client_api.max_rooms_per_user", int64(c.MaxRoomsPerUser))
+	checkPositive(configErrs, "client_api.max_devices_per_user", int64(c.MaxDevicesPerUser))
+	checkPositive(configErrs, "client_api.access_token_lifetime", int64(c.AccessTokenLifetime))
+	checkPositive(configErrs, "client_api.refresh_token_lifetime", int64(c.RefreshTokenLifetime))
+	checkPositive(configErrs, "client_api.uia_session_lifetime", int64(c.UIASessionLifetime))
+	if c.RefreshTokenLifetime > 0 && c.RefreshTokenLifetime < c.AccessTokenLifetime {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: must not be shorter than access_token_lifetime", "client_api.refresh_token_lifetime"))
+	}
+}
+
+// TermsPolicy is a policy document, such as terms of service, which users
+// must accept before they can register or log in.
+type TermsPolicy struct {
+	// The ID of the policy, e.g. "privacy_policy".
+	ID string `yaml:"id"`
+	// The version of the policy. Users are asked to accept the policy again
+	// when the version changes.
+	Version string `yaml:"version"`
+	// The policy document in each language, keyed by language code, e.g. "en".
+	Languages map[string]TermsDocument `yaml:"languages"`
+}
+
+// TermsDocument is a policy document in a single language.
+type TermsDocument struct {
+	// The name of the policy as shown to users.
+	Name string `yaml:"name"`
+	// Where the policy document can be read.
+	URL string `yaml:"url"`
+}
+
+func (p *TermsPolicy) Verify(configErrs *ConfigErrors) {
+	checkNotEmpty(configErrs, "client_api.terms.id", p.ID)
+	checkNotEmpty(configErrs, "client_api.terms.version", p.Version)
+	if len(p.Languages) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key %q for policy %q", "client_api.terms.languages", p.ID))
+	}
+	for _, doc := range p.Languages {
+		checkNotEmpty(configErrs, "client_api.terms.languages.name", doc.Name)
+		checkURL(configErrs, "client_api.terms.languages.url", doc.URL)
+	}
+}
+
+// Params returns the policy in the form used by the parameters of the
+// m.login.terms authentication stage.
+func (p *TermsPolicy) Params() map[string]interface{} {
+	params := map[string]interface{}{
+		"version": p.Version,
+	}
+	for lang, doc := range p.Languages {
+		params[lang] = map[string]string{
+			"name": doc.Name,
+			"url":  doc.URL,
+		}
+	}
+	return params
+}
+
+// AutoAcceptInvites is the policy for accepting invites automatically. The
+// same fields are read from m.accept_invites account data, which takes
+// precedence over the server default for that user.
+type AutoAcceptInvites struct {
+	// If true, invites are accepted automatically.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// If true, only invites to direct message rooms are accepted.
+	OnlyDirect bool `yaml:"only_direct" json:"only_direct"`
+	// If not empty, only invites sent by these users are accepted.
+	FromUsers []string `yaml:"from_users" json:"from_users"`
+}
+
+// Accepts returns true if an invite from the given user should be accepted.
+// isDirect is the is_direct flag from the invite.
+func (a *AutoAcceptInvites) Accepts(sender string, isDirect bool) bool {
+	if !a.Enabled || (a.OnlyDirect && !isDirect) {
+		return false
+	}
+	if len(a.FromUsers) == 0 {
+		return true
+	}
+	for _, userID := range a.FromUsers {
+		if userID == sender {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AutoAcceptInvites) Verify(configErrs *ConfigErrors) {
+	for _, userID := range a.FromUsers {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid user ID for config key %q: %s", "client_api.auto_accept_invites.from_users", userID))
+		}
+	}
 }
 
 type TURN struct {
@@ -107,12 +308,29 @@ type RateLimiting struct {
 	// The cooloff period in milliseconds after a request before the "slot"
 	// is freed again
 	CooloffMS int64 `yaml:"cooloff_ms"`
+
+	// Separate, stricter limits for creating rooms, which is much more
+	// expensive than other requests. These are applied per user rather
+	// than per IP address.
+	RoomCreation RoomCreationRateLimiting `yaml:"room_creation"`
+}
+
+// RoomCreationRateLimiting is a rate limit bucket for room creation.
+type RoomCreationRateLimiting struct {
+	// How many rooms a user can create before they are rate limited.
+	Threshold int64 `yaml:"threshold"`
+
+	// The cooloff period in milliseconds after creating a room before the
+	// "slot" is freed again
+	CooloffMS int64 `yaml:"cooloff_ms"`
 }
 
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
 	if r.Enabled {
 		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
 		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		checkPositive(configErrs, "client_api.rate_limiting.room_creation.threshold", r.RoomCreation.Threshold)
+		checkPositive(configErrs, "client_api.rate_limiting.room_creation.cooloff_ms", r.RoomCreation.CooloffMS)
 	}
 }
 
@@ -120,4 +338,108 @@ func (r *RateLimiting) Defaults() {
 	r.Enabled = true
 	r.Threshold = 5
 	r.CooloffMS = 500
+	r.RoomCreation.Threshold = 2
+	r.RoomCreation.CooloffMS = 10000
+}
+
+type RoomDirectory struct {
+	// If false, only server admins can publish rooms to the room directory,
+	// using the admin API. Users with permission can still unpublish rooms.
+	PublishAllowedForAll bool `yaml:"publish_allowed_for_all"`
+
+	// Rooms with any of these join rules, e.g. "invite", can't be published
+	// to the room directory by users.
+	BlockedJoinRules []string `yaml:"blocked_join_rules"`
+
+	// Controls which remote servers can browse the room directory.
+	Federation RoomDirectoryFederation `yaml:"federation"`
+}
+
+type RoomDirectoryFederation struct {
+	// If false, the room directory is not returned to remote servers. Rooms
+	// can still be joined over federation by anyone who knows about them.
+	Enabled bool `yaml:"enabled"`
+
+	// If not empty, only these servers can browse the room directory.
+	AllowedServers []gomatrixserverlib.ServerName `yaml:"allowed_servers"`
+}
+
+// Allows returns true if the given remote server can browse the room directory.
+func (r *RoomDirectoryFederation) Allows(serverName gomatrixserverlib.ServerName) bool {
+	if !r.Enabled {
+		return false
+	}
+	if len(r.AllowedServers) == 0 {
+		return true
+	}
+	for _, allowed := range r.AllowedServers {
+		if allowed == serverName {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RoomDirectory) Verify(configErrs *ConfigErrors) {
+	for _, joinRule := range r.BlockedJoinRules {
+		switch joinRule {
+		case "public", "invite", "knock", "private":
+		default:
+			configErrs.Add(fmt.Sprintf("invalid join rule for config key %q: %s", "client_api.room_directory.blocked_join_rules", joinRule))
+		}
+	}
+	for _, serverName := range r.Federation.AllowedServers {
+		checkNotEmpty(configErrs, "client_api.room_directory.federation.allowed_servers", string(serverName))
+	}
+}
+
+func (r *RoomDirectory) Defaults() {
+	r.PublishAllowedForAll = true
+	r.Federation.Enabled = true
+}
+
+type RequestBodyLimits struct {
+	// The maximum size in bytes of a request body to the client API. A
+	// value of 0 means unlimited. Media uploads are not affected by this.
+	Default int64 `yaml:"default"`
+
+	// Limits for specific endpoints, which take precedence over the default.
+	// Endpoints are given by their path template, for example
+	// "/_matrix/client/r0/user/{userId}/filter".
+	Endpoints map[string]int64 `yaml:"endpoints"`
+}
+
+func (r *RequestBodyLimits) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.request_body_limits.default", r.Default)
+	for endpoint, limit := range r.Endpoints {
+		checkPositive(configErrs, fmt.Sprintf("client_api.request_body_limits.endpoints[%s]", endpoint), limit)
+	}
+}
+
+func (r *RequestBodyLimits) Defaults() {
+	r.Default = 1048576
+}
+
+// PageLimits are the most events that a page can hold, whatever limit the
+// client asks for. The sync API applies them to the pages that it returns
+// and the room server to the events that it returns to any caller.
+type PageLimits struct {
+	// The most events that /messages will return, which is also the most
+	// that the room server will backfill or find missing in one request.
+	Messages int `yaml:"messages"`
+
+	// The most members that /members will return.
+	Members int `yaml:"members"`
+}
+
+func (p *PageLimits) Verify(configErrs *ConfigErrors) {
+	checkNotZero(configErrs, "client_api.page_limits.messages", int64(p.Messages))
+	checkPositive(configErrs, "client_api.page_limits.messages", int64(p.Messages))
+	checkNotZero(configErrs, "client_api.page_limits.members", int64(p.Members))
+	checkPositive(configErrs, "client_api.page_limits.members", int64(p.Members))
+}
+
+func (p *PageLimits) Defaults() {
+	p.Messages = 1000
+	p.Members = 10000
 }
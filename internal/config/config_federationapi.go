@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type FederationAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -12,12 +17,69 @@ type FederationAPI struct {
 	// to match one of these certificates.
 	// The certificates should be in PEM format.
 	FederationCertificatePaths []Path `yaml:"federation_certificates"`
+
+	// The maximum number of inbound federation requests from a single server
+	// that are handled at the same time. Further requests are rejected with
+	// HTTP 429. 0 means unlimited.
+	MaxInboundConcurrentPerServer int `yaml:"max_inbound_concurrent_per_server"`
+
+	// The maximum number of inbound federation requests handled at the same
+	// time across all servers. 0 means unlimited.
+	MaxInboundConcurrent int `yaml:"max_inbound_concurrent"`
+
+	// Whether to fetch and countersign the keys of other servers when asked
+	// to, acting as a notary (trusted key server) for them. The keys of this
+	// server are always served.
+	KeyNotary bool `yaml:"key_notary"`
+
+	// Whether to log the full JSON of inbound events that are rejected because
+	// of bad hashes, signatures or auth, along with the reason, at debug level.
+	LogRejectedEvents bool `yaml:"log_rejected_events"`
+
+	// The maximum number of prev_events and auth_events that an inbound event
+	// can refer to. Events which refer to more are rejected without fetching
+	// any of them. 0 means unlimited.
+	MaxPrevEvents int `yaml:"max_prev_events"`
+	MaxAuthEvents int `yaml:"max_auth_events"`
+
+	// The maximum amount by which the depth of an inbound event with unknown
+	// prev_events can exceed the current depth of the room. Such events are
+	// rejected rather than fetching their missing prev_events. 0 means
+	// unlimited.
+	MaxDepthSkew int64 `yaml:"max_depth_skew"`
+
+	// The signing key algorithms, e.g. "ed25519", which inbound events and
+	// requests must be signed with. Signatures made with other algorithms
+	// are ignored.
+	AllowedSignatureAlgorithms []string `yaml:"allowed_signature_algorithms"`
+
+	// Whether to soft-fail events from servers which haven't been seen before.
+	QuarantineNewServers QuarantineNewServers `yaml:"quarantine_new_servers"`
+
+	// Who can browse the room directory over federation. This is configured
+	// in client_api.room_directory.federation, alongside the other room
+	// directory options.
+	RoomDirectory *RoomDirectoryFederation `yaml:"-"`
+
+	// Which event types are dropped when they arrive over federation, if
+	// room_server.filter_federated_event_types is enabled.
+	EventTypeFilter *EventTypeFilter `yaml:"-"`
+
+	// The room server database, which most requests depend on. This is
+	// configured in room_server.database.
+	RoomServerDatabase *DatabaseOptions `yaml:"-"`
 }
 
 func (c *FederationAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7772"
 	c.InternalAPI.Connect = "http://localhost:7772"
 	c.ExternalAPI.Listen = "http://[::]:8072"
+	c.MaxInboundConcurrentPerServer = 16
+	c.MaxInboundConcurrent = 256
+	c.KeyNotary = true
+	c.MaxPrevEvents = 20
+	c.MaxAuthEvents = 10
+	c.AllowedSignatureAlgorithms = []string{"ed25519"}
 }
 
 func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -26,6 +88,45 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if !isMonolith {
 		checkURL(configErrs, "federation_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
+	if c.MaxInboundConcurrentPerServer < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_inbound_concurrent_per_server", c.MaxInboundConcurrentPerServer))
+	}
+	if c.MaxInboundConcurrent < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_inbound_concurrent", c.MaxInboundConcurrent))
+	}
+	if c.MaxPrevEvents < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_prev_events", c.MaxPrevEvents))
+	}
+	if c.MaxAuthEvents < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_auth_events", c.MaxAuthEvents))
+	}
+	checkPositive(configErrs, "federation_api.max_depth_skew", c.MaxDepthSkew)
+	// Only ed25519 signatures can be verified, so allowing nothing else would
+	// reject every inbound event and request.
+	supported := false
+	for _, alg := range c.AllowedSignatureAlgorithms {
+		checkNotEmpty(configErrs, "federation_api.allowed_signature_algorithms", alg)
+		if alg == "ed25519" {
+			supported = true
+		}
+	}
+	if !supported {
+		configErrs.Add(fmt.Sprintf("config key %q must include %q", "federation_api.allowed_signature_algorithms", "ed25519"))
+	}
+	if c.QuarantineNewServers.ProbationPeriod < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "federation_api.quarantine_new_servers.probation_period", c.QuarantineNewServers.ProbationPeriod))
+	}
 	// TODO: not applicable always, e.g. in demos
 	//checkNotZero(configErrs, "federation_api.federation_certificates", int64(len(c.FederationCertificatePaths)))
 }
+
+// QuarantineNewServers configures soft-failing the events of servers which are
+// new to us, as a mitigation against spam waves from freshly set up servers.
+type QuarantineNewServers struct {
+	// Whether events from new servers are soft-failed.
+	Enabled bool `yaml:"enabled"`
+	// How long after a server is first seen that it is trusted without an
+	// admin approving it. 0 means that servers stay in quarantine until they
+	// are approved.
+	ProbationPeriod time.Duration `yaml:"probation_period"`
+}
@@ -1,5 +1,12 @@
 package config
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type FederationSender struct {
 	Matrix *Global `yaml:"-"`
 
@@ -20,6 +27,30 @@ type FederationSender struct {
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
 
 	Proxy Proxy `yaml:"proxy_outbound"`
+
+	// The User-Agent header sent with outbound federation requests, so that
+	// the admins of other servers can identify the traffic. If empty, then
+	// "Dendrite/<version>" is sent.
+	UserAgent string `yaml:"user_agent"`
+
+	// How long an outbound federation request can take overall, including
+	// connecting and reading the response, before giving up on it. 0 means
+	// that requests never time out.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// Whether typing notifications and presence updates are sent to other
+	// servers. Incoming ones are accepted either way.
+	SendTyping   bool `yaml:"send_typing"`
+	SendPresence bool `yaml:"send_presence"`
+
+	// Replaces send_typing and send_presence for specific servers.
+	EDUOverrides []EDUOverride `yaml:"edu_overrides"`
+
+	// The most PDUs and EDUs to send to a server in a single transaction.
+	// A backlog for a server is split into as many transactions as needed.
+	// The spec allows at most 50 PDUs and 100 EDUs in a transaction.
+	MaxPDUsPerTransaction int `yaml:"max_pdus_per_transaction"`
+	MaxEDUsPerTransaction int `yaml:"max_edus_per_transaction"`
 }
 
 func (c *FederationSender) Defaults() {
@@ -30,6 +61,11 @@ func (c *FederationSender) Defaults() {
 
 	c.FederationMaxRetries = 16
 	c.DisableTLSValidation = false
+	c.RequestTimeout = time.Minute * 5
+	c.SendTyping = true
+	c.SendPresence = true
+	c.MaxPDUsPerTransaction = 50
+	c.MaxEDUsPerTransaction = 100
 
 	c.Proxy.Defaults()
 }
@@ -38,6 +74,46 @@ func (c *FederationSender) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "federation_sender.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_sender.internal_api.connect", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "federation_sender.database.connection_string", string(c.Database.ConnectionString))
+	checkPositive(configErrs, "federation_sender.request_timeout", int64(c.RequestTimeout))
+	checkTransactionLimit(configErrs, "federation_sender.max_pdus_per_transaction", c.MaxPDUsPerTransaction, 50)
+	checkTransactionLimit(configErrs, "federation_sender.max_edus_per_transaction", c.MaxEDUsPerTransaction, 100)
+	seen := make(map[gomatrixserverlib.ServerName]bool, len(c.EDUOverrides))
+	for _, o := range c.EDUOverrides {
+		checkNotEmpty(configErrs, "federation_sender.edu_overrides.server_name", string(o.ServerName))
+		if seen[o.ServerName] {
+			configErrs.Add(fmt.Sprintf("duplicate server name for config key %q: %s", "federation_sender.edu_overrides", o.ServerName))
+		}
+		seen[o.ServerName] = true
+	}
+}
+
+// SendsEDU returns whether EDUs of the given type should be sent to the given
+// server. Only typing notifications and presence updates can be turned off.
+func (c *FederationSender) SendsEDU(destination gomatrixserverlib.ServerName, eduType string) bool {
+	sendTyping, sendPresence := c.SendTyping, c.SendPresence
+	for _, o := range c.EDUOverrides {
+		if o.ServerName == destination {
+			sendTyping, sendPresence = o.SendTyping, o.SendPresence
+			break
+		}
+	}
+	switch eduType {
+	case gomatrixserverlib.MTyping:
+		return sendTyping
+	case "m.presence":
+		return sendPresence
+	default:
+		return true
+	}
+}
+
+// EDUOverride replaces the send_typing and send_presence options for a
+// single server. Both options must be given, as neither falls back to the
+// global setting.
+type EDUOverride struct {
+	ServerName   gomatrixserverlib.ServerName `yaml:"server_name"`
+	SendTyping   bool                         `yaml:"send_typing"`
+	SendPresence bool                         `yaml:"send_presence"`
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -61,3 +137,11 @@ func (c *Proxy) Defaults() {
 
 func (c *Proxy) Verify(configErrs *ConfigErrors) {
 }
+
+// checkTransactionLimit verifies that a limit on the size of transactions is
+// at least 1 and no more than the spec allows.
+func checkTransactionLimit(configErrs *ConfigErrors, key string, value, max int) {
+	if value < 1 || value > max {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d (must be between 1 and %d)", key, value, max))
+	}
+}
@@ -44,6 +44,17 @@ type Global struct {
 
 	// Metrics configuration
 	Metrics Metrics `yaml:"metrics"`
+
+	// The token which must be given to use the Dendrite admin API. If empty,
+	// the admin API is disabled.
+	AdminToken string `yaml:"admin_token"`
+
+	// The maximum lengths of specific event fields, keyed by their path within
+	// the event, e.g. "content.body". Events with longer fields are rejected
+	// when they are created by local clients. Events from other servers are
+	// only held to the maximum total event size.
+	// Defaults to no limits other than the maximum total event size.
+	MaxEventFieldLengths map[string]int `yaml:"max_event_field_lengths"`
 }
 
 func (c *Global) Defaults() {
@@ -60,6 +71,9 @@ func (c *Global) Defaults() {
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "global.server_name", string(c.ServerName))
 	checkNotEmpty(configErrs, "global.private_key", string(c.PrivateKeyPath))
+	for path, max := range c.MaxEventFieldLengths {
+		checkPositive(configErrs, "global.max_event_field_lengths."+path, int64(max))
+	}
 
 	c.Kafka.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
@@ -111,15 +125,51 @@ type DatabaseOptions struct {
 	MaxIdleConnections int `yaml:"max_idle_conns"`
 	// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 	ConnMaxLifetimeSeconds int `yaml:"conn_max_lifetime"`
+	// maximum amount of time (in seconds) a single query may run for (<= 0 means unlimited)
+	QueryTimeoutSeconds int `yaml:"query_timeout"`
+	// An optional connection string for a read-only replica of this database. Where
+	// supported, read-heavy queries will be sent to the replica instead. PostgreSQL only.
+	ReadReplicaConnectionString DataSource `yaml:"read_replica_connection_string"`
+	// maximum replication lag (in seconds) before reads fall back to the primary database
+	ReadReplicaMaxLagSeconds int `yaml:"read_replica_max_lag"`
+	// Whether these options describe a read replica. This is set by ReadReplica.
+	IsReadReplica bool `yaml:"-"`
 }
 
 func (c *DatabaseOptions) Defaults() {
 	c.MaxOpenConnections = 100
 	c.MaxIdleConnections = 2
 	c.ConnMaxLifetimeSeconds = -1
+	c.QueryTimeoutSeconds = 30
+	c.ReadReplicaMaxLagSeconds = 5
 }
 
 func (c *DatabaseOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.ReadReplicaConnectionString != "" {
+		if !c.ConnectionString.IsPostgres() || !c.ReadReplicaConnectionString.IsPostgres() {
+			configErrs.Add("read replicas are only supported with PostgreSQL databases")
+		}
+		checkPositive(configErrs, "read_replica_max_lag", int64(c.ReadReplicaMaxLagSeconds))
+	}
+}
+
+// ReadReplica returns the options for connecting to the read replica of this
+// database, or nil if no read replica is configured.
+func (c DatabaseOptions) ReadReplica() *DatabaseOptions {
+	if c.ReadReplicaConnectionString == "" {
+		return nil
+	}
+	replica := c
+	replica.ConnectionString = c.ReadReplicaConnectionString
+	replica.ReadReplicaConnectionString = ""
+	replica.IsReadReplica = true
+	return &replica
+}
+
+// ReadReplicaMaxLag returns the maximum replication lag before reads fall back to
+// the primary database
+func (c DatabaseOptions) ReadReplicaMaxLag() time.Duration {
+	return time.Duration(c.ReadReplicaMaxLagSeconds) * time.Second
 }
 
 // MaxIdleConns returns maximum idle connections to the DB
@@ -136,3 +186,11 @@ func (c DatabaseOptions) MaxOpenConns() int {
 func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
+
+// QueryTimeout returns maximum amount of time a single query may run for
+func (c DatabaseOptions) QueryTimeout() time.Duration {
+	if c.QueryTimeoutSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(c.QueryTimeoutSeconds) * time.Second
+}
@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// HTTPServer contains options for the HTTP listeners of all components.
+type HTTPServer struct {
+	// The CIDR ranges of reverse proxies which are trusted to report the
+	// real client IP address in the X-Forwarded-For or Forwarded headers.
+	// These headers are ignored for requests from any other address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+func (c *HTTPServer) Defaults() {
+	c.TrustedProxies = []string{}
+}
+
+func (c *HTTPServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid CIDR for config key %q: %s", "http_server.trusted_proxies", cidr))
+		}
+	}
+}
@@ -17,37 +17,113 @@ type Kafka struct {
 	// The prefix to use for Kafka topic names for this homeserver - really only
 	// useful if running more than one Dendrite on the same Kafka deployment.
 	TopicPrefix string `yaml:"topic_prefix"`
+	// The prefix to use for Kafka consumer group names. If set, consumers will
+	// join consumer groups so that partitions are shared between multiple
+	// instances of the same component. Not supported with Naffka.
+	ConsumerGroupPrefix string `yaml:"consumer_group_prefix"`
+	// The topic (without the topic prefix) to publish messages to when they
+	// can't be processed. If empty, failed messages are dropped.
+	DeadLetterTopic string `yaml:"dead_letter_topic"`
+	// The number of times to try processing a message, including the first
+	// attempt, before giving up on it.
+	MaxProcessingRetries int `yaml:"max_processing_retries"`
+	// Which message bus to use: "kafka", "naffka" or "nats". If empty, then
+	// UseNaffka chooses between naffka and kafka, as in older config files.
+	Provider string `yaml:"provider"`
+	// Options for NATS JetStream, if used.
+	NATS NATS `yaml:"nats"`
 	// Whether to use naffka instead of kafka.
 	// Naffka can only be used when running dendrite as a single monolithic server.
 	// Kafka can be used both with a monolithic server and when running the
 	// components as separate servers.
 	UseNaffka bool `yaml:"use_naffka"`
 	// The Naffka database is used internally by the naffka library, if used.
+	// SQLite is used for "file:" connection strings, otherwise PostgreSQL.
 	Database DatabaseOptions `yaml:"naffka_database"`
+	// Whether naffka should keep messages in memory instead of in a database.
+	// Messages are lost on restart, so this is only suitable for testing and
+	// ephemeral deployments.
+	NaffkaInMemory bool `yaml:"naffka_in_memory"`
+}
+
+// NATS configures NATS JetStream as the message bus, which performs better
+// than naffka without needing Kafka to be deployed.
+type NATS struct {
+	// A list of NATS server addresses to connect to. If empty, then a NATS
+	// server is started inside this process, which is only available in a
+	// monolithic server.
+	Addresses []string `yaml:"addresses"`
+	// The directory that the NATS server started inside this process stores
+	// messages in. If empty, then messages are kept in memory and are lost
+	// on restart.
+	StoragePath Path `yaml:"storage_path"`
+}
+
+// The message bus providers.
+const (
+	ProviderKafka  = "kafka"
+	ProviderNaffka = "naffka"
+	ProviderNATS   = "nats"
+)
+
+// ProviderName returns which message bus to use, taking into account older
+// config files which only set use_naffka.
+func (k *Kafka) ProviderName() string {
+	switch {
+	case k.Provider != "":
+		return k.Provider
+	case k.UseNaffka:
+		return ProviderNaffka
+	default:
+		return ProviderKafka
+	}
 }
 
 func (k *Kafka) TopicFor(name string) string {
 	return fmt.Sprintf("%s%s", k.TopicPrefix, name)
 }
 
+// ConsumerGroupFor returns the consumer group name for the given component.
+func (k *Kafka) ConsumerGroupFor(componentName string) string {
+	return fmt.Sprintf("%s%s", k.ConsumerGroupPrefix, componentName)
+}
+
 func (c *Kafka) Defaults() {
 	c.UseNaffka = true
 	c.Database.Defaults()
 	c.Addresses = []string{"localhost:2181"}
 	c.Database.ConnectionString = DataSource("file:naffka.db")
 	c.TopicPrefix = "Dendrite"
+	c.DeadLetterTopic = "DeadLetter"
+	c.MaxProcessingRetries = 3
 }
 
 func (c *Kafka) Verify(configErrs *ConfigErrors, isMonolith bool) {
-	if c.UseNaffka {
+	switch c.ProviderName() {
+	case ProviderNaffka:
 		if !isMonolith {
 			configErrs.Add("naffka can only be used in a monolithic server")
 		}
-		checkNotEmpty(configErrs, "global.kafka.database.connection_string", string(c.Database.ConnectionString))
-	} else {
+		if !c.NaffkaInMemory {
+			checkNotEmpty(configErrs, "global.kafka.database.connection_string", string(c.Database.ConnectionString))
+		}
+		if c.ConsumerGroupPrefix != "" {
+			configErrs.Add("consumer groups can't be used with naffka")
+		}
+	case ProviderNATS:
+		if len(c.NATS.Addresses) == 0 && !isMonolith {
+			configErrs.Add("the NATS server started by dendrite can only be used in a monolithic server, set global.kafka.nats.addresses instead")
+		}
+		if c.ConsumerGroupPrefix != "" {
+			configErrs.Add("consumer groups can't be used with NATS")
+		}
+	case ProviderKafka:
 		// If we aren't using naffka then we need to have at least one kafka
 		// server to talk to.
 		checkNotZero(configErrs, "global.kafka.addresses", int64(len(c.Addresses)))
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "global.kafka.provider", c.Provider))
 	}
 	checkNotEmpty(configErrs, "global.kafka.topic_prefix", string(c.TopicPrefix))
+	checkPositive(configErrs, "global.kafka.max_processing_retries", int64(c.MaxProcessingRetries))
 }
@@ -2,6 +2,11 @@ package config
 
 import (
 	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 type MediaAPI struct {
@@ -25,14 +30,143 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes *FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
-	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
+	// The maximum size in bytes of remote files that will be downloaded and
+	// cached. The download is aborted as soon as it goes over this size.
+	// Note: if max_remote_file_size_bytes is set to 0, the size is unlimited.
+	// Note: if max_remote_file_size_bytes is not set, it will default to 10485760 (10MB)
+	MaxRemoteFileSizeBytes *FileSizeBytes `yaml:"max_remote_file_size_bytes,omitempty"`
+
+	// The content types of remote files that will be downloaded and cached.
+	RemoteContentTypes RemoteContentTypes `yaml:"remote_content_types"`
+
+	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated.
+	// If false, the thumbnail sizes below are generated when a file is uploaded, before responding to the upload.
+	// If true, thumbnails are only generated when they are first requested, which makes uploads faster.
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
-	// The maximum number of simultaneous thumbnail generators. default: 10
-	MaxThumbnailGenerators int `yaml:"max_thumbnail_generators"`
+	// The maximum number of media processing jobs, such as generating thumbnails,
+	// which run at the same time. default: 10
+	MaxConcurrentProcessing int `yaml:"max_concurrent_processing"`
+
+	// How long a media processing job waits for another to finish when there are
+	// already max_concurrent_processing running. If it is still waiting after this,
+	// thumbnails are skipped and requests for them get a 429. default: 5s
+	ProcessingQueueTimeout time.Duration `yaml:"processing_queue_timeout"`
+
+	// How long a media processing job can run for before it is given up on. 0 means
+	// no limit. default: 30s
+	ProcessingJobTimeout time.Duration `yaml:"processing_job_timeout"`
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// The format that thumbnails are encoded in, one of jpeg, png, webp or avif.
+	// WebP and AVIF thumbnails are only sent to clients which accept them, and
+	// JPEG thumbnails are sent to other clients. default: jpeg
+	ThumbnailFormat string `yaml:"thumbnail_format"`
+
+	// Where media files are stored. Files are always written to base_path first,
+	// which acts as a local cache when a remote backend is used.
+	Storage MediaStorage `yaml:"storage"`
+}
+
+const (
+	// MediaStorageFilesystem stores media files in base_path only.
+	MediaStorageFilesystem = "filesystem"
+	// MediaStorageS3 stores media files in an S3-compatible object store.
+	MediaStorageS3 = "s3"
+)
+
+const (
+	// ThumbnailFormatJPEG encodes thumbnails as JPEG.
+	ThumbnailFormatJPEG = "jpeg"
+	// ThumbnailFormatPNG encodes thumbnails as PNG.
+	ThumbnailFormatPNG = "png"
+	// ThumbnailFormatWebP encodes thumbnails as WebP, with JPEG for clients
+	// which don't accept WebP.
+	ThumbnailFormatWebP = "webp"
+	// ThumbnailFormatAVIF encodes thumbnails as AVIF, with JPEG for clients
+	// which don't accept AVIF.
+	ThumbnailFormatAVIF = "avif"
+)
+
+// MediaStorage configures the backend that media files are stored in.
+type MediaStorage struct {
+	// The backend to use, either "filesystem" or "s3".
+	Backend string `yaml:"backend"`
+	// Options for the S3 backend.
+	S3 S3Storage `yaml:"s3"`
+}
+
+// S3Storage configures an S3-compatible object store. Objects are addressed
+// path-style, i.e. as endpoint/bucket/key.
+type S3Storage struct {
+	// The URL of the S3 endpoint, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+	// The region that requests are signed for.
+	Region string `yaml:"region"`
+	// The bucket that media files are stored in.
+	Bucket string `yaml:"bucket"`
+	// The credentials used to sign requests.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+// RemoteContentTypes lists the content types of remote media which may or may
+// not be cached. Types are matched without their parameters, and may end in
+// "/*" to match all subtypes, e.g. "image/*".
+type RemoteContentTypes struct {
+	// If not empty, only these content types are allowed.
+	Allowed []string `yaml:"allowed"`
+	// These content types are never allowed, even if they are in Allowed.
+	Blocked []string `yaml:"blocked"`
+}
+
+// IsAllowed returns whether remote media with the given content type may be cached.
+func (c *RemoteContentTypes) IsAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			if pattern == mediaType {
+				return true
+			}
+			if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(c.Blocked) {
+		return false
+	}
+	return len(c.Allowed) == 0 || matches(c.Allowed)
+}
+
+// UnmarshalYAML also accepts max_thumbnail_generators, which older config
+// files have, in place of max_concurrent_processing.
+func (c *MediaAPI) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type mediaAPI MediaAPI
+	if err := unmarshal((*mediaAPI)(c)); err != nil {
+		return err
+	}
+	var deprecated struct {
+		MaxThumbnailGenerators  int  `yaml:"max_thumbnail_generators"`
+		MaxConcurrentProcessing *int `yaml:"max_concurrent_processing"`
+	}
+	if err := unmarshal(&deprecated); err != nil {
+		return err
+	}
+	if deprecated.MaxThumbnailGenerators != 0 {
+		logrus.Warn("media_api.max_thumbnail_generators is deprecated, use media_api.max_concurrent_processing instead")
+		if deprecated.MaxConcurrentProcessing == nil {
+			c.MaxConcurrentProcessing = deprecated.MaxThumbnailGenerators
+		}
+	}
+	return nil
 }
 
 func (c *MediaAPI) Defaults() {
@@ -44,8 +178,14 @@ func (c *MediaAPI) Defaults() {
 
 	defaultMaxFileSizeBytes := FileSizeBytes(10485760)
 	c.MaxFileSizeBytes = &defaultMaxFileSizeBytes
-	c.MaxThumbnailGenerators = 10
+	defaultMaxRemoteFileSizeBytes := FileSizeBytes(10485760)
+	c.MaxRemoteFileSizeBytes = &defaultMaxRemoteFileSizeBytes
+	c.MaxConcurrentProcessing = 10
+	c.ProcessingQueueTimeout = time.Second * 5
+	c.ProcessingJobTimeout = time.Second * 30
 	c.BasePath = "./media_store"
+	c.ThumbnailFormat = ThumbnailFormatJPEG
+	c.Storage.Backend = MediaStorageFilesystem
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -58,10 +198,32 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(*c.MaxFileSizeBytes))
-	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	checkPositive(configErrs, "media_api.max_remote_file_size_bytes", int64(*c.MaxRemoteFileSizeBytes))
+	checkNotZero(configErrs, "media_api.max_concurrent_processing", int64(c.MaxConcurrentProcessing))
+	checkPositive(configErrs, "media_api.max_concurrent_processing", int64(c.MaxConcurrentProcessing))
+	checkPositive(configErrs, "media_api.processing_queue_timeout", int64(c.ProcessingQueueTimeout))
+	checkPositive(configErrs, "media_api.processing_job_timeout", int64(c.ProcessingJobTimeout))
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+
+	switch c.ThumbnailFormat {
+	case ThumbnailFormatJPEG, ThumbnailFormatPNG, ThumbnailFormatWebP, ThumbnailFormatAVIF:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.thumbnail_format", c.ThumbnailFormat))
+	}
+
+	switch c.Storage.Backend {
+	case MediaStorageFilesystem:
+	case MediaStorageS3:
+		checkURL(configErrs, "media_api.storage.s3.endpoint", c.Storage.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage.s3.region", c.Storage.S3.Region)
+		checkNotEmpty(configErrs, "media_api.storage.s3.bucket", c.Storage.S3.Bucket)
+		checkNotEmpty(configErrs, "media_api.storage.s3.access_key_id", c.Storage.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.storage.s3.secret_access_key", c.Storage.S3.SecretAccessKey)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.storage.backend", c.Storage.Backend))
+	}
 }
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// P2PTransports are the libp2p transports that can be enabled. QUIC isn't
+// one of them as the QUIC transport for our version of libp2p only builds
+// with Go 1.14 and 1.15.
+var P2PTransports = []string{"tcp", "ws"}
+
+// P2P contains options for peer-to-peer deployments, which use libp2p for
+// federation. These are ignored by regular homeservers.
+type P2P struct {
+	// Multiaddrs to listen on, e.g. "/ip4/0.0.0.0/tcp/4001".
+	ListenAddresses []string `yaml:"listen_addresses"`
+	// The transports to enable: "tcp" and/or "ws" (WebSockets).
+	Transports []string `yaml:"transports"`
+	// Multiaddrs to advertise in addition to the automatically detected ones,
+	// e.g. the public address of a port forward.
+	AnnounceAddresses []string `yaml:"announce_addresses"`
+	// Whether to map ports on the router using UPnP or NAT-PMP, so that this
+	// node can be reached from behind a NAT.
+	EnableNATPortMap bool `yaml:"enable_nat_port_map"`
+	// Whether to use DCUtR hole punching to connect directly to nodes behind
+	// a NAT. This needs a newer version of libp2p, so isn't supported yet.
+	EnableHolePunching bool `yaml:"enable_hole_punching"`
+	// Whether to offer the AutoNAT service, which helps other nodes to work
+	// out whether they are reachable from outside their NAT.
+	EnableNATService bool `yaml:"enable_nat_service"`
+	// Multiaddrs, including the peer ID, of relays to use when this node
+	// can't be reached directly. If empty, relays are discovered automatically.
+	StaticRelays []string `yaml:"static_relays"`
+	// Whether to log peer discovery at info level rather than debug.
+	LogPeerEvents bool `yaml:"log_peer_events"`
+	// Limits on the number of open connections to other nodes.
+	ConnMgr ConnMgr `yaml:"conn_mgr"`
+}
+
+// ConnMgr contains the watermarks for the libp2p connection manager. Once
+// there are more than HighWater connections, idle connections are closed
+// until there are only LowWater left. Connections younger than GracePeriod
+// are never closed.
+type ConnMgr struct {
+	LowWater    int           `yaml:"low_water"`
+	HighWater   int           `yaml:"high_water"`
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+func (c *P2P) Defaults() {
+	c.ListenAddresses = []string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"}
+	c.Transports = []string{"tcp", "ws"}
+	c.EnableNATPortMap = true
+	c.EnableHolePunching = false
+	c.EnableNATService = false
+	c.ConnMgr.LowWater = 100
+	c.ConnMgr.HighWater = 400
+	c.ConnMgr.GracePeriod = time.Minute
+}
+
+func (c *P2P) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkNotZero(configErrs, "p2p.listen_addresses", int64(len(c.ListenAddresses)))
+	for _, addr := range c.ListenAddresses {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid multiaddr %q for config key %q: %s", addr, "p2p.listen_addresses", err))
+		}
+	}
+	for _, addr := range c.AnnounceAddresses {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid multiaddr %q for config key %q: %s", addr, "p2p.announce_addresses", err))
+		}
+	}
+	checkNotZero(configErrs, "p2p.transports", int64(len(c.Transports)))
+	for _, transport := range c.Transports {
+		if transport == "quic" {
+			configErrs.Add(fmt.Sprintf("the QUIC transport for config key %q is not supported yet, use one of %v", "p2p.transports", P2PTransports))
+		} else if !isP2PTransport(transport) {
+			configErrs.Add(fmt.Sprintf("unsupported transport %q for config key %q, must be one of %v", transport, "p2p.transports", P2PTransports))
+		}
+	}
+	if c.EnableHolePunching {
+		configErrs.Add(fmt.Sprintf("DCUtR hole punching for config key %q is not supported yet, use %q instead", "p2p.enable_hole_punching", "p2p.enable_nat_port_map"))
+	}
+	for _, relay := range c.StaticRelays {
+		if err := checkP2PAddr(relay); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid multiaddr %q for config key %q: %s", relay, "p2p.static_relays", err))
+		}
+	}
+	checkPositive(configErrs, "p2p.conn_mgr.low_water", int64(c.ConnMgr.LowWater))
+	checkPositive(configErrs, "p2p.conn_mgr.high_water", int64(c.ConnMgr.HighWater))
+	checkPositive(configErrs, "p2p.conn_mgr.grace_period", int64(c.ConnMgr.GracePeriod))
+	if c.ConnMgr.HighWater < c.ConnMgr.LowWater {
+		configErrs.Add("p2p.conn_mgr.high_water must not be less than p2p.conn_mgr.low_water")
+	}
+}
+
+// checkP2PAddr checks that the address is a multiaddr which includes the
+// /p2p/ peer ID, as relays must.
+func checkP2PAddr(addr string) error {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return err
+	}
+	if _, err = ma.ValueForProtocol(multiaddr.P_P2P); err != nil {
+		return fmt.Errorf("missing /p2p/ peer ID")
+	}
+	return nil
+}
+
+func isP2PTransport(transport string) bool {
+	for _, t := range P2PTransports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,176 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// How long to wait for more input events to arrive for a room so that
+	// outliers can be written to the database together. Zero disables this.
+	WriteBatchWindow time.Duration `yaml:"write_batch_window"`
+
+	// The largest number of input events to wait for in a write batch.
+	MaxBatchSize int `yaml:"max_batch_size"`
+
+	// The most rooms that the server can know about before users are stopped
+	// from creating or joining new rooms. 0 means unlimited.
+	MaxRooms int `yaml:"max_rooms"`
+
+	// Events with a lower depth than this aren't backfilled over federation,
+	// so that paginating back through a large room doesn't fetch its entire
+	// history. 0 backfills all the way to the creation of the room.
+	BackfillMinDepth int64 `yaml:"backfill_min_depth"`
+
+	// The most events to request over federation in a single backfill, and
+	// separately the most missing state events to fetch for them. Older
+	// events are backfilled by further /messages requests.
+	BackfillMaxEvents int `yaml:"backfill_max_events"`
+
+	// The most events that backfilling and finding missing events return,
+	// and the most members that are returned for a room. This is configured
+	// in client_api.page_limits, alongside the other client limits.
+	PageLimits *PageLimits `yaml:"-"`
+
+	// Controls purging of events under MSC1763 message retention policies.
+	Retention MessageRetention `yaml:"retention"`
+
+	// The power levels that new rooms start with, in place of the defaults
+	// from the spec. The room creator can still override them when creating
+	// the room with power_level_content_override.
+	DefaultPowerLevels DefaultPowerLevels `yaml:"default_power_levels"`
+
+	// Which event types local users are allowed to send.
+	EventTypeFilter `yaml:",inline"`
+}
+
+// EventTypeFilter controls which event types can be sent into rooms. Event
+// types in the lists may end with "*" to match every type with that prefix.
+type EventTypeFilter struct {
+	// If set, only these event types can be sent, along with the standard
+	// m.* event types which are always allowed unless they are denied.
+	AllowedEventTypes []string `yaml:"allowed_event_types"`
+	// Event types which can't be sent, even if they are allowed above.
+	DeniedEventTypes []string `yaml:"denied_event_types"`
+	// Whether to also drop message events of denied types which arrive over
+	// federation. State events are always accepted, since rooms can't be
+	// authorised without them.
+	FilterFederated bool `yaml:"filter_federated_event_types"`
+}
+
+// IsEventTypeAllowed returns whether events of the given type can be sent.
+func (c *EventTypeFilter) IsEventTypeAllowed(eventType string) bool {
+	if c == nil {
+		return true
+	}
+	if matchesEventType(c.DeniedEventTypes, eventType) {
+		return false
+	}
+	if len(c.AllowedEventTypes) == 0 || strings.HasPrefix(eventType, "m.") {
+		return true
+	}
+	return matchesEventType(c.AllowedEventTypes, eventType)
+}
+
+func matchesEventType(patterns []string, eventType string) bool {
+	for _, pattern := range patterns {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(eventType, prefix) {
+				return true
+			}
+		} else if pattern == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPowerLevels are the power levels that new rooms start with. Levels
+// which aren't set keep the defaults from the spec.
+type DefaultPowerLevels struct {
+	Ban           *int64 `yaml:"ban"`
+	Invite        *int64 `yaml:"invite"`
+	Kick          *int64 `yaml:"kick"`
+	Redact        *int64 `yaml:"redact"`
+	UsersDefault  *int64 `yaml:"users_default"`
+	EventsDefault *int64 `yaml:"events_default"`
+	StateDefault  *int64 `yaml:"state_default"`
+	// The levels needed to send each event type. These are added to the
+	// defaults, so event types which aren't listed keep their levels.
+	Events map[string]int64 `yaml:"events"`
+	// The levels needed to trigger each type of notification, e.g. "room".
+	Notifications map[string]int64 `yaml:"notifications"`
+}
+
+// Apply sets the configured levels in the power level content of a new room.
+func (c *DefaultPowerLevels) Apply(content *gomatrixserverlib.PowerLevelContent) {
+	if c == nil {
+		return
+	}
+	for _, level := range []struct {
+		configured *int64
+		content    *int64
+	}{
+		{c.Ban, &content.Ban},
+		{c.Invite, &content.Invite},
+		{c.Kick, &content.Kick},
+		{c.Redact, &content.Redact},
+		{c.UsersDefault, &content.UsersDefault},
+		{c.EventsDefault, &content.EventsDefault},
+		{c.StateDefault, &content.StateDefault},
+	} {
+		if level.configured != nil {
+			*level.content = *level.configured
+		}
+	}
+	if len(c.Events) > 0 && content.Events == nil {
+		content.Events = make(map[string]int64, len(c.Events))
+	}
+	for eventType, level := range c.Events {
+		content.Events[eventType] = level
+	}
+	if len(c.Notifications) > 0 && content.Notifications == nil {
+		content.Notifications = make(map[string]int64, len(c.Notifications))
+	}
+	for notification, level := range c.Notifications {
+		content.Notifications[notification] = level
+	}
+}
+
+// MessageRetention controls how long events are kept for before their content
+// is purged. Rooms can set their own policy with an m.room.retention state
+// event, which is clamped to the allowed lifetimes.
+type MessageRetention struct {
+	// How often to purge expired events. Zero disables purging.
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+	// How long events are kept for in rooms without a retention policy. Zero
+	// keeps them forever.
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+	// The shortest and longest max_lifetime that a room's retention policy is
+	// allowed to set. Zero means no bound.
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+}
+
+// ClampLifetime returns the given max_lifetime from a room's retention policy,
+// limited to the allowed lifetimes.
+func (c *MessageRetention) ClampLifetime(lifetime time.Duration) time.Duration {
+	if c.AllowedLifetimeMin > 0 && lifetime < c.AllowedLifetimeMin {
+		return c.AllowedLifetimeMin
+	}
+	if c.AllowedLifetimeMax > 0 && lifetime > c.AllowedLifetimeMax {
+		return c.AllowedLifetimeMax
+	}
+	return lifetime
 }
 
 func (c *RoomServer) Defaults() {
@@ -13,10 +178,39 @@ func (c *RoomServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:roomserver.db"
+	c.WriteBatchWindow = 0
+	c.MaxBatchSize = 100
+	c.BackfillMaxEvents = 100
+	c.Retention.PurgeInterval = 0
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	c.Database.Verify(configErrs, isMonolith)
+	checkPositive(configErrs, "room_server.write_batch_window", int64(c.WriteBatchWindow))
+	checkPositive(configErrs, "room_server.max_batch_size", int64(c.MaxBatchSize))
+	checkPositive(configErrs, "room_server.max_rooms", int64(c.MaxRooms))
+	checkPositive(configErrs, "room_server.backfill_min_depth", c.BackfillMinDepth)
+	checkPositive(configErrs, "room_server.backfill_max_events", int64(c.BackfillMaxEvents))
+	checkPositive(configErrs, "room_server.retention.purge_interval", int64(c.Retention.PurgeInterval))
+	checkPositive(configErrs, "room_server.retention.default_max_lifetime", int64(c.Retention.DefaultMaxLifetime))
+	checkPositive(configErrs, "room_server.retention.allowed_lifetime_min", int64(c.Retention.AllowedLifetimeMin))
+	checkPositive(configErrs, "room_server.retention.allowed_lifetime_max", int64(c.Retention.AllowedLifetimeMax))
+	if c.Retention.AllowedLifetimeMax > 0 && c.Retention.AllowedLifetimeMin > c.Retention.AllowedLifetimeMax {
+		configErrs.Add("room_server.retention.allowed_lifetime_min must not be greater than room_server.retention.allowed_lifetime_max")
+	}
+	checkEventTypes(configErrs, "room_server.allowed_event_types", c.AllowedEventTypes)
+	checkEventTypes(configErrs, "room_server.denied_event_types", c.DeniedEventTypes)
+}
+
+// checkEventTypes verifies that every event type in a list is non-empty and
+// only has a "*" at the end.
+func checkEventTypes(configErrs *ConfigErrors, key string, eventTypes []string) {
+	for _, eventType := range eventTypes {
+		if eventType == "" || strings.Contains(strings.TrimSuffix(eventType, "*"), "*") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", key, eventType))
+		}
+	}
 }
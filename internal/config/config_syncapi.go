@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -7,6 +9,33 @@ type SyncAPI struct {
 	ExternalAPI ExternalAPIOptions `yaml:"external_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// The maximum number of sync responses that will be built at the same
+	// time. Requests beyond this limit will queue until a slot becomes free.
+	// Note: if max_concurrent_syncs is set to 0, the number is unlimited.
+	MaxConcurrentSyncs int `yaml:"max_concurrent_syncs"`
+
+	// The longest time that a /sync request will be held open waiting for new
+	// data, regardless of the timeout requested by the client.
+	MaxSyncTimeout time.Duration `yaml:"max_sync_timeout"`
+
+	// The most events that /messages and /members will return. This is
+	// configured in client_api.page_limits, alongside the other client limits.
+	PageLimits *PageLimits `yaml:"-"`
+
+	// Controls trimming of the device list change stream.
+	StreamRetention StreamRetention `yaml:"stream_retention"`
+}
+
+// StreamRetention controls how long device list changes are kept for. Changes
+// are only removed once every active device has synced past them.
+type StreamRetention struct {
+	// How often to trim the device list change stream. Zero disables trimming.
+	Interval time.Duration `yaml:"interval"`
+	// How long a device can go without syncing before it stops holding back
+	// trimming. When such a device syncs again it is sent a full device list
+	// resync instead of the changes since its sync token.
+	InactiveDeviceTimeout time.Duration `yaml:"inactive_device_timeout"`
 }
 
 func (c *SyncAPI) Defaults() {
@@ -15,6 +44,10 @@ func (c *SyncAPI) Defaults() {
 	c.ExternalAPI.Listen = "http://localhost:8073"
 	c.Database.Defaults()
 	c.Database.ConnectionString = "file:syncapi.db"
+	c.MaxConcurrentSyncs = 64
+	c.MaxSyncTimeout = time.Minute * 2
+	c.StreamRetention.Interval = 0
+	c.StreamRetention.InactiveDeviceTimeout = time.Hour * 24 * 7
 }
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -24,4 +57,13 @@ func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
 	}
 	checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
+	c.Database.Verify(configErrs, isMonolith)
+	checkPositive(configErrs, "sync_api.max_concurrent_syncs", int64(c.MaxConcurrentSyncs))
+	checkNotZero(configErrs, "sync_api.max_sync_timeout", int64(c.MaxSyncTimeout))
+	checkPositive(configErrs, "sync_api.max_sync_timeout", int64(c.MaxSyncTimeout))
+	checkPositive(configErrs, "sync_api.stream_retention.interval", int64(c.StreamRetention.Interval))
+	if c.StreamRetention.Interval > 0 {
+		checkNotZero(configErrs, "sync_api.stream_retention.inactive_device_timeout", int64(c.StreamRetention.InactiveDeviceTimeout))
+		checkPositive(configErrs, "sync_api.stream_retention.inactive_device_timeout", int64(c.StreamRetention.InactiveDeviceTimeout))
+	}
 }
@@ -17,6 +17,11 @@ package config
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -244,6 +249,212 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestAutoAcceptInvites(t *testing.T) {
+	policy := AutoAcceptInvites{Enabled: true, OnlyDirect: true, FromUsers: []string{"@alice:localhost"}}
+	if !policy.Accepts("@alice:localhost", true) {
+		t.Error("should accept direct invite from allowed user")
+	}
+	if policy.Accepts("@alice:localhost", false) {
+		t.Error("should not accept non-direct invite")
+	}
+	if policy.Accepts("@spammer:example.com", true) {
+		t.Error("should not accept invite from user who isn't allowed")
+	}
+	policy.Enabled = false
+	if policy.Accepts("@alice:localhost", true) {
+		t.Error("should not accept invites when disabled")
+	}
+}
+
+func TestTokenLifetimes(t *testing.T) {
+	var c ClientAPI
+	c.Defaults()
+	c.AccessTokenLifetime = time.Hour
+	c.RefreshTokenLifetime = time.Minute
+	var configErrs ConfigErrors
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 1 {
+		t.Errorf("expected refresh_token_lifetime shorter than access_token_lifetime to be rejected, got %v", configErrs)
+	}
+
+	c.RefreshTokenLifetime = 0
+	configErrs = nil
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Errorf("expected refresh tokens that never expire to be allowed, got %v", configErrs)
+	}
+}
+
+func TestTermsAddedToRegistrationFlows(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	c.ClientAPI.Terms = []TermsPolicy{{
+		ID:      "privacy_policy",
+		Version: "1.0",
+		Languages: map[string]TermsDocument{
+			"en": {Name: "Privacy Policy", URL: "https://example.com/privacy_policy-1.0.html"},
+		},
+	}}
+	if err := c.Derive(); err != nil {
+		t.Fatal("failed to derive config:", err)
+	}
+	for _, flow := range c.Derived.Registration.Flows {
+		if flow.Stages[len(flow.Stages)-1] != authtypes.LoginTypeTerms {
+			t.Errorf("expected flow %v to end with %s", flow.Stages, authtypes.LoginTypeTerms)
+		}
+	}
+	params, ok := c.Derived.Registration.Params[authtypes.LoginTypeTerms].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected params for %s", authtypes.LoginTypeTerms)
+	}
+	policy := params["policies"].(map[string]interface{})["privacy_policy"].(map[string]interface{})
+	if policy["version"] != "1.0" {
+		t.Errorf("expected policy version 1.0, got %v", policy["version"])
+	}
+}
+
+func TestSendsEDU(t *testing.T) {
+	var c FederationSender
+	c.Defaults()
+	c.SendPresence = false
+	c.EDUOverrides = []EDUOverride{
+		{ServerName: "busy.example.com", SendTyping: false, SendPresence: false},
+		{ServerName: "friend.example.com", SendTyping: true, SendPresence: true},
+	}
+	tests := []struct {
+		destination gomatrixserverlib.ServerName
+		eduType     string
+		want        bool
+	}{
+		{"other.example.com", gomatrixserverlib.MTyping, true},
+		{"other.example.com", "m.presence", false},
+		{"busy.example.com", gomatrixserverlib.MTyping, false},
+		{"busy.example.com", gomatrixserverlib.MDirectToDevice, true},
+		{"friend.example.com", "m.presence", true},
+	}
+	for _, tt := range tests {
+		if got := c.SendsEDU(tt.destination, tt.eduType); got != tt.want {
+			t.Errorf("SendsEDU(%s, %s) = %v, want %v", tt.destination, tt.eduType, got, tt.want)
+		}
+	}
+}
+
+func TestLoggingConfig(t *testing.T) {
+	// Older config files have just a list of hooks.
+	var c Dendrite
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("logging:\n- type: file\n  level: debug\n  params:\n    path: /var/log/dendrite\n"), &c); err != nil {
+		t.Fatal("failed to parse list of hooks:", err)
+	}
+	if len(c.Logging.Hooks) != 1 || c.Logging.Hooks[0].Level != "debug" {
+		t.Errorf("unexpected hooks %+v", c.Logging.Hooks)
+	}
+	if c.Logging.Format != "text" || c.Logging.Level != "info" {
+		t.Errorf("expected defaults to be kept, got format %q level %q", c.Logging.Format, c.Logging.Level)
+	}
+
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("logging:\n  format: json\n  level: warn\n  components:\n    SyncAPI: debug\n"), &c); err != nil {
+		t.Fatal("failed to parse logging options:", err)
+	}
+	if c.Logging.Format != "json" {
+		t.Errorf("expected json format, got %q", c.Logging.Format)
+	}
+	if level := c.Logging.LevelFor("SyncAPI"); level != "debug" {
+		t.Errorf("expected SyncAPI to log at debug, got %q", level)
+	}
+	if level := c.Logging.LevelFor("RoomServerAPI"); level != "warn" {
+		t.Errorf("expected RoomServerAPI to log at warn, got %q", level)
+	}
+
+	var configErrs ConfigErrors
+	c.Logging.Format = "xml"
+	c.Logging.Components["SyncAPI"] = "chatty"
+	c.checkLogging(&configErrs)
+	if len(configErrs) != 2 {
+		t.Errorf("expected bad format and level to be rejected, got %v", configErrs)
+	}
+}
+
+func TestMaxThumbnailGenerators(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("media_api:\n  max_thumbnail_generators: 4\n"), &c); err != nil {
+		t.Fatal("failed to parse media API options:", err)
+	}
+	if c.MediaAPI.MaxConcurrentProcessing != 4 {
+		t.Errorf("expected max_thumbnail_generators to set max_concurrent_processing to 4, got %d", c.MediaAPI.MaxConcurrentProcessing)
+	}
+	if c.MediaAPI.ProcessingQueueTimeout != time.Second*5 {
+		t.Errorf("expected defaults to be kept, got processing_queue_timeout %s", c.MediaAPI.ProcessingQueueTimeout)
+	}
+
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("media_api:\n  max_thumbnail_generators: 4\n  max_concurrent_processing: 8\n"), &c); err != nil {
+		t.Fatal("failed to parse media API options:", err)
+	}
+	if c.MediaAPI.MaxConcurrentProcessing != 8 {
+		t.Errorf("expected max_concurrent_processing to take precedence, got %d", c.MediaAPI.MaxConcurrentProcessing)
+	}
+}
+
+func TestDefaultPowerLevels(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("room_server:\n  default_power_levels:\n    invite: 50\n    events:\n      m.room.topic: 75\n    notifications:\n      room: 100\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	c.Wiring()
+
+	var content gomatrixserverlib.PowerLevelContent
+	content.Defaults()
+	content.Events = map[string]int64{"m.room.name": 50}
+	c.ClientAPI.DefaultPowerLevels.Apply(&content)
+
+	if content.Invite != 50 {
+		t.Errorf("got invite level %d, want 50", content.Invite)
+	}
+	if content.Kick != 50 {
+		t.Errorf("got kick level %d, want the spec default of 50", content.Kick)
+	}
+	if content.Events["m.room.topic"] != 75 || content.Events["m.room.name"] != 50 {
+		t.Errorf("got event levels %v, want m.room.topic added to m.room.name", content.Events)
+	}
+	if content.Notifications["room"] != 100 {
+		t.Errorf("got notification levels %v, want room at 100", content.Notifications)
+	}
+}
+
+func TestEventTypeFilter(t *testing.T) {
+	var c Dendrite
+	c.Defaults()
+	if err := yaml.Unmarshal([]byte("room_server:\n  allowed_event_types: [\"com.example.*\"]\n  denied_event_types: [\"m.sticker\", \"com.example.spam\"]\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	c.Wiring()
+
+	filter := c.ClientAPI.EventTypeFilter
+	for eventType, want := range map[string]bool{
+		"m.room.message":       true,
+		"m.sticker":            false,
+		"com.example.poll":     true,
+		"com.example.spam":     false,
+		"org.other.custom":     false,
+		"com.examplefoo.event": false,
+	} {
+		if got := filter.IsEventTypeAllowed(eventType); got != want {
+			t.Errorf("IsEventTypeAllowed(%q) = %v, want %v", eventType, got, want)
+		}
+	}
+
+	var configErrs ConfigErrors
+	c.RoomServer.DeniedEventTypes = []string{"com.*.spam", ""}
+	checkEventTypes(&configErrs, "room_server.denied_event_types", c.RoomServer.DeniedEventTypes)
+	if len(configErrs) != 2 {
+		t.Errorf("expected bad event types to be rejected, got %v", configErrs)
+	}
+}
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
@@ -283,3 +494,31 @@ n0Xq64k7fc42HXJpF8CGBkSaIhtlzcruO+vqR80B9r62+D0V7VmHOnP135MT6noU
 ANAf5kxmMsM0zlN2hkxl0H6o7wKlBSw3RI3cjfilXiMWRPJrzlc4
 -----END CERTIFICATE-----
 `
+
+func TestP2PVerify(t *testing.T) {
+	var c P2P
+	c.Defaults()
+	c.StaticRelays = []string{"/ip4/203.0.113.1/tcp/4001/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"}
+	var configErrs ConfigErrors
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Errorf("expected valid config to be accepted, got %v", configErrs)
+	}
+
+	for _, relay := range []string{"not a multiaddr", "/ip4/203.0.113.1/tcp/4001"} {
+		c.StaticRelays = []string{relay}
+		configErrs = nil
+		c.Verify(&configErrs, true)
+		if len(configErrs) != 1 {
+			t.Errorf("expected static relay %q to be rejected, got %v", relay, configErrs)
+		}
+	}
+
+	c.StaticRelays = nil
+	c.EnableHolePunching = true
+	configErrs = nil
+	c.Verify(&configErrs, true)
+	if len(configErrs) != 1 {
+		t.Errorf("expected hole punching to be rejected, got %v", configErrs)
+	}
+}
@@ -17,9 +17,12 @@ package internal
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/sirupsen/logrus"
 )
 
 // A PartitionStorer has the storage APIs needed by the consumer.
@@ -28,6 +31,55 @@ type PartitionStorer interface {
 	PartitionOffsets(ctx context.Context, topic string) ([]sqlutil.PartitionOffset, error)
 	// SetPartitionOffset records where the consumer has reached for a partition.
 	SetPartitionOffset(ctx context.Context, topic string, partition int32, offset int64) error
+	// ResetPartitionOffsets forgets where the consumer has reached for all partitions.
+	ResetPartitionOffsets(ctx context.Context, topic string) error
+}
+
+// A ConsumerGroupProvider is a kafkaesque stream consumer which can also join
+// consumer groups. If the Consumer of a ContinualConsumer implements this then
+// partitions will be shared between all consumers in the same group, so that
+// horizontally-scaled components don't process the same messages twice.
+type ConsumerGroupProvider interface {
+	// ConsumerGroup joins the consumer group for the given component name.
+	// initialOffset is sarama.OffsetOldest or sarama.OffsetNewest, and is
+	// where the group starts in partitions that it hasn't committed an
+	// offset for. Returns nil if consumer groups are not configured.
+	ConsumerGroup(componentName string, initialOffset int64) (sarama.ConsumerGroup, error)
+}
+
+// An OldestOffsetProvider is a kafkaesque stream consumer which can look up
+// the oldest offset which is still available for a partition. If the Consumer
+// of a ContinualConsumer in a consumer group implements this then Reset can
+// seek the group back to the beginning of the topic.
+type OldestOffsetProvider interface {
+	// OldestOffset returns the offset of the oldest message in the partition.
+	OldestOffset(topic string, partition int32) (int64, error)
+}
+
+// A DeadLetterPublisher is a kafkaesque stream consumer which can also publish
+// messages that could not be processed to a dead-letter topic. If the Consumer
+// of a ContinualConsumer implements this then failed messages will be retried
+// before being published as a DeadLetter.
+type DeadLetterPublisher interface {
+	// MaxProcessingRetries returns the number of times to try processing a
+	// message, including the first attempt, before giving up on it.
+	MaxProcessingRetries() int
+	// PublishDeadLetter publishes the dead letter to the dead-letter topic,
+	// if one is configured.
+	PublishDeadLetter(letter *DeadLetter) error
+}
+
+// A DeadLetter is a message which could not be processed, along with the
+// error that the consumer returned and where the message came from.
+type DeadLetter struct {
+	ComponentName string `json:"component_name"`
+	Topic         string `json:"topic"`
+	Partition     int32  `json:"partition"`
+	Offset        int64  `json:"offset"`
+	Key           []byte `json:"key"`
+	Value         []byte `json:"value"`
+	Error         string `json:"error"`
+	Attempts      int    `json:"attempts"`
 }
 
 // A ContinualConsumer continually consumes logs even across restarts. It requires a PartitionStorer to
@@ -43,17 +95,45 @@ type ContinualConsumer struct {
 	Consumer sarama.Consumer
 	// A thing which can load and save partition offsets for a topic.
 	PartitionStore PartitionStorer
+	// StartFromNewest makes the consumer start at the end of partitions that
+	// it has no stored offset for, rather than at the beginning. It is for
+	// consumers which only act on new messages, and which would otherwise
+	// act on the whole history of the topic the first time they start.
+	StartFromNewest bool
 	// ProcessMessage is a function which will be called for each message in the log. Return an error to
 	// stop processing messages. See ErrShutdown for specific control signals.
 	ProcessMessage func(msg *sarama.ConsumerMessage) error
 	// ShutdownCallback is called when ProcessMessage returns ErrShutdown, after the partition has been saved.
 	// It is optional.
 	ShutdownCallback func()
+	// ResetCallback is called by Reset once messages have stopped being processed and the offsets have been
+	// reset, before the topic is consumed again from the beginning. It should delete everything that was
+	// built from the messages, so that it can be rebuilt from scratch. It is optional.
+	ResetCallback func(ctx context.Context) error
+
+	mu                 sync.RWMutex // held for reading while processing a message
+	grouped            bool
+	stopped            bool
+	reset              chan struct{} // closed by Reset
+	resetGroup         bool          // whether the next group session must seek to the oldest offsets
+	partitionConsumers []sarama.PartitionConsumer
+	cancelGroup        context.CancelFunc
+}
+
+// startedConsumers are the consumers which StopConsumers stops.
+var startedConsumers struct {
+	sync.Mutex
+	consumers []*ContinualConsumer
 }
 
 // ErrShutdown can be returned from ContinualConsumer.ProcessMessage to stop the ContinualConsumer.
 var ErrShutdown = fmt.Errorf("shutdown")
 
+// ErrResetConsumerGroup is returned by ContinualConsumer.Reset when consuming
+// as part of a consumer group, if the consumer can't look up the offsets to
+// seek the group back to.
+var ErrResetConsumerGroup = fmt.Errorf("the offsets of this consumer group must be reset using the Kafka tools")
+
 // Start starts the consumer consuming.
 // Starts up a goroutine for each partition in the kafka stream.
 // Returns nil once all the goroutines are started.
@@ -65,6 +145,27 @@ func (c *ContinualConsumer) Start() error {
 
 // StartOffsets is the same as Start but returns the loaded offsets as well.
 func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
+	startedConsumers.Lock()
+	startedConsumers.consumers = append(startedConsumers.consumers, c)
+	startedConsumers.Unlock()
+
+	c.mu.Lock()
+	c.reset = make(chan struct{})
+	c.mu.Unlock()
+
+	if provider, ok := c.Consumer.(ConsumerGroupProvider); ok {
+		group, err := provider.ConsumerGroup(c.ComponentName, c.initialOffset())
+		if err != nil {
+			return nil, err
+		}
+		if group != nil {
+			c.mu.Lock()
+			c.grouped = true
+			c.mu.Unlock()
+			return c.startConsumerGroup(group)
+		}
+	}
+
 	offsets := map[int32]int64{}
 
 	partitions, err := c.Consumer.Partitions(c.Topic)
@@ -72,8 +173,9 @@ func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
 		return nil, err
 	}
 	for _, partition := range partitions {
-		// Default all the offsets to the beginning of the stream.
-		offsets[partition] = sarama.OffsetOldest
+		// Default all the offsets to the beginning of the stream, or the end
+		// if only new messages are wanted.
+		offsets[partition] = c.initialOffset()
 	}
 
 	storedOffsets, err := c.PartitionStore.PartitionOffsets(context.TODO(), c.Topic)
@@ -87,6 +189,26 @@ func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
 		offsets[offset.Partition] = 1 + offset.Offset
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = c.consumePartitions(offsets); err != nil {
+		return nil, err
+	}
+	return storedOffsets, nil
+}
+
+// initialOffset returns where to start consuming partitions that there is no
+// stored offset for.
+func (c *ContinualConsumer) initialOffset() int64 {
+	if c.StartFromNewest {
+		return sarama.OffsetNewest
+	}
+	return sarama.OffsetOldest
+}
+
+// consumePartitions starts consuming each partition from the given offset.
+// The caller must hold c.mu.
+func (c *ContinualConsumer) consumePartitions(offsets map[int32]int64) error {
 	var partitionConsumers []sarama.PartitionConsumer
 	for partition, offset := range offsets {
 		pc, err := c.Consumer.ConsumePartition(c.Topic, partition, offset)
@@ -94,24 +216,190 @@ func (c *ContinualConsumer) StartOffsets() ([]sqlutil.PartitionOffset, error) {
 			for _, p := range partitionConsumers {
 				p.Close() // nolint: errcheck
 			}
-			return nil, err
+			return err
 		}
 		partitionConsumers = append(partitionConsumers, pc)
 	}
+	c.partitionConsumers = partitionConsumers
 	for _, pc := range partitionConsumers {
-		go c.consumePartition(pc)
+		go c.consumePartition(pc, c.reset)
 	}
+	return nil
+}
 
-	return storedOffsets, nil
+// Reset consumes the topic again from the beginning. Any message which is
+// being processed is allowed to finish first, then the stored offsets are
+// forgotten and ResetCallback is called before consuming starts again.
+// The reset isn't tied to the lifetime of the caller, e.g. an HTTP request,
+// so that it is never abandoned half way through.
+//
+// If the offsets can't be reset or ResetCallback fails, the offsets that the
+// consumer had reached are put back and it carries on consuming from them.
+//
+// In a consumer group, the group is sought back to the oldest offsets of
+// the partitions that this consumer has claimed when its next session
+// starts. Any other consumers in the group should be stopped first, so that
+// this consumer claims every partition.
+func (c *ContinualConsumer) Reset() error {
+	ctx := context.Background()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return fmt.Errorf("the consumer has been stopped")
+	}
+	if _, ok := c.Consumer.(OldestOffsetProvider); c.grouped && !ok {
+		return ErrResetConsumerGroup
+	}
+	previous, err := c.PartitionStore.PartitionOffsets(ctx, c.Topic)
+	if err != nil {
+		return fmt.Errorf("c.PartitionStore.PartitionOffsets: %w", err)
+	}
+
+	// Stop processing messages. The partition consumers, or the claims of
+	// the group session, notice that the channel is closed and return.
+	close(c.reset)
+	c.reset = make(chan struct{})
+	if !c.grouped {
+		for _, pc := range c.partitionConsumers {
+			pc.AsyncClose()
+		}
+		c.partitionConsumers = nil
+	}
+
+	if err = c.PartitionStore.ResetPartitionOffsets(ctx, c.Topic); err != nil {
+		return c.restoreOffsetsLocked(ctx, previous, fmt.Errorf("c.PartitionStore.ResetPartitionOffsets: %w", err))
+	}
+	if c.ResetCallback != nil {
+		if err = c.ResetCallback(ctx); err != nil {
+			return c.restoreOffsetsLocked(ctx, previous, fmt.Errorf("c.ResetCallback: %w", err))
+		}
+	}
+
+	logger := logrus.WithField("component", c.ComponentName)
+	if c.grouped {
+		// The group session ends once its claims have returned, and the
+		// next session seeks to the oldest offsets when it is set up.
+		c.resetGroup = true
+		logger.Warnf("Reset offsets of %q, the consumer group will consume it again from the beginning", c.Topic)
+		return nil
+	}
+	// Everything built from the topic has been deleted by now, so there is
+	// no going back to the previous offsets. If consuming can't start, the
+	// consumer stays idle and Reset can be tried again.
+	if err = c.consumeFromOffsetsLocked(nil); err != nil {
+		return err
+	}
+	logger.Warnf("Reset offsets of %q, consuming it again from the beginning", c.Topic)
+	return nil
+}
+
+// restoreOffsetsLocked puts back the offsets that the consumer had reached
+// before a reset failed and carries on consuming from them. It returns the
+// error that the reset failed with. The caller must hold c.mu.
+func (c *ContinualConsumer) restoreOffsetsLocked(ctx context.Context, previous []sqlutil.PartitionOffset, resetErr error) error {
+	logrus.WithError(resetErr).WithField("component", c.ComponentName).Errorf("Failed to reset offsets of %q, carrying on from where it had got to", c.Topic)
+	for _, offset := range previous {
+		if err := c.PartitionStore.SetPartitionOffset(ctx, c.Topic, offset.Partition, offset.Offset); err != nil {
+			c.stopLocked()
+			return fmt.Errorf("%w (restoring the offsets also failed: %s)", resetErr, err)
+		}
+	}
+	if c.grouped {
+		// The next group session carries on from the offsets that the group
+		// has committed, as the group wasn't sought back.
+		return resetErr
+	}
+	if err := c.consumeFromOffsetsLocked(previous); err != nil {
+		c.stopLocked()
+		return fmt.Errorf("%w (consuming from the restored offsets also failed: %s)", resetErr, err)
+	}
+	return resetErr
+}
+
+// consumeFromOffsetsLocked starts consuming every partition after the given
+// offsets, or from the beginning for partitions without one. The caller must
+// hold c.mu.
+func (c *ContinualConsumer) consumeFromOffsetsLocked(stored []sqlutil.PartitionOffset) error {
+	partitions, err := c.Consumer.Partitions(c.Topic)
+	if err != nil {
+		return fmt.Errorf("c.Consumer.Partitions: %w", err)
+	}
+	offsets := map[int32]int64{}
+	for _, partition := range partitions {
+		offsets[partition] = sarama.OffsetOldest
+	}
+	for _, offset := range stored {
+		offsets[offset.Partition] = 1 + offset.Offset
+	}
+	if err = c.consumePartitions(offsets); err != nil {
+		return fmt.Errorf("c.consumePartitions: %w", err)
+	}
+	return nil
+}
+
+// Stop stops the consumer. Any message which is being processed is allowed to
+// finish first, so that its offset is stored and it isn't processed again when
+// the component is next started.
+func (c *ContinualConsumer) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopLocked()
+}
+
+// stopLocked stops the consumer. The caller must hold c.mu.
+func (c *ContinualConsumer) stopLocked() {
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	for _, pc := range c.partitionConsumers {
+		pc.AsyncClose()
+	}
+	if c.cancelGroup != nil {
+		c.cancelGroup()
+	}
+}
+
+// StopConsumers stops every ContinualConsumer that has been started, as part
+// of shutting down.
+func StopConsumers(ctx context.Context) error {
+	startedConsumers.Lock()
+	consumers := startedConsumers.consumers
+	startedConsumers.Unlock()
+	for _, c := range consumers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.Stop()
+	}
+	return nil
 }
 
-// consumePartition consumes the room events for a single partition of the kafkaesque stream.
-func (c *ContinualConsumer) consumePartition(pc sarama.PartitionConsumer) {
+// isClosed returns true if the channel has been closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// consumePartition consumes the room events for a single partition of the kafkaesque stream,
+// until the consumer is stopped or the reset channel is closed.
+func (c *ContinualConsumer) consumePartition(pc sarama.PartitionConsumer, reset <-chan struct{}) {
 	defer pc.Close() // nolint: errcheck
 	for message := range pc.Messages() {
-		msgErr := c.ProcessMessage(message)
+		c.mu.RLock()
+		if c.stopped || isClosed(reset) {
+			c.mu.RUnlock()
+			return
+		}
+		msgErr := c.processMessage(message)
 		// Advance our position in the stream so that we will start at the right position after a restart.
-		if err := c.PartitionStore.SetPartitionOffset(context.TODO(), c.Topic, message.Partition, message.Offset); err != nil {
+		err := c.PartitionStore.SetPartitionOffset(context.TODO(), c.Topic, message.Partition, message.Offset)
+		c.mu.RUnlock()
+		if err != nil {
 			panic(fmt.Errorf("the ContinualConsumer in %q failed to SetPartitionOffset: %w", c.ComponentName, err))
 		}
 		// Shutdown if we were told to do so.
@@ -123,3 +411,175 @@ func (c *ContinualConsumer) consumePartition(pc sarama.PartitionConsumer) {
 		}
 	}
 }
+
+// The delay before retrying a message that failed to process, which doubles
+// after each attempt up to the maximum.
+var (
+	deadLetterRetryBackoff    = 100 * time.Millisecond
+	maxDeadLetterRetryBackoff = 5 * time.Second
+)
+
+// processMessage calls ProcessMessage for the message. If the consumer is a
+// DeadLetterPublisher then messages that fail are retried with exponential
+// backoff, and then published to the dead-letter topic, so that a single bad
+// message can't wedge the consumer. Returns ErrShutdown if the consumer should
+// stop.
+func (c *ContinualConsumer) processMessage(message *sarama.ConsumerMessage) error {
+	msgErr := c.ProcessMessage(message)
+	publisher, ok := c.Consumer.(DeadLetterPublisher)
+	if !ok || msgErr == nil || msgErr == ErrShutdown {
+		return msgErr
+	}
+	attempts := 1
+	backoff := deadLetterRetryBackoff
+	for attempts < publisher.MaxProcessingRetries() {
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxDeadLetterRetryBackoff {
+			backoff = maxDeadLetterRetryBackoff
+		}
+		attempts++
+		if msgErr = c.ProcessMessage(message); msgErr == nil || msgErr == ErrShutdown {
+			return msgErr
+		}
+	}
+	logger := logrus.WithError(msgErr).WithFields(logrus.Fields{
+		"component": c.ComponentName,
+		"topic":     c.Topic,
+		"partition": message.Partition,
+		"offset":    message.Offset,
+		"attempts":  attempts,
+	})
+	logger.Error("Giving up on processing message")
+	if err := publisher.PublishDeadLetter(&DeadLetter{
+		ComponentName: c.ComponentName,
+		Topic:         c.Topic,
+		Partition:     message.Partition,
+		Offset:        message.Offset,
+		Key:           message.Key,
+		Value:         message.Value,
+		Error:         msgErr.Error(),
+		Attempts:      attempts,
+	}); err != nil {
+		logger.WithError(err).Error("Failed to publish message to dead-letter topic")
+	}
+	return msgErr
+}
+
+// startConsumerGroup starts consuming as part of a consumer group. The
+// offsets in the partition store are used as a starting point for any
+// partitions that the group hasn't committed offsets for yet.
+func (c *ContinualConsumer) startConsumerGroup(group sarama.ConsumerGroup) ([]sqlutil.PartitionOffset, error) {
+	storedOffsets, err := c.PartitionStore.PartitionOffsets(context.TODO(), c.Topic)
+	if err != nil {
+		group.Close() // nolint: errcheck
+		return nil, err
+	}
+	handler := &consumerGroupHandler{
+		c:             c,
+		storedOffsets: storedOffsets,
+		shutdown:      make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.cancelGroup = cancel
+	c.mu.Unlock()
+	go func() {
+		defer group.Close() // nolint: errcheck
+		for {
+			// Consume blocks for the lifetime of a group session, returning
+			// when the partitions are rebalanced, so keep rejoining until
+			// we are told to shut down or are stopped.
+			if err := group.Consume(ctx, []string{c.Topic}, handler); err != nil {
+				logrus.WithError(err).Errorf("The ContinualConsumer in %q failed to consume from consumer group", c.ComponentName)
+			}
+			select {
+			case <-handler.shutdown:
+				if c.ShutdownCallback != nil {
+					c.ShutdownCallback()
+				}
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}()
+	return storedOffsets, nil
+}
+
+// consumerGroupHandler implements sarama.ConsumerGroupHandler for a ContinualConsumer.
+type consumerGroupHandler struct {
+	c             *ContinualConsumer
+	storedOffsets []sqlutil.PartitionOffset
+	reset         <-chan struct{} // the reset channel of the current session
+	shutdown      chan struct{}
+	shutdownOnce  sync.Once
+}
+
+// Setup is called at the start of each group session, before any messages
+// are consumed from the claimed partitions.
+func (h *consumerGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.c.mu.Lock()
+	defer h.c.mu.Unlock()
+	h.reset = h.c.reset
+	if h.c.resetGroup {
+		// ResetOffset only ever moves the offset backwards, unlike MarkOffset.
+		provider := h.c.Consumer.(OldestOffsetProvider)
+		for _, partition := range session.Claims()[h.c.Topic] {
+			offset, err := provider.OldestOffset(h.c.Topic, partition)
+			if err != nil {
+				return fmt.Errorf("provider.OldestOffset: %w", err)
+			}
+			session.ResetOffset(h.c.Topic, partition, offset, "")
+		}
+		h.storedOffsets = nil
+		h.c.resetGroup = false
+		return nil
+	}
+	for _, offset := range h.storedOffsets {
+		// MarkOffset only ever moves the offset forward, so this is a no-op
+		// for partitions where the group has already got further than us.
+		session.MarkOffset(h.c.Topic, offset.Partition, 1+offset.Offset, "")
+	}
+	return nil
+}
+
+// Cleanup is called at the end of each group session.
+func (h *consumerGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim consumes the messages for a single claimed partition. Offsets
+// are only committed once a message has been processed, so that messages are
+// delivered at least once, even if we crash or the group rebalances.
+func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		var message *sarama.ConsumerMessage
+		select {
+		case message = <-claim.Messages():
+			if message == nil {
+				return nil
+			}
+		case <-h.reset:
+			// Returning ends the session, so that the next one seeks to
+			// the oldest offsets.
+			return nil
+		}
+		h.c.mu.RLock()
+		if h.c.stopped || isClosed(h.reset) {
+			h.c.mu.RUnlock()
+			return nil
+		}
+		msgErr := h.c.processMessage(message)
+		if err := h.c.PartitionStore.SetPartitionOffset(context.TODO(), h.c.Topic, message.Partition, message.Offset); err != nil {
+			panic(fmt.Errorf("the ContinualConsumer in %q failed to SetPartitionOffset: %w", h.c.ComponentName, err))
+		}
+		session.MarkMessage(message, "")
+		session.Commit()
+		h.c.mu.RUnlock()
+		if msgErr == ErrShutdown {
+			h.shutdownOnce.Do(func() { close(h.shutdown) })
+			return ErrShutdown
+		}
+	}
+}
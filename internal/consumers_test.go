@@ -0,0 +1,394 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const testTopic = "topic"
+
+// fakeConsumer is a sarama.Consumer for a topic with a single partition
+// holding the given messages.
+type fakeConsumer struct {
+	values []string
+	oldest int64
+}
+
+func (c *fakeConsumer) Topics() ([]string, error) { return []string{testTopic}, nil }
+
+func (c *fakeConsumer) Partitions(topic string) ([]int32, error) { return []int32{0}, nil }
+
+func (c *fakeConsumer) HighWaterMarks() map[string]map[int32]int64 { return nil }
+
+func (c *fakeConsumer) Close() error { return nil }
+
+func (c *fakeConsumer) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	switch offset {
+	case sarama.OffsetOldest:
+		offset = 0
+	case sarama.OffsetNewest:
+		offset = int64(len(c.values))
+	}
+	pc := &fakePartitionConsumer{messages: make(chan *sarama.ConsumerMessage, len(c.values))}
+	for i := offset; i < int64(len(c.values)); i++ {
+		pc.messages <- &sarama.ConsumerMessage{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    i,
+			Value:     []byte(c.values[i]),
+		}
+	}
+	return pc, nil
+}
+
+// OldestOffset implements OldestOffsetProvider
+func (c *fakeConsumer) OldestOffset(topic string, partition int32) (int64, error) {
+	return c.oldest, nil
+}
+
+type fakePartitionConsumer struct {
+	messages  chan *sarama.ConsumerMessage
+	closeOnce sync.Once
+}
+
+func (pc *fakePartitionConsumer) AsyncClose() {
+	pc.closeOnce.Do(func() { close(pc.messages) })
+}
+
+func (pc *fakePartitionConsumer) Close() error {
+	pc.AsyncClose()
+	return nil
+}
+
+func (pc *fakePartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+
+func (pc *fakePartitionConsumer) Errors() <-chan *sarama.ConsumerError { return nil }
+
+func (pc *fakePartitionConsumer) HighWaterMarkOffset() int64 { return 0 }
+
+type fakePartitionStore struct {
+	sync.Mutex
+	offsets map[int32]int64
+}
+
+func (s *fakePartitionStore) PartitionOffsets(ctx context.Context, topic string) ([]sqlutil.PartitionOffset, error) {
+	s.Lock()
+	defer s.Unlock()
+	var offsets []sqlutil.PartitionOffset
+	for partition, offset := range s.offsets {
+		offsets = append(offsets, sqlutil.PartitionOffset{Partition: partition, Offset: offset})
+	}
+	return offsets, nil
+}
+
+func (s *fakePartitionStore) SetPartitionOffset(ctx context.Context, topic string, partition int32, offset int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.offsets[partition] = offset
+	return nil
+}
+
+func (s *fakePartitionStore) ResetPartitionOffsets(ctx context.Context, topic string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.offsets = make(map[int32]int64)
+	return nil
+}
+
+func waitForMessages(t *testing.T, processed <-chan string, count int) (values []string) {
+	t.Helper()
+	for len(values) < count {
+		select {
+		case value := <-processed:
+			values = append(values, value)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for messages, got %v", values)
+		}
+	}
+	return values
+}
+
+func TestContinualConsumerReset(t *testing.T) {
+	store := &fakePartitionStore{offsets: make(map[int32]int64)}
+	processed := make(chan string, 10)
+	var resets int
+	c := &ContinualConsumer{
+		ComponentName:  "test",
+		Topic:          testTopic,
+		Consumer:       &fakeConsumer{values: []string{"a", "b", "c"}},
+		PartitionStore: store,
+		ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+			processed <- string(msg.Value)
+			return nil
+		},
+		ResetCallback: func(ctx context.Context) error {
+			resets++
+			if offsets, _ := store.PartitionOffsets(ctx, testTopic); len(offsets) != 0 {
+				t.Errorf("expected the offsets to be reset before the callback, got %v", offsets)
+			}
+			return nil
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("failed to start consumer: %s", err)
+	}
+	defer c.Stop()
+	if got := waitForMessages(t, processed, 3); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got messages %v before reset, want [a b c]", got)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("failed to reset consumer: %s", err)
+	}
+	if resets != 1 {
+		t.Errorf("ResetCallback was called %d times, want 1", resets)
+	}
+	if got := waitForMessages(t, processed, 3); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got messages %v after reset, want [a b c]", got)
+	}
+	select {
+	case value := <-processed:
+		t.Fatalf("got unexpected message %q after replaying", value)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestContinualConsumerStartFromNewest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stored map[int32]int64
+		want   []string
+	}{
+		{"without stored offsets", map[int32]int64{}, nil},
+		{"with stored offsets", map[int32]int64{0: 0}, []string{"b", "c"}},
+	} {
+		processed := make(chan string, 10)
+		c := &ContinualConsumer{
+			ComponentName:   "test",
+			Topic:           testTopic,
+			Consumer:        &fakeConsumer{values: []string{"a", "b", "c"}},
+			PartitionStore:  &fakePartitionStore{offsets: tt.stored},
+			StartFromNewest: true,
+			ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+				processed <- string(msg.Value)
+				return nil
+			},
+		}
+		if err := c.Start(); err != nil {
+			t.Fatalf("%s: failed to start consumer: %s", tt.name, err)
+		}
+		if got := waitForMessages(t, processed, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got messages %v, want %v", tt.name, got, tt.want)
+		}
+		select {
+		case value := <-processed:
+			t.Errorf("%s: got unexpected message %q", tt.name, value)
+		case <-time.After(100 * time.Millisecond):
+		}
+		c.Stop()
+	}
+}
+
+func TestContinualConsumerResetFailure(t *testing.T) {
+	store := &fakePartitionStore{offsets: make(map[int32]int64)}
+	processed := make(chan string, 10)
+	resetErr := errors.New("failed to delete")
+	c := &ContinualConsumer{
+		ComponentName:  "test",
+		Topic:          testTopic,
+		Consumer:       &fakeConsumer{values: []string{"a", "b", "c"}},
+		PartitionStore: store,
+		ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+			processed <- string(msg.Value)
+			return nil
+		},
+		ResetCallback: func(ctx context.Context) error {
+			return resetErr
+		},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("failed to start consumer: %s", err)
+	}
+	defer c.Stop()
+	waitForMessages(t, processed, 3)
+
+	if err := c.Reset(); !errors.Is(err, resetErr) {
+		t.Fatalf("got error %v, want %v", err, resetErr)
+	}
+	if offsets, _ := store.PartitionOffsets(context.Background(), testTopic); !reflect.DeepEqual(offsets, []sqlutil.PartitionOffset{{Partition: 0, Offset: 2}}) {
+		t.Errorf("expected the offsets to be restored, got %v", offsets)
+	}
+	select {
+	case value := <-processed:
+		t.Fatalf("got unexpected message %q after a failed reset", value)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The consumer is still running, so the reset can be tried again.
+	c.ResetCallback = nil
+	if err := c.Reset(); err != nil {
+		t.Fatalf("failed to reset consumer: %s", err)
+	}
+	if got := waitForMessages(t, processed, 3); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got messages %v after reset, want [a b c]", got)
+	}
+}
+
+// fakeSession records the offsets that a consumer group session is told to
+// mark or reset.
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	claims map[string][]int32
+	marked map[int32]int64
+	reset  map[int32]int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return s.claims }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.marked[partition] = offset
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.reset[partition] = offset
+}
+
+func TestConsumerGroupSetupAfterReset(t *testing.T) {
+	c := &ContinualConsumer{
+		ComponentName:  "test",
+		Topic:          testTopic,
+		Consumer:       &fakeConsumer{oldest: 5},
+		PartitionStore: &fakePartitionStore{offsets: make(map[int32]int64)},
+		grouped:        true,
+		reset:          make(chan struct{}),
+	}
+	h := &consumerGroupHandler{
+		c:             c,
+		storedOffsets: []sqlutil.PartitionOffset{{Partition: 0, Offset: 10}},
+		shutdown:      make(chan struct{}),
+	}
+	newSession := func() *fakeSession {
+		return &fakeSession{
+			claims: map[string][]int32{testTopic: {0, 1}},
+			marked: make(map[int32]int64),
+			reset:  make(map[int32]int64),
+		}
+	}
+
+	session := newSession()
+	if err := h.Setup(session); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	if want := map[int32]int64{0: 11}; !reflect.DeepEqual(session.marked, want) {
+		t.Errorf("got marked offsets %v before reset, want %v", session.marked, want)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("failed to reset consumer: %s", err)
+	}
+	if !isClosed(h.reset) {
+		t.Fatalf("expected the reset to end the session")
+	}
+	session = newSession()
+	if err := h.Setup(session); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	if want := map[int32]int64{0: 5, 1: 5}; !reflect.DeepEqual(session.reset, want) {
+		t.Errorf("got reset offsets %v, want %v", session.reset, want)
+	}
+	if len(session.marked) != 0 {
+		t.Errorf("expected no offsets to be marked after reset, got %v", session.marked)
+	}
+
+	// Later sessions carry on from wherever the group has got to.
+	session = newSession()
+	if err := h.Setup(session); err != nil {
+		t.Fatalf("Setup failed: %s", err)
+	}
+	if len(session.marked) != 0 || len(session.reset) != 0 {
+		t.Errorf("expected no offsets to be changed, got marked %v and reset %v", session.marked, session.reset)
+	}
+}
+
+type groupConsumer struct {
+	sarama.Consumer
+}
+
+func TestConsumerGroupResetNeedsOldestOffsets(t *testing.T) {
+	c := &ContinualConsumer{
+		ComponentName:  "test",
+		Topic:          testTopic,
+		Consumer:       groupConsumer{},
+		PartitionStore: &fakePartitionStore{offsets: make(map[int32]int64)},
+		grouped:        true,
+		reset:          make(chan struct{}),
+	}
+	if err := c.Reset(); err != ErrResetConsumerGroup {
+		t.Fatalf("got error %v, want ErrResetConsumerGroup", err)
+	}
+}
+
+// fakeDeadLetterConsumer is a fakeConsumer which records the dead letters
+// that it is asked to publish.
+type fakeDeadLetterConsumer struct {
+	fakeConsumer
+	maxRetries int
+	letters    []*DeadLetter
+}
+
+func (c *fakeDeadLetterConsumer) MaxProcessingRetries() int { return c.maxRetries }
+
+func (c *fakeDeadLetterConsumer) PublishDeadLetter(letter *DeadLetter) error {
+	c.letters = append(c.letters, letter)
+	return nil
+}
+
+func TestProcessMessageDeadLetterAttempts(t *testing.T) {
+	defer func(backoff time.Duration) { deadLetterRetryBackoff = backoff }(deadLetterRetryBackoff)
+	deadLetterRetryBackoff = time.Millisecond
+
+	consumer := &fakeDeadLetterConsumer{maxRetries: 3}
+	calls := 0
+	c := &ContinualConsumer{
+		ComponentName: "test",
+		Topic:         testTopic,
+		Consumer:      consumer,
+		ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+			calls++
+			return errors.New("bad message")
+		},
+	}
+	if err := c.processMessage(&sarama.ConsumerMessage{Topic: testTopic, Offset: 7}); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if calls != consumer.maxRetries {
+		t.Errorf("message was processed %d times, want %d", calls, consumer.maxRetries)
+	}
+	if len(consumer.letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(consumer.letters))
+	}
+	if letter := consumer.letters[0]; letter.Attempts != calls || letter.Offset != 7 || letter.Error != "bad message" {
+		t.Errorf("wrong dead letter: %+v", letter)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// MaxEventSize is the maximum size of the canonical JSON of an event in bytes.
+// https://matrix.org/docs/spec/server_server/latest#size-limits
+const MaxEventSize = 65536
+
+// EventTooLargeError is returned when an event, or one of its fields, is
+// larger than is allowed.
+type EventTooLargeError struct {
+	Message string
+}
+
+func (e EventTooLargeError) Error() string {
+	return e.Message
+}
+
+// CheckEventSize returns an EventTooLargeError if the canonical JSON of the
+// event is larger than MaxEventSize, or if any of the fields named in
+// maxFieldLengths is longer than allowed. Fields are given as gjson paths,
+// e.g. "content.body". String fields are measured in characters and any
+// other fields by the length of their JSON.
+func CheckEventSize(eventJSON []byte, maxFieldLengths map[string]int) error {
+	canonical, err := gomatrixserverlib.CanonicalJSON(eventJSON)
+	if err != nil {
+		return err
+	}
+	if len(canonical) > MaxEventSize {
+		return EventTooLargeError{
+			Message: fmt.Sprintf("event is %d bytes, the maximum is %d bytes", len(canonical), MaxEventSize),
+		}
+	}
+	// Check the fields in a stable order so that the error is predictable.
+	paths := make([]string, 0, len(maxFieldLengths))
+	for path := range maxFieldLengths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		field := gjson.GetBytes(canonical, path)
+		if !field.Exists() {
+			continue
+		}
+		length := len(field.Raw)
+		if field.Type == gjson.String {
+			length = utf8.RuneCountInString(field.Str)
+		}
+		if max := maxFieldLengths[path]; length > max {
+			return EventTooLargeError{
+				Message: fmt.Sprintf("%s is %d long, the maximum is %d", path, length, max),
+			}
+		}
+	}
+	return nil
+}
+
+// CheckEventDepth returns an error if the depth of the event is not greater
+// than the depth of every one of the given prev events.
+func CheckEventDepth(event *gomatrixserverlib.Event, prevEvents []gomatrixserverlib.Event) error {
+	for i := range prevEvents {
+		if event.Depth() <= prevEvents[i].Depth() {
+			return fmt.Errorf(
+				"event depth %d is not greater than depth %d of prev event %s",
+				event.Depth(), prevEvents[i].Depth(), prevEvents[i].EventID(),
+			)
+		}
+	}
+	return nil
+}
+
+// CheckHistoricalEventDepth returns an error if the depth of a historical
+// event, imported by an application service (MSC2716), is less than the depth
+// of any of the given prev events. Historical events share the depth of the
+// event they were inserted after, so that they are ordered before the live
+// events which follow it.
+func CheckHistoricalEventDepth(event *gomatrixserverlib.Event, prevEvents []gomatrixserverlib.Event) error {
+	for i := range prevEvents {
+		if event.Depth() < prevEvents[i].Depth() {
+			return fmt.Errorf(
+				"historical event depth %d is less than depth %d of prev event %s",
+				event.Depth(), prevEvents[i].Depth(), prevEvents[i].EventID(),
+			)
+		}
+	}
+	return nil
+}
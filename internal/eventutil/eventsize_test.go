@@ -0,0 +1,76 @@
+package eventutil
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// eventOfSize returns canonical event JSON which is exactly size bytes long.
+func eventOfSize(t *testing.T, size int) []byte {
+	t.Helper()
+	const prefix, suffix = `{"content":{"body":"`, `"},"type":"m.room.message"}`
+	pad := size - len(prefix) - len(suffix)
+	if pad < 0 {
+		t.Fatalf("size %d is too small", size)
+	}
+	return []byte(prefix + strings.Repeat("a", pad) + suffix)
+}
+
+func TestCheckEventSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		json   []byte
+		limits map[string]int
+		tooBig bool
+	}{
+		{"at maximum size", eventOfSize(t, MaxEventSize), nil, false},
+		{"one byte over maximum size", eventOfSize(t, MaxEventSize+1), nil, true},
+		{"body at field limit", []byte(`{"content":{"body":"abcde"}}`), map[string]int{"content.body": 5}, false},
+		{"body over field limit", []byte(`{"content":{"body":"abcdef"}}`), map[string]int{"content.body": 5}, true},
+		{"body counted in characters", []byte(`{"content":{"body":"ééééé"}}`), map[string]int{"content.body": 5}, false},
+		{"missing field", []byte(`{"content":{}}`), map[string]int{"content.body": 5}, false},
+		{"non-string field", []byte(`{"content":{"info":{"w":100}}}`), map[string]int{"content.info": 8}, true},
+	}
+	for _, tt := range tests {
+		err := CheckEventSize(tt.json, tt.limits)
+		if _, ok := err.(EventTooLargeError); ok != tt.tooBig {
+			t.Errorf("%s: CheckEventSize returned %v, want too large %v", tt.name, err, tt.tooBig)
+		}
+	}
+}
+
+func TestCheckEventDepth(t *testing.T) {
+	eventAtDepth := func(depth int64) gomatrixserverlib.Event {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+			`{"type":"m.room.message","content":{},"sender":"@alice:test","room_id":"!room:test","event_id":"$%d:test","origin_server_ts":1,"depth":%d,"prev_events":[],"auth_events":[]}`,
+			depth, depth,
+		)), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		return ev
+	}
+	event := eventAtDepth(5)
+	tests := []struct {
+		name            string
+		prev            []gomatrixserverlib.Event
+		valid           bool
+		validHistorical bool
+	}{
+		{"no prev events", nil, true, true},
+		{"deeper than all prev events", []gomatrixserverlib.Event{eventAtDepth(3), eventAtDepth(4)}, true, true},
+		{"same depth as a prev event", []gomatrixserverlib.Event{eventAtDepth(3), eventAtDepth(5)}, false, true},
+		{"shallower than a prev event", []gomatrixserverlib.Event{eventAtDepth(6)}, false, false},
+	}
+	for _, tt := range tests {
+		if err := CheckEventDepth(&event, tt.prev); (err == nil) != tt.valid {
+			t.Errorf("%s: CheckEventDepth returned %v, want valid %v", tt.name, err, tt.valid)
+		}
+		if err := CheckHistoricalEventDepth(&event, tt.prev); (err == nil) != tt.validHistorical {
+			t.Errorf("%s: CheckHistoricalEventDepth returned %v, want valid %v", tt.name, err, tt.validHistorical)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PowerLevelsChangeError is returned when the sender of an m.room.power_levels
+// event isn't allowed to make one of the changes in it.
+type PowerLevelsChangeError struct {
+	Reason string
+}
+
+func (e PowerLevelsChangeError) Error() string {
+	return "invalid power levels change: " + e.Reason
+}
+
+// CheckPowerLevelsChange checks that the sender of an m.room.power_levels event
+// is allowed to make the changes it makes to the room's current power levels,
+// as given by the auth events. The event is checked with the full event auth
+// rules so that the reason for a rejection can be returned to the client.
+// Events of other types are always allowed by this check.
+func CheckPowerLevelsChange(
+	event *gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider,
+) error {
+	if event.Type() != gomatrixserverlib.MRoomPowerLevels || !event.StateKeyEquals("") {
+		return nil
+	}
+	err := gomatrixserverlib.Allowed(*event, authEvents)
+	if notAllowed, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+		return PowerLevelsChangeError{Reason: notAllowed.Message}
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package eventutil
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustPowerLevelsTestEvent(t *testing.T, eventID, eventType, sender, stateKey string, content interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	eventJSON, err := json.Marshal(map[string]interface{}{
+		"auth_events":      []interface{}{},
+		"content":          content,
+		"depth":            1,
+		"event_id":         eventID,
+		"origin":           "test",
+		"origin_server_ts": 0,
+		"prev_events":      []interface{}{},
+		"room_id":          "!room:test",
+		"sender":           sender,
+		"state_key":        stateKey,
+		"type":             eventType,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %s", err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return &event
+}
+
+func TestCheckPowerLevelsChange(t *testing.T) {
+	base := func() gomatrixserverlib.PowerLevelContent {
+		return gomatrixserverlib.PowerLevelContent{
+			Ban:           50,
+			Invite:        0,
+			Kick:          50,
+			Redact:        50,
+			StateDefault:  50,
+			EventsDefault: 0,
+			Users: map[string]int64{
+				"@admin:test": 100,
+				"@mod:test":   50,
+				"@other:test": 50,
+				"@user:test":  10,
+			},
+			Events: map[string]int64{
+				"m.room.name":         50,
+				"m.room.power_levels": 50,
+			},
+		}
+	}
+	authEvents := gomatrixserverlib.NewAuthEvents([]*gomatrixserverlib.Event{
+		mustPowerLevelsTestEvent(t, "$create:test", gomatrixserverlib.MRoomCreate, "@admin:test", "", map[string]interface{}{
+			"creator": "@admin:test",
+		}),
+		mustPowerLevelsTestEvent(t, "$pl:test", gomatrixserverlib.MRoomPowerLevels, "@admin:test", "", base()),
+	})
+	for _, userID := range []string{"@admin:test", "@mod:test"} {
+		member := mustPowerLevelsTestEvent(t, "$member-"+userID, gomatrixserverlib.MRoomMember, userID, userID, map[string]interface{}{
+			"membership": gomatrixserverlib.Join,
+		})
+		if err := authEvents.AddEvent(member); err != nil {
+			t.Fatalf("failed to add member event: %s", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sender  string
+		change  func(pl *gomatrixserverlib.PowerLevelContent)
+		allowed bool
+	}{
+		{"no change", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {}, true},
+		{"raise user to own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@user:test"] = 50
+		}, true},
+		{"raise user above own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@user:test"] = 51
+		}, false},
+		{"change user at own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@other:test"] = 0
+		}, false},
+		{"lower own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@mod:test"] = 0
+		}, true},
+		{"remove higher user", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			delete(pl.Users, "@admin:test")
+		}, false},
+		{"add user above own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@new:test"] = 60
+		}, false},
+		{"add event level at own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Events["m.room.topic"] = 50
+		}, true},
+		{"raise default above own level", "@mod:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.StateDefault = 75
+		}, false},
+		{"admin changes anything", "@admin:test", func(pl *gomatrixserverlib.PowerLevelContent) {
+			pl.Users["@mod:test"] = 0
+			pl.Events["m.room.power_levels"] = 100
+			pl.StateDefault = 100
+		}, true},
+	}
+	for _, tt := range tests {
+		newLevels := base()
+		tt.change(&newLevels)
+		event := mustPowerLevelsTestEvent(t, "$newpl:test", gomatrixserverlib.MRoomPowerLevels, tt.sender, "", newLevels)
+		err := CheckPowerLevelsChange(event, &authEvents)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: expected change to be allowed, got %s", tt.name, err)
+		}
+		if !tt.allowed {
+			if _, ok := err.(PowerLevelsChangeError); !ok {
+				t.Errorf("%s: expected change to be rejected with a PowerLevelsChangeError, got %v", tt.name, err)
+			}
+		}
+	}
+}
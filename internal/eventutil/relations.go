@@ -0,0 +1,128 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"context"
+	"encoding/json"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/sjson"
+)
+
+const ignoredUserListType = "m.ignored_user_list"
+
+type annotationChunk struct {
+	Chunk []roomserverAPI.Annotation `json:"chunk"`
+}
+
+type threadBundle struct {
+	LatestEvent             gomatrixserverlib.ClientEvent `json:"latest_event"`
+	Count                   int                           `json:"count"`
+	CurrentUserParticipated bool                          `json:"current_user_participated"`
+}
+
+type relationsBundle struct {
+	Annotation *annotationChunk           `json:"m.annotation,omitempty"`
+	Replace    *roomserverAPI.Replacement `json:"m.replace,omitempty"`
+	Thread     *threadBundle              `json:"m.thread,omitempty"`
+}
+
+// IgnoredUsers returns the users which the given user has ignored, according
+// to their m.ignored_user_list account data.
+func IgnoredUsers(
+	ctx context.Context, userAPI userapi.UserInternalAPI, userID string,
+) ([]string, error) {
+	var res userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: ignoredUserListType,
+	}, &res); err != nil {
+		return nil, err
+	}
+	data, ok := res.GlobalAccountData[ignoredUserListType]
+	if !ok {
+		return nil, nil
+	}
+	var content struct {
+		IgnoredUsers map[string]json.RawMessage `json:"ignored_users"`
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	ignored := make([]string, 0, len(content.IgnoredUsers))
+	for ignoredUserID := range content.IgnoredUsers {
+		ignored = append(ignored, ignoredUserID)
+	}
+	return ignored, nil
+}
+
+// BundleAggregations adds the aggregated relations of each of the given events,
+// such as reaction counts, the latest edit and thread summaries, to the
+// "m.relations" key of the event's unsigned data. Annotations by users that the
+// given user has ignored aren't counted.
+func BundleAggregations(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI,
+	userID string, ignoredUsers []string, events []gomatrixserverlib.ClientEvent,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		eventIDs = append(eventIDs, event.EventID)
+	}
+	var res roomserverAPI.QueryAggregationsResponse
+	if err := rsAPI.QueryAggregations(ctx, &roomserverAPI.QueryAggregationsRequest{
+		EventIDs:     eventIDs,
+		IgnoredUsers: ignoredUsers,
+		UserID:       userID,
+	}, &res); err != nil {
+		return err
+	}
+	for i := range events {
+		aggregations, ok := res.Aggregations[events[i].EventID]
+		if !ok {
+			continue
+		}
+		var bundle relationsBundle
+		if len(aggregations.Annotations) > 0 {
+			bundle.Annotation = &annotationChunk{Chunk: aggregations.Annotations}
+		}
+		bundle.Replace = aggregations.Replace
+		if thread := aggregations.Thread; thread != nil {
+			bundle.Thread = &threadBundle{
+				LatestEvent:             gomatrixserverlib.ToClientEvent(thread.LatestEvent.Unwrap(), gomatrixserverlib.FormatAll),
+				Count:                   thread.Count,
+				CurrentUserParticipated: thread.CurrentUserParticipated,
+			}
+		}
+		unsigned := []byte(events[i].Unsigned)
+		if len(unsigned) == 0 {
+			unsigned = []byte("{}")
+		}
+		bundleJSON, err := json.Marshal(bundle)
+		if err != nil {
+			return err
+		}
+		if unsigned, err = sjson.SetRawBytes(unsigned, `m\.relations`, bundleJSON); err != nil {
+			return err
+		}
+		events[i].Unsigned = unsigned
+	}
+	return nil
+}
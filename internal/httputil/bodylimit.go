@@ -0,0 +1,94 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// ErrRequestBodyTooLarge is returned when reading a request body which is
+// larger than the limit set by LimitRequestBody.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// limitedBody wraps a http.MaxBytesReader so that going over the limit can
+// be told apart from other read errors.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = ErrRequestBodyTooLarge
+	}
+	return n, err
+}
+
+// LimitRequestBody wraps a handler so that it can't read more than limit
+// bytes of the request body. Requests which declare a larger Content-Length
+// are rejected with M_TOO_LARGE straight away, otherwise reading past the
+// limit fails with ErrRequestBodyTooLarge. A limit of 0 means unlimited.
+func LimitRequestBody(limit int64, h http.Handler) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > limit {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_ = json.NewEncoder(w).Encode(jsonerror.TooLarge(
+				fmt.Sprintf("The request body is larger than the maximum of %d bytes", limit),
+			))
+			return
+		}
+		if req.Body != nil {
+			req.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, req.Body, limit),
+				limit:      limit,
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// RequestBodyLimitMiddleware limits the size of request bodies on every route
+// of the router that it is used on. Limits in overrides are keyed by the path
+// template of the route, e.g. "/_matrix/client/r0/user/{userId}/filter", and
+// defaultLimit applies to all other routes. A limit of 0 means unlimited.
+func RequestBodyLimitMiddleware(defaultLimit int64, overrides map[string]int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			limit := defaultLimit
+			if route := mux.CurrentRoute(req); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if override, ok := overrides[template]; ok {
+						limit = override
+					}
+				}
+			}
+			LimitRequestBody(limit, next).ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package httputil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestBodyLimitMiddleware(t *testing.T) {
+	var readErr error
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, readErr = ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+	router := mux.NewRouter()
+	router.Use(RequestBodyLimitMiddleware(10, map[string]int64{"/big/{id}": 20}))
+	router.Handle("/small", handler)
+	router.Handle("/big/{id}", handler)
+
+	tests := []struct {
+		name        string
+		path        string
+		size        int
+		chunked     bool
+		wantCode    int
+		wantTooLong bool
+	}{
+		{"default limit", "/small", 10, false, http.StatusOK, false},
+		{"over default limit", "/small", 11, false, http.StatusRequestEntityTooLarge, false},
+		{"over default limit without content length", "/small", 11, true, http.StatusOK, true},
+		{"override limit", "/big/1", 20, false, http.StatusOK, false},
+		{"over override limit", "/big/1", 21, false, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		readErr = nil
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(strings.Repeat("a", tt.size)))
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.wantCode)
+		}
+		if (readErr == ErrRequestBodyTooLarge) != tt.wantTooLong {
+			t.Errorf("%s: got read error %v, want too large %v", tt.name, readErr, tt.wantTooLong)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPContextKey struct{}
+
+// ClientIP returns the IP address of the client that made the request. If the
+// request passed through ClientIPMiddleware then this is the address derived
+// from trusted proxy headers, otherwise it is the address of the peer.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+// ClientIPMiddleware returns a middleware which works out the client IP address
+// of each request. The X-Forwarded-For and Forwarded headers are only believed
+// if the request came from one of the trusted proxy CIDR ranges, so that other
+// clients can't spoof their address. Invalid CIDR ranges are ignored.
+func ClientIPMiddleware(trustedProxies []string) func(http.Handler) http.Handler {
+	var trusted []*net.IPNet
+	for _, cidr := range trustedProxies {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			trusted = append(trusted, ipnet)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ip := clientIP(req, trusted)
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientIPContextKey{}, ip)))
+		})
+	}
+}
+
+func clientIP(req *http.Request, trusted []*net.IPNet) string {
+	peer := remoteIP(req)
+	if !isTrustedProxy(peer, trusted) {
+		return peer
+	}
+	var hops []string
+	if forwarded := req.Header["Forwarded"]; len(forwarded) > 0 {
+		hops = parseForwarded(forwarded)
+	} else {
+		for _, header := range req.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	// Each proxy appends the address it received the request from, so walk
+	// backwards until we reach an address that isn't one of our proxies.
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Anything before a malformed entry can't be trusted.
+			break
+		}
+		if i == 0 || !isTrustedProxy(ip.String(), trusted) {
+			return ip.String()
+		}
+	}
+	return peer
+}
+
+// parseForwarded returns the "for" addresses from RFC 7239 Forwarded headers,
+// with any quotes, brackets and ports removed.
+func parseForwarded(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				addr := strings.Trim(kv[1], `"`)
+				if host, _, err := net.SplitHostPort(addr); err == nil {
+					addr = host
+				}
+				hops = append(hops, strings.Trim(addr, "[]"))
+			}
+		}
+	}
+	return hops
+}
+
+func remoteIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func isTrustedProxy(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
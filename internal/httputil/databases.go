@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// RequireDatabases returns middleware which answers requests with 503 while
+// any of the given databases can't be reached, so that requests which depend
+// on them don't pile up while waiting for them to come back. Only the routes
+// that the middleware is used on are affected.
+func RequireDatabases(dbs ...*config.DatabaseOptions) mux.MiddlewareFunc {
+	return requireAvailable(func() bool {
+		return sqlutil.DatabasesAvailable(dbs...)
+	})
+}
+
+func requireAvailable(available func() bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !available() {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_ = json.NewEncoder(w).Encode(jsonerror.Unknown("The database is currently unavailable"))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
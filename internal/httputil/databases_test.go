@@ -0,0 +1,44 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequireAvailableOnlyGatesItsRoutes(t *testing.T) {
+	available := true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	router := mux.NewRouter()
+	gated := router.PathPrefix("/gated").Subrouter()
+	gated.Use(requireAvailable(func() bool { return available }))
+	gated.Handle("/path", handler)
+	other := router.PathPrefix("/other").Subrouter()
+	other.Handle("/path", handler)
+
+	tests := []struct {
+		name      string
+		path      string
+		available bool
+		wantCode  int
+	}{
+		{"gated route while available", "/gated/path", true, http.StatusOK},
+		{"gated route while unavailable", "/gated/path", false, http.StatusServiceUnavailable},
+		{"other route while unavailable", "/other/path", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		available = tt.available
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.wantCode)
+		}
+		if tt.wantCode == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After header", tt.name)
+		}
+	}
+}
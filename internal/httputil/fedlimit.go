@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var federationInboundRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "inbound_requests_rejected_total",
+		Help:      "Number of inbound federation requests rejected because a concurrency limit was reached",
+	},
+	[]string{"limit"},
+)
+
+func init() {
+	prometheus.MustRegister(federationInboundRejected)
+}
+
+// Errors returned by FederationInboundLimiter.Acquire, which say which of the
+// limits was reached.
+var (
+	ErrFederationTotalLimit     = errors.New("too many concurrent federation requests to this server")
+	ErrFederationPerServerLimit = errors.New("too many concurrent requests from this server")
+)
+
+// FederationInboundLimiter limits the number of inbound federation requests
+// that are handled at the same time, both from each remote server and in
+// total. A limit of 0 means unlimited. A nil limiter never limits anything.
+type FederationInboundLimiter struct {
+	maxPerServer int
+	maxTotal     int
+	mutex        sync.Mutex
+	total        int
+	perServer    map[gomatrixserverlib.ServerName]int
+}
+
+// NewFederationInboundLimiter creates a new limiter with the given limits.
+func NewFederationInboundLimiter(maxPerServer, maxTotal int) *FederationInboundLimiter {
+	return &FederationInboundLimiter{
+		maxPerServer: maxPerServer,
+		maxTotal:     maxTotal,
+		perServer:    make(map[gomatrixserverlib.ServerName]int),
+	}
+}
+
+// Acquire reserves a slot for a request from the given server. It returns
+// ErrFederationTotalLimit or ErrFederationPerServerLimit if either limit has
+// been reached, in which case the request should be rejected. Otherwise
+// Release must be called once the request is finished.
+func (l *FederationInboundLimiter) Acquire(origin gomatrixserverlib.ServerName) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		federationInboundRejected.WithLabelValues("total").Inc()
+		return ErrFederationTotalLimit
+	}
+	if l.maxPerServer > 0 && l.perServer[origin] >= l.maxPerServer {
+		federationInboundRejected.WithLabelValues("per_server").Inc()
+		return ErrFederationPerServerLimit
+	}
+	l.total++
+	l.perServer[origin]++
+	return nil
+}
+
+// Release frees the slot reserved by a successful call to Acquire.
+func (l *FederationInboundLimiter) Release(origin gomatrixserverlib.ServerName) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	if l.perServer[origin] <= 1 {
+		delete(l.perServer, origin)
+	} else {
+		l.perServer[origin]--
+	}
+}
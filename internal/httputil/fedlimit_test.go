@@ -0,0 +1,29 @@
+package httputil
+
+import "testing"
+
+func TestFederationInboundLimiter(t *testing.T) {
+	l := NewFederationInboundLimiter(2, 3)
+	if l.Acquire("a") != nil || l.Acquire("a") != nil {
+		t.Fatal("expected first two requests from a to be allowed")
+	}
+	if err := l.Acquire("a"); err != ErrFederationPerServerLimit {
+		t.Fatalf("expected third request from a to be rejected by the per-server limit, got %v", err)
+	}
+	if err := l.Acquire("b"); err != nil {
+		t.Fatalf("expected request from b to be allowed, got %v", err)
+	}
+	if err := l.Acquire("c"); err != ErrFederationTotalLimit {
+		t.Fatalf("expected request from c to be rejected by the total limit, got %v", err)
+	}
+	l.Release("a")
+	if err := l.Acquire("c"); err != nil {
+		t.Fatalf("expected request from c to be allowed after a release, got %v", err)
+	}
+
+	var unlimited *FederationInboundLimiter
+	if err := unlimited.Acquire("a"); err != nil {
+		t.Fatalf("expected nil limiter to allow everything, got %v", err)
+	}
+	unlimited.Release("a")
+}
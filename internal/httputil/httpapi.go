@@ -16,17 +16,21 @@ package httputil
 
 import (
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationsenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -65,6 +69,81 @@ func MakeAuthAPI(
 	return MakeExternalAPI(metricsName, h)
 }
 
+// MakeAdminAPI turns a util.JSONRequestHandler function into an http.Handler which
+// checks that the request carries the admin token. If no admin token is configured
+// then the admin API is disabled and all requests are refused.
+func MakeAdminAPI(
+	metricsName, adminToken string, f func(*http.Request) util.JSONResponse,
+) http.Handler {
+	h := func(req *http.Request) util.JSONResponse {
+		if err := VerifyAdminToken(req, adminToken); err != nil {
+			return *err
+		}
+		return f(req)
+	}
+	return MakeExternalAPI(metricsName, h)
+}
+
+type adminDeviceContextKey struct{}
+
+// WithAdminDevice returns a copy of the request recording that it was made by
+// a server admin using the given device, rather than with the admin token.
+func WithAdminDevice(req *http.Request, device *userapi.Device) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), adminDeviceContextKey{}, device))
+}
+
+// AdminDevice returns the device of the server admin who made the request, or
+// nil if the request wasn't made by a server admin.
+func AdminDevice(req *http.Request) *userapi.Device {
+	device, _ := req.Context().Value(adminDeviceContextKey{}).(*userapi.Device)
+	return device
+}
+
+// VerifyAdminToken checks that the request carries the given admin token, or
+// was made by a server admin. On failure it returns a JSON error response
+// which can be sent to the client.
+func VerifyAdminToken(req *http.Request, adminToken string) *util.JSONResponse {
+	if adminToken == "" {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The admin API is disabled"),
+		}
+	}
+	if AdminDevice(req) != nil {
+		return nil
+	}
+	token, err := auth.ExtractAccessToken(req)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid admin token"),
+		}
+	}
+	return nil
+}
+
+// panicResponse logs a panic which happened while handling the request, along
+// with the stack trace, and returns the error to send to the client. This
+// includes the request ID so that the error can be matched to the log entry.
+func panicResponse(req *http.Request, r interface{}) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	logger.WithField("panic", r).Errorf("Request panicked!\n%s", debug.Stack())
+	msg := "Internal Server Error"
+	if reqID, ok := logger.Data["req.id"].(string); ok && reqID != "" {
+		msg = fmt.Sprintf("Internal Server Error (request ID %s)", reqID)
+	}
+	return util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: jsonerror.Unknown(msg),
+	}
+}
+
 // MakeExternalAPI turns a util.JSONRequestHandler function into an http.Handler.
 // This is used for APIs that are called from the internet.
 func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
@@ -74,7 +153,14 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) (res util.JSONResponse) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = panicResponse(req, r)
+			}
+		}()
+		return f(req)
+	}))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
 		nextWriter := w
 		if verbose {
@@ -186,6 +272,7 @@ func MakeFedAPI(
 	serverName gomatrixserverlib.ServerName,
 	keyRing gomatrixserverlib.JSONVerifier,
 	wakeup *FederationWakeups,
+	limiter *FederationInboundLimiter,
 	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
@@ -195,6 +282,15 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		// Only apply the concurrency limits once the request has been verified,
+		// so that unauthenticated requests can't use up another server's slots.
+		if err := limiter.Acquire(fedReq.Origin()); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(err.Error(), 1000),
+			}
+		}
+		defer limiter.Release(fedReq.Origin())
 		go wakeup.Wakeup(req.Context(), fedReq.Origin())
 		vars, err := URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
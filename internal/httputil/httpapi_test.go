@@ -18,6 +18,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/matrix-org/util"
 )
 
 func TestWrapHandlerInBasicAuth(t *testing.T) {
@@ -107,3 +109,39 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeAdminAPI(t *testing.T) {
+	dummyHandler := func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+
+	tests := []struct {
+		name       string
+		adminToken string
+		reqToken   string
+		want       int
+	}{
+		{name: "admin API disabled", adminToken: "", reqToken: "secret", want: http.StatusForbidden},
+		{name: "missing token", adminToken: "secret", reqToken: "", want: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "secret", reqToken: "wrong", want: http.StatusForbidden},
+		{name: "correct token", adminToken: "secret", reqToken: "secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := MakeAdminAPI("test", tt.adminToken, dummyHandler)
+
+			req := httptest.NewRequest("GET", "http://localhost/_dendrite/admin/v1/test", nil)
+			if tt.reqToken != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.reqToken)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			resp := w.Result()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("Expected status code %d, got %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -20,4 +20,6 @@ const (
 	PublicKeyPathPrefix        = "/_matrix/key/"
 	PublicMediaPathPrefix      = "/_matrix/media/"
 	InternalPathPrefix         = "/api/"
+	DendriteAdminPathPrefix    = "/_dendrite/admin/"
+	DendriteVersionPath        = "/_dendrite/version"
 )
@@ -15,7 +15,10 @@
 package httputil
 
 import (
+	"fmt"
 	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 )
 
 // URLDecodeMapValues is a function that iterates through each of the items in a
@@ -26,7 +29,7 @@ func URLDecodeMapValues(vmap map[string]string) (map[string]string, error) {
 	for key, value := range vmap {
 		decodedVal, err := url.PathUnescape(value)
 		if err != nil {
-			return make(map[string]string), err
+			return make(map[string]string), jsonerror.InvalidArgumentValue(fmt.Sprintf("Invalid URL encoding of %s: %s", key, err))
 		}
 		decoded[key] = decodedVal
 	}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -32,6 +33,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const timestampFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
 type utcFormatter struct {
 	logrus.Formatter
 }
@@ -62,6 +65,72 @@ func (h *logLevelHook) Levels() []logrus.Level {
 	return levels
 }
 
+// writerHook is a logrus hook which writes log entries to a writer.
+type writerHook struct {
+	writer    io.Writer
+	formatter logrus.Formatter
+}
+
+// Levels returns all the levels, as filtering is done by logLevelHook.
+func (h *writerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire formats the log entry and writes it.
+func (h *writerHook) Fire(entry *logrus.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.writer.Write(b)
+	return err
+}
+
+// discardFormatter formats every log entry as nothing. It is used once the
+// logs are written by hooks, so that logrus doesn't format them again only to
+// throw them away.
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// logFormatter returns the formatter for logs in the given format, "text" or
+// "json". Text logs written to files don't have colours, or the caller on a
+// separate line.
+func logFormatter(format string, toFile bool) logrus.Formatter {
+	switch {
+	case format == "json":
+		return &utcFormatter{
+			&logrus.JSONFormatter{
+				TimestampFormat:  timestampFormat,
+				CallerPrettyfier: jsonCallerPrettyfier,
+			},
+		}
+	case toFile:
+		return &utcFormatter{
+			&logrus.TextFormatter{
+				TimestampFormat:  timestampFormat,
+				DisableColors:    true,
+				DisableTimestamp: false,
+				DisableSorting:   false,
+				QuoteEmptyFields: true,
+			},
+		}
+	default:
+		return &utcFormatter{
+			&logrus.TextFormatter{
+				TimestampFormat:  timestampFormat,
+				FullTimestamp:    true,
+				DisableColors:    false,
+				DisableTimestamp: false,
+				QuoteEmptyFields: true,
+				CallerPrettyfier: callerPrettyfier,
+			},
+		}
+	}
+}
+
 // callerPrettyfier is a function that given a runtime.Frame object, will
 // extract the calling function's name and file, and return them in a nicely
 // formatted way
@@ -80,6 +149,13 @@ func callerPrettyfier(f *runtime.Frame) (string, string) {
 	return funcname, filename
 }
 
+// jsonCallerPrettyfier is like callerPrettyfier, but keeps the function name
+// and file on one line each, since they are separate fields in JSON logs.
+func jsonCallerPrettyfier(f *runtime.Frame) (string, string) {
+	s := strings.Split(f.Function, ".")
+	return s[len(s)-1], fmt.Sprintf("%s:%d", f.File, f.Line)
+}
+
 // SetupPprof starts a pprof listener. We use the DefaultServeMux here because it is
 // simplest, and it gives us the freedom to run pprof on a separate port.
 func SetupPprof() {
@@ -94,24 +170,37 @@ func SetupPprof() {
 // SetupStdLogging configures the logging format to standard output. Typically, it is called when the config is not yet loaded.
 func SetupStdLogging() {
 	logrus.SetReportCaller(true)
-	logrus.SetFormatter(&utcFormatter{
-		&logrus.TextFormatter{
-			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
-			FullTimestamp:    true,
-			DisableColors:    false,
-			DisableTimestamp: false,
-			QuoteEmptyFields: true,
-			CallerPrettyfier: callerPrettyfier,
-		},
-	})
+	logrus.SetFormatter(logFormatter("text", false))
 }
 
-// SetupHookLogging configures the logging hooks defined in the configuration.
-// If something fails here it means that the logging was improperly configured,
-// so we just exit with the error
-func SetupHookLogging(hooks []config.LogrusHook, componentName string) {
+// SetupHookLogging configures the log format and levels, and the logging hooks,
+// defined in the configuration. If something fails here it means that the
+// logging was improperly configured, so we just exit with the error
+func SetupHookLogging(logging config.Logging, componentName string) {
 	logrus.SetReportCaller(true)
-	for _, hook := range hooks {
+
+	// Logs are written to the output of logrus (stderr unless something else
+	// was set) by a hook, rather than by logrus itself, so that they can be
+	// filtered by a different level from the other hooks.
+	outputLevel, err := logrus.ParseLevel(logging.LevelFor(componentName))
+	if err != nil {
+		logrus.Fatalf("Unrecognised logging level %s: %q", logging.LevelFor(componentName), err)
+	}
+	output := logrus.StandardLogger().Out
+	if output == ioutil.Discard {
+		// Logging has been set up already, e.g. by another component in
+		// the same process.
+		return
+	}
+	logrus.SetLevel(outputLevel)
+	logrus.SetFormatter(discardFormatter{})
+	logrus.SetOutput(ioutil.Discard)
+	logrus.AddHook(&logLevelHook{
+		outputLevel,
+		&writerHook{output, logFormatter(logging.Format, false)},
+	})
+
+	for _, hook := range logging.Hooks {
 		// Check we received a proper logging level
 		level, err := logrus.ParseLevel(hook.Level)
 		if err != nil {
@@ -127,7 +216,7 @@ func SetupHookLogging(hooks []config.LogrusHook, componentName string) {
 		switch hook.Type {
 		case "file":
 			checkFileHookParams(hook.Params)
-			setupFileHook(hook, level, componentName)
+			setupFileHook(hook, level, componentName, logging.Format)
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
 		}
@@ -147,7 +236,7 @@ func checkFileHookParams(params map[string]interface{}) {
 }
 
 // Add a new FSHook to the logger. Each component will log in its own file
-func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName string) {
+func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName, format string) {
 	dirPath := (hook.Params["path"]).(string)
 	fullPath := filepath.Join(dirPath, componentName+".log")
 
@@ -159,15 +248,7 @@ func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName str
 		level,
 		dugong.NewFSHook(
 			fullPath,
-			&utcFormatter{
-				&logrus.TextFormatter{
-					TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
-					DisableColors:    true,
-					DisableTimestamp: false,
-					DisableSorting:   false,
-					QuoteEmptyFields: true,
-				},
-			},
+			logFormatter(format, true),
 			&dugong.DailyRotationSchedule{GZip: true},
 		),
 	})
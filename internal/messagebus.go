@@ -0,0 +1,128 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// A MessageBus carries messages between components. Messages are published
+// to topics, and each component subscribing to a topic gets every message
+// in it, in order, once.
+type MessageBus interface {
+	// Publish publishes a message to a topic. Messages with the same key
+	// are always consumed in the order that they were published. Returns
+	// where the message was stored.
+	Publish(topic string, key, value []byte) (partition int32, offset int64, err error)
+	// Subscribe starts consuming a topic. Where the component has reached
+	// in the topic is stored using the PartitionStore of the subscription,
+	// so that consuming resumes from there after a restart.
+	Subscribe(sub Subscription) (Subscriber, error)
+}
+
+// A Subscription describes what a component wants to consume from a
+// MessageBus.
+type Subscription struct {
+	// The name of the component, used for logging and consumer groups.
+	ComponentName string
+	// The topic to consume.
+	Topic string
+	// Where the offsets that the component has reached are stored.
+	PartitionStore PartitionStorer
+	// StartFromNewest starts consuming at the end of the topic the first
+	// time, rather than at the beginning. See ContinualConsumer.StartFromNewest.
+	StartFromNewest bool
+	// Process is called for each message in the topic, in order. See
+	// ContinualConsumer.ProcessMessage for what errors mean.
+	Process func(msg *Message) error
+	// ResetCallback is called by Subscriber.Reset before the topic is
+	// consumed again. See ContinualConsumer.ResetCallback. It is optional.
+	ResetCallback func(ctx context.Context) error
+}
+
+// A Subscriber is a running Subscription.
+type Subscriber interface {
+	// Stop stops consuming, once the message being processed has finished.
+	Stop()
+	// Reset forgets the offsets that the component has reached and consumes
+	// the topic again from the start. See ContinualConsumer.Reset.
+	Reset() error
+}
+
+// A Message is a message consumed from a MessageBus.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// SaramaMessageBus is a MessageBus made from sarama consumers and a producer,
+// which Kafka, naffka and NATS all provide.
+type SaramaMessageBus struct {
+	newConsumer func() sarama.Consumer
+	producer    sarama.SyncProducer
+}
+
+// NewSaramaMessageBus makes a MessageBus from a sarama producer, and a function
+// which returns the sarama consumer for each subscription. A Kafka consumer
+// can only consume a partition once, so if more than one component subscribes
+// to the same topic then they need consumers of their own.
+func NewSaramaMessageBus(newConsumer func() sarama.Consumer, producer sarama.SyncProducer) *SaramaMessageBus {
+	return &SaramaMessageBus{newConsumer, producer}
+}
+
+// Publish implements MessageBus
+func (b *SaramaMessageBus) Publish(topic string, key, value []byte) (int32, int64, error) {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	return b.producer.SendMessage(msg)
+}
+
+// Subscribe implements MessageBus
+func (b *SaramaMessageBus) Subscribe(sub Subscription) (Subscriber, error) {
+	c := &ContinualConsumer{
+		ComponentName:   sub.ComponentName,
+		Topic:           sub.Topic,
+		Consumer:        b.newConsumer(),
+		PartitionStore:  sub.PartitionStore,
+		StartFromNewest: sub.StartFromNewest,
+		ResetCallback:   sub.ResetCallback,
+		ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+			return sub.Process(&Message{
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				Key:       msg.Key,
+				Value:     msg.Value,
+				Timestamp: msg.Timestamp,
+			})
+		},
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
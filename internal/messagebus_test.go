@@ -0,0 +1,125 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type recordingProducer struct {
+	sent []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent) - 1), nil
+}
+
+func (p *recordingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.sent = append(p.sent, msgs...)
+	return nil
+}
+
+func (p *recordingProducer) Close() error {
+	return nil
+}
+
+func TestSaramaMessageBusPublish(t *testing.T) {
+	producer := &recordingProducer{}
+	bus := NewSaramaMessageBus(nil, producer)
+
+	if _, offset, err := bus.Publish("topic", []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	} else if offset != 0 {
+		t.Fatalf("got offset %d, want 0", offset)
+	}
+	if _, _, err := bus.Publish("topic", nil, []byte("unkeyed")); err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+
+	if len(producer.sent) != 2 {
+		t.Fatalf("got %d messages, want 2", len(producer.sent))
+	}
+	keyed, unkeyed := producer.sent[0], producer.sent[1]
+	if keyed.Topic != "topic" {
+		t.Errorf("got topic %q, want %q", keyed.Topic, "topic")
+	}
+	if key, _ := keyed.Key.Encode(); string(key) != "key" {
+		t.Errorf("got key %q, want %q", key, "key")
+	}
+	if value, _ := keyed.Value.Encode(); string(value) != "value" {
+		t.Errorf("got value %q, want %q", value, "value")
+	}
+	// A nil key must stay nil, so that Kafka picks the partition at random
+	// rather than sending every unkeyed message to the same one.
+	if unkeyed.Key != nil {
+		t.Errorf("got key %v for unkeyed message, want nil", unkeyed.Key)
+	}
+}
+
+func TestSaramaMessageBusSubscribe(t *testing.T) {
+	consumers := 0
+	bus := NewSaramaMessageBus(func() sarama.Consumer {
+		consumers++
+		return &fakeConsumer{values: []string{"a", "b", "c"}}
+	}, nil)
+
+	processed := make(chan string, 10)
+	all, err := bus.Subscribe(Subscription{
+		ComponentName:  "all",
+		Topic:          testTopic,
+		PartitionStore: &fakePartitionStore{offsets: map[int32]int64{}},
+		Process: func(msg *Message) error {
+			processed <- string(msg.Value)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer all.Stop()
+	newest, err := bus.Subscribe(Subscription{
+		ComponentName:   "newest",
+		Topic:           testTopic,
+		PartitionStore:  &fakePartitionStore{offsets: map[int32]int64{}},
+		StartFromNewest: true,
+		Process: func(msg *Message) error {
+			processed <- "newest:" + string(msg.Value)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer newest.Stop()
+
+	// Each subscription to the topic gets a consumer of its own.
+	if consumers != 2 {
+		t.Errorf("got %d consumers, want 2", consumers)
+	}
+	want := []string{"a", "b", "c"}
+	if got := waitForMessages(t, processed, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %v, want %v", got, want)
+	}
+	select {
+	case value := <-processed:
+		t.Errorf("got unexpected message %q", value)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import "sync"
+
+// MaxOriginLabels is the most distinct server names that OriginLabel will
+// return as metric label values.
+const MaxOriginLabels = 100
+
+// OtherOriginLabel is the label value used for servers beyond the first
+// MaxOriginLabels.
+const OtherOriginLabel = "other"
+
+var originLabels = struct {
+	sync.Mutex
+	seen map[string]struct{}
+}{seen: make(map[string]struct{})}
+
+// OriginLabel returns the metric label value to use for a remote server. The
+// first MaxOriginLabels servers seen are labelled with their server name and
+// any others with OtherOriginLabel, so that a flood of federation traffic from
+// new servers can't create an unbounded number of time series.
+func OriginLabel(origin string) string {
+	originLabels.Lock()
+	defer originLabels.Unlock()
+	if _, ok := originLabels.seen[origin]; ok {
+		return origin
+	}
+	if len(originLabels.seen) >= MaxOriginLabels {
+		return OtherOriginLabel
+	}
+	originLabels.seen[origin] = struct{}{}
+	return origin
+}
@@ -15,15 +15,23 @@
 package setup
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/setup/kafka"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -33,6 +41,7 @@ import (
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	asinthttp "github.com/matrix-org/dendrite/appservice/inthttp"
+	clientapiRouting "github.com/matrix-org/dendrite/clientapi/routing"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	eduinthttp "github.com/matrix-org/dendrite/eduserver/inthttp"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
@@ -64,18 +73,34 @@ type BaseDendrite struct {
 	PublicKeyAPIMux        *mux.Router
 	PublicMediaAPIMux      *mux.Router
 	InternalAPIMux         *mux.Router
+	DendriteAdminMux       *mux.Router
 	UseHTTPAPIs            bool
 	apiHttpClient          *http.Client
 	httpClient             *http.Client
 	Cfg                    *config.Dendrite
 	Caches                 *caching.Caches
-	//	KafkaConsumer          sarama.Consumer
-	//	KafkaProducer          sarama.SyncProducer
+	// Shutdown runs the shutdown hooks of each component, in order, once
+	// the process is asked to stop.
+	Shutdown *internal.ShutdownCoordinator
+
+	messageBusOnce sync.Once
+	messageBus     internal.MessageBus
+
+	adminAuditOnce sync.Once
+	adminAudit     mux.MiddlewareFunc
 }
 
 const HTTPServerTimeout = time.Minute * 5
+
+// HTTPSyncGracePeriod is the time allowed on top of the maximum /sync
+// long-poll timeout for the sync response to be built and written.
+const HTTPSyncGracePeriod = time.Minute
 const HTTPClientTimeout = time.Second * 30
 
+// ShutdownTimeout is how long shutting down can take before giving up on
+// anything still running.
+const ShutdownTimeout = time.Second * 30
+
 const NoListener = ""
 
 // NewBaseDendrite creates a new instance to be used by a component.
@@ -94,8 +119,13 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 	internal.SetupStdLogging()
 	internal.SetupHookLogging(cfg.Logging, componentName)
 	internal.SetupPprof()
+	go sqlutil.CollectDatabaseStats()
 
-	logrus.Infof("Dendrite version %s", internal.VersionString())
+	buildInfo := internal.GetBuildInfo()
+	logrus.WithFields(logrus.Fields{
+		"commit":     buildInfo.Commit,
+		"go_version": buildInfo.GoVersion,
+	}).Infof("Dendrite version %s", buildInfo.Version)
 
 	closer, err := cfg.SetupTracing("Dendrite" + componentName)
 	if err != nil {
@@ -127,20 +157,33 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, useHTTPAPIs boo
 	// We need to be careful with media APIs if they read from a filesystem to make sure they
 	// are not inadvertently reading paths without cleaning, else this could introduce a
 	// directory traversal attack e.g /../../../etc/passwd
-	return &BaseDendrite{
+	publicClientAPIMux := mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath()
+	publicClientAPIMux.Use(httputil.RequestBodyLimitMiddleware(
+		cfg.ClientAPI.RequestBodyLimits.Default, cfg.ClientAPI.RequestBodyLimits.Endpoints,
+	))
+	shutdown := internal.NewShutdownCoordinator(componentName)
+	shutdown.Register(internal.ShutdownStageConsumers, "Kafka consumers", internal.StopConsumers)
+	shutdown.Register(internal.ShutdownStageProducers, "Kafka producers", kafka.Close)
+	shutdown.Register(internal.ShutdownStageDatabases, "databases", sqlutil.CloseDatabases)
+
+	b := &BaseDendrite{
 		componentName:          componentName,
+		Shutdown:               shutdown,
 		UseHTTPAPIs:            useHTTPAPIs,
 		tracerCloser:           closer,
 		Cfg:                    cfg,
 		Caches:                 cache,
-		PublicClientAPIMux:     mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath(),
+		PublicClientAPIMux:     publicClientAPIMux,
 		PublicFederationAPIMux: mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
 		PublicKeyAPIMux:        mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicKeyPathPrefix).Subrouter().UseEncodedPath(),
 		PublicMediaAPIMux:      mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicMediaPathPrefix).Subrouter().UseEncodedPath(),
 		InternalAPIMux:         mux.NewRouter().SkipClean(true).PathPrefix(httputil.InternalPathPrefix).Subrouter().UseEncodedPath(),
+		DendriteAdminMux:       mux.NewRouter().SkipClean(true).PathPrefix(httputil.DendriteAdminPathPrefix).Subrouter().UseEncodedPath(),
 		apiHttpClient:          &apiClient,
 		httpClient:             &client,
 	}
+	b.DendriteAdminMux.Use(b.adminAuditMiddleware)
+	return b
 }
 
 // Close implements io.Closer
@@ -148,6 +191,42 @@ func (b *BaseDendrite) Close() error {
 	return b.tracerCloser.Close()
 }
 
+// WaitForShutdown blocks until the process is asked to stop with SIGINT or
+// SIGTERM, and then shuts everything down.
+func (b *BaseDendrite) WaitForShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+	logrus.WithField("signal", sig.String()).Infof("Stopping %s", b.componentName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	b.Shutdown.Shutdown(ctx)
+}
+
+// registerHTTPServerShutdown stops the server accepting new requests when
+// shutting down, and later waits for the requests in flight to finish.
+func (b *BaseDendrite) registerHTTPServerShutdown(serv *http.Server) {
+	shutdownErr := make(chan error, 1)
+	b.Shutdown.Register(internal.ShutdownStageHTTP, "HTTP listener on "+serv.Addr, func(ctx context.Context) error {
+		// The listeners are closed straight away, but Shutdown only returns
+		// once the requests in flight have finished.
+		go func() {
+			shutdownErr <- serv.Shutdown(ctx)
+		}()
+		return nil
+	})
+	b.Shutdown.Register(internal.ShutdownStageRequests, "HTTP requests on "+serv.Addr, func(ctx context.Context) error {
+		select {
+		case err := <-shutdownErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
 // AppserviceHTTPClient returns the AppServiceQueryAPI for hitting the appservice component over HTTP.
 func (b *BaseDendrite) AppserviceHTTPClient() appserviceAPI.AppServiceQueryAPI {
 	a, err := asinthttp.NewAppserviceClient(b.Cfg.AppServiceURL(), b.apiHttpClient)
@@ -227,13 +306,43 @@ func (b *BaseDendrite) CreateAccountsDB() accounts.Database {
 	return db
 }
 
+// SetupAdminAudit sets the accounts database and user API which are used to
+// authorise and record requests to the admin API. Components which run the
+// user API in-process must call this before serving HTTP. Otherwise, the
+// accounts database is opened and the user API is reached over HTTP once the
+// first admin request arrives.
+func (b *BaseDendrite) SetupAdminAudit(accountDB accounts.Database, userAPI userapi.UserInternalAPI) {
+	b.adminAuditOnce.Do(func() {
+		b.adminAudit = clientapiRouting.AdminAuditMiddleware(&b.Cfg.ClientAPI, accountDB, userAPI)
+	})
+}
+
+// adminAuditMiddleware rate limits, authorises and records in the admin audit
+// log every request to the admin API, whichever component the route belongs to.
+func (b *BaseDendrite) adminAuditMiddleware(next http.Handler) http.Handler {
+	b.adminAuditOnce.Do(func() {
+		b.adminAudit = clientapiRouting.AdminAuditMiddleware(&b.Cfg.ClientAPI, b.CreateAccountsDB(), b.UserAPIClient())
+	})
+	return b.adminAudit(next)
+}
+
+// MessageBus returns the message bus for the configured provider, setting
+// it up the first time it is called. Every component in the process shares
+// the same message bus.
+func (b *BaseDendrite) MessageBus() internal.MessageBus {
+	b.messageBusOnce.Do(func() {
+		b.messageBus = kafka.SetupMessageBus(&b.Cfg.Global.Kafka)
+	})
+	return b.messageBus
+}
+
 // CreateClient creates a new client (normally used for media fetch requests).
 // Should only be called once per component.
 func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
 	client := gomatrixserverlib.NewClient(
 		b.Cfg.FederationSender.DisableTLSValidation,
 	)
-	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
+	client.SetUserAgent(b.federationUserAgent())
 	return client
 }
 
@@ -242,14 +351,24 @@ func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
 	client := gomatrixserverlib.NewFederationClientWithTimeout(
 		b.Cfg.Global.ServerName, b.Cfg.Global.KeyID, b.Cfg.Global.PrivateKey,
-		b.Cfg.FederationSender.DisableTLSValidation, time.Minute*5,
+		b.Cfg.FederationSender.DisableTLSValidation, b.Cfg.FederationSender.RequestTimeout,
 	)
-	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
+	client.SetUserAgent(b.federationUserAgent())
 	return client
 }
 
+// federationUserAgent returns the User-Agent header to send with requests to
+// other servers.
+func (b *BaseDendrite) federationUserAgent() string {
+	if b.Cfg.FederationSender.UserAgent != "" {
+		return b.Cfg.FederationSender.UserAgent
+	}
+	return fmt.Sprintf("Dendrite/%s", internal.VersionString())
+}
+
 // SetupAndServeHTTP sets up the HTTP server to serve endpoints registered on
-// ApiMux under /api/ and adds a prometheus handler under /metrics.
+// ApiMux under /api/ and adds a prometheus handler under /metrics. It blocks
+// until the process has been asked to stop and has shut down.
 // nolint:gocyclo
 func (b *BaseDendrite) SetupAndServeHTTP(
 	internalHTTPAddr, externalHTTPAddr config.HTTPAddress,
@@ -261,9 +380,16 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	externalRouter := mux.NewRouter().SkipClean(true).UseEncodedPath()
 	internalRouter := externalRouter
 
+	// /sync requests are long-polls which are clamped by the sync API, so
+	// make sure that the server write timeout never cuts them short.
+	writeTimeout := HTTPServerTimeout
+	if syncTimeout := b.Cfg.SyncAPI.MaxSyncTimeout + HTTPSyncGracePeriod; syncTimeout > writeTimeout {
+		writeTimeout = syncTimeout
+	}
+
 	externalServ := &http.Server{
 		Addr:         string(externalAddr),
-		WriteTimeout: HTTPServerTimeout,
+		WriteTimeout: writeTimeout,
 		Handler:      externalRouter,
 	}
 	internalServ := externalServ
@@ -281,20 +407,31 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		internalRouter.Handle("/metrics", httputil.WrapHandlerInBasicAuth(promhttp.Handler(), b.Cfg.Global.Metrics.BasicAuth))
 	}
 
+	externalRouter.Use(httputil.ClientIPMiddleware(b.Cfg.HTTPServer.TrustedProxies))
 	externalRouter.PathPrefix(httputil.PublicClientPathPrefix).Handler(b.PublicClientAPIMux)
 	externalRouter.PathPrefix(httputil.PublicKeyPathPrefix).Handler(b.PublicKeyAPIMux)
 	externalRouter.PathPrefix(httputil.PublicFederationPathPrefix).Handler(b.PublicFederationAPIMux)
 	externalRouter.PathPrefix(httputil.PublicMediaPathPrefix).Handler(b.PublicMediaAPIMux)
+	externalRouter.PathPrefix(httputil.DendriteAdminPathPrefix).Handler(b.DendriteAdminMux)
+	externalRouter.Handle(httputil.DendriteVersionPath, httputil.MakeExternalAPI("version",
+		func(req *http.Request) util.JSONResponse {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: internal.GetBuildInfo(),
+			}
+		},
+	)).Methods(http.MethodGet)
 
 	if internalAddr != NoListener && internalAddr != externalAddr {
+		b.registerHTTPServerShutdown(internalServ)
 		go func() {
 			logrus.Infof("Starting internal %s listener on %s", b.componentName, internalServ.Addr)
 			if certFile != nil && keyFile != nil {
-				if err := internalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+				if err := internalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil && err != http.ErrServerClosed {
 					logrus.WithError(err).Fatal("failed to serve HTTPS")
 				}
 			} else {
-				if err := internalServ.ListenAndServe(); err != nil {
+				if err := internalServ.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 					logrus.WithError(err).Fatal("failed to serve HTTP")
 				}
 			}
@@ -303,14 +440,15 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 	}
 
 	if externalAddr != NoListener {
+		b.registerHTTPServerShutdown(externalServ)
 		go func() {
 			logrus.Infof("Starting external %s listener on %s", b.componentName, externalServ.Addr)
 			if certFile != nil && keyFile != nil {
-				if err := externalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+				if err := externalServ.ListenAndServeTLS(*certFile, *keyFile); err != nil && err != http.ErrServerClosed {
 					logrus.WithError(err).Fatal("failed to serve HTTPS")
 				}
 			} else {
-				if err := externalServ.ListenAndServe(); err != nil {
+				if err := externalServ.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 					logrus.WithError(err).Fatal("failed to serve HTTP")
 				}
 			}
@@ -318,5 +456,5 @@ func (b *BaseDendrite) SetupAndServeHTTP(
 		}()
 	}
 
-	select {}
+	b.WaitForShutdown()
 }
@@ -1,33 +1,98 @@
 package kafka
 
 import (
+	"context"
+	"encoding/json"
+	"sync"
+
 	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/naffka"
 	naffkaStorage "github.com/matrix-org/naffka/storage"
 	"github.com/sirupsen/logrus"
 )
 
+// SetupMessageBus creates a message bus for the configured provider.
+func SetupMessageBus(cfg *config.Kafka) internal.MessageBus {
+	if cfg.ProviderName() != config.ProviderKafka {
+		// Naffka and NATS can consume the same partition more than once,
+		// so every subscription shares the one consumer.
+		consumer, producer := SetupConsumerProducer(cfg)
+		return internal.NewSaramaMessageBus(func() sarama.Consumer { return consumer }, producer)
+	}
+	producer := setupKafkaProducer(cfg)
+	return internal.NewSaramaMessageBus(func() sarama.Consumer {
+		return &wrappedConsumer{setupKafkaConsumer(cfg), producer, cfg}
+	}, producer)
+}
+
+// SetupConsumerProducer creates a consumer/producer pair for the configured
+// provider. New code should use SetupMessageBus instead.
 func SetupConsumerProducer(cfg *config.Kafka) (sarama.Consumer, sarama.SyncProducer) {
-	if cfg.UseNaffka {
-		return setupNaffka(cfg)
+	var consumer sarama.Consumer
+	var producer sarama.SyncProducer
+	switch cfg.ProviderName() {
+	case config.ProviderNaffka:
+		consumer, producer = setupNaffka(cfg)
+	case config.ProviderNATS:
+		consumer, producer = setupNATS(cfg)
+	default:
+		producer = setupKafkaProducer(cfg)
+		consumer = setupKafkaConsumer(cfg)
+	}
+	return &wrappedConsumer{consumer, producer, cfg}, producer
+}
+
+// opened holds the Kafka producers and consumers, or the Naffka or NATS instance, so
+// that they can be closed when shutting down. Each producer comes before the
+// consumers set up with it, so that any messages it is still sending get
+// flushed first.
+var opened struct {
+	sync.Mutex
+	closers []interface{ Close() error }
+}
+
+// Close closes every producer and consumer made by SetupConsumerProducer.
+// The ContinualConsumers using them should have been stopped first.
+func Close(ctx context.Context) error {
+	opened.Lock()
+	defer opened.Unlock()
+	for len(opened.closers) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		closer := opened.closers[0]
+		opened.closers = opened.closers[1:]
+		if err := closer.Close(); err != nil {
+			return err
+		}
 	}
-	return setupKafka(cfg)
+	return nil
 }
 
-// setupKafka creates kafka consumer/producer pair from the config.
-func setupKafka(cfg *config.Kafka) (sarama.Consumer, sarama.SyncProducer) {
+// setupKafkaConsumer creates a kafka consumer from the config.
+func setupKafkaConsumer(cfg *config.Kafka) sarama.Consumer {
 	consumer, err := sarama.NewConsumer(cfg.Addresses, nil)
 	if err != nil {
 		logrus.WithError(err).Panic("failed to start kafka consumer")
 	}
+	opened.Lock()
+	opened.closers = append(opened.closers, consumer)
+	opened.Unlock()
+	return consumer
+}
 
+// setupKafkaProducer creates a kafka producer from the config.
+func setupKafkaProducer(cfg *config.Kafka) sarama.SyncProducer {
 	producer, err := sarama.NewSyncProducer(cfg.Addresses, nil)
 	if err != nil {
 		logrus.WithError(err).Panic("failed to setup kafka producers")
 	}
-
-	return consumer, producer
+	opened.Lock()
+	opened.closers = append(opened.closers, producer)
+	opened.Unlock()
+	return producer
 }
 
 // In monolith mode with Naffka, we don't have the same constraints about
@@ -41,13 +106,88 @@ func setupNaffka(cfg *config.Kafka) (sarama.Consumer, sarama.SyncProducer) {
 	if naffkaInstance != nil {
 		return naffkaInstance, naffkaInstance
 	}
-	naffkaDB, err := naffkaStorage.NewDatabase(string(cfg.Database.ConnectionString))
-	if err != nil {
-		logrus.WithError(err).Panic("Failed to setup naffka database")
+	var naffkaDB naffka.Database
+	var err error
+	if cfg.NaffkaInMemory {
+		logrus.Warn("Using in-memory naffka, messages will be lost on restart")
+		naffkaDB = newMemoryDatabase(MemoryDatabaseMaxMessages)
+	} else {
+		// The naffka storage picks the SQLite or PostgreSQL backend based on the
+		// scheme of the connection string.
+		backend := "PostgreSQL"
+		if cfg.Database.ConnectionString.IsSQLite() {
+			backend = "SQLite"
+		}
+		logrus.Infof("Using %s backend for naffka", backend)
+		naffkaDB, err = naffkaStorage.NewDatabase(string(cfg.Database.ConnectionString))
+		if err != nil {
+			logrus.WithError(err).Panic("Failed to setup naffka database")
+		}
 	}
 	naffkaInstance, err = naffka.New(naffkaDB)
 	if err != nil {
 		logrus.WithError(err).Panic("Failed to setup naffka")
 	}
+	opened.Lock()
+	opened.closers = append(opened.closers, naffkaInstance)
+	opened.Unlock()
 	return naffkaInstance, naffkaInstance
 }
+
+// wrappedConsumer is a kafka consumer which can also join consumer groups,
+// look up the oldest offsets of partitions and publish dead letters,
+// implementing internal.ConsumerGroupProvider, internal.OldestOffsetProvider
+// and internal.DeadLetterPublisher.
+type wrappedConsumer struct {
+	sarama.Consumer
+	producer sarama.SyncProducer
+	cfg      *config.Kafka
+}
+
+// ConsumerGroup joins the consumer group for the given component, or returns
+// nil if consumer groups aren't configured. Offsets are committed explicitly
+// once messages have been processed, so automatic committing is disabled.
+func (c *wrappedConsumer) ConsumerGroup(componentName string, initialOffset int64) (sarama.ConsumerGroup, error) {
+	if c.cfg.ProviderName() != config.ProviderKafka || c.cfg.ConsumerGroupPrefix == "" {
+		return nil, nil
+	}
+	sc := sarama.NewConfig()
+	sc.Version = sarama.V1_0_0_0
+	sc.Consumer.Offsets.Initial = initialOffset
+	sc.Consumer.Offsets.AutoCommit.Enable = false
+	return sarama.NewConsumerGroup(c.cfg.Addresses, c.cfg.ConsumerGroupFor(componentName), sc)
+}
+
+// OldestOffset implements internal.OldestOffsetProvider
+func (c *wrappedConsumer) OldestOffset(topic string, partition int32) (int64, error) {
+	sc := sarama.NewConfig()
+	sc.Version = sarama.V1_0_0_0
+	client, err := sarama.NewClient(c.cfg.Addresses, sc)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close() // nolint: errcheck
+	return client.GetOffset(topic, partition, sarama.OffsetOldest)
+}
+
+// MaxProcessingRetries implements internal.DeadLetterPublisher
+func (c *wrappedConsumer) MaxProcessingRetries() int {
+	return c.cfg.MaxProcessingRetries
+}
+
+// PublishDeadLetter implements internal.DeadLetterPublisher
+func (c *wrappedConsumer) PublishDeadLetter(letter *internal.DeadLetter) error {
+	if c.cfg.DeadLetterTopic == "" {
+		return nil
+	}
+	value, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: c.cfg.TopicFor(c.cfg.DeadLetterTopic),
+		Key:   sarama.ByteEncoder(letter.Key),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
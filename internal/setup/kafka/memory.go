@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/naffka"
+)
+
+// MemoryDatabaseMaxMessages is the number of messages kept per topic by the
+// in-memory naffka database. Older messages are discarded.
+const MemoryDatabaseMaxMessages = 10000
+
+// memoryDatabase is a naffka.Database which keeps messages in memory, in a
+// bounded ring buffer per topic. Messages are lost on restart, and consumers
+// which fall too far behind will skip the messages that have been discarded.
+type memoryDatabase struct {
+	maxMessages int
+	topicsMutex sync.Mutex
+	topics      map[string]*memoryTopic
+}
+
+type memoryTopic struct {
+	mutex    sync.Mutex
+	messages []naffka.Message // ring buffer, indexed by offset modulo capacity
+	next     int64            // the offset of the next message to be stored
+}
+
+func newMemoryDatabase(maxMessages int) *memoryDatabase {
+	return &memoryDatabase{
+		maxMessages: maxMessages,
+		topics:      map[string]*memoryTopic{},
+	}
+}
+
+func (m *memoryDatabase) topic(name string) *memoryTopic {
+	m.topicsMutex.Lock()
+	defer m.topicsMutex.Unlock()
+	t, ok := m.topics[name]
+	if !ok {
+		t = &memoryTopic{
+			messages: make([]naffka.Message, m.maxMessages),
+		}
+		m.topics[name] = t
+	}
+	return t
+}
+
+// StoreMessages implements naffka.Database
+func (m *memoryDatabase) StoreMessages(topic string, messages []naffka.Message) error {
+	t := m.topic(topic)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i := range messages {
+		if messages[i].Offset != t.next {
+			return fmt.Errorf("message offset %d is not the next offset %d", messages[i].Offset, t.next)
+		}
+		t.messages[t.next%int64(len(t.messages))] = messages[i]
+		t.next++
+	}
+	return nil
+}
+
+// FetchMessages implements naffka.Database. Returns the messages with offsets
+// from startOffset up to (but not including) endOffset which are still held.
+func (m *memoryDatabase) FetchMessages(topic string, startOffset, endOffset int64) ([]naffka.Message, error) {
+	t := m.topic(topic)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if oldest := t.next - int64(len(t.messages)); startOffset < oldest {
+		startOffset = oldest
+	}
+	if startOffset < 0 {
+		startOffset = 0
+	}
+	if endOffset > t.next {
+		endOffset = t.next
+	}
+	var result []naffka.Message
+	for offset := startOffset; offset < endOffset; offset++ {
+		result = append(result, t.messages[offset%int64(len(t.messages))])
+	}
+	return result, nil
+}
+
+// MaxOffsets implements naffka.Database
+func (m *memoryDatabase) MaxOffsets() (map[string]int64, error) {
+	m.topicsMutex.Lock()
+	defer m.topicsMutex.Unlock()
+	result := map[string]int64{}
+	for name, t := range m.topics {
+		t.mutex.Lock()
+		if t.next > 0 {
+			result[name] = t.next - 1
+		}
+		t.mutex.Unlock()
+	}
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/matrix-org/naffka"
+)
+
+func TestMemoryDatabaseDiscardsOldMessages(t *testing.T) {
+	db := newMemoryDatabase(3)
+	for i := int64(0); i < 5; i++ {
+		if err := db.StoreMessages("topic", []naffka.Message{{Offset: i}}); err != nil {
+			t.Fatalf("StoreMessages: %s", err)
+		}
+	}
+	messages, err := db.FetchMessages("topic", 0, 5)
+	if err != nil {
+		t.Fatalf("FetchMessages: %s", err)
+	}
+	if len(messages) != 3 || messages[0].Offset != 2 || messages[2].Offset != 4 {
+		t.Fatalf("expected offsets 2-4, got %+v", messages)
+	}
+	offsets, err := db.MaxOffsets()
+	if err != nil {
+		t.Fatalf("MaxOffsets: %s", err)
+	}
+	if offsets["topic"] != 4 {
+		t.Fatalf("expected max offset 4, got %d", offsets["topic"])
+	}
+	if err := db.StoreMessages("topic", []naffka.Message{{Offset: 7}}); err == nil {
+		t.Fatalf("expected error storing out-of-order message")
+	}
+}
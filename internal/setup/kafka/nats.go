@@ -0,0 +1,365 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/config"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// natsKeyHeader is the NATS message header which holds the Kafka
+	// message key, since NATS messages don't have keys of their own.
+	natsKeyHeader = "Dendrite-Key"
+	// natsMaxAckPending is the number of messages which NATS will send to a
+	// partition consumer before they have been passed on.
+	natsMaxAckPending = 256
+	// natsAckWait is how long NATS waits for a message to be passed on
+	// before sending it again. Messages which are sent again are skipped.
+	natsAckWait = time.Minute
+)
+
+// natsInstance is shared by every component in the process, like naffka.
+var natsInstance *natsBus
+
+// setupNATS creates a consumer/producer pair backed by NATS JetStream. It
+// connects to the configured NATS servers, or if there are none, starts a
+// NATS server inside this process. Each topic is stored in a stream of the
+// same name, with a single partition whose offsets are the stream sequence
+// numbers minus one.
+func setupNATS(cfg *config.Kafka) (sarama.Consumer, sarama.SyncProducer) {
+	if natsInstance != nil {
+		return natsInstance, natsInstance
+	}
+	natsInstance = newNATSBus(cfg)
+	opened.Lock()
+	opened.closers = append(opened.closers, natsInstance)
+	opened.Unlock()
+	return natsInstance, natsInstance
+}
+
+// newNATSBus connects to NATS, starting a NATS server first if needed.
+func newNATSBus(cfg *config.Kafka) *natsBus {
+	bus := &natsBus{
+		storage:     nats.FileStorage,
+		topicPrefix: cfg.TopicPrefix,
+	}
+	addresses := strings.Join(cfg.NATS.Addresses, ",")
+	if addresses == "" {
+		if cfg.NATS.StoragePath == "" {
+			logrus.Warn("Using in-memory NATS, messages will be lost on restart")
+			bus.storage = nats.MemoryStorage
+		}
+		bus.server = startNATSServer(cfg)
+		addresses = bus.server.ClientURL()
+	}
+	var err error
+	bus.conn, err = nats.Connect(addresses, nats.Name("Dendrite"), nats.MaxReconnects(-1))
+	if err != nil {
+		logrus.WithError(err).Panic("Failed to connect to NATS")
+	}
+	bus.js, err = bus.conn.JetStream()
+	if err != nil {
+		logrus.WithError(err).Panic("Failed to set up NATS JetStream")
+	}
+	return bus
+}
+
+// startNATSServer starts a NATS server with JetStream enabled, which only
+// listens on the loopback interface.
+func startNATSServer(cfg *config.Kafka) *natsserver.Server {
+	s, err := natsserver.NewServer(&natsserver.Options{
+		ServerName: "dendrite",
+		Host:       "127.0.0.1",
+		Port:       natsserver.RANDOM_PORT,
+		JetStream:  true,
+		StoreDir:   string(cfg.NATS.StoragePath),
+		NoSigs:     true,
+		NoLog:      true,
+	})
+	if err != nil {
+		logrus.WithError(err).Panic("Failed to set up NATS server")
+	}
+	go s.Start()
+	if !s.ReadyForConnections(time.Second * 10) {
+		logrus.Panic("NATS server didn't start in time")
+	}
+	logrus.Infof("Started NATS server, storing messages in %q", cfg.NATS.StoragePath)
+	return s
+}
+
+// natsBus implements sarama.Consumer and sarama.SyncProducer on top of NATS
+// JetStream.
+type natsBus struct {
+	server      *natsserver.Server // nil if connected to external NATS servers
+	conn        *nats.Conn
+	js          nats.JetStreamContext
+	storage     nats.StorageType
+	topicPrefix string   // only streams with this prefix are listed by Topics
+	streams     sync.Map // topic -> bool, for the streams known to exist
+}
+
+// ensureStream creates the stream for a topic if it doesn't exist yet.
+func (b *natsBus) ensureStream(topic string) error {
+	if _, ok := b.streams.Load(topic); ok {
+		return nil
+	}
+	if _, err := b.js.StreamInfo(topic); err != nil {
+		streamConfig := &nats.StreamConfig{
+			Name:     topic,
+			Subjects: []string{topic},
+			Storage:  b.storage,
+		}
+		if b.storage == nats.MemoryStorage {
+			streamConfig.MaxMsgs = MemoryDatabaseMaxMessages
+		}
+		if _, err = b.js.AddStream(streamConfig); err != nil {
+			return fmt.Errorf("b.js.AddStream: %w", err)
+		}
+	}
+	b.streams.Store(topic, true)
+	return nil
+}
+
+// SendMessage implements sarama.SyncProducer
+func (b *natsBus) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	if err = b.ensureStream(msg.Topic); err != nil {
+		return 0, 0, err
+	}
+	m := nats.NewMsg(msg.Topic)
+	if msg.Key != nil {
+		key, kerr := msg.Key.Encode()
+		if kerr != nil {
+			return 0, 0, kerr
+		}
+		m.Header.Set(natsKeyHeader, string(key))
+	}
+	if msg.Value != nil {
+		if m.Data, err = msg.Value.Encode(); err != nil {
+			return 0, 0, err
+		}
+	}
+	ack, err := b.js.PublishMsg(m)
+	if err != nil {
+		return 0, 0, err
+	}
+	msg.Partition = 0
+	msg.Offset = int64(ack.Sequence) - 1
+	return msg.Partition, msg.Offset, nil
+}
+
+// SendMessages implements sarama.SyncProducer
+func (b *natsBus) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := b.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Topics implements sarama.Consumer. Streams belonging to other Dendrite
+// instances sharing the NATS servers, or to anything else, are left out.
+func (b *natsBus) Topics() ([]string, error) {
+	var topics []string
+	for name := range b.js.StreamNames() {
+		if strings.HasPrefix(name, b.topicPrefix) {
+			topics = append(topics, name)
+		}
+	}
+	return topics, nil
+}
+
+// Partitions implements sarama.Consumer
+func (b *natsBus) Partitions(topic string) ([]int32, error) {
+	return []int32{0}, nil
+}
+
+// ConsumePartition implements sarama.Consumer
+func (b *natsBus) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	if partition != 0 {
+		return nil, fmt.Errorf("unknown partition %d", partition)
+	}
+	if err := b.ensureStream(topic); err != nil {
+		return nil, err
+	}
+	var start nats.SubOpt
+	switch {
+	case offset == sarama.OffsetOldest:
+		start = nats.DeliverAll()
+	case offset == sarama.OffsetNewest:
+		start = nats.DeliverNew()
+	case offset >= 0:
+		start = nats.StartSequence(uint64(offset) + 1)
+	default:
+		return nil, fmt.Errorf("invalid offset %d", offset)
+	}
+	pc, err := b.consume(topic, start, offset-1)
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// consume subscribes to the stream for the topic from the given starting
+// point. Messages at or before lastOffset are skipped.
+func (b *natsBus) consume(topic string, start nats.SubOpt, lastOffset int64) (*natsPartitionConsumer, error) {
+	pc := &natsPartitionConsumer{
+		bus:        b,
+		topic:      topic,
+		messages:   make(chan *sarama.ConsumerMessage),
+		errors:     make(chan *sarama.ConsumerError),
+		closing:    make(chan struct{}),
+		lastOffset: lastOffset,
+	}
+	var err error
+	pc.sub, err = b.js.Subscribe(
+		topic, pc.handle, start,
+		nats.ManualAck(), nats.AckExplicit(), nats.AckWait(natsAckWait), nats.MaxAckPending(natsMaxAckPending),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("b.js.Subscribe: %w", err)
+	}
+	return pc, nil
+}
+
+// HighWaterMarks implements sarama.Consumer
+func (b *natsBus) HighWaterMarks() map[string]map[int32]int64 {
+	marks := make(map[string]map[int32]int64)
+	b.streams.Range(func(topic, _ interface{}) bool {
+		if info, err := b.js.StreamInfo(topic.(string)); err == nil {
+			marks[topic.(string)] = map[int32]int64{0: int64(info.State.LastSeq)}
+		}
+		return true
+	})
+	return marks
+}
+
+// Close implements sarama.Consumer and sarama.SyncProducer. It stops the NATS
+// server too, if it was started by setupNATS.
+func (b *natsBus) Close() error {
+	if err := b.conn.Flush(); err != nil {
+		logrus.WithError(err).Warn("Failed to flush NATS connection")
+	}
+	b.conn.Close()
+	if b.server != nil {
+		b.server.Shutdown()
+	}
+	return nil
+}
+
+// natsPartitionConsumer implements sarama.PartitionConsumer. NATS delivers
+// messages to handle one at a time, so it passes them on in order.
+type natsPartitionConsumer struct {
+	bus        *natsBus
+	topic      string
+	sub        *nats.Subscription
+	messages   chan *sarama.ConsumerMessage
+	errors     chan *sarama.ConsumerError
+	closing    chan struct{}
+	closeOnce  sync.Once
+	mu         sync.Mutex // held while passing on a message, so that messages isn't closed meanwhile
+	closed     bool       // protected by mu
+	lastOffset int64      // only used by handle
+}
+
+func (pc *natsPartitionConsumer) handle(msg *nats.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		logrus.WithError(err).WithField("topic", pc.topic).Error("Failed to read NATS message metadata")
+		return
+	}
+	offset := int64(meta.Sequence.Stream) - 1
+	if offset <= pc.lastOffset {
+		// This was sent again because it took too long to pass on last time.
+		_ = msg.Ack()
+		return
+	}
+	cm := &sarama.ConsumerMessage{
+		Topic:     pc.topic,
+		Partition: 0,
+		Offset:    offset,
+		Timestamp: meta.Timestamp,
+		Value:     msg.Data,
+	}
+	if key := msg.Header.Get(natsKeyHeader); key != "" {
+		cm.Key = []byte(key)
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	select {
+	case pc.messages <- cm:
+		pc.lastOffset = offset
+		_ = msg.Ack()
+	case <-pc.closing:
+	}
+}
+
+// AsyncClose implements sarama.PartitionConsumer. The messages channel is
+// closed once any message being passed on has been given up on, as the
+// sarama partition consumers do.
+func (pc *natsPartitionConsumer) AsyncClose() {
+	pc.closeOnce.Do(func() {
+		close(pc.closing)
+		go func() {
+			if err := pc.sub.Unsubscribe(); err != nil {
+				logrus.WithError(err).WithField("topic", pc.topic).Warn("Failed to unsubscribe from NATS")
+			}
+			pc.mu.Lock()
+			defer pc.mu.Unlock()
+			pc.closed = true
+			close(pc.messages)
+			close(pc.errors)
+		}()
+	})
+}
+
+// Close implements sarama.PartitionConsumer
+func (pc *natsPartitionConsumer) Close() error {
+	pc.AsyncClose()
+	return nil
+}
+
+// Messages implements sarama.PartitionConsumer
+func (pc *natsPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
+	return pc.messages
+}
+
+// Errors implements sarama.PartitionConsumer
+func (pc *natsPartitionConsumer) Errors() <-chan *sarama.ConsumerError {
+	return pc.errors
+}
+
+// HighWaterMarkOffset implements sarama.PartitionConsumer
+func (pc *natsPartitionConsumer) HighWaterMarkOffset() int64 {
+	info, err := pc.bus.js.StreamInfo(pc.topic)
+	if err != nil {
+		return 0
+	}
+	return int64(info.State.LastSeq)
+}
@@ -0,0 +1,206 @@
+// +build !wasm
+
+package kafka
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/config"
+	nats "github.com/nats-io/nats.go"
+)
+
+// mustNewTestNATSBus starts a NATS server storing messages in a temporary
+// directory, and connects to it. The returned function shuts it down again.
+func mustNewTestNATSBus(t *testing.T) (*natsBus, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-nats-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %s", err)
+	}
+	bus := newNATSBus(&config.Kafka{
+		TopicPrefix: "Dendrite",
+		NATS: config.NATS{
+			StoragePath: config.Path(dir),
+		},
+	})
+	return bus, func() {
+		_ = bus.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func mustSendNATSMessage(t *testing.T, bus *natsBus, topic, key, value string) int64 {
+	t.Helper()
+	_, offset, err := bus.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.StringEncoder(value),
+	})
+	if err != nil {
+		t.Fatalf("SendMessage: %s", err)
+	}
+	return offset
+}
+
+func mustReceiveNATSMessage(t *testing.T, pc sarama.PartitionConsumer) *sarama.ConsumerMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-pc.Messages():
+		if !ok {
+			t.Fatalf("messages channel closed unexpectedly")
+		}
+		return msg
+	case <-time.After(time.Second * 10):
+		t.Fatalf("timed out waiting for message")
+	}
+	return nil
+}
+
+func mustNotReceiveNATSMessage(t *testing.T, pc sarama.PartitionConsumer) {
+	t.Helper()
+	select {
+	case msg := <-pc.Messages():
+		t.Fatalf("unexpected message at offset %d", msg.Offset)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestNATSSendAndConsume(t *testing.T) {
+	bus, closeBus := mustNewTestNATSBus(t)
+	defer closeBus()
+
+	for i, value := range []string{"a", "b", "c"} {
+		if offset := mustSendNATSMessage(t, bus, "DendriteTest", "key-"+value, value); offset != int64(i) {
+			t.Fatalf("expected message %q at offset %d, got %d", value, i, offset)
+		}
+	}
+
+	pc, err := bus.ConsumePartition("DendriteTest", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("ConsumePartition: %s", err)
+	}
+	defer pc.AsyncClose()
+	for i, value := range []string{"a", "b", "c"} {
+		msg := mustReceiveNATSMessage(t, pc)
+		if msg.Offset != int64(i) || string(msg.Value) != value || string(msg.Key) != "key-"+value {
+			t.Fatalf("expected %q with key %q at offset %d, got %q with key %q at offset %d", value, "key-"+value, i, msg.Value, msg.Key, msg.Offset)
+		}
+	}
+	if hwm := pc.HighWaterMarkOffset(); hwm != 3 {
+		t.Fatalf("expected high water mark 3, got %d", hwm)
+	}
+}
+
+func TestNATSConsumeFromOffset(t *testing.T) {
+	bus, closeBus := mustNewTestNATSBus(t)
+	defer closeBus()
+
+	for _, value := range []string{"a", "b", "c"} {
+		mustSendNATSMessage(t, bus, "DendriteTest", "", value)
+	}
+
+	pc, err := bus.ConsumePartition("DendriteTest", 0, 1)
+	if err != nil {
+		t.Fatalf("ConsumePartition: %s", err)
+	}
+	defer pc.AsyncClose()
+	for _, want := range []int64{1, 2} {
+		if msg := mustReceiveNATSMessage(t, pc); msg.Offset != want {
+			t.Fatalf("expected offset %d, got %d", want, msg.Offset)
+		}
+	}
+
+	newest, err := bus.ConsumePartition("DendriteTest", 0, sarama.OffsetNewest)
+	if err != nil {
+		t.Fatalf("ConsumePartition: %s", err)
+	}
+	defer newest.AsyncClose()
+	mustNotReceiveNATSMessage(t, newest)
+	mustSendNATSMessage(t, bus, "DendriteTest", "", "d")
+	if msg := mustReceiveNATSMessage(t, newest); msg.Offset != 3 || string(msg.Value) != "d" {
+		t.Fatalf("expected %q at offset 3, got %q at offset %d", "d", msg.Value, msg.Offset)
+	}
+
+	if _, err = bus.ConsumePartition("DendriteTest", 1, sarama.OffsetOldest); err == nil {
+		t.Fatalf("expected error consuming unknown partition")
+	}
+	if _, err = bus.ConsumePartition("DendriteTest", 0, -5); err == nil {
+		t.Fatalf("expected error consuming from invalid offset")
+	}
+}
+
+func TestNATSSkipsRedeliveredMessages(t *testing.T) {
+	bus, closeBus := mustNewTestNATSBus(t)
+	defer closeBus()
+
+	for _, value := range []string{"a", "b", "c"} {
+		mustSendNATSMessage(t, bus, "DendriteTest", "", value)
+	}
+
+	// Deliver every message again to a consumer which has already passed
+	// on the first two, as NATS does when they aren't acked in time.
+	pc, err := bus.consume("DendriteTest", nats.DeliverAll(), 1)
+	if err != nil {
+		t.Fatalf("consume: %s", err)
+	}
+	defer pc.AsyncClose()
+	if msg := mustReceiveNATSMessage(t, pc); msg.Offset != 2 {
+		t.Fatalf("expected offset 2, got %d", msg.Offset)
+	}
+	mustNotReceiveNATSMessage(t, pc)
+}
+
+func TestNATSAsyncCloseWithMessageInFlight(t *testing.T) {
+	bus, closeBus := mustNewTestNATSBus(t)
+	defer closeBus()
+
+	pc, err := bus.ConsumePartition("DendriteTest", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("ConsumePartition: %s", err)
+	}
+	mustSendNATSMessage(t, bus, "DendriteTest", "", "a")
+	// Give NATS time to hand the message over, so that it is blocked
+	// waiting for someone to read from the messages channel.
+	time.Sleep(time.Millisecond * 200)
+
+	pc.AsyncClose()
+	pc.AsyncClose() // closing twice must not panic
+	timeout := time.After(time.Second * 10)
+	for open := true; open; {
+		select {
+		case _, open = <-pc.Messages():
+		case <-timeout:
+			t.Fatalf("messages channel wasn't closed")
+		}
+	}
+	select {
+	case _, open := <-pc.Errors():
+		if open {
+			t.Fatalf("unexpected error from closed consumer")
+		}
+	case <-timeout:
+		t.Fatalf("errors channel wasn't closed")
+	}
+}
+
+func TestNATSTopicsFiltersByPrefix(t *testing.T) {
+	bus, closeBus := mustNewTestNATSBus(t)
+	defer closeBus()
+
+	for _, topic := range []string{"DendriteOne", "DendriteTwo", "Other"} {
+		mustSendNATSMessage(t, bus, topic, "", "a")
+	}
+	topics, err := bus.Topics()
+	if err != nil {
+		t.Fatalf("Topics: %s", err)
+	}
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "DendriteOne" || topics[1] != "DendriteTwo" {
+		t.Fatalf("expected only Dendrite topics, got %v", topics)
+	}
+}
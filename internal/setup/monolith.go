@@ -22,6 +22,7 @@ import (
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/federationapi"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
@@ -37,11 +38,12 @@ import (
 // Monolith represents an instantiation of all dependencies required to build
 // all components of Dendrite, for use in monolith mode.
 type Monolith struct {
-	Config    *config.Dendrite
-	AccountDB accounts.Database
-	KeyRing   *gomatrixserverlib.KeyRing
-	Client    *gomatrixserverlib.Client
-	FedClient *gomatrixserverlib.FederationClient
+	Config     *config.Dendrite
+	MessageBus internal.MessageBus
+	AccountDB  accounts.Database
+	KeyRing    *gomatrixserverlib.KeyRing
+	Client     *gomatrixserverlib.Client
+	FedClient  *gomatrixserverlib.FederationClient
 
 	AppserviceAPI       appserviceAPI.AppServiceQueryAPI
 	EDUInternalAPI      eduServerAPI.EDUServerInputAPI
@@ -53,12 +55,16 @@ type Monolith struct {
 
 	// Optional
 	ExtPublicRoomsProvider api.ExtraPublicRoomsProvider
+	// Optional, for components to register their shutdown hooks with
+	Shutdown *internal.ShutdownCoordinator
 }
 
-// AddAllPublicRoutes attaches all public paths to the given router
-func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux *mux.Router) {
+// AddAllPublicRoutes attaches all public paths to the given router. Components
+// which can only register their admin paths alongside their public paths do
+// so on the admin router.
+func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux, adminMux *mux.Router) {
 	clientapi.AddPublicRoutes(
-		csMux, &m.Config.ClientAPI, m.AccountDB,
+		csMux, &m.Config.ClientAPI, m.MessageBus, m.AccountDB,
 		m.FedClient, m.RoomserverAPI,
 		m.EDUInternalAPI, m.AppserviceAPI, transactions.New(),
 		m.FederationSenderAPI, m.UserAPI, m.KeyAPI, m.ExtPublicRoomsProvider,
@@ -70,7 +76,13 @@ func (m *Monolith) AddAllPublicRoutes(csMux, ssMux, keyMux, mediaMux *mux.Router
 	)
 	mediaapi.AddPublicRoutes(mediaMux, &m.Config.MediaAPI, m.UserAPI, m.Client)
 	syncapi.AddPublicRoutes(
-		csMux, m.UserAPI, m.RoomserverAPI,
-		m.KeyAPI, m.FedClient, &m.Config.SyncAPI,
+		csMux, adminMux, m.UserAPI, m.RoomserverAPI,
+		m.KeyAPI, m.FedClient, &m.Config.SyncAPI, m.MessageBus, m.Shutdown,
 	)
 }
+
+// AddAllAdminRoutes attaches all admin paths to the given router
+func (m *Monolith) AddAllAdminRoutes(adminMux *mux.Router) {
+	clientapi.AddAdminRoutes(adminMux, &m.Config.ClientAPI, m.AccountDB, m.UserAPI, m.RoomserverAPI, m.KeyAPI)
+	federationapi.AddAdminRoutes(adminMux, &m.Config.FederationAPI, m.FederationSenderAPI)
+}
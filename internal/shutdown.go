@@ -0,0 +1,155 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ShutdownStage is a step of shutting down. Stages run in the order below, so
+// that nothing is stopped while something that depends on it is still running.
+type ShutdownStage int
+
+const (
+	// ShutdownStageHTTP stops accepting new HTTP requests.
+	ShutdownStageHTTP ShutdownStage = iota
+	// ShutdownStageSync wakes up /sync long-polls so that they respond now
+	// rather than waiting for their timeout.
+	ShutdownStageSync
+	// ShutdownStageRequests waits for HTTP requests in flight to finish.
+	ShutdownStageRequests
+	// ShutdownStageBackground stops periodic background tasks.
+	ShutdownStageBackground
+	// ShutdownStageConsumers stops consuming from Kafka, once the messages
+	// being processed have been processed and their offsets stored.
+	ShutdownStageConsumers
+	// ShutdownStageQueues waits for work which has already been queued, such
+	// as room events being input or transactions being sent to other servers,
+	// once the consumers have stopped adding to it.
+	ShutdownStageQueues
+	// ShutdownStageProducers closes the Kafka producers.
+	ShutdownStageProducers
+	// ShutdownStageDatabases closes the database connections.
+	ShutdownStageDatabases
+	// ShutdownStageP2P closes peer-to-peer networking.
+	ShutdownStageP2P
+
+	shutdownStageCount
+)
+
+var shutdownStageNames = [shutdownStageCount]string{
+	"http", "sync", "requests", "background", "consumers", "queues", "producers", "databases", "p2p",
+}
+
+func (s ShutdownStage) String() string {
+	if s < 0 || s >= shutdownStageCount {
+		return "unknown"
+	}
+	return shutdownStageNames[s]
+}
+
+// ShutdownHook is called to shut something down. It should give up when the
+// context is done.
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHook struct {
+	name string
+	hook ShutdownHook
+}
+
+// ShutdownCoordinator runs the shutdown hooks registered by each component in
+// stage order. The hooks in the same stage run at the same time. A nil
+// ShutdownCoordinator ignores hooks, for callers which don't shut down cleanly.
+type ShutdownCoordinator struct {
+	mu     sync.Mutex
+	hooks  [shutdownStageCount][]shutdownHook
+	once   sync.Once
+	done   chan struct{}
+	logger *logrus.Entry
+}
+
+// NewShutdownCoordinator makes a ShutdownCoordinator with no hooks.
+func NewShutdownCoordinator(componentName string) *ShutdownCoordinator {
+	return &ShutdownCoordinator{
+		done:   make(chan struct{}),
+		logger: logrus.WithField("component", componentName),
+	}
+}
+
+// Register adds a hook to run in the given stage of shutting down.
+func (s *ShutdownCoordinator) Register(stage ShutdownStage, name string, hook ShutdownHook) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[stage] = append(s.hooks[stage], shutdownHook{name, hook})
+}
+
+// Shutdown runs the hooks, returning once they have all finished or the
+// context is done. Only the first call runs the hooks, and any later calls
+// wait for it to finish.
+func (s *ShutdownCoordinator) Shutdown(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		defer close(s.done)
+		s.mu.Lock()
+		hooks := s.hooks
+		s.mu.Unlock()
+		for stage := ShutdownStage(0); stage < shutdownStageCount; stage++ {
+			if !s.runStage(ctx, stage, hooks[stage]) {
+				return
+			}
+		}
+		s.logger.Info("Shut down cleanly")
+	})
+	<-s.done
+}
+
+// runStage runs the hooks for a stage at the same time and waits for them.
+// Returns false if the context was done first.
+func (s *ShutdownCoordinator) runStage(ctx context.Context, stage ShutdownStage, hooks []shutdownHook) bool {
+	if len(hooks) == 0 {
+		return true
+	}
+	s.logger.WithField("stage", stage.String()).Info("Shutting down")
+	var wg sync.WaitGroup
+	for _, h := range hooks {
+		wg.Add(1)
+		go func(h shutdownHook) {
+			defer wg.Done()
+			if err := h.hook(ctx); err != nil {
+				s.logger.WithError(err).WithField("stage", stage.String()).Errorf("Failed to shut down %s", h.name)
+			}
+		}(h)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		s.logger.WithField("stage", stage.String()).Error("Ran out of time to shut down")
+		return false
+	}
+}
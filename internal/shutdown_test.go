@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownRunsStagesInOrder(t *testing.T) {
+	s := NewShutdownCoordinator("test")
+	var mu sync.Mutex
+	var ran []string
+	record := func(name string) ShutdownHook {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return nil
+		}
+	}
+	// Registered out of order on purpose.
+	s.Register(ShutdownStageDatabases, "databases", record("databases"))
+	s.Register(ShutdownStageHTTP, "http", record("http"))
+	s.Register(ShutdownStageConsumers, "consumers", record("consumers"))
+	s.Register(ShutdownStageSync, "sync", record("sync"))
+
+	s.Shutdown(context.Background())
+	want := []string{"http", "sync", "consumers", "databases"}
+	if !reflect.DeepEqual(ran, want) {
+		t.Fatalf("hooks ran in order %v, want %v", ran, want)
+	}
+
+	// Shutting down again doesn't run the hooks again.
+	s.Shutdown(context.Background())
+	if len(ran) != len(want) {
+		t.Fatalf("hooks ran again on second shutdown: %v", ran)
+	}
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	s := NewShutdownCoordinator("test")
+	s.Register(ShutdownStageHTTP, "stuck", func(ctx context.Context) error {
+		select {} // never returns, even when the context is done
+	})
+	var laterRan bool
+	s.Register(ShutdownStageDatabases, "databases", func(ctx context.Context) error {
+		laterRan = true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Shutdown(ctx)
+	if laterRan {
+		t.Fatal("expected later stages to be skipped once the deadline passed")
+	}
+}
+
+func TestNilShutdownCoordinator(t *testing.T) {
+	var s *ShutdownCoordinator
+	s.Register(ShutdownStageHTTP, "http", func(ctx context.Context) error {
+		t.Fatal("hook on nil coordinator should never run")
+		return nil
+	})
+	s.Shutdown(context.Background())
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// DatabaseHealthCheckInterval is how often the connection to each database is checked.
+const DatabaseHealthCheckInterval = time.Second * 5
+
+// unavailableDatabases counts, for each database, the connection pools which
+// couldn't reach it when they were last checked. The same database may be
+// opened more than once, e.g. by several components in a monolith.
+var unavailableDatabases = struct {
+	sync.RWMutex
+	pools map[config.DataSource]int
+}{
+	pools: make(map[config.DataSource]int),
+}
+
+// DatabasesAvailable returns false if any of the given databases couldn't be
+// reached when they were last checked. Requests which depend on them should be
+// turned away while this is the case, rather than failing one by one. Only
+// databases opened by this process are monitored, so any others are assumed to
+// be available, as are nil options.
+func DatabasesAvailable(dbs ...*config.DatabaseOptions) bool {
+	unavailableDatabases.RLock()
+	defer unavailableDatabases.RUnlock()
+	for _, db := range dbs {
+		if db != nil && unavailableDatabases.pools[db.ConnectionString] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// setDatabaseAvailable records whether a connection pool for the given
+// database could reach it.
+func setDatabaseAvailable(connectionString config.DataSource, available bool) {
+	unavailableDatabases.Lock()
+	defer unavailableDatabases.Unlock()
+	if available {
+		unavailableDatabases.pools[connectionString]--
+		if unavailableDatabases.pools[connectionString] <= 0 {
+			delete(unavailableDatabases.pools, connectionString)
+		}
+	} else {
+		unavailableDatabases.pools[connectionString]++
+	}
+}
+
+// monitorDatabase checks that the database can be reached every
+// DatabaseHealthCheckInterval. When the database comes back after being
+// unreachable, e.g. because Postgres was restarted, the idle connections are
+// closed as they will have gone stale. New connections are made as they are
+// needed and prepared statements are prepared again on them by database/sql.
+func monitorDatabase(db *sql.DB, connectionString config.DataSource, maxIdleConns int, logger *logrus.Entry) {
+	available := true
+	for range time.Tick(DatabaseHealthCheckInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), DatabaseHealthCheckInterval)
+		err := db.PingContext(ctx)
+		cancel()
+		switch {
+		case err != nil && available:
+			available = false
+			setDatabaseAvailable(connectionString, false)
+			logger.WithError(err).Error("Database is unavailable")
+		case err == nil && !available:
+			available = true
+			db.SetMaxIdleConns(0)
+			db.SetMaxIdleConns(maxIdleConns)
+			setDatabaseAvailable(connectionString, true)
+			logger.Warn("Database is available again")
+		}
+	}
+}
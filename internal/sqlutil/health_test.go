@@ -0,0 +1,34 @@
+package sqlutil
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func TestDatabasesAvailable(t *testing.T) {
+	rooms := &config.DatabaseOptions{ConnectionString: "postgresql://localhost/rooms"}
+	syncDB := &config.DatabaseOptions{ConnectionString: "postgresql://localhost/sync"}
+	if !DatabasesAvailable(rooms, syncDB, nil) {
+		t.Fatalf("expected unmonitored databases to be available")
+	}
+
+	// The rooms database is opened twice, and both connection pools lose it.
+	setDatabaseAvailable(rooms.ConnectionString, false)
+	setDatabaseAvailable(rooms.ConnectionString, false)
+	if DatabasesAvailable(rooms) || DatabasesAvailable(syncDB, rooms) {
+		t.Errorf("expected the rooms database to be unavailable")
+	}
+	if !DatabasesAvailable(syncDB) {
+		t.Errorf("expected the sync database to be unaffected")
+	}
+
+	setDatabaseAvailable(rooms.ConnectionString, true)
+	if DatabasesAvailable(rooms) {
+		t.Errorf("expected the rooms database to be unavailable until every pool reaches it")
+	}
+	setDatabaseAvailable(rooms.ConnectionString, true)
+	if !DatabasesAvailable(rooms) {
+		t.Errorf("expected the rooms database to be available again")
+	}
+}
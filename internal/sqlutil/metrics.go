@@ -0,0 +1,227 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngrok/sqlmw"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DatabaseStatsInterval is how often the connection pool stats of each
+// database are published.
+const DatabaseStatsInterval = time.Second * 15
+
+var (
+	queryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "query_errors_total",
+			Help:      "Number of database queries which failed, by database and type of error",
+		},
+		[]string{"database", "type"},
+	)
+	openConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "open_connections",
+			Help:      "Number of connections to the database, both in use and idle",
+		},
+		[]string{"database"},
+	)
+	inUseConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "in_use_connections",
+			Help:      "Number of connections to the database which are in use",
+		},
+		[]string{"database"},
+	)
+	idleConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "idle_connections",
+			Help:      "Number of idle connections to the database",
+		},
+		[]string{"database"},
+	)
+	waitCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "waits_total",
+			Help:      "Total number of times a query had to wait for a free connection to the database",
+		},
+		[]string{"database"},
+	)
+	waitDuration = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "sqlutil",
+			Name:      "wait_duration_seconds_total",
+			Help:      "Total time spent waiting for a free connection to the database",
+		},
+		[]string{"database"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		queryErrors, openConnections, inUseConnections, idleConnections, waitCount, waitDuration,
+	)
+}
+
+// metricsInterceptor counts the queries against a database which fail.
+type metricsInterceptor struct {
+	sqlmw.NullInterceptor
+	database string
+}
+
+func (in *metricsInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := conn.ExecContext(ctx, query, args)
+	in.count(err)
+	return result, err
+}
+
+func (in *metricsInterceptor) ConnQueryContext(ctx context.Context, conn driver.QueryerContext, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := conn.QueryContext(ctx, query, args)
+	in.count(err)
+	return rows, err
+}
+
+func (in *metricsInterceptor) StmtExecContext(ctx context.Context, stmt driver.StmtExecContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := stmt.ExecContext(ctx, args)
+	in.count(err)
+	return result, err
+}
+
+func (in *metricsInterceptor) StmtQueryContext(ctx context.Context, stmt driver.StmtQueryContext, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := stmt.QueryContext(ctx, args)
+	in.count(err)
+	return rows, err
+}
+
+func (in *metricsInterceptor) count(err error) {
+	if err != nil {
+		queryErrors.WithLabelValues(in.database, queryErrorType(err)).Inc()
+	}
+}
+
+// queryErrorType sorts the errors returned by the database drivers into a
+// few broad types, so that e.g. connection problems can be told apart from
+// constraint violations.
+func queryErrorType(err error) string {
+	if code, ok := postgresErrorCode(err); ok {
+		// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+		switch {
+		case strings.HasPrefix(code, "08"), strings.HasPrefix(code, "57P"):
+			return "connection"
+		case strings.HasPrefix(code, "23"):
+			return "constraint"
+		case strings.HasPrefix(code, "40"):
+			return "serialization"
+		case code == "57014":
+			return "timeout"
+		}
+		return "other"
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, driver.ErrBadConn):
+		return "connection"
+	case strings.Contains(err.Error(), "constraint failed"):
+		// SQLite
+		return "constraint"
+	case strings.Contains(err.Error(), "database is locked"):
+		// SQLite
+		return "locked"
+	}
+	return "other"
+}
+
+// metricsDrivers are the names of the drivers which have been registered by
+// metricsDriverName.
+var metricsDrivers struct {
+	sync.Mutex
+	registered map[string]bool
+}
+
+// metricsDriverName returns the name of a driver which wraps the given
+// driver and counts the query errors for the named database, registering it
+// if it hasn't been already.
+func metricsDriverName(driverName, database string) (string, error) {
+	name := driverName + "-metrics-" + database
+	metricsDrivers.Lock()
+	defer metricsDrivers.Unlock()
+	if metricsDrivers.registered[name] {
+		return name, nil
+	}
+	// Opening a database doesn't connect to it, so this is just a way of
+	// getting hold of the registered driver.
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close() // nolint:errcheck
+	sql.Register(name, sqlmw.Driver(db.Driver(), &metricsInterceptor{database: database}))
+	if metricsDrivers.registered == nil {
+		metricsDrivers.registered = make(map[string]bool)
+	}
+	metricsDrivers.registered[name] = true
+	return name, nil
+}
+
+// CollectDatabaseStats publishes the connection pool stats of each named
+// database every DatabaseStatsInterval, so that it's possible to tell when
+// the pool is saturated. It should be run in a goroutine.
+func CollectDatabaseStats() {
+	for range time.Tick(DatabaseStatsInterval) {
+		collectDatabaseStats()
+	}
+}
+
+func collectDatabaseStats() {
+	openDatabases.Lock()
+	defer openDatabases.Unlock()
+	for i := range openDatabases.dbs {
+		db := &openDatabases.dbs[i]
+		if db.name == "" {
+			continue
+		}
+		stats := db.Stats()
+		openConnections.WithLabelValues(db.name).Set(float64(stats.OpenConnections))
+		inUseConnections.WithLabelValues(db.name).Set(float64(stats.InUse))
+		idleConnections.WithLabelValues(db.name).Set(float64(stats.Idle))
+		// The waits are totals since the database was opened, so the counters
+		// go up by how much they have changed since they were last collected.
+		waitCount.WithLabelValues(db.name).Add(float64(stats.WaitCount - db.lastStats.WaitCount))
+		waitDuration.WithLabelValues(db.name).Add((stats.WaitDuration - db.lastStats.WaitDuration).Seconds())
+		db.lastStats = stats
+	}
+}
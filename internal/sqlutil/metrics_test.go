@@ -0,0 +1,81 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("query: %w", context.Canceled), "cancelled"},
+		{driver.ErrBadConn, "connection"},
+		{&pq.Error{Code: "08006"}, "connection"},
+		{&pq.Error{Code: "23505"}, "constraint"},
+		{&pq.Error{Code: "40001"}, "serialization"},
+		{&pq.Error{Code: "57014"}, "timeout"},
+		{&pq.Error{Code: "42P01"}, "other"},
+		{errors.New("UNIQUE constraint failed: account_accounts.localpart"), "constraint"},
+		{errors.New("database is locked"), "locked"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tc := range tests {
+		if got := queryErrorType(tc.err); got != tc.want {
+			t.Errorf("queryErrorType(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestCollectDatabaseStatsCountsWaits(t *testing.T) {
+	db, err := sql.Open(SQLiteDriverName(), "file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	db.SetMaxOpenConns(1)
+	openDatabases.Lock()
+	openDatabases.dbs = append(openDatabases.dbs, openDatabase{DB: db, name: "waits_test"})
+	openDatabases.Unlock()
+
+	// Make a query wait for the only connection.
+	wait := func() {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatalf("failed to get connection: %s", err)
+		}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			conn.Close() // nolint:errcheck
+		}()
+		if err = db.Ping(); err != nil {
+			t.Fatalf("failed to ping database: %s", err)
+		}
+	}
+
+	wait()
+	collectDatabaseStats()
+	if got := testutil.ToFloat64(waitCount.WithLabelValues("waits_test")); got != 1 {
+		t.Errorf("got %v waits, want 1", got)
+	}
+	// Collecting again only adds the waits since the last collection.
+	wait()
+	collectDatabaseStats()
+	collectDatabaseStats()
+	if got := testutil.ToFloat64(waitCount.WithLabelValues("waits_test")); got != 2 {
+		t.Errorf("got %v waits, want 2", got)
+	}
+	if got := testutil.ToFloat64(waitDuration.WithLabelValues("waits_test")); got <= 0 {
+		t.Errorf("got %v seconds waited, want more than 0", got)
+	}
+}
@@ -1,21 +1,65 @@
 package sqlutil
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/pressly/goose"
 )
 
+const schemaVersionsSchema = `
+-- Records the schema version of each component sharing this database.
+CREATE TABLE IF NOT EXISTS schema_versions (
+	component TEXT NOT NULL PRIMARY KEY,
+	version BIGINT NOT NULL
+);
+`
+
+const selectSchemaVersionSQL = "" +
+	"SELECT version FROM schema_versions WHERE component = $1"
+
+const insertSchemaVersionSQL = "" +
+	"INSERT INTO schema_versions (component, version) VALUES ($1, $2)"
+
+const updateSchemaVersionSQL = "" +
+	"UPDATE schema_versions SET version = $1 WHERE component = $2"
+
+const selectSQLiteGooseTableSQL = "" +
+	"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'goose_db_version'"
+
+const selectPostgresGooseTableSQL = "" +
+	"SELECT COUNT(*) FROM information_schema.tables" +
+	" WHERE table_schema = current_schema() AND table_name = 'goose_db_version'"
+
+const selectSchemaVersionsSQL = "" +
+	"SELECT component, version FROM schema_versions"
+
+const selectSQLiteSchemaVersionsTableSQL = "" +
+	"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_versions'"
+
+const selectPostgresSchemaVersionsTableSQL = "" +
+	"SELECT COUNT(*) FROM information_schema.tables" +
+	" WHERE table_schema = current_schema() AND table_name = 'schema_versions'"
+
+// Migrations holds the ordered schema migrations for a single component,
+// e.g. "accounts" or "keydb". Each migration is identified by the numeric
+// prefix of the file that registers it, so migrations which were previously
+// applied by goose keep the same version.
 type Migrations struct {
+	component              string
 	registeredGoMigrations map[int64]*goose.Migration
 }
 
-func NewMigrations() *Migrations {
+// NewMigrations returns an empty set of migrations for the given component.
+func NewMigrations(component string) *Migrations {
 	return &Migrations{
+		component:              component,
 		registeredGoMigrations: make(map[int64]*goose.Migration),
 	}
 }
@@ -40,91 +84,169 @@ func (m *Migrations) AddNamedMigration(filename string, up func(*sql.Tx) error,
 	m.registeredGoMigrations[v] = migration
 }
 
-// RunDeltas up to the latest version.
+// RunDeltas brings the component's schema up to the latest version. Each
+// pending migration runs in its own transaction together with the update
+// to schema_versions, so a failed migration leaves the recorded version
+// untouched. An error is returned without changing anything if the
+// database has a newer schema than this binary knows about, since running
+// against it could corrupt data that a newer Dendrite wrote.
 func (m *Migrations) RunDeltas(db *sql.DB, props *config.DatabaseOptions) error {
-	maxVer := goose.MaxVersion
-	minVer := int64(0)
-	migrations, err := m.collect(minVer, maxVer)
-	if err != nil {
-		return fmt.Errorf("RunDeltas: Failed to collect migrations: %w", err)
+	migrations := m.sorted()
+
+	if _, err := db.Exec(schemaVersionsSchema); err != nil {
+		return fmt.Errorf("RunDeltas: failed to create schema_versions table: %w", err)
 	}
-	if props.ConnectionString.IsPostgres() {
-		if err = goose.SetDialect("postgres"); err != nil {
-			return err
-		}
-	} else if props.ConnectionString.IsSQLite() {
-		if err = goose.SetDialect("sqlite3"); err != nil {
-			return err
-		}
-	} else {
-		return fmt.Errorf("Unknown connection string: %s", props.ConnectionString)
+	current, err := m.currentVersion(db, props, migrations)
+	if err != nil {
+		return fmt.Errorf("RunDeltas: failed to get current version of %q: %w", m.component, err)
 	}
-	for {
-		current, err := goose.EnsureDBVersion(db)
-		if err != nil {
-			return fmt.Errorf("RunDeltas: Failed to EnsureDBVersion: %w", err)
-		}
 
-		next, err := migrations.Next(current)
-		if err != nil {
-			if err == goose.ErrNoNextVersion {
-				return nil
-			}
+	latest := m.Latest()
+	if current > latest {
+		return fmt.Errorf(
+			"RunDeltas: the %q schema is at version %d but this version of Dendrite only knows about version %d; "+
+				"upgrade Dendrite or restore the database from a backup taken before the upgrade",
+			m.component, current, latest,
+		)
+	}
 
-			return fmt.Errorf("RunDeltas: Failed to load next migration to %+v : %w", next, err)
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
 		}
-
-		if err = next.Up(db); err != nil {
-			return fmt.Errorf("RunDeltas: Failed run migration: %w", err)
+		if err = m.runMigration(db, migration); err != nil {
+			return fmt.Errorf("RunDeltas: failed to run migration %q: %w", migration.Source, err)
 		}
 	}
+	return nil
 }
 
-func (m *Migrations) collect(current, target int64) (goose.Migrations, error) {
-	var migrations goose.Migrations
-
-	// Go migrations registered via goose.AddMigration().
-	for _, migration := range m.registeredGoMigrations {
-		v, err := goose.NumericComponent(migration.Source)
+func (m *Migrations) runMigration(db *sql.DB, migration *goose.Migration) (err error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
-			return nil, err
+			_ = txn.Rollback()
 		}
-		if versionFilter(v, current, target) {
-			migrations = append(migrations, migration)
+	}()
+	if migration.UpFn != nil {
+		if err = migration.UpFn(txn); err != nil {
+			return err
 		}
 	}
-
-	migrations = sortAndConnectMigrations(migrations)
-
-	return migrations, nil
+	if _, err = txn.Exec(updateSchemaVersionSQL, migration.Version, m.component); err != nil {
+		return err
+	}
+	return txn.Commit()
 }
 
-func sortAndConnectMigrations(migrations goose.Migrations) goose.Migrations {
-	sort.Sort(migrations)
-
-	// now that we're sorted in the appropriate direction,
-	// populate next and previous for each migration
-	for i, m := range migrations {
-		prev := int64(-1)
-		if i > 0 {
-			prev = migrations[i-1].Version
-			migrations[i-1].Next = m.Version
-		}
-		migrations[i].Previous = prev
+// currentVersion returns the recorded schema version of the component. The
+// first time a component is seen, its version is imported from goose's
+// bookkeeping table, if there is one, so that databases upgraded by older
+// releases don't re-run migrations they have already applied.
+func (m *Migrations) currentVersion(db *sql.DB, props *config.DatabaseOptions, migrations goose.Migrations) (int64, error) {
+	var version int64
+	err := db.QueryRow(selectSchemaVersionSQL, m.component).Scan(&version)
+	if err == nil {
+		return version, nil
 	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	if version, err = gooseVersion(db, props, migrations); err != nil {
+		return 0, fmt.Errorf("gooseVersion: %w", err)
+	}
+	if _, err = db.Exec(insertSchemaVersionSQL, m.component, version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
 
-	return migrations
+// gooseVersion returns the highest of the given migrations that goose has
+// recorded as applied, or 0 if there is no goose table. Only the versions of
+// this component are considered as several components may share a database.
+func gooseVersion(db *sql.DB, props *config.DatabaseOptions, migrations goose.Migrations) (int64, error) {
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	selectGooseTableSQL := selectPostgresGooseTableSQL
+	if props.ConnectionString.IsSQLite() {
+		selectGooseTableSQL = selectSQLiteGooseTableSQL
+	}
+	var tables int
+	if err := db.QueryRow(selectGooseTableSQL).Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	versions := make([]string, len(migrations))
+	for i, migration := range migrations {
+		versions[i] = strconv.FormatInt(migration.Version, 10)
+	}
+	var version sql.NullInt64
+	query := "SELECT MAX(version_id) FROM goose_db_version WHERE is_applied AND version_id IN (" + strings.Join(versions, ",") + ")"
+	if err := db.QueryRow(query).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version.Int64, nil
 }
 
-func versionFilter(v, current, target int64) bool {
+// Component returns the name of the component that the migrations are for.
+func (m *Migrations) Component() string {
+	return m.component
+}
 
-	if target > current {
-		return v > current && v <= target
+// Latest returns the version of the newest migration, which is the schema
+// version that this binary expects, or 0 if there are no migrations.
+func (m *Migrations) Latest() int64 {
+	migrations := m.sorted()
+	if len(migrations) == 0 {
+		return 0
 	}
+	return migrations[len(migrations)-1].Version
+}
 
-	if target < current {
-		return v <= current && v > target
+// SchemaVersions returns the schema version of each component that has
+// recorded one in the database, without changing anything. It returns an
+// empty map if no component has run its migrations yet.
+func SchemaVersions(ctx context.Context, db *sql.DB, props *config.DatabaseOptions) (versions map[string]int64, err error) {
+	selectTableSQL := selectPostgresSchemaVersionsTableSQL
+	if props.ConnectionString.IsSQLite() {
+		selectTableSQL = selectSQLiteSchemaVersionsTableSQL
+	}
+	versions = map[string]int64{}
+	var tables int
+	if err = db.QueryRowContext(ctx, selectTableSQL).Scan(&tables); err != nil {
+		return nil, err
+	}
+	if tables == 0 {
+		return versions, nil
 	}
+	rows, err := db.QueryContext(ctx, selectSchemaVersionsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer checkNamedErr(rows.Close, &err)
+	for rows.Next() {
+		var component string
+		var version int64
+		if err = rows.Scan(&component, &version); err != nil {
+			return nil, err
+		}
+		versions[component] = version
+	}
+	err = rows.Err()
+	return versions, err
+}
 
-	return false
+func (m *Migrations) sorted() goose.Migrations {
+	var migrations goose.Migrations
+	for _, migration := range m.registeredGoMigrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Sort(migrations)
+	return migrations
 }
@@ -0,0 +1,182 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+const gooseTableSQL = `
+CREATE TABLE goose_db_version (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	version_id INTEGER NOT NULL,
+	is_applied INTEGER NOT NULL,
+	tstamp TIMESTAMP DEFAULT (datetime('now'))
+);
+`
+
+func mustOpenMigrationsDB(t *testing.T) (*sql.DB, *config.DatabaseOptions, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-migrate-test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	props := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "migrate.db")),
+	}
+	db, err := Open(props)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("failed to open database: %s", err)
+	}
+	return db, props, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// testMigrations returns two migrations for the component, along with the
+// number of times that each of them has been run.
+func testMigrations(component string) (*Migrations, map[int64]int) {
+	runs := make(map[int64]int)
+	m := NewMigrations(component)
+	m.AddNamedMigration("1_first.go", func(txn *sql.Tx) error {
+		runs[1]++
+		_, err := txn.Exec("CREATE TABLE first (id INTEGER)")
+		return err
+	}, nil)
+	m.AddNamedMigration("2_second.go", func(txn *sql.Tx) error {
+		runs[2]++
+		_, err := txn.Exec("CREATE TABLE second (id INTEGER)")
+		return err
+	}, nil)
+	return m, runs
+}
+
+func assertSchemaVersion(t *testing.T, db *sql.DB, component string, want int64) {
+	t.Helper()
+	var version int64
+	if err := db.QueryRow(selectSchemaVersionSQL, component).Scan(&version); err != nil {
+		t.Fatalf("failed to select schema version: %s", err)
+	}
+	if version != want {
+		t.Errorf("schema version of %q is %d, want %d", component, version, want)
+	}
+}
+
+func TestRunDeltasFreshDatabase(t *testing.T) {
+	db, props, closeDB := mustOpenMigrationsDB(t)
+	defer closeDB()
+	m, runs := testMigrations("test")
+	if err := m.RunDeltas(db, props); err != nil {
+		t.Fatalf("RunDeltas failed: %s", err)
+	}
+	if runs[1] != 1 || runs[2] != 1 {
+		t.Errorf("expected each migration to run once, got %v", runs)
+	}
+	assertSchemaVersion(t, db, "test", 2)
+
+	// Running the migrations again shouldn't do anything.
+	if err := m.RunDeltas(db, props); err != nil {
+		t.Fatalf("RunDeltas failed the second time: %s", err)
+	}
+	if runs[1] != 1 || runs[2] != 1 {
+		t.Errorf("expected each migration to run once, got %v", runs)
+	}
+}
+
+func TestRunDeltasUpgradesFromGoose(t *testing.T) {
+	db, props, closeDB := mustOpenMigrationsDB(t)
+	defer closeDB()
+	if _, err := db.Exec(gooseTableSQL); err != nil {
+		t.Fatalf("failed to create goose table: %s", err)
+	}
+	// Version 1 was applied by goose. Version 3 belongs to another component
+	// sharing the database, so it mustn't be taken as ours.
+	for _, version := range []int64{0, 1, 3} {
+		if _, err := db.Exec("INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, 1)", version); err != nil {
+			t.Fatalf("failed to insert goose version: %s", err)
+		}
+	}
+	m, runs := testMigrations("test")
+	if err := m.RunDeltas(db, props); err != nil {
+		t.Fatalf("RunDeltas failed: %s", err)
+	}
+	if runs[1] != 0 || runs[2] != 1 {
+		t.Errorf("expected only the second migration to run, got %v", runs)
+	}
+	assertSchemaVersion(t, db, "test", 2)
+}
+
+func TestRunDeltasReturnsGooseErrors(t *testing.T) {
+	db, props, closeDB := mustOpenMigrationsDB(t)
+	defer closeDB()
+	// A goose table that we can't read the versions from.
+	if _, err := db.Exec("CREATE TABLE goose_db_version (id INTEGER)"); err != nil {
+		t.Fatalf("failed to create goose table: %s", err)
+	}
+	m, runs := testMigrations("test")
+	if err := m.RunDeltas(db, props); err == nil {
+		t.Fatalf("expected RunDeltas to fail")
+	}
+	if runs[1] != 0 || runs[2] != 0 {
+		t.Errorf("expected no migrations to run, got %v", runs)
+	}
+}
+
+func TestRunDeltasRefusesNewerSchema(t *testing.T) {
+	db, props, closeDB := mustOpenMigrationsDB(t)
+	defer closeDB()
+	if _, err := db.Exec(schemaVersionsSchema); err != nil {
+		t.Fatalf("failed to create schema_versions table: %s", err)
+	}
+	if _, err := db.Exec(insertSchemaVersionSQL, "test", 3); err != nil {
+		t.Fatalf("failed to insert schema version: %s", err)
+	}
+	m, runs := testMigrations("test")
+	if err := m.RunDeltas(db, props); err == nil {
+		t.Fatalf("expected RunDeltas to refuse a newer schema")
+	}
+	if runs[1] != 0 || runs[2] != 0 {
+		t.Errorf("expected no migrations to run, got %v", runs)
+	}
+	assertSchemaVersion(t, db, "test", 3)
+}
+
+func TestSchemaVersions(t *testing.T) {
+	db, props, closeDB := mustOpenMigrationsDB(t)
+	defer closeDB()
+	ctx := context.Background()
+	versions, err := SchemaVersions(ctx, db, props)
+	if err != nil {
+		t.Fatalf("SchemaVersions failed without a schema_versions table: %s", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("expected no schema versions, got %v", versions)
+	}
+
+	m, _ := testMigrations("test")
+	if err = m.RunDeltas(db, props); err != nil {
+		t.Fatalf("RunDeltas failed: %s", err)
+	}
+	if err = NewMigrations("empty").RunDeltas(db, props); err != nil {
+		t.Fatalf("RunDeltas failed: %s", err)
+	}
+	versions, err = SchemaVersions(ctx, db, props)
+	if err != nil {
+		t.Fatalf("SchemaVersions failed: %s", err)
+	}
+	want := map[string]int64{"test": 2, "empty": 0}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("got schema versions %v, want %v", versions, want)
+	}
+	if m.Latest() != 2 {
+		t.Errorf("got latest version %d, want 2", m.Latest())
+	}
+}
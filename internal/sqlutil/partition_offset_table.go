@@ -49,12 +49,16 @@ const upsertPartitionOffsetsSQL = "" +
 	" ON CONFLICT (topic, partition)" +
 	" DO UPDATE SET partition_offset = $3"
 
+const deletePartitionOffsetsSQL = "" +
+	"DELETE FROM ${prefix}_partition_offsets WHERE topic = $1"
+
 // PartitionOffsetStatements represents a set of statements that can be run on a partition_offsets table.
 type PartitionOffsetStatements struct {
 	db                         *sql.DB
 	writer                     Writer
 	selectPartitionOffsetsStmt *sql.Stmt
 	upsertPartitionOffsetStmt  *sql.Stmt
+	deletePartitionOffsetsStmt *sql.Stmt
 }
 
 // Prepare converts the raw SQL statements into prepared statements.
@@ -77,6 +81,11 @@ func (s *PartitionOffsetStatements) Prepare(db *sql.DB, writer Writer, prefix st
 	); err != nil {
 		return
 	}
+	if s.deletePartitionOffsetsStmt, err = db.Prepare(
+		strings.Replace(deletePartitionOffsetsSQL, "${prefix}", prefix, -1),
+	); err != nil {
+		return
+	}
 	return
 }
 
@@ -94,6 +103,17 @@ func (s *PartitionOffsetStatements) SetPartitionOffset(
 	return s.upsertPartitionOffset(ctx, topic, partition, offset)
 }
 
+// ResetPartitionOffsets implements PartitionStorer
+func (s *PartitionOffsetStatements) ResetPartitionOffsets(
+	ctx context.Context, topic string,
+) error {
+	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := TxStmt(txn, s.deletePartitionOffsetsStmt)
+		_, err := stmt.ExecContext(ctx, topic)
+		return err
+	})
+}
+
 // selectPartitionOffsets returns all the partition offsets for the given topic.
 func (s *PartitionOffsetStatements) selectPartitionOffsets(
 	ctx context.Context, topic string,
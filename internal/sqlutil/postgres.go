@@ -16,10 +16,24 @@
 
 package sqlutil
 
-import "github.com/lib/pq"
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
 
 // IsUniqueConstraintViolationErr returns true if the error is a postgresql unique_violation error
 func IsUniqueConstraintViolationErr(err error) bool {
 	pqErr, ok := err.(*pq.Error)
 	return ok && pqErr.Code == "23505"
 }
+
+// postgresErrorCode returns the SQLSTATE code of a postgresql error, or
+// false if the error didn't come from postgresql
+func postgresErrorCode(err error) (string, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return "", false
+	}
+	return string(pqErr.Code), true
+}
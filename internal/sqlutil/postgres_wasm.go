@@ -20,3 +20,8 @@ package sqlutil
 func IsUniqueConstraintViolationErr(err error) bool {
 	return false
 }
+
+// postgresErrorCode no-ops for this architecture
+func postgresErrorCode(err error) (string, bool) {
+	return "", false
+}
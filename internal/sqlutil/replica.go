@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/ngrok/sqlmw"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+// replicaInterceptor is installed on connections to read replicas. Since a
+// replica is read-only, schema creation and migrations are left to the
+// primary, so the schemas which the tables execute when they are set up are
+// skipped rather than failing. Any other statement is refused.
+type replicaInterceptor struct {
+	sqlmw.NullInterceptor
+}
+
+func (in *replicaInterceptor) ConnExecContext(ctx context.Context, conn driver.ExecerContext, query string, args []driver.NamedValue) (driver.Result, error) {
+	if len(args) > 0 || !isSchemaStatement(query) {
+		return nil, fmt.Errorf("sqlutil: refusing to execute statement on read replica: %s", query)
+	}
+	logrus.Tracef("Skipping schema statement on read replica: %s", query)
+	return driver.ResultNoRows, nil
+}
+
+// isSchemaStatement returns true if every statement in the query is schema
+// DDL, or is an insert of seed data which does nothing if the data already
+// exists, as the table schemas contain.
+func isSchemaStatement(query string) bool {
+	var lines []string
+	for _, line := range strings.Split(query, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	found := false
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		stmt = strings.ToUpper(strings.Join(strings.Fields(stmt), " "))
+		switch {
+		case stmt == "":
+			continue
+		case strings.HasPrefix(stmt, "CREATE "), strings.HasPrefix(stmt, "ALTER "),
+			strings.HasPrefix(stmt, "DROP "), strings.HasPrefix(stmt, "COMMENT ON "):
+		case strings.HasPrefix(stmt, "INSERT ") && strings.HasSuffix(stmt, " ON CONFLICT DO NOTHING"):
+		default:
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// ReplicaHealthCheckInterval is how often the health of a read replica is checked.
+const ReplicaHealthCheckInterval = time.Second * 5
+
+// ReadReplica tracks whether a read replica is reachable and sufficiently
+// up-to-date to be used for queries.
+type ReadReplica struct {
+	db      *sql.DB
+	maxLag  time.Duration
+	healthy atomic.Bool
+}
+
+// NewReadReplica starts monitoring the given read replica. The replica is
+// considered unhealthy if it can't be reached or if it is lagging behind the
+// primary by more than the configured maximum lag.
+func NewReadReplica(dbProperties *config.DatabaseOptions) (*ReadReplica, error) {
+	db, err := Open(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	r := &ReadReplica{
+		db:     db,
+		maxLag: dbProperties.ReadReplicaMaxLag(),
+	}
+	r.check()
+	go func() {
+		for range time.Tick(ReplicaHealthCheckInterval) {
+			r.check()
+		}
+	}()
+	return r, nil
+}
+
+// Healthy returns true if the replica should be used for queries.
+func (r *ReadReplica) Healthy() bool {
+	return r != nil && r.healthy.Load()
+}
+
+func (r *ReadReplica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), ReplicaHealthCheckInterval)
+	defer cancel()
+	// pg_last_xact_replay_timestamp is NULL if this isn't a replica, or if
+	// nothing has been replayed yet, in which case there is no lag.
+	var lagSeconds sql.NullFloat64
+	err := r.db.QueryRowContext(
+		ctx, "SELECT EXTRACT(EPOCH FROM (now() - pg_last_xact_replay_timestamp()))",
+	).Scan(&lagSeconds)
+	healthy := err == nil && (!lagSeconds.Valid || time.Duration(lagSeconds.Float64*float64(time.Second)) <= r.maxLag)
+	if was := r.healthy.Swap(healthy); was != healthy {
+		logrus.WithError(err).WithField("lag_seconds", lagSeconds.Float64).Warnf("Read replica healthy: %v", healthy)
+	}
+}
@@ -0,0 +1,35 @@
+package sqlutil
+
+import "testing"
+
+func TestIsSchemaStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{`
+-- The events table.
+CREATE SEQUENCE IF NOT EXISTS test_nid_seq;
+CREATE TABLE IF NOT EXISTS test (
+    -- The numeric ID.
+    nid BIGINT PRIMARY KEY DEFAULT nextval('test_nid_seq')
+);
+CREATE INDEX IF NOT EXISTS test_idx ON test(nid);
+`, true},
+		{`
+CREATE TABLE IF NOT EXISTS test (nid BIGINT PRIMARY KEY, name TEXT);
+INSERT INTO test (nid, name) VALUES
+    (1, 'a') ON CONFLICT DO NOTHING;
+`, true},
+		{"ALTER TABLE test ADD COLUMN IF NOT EXISTS name TEXT", true},
+		{"INSERT INTO test (nid) VALUES (1)", false},
+		{"CREATE TABLE test (nid BIGINT); DELETE FROM test", false},
+		{"UPDATE test SET name = 'a' -- ON CONFLICT DO NOTHING", false},
+		{"-- nothing to see here", false},
+	}
+	for _, tt := range tests {
+		if got := isSchemaStatement(tt.query); got != tt.want {
+			t.Errorf("isSchemaStatement(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var queryDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "sqlutil",
+		Name:      "query_duration_seconds",
+		Help:      "How long database queries take to run, by database and statement name",
+	},
+	[]string{"database", "statement"},
+)
+
+func init() {
+	prometheus.MustRegister(queryDurations)
+}
+
+// QueryTimer bounds the duration of queries against a database and records
+// how long each of them took. Only the outermost database method should be
+// timed: helpers that are called from timed methods must not start their own
+// timers, otherwise the same work is counted more than once.
+type QueryTimer struct {
+	// The name of the database, used to label metrics.
+	Database string
+	// The maximum time that a query may run for. Zero means no limit.
+	Timeout time.Duration
+}
+
+// Start returns a context which will be cancelled once the query timeout has
+// elapsed. The returned function must be called, usually with defer, once
+// the named statement has finished and all rows have been read, otherwise
+// the context will be leaked until the timeout expires.
+func (t QueryTimer) Start(ctx context.Context, statement string) (context.Context, func()) {
+	started := time.Now()
+	cancel := context.CancelFunc(func() {})
+	if t.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+	}
+	return ctx, func() {
+		cancel()
+		queryDurations.WithLabelValues(t.Database, statement).Observe(time.Since(started).Seconds())
+	}
+}
+
+// StatementCache prepares statements the first time that they are used and
+// then reuses them. This is useful for queries which can't be prepared up
+// front, e.g. because they take a variable number of parameters.
+type StatementCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewStatementCache creates a new statement cache for the given database.
+func NewStatementCache(db *sql.DB) *StatementCache {
+	return &StatementCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// Prepare returns a prepared statement for the given query, preparing it
+// only if it hasn't been seen before.
+func (c *StatementCache) Prepare(query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
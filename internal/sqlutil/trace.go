@@ -100,6 +100,13 @@ func trackGoID(query string) {
 // usually consisting of at least a database name and connection information. Includes tracing driver
 // if DENDRITE_TRACE_SQL=1
 func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
+	return OpenNamed("", dbProperties)
+}
+
+// OpenNamed opens a database like Open, and also publishes metrics about the
+// query errors and the connection pool of the database, labelled with the
+// given name, e.g. "accounts".
+func OpenNamed(name string, dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
 	switch {
@@ -115,28 +122,77 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	default:
 		return nil, fmt.Errorf("invalid database connection string %q", dbProperties.ConnectionString)
 	}
-	if tracingEnabled {
+	switch {
+	case dbProperties.IsReadReplica:
+		// install the read replica driver
+		driverName += "-replica"
+	case tracingEnabled:
 		// install the wrapped driver
 		driverName += "-trace"
+	case name != "":
+		// install the driver which counts query errors
+		if driverName, err = metricsDriverName(driverName, name); err != nil {
+			return nil, fmt.Errorf("metricsDriverName: %w", err)
+		}
 	}
 	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
-	if driverName != SQLiteDriverName() {
+	openDatabases.Lock()
+	openDatabases.dbs = append(openDatabases.dbs, openDatabase{DB: db, name: name})
+	openDatabases.Unlock()
+	if !dbProperties.ConnectionString.IsSQLite() {
+		dataSourceName := regexp.MustCompile(`://[^@]*@`).ReplaceAllLiteralString(dsn, "://")
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns,
 			"MaxIdleConns":    dbProperties.MaxIdleConns,
 			"ConnMaxLifetime": dbProperties.ConnMaxLifetime,
-			"dataSourceName":  regexp.MustCompile(`://[^@]*@`).ReplaceAllLiteralString(dsn, "://"),
+			"dataSourceName":  dataSourceName,
 		}).Debug("Setting DB connection limits")
 		db.SetMaxOpenConns(dbProperties.MaxOpenConns())
 		db.SetMaxIdleConns(dbProperties.MaxIdleConns())
 		db.SetConnMaxLifetime(dbProperties.ConnMaxLifetime())
+		if !dbProperties.IsReadReplica {
+			// Read replicas are monitored by NewReadReplica instead.
+			go monitorDatabase(db, dbProperties.ConnectionString, dbProperties.MaxIdleConns(), logrus.WithField("dataSourceName", dataSourceName))
+		}
 	}
 	return db, nil
 }
 
+// openDatabase is a database opened by Open, along with its name if it was
+// given one.
+type openDatabase struct {
+	*sql.DB
+	name      string
+	lastStats sql.DBStats // when the stats were last collected
+}
+
+// openDatabases are the databases opened by Open, which CloseDatabases closes.
+var openDatabases struct {
+	sync.Mutex
+	dbs []openDatabase
+}
+
+// CloseDatabases closes every database opened by Open, as part of shutting
+// down. Closing a database waits for the queries in progress to finish.
+func CloseDatabases(ctx context.Context) error {
+	openDatabases.Lock()
+	defer openDatabases.Unlock()
+	for len(openDatabases.dbs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		db := openDatabases.dbs[0]
+		openDatabases.dbs = openDatabases.dbs[1:]
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	registerDrivers()
 }
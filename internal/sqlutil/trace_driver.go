@@ -25,6 +25,9 @@ import (
 )
 
 func registerDrivers() {
+	// install the read replica driver
+	sql.Register("postgres-replica", sqlmw.Driver(&pq.Driver{}, new(replicaInterceptor)))
+
 	if !tracingEnabled {
 		return
 	}
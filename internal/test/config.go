@@ -132,33 +132,43 @@ func WriteConfig(cfg *config.Dendrite, configDir string) error {
 }
 
 // NewMatrixKey generates a new ed25519 matrix server key and writes it to a file.
-func NewMatrixKey(matrixKeyPath string) (err error) {
+func NewMatrixKey(matrixKeyPath string) error {
+	_, err := GenerateMatrixKey(matrixKeyPath)
+	return err
+}
+
+// GenerateMatrixKey generates a new ed25519 matrix server key, writes it to a
+// file and returns the ID of the key.
+func GenerateMatrixKey(matrixKeyPath string) (_ gomatrixserverlib.KeyID, err error) {
 	var data [35]byte
 	_, err = rand.Read(data[:])
 	if err != nil {
-		return err
+		return "", err
 	}
 	keyOut, err := os.OpenFile(matrixKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer (func() {
-		err = keyOut.Close()
+		if closeErr := keyOut.Close(); err == nil {
+			err = closeErr
+		}
 	})()
 
 	keyID := base64.RawURLEncoding.EncodeToString(data[:])
 	keyID = strings.ReplaceAll(keyID, "-", "")
 	keyID = strings.ReplaceAll(keyID, "_", "")
+	fullKeyID := gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:%s", keyID[:6]))
 
 	err = pem.Encode(keyOut, &pem.Block{
 		Type: "MATRIX PRIVATE KEY",
 		Headers: map[string]string{
-			"Key-ID": fmt.Sprintf("ed25519:%s", keyID[:6]),
+			"Key-ID": string(fullKeyID),
 		},
 		Bytes: data[3:],
 	})
-	return err
+	return fullKeyID, err
 }
 
 const certificateDuration = time.Hour * 24 * 365 * 10
@@ -22,6 +22,10 @@ import (
 // DefaultCleanupPeriod represents the default time duration after which cacheCleanService runs.
 const DefaultCleanupPeriod time.Duration = 30 * time.Minute
 
+// DefaultMaxEntries is the default number of entries after which the cache is
+// cycled early, so that the cache holds at most twice this many entries.
+const DefaultMaxEntries = 10000
+
 type txnsMap map[CacheKey]*util.JSONResponse
 
 // CacheKey is the type for the key in a transactions cache.
@@ -33,11 +37,13 @@ type CacheKey struct {
 
 // Cache represents a temporary store for response entries.
 // Entries are evicted after a certain period, defined by cleanupPeriod.
-// This works by keeping two maps of entries, and cycling the maps after the cleanupPeriod.
+// This works by keeping two maps of entries, and cycling the maps after the cleanupPeriod,
+// or sooner if the front map reaches maxEntries.
 type Cache struct {
 	sync.RWMutex
 	txnsMaps      [2]txnsMap
 	cleanupPeriod time.Duration
+	maxEntries    int
 }
 
 // New is a wrapper which calls NewWithCleanupPeriod with DefaultCleanupPeriod as argument.
@@ -51,6 +57,7 @@ func New() *Cache {
 func NewWithCleanupPeriod(cleanupPeriod time.Duration) *Cache {
 	t := Cache{txnsMaps: [2]txnsMap{make(txnsMap), make(txnsMap)}}
 	t.cleanupPeriod = cleanupPeriod
+	t.maxEntries = DefaultMaxEntries
 
 	// Start clean service as the Cache is created
 	go cacheCleanService(&t)
@@ -73,14 +80,24 @@ func (t *Cache) FetchTransaction(accessToken, txnID string) (*util.JSONResponse,
 }
 
 // AddTransaction adds an entry for the (accessToken, txnID) tuple in Cache.
-// Adds to the front txnMap.
+// Adds to the front txnMap, cycling the txnMaps first if the front txnMap is full.
 func (t *Cache) AddTransaction(accessToken, txnID string, res *util.JSONResponse) {
 	t.Lock()
 	defer t.Unlock()
 
+	if len(t.txnsMaps[0]) >= t.maxEntries {
+		t.cycle()
+	}
 	t.txnsMaps[0][CacheKey{accessToken, txnID}] = res
 }
 
+// cycle moves the front txnMap to the back, dropping the old back txnMap.
+// The caller must hold the lock.
+func (t *Cache) cycle() {
+	t.txnsMaps[1] = t.txnsMaps[0]
+	t.txnsMaps[0] = make(txnsMap)
+}
+
 // cacheCleanService is responsible for cleaning up entries after cleanupPeriod.
 // It guarantees that an entry will be present in cache for at least cleanupPeriod & at most 2 * cleanupPeriod.
 // This cycles the txnMaps forward, i.e. back map is assigned the front and front is assigned an empty map.
@@ -88,8 +105,7 @@ func cacheCleanService(t *Cache) {
 	ticker := time.NewTicker(t.cleanupPeriod).C
 	for range ticker {
 		t.Lock()
-		t.txnsMaps[1] = t.txnsMaps[0]
-		t.txnsMaps[0] = make(txnsMap)
+		t.cycle()
 		t.Unlock()
 	}
 }
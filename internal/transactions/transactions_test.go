@@ -57,6 +57,31 @@ func TestCache(t *testing.T) {
 	}
 }
 
+// TestCacheMaxEntries ensures that the cache doesn't grow without bound.
+func TestCacheMaxEntries(t *testing.T) {
+	cache := New()
+	cache.maxEntries = 2
+	cache.AddTransaction(fakeAccessToken, "txn1", fakeResponse)
+	cache.AddTransaction(fakeAccessToken, "txn2", fakeResponse)
+	cache.AddTransaction(fakeAccessToken, "txn3", fakeResponse)
+
+	// txn1 and txn2 were cycled to the back map, so are still available.
+	for _, txnID := range []string{"txn1", "txn2", "txn3"} {
+		if _, ok := cache.FetchTransaction(fakeAccessToken, txnID); !ok {
+			t.Errorf("failed to retrieve entry for (%s, %s)", fakeAccessToken, txnID)
+		}
+	}
+
+	cache.AddTransaction(fakeAccessToken, "txn4", fakeResponse)
+	cache.AddTransaction(fakeAccessToken, "txn5", fakeResponse)
+	if _, ok := cache.FetchTransaction(fakeAccessToken, "txn1"); ok {
+		t.Errorf("entry for (%s, %s) should have been evicted", fakeAccessToken, "txn1")
+	}
+	if _, ok := cache.FetchTransaction(fakeAccessToken, "txn5"); !ok {
+		t.Errorf("failed to retrieve entry for (%s, %s)", fakeAccessToken, "txn5")
+	}
+}
+
 // TestCacheScope ensures transactions with the same transaction ID are not shared
 // across multiple access tokens.
 func TestCacheScope(t *testing.T) {
@@ -2,7 +2,11 @@ package internal
 
 import (
 	"fmt"
+	"runtime"
 	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // the final version string
@@ -14,6 +18,9 @@ var branch string
 // -ldflags "-X github.com/matrix-org/dendrite/internal.build=alpha"
 var build string
 
+// -ldflags "-X github.com/matrix-org/dendrite/internal.commit=0123abc"
+var commit string
+
 const (
 	VersionMajor = 0
 	VersionMinor = 1
@@ -21,10 +28,38 @@ const (
 	VersionTag   = "" // example: "rc1"
 )
 
+// BuildInfo describes the build of Dendrite that is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Branch    string `json:"branch"`
+	GoVersion string `json:"go_version"`
+}
+
+var buildInfoGauge = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Name:      "build_info",
+		Help:      "Always 1, labelled with the version of Dendrite that is running",
+	},
+	[]string{"version", "commit", "branch", "go_version"},
+)
+
 func VersionString() string {
 	return version
 }
 
+// GetBuildInfo returns information about the running build, as set by
+// ldflags at build time.
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Branch:    branch,
+		GoVersion: runtime.Version(),
+	}
+}
+
 func init() {
 	version = fmt.Sprintf("%d.%d.%d", VersionMajor, VersionMinor, VersionPatch)
 	if VersionTag != "" {
@@ -40,4 +75,7 @@ func init() {
 	if len(parts) > 0 {
 		version += "+" + strings.Join(parts, ".")
 	}
+
+	info := GetBuildInfo()
+	buildInfoGauge.WithLabelValues(info.Version, info.Commit, info.Branch, info.GoVersion).Set(1)
 }
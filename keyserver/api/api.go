@@ -30,10 +30,16 @@ type KeyInternalAPI interface {
 	// InputDeviceListUpdate from a federated server EDU
 	InputDeviceListUpdate(ctx context.Context, req *InputDeviceListUpdateRequest, res *InputDeviceListUpdateResponse)
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
+	// PerformUploadCrossSigningKeys stores a user's cross-signing keys
+	PerformUploadCrossSigningKeys(ctx context.Context, req *PerformUploadCrossSigningKeysRequest, res *PerformUploadCrossSigningKeysResponse)
+	// PerformUploadDeviceSignatures adds signatures made with cross-signing or device keys to a user's keys
+	PerformUploadDeviceSignatures(ctx context.Context, req *PerformUploadDeviceSignaturesRequest, res *PerformUploadDeviceSignaturesResponse)
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
+	// PerformTrimKeyChanges removes key changes which no client needs to be told about any more
+	PerformTrimKeyChanges(ctx context.Context, req *PerformTrimKeyChangesRequest, res *PerformTrimKeyChangesResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
 	QueryDeviceMessages(ctx context.Context, req *QueryDeviceMessagesRequest, res *QueryDeviceMessagesResponse)
 }
@@ -41,6 +47,11 @@ type KeyInternalAPI interface {
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
 	Err string
+	// Set if the keys or signatures given were invalid, rather than the
+	// server failing to process them
+	IsInvalidParam bool
+	// Set if a signature didn't verify
+	IsInvalidSignature bool
 }
 
 func (k *KeyError) Error() string {
@@ -134,6 +145,57 @@ func (r *PerformUploadKeysResponse) KeyError(userID, deviceID string, err *KeyEr
 	r.KeyErrors[userID][deviceID] = err
 }
 
+// The purposes of cross-signing keys, which are also the key types stored for
+// each user.
+const (
+	CrossSigningKeyPurposeMaster      = "master"
+	CrossSigningKeyPurposeSelfSigning = "self_signing"
+	CrossSigningKeyPurposeUserSigning = "user_signing"
+)
+
+// PerformUploadCrossSigningKeysRequest is the request to PerformUploadCrossSigningKeys
+type PerformUploadCrossSigningKeysRequest struct {
+	// The local user uploading the keys
+	UserID string
+	// Map of key purpose, e.g. "master", to key JSON. Keys which aren't
+	// given are left unchanged.
+	Keys map[string]json.RawMessage
+}
+
+// PerformUploadCrossSigningKeysResponse is the response to PerformUploadCrossSigningKeys
+type PerformUploadCrossSigningKeysResponse struct {
+	// Set if the keys were invalid or couldn't be stored
+	Error *KeyError
+}
+
+// PerformUploadDeviceSignaturesRequest is the request to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesRequest struct {
+	// The local user uploading the signatures
+	UserID string
+	// Map of user_id to key ID to the signed key JSON. The key ID is a
+	// device ID for device keys, or the public key for cross-signing keys.
+	Signatures map[string]map[string]json.RawMessage
+}
+
+// PerformUploadDeviceSignaturesResponse is the response to PerformUploadDeviceSignatures
+type PerformUploadDeviceSignaturesResponse struct {
+	// A fatal error when processing e.g database failures
+	Error *KeyError
+	// A map of user_id -> key ID -> Error for signatures which weren't stored
+	Failures map[string]map[string]*KeyError
+}
+
+// Failure sets a failure for the given key
+func (r *PerformUploadDeviceSignaturesResponse) Failure(userID, keyID string, err *KeyError) {
+	if r.Failures == nil {
+		r.Failures = make(map[string]map[string]*KeyError)
+	}
+	if r.Failures[userID] == nil {
+		r.Failures[userID] = make(map[string]*KeyError)
+	}
+	r.Failures[userID][keyID] = err
+}
+
 type PerformClaimKeysRequest struct {
 	// Map of user_id to device_id to algorithm name
 	OneTimeKeys map[string]map[string]string
@@ -150,6 +212,9 @@ type PerformClaimKeysResponse struct {
 }
 
 type QueryKeysRequest struct {
+	// The user making the query, who also gets their own user-signing key
+	// back. Empty for queries over federation.
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -160,6 +225,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key, for local users who have them
+	MasterKeys      map[string]json.RawMessage
+	SelfSigningKeys map[string]json.RawMessage
+	UserSigningKeys map[string]json.RawMessage
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
@@ -185,6 +254,18 @@ type QueryKeyChangesResponse struct {
 	Error *KeyError
 }
 
+type PerformTrimKeyChangesRequest struct {
+	// The partition to trim
+	Partition int32
+	// The inclusive offset to trim key changes up to.
+	ToOffset int64
+}
+
+type PerformTrimKeyChangesResponse struct {
+	// Set if there was a problem handling the request.
+	Error *KeyError
+}
+
 type QueryOneTimeKeysRequest struct {
 	// The local user to query OTK counts for
 	UserID string
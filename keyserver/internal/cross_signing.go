@@ -0,0 +1,363 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// crossSigningKey is the JSON of a master, self-signing or user-signing key.
+// Signatures are checked against the raw JSON, so they aren't needed here.
+type crossSigningKey struct {
+	UserID string            `json:"user_id"`
+	Usage  []string          `json:"usage"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// signedKey is the part of a device or cross-signing key which holds its
+// public keys and signatures.
+type signedKey struct {
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// parseCrossSigningKey checks that the key JSON is a key for the given purpose
+// belonging to the user, and returns its key ID and base64 public key.
+func parseCrossSigningKey(userID, purpose string, keyJSON json.RawMessage) (keyID, publicKey string, err error) {
+	var key crossSigningKey
+	if err = json.Unmarshal(keyJSON, &key); err != nil {
+		return "", "", fmt.Errorf("%s key is not valid JSON: %w", purpose, err)
+	}
+	if key.UserID != userID {
+		return "", "", fmt.Errorf("%s key has user_id %q, want %q", purpose, key.UserID, userID)
+	}
+	hasUsage := false
+	for _, usage := range key.Usage {
+		if usage == purpose {
+			hasUsage = true
+		}
+	}
+	if !hasUsage {
+		return "", "", fmt.Errorf("%s key does not have usage %q", purpose, purpose)
+	}
+	if len(key.Keys) != 1 {
+		return "", "", fmt.Errorf("%s key must contain exactly one key, got %d", purpose, len(key.Keys))
+	}
+	for id, pub := range key.Keys {
+		keyID, publicKey = id, pub
+	}
+	if keyID != "ed25519:"+publicKey {
+		return "", "", fmt.Errorf("%s key ID %q must be the ed25519 public key", purpose, keyID)
+	}
+	return keyID, publicKey, nil
+}
+
+// verifyKeySignature checks that the signed JSON has a valid signature from
+// the given user's ed25519 key.
+func verifyKeySignature(userID, keyID, publicKey string, signed []byte) error {
+	pub, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(publicKey, "="))
+	if err != nil {
+		return fmt.Errorf("public key %s is not valid base64: %w", keyID, err)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key %s is not an ed25519 key", keyID)
+	}
+	return gomatrixserverlib.VerifyJSON(userID, gomatrixserverlib.KeyID(keyID), ed25519.PublicKey(pub), signed)
+}
+
+// addKeySignatures copies the signer's signatures from the signed JSON into
+// the stored key JSON, keeping any signatures which are already there.
+func addKeySignatures(stored, signed json.RawMessage, signerUserID string) (json.RawMessage, error) {
+	var storedKey, signedKey map[string]json.RawMessage
+	if err := json.Unmarshal(stored, &storedKey); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(signed, &signedKey); err != nil {
+		return nil, err
+	}
+	var storedSigs, signedSigs map[string]map[string]string
+	if raw, ok := storedKey["signatures"]; ok {
+		if err := json.Unmarshal(raw, &storedSigs); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := signedKey["signatures"]; ok {
+		if err := json.Unmarshal(raw, &signedSigs); err != nil {
+			return nil, err
+		}
+	}
+	if len(signedSigs[signerUserID]) == 0 {
+		return nil, fmt.Errorf("no signatures from %s", signerUserID)
+	}
+	if storedSigs == nil {
+		storedSigs = make(map[string]map[string]string)
+	}
+	if storedSigs[signerUserID] == nil {
+		storedSigs[signerUserID] = make(map[string]string)
+	}
+	for keyID, sig := range signedSigs[signerUserID] {
+		storedSigs[signerUserID][keyID] = sig
+	}
+	sigsJSON, err := json.Marshal(storedSigs)
+	if err != nil {
+		return nil, err
+	}
+	storedKey["signatures"] = sigsJSON
+	return json.Marshal(storedKey)
+}
+
+func (a *KeyInternalAPI) PerformUploadCrossSigningKeys(ctx context.Context, req *api.PerformUploadCrossSigningKeysRequest, res *api.PerformUploadCrossSigningKeysResponse) {
+	_, serverName, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || serverName != a.ThisServer {
+		res.Error = &api.KeyError{
+			Err:            fmt.Sprintf("cannot upload cross-signing keys for %s", req.UserID),
+			IsInvalidParam: true,
+		}
+		return
+	}
+	if len(req.Keys) == 0 {
+		return
+	}
+	existing, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+		return
+	}
+
+	// the other keys are signed by the master key, which is either being
+	// uploaded along with them or which we already have
+	masterJSON, ok := req.Keys[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		masterJSON = existing[api.CrossSigningKeyPurposeMaster]
+	}
+	var masterKeyID, masterPublicKey string
+	if masterJSON != nil {
+		masterKeyID, masterPublicKey, err = parseCrossSigningKey(req.UserID, api.CrossSigningKeyPurposeMaster, masterJSON)
+		if err != nil {
+			res.Error = &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+			return
+		}
+	}
+	for purpose, keyJSON := range req.Keys {
+		switch purpose {
+		case api.CrossSigningKeyPurposeMaster:
+			continue
+		case api.CrossSigningKeyPurposeSelfSigning, api.CrossSigningKeyPurposeUserSigning:
+		default:
+			res.Error = &api.KeyError{
+				Err:            fmt.Sprintf("unknown cross-signing key purpose %q", purpose),
+				IsInvalidParam: true,
+			}
+			return
+		}
+		if _, _, err = parseCrossSigningKey(req.UserID, purpose, keyJSON); err != nil {
+			res.Error = &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+			return
+		}
+		if masterJSON == nil {
+			res.Error = &api.KeyError{
+				Err:            fmt.Sprintf("%s key cannot be uploaded without a master key", purpose),
+				IsInvalidParam: true,
+			}
+			return
+		}
+		if err = verifyKeySignature(req.UserID, masterKeyID, masterPublicKey, keyJSON); err != nil {
+			res.Error = &api.KeyError{
+				Err:                fmt.Sprintf("%s key is not signed by the master key: %s", purpose, err),
+				IsInvalidSignature: true,
+			}
+			return
+		}
+	}
+
+	if err = a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, req.Keys); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+	}
+}
+
+func (a *KeyInternalAPI) PerformUploadDeviceSignatures(ctx context.Context, req *api.PerformUploadDeviceSignaturesRequest, res *api.PerformUploadDeviceSignaturesResponse) {
+	crossSigningKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+		return
+	}
+	var masterPublicKey, selfSigningKeyID, selfSigningPublicKey string
+	if keyJSON, ok := crossSigningKeys[api.CrossSigningKeyPurposeMaster]; ok {
+		_, masterPublicKey, _ = parseCrossSigningKey(req.UserID, api.CrossSigningKeyPurposeMaster, keyJSON)
+	}
+	if keyJSON, ok := crossSigningKeys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+		selfSigningKeyID, selfSigningPublicKey, _ = parseCrossSigningKey(req.UserID, api.CrossSigningKeyPurposeSelfSigning, keyJSON)
+	}
+
+	for userID, keys := range req.Signatures {
+		for keyID, signed := range keys {
+			if userID != req.UserID {
+				// Signatures made with a user-signing key are only visible to
+				// the user who made them, which needs per-signer storage.
+				res.Failure(userID, keyID, &api.KeyError{
+					Err:            "signing other users' keys is not supported",
+					IsInvalidParam: true,
+				})
+				continue
+			}
+			var keyErr *api.KeyError
+			if masterPublicKey != "" && keyID == masterPublicKey {
+				keyErr = a.signMasterKey(ctx, req.UserID, crossSigningKeys[api.CrossSigningKeyPurposeMaster], signed)
+			} else {
+				keyErr = a.signDeviceKey(ctx, req.UserID, keyID, selfSigningKeyID, selfSigningPublicKey, signed)
+			}
+			if keyErr != nil {
+				res.Failure(userID, keyID, keyErr)
+			}
+		}
+	}
+}
+
+// signMasterKey stores signatures made on the user's master key by their own
+// devices, so that other devices can trust the master key.
+func (a *KeyInternalAPI) signMasterKey(ctx context.Context, userID string, stored, signed json.RawMessage) *api.KeyError {
+	merged, err := addKeySignatures(stored, signed, userID)
+	if err != nil {
+		return &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+	}
+	var signedBy signedKey
+	if err = json.Unmarshal(signed, &signedBy); err != nil {
+		return &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+	}
+	// every signature by the user must be from one of their devices
+	for sigKeyID := range signedBy.Signatures[userID] {
+		deviceID := strings.TrimPrefix(sigKeyID, "ed25519:")
+		if deviceID == sigKeyID {
+			return &api.KeyError{Err: fmt.Sprintf("unknown signing key %s", sigKeyID), IsInvalidSignature: true}
+		}
+		devices, err := a.DB.DeviceKeysForUser(ctx, userID, []string{deviceID})
+		if err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to query device keys: %s", err)}
+		}
+		if len(devices) == 0 || len(devices[0].KeyJSON) == 0 {
+			return &api.KeyError{Err: fmt.Sprintf("unknown device %s", deviceID), IsInvalidSignature: true}
+		}
+		var deviceKey signedKey
+		if err = json.Unmarshal(devices[0].KeyJSON, &deviceKey); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to parse device key %s: %s", deviceID, err)}
+		}
+		devicePublicKey := deviceKey.Keys[sigKeyID]
+		if err = verifyKeySignature(userID, sigKeyID, devicePublicKey, merged); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("invalid signature from %s: %s", sigKeyID, err), IsInvalidSignature: true}
+		}
+	}
+	err = a.DB.StoreCrossSigningKeysForUser(ctx, userID, map[string]json.RawMessage{
+		api.CrossSigningKeyPurposeMaster: merged,
+	})
+	if err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("failed to store master key: %s", err)}
+	}
+	return nil
+}
+
+// signDeviceKey stores a self-signing key signature on one of the user's
+// device keys, and tells other users that the device keys have changed.
+func (a *KeyInternalAPI) signDeviceKey(ctx context.Context, userID, deviceID, selfSigningKeyID, selfSigningPublicKey string, signed json.RawMessage) *api.KeyError {
+	devices, err := a.DB.DeviceKeysForUser(ctx, userID, []string{deviceID})
+	if err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("failed to query device keys: %s", err)}
+	}
+	if len(devices) == 0 || len(devices[0].KeyJSON) == 0 {
+		return &api.KeyError{Err: fmt.Sprintf("unknown key %s", deviceID), IsInvalidParam: true}
+	}
+	if selfSigningKeyID == "" {
+		return &api.KeyError{Err: "no self-signing key has been uploaded", IsInvalidSignature: true}
+	}
+	// only keep the self-signing signature
+	var signedBy signedKey
+	if err = json.Unmarshal(signed, &signedBy); err != nil {
+		return &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+	}
+	sig := signedBy.Signatures[userID][selfSigningKeyID]
+	if sig == "" {
+		return &api.KeyError{Err: "device key is not signed by the self-signing key", IsInvalidSignature: true}
+	}
+	selfSigned, err := json.Marshal(map[string]interface{}{
+		"signatures": map[string]map[string]string{
+			userID: {selfSigningKeyID: sig},
+		},
+	})
+	if err != nil {
+		return &api.KeyError{Err: err.Error()}
+	}
+	existing := devices[0]
+	merged, err := addKeySignatures(existing.KeyJSON, selfSigned, userID)
+	if err != nil {
+		return &api.KeyError{Err: err.Error(), IsInvalidParam: true}
+	}
+	if err = verifyKeySignature(userID, selfSigningKeyID, selfSigningPublicKey, merged); err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("invalid self-signing signature: %s", err), IsInvalidSignature: true}
+	}
+	updated := existing
+	updated.KeyJSON = merged
+	keysToStore := []api.DeviceMessage{updated}
+	if err = a.DB.StoreLocalDeviceKeys(ctx, keysToStore); err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("failed to store device keys: %s", err)}
+	}
+	if err = emitDeviceKeyChanges(a.Producer, []api.DeviceMessage{existing}, keysToStore); err != nil {
+		util.GetLogger(ctx).Errorf("Failed to emitDeviceKeyChanges: %s", err)
+	}
+	return nil
+}
+
+// crossSigningKeysFromDatabase adds a local user's cross-signing keys to the
+// response. The user-signing key is only given to the user it belongs to.
+func (a *KeyInternalAPI) crossSigningKeysFromDatabase(
+	ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse, userID string,
+) error {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if key, ok := keys[api.CrossSigningKeyPurposeMaster]; ok {
+		if res.MasterKeys == nil {
+			res.MasterKeys = make(map[string]json.RawMessage)
+		}
+		res.MasterKeys[userID] = key
+	}
+	if key, ok := keys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+		if res.SelfSigningKeys == nil {
+			res.SelfSigningKeys = make(map[string]json.RawMessage)
+		}
+		res.SelfSigningKeys[userID] = key
+	}
+	if key, ok := keys[api.CrossSigningKeyPurposeUserSigning]; ok && userID == req.UserID {
+		if res.UserSigningKeys == nil {
+			res.UserSigningKeys = make(map[string]json.RawMessage)
+		}
+		res.UserSigningKeys[userID] = key
+	}
+	return nil
+}
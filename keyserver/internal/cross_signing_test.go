@@ -0,0 +1,372 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const crossSigningUser = "@alice:kaer.morhen"
+
+type mockCrossSigningDatabase struct {
+	storage.Database
+	crossSigningKeys map[string]map[string]json.RawMessage
+	deviceKeys       map[string]map[string]json.RawMessage
+	keyChanges       int
+}
+
+func (d *mockCrossSigningDatabase) CrossSigningKeysForUser(ctx context.Context, userID string) (map[string]json.RawMessage, error) {
+	keys := make(map[string]json.RawMessage)
+	for keyType, keyData := range d.crossSigningKeys[userID] {
+		keys[keyType] = keyData
+	}
+	return keys, nil
+}
+
+func (d *mockCrossSigningDatabase) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[string]json.RawMessage) error {
+	if d.crossSigningKeys[userID] == nil {
+		d.crossSigningKeys[userID] = make(map[string]json.RawMessage)
+	}
+	for keyType, keyData := range keys {
+		d.crossSigningKeys[userID][keyType] = keyData
+	}
+	return nil
+}
+
+func (d *mockCrossSigningDatabase) DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error) {
+	var result []api.DeviceMessage
+	for deviceID, keyJSON := range d.deviceKeys[userID] {
+		wanted := len(deviceIDs) == 0
+		for _, wantID := range deviceIDs {
+			wanted = wanted || wantID == deviceID
+		}
+		if wanted {
+			result = append(result, api.DeviceMessage{
+				DeviceKeys: api.DeviceKeys{UserID: userID, DeviceID: deviceID, KeyJSON: keyJSON},
+			})
+		}
+	}
+	return result, nil
+}
+
+func (d *mockCrossSigningDatabase) StoreLocalDeviceKeys(ctx context.Context, keys []api.DeviceMessage) error {
+	for _, key := range keys {
+		d.deviceKeys[key.UserID][key.DeviceID] = key.KeyJSON
+	}
+	return nil
+}
+
+func (d *mockCrossSigningDatabase) StoreKeyChange(ctx context.Context, partition int32, offset int64, userID string) error {
+	d.keyChanges++
+	return nil
+}
+
+type mockSyncProducer struct {
+	sarama.SyncProducer
+}
+
+func (p *mockSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, nil
+}
+
+type mockDeviceInfosUserAPI struct {
+	userapi.UserInternalAPI
+}
+
+func (u *mockDeviceInfosUserAPI) QueryDeviceInfos(ctx context.Context, req *userapi.QueryDeviceInfosRequest, res *userapi.QueryDeviceInfosResponse) error {
+	return nil
+}
+
+type testSigningKey struct {
+	keyID   string
+	public  string
+	private ed25519.PrivateKey
+}
+
+func newTestSigningKey(seed byte, keyID string) testSigningKey {
+	s := make([]byte, ed25519.SeedSize)
+	s[0] = seed
+	private := ed25519.NewKeyFromSeed(s)
+	public := base64.RawStdEncoding.EncodeToString(private.Public().(ed25519.PublicKey))
+	if keyID == "" {
+		keyID = "ed25519:" + public
+	}
+	return testSigningKey{keyID: keyID, public: public, private: private}
+}
+
+func mustSignKey(t *testing.T, key interface{}, signers ...testSigningKey) json.RawMessage {
+	t.Helper()
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	for _, signer := range signers {
+		keyJSON, err = gomatrixserverlib.SignJSON(crossSigningUser, gomatrixserverlib.KeyID(signer.keyID), signer.private, keyJSON)
+		if err != nil {
+			t.Fatalf("failed to sign key: %s", err)
+		}
+	}
+	return keyJSON
+}
+
+func crossSigningKeyJSON(t *testing.T, purpose string, key testSigningKey, signers ...testSigningKey) json.RawMessage {
+	t.Helper()
+	return mustSignKey(t, map[string]interface{}{
+		"user_id": crossSigningUser,
+		"usage":   []string{purpose},
+		"keys":    map[string]string{key.keyID: key.public},
+	}, signers...)
+}
+
+func newCrossSigningTestAPI(db *mockCrossSigningDatabase) *KeyInternalAPI {
+	return &KeyInternalAPI{
+		DB:         db,
+		ThisServer: "kaer.morhen",
+		UserAPI:    &mockDeviceInfosUserAPI{},
+		Producer:   &producers.KeyChange{Producer: &mockSyncProducer{}, DB: db},
+	}
+}
+
+func TestPerformUploadCrossSigningKeys(t *testing.T) {
+	master := newTestSigningKey(1, "")
+	selfSigning := newTestSigningKey(2, "")
+	other := newTestSigningKey(3, "")
+
+	for _, tt := range []struct {
+		name         string
+		existing     map[string]json.RawMessage
+		keys         map[string]json.RawMessage
+		wantInvalid  bool
+		wantBadSig   bool
+		wantKeyTypes int
+	}{
+		{
+			name: "master and self-signing keys",
+			keys: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeMaster:      crossSigningKeyJSON(t, api.CrossSigningKeyPurposeMaster, master),
+				api.CrossSigningKeyPurposeSelfSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, selfSigning, master),
+			},
+			wantKeyTypes: 2,
+		},
+		{
+			name: "self-signing key signed by the stored master key",
+			existing: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeMaster: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeMaster, master),
+			},
+			keys: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeSelfSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, selfSigning, master),
+			},
+			wantKeyTypes: 2,
+		},
+		{
+			name: "self-signing key not signed by the master key",
+			keys: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeMaster:      crossSigningKeyJSON(t, api.CrossSigningKeyPurposeMaster, master),
+				api.CrossSigningKeyPurposeSelfSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, selfSigning, other),
+			},
+			wantBadSig: true,
+		},
+		{
+			name: "self-signing key without a master key",
+			keys: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeSelfSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, selfSigning, master),
+			},
+			wantInvalid: true,
+		},
+		{
+			name: "master key with the wrong usage",
+			keys: map[string]json.RawMessage{
+				api.CrossSigningKeyPurposeMaster: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, master),
+			},
+			wantInvalid: true,
+		},
+	} {
+		db := &mockCrossSigningDatabase{crossSigningKeys: map[string]map[string]json.RawMessage{
+			crossSigningUser: tt.existing,
+		}}
+		a := newCrossSigningTestAPI(db)
+		var res api.PerformUploadCrossSigningKeysResponse
+		a.PerformUploadCrossSigningKeys(ctx, &api.PerformUploadCrossSigningKeysRequest{
+			UserID: crossSigningUser,
+			Keys:   tt.keys,
+		}, &res)
+		if tt.wantInvalid || tt.wantBadSig {
+			if res.Error == nil || res.Error.IsInvalidParam != tt.wantInvalid || res.Error.IsInvalidSignature != tt.wantBadSig {
+				t.Errorf("%s: got error %+v, want invalid param %v, invalid signature %v", tt.name, res.Error, tt.wantInvalid, tt.wantBadSig)
+			}
+			if len(db.crossSigningKeys[crossSigningUser]) != len(tt.existing) {
+				t.Errorf("%s: rejected keys were stored", tt.name)
+			}
+			continue
+		}
+		if res.Error != nil {
+			t.Errorf("%s: got error %s", tt.name, res.Error)
+			continue
+		}
+		if got := len(db.crossSigningKeys[crossSigningUser]); got != tt.wantKeyTypes {
+			t.Errorf("%s: got %d stored keys, want %d", tt.name, got, tt.wantKeyTypes)
+		}
+	}
+}
+
+func TestPerformUploadDeviceSignatures(t *testing.T) {
+	master := newTestSigningKey(1, "")
+	selfSigning := newTestSigningKey(2, "")
+	device := newTestSigningKey(3, "ed25519:DEVICE")
+	other := newTestSigningKey(4, "")
+
+	deviceKey := map[string]interface{}{
+		"user_id":    crossSigningUser,
+		"device_id":  "DEVICE",
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2"},
+		"keys":       map[string]string{device.keyID: device.public},
+	}
+	masterKey := map[string]interface{}{
+		"user_id": crossSigningUser,
+		"usage":   []string{api.CrossSigningKeyPurposeMaster},
+		"keys":    map[string]string{master.keyID: master.public},
+	}
+	newDB := func() *mockCrossSigningDatabase {
+		return &mockCrossSigningDatabase{
+			crossSigningKeys: map[string]map[string]json.RawMessage{
+				crossSigningUser: {
+					api.CrossSigningKeyPurposeMaster:      mustSignKey(t, masterKey),
+					api.CrossSigningKeyPurposeSelfSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeSelfSigning, selfSigning, master),
+				},
+			},
+			deviceKeys: map[string]map[string]json.RawMessage{
+				crossSigningUser: {"DEVICE": mustSignKey(t, deviceKey, device)},
+			},
+		}
+	}
+	upload := func(db *mockCrossSigningDatabase, userID, keyID string, signed json.RawMessage) *api.PerformUploadDeviceSignaturesResponse {
+		var res api.PerformUploadDeviceSignaturesResponse
+		newCrossSigningTestAPI(db).PerformUploadDeviceSignatures(ctx, &api.PerformUploadDeviceSignaturesRequest{
+			UserID:     crossSigningUser,
+			Signatures: map[string]map[string]json.RawMessage{userID: {keyID: signed}},
+		}, &res)
+		if res.Error != nil {
+			t.Fatalf("PerformUploadDeviceSignatures failed: %s", res.Error)
+		}
+		return &res
+	}
+	hasSignature := func(keyJSON json.RawMessage, keyID string) bool {
+		var key signedKey
+		if err := json.Unmarshal(keyJSON, &key); err != nil {
+			t.Fatalf("failed to parse stored key: %s", err)
+		}
+		return key.Signatures[crossSigningUser][keyID] != ""
+	}
+
+	// a device key signed by the self-signing key
+	db := newDB()
+	res := upload(db, crossSigningUser, "DEVICE", mustSignKey(t, deviceKey, device, selfSigning))
+	if len(res.Failures) != 0 {
+		t.Fatalf("signing a device key: got failures %+v", res.Failures)
+	}
+	stored := db.deviceKeys[crossSigningUser]["DEVICE"]
+	if !hasSignature(stored, selfSigning.keyID) || !hasSignature(stored, device.keyID) {
+		t.Errorf("signing a device key: stored key %s is missing signatures", stored)
+	}
+	if db.keyChanges != 1 {
+		t.Errorf("signing a device key: got %d key changes, want 1", db.keyChanges)
+	}
+
+	// a device key signed by some other key
+	db = newDB()
+	res = upload(db, crossSigningUser, "DEVICE", mustSignKey(t, deviceKey, device, other))
+	if res.Failures[crossSigningUser]["DEVICE"] == nil {
+		t.Errorf("signing a device key with an unknown key: got no failure")
+	}
+	if hasSignature(db.deviceKeys[crossSigningUser]["DEVICE"], other.keyID) {
+		t.Errorf("signing a device key with an unknown key: the signature was stored")
+	}
+
+	// a device key whose content doesn't match the stored key
+	db = newDB()
+	changed := map[string]interface{}{}
+	for k, v := range deviceKey {
+		changed[k] = v
+	}
+	changed["algorithms"] = []string{"m.megolm.v1.aes-sha2"}
+	res = upload(db, crossSigningUser, "DEVICE", mustSignKey(t, changed, selfSigning))
+	if failure := res.Failures[crossSigningUser]["DEVICE"]; failure == nil || !failure.IsInvalidSignature {
+		t.Errorf("signing a different device key: got failure %+v, want an invalid signature", failure)
+	}
+
+	// the master key signed by one of the user's devices
+	db = newDB()
+	res = upload(db, crossSigningUser, master.public, mustSignKey(t, masterKey, device))
+	if len(res.Failures) != 0 {
+		t.Fatalf("signing the master key: got failures %+v", res.Failures)
+	}
+	if !hasSignature(db.crossSigningKeys[crossSigningUser][api.CrossSigningKeyPurposeMaster], device.keyID) {
+		t.Errorf("signing the master key: the device signature was not stored")
+	}
+
+	// another user's key
+	db = newDB()
+	res = upload(db, "@bob:kaer.morhen", "BOBDEVICE", mustSignKey(t, deviceKey, selfSigning))
+	if res.Failures["@bob:kaer.morhen"]["BOBDEVICE"] == nil {
+		t.Errorf("signing another user's key: got no failure")
+	}
+}
+
+func TestQueryKeysCrossSigning(t *testing.T) {
+	master := newTestSigningKey(1, "")
+	userSigning := newTestSigningKey(2, "")
+	db := &mockCrossSigningDatabase{
+		crossSigningKeys: map[string]map[string]json.RawMessage{
+			crossSigningUser: {
+				api.CrossSigningKeyPurposeMaster:      crossSigningKeyJSON(t, api.CrossSigningKeyPurposeMaster, master),
+				api.CrossSigningKeyPurposeUserSigning: crossSigningKeyJSON(t, api.CrossSigningKeyPurposeUserSigning, userSigning, master),
+			},
+		},
+	}
+	a := newCrossSigningTestAPI(db)
+	for _, tt := range []struct {
+		requester       string
+		wantUserSigning bool
+	}{
+		{crossSigningUser, true},
+		{"@bob:kaer.morhen", false},
+	} {
+		var res api.QueryKeysResponse
+		a.QueryKeys(ctx, &api.QueryKeysRequest{
+			UserID:        tt.requester,
+			UserToDevices: map[string][]string{crossSigningUser: {}},
+		}, &res)
+		if res.Error != nil {
+			t.Fatalf("QueryKeys failed: %s", res.Error)
+		}
+		if res.MasterKeys[crossSigningUser] == nil {
+			t.Errorf("%s: master key was not returned", tt.requester)
+		}
+		if _, ok := res.UserSigningKeys[crossSigningUser]; ok != tt.wantUserSigning {
+			t.Errorf("%s: got user-signing key %v, want %v", tt.requester, ok, tt.wantUserSigning)
+		}
+	}
+}
@@ -73,6 +73,14 @@ func (a *KeyInternalAPI) QueryKeyChanges(ctx context.Context, req *api.QueryKeyC
 	res.UserIDs = userIDs
 }
 
+func (a *KeyInternalAPI) PerformTrimKeyChanges(ctx context.Context, req *api.PerformTrimKeyChangesRequest, res *api.PerformTrimKeyChangesResponse) {
+	if err := a.DB.TrimKeyChanges(ctx, req.Partition, req.ToOffset); err != nil {
+		res.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
+
 func (a *KeyInternalAPI) PerformUploadKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
 	res.KeyErrors = make(map[string]map[string]*api.KeyError)
 	a.uploadLocalDeviceKeys(ctx, req, res)
@@ -270,6 +278,13 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 				}{displayName})
 				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
 			}
+
+			if err = a.crossSigningKeysFromDatabase(ctx, req, res, userID); err != nil {
+				res.Error = &api.KeyError{
+					Err: fmt.Sprintf("failed to query local cross-signing keys: %s", err),
+				}
+				return
+			}
 		} else {
 			domainToDeviceKeys[domain] = make(map[string][]string)
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
@@ -292,10 +307,16 @@ func (a *KeyInternalAPI) remoteKeysFromDatabase(
 	fetchRemote := make(map[string]map[string][]string)
 	for domain, userToDeviceMap := range domainToDeviceKeys {
 		for userID, deviceIDs := range userToDeviceMap {
-			// we can't safely return keys from the db when all devices are requested as we don't
-			// know if one has just been added.
-			if len(deviceIDs) > 0 {
-				err := a.populateResponseWithDeviceKeysFromDatabase(ctx, res, userID, deviceIDs)
+			// The keys in the database are only current if the user's device list is being kept
+			// up to date by device list updates. Otherwise we might have missed a device being
+			// added or removed, so we have to ask the remote server.
+			isStale, err := a.DB.DeviceListIsStale(ctx, userID)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("DeviceListIsStale")
+				isStale = true
+			}
+			if !isStale {
+				err = a.populateResponseWithDeviceKeysFromDatabase(ctx, res, userID, deviceIDs)
 				if err == nil {
 					continue
 				}
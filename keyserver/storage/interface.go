@@ -67,10 +67,25 @@ type Database interface {
 	// Returns the offset of the latest key change.
 	KeyChanges(ctx context.Context, partition int32, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
 
+	// TrimKeyChanges removes the key changes up to and including the offset given. Clients whose sync
+	// tokens are older than this offset will no longer see these changes through KeyChanges.
+	TrimKeyChanges(ctx context.Context, partition int32, toOffset int64) error
+
+	// CrossSigningKeysForUser returns a map of key purpose, e.g. "master", to key JSON for the user's cross-signing keys.
+	// Returns an empty map if the user has no cross-signing keys.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[string]json.RawMessage, error)
+
+	// StoreCrossSigningKeysForUser stores the given cross-signing keys, replacing any existing keys with the same purpose.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[string]json.RawMessage) error
+
 	// StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
 	// If no domains are given, all user IDs with stale device lists are returned.
 	StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// DeviceListIsStale returns true if the remote user's device list isn't being kept up to date by device
+	// list updates, either because it has been marked as stale or because we have never fetched it.
+	DeviceListIsStale(ctx context.Context, userID string) (bool, error)
 }
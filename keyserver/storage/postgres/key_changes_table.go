@@ -48,10 +48,15 @@ const upsertKeyChangeSQL = "" +
 const selectKeyChangesSQL = "" +
 	"SELECT user_id, MAX(log_offset) FROM keyserver_key_changes WHERE partition = $1 AND log_offset > $2 AND log_offset <= $3 GROUP BY user_id"
 
+// delete the key changes up to and including the given offset, once no client needs them any more.
+const deleteKeyChangesSQL = "" +
+	"DELETE FROM keyserver_key_changes WHERE partition = $1 AND log_offset <= $2"
+
 type keyChangesStatements struct {
 	db                   *sql.DB
 	upsertKeyChangeStmt  *sql.Stmt
 	selectKeyChangesStmt *sql.Stmt
+	deleteKeyChangesStmt *sql.Stmt
 }
 
 func NewPostgresKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
@@ -68,6 +73,9 @@ func NewPostgresKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
 	if s.selectKeyChangesStmt, err = db.Prepare(selectKeyChangesSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteKeyChangesStmt, err = db.Prepare(deleteKeyChangesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -100,3 +108,8 @@ func (s *keyChangesStatements) SelectKeyChanges(
 	}
 	return
 }
+
+func (s *keyChangesStatements) DeleteKeyChanges(ctx context.Context, partition int32, toOffset int64) error {
+	_, err := s.deleteKeyChangesStmt.ExecContext(ctx, partition, toOffset)
+	return err
+}
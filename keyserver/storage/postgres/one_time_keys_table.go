@@ -55,8 +55,11 @@ const selectKeysCountSQL = "" +
 const deleteOneTimeKeySQL = "" +
 	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 AND key_id = $4"
 
+// Lock the selected key so that it can't be handed out to another claim
+// before it is deleted, and skip keys which are locked by other claims.
 const selectKeyByAlgorithmSQL = "" +
-	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
+	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1" +
+	" FOR UPDATE SKIP LOCKED"
 
 type oneTimeKeysStatements struct {
 	db                       *sql.DB
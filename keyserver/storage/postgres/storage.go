@@ -43,6 +43,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*shared.Database, error)
 	if err != nil {
 		return nil, err
 	}
+	csk, err := NewPostgresCrossSigningKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
 		DB:                    db,
 		Writer:                sqlutil.NewDummyWriter(),
@@ -50,5 +54,6 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*shared.Database, error)
 		DeviceKeysTable:       dk,
 		KeyChangesTable:       kc,
 		StaleDeviceListsTable: sdl,
+		CrossSigningKeysTable: csk,
 	}, nil
 }
@@ -32,6 +32,7 @@ type Database struct {
 	DeviceKeysTable       tables.DeviceKeys
 	KeyChangesTable       tables.KeyChanges
 	StaleDeviceListsTable tables.StaleDeviceLists
+	CrossSigningKeysTable tables.CrossSigningKeys
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -140,12 +141,41 @@ func (d *Database) KeyChanges(ctx context.Context, partition int32, fromOffset,
 	return d.KeyChangesTable.SelectKeyChanges(ctx, partition, fromOffset, toOffset)
 }
 
+func (d *Database) TrimKeyChanges(ctx context.Context, partition int32, toOffset int64) error {
+	return d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
+		return d.KeyChangesTable.DeleteKeyChanges(ctx, partition, toOffset)
+	})
+}
+
+// CrossSigningKeysForUser returns a map of key purpose, e.g. "master", to key JSON for the user's cross-signing keys.
+func (d *Database) CrossSigningKeysForUser(ctx context.Context, userID string) (map[string]json.RawMessage, error) {
+	return d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, nil, userID)
+}
+
+// StoreCrossSigningKeysForUser stores the given cross-signing keys, replacing any existing keys with the same purpose.
+func (d *Database) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[string]json.RawMessage) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for keyType, keyData := range keys {
+			if err := d.CrossSigningKeysTable.UpsertCrossSigningKeyForUser(ctx, txn, userID, keyType, keyData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // StaleDeviceLists returns a list of user IDs ending with the domains provided who have stale device lists.
 // If no domains are given, all user IDs with stale device lists are returned.
 func (d *Database) StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
 	return d.StaleDeviceListsTable.SelectUserIDsWithStaleDeviceLists(ctx, domains)
 }
 
+// DeviceListIsStale returns true if the remote user's device list isn't being kept up to date by device
+// list updates, either because it has been marked as stale or because we have never fetched it.
+func (d *Database) DeviceListIsStale(ctx context.Context, userID string) (bool, error) {
+	return d.StaleDeviceListsTable.SelectDeviceListIsStale(ctx, userID)
+}
+
 // MarkDeviceListStale sets the stale bit for this user to isStale.
 func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error {
 	return d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
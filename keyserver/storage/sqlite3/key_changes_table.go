@@ -49,10 +49,15 @@ const upsertKeyChangeSQL = "" +
 const selectKeyChangesSQL = "" +
 	"SELECT user_id, MAX(offset) FROM keyserver_key_changes WHERE partition = $1 AND offset > $2 AND offset <= $3 GROUP BY user_id"
 
+// delete the key changes up to and including the given offset, once no client needs them any more.
+const deleteKeyChangesSQL = "" +
+	"DELETE FROM keyserver_key_changes WHERE partition = $1 AND offset <= $2"
+
 type keyChangesStatements struct {
 	db                   *sql.DB
 	upsertKeyChangeStmt  *sql.Stmt
 	selectKeyChangesStmt *sql.Stmt
+	deleteKeyChangesStmt *sql.Stmt
 }
 
 func NewSqliteKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
@@ -69,6 +74,9 @@ func NewSqliteKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
 	if s.selectKeyChangesStmt, err = db.Prepare(selectKeyChangesSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteKeyChangesStmt, err = db.Prepare(deleteKeyChangesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -101,3 +109,8 @@ func (s *keyChangesStatements) SelectKeyChanges(
 	}
 	return
 }
+
+func (s *keyChangesStatements) DeleteKeyChanges(ctx context.Context, partition int32, toOffset int64) error {
+	_, err := s.deleteKeyChangesStmt.ExecContext(ctx, partition, toOffset)
+	return err
+}
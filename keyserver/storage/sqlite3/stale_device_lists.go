@@ -48,11 +48,15 @@ const selectStaleDeviceListsWithDomainsSQL = "" +
 const selectStaleDeviceListsSQL = "" +
 	"SELECT user_id FROM keyserver_stale_device_lists WHERE is_stale = $1"
 
+const selectDeviceListIsStaleSQL = "" +
+	"SELECT is_stale FROM keyserver_stale_device_lists WHERE user_id = $1"
+
 type staleDeviceListsStatements struct {
 	db                                    *sql.DB
 	upsertStaleDeviceListStmt             *sql.Stmt
 	selectStaleDeviceListsWithDomainsStmt *sql.Stmt
 	selectStaleDeviceListsStmt            *sql.Stmt
+	selectDeviceListIsStaleStmt           *sql.Stmt
 }
 
 func NewSqliteStaleDeviceListsTable(db *sql.DB) (tables.StaleDeviceLists, error) {
@@ -72,6 +76,9 @@ func NewSqliteStaleDeviceListsTable(db *sql.DB) (tables.StaleDeviceLists, error)
 	if s.selectStaleDeviceListsWithDomainsStmt, err = db.Prepare(selectStaleDeviceListsWithDomainsSQL); err != nil {
 		return nil, err
 	}
+	if s.selectDeviceListIsStaleStmt, err = db.Prepare(selectDeviceListIsStaleSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -84,6 +91,15 @@ func (s *staleDeviceListsStatements) InsertStaleDeviceList(ctx context.Context,
 	return err
 }
 
+func (s *staleDeviceListsStatements) SelectDeviceListIsStale(ctx context.Context, userID string) (bool, error) {
+	var isStale bool
+	err := s.selectDeviceListIsStaleStmt.QueryRowContext(ctx, userID).Scan(&isStale)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return isStale, err
+}
+
 func (s *staleDeviceListsStatements) SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
 	// we only query for 1 domain or all domains so optimise for those use cases
 	if len(domains) == 0 {
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -174,3 +175,59 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestDeviceListIsStale(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	userID := "@alice:remote"
+	isStale, err := db.DeviceListIsStale(ctx, userID)
+	MustNotError(t, err)
+	if !isStale {
+		t.Fatalf("DeviceListIsStale: untracked device list should be stale")
+	}
+	MustNotError(t, db.MarkDeviceListStale(ctx, userID, false))
+	isStale, err = db.DeviceListIsStale(ctx, userID)
+	MustNotError(t, err)
+	if isStale {
+		t.Fatalf("DeviceListIsStale: fresh device list should not be stale")
+	}
+	MustNotError(t, db.MarkDeviceListStale(ctx, userID, true))
+	isStale, err = db.DeviceListIsStale(ctx, userID)
+	MustNotError(t, err)
+	if !isStale {
+		t.Fatalf("DeviceListIsStale: device list marked as stale should be stale")
+	}
+}
+
+func TestCrossSigningKeys(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	alice := "@alice:TestCrossSigningKeys"
+	keys, err := db.CrossSigningKeysForUser(ctx, alice)
+	MustNotError(t, err)
+	if len(keys) != 0 {
+		t.Fatalf("CrossSigningKeysForUser: got %v for a user without keys, want none", keys)
+	}
+	MustNotError(t, db.StoreCrossSigningKeysForUser(ctx, alice, map[string]json.RawMessage{
+		api.CrossSigningKeyPurposeMaster:      json.RawMessage(`{"key":"master1"}`),
+		api.CrossSigningKeyPurposeSelfSigning: json.RawMessage(`{"key":"self1"}`),
+	}))
+	// replacing one key leaves the others alone
+	MustNotError(t, db.StoreCrossSigningKeysForUser(ctx, alice, map[string]json.RawMessage{
+		api.CrossSigningKeyPurposeMaster: json.RawMessage(`{"key":"master2"}`),
+	}))
+	keys, err = db.CrossSigningKeysForUser(ctx, alice)
+	MustNotError(t, err)
+	want := map[string]string{
+		api.CrossSigningKeyPurposeMaster:      `{"key":"master2"}`,
+		api.CrossSigningKeyPurposeSelfSigning: `{"key":"self1"}`,
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("CrossSigningKeysForUser: got %d keys, want %d", len(keys), len(want))
+	}
+	for keyType, keyJSON := range want {
+		if string(keys[keyType]) != keyJSON {
+			t.Errorf("CrossSigningKeysForUser: got %s key %s, want %s", keyType, keys[keyType], keyJSON)
+		}
+	}
+}
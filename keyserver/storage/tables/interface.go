@@ -46,9 +46,19 @@ type KeyChanges interface {
 	// SelectKeyChanges returns the set (de-duplicated) of users who have changed their keys between the two offsets.
 	// Results are exclusive of fromOffset and inclusive of toOffset. A toOffset of sarama.OffsetNewest means no upper offset.
 	SelectKeyChanges(ctx context.Context, partition int32, fromOffset, toOffset int64) (userIDs []string, latestOffset int64, err error)
+	// DeleteKeyChanges removes the key changes in the partition up to and including toOffset.
+	DeleteKeyChanges(ctx context.Context, partition int32, toOffset int64) error
+}
+
+type CrossSigningKeys interface {
+	// SelectCrossSigningKeysForUser returns a map of key type, e.g. "master", to key JSON.
+	SelectCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[string]json.RawMessage, error)
+	UpsertCrossSigningKeyForUser(ctx context.Context, txn *sql.Tx, userID, keyType string, keyData json.RawMessage) error
 }
 
 type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+	// SelectDeviceListIsStale returns true if the user's device list is stale or isn't tracked at all.
+	SelectDeviceListIsStale(ctx context.Context, userID string) (bool, error)
 }
@@ -17,8 +17,10 @@ package mediaapi
 import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/mediastorage"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
@@ -35,7 +37,16 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStorage, err := mediastorage.Open(cfg)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media storage")
+	}
+
+	if !thumbnailer.IsFormatSupported(cfg.ThumbnailFormat) {
+		logrus.Panicf("thumbnail format %q is not supported by this build", cfg.ThumbnailFormat)
+	}
+
 	routing.Setup(
-		router, cfg, mediaDB, userAPI, client,
+		router, cfg, mediaDB, mediaStorage, userAPI, client,
 	)
 }
@@ -0,0 +1,79 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastorage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// FileStorage stores media files in a directory on the local filesystem.
+type FileStorage struct {
+	root string
+}
+
+// NewFileStorage returns a FileStorage rooted at the given directory.
+func NewFileStorage(root config.Path) *FileStorage {
+	return &FileStorage{root: string(root)}
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+// Put implements MediaStorage.
+func (s *FileStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dest := s.path(key)
+	// The media API writes files to the base path before storing them, so
+	// the file may already be where it belongs.
+	if f, ok := r.(*os.File); ok && filepath.Clean(f.Name()) == dest {
+		return nil
+	}
+	return writeFileAtomically(dest, io.LimitReader(r, size))
+}
+
+// Get implements MediaStorage.
+func (s *FileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete implements MediaStorage.
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Stat implements MediaStorage.
+func (s *FileStorage) Stat(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
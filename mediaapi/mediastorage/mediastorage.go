@@ -0,0 +1,142 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// ErrNotFound is returned when a file does not exist in the storage backend.
+var ErrNotFound = errors.New("media file not found")
+
+// MediaStorage is a backend that media files are stored in. Files are
+// identified by keys, which are their paths relative to the media base path
+// using forward slashes, e.g. "q/w/erty/file".
+type MediaStorage interface {
+	// Put stores size bytes read from r under key, replacing any existing file.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns the contents of the file stored under key, or ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the file stored under key. It is not an error if there
+	// is no such file.
+	Delete(ctx context.Context, key string) error
+	// Stat returns the size of the file stored under key, or ErrNotFound.
+	Stat(ctx context.Context, key string) (int64, error)
+}
+
+// Open returns the storage backend configured for the media API.
+func Open(cfg *config.MediaAPI) (MediaStorage, error) {
+	switch cfg.Storage.Backend {
+	case config.MediaStorageFilesystem, "":
+		return NewFileStorage(cfg.AbsBasePath), nil
+	case config.MediaStorageS3:
+		return NewS3Storage(&cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// Key returns the key of the file at filePath, which must be inside absBasePath.
+func Key(absBasePath config.Path, filePath types.Path) (string, error) {
+	rel, err := filepath.Rel(string(absBasePath), string(filePath))
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is not inside the media base path", filePath)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// PutFile stores the local file at filePath in the backend. The file is not
+// uploaded again if the backend already holds a file of the same size under
+// its key, as keys are derived from the hash of the file contents.
+func PutFile(ctx context.Context, store MediaStorage, absBasePath config.Path, filePath types.Path) error {
+	key, err := Key(absBasePath, filePath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(string(filePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if size, err := store.Stat(ctx, key); err == nil && size == info.Size() {
+		return nil
+	}
+	return store.Put(ctx, key, file, info.Size())
+}
+
+// FetchFile makes sure that the file at filePath exists locally, fetching
+// it from the backend if it does not. Returns ErrNotFound if the backend
+// does not have the file either.
+func FetchFile(ctx context.Context, store MediaStorage, absBasePath config.Path, filePath types.Path) error {
+	if _, err := os.Stat(string(filePath)); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	key, err := Key(absBasePath, filePath)
+	if err != nil {
+		return err
+	}
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close() // nolint: errcheck
+	return writeFileAtomically(string(filePath), body)
+}
+
+// writeFileAtomically writes the contents of r to a temporary file in the
+// same directory as filePath and then renames it into place, so that readers
+// never see a partially written file.
+func writeFileAtomically(filePath string, r io.Reader) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	if _, err = io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()    // nolint: errcheck
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+	return nil
+}
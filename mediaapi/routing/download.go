@@ -28,14 +28,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastorage"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workqueue"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/pkg/errors"
@@ -44,6 +47,20 @@ import (
 
 const mediaIDCharacters = "A-Za-z0-9_=-"
 
+// remoteFileDownloadTimeout is the longest that downloading a remote file may take.
+const remoteFileDownloadTimeout = time.Minute * 5
+
+var (
+	// errRemoteFileTooLarge is returned when a remote file is larger than max_remote_file_size_bytes.
+	errRemoteFileTooLarge = errors.New("remote file is too large")
+	// errRemoteContentTypeNotAllowed is returned when remote_content_types doesn't allow a remote file.
+	errRemoteContentTypeNotAllowed = errors.New("content type of remote file is not allowed")
+	// errThumbnailerBusy is returned when a thumbnail couldn't be generated
+	// because too many media processing jobs were running, and there was no
+	// other thumbnail to respond with instead.
+	errThumbnailerBusy = errors.New("too many thumbnails are being generated")
+)
+
 // Note: unfortunately regex.MustCompile() cannot be assigned to a const
 var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 
@@ -58,8 +75,13 @@ type downloadRequest struct {
 	MediaMetadata      *types.MediaMetadata
 	IsThumbnailRequest bool
 	ThumbnailSize      types.ThumbnailSize
-	Logger             *log.Entry
-	DownloadFilename   string
+	// ThumbnailFormat is the configured format that thumbnails are generated in,
+	// and ResponseFormat is the format that this client gets thumbnails in.
+	ThumbnailFormat  string
+	ResponseFormat   string
+	Logger           *log.Entry
+	DownloadFilename string
+	Storage          mediastorage.MediaStorage
 }
 
 // Download implements GET /download and GET /thumbnail
@@ -75,9 +97,10 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastorage.MediaStorage,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	queue *workqueue.Queue,
 	isThumbnailRequest bool,
 	customFilename string,
 ) {
@@ -91,7 +114,9 @@ func Download(
 			"Origin":  origin,
 			"MediaID": mediaID,
 		}),
+		ThumbnailFormat:  cfg.ThumbnailFormat,
 		DownloadFilename: customFilename,
+		Storage:          store,
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -108,6 +133,7 @@ func Download(
 			Height:       height,
 			ResizeMethod: strings.ToLower(req.FormValue("method")),
 		}
+		dReq.ResponseFormat = thumbnailer.NegotiateFormat(cfg.ThumbnailFormat, req.Header.Get("Accept"))
 		dReq.Logger.WithFields(log.Fields{
 			"RequestedWidth":        dReq.ThumbnailSize.Width,
 			"RequestedHeight":       dReq.ThumbnailSize.Height,
@@ -123,14 +149,35 @@ func Download(
 
 	metadata, err := dReq.doDownload(
 		req.Context(), w, cfg, db, client,
-		activeRemoteRequests, activeThumbnailGeneration,
+		activeRemoteRequests, queue,
 	)
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
-		dReq.jsonErrorResponse(w, util.JSONResponse{
+		res := util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Failed to download: " + err.Error()),
-		})
+		}
+		switch errors.Cause(err) {
+		case errRemoteFileTooLarge:
+			res = util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge("Failed to download: " + err.Error()),
+			}
+		case errRemoteContentTypeNotAllowed:
+			res = util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Failed to download: " + err.Error()),
+			}
+		case errThumbnailerBusy:
+			res = util.JSONResponse{
+				Code: http.StatusTooManyRequests,
+				JSON: jsonerror.LimitExceeded(
+					"Failed to download: "+err.Error(),
+					cfg.ProcessingQueueTimeout.Milliseconds(),
+				),
+			}
+		}
+		dReq.jsonErrorResponse(w, res)
 		return
 	}
 
@@ -207,7 +254,7 @@ func (r *downloadRequest) doDownload(
 	db storage.Database,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	queue *workqueue.Queue,
 ) (*types.MediaMetadata, error) {
 	// check if we have a record of the media in our database
 	mediaMetadata, err := db.GetMediaMetadata(
@@ -223,7 +270,7 @@ func (r *downloadRequest) doDownload(
 		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, cfg, db, activeRemoteRequests, queue,
 		)
 		if resErr != nil {
 			return nil, resErr
@@ -233,8 +280,7 @@ func (r *downloadRequest) doDownload(
 		r.MediaMetadata = mediaMetadata
 	}
 	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
-		cfg.MaxThumbnailGenerators, db,
+		ctx, w, cfg.AbsBasePath, queue, db,
 		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
 	)
 }
@@ -245,8 +291,7 @@ func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
 	absBasePath config.Path,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
@@ -255,6 +300,11 @@ func (r *downloadRequest) respondFromLocalFile(
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get file path from metadata")
 	}
+	// The file may have been stored by another media API instance, in which
+	// case it needs to be fetched from the storage backend first.
+	if err = mediastorage.FetchFile(ctx, r.Storage, absBasePath, types.Path(filePath)); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch file from storage")
+	}
 	file, err := os.Open(filePath)
 	defer file.Close() // nolint: errcheck, staticcheck, megacheck
 	if err != nil {
@@ -277,7 +327,7 @@ func (r *downloadRequest) respondFromLocalFile(
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+			ctx, absBasePath, types.Path(filePath), queue,
 			db, dynamicThumbnails, thumbnailSizes,
 		)
 		if thumbFile != nil {
@@ -315,6 +365,11 @@ func (r *downloadRequest) respondFromLocalFile(
 	}
 
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
+	if r.IsThumbnailRequest && r.ThumbnailFormat != thumbnailer.FallbackFormat(r.ThumbnailFormat) {
+		// The thumbnail format depends on what the client accepts, so caches
+		// mustn't send this response to other clients.
+		w.Header().Set("Vary", "Accept")
+	}
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
@@ -394,20 +449,20 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
+	absBasePath config.Path,
 	filePath types.Path,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*os.File, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
+	var busy bool
 	var err error
 
 	if dynamicThumbnails {
-		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
-			maxThumbnailGenerators, db,
+		thumbnail, busy, err = r.generateThumbnail(
+			ctx, absBasePath, filePath, r.ThumbnailSize, queue, db,
 		)
 		if err != nil {
 			return nil, nil, err
@@ -436,9 +491,8 @@ func (r *downloadRequest) getThumbnailFile(
 				"Height":       thumbnailSize.Height,
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Info("Pre-generating thumbnail for immediate response.")
-			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
-				maxThumbnailGenerators, db,
+			thumbnail, busy, err = r.generateThumbnail(
+				ctx, absBasePath, filePath, *thumbnailSize, queue, db,
 			)
 			if err != nil {
 				return nil, nil, err
@@ -446,8 +500,14 @@ func (r *downloadRequest) getThumbnailFile(
 		}
 	}
 	if thumbnail == nil {
+		if busy {
+			return nil, nil, errThumbnailerBusy
+		}
 		return nil, nil, nil
 	}
+	if variantFile, variant := r.getThumbnailVariantFile(ctx, absBasePath, filePath, thumbnail); variantFile != nil {
+		return variantFile, variant, nil
+	}
 	r.Logger = r.Logger.WithFields(log.Fields{
 		"Width":         thumbnail.ThumbnailSize.Width,
 		"Height":        thumbnail.ThumbnailSize.Height,
@@ -456,6 +516,9 @@ func (r *downloadRequest) getThumbnailFile(
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
 	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
+	if err = mediastorage.FetchFile(ctx, r.Storage, absBasePath, types.Path(thumbPath)); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to fetch thumbnail from storage")
+	}
 	thumbFile, err := os.Open(string(thumbPath))
 	if err != nil {
 		thumbFile.Close() // nolint: errcheck
@@ -473,38 +536,85 @@ func (r *downloadRequest) getThumbnailFile(
 	return thumbFile, thumbnail, nil
 }
 
+// getThumbnailVariantFile opens the version of a thumbnail in the format that
+// the client asked for, if that is WebP or AVIF and it has been generated.
+// Returns nil if there isn't one, in which case the thumbnail in the fallback
+// format should be used instead.
+func (r *downloadRequest) getThumbnailVariantFile(
+	ctx context.Context,
+	absBasePath config.Path,
+	filePath types.Path,
+	thumbnail *types.ThumbnailMetadata,
+) (*os.File, *types.ThumbnailMetadata) {
+	variantPath := thumbnailer.GetThumbnailPathForFormat(filePath, thumbnail.ThumbnailSize, r.ResponseFormat)
+	if variantPath == thumbnailer.GetThumbnailPath(filePath, thumbnail.ThumbnailSize) {
+		return nil, nil
+	}
+	if err := mediastorage.FetchFile(ctx, r.Storage, absBasePath, variantPath); err != nil {
+		if err != mediastorage.ErrNotFound {
+			r.Logger.WithError(err).Warn("Failed to fetch thumbnail from storage")
+		}
+		return nil, nil
+	}
+	variantFile, err := os.Open(string(variantPath))
+	if err != nil {
+		return nil, nil
+	}
+	variantStat, err := variantFile.Stat()
+	if err != nil {
+		variantFile.Close() // nolint: errcheck
+		return nil, nil
+	}
+	metadata := *thumbnail.MediaMetadata
+	metadata.ContentType = thumbnailer.FormatContentType(r.ResponseFormat)
+	metadata.FileSizeBytes = types.FileSizeBytes(variantStat.Size())
+	r.Logger = r.Logger.WithFields(log.Fields{
+		"Width":         thumbnail.ThumbnailSize.Width,
+		"Height":        thumbnail.ThumbnailSize.Height,
+		"ResizeMethod":  thumbnail.ThumbnailSize.ResizeMethod,
+		"FileSizeBytes": metadata.FileSizeBytes,
+		"ContentType":   metadata.ContentType,
+	})
+	return variantFile, &types.ThumbnailMetadata{
+		MediaMetadata: &metadata,
+		ThumbnailSize: thumbnail.ThumbnailSize,
+	}
+}
+
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
+	absBasePath config.Path,
 	filePath types.Path,
 	thumbnailSize types.ThumbnailSize,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
-) (*types.ThumbnailMetadata, error) {
+) (thumbnail *types.ThumbnailMetadata, busy bool, err error) {
 	r.Logger.WithFields(log.Fields{
 		"Width":        thumbnailSize.Width,
 		"Height":       thumbnailSize.Height,
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
-	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
-		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+	busy, err = thumbnailer.GenerateThumbnail(
+		ctx, filePath, thumbnailSize, r.ThumbnailFormat, r.MediaMetadata,
+		queue, db, r.Logger,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating thumbnail")
+		return nil, false, errors.Wrap(err, "error creating thumbnail")
 	}
 	if busy {
-		return nil, nil
+		return nil, true, nil
+	}
+	if err = putThumbnailFiles(ctx, r.Storage, absBasePath, filePath, thumbnailSize, r.ThumbnailFormat); err != nil {
+		return nil, false, errors.Wrap(err, "error storing thumbnail")
 	}
-	var thumbnail *types.ThumbnailMetadata
 	thumbnail, err = db.GetThumbnail(
 		ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin,
 		thumbnailSize.Width, thumbnailSize.Height, thumbnailSize.ResizeMethod,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "error looking up thumbnail")
+		return nil, false, errors.Wrap(err, "error looking up thumbnail")
 	}
-	return thumbnail, nil
+	return thumbnail, false, nil
 }
 
 // getRemoteFile fetches the remote file and caches it locally
@@ -517,7 +627,7 @@ func (r *downloadRequest) getRemoteFile(
 	cfg *config.MediaAPI,
 	db storage.Database,
 	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	queue *workqueue.Queue,
 ) (errorResponse error) {
 	// Note: getMediaMetadataFromActiveRequest uses mutexes and conditions from activeRemoteRequests
 	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
@@ -550,12 +660,11 @@ func (r *downloadRequest) getRemoteFile(
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
-				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
-				cfg.MaxThumbnailGenerators,
+				cfg.AbsBasePath, *cfg.MaxRemoteFileSizeBytes, &cfg.RemoteContentTypes, db,
+				cfg.ThumbnailSizes, queue, cfg.DynamicThumbnails,
 			)
 			if err != nil {
-				return errors.Wrap(err, "error querying the database.")
+				return errors.Wrap(err, "error fetching the remote file")
 			}
 		} else {
 			// If we have a record, we can respond from the local file
@@ -617,18 +726,26 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
+	contentTypes *config.RemoteContentTypes,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
+	dynamicThumbnails bool,
 ) error {
 	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+		ctx, client, absBasePath, maxFileSizeBytes, contentTypes,
 	)
 	if err != nil {
 		return err
 	}
 
+	if err = mediastorage.PutFile(ctx, r.Storage, absBasePath, finalPath); err != nil {
+		if !duplicate {
+			fileutils.RemoveDir(types.Path(filepath.Dir(string(finalPath))), r.Logger)
+		}
+		return errors.Wrap(err, "failed to store remote file")
+	}
+
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -650,18 +767,14 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		return errors.New("failed to store file metadata in DB")
 	}
 
-	go func() {
-		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+	// Unlike uploads, remote files are thumbnailed in the background so that
+	// the file can be served to the requester straight away.
+	if !dynamicThumbnails {
+		go pregenerateThumbnails(
+			context.Background(), r.Storage, absBasePath, finalPath, r.MediaMetadata, thumbnailSizes,
+			r.ThumbnailFormat, queue, db, r.Logger,
 		)
-		if err != nil {
-			r.Logger.WithError(err).Warn("Error generating thumbnails")
-		}
-		if busy {
-			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
-		}
-	}()
+	}
 
 	r.Logger.WithFields(log.Fields{
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -678,9 +791,14 @@ func (r *downloadRequest) fetchRemoteFile(
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
+	contentTypes *config.RemoteContentTypes,
 ) (types.Path, bool, error) {
 	r.Logger.Info("Fetching remote file")
 
+	// Don't let a slow remote server hold on to the download forever.
+	ctx, cancel := context.WithTimeout(ctx, remoteFileDownloadTimeout)
+	defer cancel()
+
 	// create request for remote file
 	resp, err := r.createRemoteRequest(ctx, client)
 	if err != nil {
@@ -692,18 +810,25 @@ func (r *downloadRequest) fetchRemoteFile(
 	}
 	defer resp.Body.Close() // nolint: errcheck
 
-	// get metadata from request and set metadata on response
-	contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		r.Logger.WithError(err).Warn("Failed to parse content length")
-		return "", false, errors.Wrap(err, "invalid response from remote server")
+	// get metadata from request and set metadata on response. The remote
+	// server may not send a Content-Length, in which case the size is only
+	// checked as the file is downloaded.
+	contentLength := int64(-1)
+	if header := resp.Header.Get("Content-Length"); header != "" {
+		contentLength, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			r.Logger.WithError(err).Warn("Failed to parse content length")
+			return "", false, errors.Wrap(err, "invalid response from remote server")
+		}
 	}
-	if contentLength > int64(maxFileSizeBytes) {
-		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
+		return "", false, errors.Wrapf(errRemoteFileTooLarge, "%v > %v bytes", contentLength, maxFileSizeBytes)
 	}
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
 	r.MediaMetadata.ContentType = types.ContentType(resp.Header.Get("Content-Type"))
+	if !contentTypes.IsAllowed(string(r.MediaMetadata.ContentType)) {
+		return "", false, errors.Wrapf(errRemoteContentTypeNotAllowed, "%q", r.MediaMetadata.ContentType)
+	}
 
 	dispositionHeader := resp.Header.Get("Content-Disposition")
 	if _, params, e := mime.ParseMediaType(dispositionHeader); e == nil {
@@ -727,14 +852,23 @@ func (r *downloadRequest) fetchRemoteFile(
 	// The file data is hashed but is NOT used as the MediaID, unlike in Upload. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
-	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, resp.Body, maxFileSizeBytes, absBasePath)
+	// Read one byte more than the maximum so that we can tell if the remote server sent more than it
+	// said it would, in which case the file is thrown away rather than being cached truncated.
+	readLimit := maxFileSizeBytes
+	if readLimit > 0 {
+		readLimit++
+	}
+	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, resp.Body, readLimit, absBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
 		return "", false, errors.New("file could not be downloaded from remote server")
 	}
+	if maxFileSizeBytes > 0 && bytesWritten > types.FileSizeBytes(maxFileSizeBytes) {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return "", false, errors.Wrapf(errRemoteFileTooLarge, "more than %v bytes", maxFileSizeBytes)
+	}
 
 	r.Logger.Info("Remote file transferred")
 
@@ -23,8 +23,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastorage"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workqueue"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -41,20 +43,23 @@ func Setup(
 	publicAPIMux *mux.Router,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastorage.MediaStorage,
 	userAPI userapi.UserInternalAPI,
 	client *gomatrixserverlib.Client,
 ) {
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	r0mux.Use(httputil.RequireDatabases(&cfg.Database))
+	v1mux.Use(httputil.RequireDatabases(&cfg.Database))
 
-	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
-		PathToResult: map[string]*types.ThumbnailGenerationResult{},
-	}
+	// Thumbnails are generated on a shared queue, so that generating a lot of
+	// them at once can't exhaust the memory of the media API.
+	queue := workqueue.New(cfg.MaxConcurrentProcessing, cfg.ProcessingQueueTimeout, cfg.ProcessingJobTimeout)
 
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			return Upload(req, cfg, dev, db, activeThumbnailGeneration)
+			return Upload(req, cfg, dev, db, store, queue)
 		},
 	)
 
@@ -65,14 +70,14 @@ func Setup(
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", cfg, db, store, client, activeRemoteRequests, queue)
 	r0mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)                // TODO: remove when synapse is fixed
 	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions) // TODO: remove when synapse is fixed
 
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, db, store, client, activeRemoteRequests, queue),
 	).Methods(http.MethodGet, http.MethodOptions)
 }
 
@@ -80,9 +85,10 @@ func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastorage.MediaStorage,
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	queue *workqueue.Queue,
 ) http.HandlerFunc {
 	counterVec := promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -119,9 +125,10 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
 			client,
 			activeRemoteRequests,
-			activeThumbnailGeneration,
+			queue,
 			name == "thumbnail",
 			vars["downloadName"],
 		)
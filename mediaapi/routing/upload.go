@@ -22,15 +22,18 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastorage"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workqueue"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -43,6 +46,7 @@ import (
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
 	Logger        *log.Entry
+	Storage       mediastorage.MediaStorage
 }
 
 // uploadResponse defines the format of the JSON response
@@ -56,13 +60,14 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store mediastorage.MediaStorage, queue *workqueue.Queue) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
+	r.Storage = store
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, queue); resErr != nil {
 		return *resErr
 	}
 
@@ -128,7 +133,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	queue *workqueue.Queue,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -215,7 +220,7 @@ func (r *uploadRequest) doUpload(
 
 	return r.storeFileAndMetadata(
 		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
-		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
+		cfg.ThumbnailFormat, queue, cfg.DynamicThumbnails,
 	)
 }
 
@@ -274,8 +279,9 @@ func (r *uploadRequest) storeFileAndMetadata(
 	absBasePath config.Path,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	thumbnailFormat string,
+	queue *workqueue.Queue,
+	dynamicThumbnails bool,
 ) *util.JSONResponse {
 	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
 	if err != nil {
@@ -289,6 +295,17 @@ func (r *uploadRequest) storeFileAndMetadata(
 		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
 	}
 
+	if err = mediastorage.PutFile(ctx, r.Storage, absBasePath, finalPath); err != nil {
+		r.Logger.WithError(err).Error("Failed to store file.")
+		if !duplicate {
+			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+		}
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Failed to upload"),
+		}
+	}
+
 	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
 		r.Logger.WithError(err).Warn("Failed to store metadata")
 		// If the file is a duplicate (has the same hash as an existing file) then
@@ -296,6 +313,11 @@ func (r *uploadRequest) storeFileAndMetadata(
 		// remove the file if it is not a duplicate.
 		if !duplicate {
 			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			if key, kerr := mediastorage.Key(absBasePath, finalPath); kerr == nil {
+				if kerr = r.Storage.Delete(ctx, key); kerr != nil {
+					r.Logger.WithError(kerr).Warn("Failed to delete file from storage")
+				}
+			}
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -303,18 +325,75 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 	}
 
-	go func() {
-		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
+	// Thumbnails are generated before responding so that they are ready as
+	// soon as clients ask for them, unless they are generated dynamically
+	// when they are first requested.
+	if !dynamicThumbnails {
+		pregenerateThumbnails(
+			ctx, r.Storage, absBasePath, finalPath, r.MediaMetadata, thumbnailSizes,
+			thumbnailFormat, queue, db, r.Logger,
 		)
-		if err != nil {
-			r.Logger.WithError(err).Warn("Error generating thumbnails")
+	}
+
+	return nil
+}
+
+// pregenerateThumbnails generates the configured thumbnail sizes for the file
+// at filePath and stores them in the storage backend. Errors are only logged,
+// as thumbnails can still be generated when they are requested.
+func pregenerateThumbnails(
+	ctx context.Context,
+	store mediastorage.MediaStorage,
+	absBasePath config.Path,
+	filePath types.Path,
+	mediaMetadata *types.MediaMetadata,
+	thumbnailSizes []config.ThumbnailSize,
+	thumbnailFormat string,
+	queue *workqueue.Queue,
+	db storage.Database,
+	logger *log.Entry,
+) {
+	busy, err := thumbnailer.GenerateThumbnails(
+		ctx, filePath, thumbnailSizes, thumbnailFormat, mediaMetadata,
+		queue, db, logger,
+	)
+	if err != nil {
+		logger.WithError(err).Warn("Error generating thumbnails")
+	}
+	if busy {
+		logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+	}
+	for _, size := range thumbnailSizes {
+		thumbPath := thumbnailer.GetThumbnailPath(filePath, types.ThumbnailSize(size))
+		if _, err := os.Stat(string(thumbPath)); err != nil {
+			continue
 		}
-		if busy {
-			r.Logger.Warn("Maximum number of active thumbnail generators reached. Skipping pre-generation.")
+		if err := putThumbnailFiles(ctx, store, absBasePath, filePath, types.ThumbnailSize(size), thumbnailFormat); err != nil {
+			logger.WithError(err).WithField("dst", thumbPath).Warn("Error storing thumbnail")
 		}
-	}()
+	}
+}
 
-	return nil
+// putThumbnailFiles stores a generated thumbnail in the storage backend, along
+// with its WebP or AVIF version if there is one.
+func putThumbnailFiles(
+	ctx context.Context,
+	store mediastorage.MediaStorage,
+	absBasePath config.Path,
+	filePath types.Path,
+	size types.ThumbnailSize,
+	thumbnailFormat string,
+) error {
+	thumbPath := thumbnailer.GetThumbnailPath(filePath, size)
+	if err := mediastorage.PutFile(ctx, store, absBasePath, thumbPath); err != nil {
+		return err
+	}
+	variantPath := thumbnailer.GetThumbnailPathForFormat(filePath, size, thumbnailFormat)
+	if variantPath == thumbPath {
+		return nil
+	}
+	if _, err := os.Stat(string(variantPath)); err != nil {
+		return nil
+	}
+	return mediastorage.PutFile(ctx, store, absBasePath, variantPath)
 }
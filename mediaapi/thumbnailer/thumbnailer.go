@@ -18,9 +18,11 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"mime"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
@@ -48,6 +50,67 @@ func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
 	))
 }
 
+// formatContentTypes are the content types of each thumbnail format.
+var formatContentTypes = map[string]types.ContentType{
+	config.ThumbnailFormatJPEG: "image/jpeg",
+	config.ThumbnailFormatPNG:  "image/png",
+	config.ThumbnailFormatWebP: "image/webp",
+	config.ThumbnailFormatAVIF: "image/avif",
+}
+
+// FormatContentType returns the content type of a thumbnail format.
+func FormatContentType(format string) types.ContentType {
+	return formatContentTypes[format]
+}
+
+// isVariantFormat returns whether thumbnails in the given format are only
+// sent to clients which accept them. These are stored alongside a thumbnail
+// in the fallback format, which is the one recorded in the database.
+func isVariantFormat(format string) bool {
+	return format == config.ThumbnailFormatWebP || format == config.ThumbnailFormatAVIF
+}
+
+// FallbackFormat returns the format that thumbnails are always generated in
+// when the given format is configured, which every client can display.
+func FallbackFormat(format string) string {
+	if format == config.ThumbnailFormatPNG {
+		return config.ThumbnailFormatPNG
+	}
+	return config.ThumbnailFormatJPEG
+}
+
+// NegotiateFormat returns the format to send a thumbnail to a client in, given
+// the configured format and the Accept header of the request. Only media types
+// which are listed explicitly count, since clients often accept image/* without
+// being able to display every image format.
+func NegotiateFormat(format, accept string) string {
+	if !isVariantFormat(format) {
+		return FallbackFormat(format)
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || types.ContentType(mediaType) != formatContentTypes[format] {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+		return format
+	}
+	return FallbackFormat(format)
+}
+
+// GetThumbnailPathForFormat returns the path to a thumbnail in the given
+// format. Thumbnails in the fallback format are at GetThumbnailPath, and
+// WebP and AVIF thumbnails are alongside them.
+func GetThumbnailPathForFormat(src types.Path, config types.ThumbnailSize, format string) types.Path {
+	path := GetThumbnailPath(src, config)
+	if isVariantFormat(format) {
+		path += types.Path("." + format)
+	}
+	return path
+}
+
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
 // The algorithm is very similar to what was implemented in Synapse
 // In order of priority unless absolute, the following metrics are compared; the image is:
@@ -88,49 +151,6 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 	return chosenThumbnail, chosenThumbnailSize
 }
 
-// getActiveThumbnailGeneration checks for active thumbnail generation
-func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
-	// Check if there is active thumbnail generation.
-	activeThumbnailGeneration.Lock()
-	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
-		logger.Info("Waiting for another goroutine to generate the thumbnail.")
-
-		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
-		activeThumbnailGenerationResult.Cond.Wait()
-		// Note: either there is an error or it is nil, either way returning it is correct
-		return false, false, activeThumbnailGenerationResult.Err
-	}
-
-	// Only allow thumbnail generation up to a maximum configured number. Above this we fall back to serving the
-	// original. Or in the case of pre-generation, they maybe get generated on the first request for a thumbnail if
-	// load has subsided.
-	if len(activeThumbnailGeneration.PathToResult) >= maxThumbnailGenerators {
-		return false, true, nil
-	}
-
-	// No active thumbnail generation so create one
-	activeThumbnailGeneration.PathToResult[string(dst)] = &types.ThumbnailGenerationResult{
-		Cond: &sync.Cond{L: activeThumbnailGeneration},
-	}
-
-	return true, false, nil
-}
-
-// broadcastGeneration broadcasts that thumbnail generation completed and the error to all waiting goroutines
-// Note: This should only be called by the owner of the activeThumbnailGenerationResult
-func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
-	activeThumbnailGeneration.Lock()
-	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
-		logger.Info("Signalling other goroutines waiting for this goroutine to generate the thumbnail.")
-		// Note: errorReturn is a named return value error that is signalled from here to waiting goroutines
-		activeThumbnailGenerationResult.Err = errorReturn
-		activeThumbnailGenerationResult.Cond.Broadcast()
-	}
-	delete(activeThumbnailGeneration.PathToResult, string(dst))
-}
-
 func isThumbnailExists(
 	ctx context.Context,
 	dst types.Path,
@@ -159,6 +179,11 @@ func isThumbnailExists(
 	return false, nil
 }
 
+func isFileExists(path types.Path) bool {
+	_, err := os.Stat(string(path))
+	return err == nil
+}
+
 // init with worst values
 func newThumbnailFitness() thumbnailFitness {
 	return thumbnailFitness{
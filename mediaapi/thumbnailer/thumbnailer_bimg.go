@@ -21,11 +21,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/h2non/bimg"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workqueue"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/h2non/bimg.v1"
 )
 
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
@@ -33,10 +34,10 @@ func GenerateThumbnails(
 	ctx context.Context,
 	src types.Path,
 	configs []config.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
-	db *storage.Database,
+	queue *workqueue.Queue,
+	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	buffer, err := bimg.Read(string(src))
@@ -46,10 +47,8 @@ func GenerateThumbnails(
 	}
 	img := bimg.NewImage(buffer)
 	for _, config := range configs {
-		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-			maxThumbnailGenerators, db, logger,
+			ctx, src, img, types.ThumbnailSize(config), format, mediaMetadata, queue, db, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -67,10 +66,10 @@ func GenerateThumbnail(
 	ctx context.Context,
 	src types.Path,
 	config types.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
-	db *storage.Database,
+	queue *workqueue.Queue,
+	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	buffer, err := bimg.Read(string(src))
@@ -81,10 +80,8 @@ func GenerateThumbnail(
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
-	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		ctx, src, img, config, format, mediaMetadata, queue, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -105,10 +102,10 @@ func createThumbnail(
 	src types.Path,
 	img *bimg.Image,
 	config types.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
-	db *storage.Database,
+	queue *workqueue.Queue,
+	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
 	logger = logger.WithFields(log.Fields{
@@ -124,55 +121,73 @@ func createThumbnail(
 
 	dst := GetThumbnailPath(src, config)
 
-	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
-	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
-	if err != nil {
-		return false, err
-	}
-	if busy {
+	// Note: the queue makes sure that each thumbnail is only generated once
+	// at a time, and that only so many are generated at the same time.
+	err := queue.Do(ctx, "thumbnail", string(dst), func(ctx context.Context) error {
+		return generateThumbnail(ctx, src, img, config, format, mediaMetadata, db, logger)
+	})
+	if err == workqueue.ErrBusy {
+		logger.Warn("Too many media processing jobs running to generate thumbnail")
 		return true, nil
 	}
+	return false, err
+}
 
-	if isActive {
-		// Note: This is an active request that MUST broadcastGeneration to wake up waiting goroutines!
-		// Note: broadcastGeneration uses mutexes and conditions from activeThumbnailGeneration
-		defer func() {
-			// Note: errorReturn is the named return variable so we wrap this in a closure to re-evaluate the arguments at defer-time
-			if err := recover(); err != nil {
-				broadcastGeneration(dst, activeThumbnailGeneration, config, err.(error), logger)
-				panic(err)
-			}
-			broadcastGeneration(dst, activeThumbnailGeneration, config, errorReturn, logger)
-		}()
+// generateThumbnail generates a thumbnail in the fallback format and stores
+// its metadata, and generates it in the given format too if that is only for
+// some clients, unless they have already been generated.
+func generateThumbnail(
+	ctx context.Context,
+	src types.Path,
+	img *bimg.Image,
+	config types.ThumbnailSize,
+	format string,
+	mediaMetadata *types.MediaMetadata,
+	db storage.Database,
+	logger *log.Entry,
+) error {
+	dst := GetThumbnailPath(src, config)
+	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	if err != nil {
+		return err
+	}
+	variantDst := GetThumbnailPathForFormat(src, config, format)
+	needsVariant := variantDst != dst && !isFileExists(variantDst)
+	if exists && !needsVariant {
+		return nil
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
-	if err != nil || exists {
-		return false, err
+	if needsVariant {
+		if _, _, err = resize(variantDst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, format, logger); err != nil {
+			return err
+		}
+	}
+	if exists {
+		return nil
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	fallbackFormat := FallbackFormat(format)
+	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, fallbackFormat, logger)
 	if err != nil {
-		return false, err
+		return err
 	}
 	logger.WithFields(log.Fields{
 		"ActualWidth":  width,
 		"ActualHeight": height,
-		"processTime":  time.Now().Sub(start),
+		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
 	stat, err := os.Stat(string(dst))
 	if err != nil {
-		return false, err
+		return err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   FormatContentType(fallbackFormat),
 			FileSizeBytes: types.FileSizeBytes(stat.Size()),
 		},
 		ThumbnailSize: types.ThumbnailSize{
@@ -188,10 +203,25 @@ func createThumbnail(
 			"ActualWidth":  width,
 			"ActualHeight": height,
 		}).Error("Failed to store thumbnail metadata in database.")
-		return false, err
+		return err
 	}
 
-	return false, nil
+	return nil
+}
+
+// formatImageTypes are the bimg image types of each thumbnail format.
+var formatImageTypes = map[string]bimg.ImageType{
+	config.ThumbnailFormatJPEG: bimg.JPEG,
+	config.ThumbnailFormatPNG:  bimg.PNG,
+	config.ThumbnailFormatWebP: bimg.WEBP,
+	config.ThumbnailFormatAVIF: bimg.AVIF,
+}
+
+// IsFormatSupported returns whether thumbnails can be encoded in the given
+// format by the libvips that bimg is using.
+func IsFormatSupported(format string) bool {
+	imageType, ok := formatImageTypes[format]
+	return ok && bimg.IsTypeSupportedSave(imageType)
 }
 
 func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
@@ -205,14 +235,14 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, format string, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
 	}
 
 	options := bimg.Options{
-		Type:    bimg.JPEG,
+		Type:    formatImageTypes[format],
 		Quality: 85,
 	}
 	if crop {
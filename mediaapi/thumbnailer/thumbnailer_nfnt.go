@@ -18,6 +18,7 @@ package thumbnailer
 
 import (
 	"context"
+	"fmt"
 	"image"
 	"image/draw"
 
@@ -25,14 +26,14 @@ import (
 	_ "image/gif"
 	"image/jpeg"
 
-	// Imported for png codec
-	_ "image/png"
+	"image/png"
 	"os"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/mediaapi/workqueue"
 	"github.com/nfnt/resize"
 	log "github.com/sirupsen/logrus"
 )
@@ -42,9 +43,9 @@ func GenerateThumbnails(
 	ctx context.Context,
 	src types.Path,
 	configs []config.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
@@ -54,10 +55,9 @@ func GenerateThumbnails(
 		return false, err
 	}
 	for _, singleConfig := range configs {
-		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
-			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
+			ctx, src, img, types.ThumbnailSize(singleConfig), format, mediaMetadata,
+			queue, db, logger,
 		)
 		if err != nil {
 			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
@@ -75,9 +75,9 @@ func GenerateThumbnail(
 	ctx context.Context,
 	src types.Path,
 	config types.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
@@ -88,10 +88,8 @@ func GenerateThumbnail(
 		}).Error("Failed to read src file")
 		return false, err
 	}
-	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
-		maxThumbnailGenerators, db, logger,
+		ctx, src, img, config, format, mediaMetadata, queue, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
@@ -120,16 +118,29 @@ func readFile(src string) (image.Image, error) {
 	return img, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
+// IsFormatSupported returns whether thumbnails can be encoded in the given
+// format. WebP and AVIF need the bimg thumbnailer.
+func IsFormatSupported(format string) bool {
+	return format == config.ThumbnailFormatJPEG || format == config.ThumbnailFormatPNG
+}
+
+func writeFile(img image.Image, dst string, format string) (err error) {
 	out, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
 	defer (func() { err = out.Close() })()
 
-	return jpeg.Encode(out, img, &jpeg.Options{
-		Quality: 85,
-	})
+	switch format {
+	case config.ThumbnailFormatJPEG:
+		return jpeg.Encode(out, img, &jpeg.Options{
+			Quality: 85,
+		})
+	case config.ThumbnailFormatPNG:
+		return png.Encode(out, img)
+	default:
+		return fmt.Errorf("unsupported thumbnail format %q", format)
+	}
 }
 
 // createThumbnail checks if the thumbnail exists, and if not, generates it
@@ -139,9 +150,9 @@ func createThumbnail(
 	src types.Path,
 	img image.Image,
 	config types.ThumbnailSize,
+	format string,
 	mediaMetadata *types.MediaMetadata,
-	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
-	maxThumbnailGenerators int,
+	queue *workqueue.Queue,
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
@@ -158,55 +169,75 @@ func createThumbnail(
 
 	dst := GetThumbnailPath(src, config)
 
-	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
-	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
-	if err != nil {
-		return false, err
-	}
-	if busy {
+	// Note: the queue makes sure that each thumbnail is only generated once
+	// at a time, and that only so many are generated at the same time.
+	err := queue.Do(ctx, "thumbnail", string(dst), func(ctx context.Context) error {
+		return generateThumbnail(ctx, src, img, config, format, mediaMetadata, db, logger)
+	})
+	if err == workqueue.ErrBusy {
+		logger.Warn("Too many media processing jobs running to generate thumbnail")
 		return true, nil
 	}
+	return false, err
+}
 
-	if isActive {
-		// Note: This is an active request that MUST broadcastGeneration to wake up waiting goroutines!
-		// Note: broadcastGeneration uses mutexes and conditions from activeThumbnailGeneration
-		defer func() {
-			// Note: errorReturn is the named return variable so we wrap this in a closure to re-evaluate the arguments at defer-time
-			// if err := recover(); err != nil {
-			// 	broadcastGeneration(dst, activeThumbnailGeneration, config, err.(error), logger)
-			// 	panic(err)
-			// }
-			broadcastGeneration(dst, activeThumbnailGeneration, config, errorReturn, logger)
-		}()
-	}
-
+// generateThumbnail generates a thumbnail in the fallback format and stores
+// its metadata, and generates it in the given format too if that is only for
+// some clients, unless they have already been generated.
+func generateThumbnail(
+	ctx context.Context,
+	src types.Path,
+	img image.Image,
+	config types.ThumbnailSize,
+	format string,
+	mediaMetadata *types.MediaMetadata,
+	db storage.Database,
+	logger *log.Entry,
+) error {
+	dst := GetThumbnailPath(src, config)
 	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
-	if err != nil || exists {
-		return false, err
+	if err != nil {
+		return err
+	}
+	variantDst := GetThumbnailPathForFormat(src, config, format)
+	needsVariant := variantDst != dst && !isFileExists(variantDst)
+	if exists && !needsVariant {
+		return nil
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
-	if err != nil {
-		return false, err
-	}
+	out := adjustSize(img, config.Width, config.Height, config.ResizeMethod == types.Crop)
 	logger.WithFields(log.Fields{
-		"ActualWidth":  width,
-		"ActualHeight": height,
+		"ActualWidth":  out.Bounds().Max.X,
+		"ActualHeight": out.Bounds().Max.Y,
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
+	if needsVariant {
+		if err = writeFile(out, string(variantDst), format); err != nil {
+			logger.WithError(err).WithField("format", format).Error("Failed to encode and write image")
+			return err
+		}
+	}
+	if exists {
+		return nil
+	}
+
+	fallbackFormat := FallbackFormat(format)
+	if err = writeFile(out, string(dst), fallbackFormat); err != nil {
+		logger.WithError(err).WithField("format", fallbackFormat).Error("Failed to encode and write image")
+		return err
+	}
 	stat, err := os.Stat(string(dst))
 	if err != nil {
-		return false, err
+		return err
 	}
 
 	thumbnailMetadata := &types.ThumbnailMetadata{
 		MediaMetadata: &types.MediaMetadata{
-			MediaID: mediaMetadata.MediaID,
-			Origin:  mediaMetadata.Origin,
-			// Note: the code currently always creates a JPEG thumbnail
-			ContentType:   types.ContentType("image/jpeg"),
+			MediaID:       mediaMetadata.MediaID,
+			Origin:        mediaMetadata.Origin,
+			ContentType:   FormatContentType(fallbackFormat),
 			FileSizeBytes: types.FileSizeBytes(stat.Size()),
 		},
 		ThumbnailSize: types.ThumbnailSize{
@@ -219,21 +250,20 @@ func createThumbnail(
 	err = db.StoreThumbnail(ctx, thumbnailMetadata)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"ActualWidth":  width,
-			"ActualHeight": height,
+			"ActualWidth":  out.Bounds().Max.X,
+			"ActualHeight": out.Bounds().Max.Y,
 		}).Error("Failed to store thumbnail metadata in database.")
-		return false, err
+		return err
 	}
 
-	return false, nil
+	return nil
 }
 
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func adjustSize(img image.Image, w, h int, crop bool) image.Image {
 	var out image.Image
-	var err error
 	if crop {
 		inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
 		outAR := float64(w) / float64(h)
@@ -262,10 +292,5 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
-		logger.WithError(err).Error("Failed to encode and write image")
-		return -1, -1, err
-	}
-
-	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+	return out
 }
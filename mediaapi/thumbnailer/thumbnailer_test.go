@@ -0,0 +1,58 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thumbnailer
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		accept string
+		want   string
+	}{
+		{"jpeg", "image/webp,*/*", "jpeg"},
+		{"png", "image/webp,*/*", "png"},
+		{"webp", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "webp"},
+		{"webp", "image/*,*/*;q=0.8", "jpeg"},
+		{"webp", "", "jpeg"},
+		{"webp", "image/webp;q=0", "jpeg"},
+		{"avif", "image/avif;q=0.9, image/webp", "avif"},
+		{"avif", "image/webp", "jpeg"},
+	}
+	for _, tt := range tests {
+		if got := NegotiateFormat(tt.format, tt.accept); got != tt.want {
+			t.Errorf("NegotiateFormat(%q, %q) = %q, want %q", tt.format, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGetThumbnailPathForFormat(t *testing.T) {
+	size := types.ThumbnailSize{Width: 96, Height: 96, ResizeMethod: types.Crop}
+	src := types.Path("/media/a/b/file")
+	base := GetThumbnailPath(src, size)
+	if got := GetThumbnailPathForFormat(src, size, "jpeg"); got != base {
+		t.Errorf("got %q for jpeg, want %q", got, base)
+	}
+	if got := GetThumbnailPathForFormat(src, size, "png"); got != base {
+		t.Errorf("got %q for png, want %q", got, base)
+	}
+	if got, want := GetThumbnailPathForFormat(src, size, "webp"), base+".webp"; got != want {
+		t.Errorf("got %q for webp, want %q", got, want)
+	}
+}
@@ -87,22 +87,6 @@ type ThumbnailMetadata struct {
 	ThumbnailSize ThumbnailSize
 }
 
-// ThumbnailGenerationResult is used for broadcasting the result of thumbnail generation to routines waiting on the condition
-type ThumbnailGenerationResult struct {
-	// Condition used for the generator to signal the result to all other routines waiting on this condition
-	Cond *sync.Cond
-	// Resulting error from the generation attempt
-	Err error
-}
-
-// ActiveThumbnailGeneration is a lockable map of file paths being thumbnailed
-// It is used to ensure thumbnails are only generated once.
-type ActiveThumbnailGeneration struct {
-	sync.Mutex
-	// The string key is a thumbnail file path
-	PathToResult map[string]*ThumbnailGenerationResult
-}
-
 // Crop indicates we should crop the thumbnail on resize
 const Crop = "crop"
 
@@ -0,0 +1,212 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workqueue limits how much expensive media processing, such as
+// generating thumbnails, happens at the same time.
+package workqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ErrBusy is returned by Do when no worker became free in time.
+	ErrBusy = errors.New("too many media processing jobs are running")
+	// ErrTimeout is returned by Do when a job took longer than the job timeout.
+	ErrTimeout = errors.New("media processing job took too long")
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "processing_queue_depth",
+			Help:      "Number of media processing jobs waiting for a free worker",
+		},
+		[]string{"kind"},
+	)
+	jobsRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "processing_jobs_running",
+			Help:      "Number of media processing jobs being run by a worker",
+		},
+		[]string{"kind"},
+	)
+	jobsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "processing_jobs_rejected_total",
+			Help:      "Number of media processing jobs which gave up waiting for a free worker",
+		},
+		[]string{"kind"},
+	)
+	jobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "dendrite",
+			Subsystem: "mediaapi",
+			Name:      "processing_job_duration_seconds",
+			Help:      "How long media processing jobs took to run, by outcome",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"kind", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth, jobsRunning, jobsRejected, jobDuration)
+}
+
+// Queue runs media processing jobs with a bounded number of workers. Jobs
+// with the same key which are submitted while one is already in progress
+// aren't run again, and share its result instead.
+type Queue struct {
+	workers    chan struct{} // holds a value for each busy worker
+	maxWait    time.Duration
+	jobTimeout time.Duration
+	mu         sync.Mutex
+	jobs       map[string]*job // protected by mu
+}
+
+// job is a job which is waiting for a worker or running.
+type job struct {
+	once sync.Once
+	done chan struct{}
+	err  error // only set before done is closed
+}
+
+func (j *job) finish(err error) {
+	j.once.Do(func() {
+		j.err = err
+		close(j.done)
+	})
+}
+
+// New makes a Queue which runs up to maxConcurrent jobs at the same time.
+// Jobs wait up to maxWait for a free worker, or not at all if maxWait is
+// zero. Jobs which run for longer than jobTimeout are given up on, or never
+// if jobTimeout is zero.
+func New(maxConcurrent int, maxWait, jobTimeout time.Duration) *Queue {
+	return &Queue{
+		workers:    make(chan struct{}, maxConcurrent),
+		maxWait:    maxWait,
+		jobTimeout: jobTimeout,
+		jobs:       make(map[string]*job),
+	}
+}
+
+// Do runs fn on a worker and returns its error, or returns the error of the
+// job already in progress with the same key. The kind of job is only used for
+// metrics. Returns ErrBusy if no worker became free in time and ErrTimeout if
+// the job took too long, or ctx.Err() if ctx was done before the job finished.
+//
+// The context passed to fn isn't derived from ctx, since other callers may be
+// waiting for the same job, but it is done once the job timeout passes. The
+// worker is only freed when fn returns.
+func (q *Queue) Do(ctx context.Context, kind, key string, fn func(ctx context.Context) error) error {
+	q.mu.Lock()
+	j, ok := q.jobs[key]
+	if !ok {
+		j = &job{done: make(chan struct{})}
+		q.jobs[key] = j
+	}
+	q.mu.Unlock()
+	if !ok {
+		go q.run(kind, key, j, fn)
+	}
+	select {
+	case <-j.done:
+		return j.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run waits for a free worker and runs a job on it.
+func (q *Queue) run(kind, key string, j *job, fn func(ctx context.Context) error) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.jobs, key)
+		q.mu.Unlock()
+	}()
+
+	if !q.acquire(kind) {
+		jobsRejected.WithLabelValues(kind).Inc()
+		j.finish(ErrBusy)
+		return
+	}
+
+	ctx, cancel := context.Background(), func() {}
+	if q.jobTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.jobTimeout)
+	}
+	defer cancel()
+
+	start := time.Now()
+	jobsRunning.WithLabelValues(kind).Inc()
+	go func() {
+		defer func() { <-q.workers }()
+		defer jobsRunning.WithLabelValues(kind).Dec()
+		err := fn(ctx)
+		outcome := "success"
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			outcome = "timeout"
+			err = ErrTimeout
+		case err != nil:
+			outcome = "failure"
+		}
+		jobDuration.WithLabelValues(kind, outcome).Observe(time.Since(start).Seconds())
+		j.finish(err)
+	}()
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		// The job keeps its worker until fn notices and returns, but the
+		// callers and any later job with the same key don't wait for it.
+		j.finish(ErrTimeout)
+	}
+}
+
+// acquire waits for a free worker, returning false if none became free
+// within the maximum wait.
+func (q *Queue) acquire(kind string) bool {
+	select {
+	case q.workers <- struct{}{}:
+		return true
+	default:
+	}
+	if q.maxWait <= 0 {
+		return false
+	}
+	queueDepth.WithLabelValues(kind).Inc()
+	defer queueDepth.WithLabelValues(kind).Dec()
+	timer := time.NewTimer(q.maxWait)
+	defer timer.Stop()
+	select {
+	case q.workers <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
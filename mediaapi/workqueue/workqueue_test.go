@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workqueue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdenticalJobsRunOnce(t *testing.T) {
+	q := New(1, 0, 0)
+	var runs int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = q.Do(context.Background(), "test", "key", fn)
+		}(i)
+	}
+	// Give the callers a chance to all join the same job before it finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if runs != 1 {
+		t.Fatalf("job ran %d times, want 1", runs)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d got error %s, want nil", i, err)
+		}
+	}
+}
+
+func TestBusyWhenNoWorkerFree(t *testing.T) {
+	q := New(1, 20*time.Millisecond, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go q.Do(context.Background(), "test", "first", func(ctx context.Context) error { // nolint: errcheck
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	err := q.Do(context.Background(), "test", "second", func(ctx context.Context) error {
+		t.Error("job ran while the only worker was busy")
+		return nil
+	})
+	if err != ErrBusy {
+		t.Fatalf("got error %v, want ErrBusy", err)
+	}
+
+	close(release)
+	// The worker is freed once the first job finishes, so later jobs run.
+	for i := 0; i < 50; i++ {
+		if err = q.Do(context.Background(), "test", "third", func(ctx context.Context) error {
+			return nil
+		}); err != ErrBusy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("got error %v once the worker was free, want nil", err)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	q := New(1, 0, 20*time.Millisecond)
+	err := q.Do(context.Background(), "test", "key", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != ErrTimeout {
+		t.Fatalf("got error %v, want ErrTimeout", err)
+	}
+}
@@ -38,7 +38,10 @@ type ServerACLDatabase interface {
 
 type ServerACLs struct {
 	acls      map[string]*serverACL // room ID -> ACL
-	aclsMutex sync.RWMutex          // protects the above
+	aclsMutex sync.RWMutex          // protects the above and below
+	// Rooms whose create event sets "m.federate" to false, mapped to the
+	// server that created them, which is the only server allowed in them.
+	unfederatable map[string]gomatrixserverlib.ServerName
 }
 
 func NewServerACLs(db ServerACLDatabase) *ServerACLs {
@@ -63,10 +66,46 @@ func NewServerACLs(db ServerACLDatabase) *ServerACLs {
 		if state != nil {
 			acls.OnServerACLUpdate(&state.Event)
 		}
+		create, err := db.GetStateEvent(ctx, room, gomatrixserverlib.MRoomCreate, "")
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get create event for room %q", room)
+			continue
+		}
+		if create != nil {
+			acls.OnRoomCreate(&create.Event)
+		}
 	}
 	return acls
 }
 
+// OnRoomCreate records whether the room can be federated, according to the
+// "m.federate" key of its create event. Servers other than the one that
+// created an unfederatable room are treated as banned from it.
+func (s *ServerACLs) OnRoomCreate(create *gomatrixserverlib.Event) {
+	var content struct {
+		Federate *bool `json:"m.federate"`
+	}
+	if err := json.Unmarshal(create.Content(), &content); err != nil {
+		logrus.WithError(err).Errorf("Failed to unmarshal create event content")
+		return
+	}
+	if content.Federate == nil || *content.Federate {
+		return
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', create.Sender())
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get the domain of the room creator")
+		return
+	}
+	logrus.Debugf("Room %q is not federated beyond %q", create.RoomID(), domain)
+	s.aclsMutex.Lock()
+	defer s.aclsMutex.Unlock()
+	if s.unfederatable == nil {
+		s.unfederatable = make(map[string]gomatrixserverlib.ServerName)
+	}
+	s.unfederatable[create.RoomID()] = domain
+}
+
 type ServerACL struct {
 	Allowed         []string `json:"allow"`
 	Denied          []string `json:"deny"`
@@ -122,6 +161,12 @@ func (s *ServerACLs) OnServerACLUpdate(state *gomatrixserverlib.Event) {
 
 func (s *ServerACLs) IsServerBannedFromRoom(serverName gomatrixserverlib.ServerName, roomID string) bool {
 	s.aclsMutex.RLock()
+	// If the room can't be federated then only the server that created it
+	// is allowed in it.
+	if origin, ok := s.unfederatable[roomID]; ok {
+		s.aclsMutex.RUnlock()
+		return serverName != origin
+	}
 	// First of all check if we have an ACL for this room. If we don't then
 	// no servers are banned from the room.
 	acls, ok := s.acls[roomID]
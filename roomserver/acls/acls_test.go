@@ -17,6 +17,8 @@ package acls
 import (
 	"regexp"
 	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestOpenACLsWithBlacklist(t *testing.T) {
@@ -103,3 +105,23 @@ func TestDefaultACLsWithWhitelist(t *testing.T) {
 		t.Fatal("Expected qux.com:4567 to be allowed but wasn't")
 	}
 }
+
+func TestUnfederatableRoom(t *testing.T) {
+	roomID := "!test:test.com"
+	acls := ServerACLs{
+		acls: make(map[string]*serverACL),
+		unfederatable: map[string]gomatrixserverlib.ServerName{
+			roomID: "test.com",
+		},
+	}
+
+	if acls.IsServerBannedFromRoom("test.com", roomID) {
+		t.Fatal("Expected test.com to be allowed but wasn't")
+	}
+	if !acls.IsServerBannedFromRoom("foo.com", roomID) {
+		t.Fatal("Expected foo.com to be banned but wasn't")
+	}
+	if acls.IsServerBannedFromRoom("foo.com", "!other:test.com") {
+		t.Fatal("Expected foo.com to be allowed in another room but wasn't")
+	}
+}
@@ -42,6 +42,12 @@ type RoomserverInternalAPI interface {
 		res *PerformPeekResponse,
 	)
 
+	PerformUnpeek(
+		ctx context.Context,
+		req *PerformUnpeekRequest,
+		res *PerformUnpeekResponse,
+	)
+
 	PerformPublish(
 		ctx context.Context,
 		req *PerformPublishRequest,
@@ -96,6 +102,13 @@ type RoomserverInternalAPI interface {
 		response *QueryMembershipsForRoomResponse,
 	) error
 
+	// Query the display names and avatars of the users currently joined to a room
+	QueryJoinedMembers(
+		ctx context.Context,
+		request *QueryJoinedMembersRequest,
+		response *QueryJoinedMembersResponse,
+	) error
+
 	// Query if we think we're still in a room.
 	QueryServerJoinedToRoom(
 		ctx context.Context,
@@ -110,6 +123,13 @@ type RoomserverInternalAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query which of a set of events a local user is allowed to see
+	QueryEventsVisibleToUser(
+		ctx context.Context,
+		request *QueryEventsVisibleToUserRequest,
+		response *QueryEventsVisibleToUserResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
@@ -117,6 +137,13 @@ type RoomserverInternalAPI interface {
 		response *QueryMissingEventsResponse,
 	) error
 
+	// Query the auth chain of a set of events
+	QueryAuthChain(
+		ctx context.Context,
+		request *QueryAuthChainRequest,
+		response *QueryAuthChainResponse,
+	) error
+
 	// Query to get state and auth chain for a (potentially hypothetical) event.
 	// Takes lists of PrevEventIDs and AuthEventsIDs and uses them to calculate
 	// the state and auth chain to return.
@@ -139,6 +166,22 @@ type RoomserverInternalAPI interface {
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
+	// QueryEventsBySender pages through the events in a room, returning those sent by the given user.
+	QueryEventsBySender(ctx context.Context, req *QueryEventsBySenderRequest, res *QueryEventsBySenderResponse) error
+	// QueryRelations returns the events which relate to an event, newest first.
+	QueryRelations(ctx context.Context, req *QueryRelationsRequest, res *QueryRelationsResponse) error
+	// QueryAggregations returns the aggregated relations, such as reaction counts and the latest edit, of events.
+	QueryAggregations(ctx context.Context, req *QueryAggregationsRequest, res *QueryAggregationsResponse) error
+	// QueryThreads returns the root events of threads in a room, most recently active first.
+	QueryThreads(ctx context.Context, req *QueryThreadsRequest, res *QueryThreadsResponse) error
+	// QueryRoomCounts returns how many rooms a user is joined to and how many rooms the server knows about.
+	QueryRoomCounts(ctx context.Context, req *QueryRoomCountsRequest, res *QueryRoomCountsResponse) error
+	// QueryRetentionRooms returns the rooms whose events are purged under a message retention policy.
+	QueryRetentionRooms(ctx context.Context, req *QueryRetentionRoomsRequest, res *QueryRetentionRoomsResponse) error
+	// QueryRoomSummary returns the member counts, heroes, name and latest event of a room, without its full state.
+	QueryRoomSummary(ctx context.Context, req *QueryRoomSummaryRequest, res *QueryRoomSummaryResponse) error
+	// QueryInsertionEvent returns the MSC2716 insertion event in a room which accepts a batch ID.
+	QueryInsertionEvent(ctx context.Context, req *QueryInsertionEventRequest, res *QueryInsertionEventResponse) error
 
 	// Query a given amount (or less) of events prior to a given set of events.
 	PerformBackfill(
@@ -46,6 +46,15 @@ func (t *RoomserverInternalAPITrace) PerformPeek(
 	util.GetLogger(ctx).Infof("PerformPeek req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformUnpeek(
+	ctx context.Context,
+	req *PerformUnpeekRequest,
+	res *PerformUnpeekResponse,
+) {
+	t.Impl.PerformUnpeek(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformUnpeek req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformJoin(
 	ctx context.Context,
 	req *PerformJoinRequest,
@@ -144,6 +153,16 @@ func (t *RoomserverInternalAPITrace) QueryMembershipsForRoom(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryJoinedMembers(
+	ctx context.Context,
+	req *QueryJoinedMembersRequest,
+	res *QueryJoinedMembersResponse,
+) error {
+	err := t.Impl.QueryJoinedMembers(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryJoinedMembers req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryServerJoinedToRoom(
 	ctx context.Context,
 	req *QueryServerJoinedToRoomRequest,
@@ -164,6 +183,16 @@ func (t *RoomserverInternalAPITrace) QueryServerAllowedToSeeEvent(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryEventsVisibleToUser(
+	ctx context.Context,
+	req *QueryEventsVisibleToUserRequest,
+	res *QueryEventsVisibleToUserResponse,
+) error {
+	err := t.Impl.QueryEventsVisibleToUser(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventsVisibleToUser req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryMissingEvents(
 	ctx context.Context,
 	req *QueryMissingEventsRequest,
@@ -174,6 +203,16 @@ func (t *RoomserverInternalAPITrace) QueryMissingEvents(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryAuthChain(
+	ctx context.Context,
+	req *QueryAuthChainRequest,
+	res *QueryAuthChainResponse,
+) error {
+	err := t.Impl.QueryAuthChain(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAuthChain req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryStateAndAuthChain(
 	ctx context.Context,
 	req *QueryStateAndAuthChainRequest,
@@ -305,6 +344,13 @@ func (t *RoomserverInternalAPITrace) QueryServerBannedFromRoom(ctx context.Conte
 	return err
 }
 
+// QueryEventsBySender pages through the events in a room, returning those sent by the given user.
+func (t *RoomserverInternalAPITrace) QueryEventsBySender(ctx context.Context, req *QueryEventsBySenderRequest, res *QueryEventsBySenderResponse) error {
+	err := t.Impl.QueryEventsBySender(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventsBySender req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func js(thing interface{}) string {
 	b, err := json.Marshal(thing)
 	if err != nil {
@@ -312,3 +358,52 @@ func js(thing interface{}) string {
 	}
 	return string(b)
 }
+
+// QueryRelations returns the events which relate to an event, newest first.
+func (t *RoomserverInternalAPITrace) QueryRelations(ctx context.Context, req *QueryRelationsRequest, res *QueryRelationsResponse) error {
+	err := t.Impl.QueryRelations(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRelations req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryAggregations returns the aggregated relations, such as reaction counts and the latest edit, of events.
+func (t *RoomserverInternalAPITrace) QueryAggregations(ctx context.Context, req *QueryAggregationsRequest, res *QueryAggregationsResponse) error {
+	err := t.Impl.QueryAggregations(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryAggregations req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryThreads returns the root events of threads in a room, most recently active first.
+func (t *RoomserverInternalAPITrace) QueryThreads(ctx context.Context, req *QueryThreadsRequest, res *QueryThreadsResponse) error {
+	err := t.Impl.QueryThreads(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryThreads req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomCounts returns how many rooms a user is joined to and how many rooms the server knows about.
+func (t *RoomserverInternalAPITrace) QueryRoomCounts(ctx context.Context, req *QueryRoomCountsRequest, res *QueryRoomCountsResponse) error {
+	err := t.Impl.QueryRoomCounts(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomCounts req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRetentionRooms returns the rooms whose events are purged under a message retention policy.
+func (t *RoomserverInternalAPITrace) QueryRetentionRooms(ctx context.Context, req *QueryRetentionRoomsRequest, res *QueryRetentionRoomsResponse) error {
+	err := t.Impl.QueryRetentionRooms(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRetentionRooms req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryRoomSummary returns the member counts, heroes, name and latest event of a room, without its full state.
+func (t *RoomserverInternalAPITrace) QueryRoomSummary(ctx context.Context, req *QueryRoomSummaryRequest, res *QueryRoomSummaryResponse) error {
+	err := t.Impl.QueryRoomSummary(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomSummary req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+// QueryInsertionEvent returns the MSC2716 insertion event in a room which accepts a batch ID.
+func (t *RoomserverInternalAPITrace) QueryInsertionEvent(ctx context.Context, req *QueryInsertionEventRequest, res *QueryInsertionEventResponse) error {
+	err := t.Impl.QueryInsertionEvent(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryInsertionEvent req=%+v res=%+v", js(req), js(res))
+	return err
+}
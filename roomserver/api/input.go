@@ -74,6 +74,14 @@ type InputRoomEvent struct {
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// Whether this is a historical event imported by an application service
+	// (MSC2716). Historical events have the same depth as the event they were
+	// inserted after, rather than being deeper than it. Only used with KindOld.
+	Historical bool `json:"historical,omitempty"`
+	// Whether to soft-fail this event even if it passes auth against the
+	// current state of the room, e.g. because the server which sent it is
+	// quarantined. Only used with KindNew.
+	SoftFail bool `json:"soft_fail,omitempty"`
 }
 
 // TransactionID contains the transaction ID sent by a client when sending an
@@ -86,12 +94,24 @@ type TransactionID struct {
 // InputRoomEventsRequest is a request to InputRoomEvents
 type InputRoomEventsRequest struct {
 	InputRoomEvents []InputRoomEvent `json:"input_room_events"`
+	// If true, the outliers in InputRoomEvents are authed against each other
+	// and stored together in a single transaction rather than one at a time,
+	// before the remaining events are processed in order. The events must be
+	// ordered so that auth events come before the events that reference them,
+	// and must all be for the same room. Events which are invalid or not
+	// allowed are rejected individually without failing the rest of the batch.
+	Batch bool `json:"batch"`
 }
 
 // InputRoomEventsResponse is a response to InputRoomEvents
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	// The IDs of the input events as stored, in the same order as the input.
+	// If an event has a transaction ID which was already used then this is
+	// the ID of the event originally sent with it. For batches, this is empty
+	// for each event which was rejected.
+	EventIDs []string
 }
 
 func (r *InputRoomEventsResponse) Err() error {
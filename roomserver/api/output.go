@@ -51,6 +51,10 @@ const (
 
 	// OutputTypeNewPeek indicates that the kafka event is an OutputNewPeek
 	OutputTypeNewPeek OutputType = "new_peek"
+	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
+	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypePurgedEvents indicates that the kafka event is an OutputPurgedEvents
+	OutputTypePurgedEvents OutputType = "purged_events"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -70,6 +74,10 @@ type OutputEvent struct {
 	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
 	// The content of event with type OutputTypeNewPeek
 	NewPeek *OutputNewPeek `json:"new_peek,omitempty"`
+	// The content of event with type OutputTypeRetirePeek
+	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypePurgedEvents
+	PurgedEvents *OutputPurgedEvents `json:"purged_events,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -124,6 +132,10 @@ type OutputNewRoomEvent struct {
 	// If the LastSentEventID doesn't match what they were expecting it to be
 	// they can use the LatestEventIDs to request the full current state.
 	LastSentEventID string `json:"last_sent_event_id"`
+	// The state snapshot of the room after this event. Consumers can use it
+	// to tell whether the room state has changed, e.g. to key caches on it.
+	// 0 if the roomserver didn't say.
+	StateSnapshotNID int64 `json:"state_snapshot_nid,omitempty"`
 	// The state event IDs that are part of the state at the event, but not
 	// part of the current state. Together with the StateBeforeRemovesEventIDs
 	// this can be used to construct the state before the event from the
@@ -240,3 +252,21 @@ type OutputNewPeek struct {
 	UserID   string
 	DeviceID string
 }
+
+// An OutputRetirePeek is written whenever a user stops peeking into a room
+// using a given device.
+type OutputRetirePeek struct {
+	RoomID   string
+	UserID   string
+	DeviceID string
+}
+
+// An OutputPurgedEvents is written whenever events have expired under their
+// room's message retention policy and the roomserver has wiped their content.
+// Downstream components MUST redact the given event IDs if they have stored
+// the event JSON. The events stay in the room DAG, and state events are never
+// purged.
+type OutputPurgedEvents struct {
+	RoomID   string
+	EventIDs []string
+}
@@ -49,7 +49,10 @@ func (p *PerformError) JSONResponse() util.JSONResponse {
 		// if the code is 0 then something bad happened and it isn't
 		// a remote HTTP error being encapsulated, e.g network error to remote.
 		if p.RemoteCode == 0 {
-			return util.ErrorResponse(fmt.Errorf("%s", p.Msg))
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: jsonerror.Unknown(p.Msg),
+			}
 		}
 		return util.JSONResponse{
 			Code: p.RemoteCode,
@@ -57,7 +60,7 @@ func (p *PerformError) JSONResponse() util.JSONResponse {
 			JSON: json.RawMessage(p.Msg),
 		}
 	default:
-		return util.ErrorResponse(p)
+		return jsonerror.InternalServerError()
 	}
 }
 
@@ -122,13 +125,25 @@ type PerformPeekResponse struct {
 	Error *PerformError
 }
 
+type PerformUnpeekRequest struct {
+	RoomID   string `json:"room_id"`
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+type PerformUnpeekResponse struct {
+	// If non-nil, the unpeek request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
 // PerformBackfillRequest is a request to PerformBackfill.
 type PerformBackfillRequest struct {
 	// The room to backfill
 	RoomID string `json:"room_id"`
 	// A map of backwards extremity event ID to a list of its prev_event IDs.
 	BackwardsExtremities map[string][]string `json:"backwards_extremities"`
-	// The maximum number of events to retrieve.
+	// The maximum number of events to retrieve, up to the configured
+	// client_api.page_limits.messages.
 	Limit int `json:"limit"`
 	// The server interested in the events.
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
@@ -153,6 +168,11 @@ type PerformBackfillResponse struct {
 type PerformPublishRequest struct {
 	RoomID     string
 	Visibility string
+	// The third party network to publish the room in, or empty for the
+	// server's own room directory.
+	NetworkID string
+	// The user publishing the room, or empty for a server admin.
+	UserID string
 }
 
 type PerformPublishResponse struct {
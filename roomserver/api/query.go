@@ -151,6 +151,17 @@ type QueryMembershipsForRoomRequest struct {
 	RoomID string `json:"room_id"`
 	// ID of the user sending the request
 	Sender string `json:"sender"`
+	// Optional ID of an event in the room. If set, the memberships are
+	// returned as they were after this event rather than as they are now.
+	// Users who have left the room never see memberships from after they left.
+	AtEventID string `json:"at_event_id,omitempty"`
+	// Optionally only return the events with this membership.
+	Membership string `json:"membership,omitempty"`
+	// Optionally only return the events without this membership.
+	NotMembership string `json:"not_membership,omitempty"`
+	// The most events to return, up to the configured
+	// client_api.page_limits.members. 0 returns as many as are allowed.
+	Limit int `json:"limit,omitempty"`
 }
 
 // QueryMembershipsForRoomResponse is a response to QueryMembershipsForRoom
@@ -162,6 +173,30 @@ type QueryMembershipsForRoomResponse struct {
 	HasBeenInRoom bool `json:"has_been_in_room"`
 }
 
+// QueryJoinedMembersRequest is a request to QueryJoinedMembers
+type QueryJoinedMembersRequest struct {
+	// ID of the room to fetch the joined members of
+	RoomID string `json:"room_id"`
+	// ID of the user sending the request
+	UserID string `json:"user_id"`
+}
+
+// QueryJoinedMembersResponse is a response to QueryJoinedMembers
+type QueryJoinedMembersResponse struct {
+	// True if the requesting user is currently joined to the room. The
+	// members are only populated if this is true.
+	IsJoined bool `json:"is_joined"`
+	// The currently joined members, keyed by user ID
+	Members map[string]JoinedMember `json:"members"`
+}
+
+// JoinedMember is the profile of a joined member of a room, as given in their
+// current membership event.
+type JoinedMember struct {
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
 // QueryServerJoinedToRoomRequest is a request to QueryServerJoinedToRoom
 type QueryServerJoinedToRoomRequest struct {
 	// Server name of the server to find
@@ -194,13 +229,30 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryEventsVisibleToUserRequest is a request to QueryEventsVisibleToUser
+type QueryEventsVisibleToUserRequest struct {
+	// The user who wants to see the events.
+	UserID string `json:"user_id"`
+	// The events to check. These can be in any number of rooms.
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryEventsVisibleToUserResponse is a response to QueryEventsVisibleToUser
+type QueryEventsVisibleToUserResponse struct {
+	// The IDs of the events which the user is allowed to see according to the
+	// history visibility of the room when each event was sent. Events that we
+	// don't know about are never visible.
+	VisibleEventIDs map[string]bool `json:"visible_event_ids"`
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
 	EarliestEvents []string `json:"earliest_events"`
 	// Latest known events.
 	LatestEvents []string `json:"latest_events"`
-	// Limit the number of events this query returns.
+	// Limit the number of events this query returns, up to the configured
+	// client_api.page_limits.messages.
 	Limit int `json:"limit"`
 	// The server interested in the event
 	ServerName gomatrixserverlib.ServerName `json:"server_name"`
@@ -212,6 +264,23 @@ type QueryMissingEventsResponse struct {
 	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
 }
 
+// QueryAuthChainRequest is a request to QueryAuthChain
+type QueryAuthChainRequest struct {
+	// The room ID that the events are in.
+	RoomID string `json:"room_id"`
+	// The events to fetch the auth chain of, e.g. the auth events of an event.
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryAuthChainResponse is a response to QueryAuthChain
+type QueryAuthChainResponse struct {
+	// Does the room exist on this roomserver?
+	RoomExists bool `json:"room_exists"`
+	// The requested events, their auth events, and so on recursively, in an
+	// arbitrary order. Events that we don't have are left out.
+	AuthChain []gomatrixserverlib.HeaderedEvent `json:"auth_chain"`
+}
+
 // QueryStateAndAuthChainRequest is a request to QueryStateAndAuthChain
 type QueryStateAndAuthChainRequest struct {
 	// The room ID to query the state in.
@@ -221,6 +290,10 @@ type QueryStateAndAuthChainRequest struct {
 	PrevEventIDs []string `json:"prev_event_ids"`
 	// The list of auth events for the event. Used to calculate the auth chain
 	AuthEventIDs []string `json:"auth_event_ids"`
+	// Optional. If set, the state before this event is returned instead of
+	// the state after PrevEventIDs. This is the state that the event was
+	// authed against when it was stored.
+	StateBeforeEventID string `json:"state_before_event_id"`
 	// Should state resolution be ran on the result events?
 	// TODO: check call sites and remove if we always want to do state res
 	ResolveState bool `json:"resolve_state"`
@@ -235,6 +308,7 @@ type QueryStateAndAuthChainResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 	// Do all the previous events exist on this roomserver?
 	// If some of previous events do not exist this will be false and StateEvents will be empty.
+	// If StateBeforeEventID was given, this is false if the state before that event is unknown.
 	PrevEventsExist bool `json:"prev_events_exist"`
 	// The state and auth chain events that were requested.
 	// The lists will be in an arbitrary order.
@@ -264,11 +338,33 @@ type QueryRoomVersionForRoomResponse struct {
 type QueryPublishedRoomsRequest struct {
 	// Optional. If specified, returns whether this room is published or not.
 	RoomID string
+	// Optional. If true, also returns who published which rooms, including
+	// rooms published in the directories of third party networks.
+	IncludePublications bool
+	// Optional. If specified, returns the rooms published in the directory of
+	// this third party network rather than the server's own directory.
+	NetworkID string
+	// Optional. If true, returns the rooms published in the server's own
+	// directory and in the directories of all third party networks.
+	IncludeAllNetworks bool
 }
 
 type QueryPublishedRoomsResponse struct {
 	// The list of published rooms.
 	RoomIDs []string
+	// The publications of rooms, most recent first, if requested.
+	Publications []Publication
+}
+
+// Publication describes the publication of a room in a room directory.
+type Publication struct {
+	RoomID string `json:"room_id"`
+	// The third party network that the room is published in, or empty for
+	// the server's own room directory.
+	NetworkID string `json:"network_id,omitempty"`
+	// The user who published the room, or empty for a server admin.
+	UserID      string                      `json:"user_id,omitempty"`
+	PublishedTS gomatrixserverlib.Timestamp `json:"published_ts"`
 }
 
 type QuerySharedUsersRequest struct {
@@ -343,6 +439,235 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+// QueryEventsBySenderRequest is a request to QueryEventsBySender
+type QueryEventsBySenderRequest struct {
+	// The room to look for events in.
+	RoomID string `json:"room_id"`
+	// The user ID of the sender.
+	Sender string `json:"sender"`
+	// The pagination token returned in a previous response, or 0 to start
+	// from the beginning of the room.
+	From int64 `json:"from"`
+	// The maximum number of events to return.
+	Limit int `json:"limit"`
+}
+
+// QueryEventsBySenderResponse is a response to QueryEventsBySender
+type QueryEventsBySenderResponse struct {
+	// The events sent by the user, in the order that we received them.
+	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The pagination token to use for the next request, or 0 if there are
+	// no more events in the room.
+	Next int64 `json:"next"`
+}
+
+// Relation types which the roomserver aggregates.
+const (
+	RelTypeAnnotation = "m.annotation"
+	RelTypeReplace    = "m.replace"
+	RelTypeThread     = "m.thread"
+)
+
+// QueryRelationsMaxLimit is the maximum number of relations that
+// QueryRelations will return in a single request.
+const QueryRelationsMaxLimit = 100
+
+// QueryRelationsRequest is a request to QueryRelations
+type QueryRelationsRequest struct {
+	// The room that the event is in.
+	RoomID string `json:"room_id"`
+	// The event to find relations to.
+	EventID string `json:"event_id"`
+	// Optional relation type and event type to filter by.
+	RelType   string `json:"rel_type,omitempty"`
+	EventType string `json:"event_type,omitempty"`
+	// The pagination token returned in a previous response, or 0 to start
+	// from the most recent relation.
+	From int64 `json:"from"`
+	// The maximum number of events to return.
+	Limit int `json:"limit"`
+}
+
+// QueryRelationsResponse is a response to QueryRelations
+type QueryRelationsResponse struct {
+	// The events relating to the event, newest first.
+	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The pagination token to use for the next request, or 0 if there are
+	// no more relations.
+	NextBatch int64 `json:"next_batch"`
+}
+
+// QueryAggregationsRequest is a request to QueryAggregations
+type QueryAggregationsRequest struct {
+	// The events to aggregate the relations of.
+	EventIDs []string `json:"event_ids"`
+	// Users whose annotations should not be counted, e.g. because the
+	// requesting user has ignored them.
+	IgnoredUsers []string `json:"ignored_users,omitempty"`
+	// The user making the request, used to work out whether they have
+	// participated in threads.
+	UserID string `json:"user_id,omitempty"`
+}
+
+// QueryAggregationsResponse is a response to QueryAggregations
+type QueryAggregationsResponse struct {
+	// A map from event ID to the aggregated relations of that event. Events
+	// without any aggregated relations are left out.
+	Aggregations map[string]EventAggregations `json:"aggregations"`
+}
+
+// EventAggregations are the aggregated relations of an event.
+type EventAggregations struct {
+	// Annotations grouped by event type and key, most popular first.
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// The most recent edit of the event by its original sender, if any.
+	Replace *Replacement `json:"replace,omitempty"`
+	// A summary of the thread rooted at the event, if any.
+	Thread *ThreadSummary `json:"thread,omitempty"`
+}
+
+// Annotation is the number of users that annotated an event with a key,
+// e.g. the number of users that reacted with a particular emoji.
+type Annotation struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Replacement identifies the event which replaces another event.
+type Replacement struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+	Sender         string                      `json:"sender"`
+}
+
+// ThreadSummary summarises the replies in a thread.
+type ThreadSummary struct {
+	// The most recent event in the thread.
+	LatestEvent gomatrixserverlib.HeaderedEvent `json:"latest_event"`
+	// The number of events in the thread, not including the root.
+	Count int `json:"count"`
+	// True if the requesting user sent the root or any event in the thread.
+	CurrentUserParticipated bool `json:"current_user_participated"`
+}
+
+// Values for QueryThreadsRequest.Include.
+const (
+	ThreadsIncludeAll          = "all"
+	ThreadsIncludeParticipated = "participated"
+)
+
+// QueryThreadsRequest is a request to QueryThreads
+type QueryThreadsRequest struct {
+	// The room to list threads in.
+	RoomID string `json:"room_id"`
+	// The user making the request.
+	UserID string `json:"user_id"`
+	// Either ThreadsIncludeAll, or ThreadsIncludeParticipated to only list
+	// threads that the user has participated in.
+	Include string `json:"include"`
+	// The pagination token returned in a previous response, or 0 to start
+	// from the most recently active thread.
+	From int64 `json:"from"`
+	// The maximum number of thread roots to return.
+	Limit int `json:"limit"`
+}
+
+// QueryThreadsResponse is a response to QueryThreads
+type QueryThreadsResponse struct {
+	// The thread root events, most recently active first.
+	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
+	// The pagination token to use for the next request, or 0 if there are
+	// no more threads.
+	NextBatch int64 `json:"next_batch"`
+}
+
+// QueryRoomCountsRequest is a request to QueryRoomCounts
+type QueryRoomCountsRequest struct {
+	// The user to count the joined rooms of. Can be empty to only count the
+	// rooms known to the server.
+	UserID string `json:"user_id"`
+}
+
+// QueryRoomCountsResponse is a response to QueryRoomCounts
+type QueryRoomCountsResponse struct {
+	// The number of rooms that the user is joined to.
+	JoinedRoomCount int `json:"joined_room_count"`
+	// The number of rooms known to the server.
+	RoomCount int `json:"room_count"`
+	// True if the server knows about as many rooms as room_server.max_rooms
+	// allows, so no new rooms should be created or joined.
+	AtMaxRooms bool `json:"at_max_rooms"`
+}
+
+// QueryRetentionRoomsRequest is a request to QueryRetentionRooms
+type QueryRetentionRoomsRequest struct {
+}
+
+// RoomRetention describes the message retention that applies to a room.
+type RoomRetention struct {
+	RoomID string `json:"room_id"`
+	// How long events are kept for, in milliseconds, after clamping the
+	// room's policy to the allowed lifetimes.
+	MaxLifetimeMS int64 `json:"max_lifetime"`
+	// True if the room has an m.room.retention policy, false if the server's
+	// default max lifetime applies.
+	HasPolicy bool `json:"has_policy"`
+}
+
+// QueryRetentionRoomsResponse is a response to QueryRetentionRooms
+type QueryRetentionRoomsResponse struct {
+	// The rooms whose events expire.
+	Rooms []RoomRetention `json:"rooms"`
+	// True if expired events are actually being purged, which is only the
+	// case if room_server.retention.purge_interval is set.
+	PurgeEnabled bool `json:"purge_enabled"`
+}
+
+// QueryRoomSummaryRequest is a request to QueryRoomSummary
+type QueryRoomSummaryRequest struct {
+	RoomID string `json:"room_id"`
+	// The user asking for the summary. The summary is only filled in if they
+	// are joined to the room, and they are never one of the heroes.
+	UserID string `json:"user_id"`
+}
+
+// QueryRoomSummaryResponse is a response to QueryRoomSummary
+type QueryRoomSummaryResponse struct {
+	// True if the room is known to the server.
+	RoomExists bool `json:"room_exists"`
+	// True if the user is joined to the room. The fields below are only set
+	// if they are.
+	IsJoined           bool `json:"is_joined"`
+	JoinedMemberCount  int  `json:"joined_member_count"`
+	InvitedMemberCount int  `json:"invited_member_count"`
+	// The users to name the room after if it has no name or canonical alias,
+	// as described in the room summary section of the spec.
+	Heroes         []string                      `json:"heroes"`
+	RoomVersion    gomatrixserverlib.RoomVersion `json:"room_version"`
+	Name           string                        `json:"name"`
+	CanonicalAlias string                        `json:"canonical_alias"`
+	AvatarURL      string                        `json:"avatar_url"`
+	JoinRule       string                        `json:"join_rule"`
+	// The most recent event in the room, for previews in the room list.
+	LatestEvent *gomatrixserverlib.HeaderedEvent `json:"latest_event"`
+}
+
+// QueryInsertionEventRequest is a request to QueryInsertionEvent
+type QueryInsertionEventRequest struct {
+	RoomID string `json:"room_id"`
+	// The batch ID which the insertion event accepts, as given in its
+	// org.matrix.msc2716.next_batch_id.
+	BatchID string `json:"batch_id"`
+}
+
+// QueryInsertionEventResponse is a response to QueryInsertionEvent
+type QueryInsertionEventResponse struct {
+	// The ID of the insertion event, or empty if there isn't one in the room
+	// for the batch ID.
+	EventID string `json:"event_id"`
+}
+
 // MarshalJSON stringifies the room ID and StateKeyTuple keys so they can be sent over the wire in HTTP API mode.
 func (r *QueryBulkStateContentResponse) MarshalJSON() ([]byte, error) {
 	se := make(map[string]string)
@@ -41,6 +41,34 @@ func SendEvents(
 	return SendInputRoomEvents(ctx, rsAPI, ires)
 }
 
+// SendEventWithTransactionID writes a new event with a transaction ID to the
+// roomserver and returns the ID of the event which the transaction ID refers
+// to. This is the ID of an earlier event if the transaction ID was already
+// used, in which case the given event is discarded.
+func SendEventWithTransactionID(
+	ctx context.Context, rsAPI RoomserverInternalAPI, event gomatrixserverlib.HeaderedEvent,
+	sendAsServer gomatrixserverlib.ServerName, txnID *TransactionID,
+) (string, error) {
+	request := InputRoomEventsRequest{
+		InputRoomEvents: []InputRoomEvent{{
+			Kind:          KindNew,
+			Event:         event,
+			AuthEventIDs:  event.AuthEventIDs(),
+			SendAsServer:  string(sendAsServer),
+			TransactionID: txnID,
+		}},
+	}
+	var response InputRoomEventsResponse
+	rsAPI.InputRoomEvents(ctx, &request, &response)
+	if err := response.Err(); err != nil {
+		return "", err
+	}
+	if len(response.EventIDs) == 1 && response.EventIDs[0] != "" {
+		return response.EventIDs[0], nil
+	}
+	return event.EventID(), nil
+}
+
 // SendEventWithState writes an event with the specified kind to the roomserver
 // with the state at the event as KindOutlier before it. Will not send any event that is
 // marked as `true` in haveEventIDs
@@ -79,7 +107,7 @@ func SendEventWithState(
 		StateEventIDs: stateEventIDs,
 	})
 
-	return SendInputRoomEvents(ctx, rsAPI, ires)
+	return SendInputRoomEventsBatch(ctx, rsAPI, ires)
 }
 
 // SendInputRoomEvents to the roomserver.
@@ -92,6 +120,17 @@ func SendInputRoomEvents(
 	return response.Err()
 }
 
+// SendInputRoomEventsBatch to the roomserver, storing all of the outliers
+// in a single transaction.
+func SendInputRoomEventsBatch(
+	ctx context.Context, rsAPI RoomserverInternalAPI, ires []InputRoomEvent,
+) error {
+	request := InputRoomEventsRequest{InputRoomEvents: ires, Batch: true}
+	var response InputRoomEventsResponse
+	rsAPI.InputRoomEvents(ctx, &request, &response)
+	return response.Err()
+}
+
 // SendInvite event to the roomserver.
 // This should only be needed for invite events that occur outside of a known room.
 // If we are in the room then the event should be sent using the SendEvents method.
@@ -137,6 +176,34 @@ func GetEvent(ctx context.Context, rsAPI RoomserverInternalAPI, eventID string)
 	return &res.Events[0]
 }
 
+// FilterVisibleEvents returns the events which the user is allowed to see
+// according to the history visibility of their rooms, keeping their order.
+func FilterVisibleEvents(
+	ctx context.Context, rsAPI RoomserverInternalAPI, userID string, events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	var res QueryEventsVisibleToUserResponse
+	if err := rsAPI.QueryEventsVisibleToUser(ctx, &QueryEventsVisibleToUserRequest{
+		UserID:   userID,
+		EventIDs: eventIDs,
+	}, &res); err != nil {
+		return nil, err
+	}
+	visible := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if res.VisibleEventIDs[ev.EventID()] {
+			visible = append(visible, ev)
+		}
+	}
+	return visible, nil
+}
+
 // GetStateEvent returns the current state event in the room or nil.
 func GetStateEvent(ctx context.Context, rsAPI RoomserverInternalAPI, roomID string, tuple gomatrixserverlib.StateKeyTuple) *gomatrixserverlib.HeaderedEvent {
 	var res QueryCurrentStateResponse
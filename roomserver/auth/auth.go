@@ -52,6 +52,71 @@ func IsServerAllowed(
 	return false
 }
 
+// historyVisibilityOrder ranks the history visibilities from the least to the
+// most permissive.
+var historyVisibilityOrder = map[string]int{
+	"joined":         0,
+	"invited":        1,
+	"shared":         2,
+	"world_readable": 3,
+}
+
+// IsUserAllowed returns true if the user is allowed to see the event, given the
+// state of the room before the event and whether the user joined the room at
+// any point after the event. This function implements https://matrix.org/docs/spec/client_server/r0.6.1#id89
+func IsUserAllowed(
+	userID string,
+	userJoinedAfterEvent bool,
+	event gomatrixserverlib.Event,
+	stateBeforeEvent []gomatrixserverlib.Event,
+) bool {
+	historyVisibility := HistoryVisibilityForRoom(stateBeforeEvent)
+	if event.Type() == gomatrixserverlib.MRoomHistoryVisibility && event.StateKeyEquals("") {
+		// If the event changes the history visibility then the more permissive
+		// of the old and new visibilities applies to it, so that users who
+		// could see the history before the change can see the change itself.
+		newVisibility := HistoryVisibilityForRoom([]gomatrixserverlib.Event{event})
+		if historyVisibilityOrder[newVisibility] > historyVisibilityOrder[historyVisibility] {
+			historyVisibility = newVisibility
+		}
+	}
+
+	membership := gomatrixserverlib.Leave
+	for _, ev := range stateBeforeEvent {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(userID) {
+			if m, err := ev.Membership(); err == nil {
+				membership = m
+			}
+		}
+	}
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(userID) {
+		// Users can always see the effect of their own membership events.
+		if m, err := event.Membership(); err == nil {
+			membership = m
+		}
+	}
+
+	// 1. If the history_visibility was set to world_readable, allow.
+	if historyVisibility == "world_readable" {
+		return true
+	}
+	// 2. If the user's membership was join, allow.
+	if membership == gomatrixserverlib.Join {
+		return true
+	}
+	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
+	if historyVisibility == "shared" && userJoinedAfterEvent {
+		return true
+	}
+	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
+	if historyVisibility == "invited" && membership == gomatrixserverlib.Invite {
+		return true
+	}
+
+	// 5. Otherwise, deny.
+	return false
+}
+
 func HistoryVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
@@ -0,0 +1,72 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testUserID = "@alice:test"
+
+func mustEvent(t *testing.T, eventType, stateKey, content string) gomatrixserverlib.Event {
+	t.Helper()
+	eventJSON := fmt.Sprintf(
+		`{"type":%q,"state_key":%q,"content":%s,"sender":"@creator:test","room_id":"!room:test","event_id":"$%s:test","origin_server_ts":1,"depth":1,"prev_events":[],"auth_events":[]}`,
+		eventType, stateKey, content, eventType,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func TestIsUserAllowed(t *testing.T) {
+	visibility := func(v string) gomatrixserverlib.Event {
+		return mustEvent(t, gomatrixserverlib.MRoomHistoryVisibility, "", fmt.Sprintf(`{"history_visibility":%q}`, v))
+	}
+	membership := func(m string) gomatrixserverlib.Event {
+		return mustEvent(t, gomatrixserverlib.MRoomMember, testUserID, fmt.Sprintf(`{"membership":%q}`, m))
+	}
+	message := mustEvent(t, "m.room.message", "", `{"body":"hello"}`)
+
+	tests := []struct {
+		name        string
+		event       gomatrixserverlib.Event
+		state       []gomatrixserverlib.Event
+		joinedAfter bool
+		allowed     bool
+	}{
+		{"world_readable without membership", message, []gomatrixserverlib.Event{visibility("world_readable")}, false, true},
+		{"joined at event", message, []gomatrixserverlib.Event{visibility("joined"), membership("join")}, true, true},
+		{"joined later", message, []gomatrixserverlib.Event{visibility("joined")}, true, false},
+		{"shared and joined later", message, []gomatrixserverlib.Event{visibility("shared")}, true, true},
+		{"shared and never joined", message, []gomatrixserverlib.Event{visibility("shared")}, false, false},
+		{"default is shared", message, nil, true, true},
+		{"invited with invited visibility", message, []gomatrixserverlib.Event{visibility("invited"), membership("invite")}, false, true},
+		{"invited with joined visibility", message, []gomatrixserverlib.Event{visibility("joined"), membership("invite")}, false, false},
+		{"left with joined visibility", message, []gomatrixserverlib.Event{visibility("joined"), membership("leave")}, true, false},
+		{"own join event", membership("join"), []gomatrixserverlib.Event{visibility("joined")}, true, true},
+		{"change to world_readable", visibility("world_readable"), []gomatrixserverlib.Event{visibility("joined")}, false, true},
+	}
+	for _, tt := range tests {
+		if got := IsUserAllowed(testUserID, tt.joinedAfter, tt.event, tt.state); got != tt.allowed {
+			t.Errorf("%s: IsUserAllowed got %v want %v", tt.name, got, tt.allowed)
+		}
+	}
+}
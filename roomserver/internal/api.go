@@ -23,6 +23,7 @@ type RoomserverInternalAPI struct {
 	*perform.Inviter
 	*perform.Joiner
 	*perform.Peeker
+	*perform.Unpeeker
 	*perform.Leaver
 	*perform.Publisher
 	*perform.Backfiller
@@ -35,6 +36,8 @@ type RoomserverInternalAPI struct {
 	fsAPI                  fsAPI.FederationSenderInternalAPI
 	OutputRoomEventTopic   string // Kafka topic for new output room events
 	PerspectiveServerNames []gomatrixserverlib.ServerName
+	// Purges expired events, or nil if room_server.retention is disabled.
+	Purger *perform.Purger
 }
 
 func NewRoomserverAPI(
@@ -54,6 +57,9 @@ func NewRoomserverAPI(
 			DB:         roomserverDB,
 			Cache:      caches,
 			ServerACLs: serverACLs,
+			MaxRooms:   cfg.MaxRooms,
+			Retention:  &cfg.Retention,
+			PageLimits: cfg.PageLimits,
 		},
 		Inputer: &input.Inputer{
 			DB:                   roomserverDB,
@@ -61,9 +67,15 @@ func NewRoomserverAPI(
 			Producer:             producer,
 			ServerName:           cfg.Matrix.ServerName,
 			ACLs:                 serverACLs,
+			WriteBatchWindow:     cfg.WriteBatchWindow,
+			MaxBatchSize:         cfg.MaxBatchSize,
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
+	if cfg.Retention.PurgeInterval > 0 {
+		a.Purger = perform.NewPurger(roomserverDB, cfg, a.Inputer)
+		a.Purger.Start()
+	}
 	return a
 }
 
@@ -93,6 +105,11 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 		FSAPI:      r.fsAPI,
 		Inputer:    r.Inputer,
 	}
+	r.Unpeeker = &perform.Unpeeker{
+		ServerName: r.Cfg.Matrix.ServerName,
+		Cfg:        r.Cfg,
+		Inputer:    r.Inputer,
+	}
 	r.Leaver = &perform.Leaver{
 		Cfg:     r.Cfg,
 		DB:      r.DB,
@@ -111,6 +128,9 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 		// prefer these servers when backfilling (assuming they are in the room) rather
 		// than trying random servers
 		PreferServers: r.PerspectiveServerNames,
+		MinDepth:      r.Cfg.BackfillMinDepth,
+		MaxEvents:     r.Cfg.BackfillMaxEvents,
+		MaxLimit:      r.Cfg.PageLimits.Messages,
 	}
 }
 
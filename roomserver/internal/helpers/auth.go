@@ -36,33 +36,57 @@ func CheckForSoftFail(
 ) (bool, error) {
 	rewritesState := len(stateEventIDs) > 1
 
-	var authStateEntries []types.StateEntry
-	var err error
 	if rewritesState {
-		authStateEntries, err = db.StateEntriesForEventIDs(ctx, stateEventIDs)
+		authStateEntries, err := db.StateEntriesForEventIDs(ctx, stateEventIDs)
 		if err != nil {
 			return true, fmt.Errorf("StateEntriesForEventIDs failed: %w", err)
 		}
-	} else {
-		// Work out if the room exists.
-		var roomInfo *types.RoomInfo
-		roomInfo, err = db.RoomInfo(ctx, event.RoomID())
-		if err != nil {
-			return false, fmt.Errorf("db.RoomNID: %w", err)
-		}
-		if roomInfo == nil || roomInfo.IsStub {
-			return false, nil
-		}
+		return checkForSoftFail(ctx, db, event, authStateEntries)
+	}
 
-		// Then get the state entries for the current state snapshot.
-		// We'll use this to check if the event is allowed right now.
-		roomState := state.NewStateResolution(db, *roomInfo)
-		authStateEntries, err = roomState.LoadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID)
-		if err != nil {
-			return true, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
-		}
+	// Work out if the room exists.
+	roomInfo, err := db.RoomInfo(ctx, event.RoomID())
+	if err != nil {
+		return false, fmt.Errorf("db.RoomNID: %w", err)
 	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return false, nil
+	}
+	return CheckForSoftFailAtSnapshot(ctx, db, *roomInfo, event, roomInfo.StateSnapshotNID)
+}
 
+// CheckForSoftFailAtSnapshot is like CheckForSoftFail, but checks the event
+// against the given snapshot of the room state rather than the current state
+// of the room in the database. This is used while the current state is being
+// updated in a transaction which hasn't been committed yet.
+func CheckForSoftFailAtSnapshot(
+	ctx context.Context,
+	db storage.Database,
+	roomInfo types.RoomInfo,
+	event gomatrixserverlib.HeaderedEvent,
+	stateNID types.StateSnapshotNID,
+) (bool, error) {
+	if stateNID == 0 {
+		// The room doesn't have any current state yet.
+		return false, nil
+	}
+
+	// Then get the state entries for the state snapshot.
+	// We'll use this to check if the event is allowed right now.
+	roomState := state.NewStateResolution(db, roomInfo)
+	authStateEntries, err := roomState.LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return true, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	return checkForSoftFail(ctx, db, event, authStateEntries)
+}
+
+func checkForSoftFail(
+	ctx context.Context,
+	db storage.Database,
+	event gomatrixserverlib.HeaderedEvent,
+	authStateEntries []types.StateEntry,
+) (bool, error) {
 	// As a special case, it's possible that the room will have no
 	// state because we haven't received a m.room.create event yet.
 	// If we're now processing the first create event then never
@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+)
+
+// MRoomRetention is the state event type of MSC1763 message retention policies.
+const MRoomRetention = "m.room.retention"
+
+// RoomMaxLifetime returns how long events in the room are kept for, which is
+// the max_lifetime of the room's m.room.retention policy clamped to the
+// allowed lifetimes, or the default max lifetime if the room doesn't have a
+// policy. Events are always kept for at least the policy's min_lifetime,
+// clamped in the same way. Zero means that events are kept forever.
+// hasPolicy is true if the room has a policy.
+func RoomMaxLifetime(
+	ctx context.Context, db storage.Database, cfg *config.MessageRetention, roomID string,
+) (lifetime time.Duration, hasPolicy bool, err error) {
+	ev, err := db.GetStateEvent(ctx, roomID, MRoomRetention, "")
+	if err != nil {
+		return 0, false, err
+	}
+	lifetime = cfg.DefaultMaxLifetime
+	if ev == nil {
+		return lifetime, false, nil
+	}
+	var content struct {
+		MaxLifetime *int64 `json:"max_lifetime"`
+		MinLifetime *int64 `json:"min_lifetime"`
+	}
+	if err = json.Unmarshal(ev.Content(), &content); err != nil {
+		return lifetime, false, nil
+	}
+	if content.MaxLifetime != nil && *content.MaxLifetime > 0 {
+		lifetime, hasPolicy = cfg.ClampLifetime(time.Duration(*content.MaxLifetime)*time.Millisecond), true
+	}
+	if lifetime > 0 && content.MinLifetime != nil && *content.MinLifetime > 0 {
+		if minLifetime := cfg.ClampLifetime(time.Duration(*content.MinLifetime) * time.Millisecond); minLifetime > lifetime {
+			lifetime = minLifetime
+		}
+		hasPolicy = true
+	}
+	return lifetime, hasPolicy, nil
+}
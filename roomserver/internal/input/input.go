@@ -18,6 +18,7 @@ package input
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
@@ -36,15 +37,26 @@ type Inputer struct {
 	ServerName           gomatrixserverlib.ServerName
 	ACLs                 *acls.ServerACLs
 	OutputRoomEventTopic string
+	WriteBatchWindow     time.Duration // 0 to process input events as they arrive
+	MaxBatchSize         int
 
-	workers sync.Map // room ID -> *inputWorker
+	workers   sync.Map // room ID -> *inputWorker
+	stopMutex sync.RWMutex
+	stopped   bool           // protected by stopMutex
+	inFlight  sync.WaitGroup // input requests being processed
 }
 
+var errInputStopped = errors.New("the roomserver is shutting down")
+
 type inputTask struct {
 	ctx   context.Context
 	event *api.InputRoomEvent
+	batch []api.InputRoomEvent // set instead of event for batched input
 	wg    *sync.WaitGroup
-	err   error // written back by worker, only safe to read when all tasks are done
+	// written back by worker, only safe to read when all tasks are done
+	eventID  string
+	eventIDs []string // for batched input
+	err      error
 }
 
 type inputWorker struct {
@@ -61,14 +73,85 @@ func (w *inputWorker) start() {
 	for {
 		select {
 		case task := <-w.input:
-			_, task.err = w.r.processRoomEvent(task.ctx, task.event)
-			task.wg.Done()
+			w.r.processTasks(w.collectTasks(task))
 		case <-time.After(time.Second * 5):
 			return
 		}
 	}
 }
 
+// collectTasks waits for up to WriteBatchWindow for more tasks to arrive after
+// the given one, so that they can be written to the database together.
+func (w *inputWorker) collectTasks(task *inputTask) []*inputTask {
+	tasks := []*inputTask{task}
+	if w.r.WriteBatchWindow <= 0 {
+		return tasks
+	}
+	timer := time.NewTimer(w.r.WriteBatchWindow)
+	defer timer.Stop()
+	for len(tasks) < w.r.MaxBatchSize {
+		select {
+		case task = <-w.input:
+			tasks = append(tasks, task)
+		case <-timer.C:
+			return tasks
+		}
+	}
+	return tasks
+}
+
+// processTasks processes the tasks in the order that they arrived. Runs of
+// outliers are stored in a single transaction, as they don't depend on the
+// room state and only produce output events for redactions that they complete,
+// so this doesn't change the order of anything that the rest of the server sees.
+// Runs of new events in the same room update the latest events in the room in
+// a single transaction, one event after another, so their output events are
+// written in the same order as if they had been processed one at a time.
+func (r *Inputer) processTasks(tasks []*inputTask) {
+	for len(tasks) > 0 {
+		if run := countTasks(tasks, isOutlierTask); run > 1 {
+			r.processOutlierTasks(tasks[:run])
+			tasks = tasks[run:]
+			continue
+		}
+		if run := countTasks(tasks, isNewEventTask); run > 1 {
+			r.processNewEventTasks(tasks[:run])
+			tasks = tasks[run:]
+			continue
+		}
+		task := tasks[0]
+		if task.batch != nil {
+			task.eventIDs, task.err = r.processRoomEventBatch(task.ctx, task.batch)
+		} else {
+			task.eventID, task.err = r.processRoomEvent(task.ctx, task.event, nil)
+		}
+		task.wg.Done()
+		tasks = tasks[1:]
+	}
+}
+
+// countTasks returns how many tasks at the start of the list match, each
+// compared with the first task.
+func countTasks(tasks []*inputTask, match func(first, task *inputTask) bool) int {
+	run := 0
+	for run < len(tasks) && match(tasks[0], tasks[run]) {
+		run++
+	}
+	return run
+}
+
+func isOutlierTask(_, task *inputTask) bool {
+	return task.event != nil && task.event.Kind == api.KindOutlier
+}
+
+// isNewEventTask returns true if the task is a new event in the same room
+// as the first task, which doesn't replace the state of the room.
+func isNewEventTask(first, task *inputTask) bool {
+	return task.event != nil && task.event.Kind == api.KindNew &&
+		!task.event.HasState && len(task.event.StateEventIDs) <= 1 &&
+		task.event.Event.RoomID() == first.event.Event.RoomID()
+}
+
 // WriteOutputEvents implements OutputRoomEventWriter
 func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
 	messages := make([]*sarama.ProducerMessage, len(updates))
@@ -94,6 +177,10 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 				ev := updates[i].NewRoomEvent.Event.Unwrap()
 				defer r.ACLs.OnServerACLUpdate(&ev)
 			}
+			if updates[i].NewRoomEvent.Event.Type() == gomatrixserverlib.MRoomCreate && updates[i].NewRoomEvent.Event.StateKeyEquals("") {
+				ev := updates[i].NewRoomEvent.Event.Unwrap()
+				r.ACLs.OnRoomCreate(&ev)
+			}
 		}
 		logger.Infof("Producing to topic '%s'", r.OutputRoomEventTopic)
 		messages[i] = &sarama.ProducerMessage{
@@ -105,12 +192,42 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 	return r.Producer.SendMessages(messages)
 }
 
+// workerForRoom returns the input worker for the given room, creating
+// it if it doesn't exist.
+func (r *Inputer) workerForRoom(roomID string) *inputWorker {
+	// Work out if we are running per-room workers or if we're just doing
+	// it on a global basis (e.g. SQLite).
+	if !r.DB.SupportsConcurrentRoomInputs() {
+		roomID = "global"
+	}
+
+	// Look up the worker, or create it if it doesn't exist. This channel
+	// is buffered to reduce the chance that we'll be blocked by another
+	// room - the channel will be quite small as it's just pointer types.
+	w, _ := r.workers.LoadOrStore(roomID, &inputWorker{
+		r:     r,
+		input: make(chan *inputTask, 10),
+	})
+	return w.(*inputWorker)
+}
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	if !r.startInput() {
+		response.ErrMsg = errInputStopped.Error()
+		return
+	}
+	defer r.inFlight.Done()
+
+	if request.Batch && len(request.InputRoomEvents) > 0 {
+		r.inputRoomEventsBatch(ctx, request, response)
+		return
+	}
+
 	// Create a wait group. Each task that we dispatch will call Done on
 	// this wait group so that we know when all of our events have been
 	// processed.
@@ -119,21 +236,7 @@ func (r *Inputer) InputRoomEvents(
 	tasks := make([]*inputTask, len(request.InputRoomEvents))
 
 	for i, e := range request.InputRoomEvents {
-		// Work out if we are running per-room workers or if we're just doing
-		// it on a global basis (e.g. SQLite).
-		roomID := "global"
-		if r.DB.SupportsConcurrentRoomInputs() {
-			roomID = e.Event.RoomID()
-		}
-
-		// Look up the worker, or create it if it doesn't exist. This channel
-		// is buffered to reduce the chance that we'll be blocked by another
-		// room - the channel will be quite small as it's just pointer types.
-		w, _ := r.workers.LoadOrStore(roomID, &inputWorker{
-			r:     r,
-			input: make(chan *inputTask, 10),
-		})
-		worker := w.(*inputWorker)
+		worker := r.workerForRoom(e.Event.RoomID())
 
 		// Create a task. This contains the input event and a reference to
 		// the wait group, so that the worker can notify us when this specific
@@ -154,12 +257,74 @@ func (r *Inputer) InputRoomEvents(
 
 	// If any of the tasks returned an error, we should probably report
 	// that back to the caller.
-	for _, task := range tasks {
+	response.EventIDs = make([]string, len(tasks))
+	for i, task := range tasks {
 		if task.err != nil {
 			response.ErrMsg = task.err.Error()
 			_, rejected := task.err.(*gomatrixserverlib.NotAllowed)
 			response.NotAllowed = rejected
 			return
 		}
+		response.EventIDs[i] = task.eventID
+	}
+}
+
+// startInput counts an input request as in flight, unless the Inputer has been
+// stopped. Returns false if it has.
+func (r *Inputer) startInput() bool {
+	r.stopMutex.RLock()
+	defer r.stopMutex.RUnlock()
+	if r.stopped {
+		return false
+	}
+	r.inFlight.Add(1)
+	return true
+}
+
+// Stop rejects new input, and waits for the events already being input to be
+// processed and their output events sent, or for the context to be done.
+func (r *Inputer) Stop(ctx context.Context) error {
+	r.stopMutex.Lock()
+	r.stopped = true
+	r.stopMutex.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		r.inFlight.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inputRoomEventsBatch sends the entire request to a single worker so that
+// the batch is processed in order and atomically with respect to other input
+// for the same room.
+func (r *Inputer) inputRoomEventsBatch(
+	ctx context.Context,
+	request *api.InputRoomEventsRequest,
+	response *api.InputRoomEventsResponse,
+) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	task := &inputTask{
+		ctx:   ctx,
+		batch: request.InputRoomEvents,
+		wg:    wg,
+	}
+	worker := r.workerForRoom(request.InputRoomEvents[0].Event.RoomID())
+	go worker.start()
+	worker.input <- task
+	wg.Wait()
+
+	if task.err != nil {
+		response.ErrMsg = task.err.Error()
+		_, rejected := task.err.(*gomatrixserverlib.NotAllowed)
+		response.NotAllowed = rejected
+		return
 	}
+	response.EventIDs = task.eventIDs
 }
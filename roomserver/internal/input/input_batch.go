@@ -0,0 +1,414 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// processRoomEventBatch processes an ordered batch of input events. All of
+// the outliers in the batch are authed against each other and the database,
+// then stored in a single transaction, so that a failure to store them leaves
+// nothing behind. The remaining events are then processed in order as normal,
+// which means that state only needs to be calculated for those, rather than
+// for every event in the batch. An event which is invalid or not allowed is
+// rejected on its own and the rest of the batch carries on without it. Returns
+// the IDs of the events which were accepted, in the same order as the input,
+// with an empty string for each event that was rejected.
+func (r *Inputer) processRoomEventBatch(
+	ctx context.Context,
+	inputs []api.InputRoomEvent,
+) ([]string, error) {
+	var (
+		outliers     []gomatrixserverlib.Event
+		outlierIdxs  []int
+		authEventIDs [][]string
+		rejected     []bool
+		roomVersions = make(map[string]gomatrixserverlib.RoomVersion)
+	)
+	eventIDs := make([]string, len(inputs))
+	// Events which have passed auth so far in this batch, by event ID.
+	accepted := make(map[string]*gomatrixserverlib.Event)
+	for i := range inputs {
+		if inputs[i].Kind != api.KindOutlier {
+			continue
+		}
+		event := inputs[i].Event.Unwrap()
+		logger := logrus.WithField("event_id", event.EventID())
+		if err := eventutil.CheckEventSize(event.JSON(), nil); err != nil {
+			logger.WithError(err).Warn("Batched outlier is too large, rejecting event")
+			continue
+		}
+		if err := r.checkRoomVersion(ctx, &inputs[i].Event); err != nil {
+			logger.WithError(err).Warn("Batched outlier has the wrong room version, rejecting event")
+			continue
+		}
+		knownAuthEventIDs, err := r.checkBatchAuth(ctx, event, inputs[i].AuthEventIDs, accepted)
+		if err != nil {
+			logger.WithError(err).Error("Auth check failed for batched outlier, rejecting event")
+		} else {
+			accepted[event.EventID()] = &event
+		}
+		outliers = append(outliers, event)
+		outlierIdxs = append(outlierIdxs, i)
+		authEventIDs = append(authEventIDs, knownAuthEventIDs)
+		rejected = append(rejected, err != nil)
+		roomVersions[event.RoomID()] = inputs[i].Event.RoomVersion
+	}
+
+	if len(outliers) > 0 {
+		_, redactions, err := r.DB.StoreEvents(ctx, outliers, authEventIDs, rejected)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.StoreEvents: %w", err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"room_id":  outliers[0].RoomID(),
+			"outliers": len(outliers),
+		}).Debug("Stored batch of outliers")
+		if err = r.writeRedactions(roomVersions, redactions); err != nil {
+			return nil, err
+		}
+		for i, idx := range outlierIdxs {
+			if !rejected[i] {
+				eventIDs[idx] = outliers[i].EventID()
+			}
+		}
+	}
+
+	for i := range inputs {
+		if inputs[i].Kind == api.KindOutlier {
+			continue
+		}
+		eventID, err := r.processRoomEvent(ctx, &inputs[i], nil)
+		if err != nil {
+			logrus.WithError(err).WithField("event_id", inputs[i].Event.EventID()).Warn("Failed to process batched event, rejecting event")
+			continue
+		}
+		eventIDs[i] = eventID
+	}
+	return eventIDs, nil
+}
+
+// processOutlierTasks stores the outliers from several input tasks in a single
+// transaction, authing them against each other and the database in the same
+// way as processRoomEventBatch does. If storing fails then every task fails.
+func (r *Inputer) processOutlierTasks(tasks []*inputTask) {
+	var (
+		outliers     []gomatrixserverlib.Event
+		authEventIDs [][]string
+		rejected     []bool
+		stored       []*inputTask
+		roomVersions = make(map[string]gomatrixserverlib.RoomVersion)
+	)
+	accepted := make(map[string]*gomatrixserverlib.Event)
+	for _, task := range tasks {
+		event := task.event.Event.Unwrap()
+		if err := eventutil.CheckEventSize(event.JSON(), nil); err != nil {
+			task.err = err
+			continue
+		}
+		if err := r.checkRoomVersion(task.ctx, &task.event.Event); err != nil {
+			task.err = err
+			continue
+		}
+		knownAuthEventIDs, err := r.checkBatchAuth(task.ctx, event, task.event.AuthEventIDs, accepted)
+		if err != nil {
+			logrus.WithError(err).WithField("event_id", event.EventID()).Error("Auth check failed for buffered outlier, rejecting event")
+		} else {
+			accepted[event.EventID()] = &event
+		}
+		outliers = append(outliers, event)
+		authEventIDs = append(authEventIDs, knownAuthEventIDs)
+		rejected = append(rejected, err != nil)
+		stored = append(stored, task)
+		roomVersions[event.RoomID()] = task.event.Event.RoomVersion
+	}
+
+	if len(outliers) > 0 {
+		// The tasks may have come from different requests, so don't let one
+		// of them being cancelled stop the others from being stored.
+		_, redactions, err := r.DB.StoreEvents(context.Background(), outliers, authEventIDs, rejected)
+		if err != nil {
+			err = fmt.Errorf("r.DB.StoreEvents: %w", err)
+		} else {
+			err = r.writeRedactions(roomVersions, redactions)
+		}
+		for i, task := range stored {
+			if err != nil {
+				task.err = err
+			} else {
+				task.eventID = outliers[i].EventID()
+			}
+		}
+		logrus.WithFields(logrus.Fields{
+			"room_id":  outliers[0].RoomID(),
+			"outliers": len(outliers),
+		}).WithError(err).Debug("Stored buffered outliers")
+	}
+
+	for _, task := range tasks {
+		task.wg.Done()
+	}
+}
+
+// deferredNewEvent is a new event which has been stored by processRoomEvent,
+// but which hasn't updated the latest events in the room yet.
+type deferredNewEvent struct {
+	input        *api.InputRoomEvent
+	event        gomatrixserverlib.Event
+	stateAtEvent types.StateAtEvent
+	// Set if the event wasn't rejected, so should update the latest events.
+	ready           bool
+	outcome         string
+	roomInfo        *types.RoomInfo
+	redactionEvent  *gomatrixserverlib.Event
+	redactedEventID string
+	// For metrics about events from remote servers.
+	origin    gomatrixserverlib.ServerName
+	federated bool
+	start     time.Time
+}
+
+// processNewEventTasks processes a run of new events in the same room. Each
+// event is checked, stored and has its state calculated as normal, and then
+// the latest events in the room are updated for all of them in a single
+// transaction, rather than one transaction per event. If that fails then every
+// event which would have updated the latest events fails.
+func (r *Inputer) processNewEventTasks(tasks []*inputTask) {
+	deferred := make([]*deferredNewEvent, len(tasks))
+	var stored []*deferredNewEvent
+	var roomInfo *types.RoomInfo
+	for i, task := range tasks {
+		deferred[i] = &deferredNewEvent{}
+		task.eventID, task.err = r.processRoomEvent(task.ctx, task.event, deferred[i])
+		if deferred[i].input != nil {
+			stored = append(stored, deferred[i])
+		}
+		if deferred[i].ready {
+			roomInfo = deferred[i].roomInfo
+		}
+	}
+
+	if len(stored) > 0 {
+		// The tasks may have come from different requests, so don't let one
+		// of them being cancelled stop the others from being processed.
+		err := r.updateLatestEventsBatch(context.Background(), roomInfo, stored)
+		for i, task := range tasks {
+			d := deferred[i]
+			if !d.ready {
+				continue
+			}
+			outcome := d.outcome
+			if err != nil {
+				task.err = err
+				outcome = "error"
+			}
+			if d.federated {
+				observeFederatedEvent(d.origin, d.input.Event.RoomVersion, outcome, d.start)
+			}
+		}
+	}
+
+	for _, task := range tasks {
+		task.wg.Done()
+	}
+}
+
+// updateLatestEventsBatch stores the references to the prev events of the
+// given events, and updates the latest events in the room for those which
+// weren't rejected, in order and in a single transaction. The events are
+// soft-fail checked against the current state of the room as it is updated
+// by each of them in turn. The output events for the whole batch are written
+// once the transaction has been committed, so that nothing is sent for events
+// whose update was rolled back.
+func (r *Inputer) updateLatestEventsBatch(
+	ctx context.Context, roomInfo *types.RoomInfo, events []*deferredNewEvent,
+) error {
+	outputs, err := r.storeLatestEventsBatch(ctx, roomInfo, events)
+	if err != nil {
+		return err
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+	if err = r.WriteOutputEvents(events[0].event.RoomID(), outputs); err != nil {
+		return fmt.Errorf("r.WriteOutputEvents: %w", err)
+	}
+	return nil
+}
+
+// storeLatestEventsBatch does the database work for updateLatestEventsBatch
+// in a single transaction, returning the output events to write once it has
+// been committed.
+func (r *Inputer) storeLatestEventsBatch(
+	ctx context.Context, roomInfo *types.RoomInfo, events []*deferredNewEvent,
+) (outputs []api.OutputEvent, err error) {
+	if roomInfo == nil {
+		// None of the events need to update the latest events, so we only
+		// need to store the references to their prev events.
+		if roomInfo, err = r.DB.RoomInfo(ctx, events[0].event.RoomID()); err != nil {
+			return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if roomInfo == nil {
+			return nil, fmt.Errorf("r.DB.RoomInfo missing for room %s", events[0].event.RoomID())
+		}
+	}
+	updater, err := r.DB.GetLatestEventsForUpdate(ctx, *roomInfo)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetLatestEventsForUpdate: %w", err)
+	}
+	succeeded := false
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
+	for _, d := range events {
+		if prevEvents := d.event.PrevEvents(); len(prevEvents) > 0 {
+			if err = updater.StoreDeferredPreviousEvents(d.stateAtEvent.EventNID, prevEvents); err != nil {
+				return nil, fmt.Errorf("updater.StoreDeferredPreviousEvents: %w", err)
+			}
+		}
+		if !d.ready {
+			continue
+		}
+
+		// Check that the event passes authentication checks based on the
+		// current room state, including the changes made by the events
+		// before it in this batch.
+		softfail, serr := helpers.CheckForSoftFailAtSnapshot(ctx, r.DB, *roomInfo, d.input.Event, updater.CurrentStateSnapshotNID())
+		if serr != nil {
+			logrus.WithFields(logrus.Fields{
+				"event_id": d.event.EventID(),
+				"type":     d.event.Type(),
+				"room":     d.event.RoomID(),
+			}).WithError(serr).Info("Error authing soft-failed event")
+		}
+		if softfail || d.input.SoftFail {
+			d.outcome = "soft_failed"
+			logrus.WithFields(logrus.Fields{
+				"event_id":  d.event.EventID(),
+				"type":      d.event.Type(),
+				"room":      d.event.RoomID(),
+				"soft_fail": true,
+				"sender":    d.event.Sender(),
+			}).Debug("Stored rejected event")
+			continue
+		}
+
+		u := latestEventsUpdater{
+			ctx:           ctx,
+			api:           r,
+			updater:       updater,
+			roomInfo:      roomInfo,
+			stateAtEvent:  d.stateAtEvent,
+			event:         d.event,
+			sendAsServer:  d.input.SendAsServer,
+			transactionID: d.input.TransactionID,
+			rewritesState: d.input.HasState,
+			outputs:       &outputs,
+		}
+		if err = u.doUpdateLatestEvents(); err != nil {
+			return nil, fmt.Errorf("u.doUpdateLatestEvents: %w", err)
+		}
+		d.outcome = "persisted"
+
+		if d.redactedEventID != "" {
+			outputs = append(outputs, redactionOutputEvent(roomInfo.RoomVersion, types.Redaction{
+				RedactionEvent:  d.redactionEvent,
+				RedactedEventID: d.redactedEventID,
+			}))
+		}
+	}
+
+	succeeded = true
+	return outputs, nil
+}
+
+// writeRedactions tells downstream components about redactions which were
+// completed by storing a batch of outliers, in the same way as processRoomEvent
+// does for a single event. The redacted event may be one that they already have.
+func (r *Inputer) writeRedactions(
+	roomVersions map[string]gomatrixserverlib.RoomVersion, redactions []types.Redaction,
+) error {
+	for _, redaction := range redactions {
+		roomVersion := roomVersions[redaction.RedactionEvent.RoomID()]
+		err := r.WriteOutputEvents(redaction.RedactionEvent.RoomID(), []api.OutputEvent{
+			redactionOutputEvent(roomVersion, redaction),
+		})
+		if err != nil {
+			return fmt.Errorf("r.WriteOutputEvents (redactions): %w", err)
+		}
+	}
+	return nil
+}
+
+// redactionOutputEvent returns the output event telling downstream components
+// about a redaction.
+func redactionOutputEvent(roomVersion gomatrixserverlib.RoomVersion, redaction types.Redaction) api.OutputEvent {
+	return api.OutputEvent{
+		Type: api.OutputTypeRedactedEvent,
+		RedactedEvent: &api.OutputRedactedEvent{
+			RedactedEventID: redaction.RedactedEventID,
+			RedactedBecause: redaction.RedactionEvent.Headered(roomVersion),
+		},
+	}
+}
+
+// checkBatchAuth checks that the event is allowed by its auth events, which
+// may either be earlier events in the batch or events already in the database.
+// Returns the IDs of the auth events that we know about, even if the event is
+// not allowed, so that they can be stored alongside the event.
+func (r *Inputer) checkBatchAuth(
+	ctx context.Context, event gomatrixserverlib.Event, authEventIDs []string,
+	accepted map[string]*gomatrixserverlib.Event,
+) ([]string, error) {
+	known := make([]string, 0, len(authEventIDs))
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	var missing []string
+	for _, authEventID := range authEventIDs {
+		if ev, ok := accepted[authEventID]; ok {
+			if err := authEvents.AddEvent(ev); err != nil {
+				return known, err
+			}
+			known = append(known, authEventID)
+		} else {
+			missing = append(missing, authEventID)
+		}
+	}
+	if len(missing) > 0 {
+		events, err := r.DB.EventsFromIDs(ctx, missing)
+		if err != nil {
+			return known, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		for i := range events {
+			if err = authEvents.AddEvent(&events[i].Event); err != nil {
+				return known, err
+			}
+			known = append(known, events[i].EventID())
+		}
+		if len(events) != len(missing) {
+			return known, fmt.Errorf("missing %d auth events for event %q", len(missing)-len(events), event.EventID())
+		}
+	}
+	return known, gomatrixserverlib.Allowed(event, &authEvents)
+}
@@ -20,19 +20,87 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+var federatedEventsProcessed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "federated_events_processed_total",
+		Help:      "Number of new and old events from remote servers processed by the roomserver, by outcome",
+	},
+	// outcome is one of persisted, rejected, soft_failed or error.
+	[]string{"outcome", "room_version", "origin"},
+)
+
+var federatedEventDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "federated_event_processing_duration_seconds",
+		Help:      "How long it takes the roomserver to process a new or old event from a remote server",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"room_version"},
+)
+
+func init() {
+	prometheus.MustRegister(federatedEventsProcessed, federatedEventDurations)
+}
+
+// federatedOrigin returns the server that sent the event and true if the
+// event came from a remote server.
+func (r *Inputer) federatedOrigin(event *gomatrixserverlib.Event) (gomatrixserverlib.ServerName, bool) {
+	_, domain, err := gomatrixserverlib.SplitID('@', event.Sender())
+	if err != nil || domain == r.ServerName {
+		return "", false
+	}
+	return domain, true
+}
+
+// checkRoomVersion makes sure that the event was parsed with the rules of
+// its room's version, rather than whichever version it was sent to us as.
+func (r *Inputer) checkRoomVersion(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error {
+	info, err := r.DB.RoomInfo(ctx, event.RoomID())
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	var roomVersion gomatrixserverlib.RoomVersion
+	if info != nil {
+		roomVersion = info.RoomVersion
+	}
+	return version.CheckEventRoomVersion(event, roomVersion)
+}
+
+// observeFederatedEvent records the outcome of processing a new or old event
+// from a remote server.
+func observeFederatedEvent(
+	origin gomatrixserverlib.ServerName, roomVersion gomatrixserverlib.RoomVersion, outcome string, start time.Time,
+) {
+	federatedEventsProcessed.WithLabelValues(outcome, string(roomVersion), internal.OriginLabel(string(origin))).Inc()
+	federatedEventDurations.WithLabelValues(string(roomVersion)).Observe(time.Since(start).Seconds())
+}
+
 // processRoomEvent can only be called once at a time
 //
+// If deferred is not nil then a new event isn't soft-fail checked and the
+// latest events in the room aren't updated for it. Instead, everything needed
+// to do that is written into deferred, so that the caller can do it for
+// several events at once.
+//
 // TODO(#375): This should be rewritten to allow concurrent calls. The
 // difficulty is in ensuring that we correctly annotate events with the correct
 // state deltas when sending to kafka streams
@@ -41,10 +109,35 @@ import (
 func (r *Inputer) processRoomEvent(
 	ctx context.Context,
 	input *api.InputRoomEvent,
+	deferred *deferredNewEvent,
 ) (eventID string, err error) {
 	// Parse and validate the event JSON
 	headered := input.Event
 	event := headered.Unwrap()
+	var outcome string
+	start := time.Now()
+	origin, federated := r.federatedOrigin(&event)
+	if federated && input.Kind != api.KindOutlier {
+		defer func() {
+			if outcome == "deferred" {
+				// This is recorded once the latest events are updated.
+				return
+			}
+			if outcome == "" {
+				outcome = "persisted"
+				if err != nil {
+					outcome = "error"
+				}
+			}
+			observeFederatedEvent(origin, headered.RoomVersion, outcome, start)
+		}()
+	}
+	if err = eventutil.CheckEventSize(event.JSON(), nil); err != nil {
+		return "", err
+	}
+	if err = r.checkRoomVersion(ctx, &headered); err != nil {
+		return "", err
+	}
 
 	// if we have already got this event then do not process it again, if the input kind is an outlier.
 	// Outliers contain no extra information which may warrant a re-processing.
@@ -77,8 +170,32 @@ func (r *Inputer) processRoomEvent(
 		isRejected = true
 	}
 
+	// Check that the event is deeper than all of the prev events that we
+	// know about. The spec doesn't require this of other servers, which
+	// may have their own reasons for the depths they pick, so rejecting
+	// their events for it would only split our view of the room from
+	// theirs. We only hold events that we created ourselves to it.
+	if !isRejected && !federated {
+		prevEvents, err := r.DB.EventsFromIDs(ctx, event.PrevEventIDs())
+		if err != nil {
+			return "", fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		prevs := make([]gomatrixserverlib.Event, len(prevEvents))
+		for i := range prevEvents {
+			prevs[i] = prevEvents[i].Event
+		}
+		checkDepth := eventutil.CheckEventDepth
+		if input.Historical && input.Kind == api.KindOld {
+			checkDepth = eventutil.CheckHistoricalEventDepth
+		}
+		if depthErr := checkDepth(&event, prevs); depthErr != nil {
+			logrus.WithError(depthErr).WithField("event_id", event.EventID()).Error("eventutil.CheckEventDepth failed for event, rejecting event")
+			isRejected = true
+		}
+	}
+
 	var softfail bool
-	if input.Kind == api.KindNew {
+	if input.Kind == api.KindNew && deferred == nil {
 		// Check that the event passes authentication checks based on the
 		// current room state.
 		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, headered, input.StateEventIDs)
@@ -89,6 +206,7 @@ func (r *Inputer) processRoomEvent(
 				"room":     event.RoomID(),
 			}).WithError(err).Info("Error authing soft-failed event")
 		}
+		softfail = softfail || input.SoftFail
 	}
 
 	// If we don't have a transaction ID then get one.
@@ -103,11 +221,23 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
-	// Store the event.
-	_, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected)
+	// Store the event. If we're deferring the update to the latest events
+	// then the references to the prev events are stored later as part of
+	// that update, so that this event doesn't stop any earlier events in the
+	// same batch from becoming forward extremities in the meantime.
+	storeEvent := r.DB.StoreEvent
+	if deferred != nil {
+		storeEvent = r.DB.StoreEventWithoutPreviousEvents
+	}
+	_, stateAtEvent, redactionEvent, redactedEventID, err := storeEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected)
 	if err != nil {
 		return "", fmt.Errorf("r.DB.StoreEvent: %w", err)
 	}
+	if deferred != nil {
+		deferred.input = input
+		deferred.event = event
+		deferred.stateAtEvent = stateAtEvent
+	}
 
 	// if storing this event results in it being redacted then do so.
 	if !isRejected && redactedEventID == event.EventID() {
@@ -150,6 +280,10 @@ func (r *Inputer) processRoomEvent(
 
 	// We stop here if the event is rejected: We've stored it but won't update forward extremities or notify anyone about it.
 	if isRejected || softfail {
+		outcome = "rejected"
+		if !isRejected {
+			outcome = "soft_failed"
+		}
 		logrus.WithFields(logrus.Fields{
 			"event_id":  event.EventID(),
 			"type":      event.Type(),
@@ -162,6 +296,17 @@ func (r *Inputer) processRoomEvent(
 
 	switch input.Kind {
 	case api.KindNew:
+		if deferred != nil {
+			deferred.ready = true
+			deferred.event = event
+			deferred.roomInfo = roomInfo
+			deferred.stateAtEvent = stateAtEvent
+			deferred.redactionEvent = redactionEvent
+			deferred.redactedEventID = redactedEventID
+			deferred.origin, deferred.federated, deferred.start = origin, federated, start
+			outcome = "deferred"
+			return event.EventID(), nil
+		}
 		if err = r.updateLatestEvents(
 			ctx,                 // context
 			roomInfo,            // room info for the room being updated
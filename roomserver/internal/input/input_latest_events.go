@@ -114,6 +114,10 @@ type latestEventsUpdater struct {
 	// The snapshots of current state before and after processing this event
 	oldStateNID types.StateSnapshotNID
 	newStateNID types.StateSnapshotNID
+	// If set, the output events are added to this rather than being written
+	// straight away, so that the caller can write them once the transaction
+	// has been committed.
+	outputs *[]api.OutputEvent
 }
 
 func (u *latestEventsUpdater) doUpdateLatestEvents() error {
@@ -178,7 +182,9 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	// send the event asynchronously but we would need to ensure that 1) the events are written to the log in
 	// the correct order, 2) that pending writes are resent across restarts. In order to avoid writing all the
 	// necessary bookkeeping we'll keep the event sending synchronous for now.
-	if err = u.api.WriteOutputEvents(u.event.RoomID(), updates); err != nil {
+	if u.outputs != nil {
+		*u.outputs = append(*u.outputs, updates...)
+	} else if err = u.api.WriteOutputEvents(u.event.RoomID(), updates); err != nil {
 		return fmt.Errorf("u.api.WriteOutputEvents: %w", err)
 	}
 
@@ -316,11 +322,12 @@ func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error)
 	}
 
 	ore := api.OutputNewRoomEvent{
-		Event:           u.event.Headered(u.roomInfo.RoomVersion),
-		RewritesState:   u.rewritesState,
-		LastSentEventID: u.lastEventIDSent,
-		LatestEventIDs:  latestEventIDs,
-		TransactionID:   u.transactionID,
+		Event:            u.event.Headered(u.roomInfo.RoomVersion),
+		RewritesState:    u.rewritesState,
+		LastSentEventID:  u.lastEventIDSent,
+		LatestEventIDs:   latestEventIDs,
+		TransactionID:    u.transactionID,
+		StateSnapshotNID: int64(u.newStateNID),
 	}
 
 	eventIDMap, err := u.stateEventMap()
@@ -0,0 +1,50 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func TestInputerStopWaitsForInput(t *testing.T) {
+	r := &Inputer{}
+	if !r.startInput() {
+		t.Fatalf("input was rejected before stopping")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Stop with input in flight: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Once stopped, new input is rejected without being processed.
+	res := &api.InputRoomEventsResponse{}
+	r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{Kind: api.KindNew}},
+	}, res)
+	if res.ErrMsg != errInputStopped.Error() {
+		t.Errorf("input after stopping: got error %q, want %q", res.ErrMsg, errInputStopped)
+	}
+
+	r.inFlight.Done()
+	if err := r.Stop(context.Background()); err != nil {
+		t.Errorf("Stop with nothing in flight: got error %v", err)
+	}
+}
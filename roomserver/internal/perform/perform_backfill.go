@@ -27,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -35,6 +36,22 @@ import (
 // as we try dead servers.
 const maxBackfillServers = 5
 
+// the number of events to backfill over federation in a single request if MaxEvents isn't set.
+const defaultBackfillMaxEvents = 100
+
+var backfillEventsFetched = prometheus.NewSummary(
+	prometheus.SummaryOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_events_fetched",
+		Help:      "The number of events fetched over federation by each backfill request",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(backfillEventsFetched)
+}
+
 type Backfiller struct {
 	ServerName gomatrixserverlib.ServerName
 	DB         storage.Database
@@ -43,6 +60,18 @@ type Backfiller struct {
 
 	// The servers which should be preferred above other servers when backfilling
 	PreferServers []gomatrixserverlib.ServerName
+
+	// Events with a lower depth than this aren't backfilled over federation.
+	// 0 backfills all the way to the creation of the room.
+	MinDepth int64
+	// The most events to request over federation in a single backfill, and
+	// the most missing state events to fetch for them.
+	// Clients page through more history with further /messages requests,
+	// each of which continues from the events backfilled before it.
+	MaxEvents int
+	// The most events to return from a single PerformBackfill, whatever the
+	// limit in the request. 0 means no limit.
+	MaxLimit int
 }
 
 // PerformBackfill implements api.RoomServerQueryAPI
@@ -51,6 +80,9 @@ func (r *Backfiller) PerformBackfill(
 	request *api.PerformBackfillRequest,
 	response *api.PerformBackfillResponse,
 ) error {
+	if r.MaxLimit > 0 && request.Limit > r.MaxLimit {
+		request.Limit = r.MaxLimit
+	}
 	// if we are requesting the backfill then we need to do a federation hit
 	// TODO: we could be more sensible and fetch as many events we already have then request the rest
 	//       which is what the syncapi does already.
@@ -104,19 +136,34 @@ func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.Perform
 	if info == nil || info.IsStub {
 		return fmt.Errorf("backfillViaFederation: missing room info for room %s", req.RoomID)
 	}
+	if r.MinDepth > 0 {
+		var reached bool
+		if reached, err = r.reachedMinDepth(ctx, req); err != nil {
+			return err
+		}
+		if reached {
+			logrus.WithField("room_id", req.RoomID).Infof("not backfilling events below depth %d", r.MinDepth)
+			return nil
+		}
+	}
 	requester := newBackfillRequester(r.DB, r.FSAPI, r.ServerName, req.BackwardsExtremities, r.PreferServers)
-	// Request 100 items regardless of what the query asks for.
-	// We don't want to go much higher than this.
+	// Request MaxEvents items regardless of what the query asks for.
 	// We can't honour exactly the limit as some sytests rely on requesting more for tests to pass
 	// (so we don't need to hit /state_ids which the test has no listener for)
 	// Specifically the test "Outbound federation can backfill events"
+	limit := r.MaxEvents
+	if limit <= 0 {
+		limit = defaultBackfillMaxEvents
+	}
 	events, err := gomatrixserverlib.RequestBackfill(
 		ctx, requester,
-		r.KeyRing, req.RoomID, info.RoomVersion, req.PrevEventIDs(), 100)
+		r.KeyRing, req.RoomID, info.RoomVersion, req.PrevEventIDs(), limit)
 	if err != nil {
 		return err
 	}
+	backfillEventsFetched.Observe(float64(len(events)))
 	logrus.WithField("room_id", req.RoomID).Infof("backfilled %d events", len(events))
+	events = filterBelowMinDepth(events, r.MinDepth)
 
 	// persist these new events - auth checks have already been done
 	roomNID, backfilledEventMap := persistEvents(ctx, r.DB, events)
@@ -124,6 +171,12 @@ func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.Perform
 		return err
 	}
 
+	// The missing state events fetched for the backfilled events count
+	// against the same cap as the backfilled events, so that backfilling
+	// into a room with a large state can't turn into an /event request
+	// for every member of the room.
+	missingBudget := limit
+
 	for _, ev := range backfilledEventMap {
 		// now add state for these events
 		stateIDs, ok := requester.eventIDToBeforeStateIDs[ev.EventID()]
@@ -136,9 +189,15 @@ func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.Perform
 		var entries []types.StateEntry
 		if entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs); err != nil {
 			// attempt to fetch the missing events
-			r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, stateIDs)
+			missingBudget -= r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, stateIDs, missingBudget)
 			// try again
 			entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs)
+			if err != nil && missingBudget <= 0 {
+				// We stopped fetching before we had all of the state, so the
+				// event is left without any, like an outlier.
+				logrus.WithError(err).WithField("event_id", ev.EventID()).Warn("backfillViaFederation: too many missing state events to fetch for event")
+				continue
+			}
 			if err != nil {
 				logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to get state entries for event")
 				return err
@@ -161,10 +220,48 @@ func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.Perform
 	return nil
 }
 
+// reachedMinDepth returns whether all of the backwards extremities in the
+// request are at or below MinDepth, in which case all of their prev_events
+// are too deep in the history of the room to be backfilled.
+func (r *Backfiller) reachedMinDepth(ctx context.Context, req *api.PerformBackfillRequest) (bool, error) {
+	eventIDs := make([]string, 0, len(req.BackwardsExtremities))
+	for eventID := range req.BackwardsExtremities {
+		eventIDs = append(eventIDs, eventID)
+	}
+	events, err := r.DB.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		return false, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	if len(events) < len(eventIDs) {
+		// We can't tell how deep the missing backwards extremities are.
+		return false, nil
+	}
+	for _, ev := range events {
+		if ev.Depth() > r.MinDepth {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// filterBelowMinDepth removes the events with a depth lower than minDepth.
+func filterBelowMinDepth(events []gomatrixserverlib.HeaderedEvent, minDepth int64) []gomatrixserverlib.HeaderedEvent {
+	if minDepth <= 0 {
+		return events
+	}
+	filtered := events[:0]
+	for _, ev := range events {
+		if ev.Depth() >= minDepth {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
 // fetchAndStoreMissingEvents does a best-effort fetch and store of missing events specified in stateIDs. Returns no error as it is just
-// best effort.
+// best effort. At most limit missing events are fetched, and the number that were tried is returned.
 func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
-	backfillRequester *backfillRequester, stateIDs []string) {
+	backfillRequester *backfillRequester, stateIDs []string, limit int) int {
 
 	servers := backfillRequester.servers
 
@@ -172,15 +269,19 @@ func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gom
 	nidMap, err := r.DB.EventNIDs(ctx, stateIDs)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Warn("cannot query missing events")
-		return
+		return 0
 	}
 	missingMap := make(map[string]*gomatrixserverlib.HeaderedEvent) // id -> event
+	missing := 0
 	for _, id := range stateIDs {
 		if _, ok := nidMap[id]; !ok {
-			missingMap[id] = nil
+			missing++
+			if len(missingMap) < limit {
+				missingMap[id] = nil
+			}
 		}
 	}
-	util.GetLogger(ctx).Infof("Fetching %d missing state events (from %d possible servers)", len(missingMap), len(servers))
+	util.GetLogger(ctx).Infof("Fetching %d of %d missing state events (from %d possible servers)", len(missingMap), missing, len(servers))
 
 	// fetch the events from federation. Loop the servers first so if we find one that works we stick with them
 	for _, srv := range servers {
@@ -219,6 +320,7 @@ func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gom
 	}
 	util.GetLogger(ctx).Infof("Persisting %d new events", len(newEvents))
 	persistEvents(ctx, r.DB, newEvents)
+	return len(missingMap)
 }
 
 // backfillRequester implements gomatrixserverlib.BackfillRequester
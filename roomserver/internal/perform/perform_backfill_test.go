@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustBuildEventAtDepth(t *testing.T, depth int64) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender: "@geralt:kaer.morhen",
+		RoomID: "!room:kaer.morhen",
+		Type:   "m.room.message",
+		Depth:  depth,
+	}
+	if err := eb.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), "kaer.morhen", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV6)
+}
+
+func TestFilterBelowMinDepth(t *testing.T) {
+	for _, tt := range []struct {
+		minDepth   int64
+		wantDepths []int64
+	}{
+		{0, []int64{3, 1, 5, 2}},
+		{2, []int64{3, 5, 2}},
+		{4, []int64{5}},
+		{6, []int64{}},
+	} {
+		var events []gomatrixserverlib.HeaderedEvent
+		for _, depth := range []int64{3, 1, 5, 2} {
+			events = append(events, mustBuildEventAtDepth(t, depth))
+		}
+		filtered := filterBelowMinDepth(events, tt.minDepth)
+		if len(filtered) != len(tt.wantDepths) {
+			t.Errorf("min depth %d: got %d events, want %d", tt.minDepth, len(filtered), len(tt.wantDepths))
+			continue
+		}
+		for i, ev := range filtered {
+			if ev.Depth() != tt.wantDepths[i] {
+				t.Errorf("min depth %d: event %d has depth %d, want %d", tt.minDepth, i, ev.Depth(), tt.wantDepths[i])
+			}
+		}
+	}
+}
+
+type testBackfillDB struct {
+	storage.Database
+}
+
+func (d *testBackfillDB) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	return map[string]types.EventNID{}, nil
+}
+
+type testBackfillFSAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	requested map[string]int
+}
+
+func (f *testBackfillFSAPI) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (gomatrixserverlib.Transaction, error) {
+	f.requested[eventID]++
+	return gomatrixserverlib.Transaction{}, errors.New("unreachable")
+}
+
+func TestFetchAndStoreMissingEventsIsCapped(t *testing.T) {
+	fsAPI := &testBackfillFSAPI{requested: map[string]int{}}
+	backfiller := &Backfiller{DB: &testBackfillDB{}, FSAPI: fsAPI}
+	requester := &backfillRequester{servers: []gomatrixserverlib.ServerName{"kaer.morhen", "novigrad.example"}}
+	var stateIDs []string
+	for i := 0; i < 10; i++ {
+		stateIDs = append(stateIDs, fmt.Sprintf("$state%d:kaer.morhen", i))
+	}
+
+	tried := backfiller.fetchAndStoreMissingEvents(context.Background(), gomatrixserverlib.RoomVersionV6, requester, stateIDs, 3)
+	if tried != 3 {
+		t.Errorf("got %d missing events tried, want 3", tried)
+	}
+	if len(fsAPI.requested) != 3 {
+		t.Errorf("got %d missing events requested, want 3", len(fsAPI.requested))
+	}
+	for eventID, requests := range fsAPI.requested {
+		if requests != len(requester.servers) {
+			t.Errorf("%s: got %d requests, want one to each of the %d servers", eventID, requests, len(requester.servers))
+		}
+	}
+}
@@ -72,16 +72,18 @@ func (r *Inviter) PerformInvite(
 		var is []gomatrixserverlib.InviteV2StrippedState
 		if is, err = buildInviteStrippedState(ctx, r.DB, info, req); err == nil {
 			inviteState = is
+		} else {
+			log.WithError(err).WithField("event_id", event.EventID()).Warn("Failed to build invite stripped state")
 		}
 	}
-	if len(inviteState) == 0 {
-		if err = event.SetUnsignedField("invite_room_state", struct{}{}); err != nil {
-			return nil, fmt.Errorf("event.SetUnsignedField: %w", err)
-		}
-	} else {
-		if err = event.SetUnsignedField("invite_room_state", inviteState); err != nil {
-			return nil, fmt.Errorf("event.SetUnsignedField: %w", err)
-		}
+	if inviteState == nil {
+		inviteState = []gomatrixserverlib.InviteV2StrippedState{}
+	}
+	// The stripped state is stored with the invite, so that the sync API can
+	// send it to the invited user as invite_state. For invites received over
+	// federation this is the only copy of the state that we have.
+	if err = event.SetUnsignedField("invite_room_state", inviteState); err != nil {
+		return nil, fmt.Errorf("event.SetUnsignedField: %w", err)
 	}
 
 	var isAlreadyJoined bool
@@ -127,6 +129,16 @@ func (r *Inviter) PerformInvite(
 	}
 
 	if isOriginLocal {
+		// Users on servers which aren't allowed in the room, either because of
+		// server ACLs or because the room isn't federated, can't be invited.
+		if !isTargetLocal && r.Inputer.ACLs.IsServerBannedFromRoom(domain, roomID) {
+			res.Error = &api.PerformError{
+				Msg:  fmt.Sprintf("Users on %s are not allowed in this room", domain),
+				Code: api.PerformErrorNotAllowed,
+			}
+			return nil, nil
+		}
+
 		// The invite originated locally. Therefore we have a responsibility to
 		// try and see if the user is allowed to make this invite. We can't do
 		// this for invites coming in over federation - we have to take those on
@@ -213,6 +225,9 @@ func (r *Inviter) PerformInvite(
 	return nil, nil
 }
 
+// buildInviteStrippedState returns the stripped state of the room for an
+// invite, which lets the invited user see what the room is before joining it.
+// The invite event itself isn't included, as it is sent alongside.
 func buildInviteStrippedState(
 	ctx context.Context,
 	db storage.Database,
@@ -223,15 +238,20 @@ func buildInviteStrippedState(
 	// "If they are set on the room, at least the state for m.room.avatar, m.room.canonical_alias, m.room.join_rules, and m.room.name SHOULD be included."
 	// https://matrix.org/docs/spec/client_server/r0.6.0#m-room-member
 	for _, t := range []string{
-		gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias,
-		gomatrixserverlib.MRoomAliases, gomatrixserverlib.MRoomJoinRules,
-		"m.room.avatar", "m.room.encryption",
+		gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomName,
+		gomatrixserverlib.MRoomCanonicalAlias, gomatrixserverlib.MRoomAliases,
+		gomatrixserverlib.MRoomJoinRules, "m.room.avatar", "m.room.encryption",
 	} {
 		stateWanted = append(stateWanted, gomatrixserverlib.StateKeyTuple{
 			EventType: t,
 			StateKey:  "",
 		})
 	}
+	// The inviter's membership lets clients show who the invite is from.
+	stateWanted = append(stateWanted, gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomMember,
+		StateKey:  input.Event.Sender(),
+	})
 	roomState := state.NewStateResolution(db, *info)
 	stateEntries, err := roomState.LoadStateAtSnapshotForStringTuples(
 		ctx, info.StateSnapshotNID, stateWanted,
@@ -247,10 +267,7 @@ func buildInviteStrippedState(
 	if err != nil {
 		return nil, err
 	}
-	inviteState := []gomatrixserverlib.InviteV2StrippedState{
-		gomatrixserverlib.NewInviteV2StrippedState(&input.Event.Event),
-	}
-	stateEvents = append(stateEvents, types.Event{Event: input.Event.Unwrap()})
+	inviteState := []gomatrixserverlib.InviteV2StrippedState{}
 	for _, event := range stateEvents {
 		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(&event.Event))
 	}
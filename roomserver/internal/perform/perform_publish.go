@@ -30,7 +30,7 @@ func (r *Publisher) PerformPublish(
 	req *api.PerformPublishRequest,
 	res *api.PerformPublishResponse,
 ) {
-	err := r.DB.PublishRoom(ctx, req.RoomID, req.Visibility == "public")
+	err := r.DB.PublishRoom(ctx, req.RoomID, req.NetworkID, req.UserID, req.Visibility == "public")
 	if err != nil {
 		res.Error = &api.PerformError{
 			Msg: err.Error(),
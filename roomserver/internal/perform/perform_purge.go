@@ -0,0 +1,221 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// purgeBatchSize is how many events are loaded at a time when looking for
+// expired events in a room.
+const purgeBatchSize = 100
+
+// Purger enforces message retention policies by wiping the content of events
+// which are older than their room's max lifetime. Events are redacted rather
+// than deleted, so the room DAG stays intact, and state events and the latest
+// events in the room are never purged so that the current state and auth
+// chains are preserved.
+type Purger struct {
+	DB      storage.Database
+	Cfg     *config.RoomServer
+	Inputer *input.Inputer
+	// The event NID in each room up to which every event has already been
+	// purged or can never be purged, so that later runs start from there
+	// rather than scanning the whole room again. This is only kept in
+	// memory, so the first run after a restart scans every room in full.
+	watermarks map[types.RoomNID]types.EventNID
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopped    chan struct{}
+}
+
+// NewPurger returns a purger which purges expired events once started.
+func NewPurger(db storage.Database, cfg *config.RoomServer, inputer *input.Inputer) *Purger {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Purger{
+		DB:         db,
+		Cfg:        cfg,
+		Inputer:    inputer,
+		watermarks: make(map[types.RoomNID]types.EventNID),
+		ctx:        ctx,
+		cancel:     cancel,
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Start purges expired events from every room once per purge interval, in
+// the background, until Stop is called.
+func (r *Purger) Start() {
+	go func() {
+		defer close(r.stopped)
+		ticker := time.NewTicker(r.Cfg.Retention.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				r.purgeRooms(r.ctx)
+			}
+		}
+	}()
+}
+
+// Stop stops purging, waiting for a purge which is in progress to stop or
+// for the context to be done. Start must have been called.
+func (r *Purger) Stop(ctx context.Context) error {
+	r.cancel()
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Purger) purgeRooms(ctx context.Context) {
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get rooms to purge expired events from")
+		return
+	}
+	for _, roomID := range roomIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		purged, err := r.purgeRoom(ctx, roomID)
+		if err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to purge expired events")
+			continue
+		}
+		if purged > 0 {
+			logrus.WithFields(logrus.Fields{
+				"room_id": roomID,
+				"purged":  purged,
+			}).Info("Purged expired events")
+		}
+	}
+}
+
+// purgeRoom wipes the content of the expired events in the room, and tells
+// downstream components to do the same. Returns how many events were purged.
+func (r *Purger) purgeRoom(ctx context.Context, roomID string) (int, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return 0, nil
+	}
+	lifetime, _, err := helpers.RoomMaxLifetime(ctx, r.DB, &r.Cfg.Retention, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("helpers.RoomMaxLifetime: %w", err)
+	}
+	if lifetime == 0 {
+		return 0, nil
+	}
+	cutoff := gomatrixserverlib.AsTimestamp(time.Now().Add(-lifetime))
+
+	latest, _, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	isLatest := make(map[string]bool, len(latest))
+	for _, ref := range latest {
+		isLatest[ref.EventID] = true
+	}
+
+	// Event NIDs only ever increase, so new events always come after the
+	// watermark. The watermark stops at the first event which may still need
+	// purging later, i.e. one which hasn't expired yet or is a latest event.
+	purged := 0
+	after := r.watermarks[info.RoomNID]
+	watermark, advancing := after, true
+	for {
+		eventNIDs, err := r.DB.RoomEventNIDs(ctx, info.RoomNID, after, purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("r.DB.RoomEventNIDs: %w", err)
+		}
+		if len(eventNIDs) == 0 {
+			r.watermarks[info.RoomNID] = watermark
+			return purged, nil
+		}
+		after = eventNIDs[len(eventNIDs)-1]
+
+		events, err := r.DB.Events(ctx, eventNIDs)
+		if err != nil {
+			return purged, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		eventsByNID := make(map[types.EventNID]types.Event, len(events))
+		for _, event := range events {
+			eventsByNID[event.EventNID] = event
+		}
+		var expired []types.Event
+		var expiredIDs []string
+		for _, eventNID := range eventNIDs {
+			event, ok := eventsByNID[eventNID]
+			switch {
+			case !ok:
+				advancing = false
+				continue
+			case event.StateKey() != nil:
+				// never purged
+			case isLatest[event.EventID()] || event.OriginServerTS() >= cutoff:
+				advancing = false
+				continue
+			case bytes.Equal(event.Redact().JSON(), event.JSON()):
+				// already purged or redacted
+			default:
+				expired = append(expired, event)
+				expiredIDs = append(expiredIDs, event.EventID())
+			}
+			if advancing {
+				watermark = eventNID
+			}
+		}
+		if len(expired) == 0 {
+			r.watermarks[info.RoomNID] = watermark
+			continue
+		}
+		if err = r.DB.PurgeEvents(ctx, expired); err != nil {
+			return purged, fmt.Errorf("r.DB.PurgeEvents: %w", err)
+		}
+		if err = r.Inputer.WriteOutputEvents(roomID, []api.OutputEvent{
+			{
+				Type: api.OutputTypePurgedEvents,
+				PurgedEvents: &api.OutputPurgedEvents{
+					RoomID:   roomID,
+					EventIDs: expiredIDs,
+				},
+			},
+		}); err != nil {
+			return purged, fmt.Errorf("r.Inputer.WriteOutputEvents: %w", err)
+		}
+		purged += len(expired)
+		r.watermarks[info.RoomNID] = watermark
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"crypto/ed25519"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testPurgeRoomID = "!room:kaer.morhen"
+
+type testPurgeDB struct {
+	storage.Database
+	events    []types.Event // in event NID order
+	retention *gomatrixserverlib.HeaderedEvent
+	latest    string
+	// The afterEventNID of each RoomEventNIDs call.
+	afters     []types.EventNID
+	purged     []string
+	knownRooms int32
+}
+
+func (d *testPurgeDB) GetKnownRooms(ctx context.Context) ([]string, error) {
+	atomic.AddInt32(&d.knownRooms, 1)
+	return []string{testPurgeRoomID}, nil
+}
+
+func (d *testPurgeDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV6}, nil
+}
+
+func (d *testPurgeDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType == helpers.MRoomRetention {
+		return d.retention, nil
+	}
+	return nil, nil
+}
+
+func (d *testPurgeDB) LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error) {
+	return []gomatrixserverlib.EventReference{{EventID: d.latest}}, 0, 0, nil
+}
+
+func (d *testPurgeDB) RoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error) {
+	d.afters = append(d.afters, afterEventNID)
+	var eventNIDs []types.EventNID
+	for _, event := range d.events {
+		if event.EventNID > afterEventNID && len(eventNIDs) < limit {
+			eventNIDs = append(eventNIDs, event.EventNID)
+		}
+	}
+	return eventNIDs, nil
+}
+
+func (d *testPurgeDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, event := range d.events {
+		for _, eventNID := range eventNIDs {
+			if event.EventNID == eventNID {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (d *testPurgeDB) PurgeEvents(ctx context.Context, events []types.Event) error {
+	for _, purged := range events {
+		for i := range d.events {
+			if d.events[i].EventNID == purged.EventNID {
+				d.events[i].Event = purged.Redact()
+				d.purged = append(d.purged, purged.EventID())
+			}
+		}
+	}
+	return nil
+}
+
+type testPurgeProducer struct {
+	sarama.SyncProducer
+	messages int
+}
+
+func (p *testPurgeProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.messages += len(msgs)
+	return nil
+}
+
+func mustBuildPurgeEvent(
+	t *testing.T, eventNID types.EventNID, evType string, stateKey *string,
+	content map[string]interface{}, age time.Duration,
+) types.Event {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   "@geralt:kaer.morhen",
+		RoomID:   testPurgeRoomID,
+		Type:     evType,
+		StateKey: stateKey,
+		Depth:    int64(eventNID),
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now().Add(-age), "kaer.morhen", "ed25519:test", key, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return types.Event{EventNID: eventNID, Event: ev}
+}
+
+func mustBuildPurgeMessage(t *testing.T, eventNID types.EventNID, age time.Duration) types.Event {
+	t.Helper()
+	return mustBuildPurgeEvent(t, eventNID, "m.room.message", nil, map[string]interface{}{"body": "hello"}, age)
+}
+
+func newTestPurger(db *testPurgeDB, retention config.MessageRetention) (*Purger, *testPurgeProducer) {
+	producer := &testPurgeProducer{}
+	cfg := &config.RoomServer{Retention: retention}
+	return NewPurger(db, cfg, &input.Inputer{Producer: producer}), producer
+}
+
+func TestPurgerStartsFromWatermark(t *testing.T) {
+	emptyStateKey := ""
+	db := &testPurgeDB{}
+	db.events = []types.Event{
+		mustBuildPurgeEvent(t, 1, gomatrixserverlib.MRoomCreate, &emptyStateKey, map[string]interface{}{"creator": "@geralt:kaer.morhen"}, 2*time.Hour),
+		mustBuildPurgeMessage(t, 2, 2*time.Hour),
+		mustBuildPurgeMessage(t, 3, 2*time.Hour),
+		mustBuildPurgeMessage(t, 4, time.Minute),
+		mustBuildPurgeMessage(t, 5, 2*time.Hour),
+		mustBuildPurgeMessage(t, 6, 2*time.Hour),
+	}
+	db.latest = db.events[5].EventID()
+	purger, producer := newTestPurger(db, config.MessageRetention{DefaultMaxLifetime: time.Hour})
+
+	purged, err := purger.purgeRoom(context.Background(), testPurgeRoomID)
+	if err != nil {
+		t.Fatalf("purgeRoom failed: %s", err)
+	}
+	wantPurged := []string{db.events[1].EventID(), db.events[2].EventID(), db.events[4].EventID()}
+	if purged != len(wantPurged) || !reflect.DeepEqual(db.purged, wantPurged) {
+		t.Fatalf("got %d purged events %v, want %v", purged, db.purged, wantPurged)
+	}
+	if db.afters[0] != 0 {
+		t.Errorf("first run started after event NID %d, want 0", db.afters[0])
+	}
+	if producer.messages != 1 {
+		t.Errorf("got %d output events, want 1", producer.messages)
+	}
+
+	// The second run starts from the last event before the one which hasn't
+	// expired yet, and has nothing left to purge.
+	db.afters = nil
+	if purged, err = purger.purgeRoom(context.Background(), testPurgeRoomID); err != nil {
+		t.Fatalf("purgeRoom failed: %s", err)
+	}
+	if purged != 0 {
+		t.Errorf("got %d purged events on the second run, want 0", purged)
+	}
+	if db.afters[0] != 3 {
+		t.Errorf("second run started after event NID %d, want 3", db.afters[0])
+	}
+}
+
+func TestPurgerHonoursMinLifetime(t *testing.T) {
+	emptyStateKey := ""
+	retention := mustBuildPurgeEvent(t, 1, helpers.MRoomRetention, &emptyStateKey, map[string]interface{}{
+		"max_lifetime": time.Hour.Milliseconds(),
+		"min_lifetime": (3 * time.Hour).Milliseconds(),
+	}, 5*time.Hour)
+	headered := retention.Headered(gomatrixserverlib.RoomVersionV6)
+	db := &testPurgeDB{retention: &headered}
+	db.events = []types.Event{
+		retention,
+		mustBuildPurgeMessage(t, 2, 4*time.Hour),
+		mustBuildPurgeMessage(t, 3, 2*time.Hour),
+		mustBuildPurgeMessage(t, 4, time.Minute),
+	}
+	db.latest = db.events[3].EventID()
+	purger, _ := newTestPurger(db, config.MessageRetention{})
+
+	if _, err := purger.purgeRoom(context.Background(), testPurgeRoomID); err != nil {
+		t.Fatalf("purgeRoom failed: %s", err)
+	}
+	if wantPurged := []string{db.events[1].EventID()}; !reflect.DeepEqual(db.purged, wantPurged) {
+		t.Errorf("got purged events %v, want only the one older than min_lifetime %v", db.purged, wantPurged)
+	}
+}
+
+func TestPurgerStop(t *testing.T) {
+	db := &testPurgeDB{events: []types.Event{mustBuildPurgeMessage(t, 1, time.Minute)}}
+	db.latest = db.events[0].EventID()
+	purger, _ := newTestPurger(db, config.MessageRetention{
+		PurgeInterval:      time.Millisecond,
+		DefaultMaxLifetime: time.Hour,
+	})
+	purger.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&db.knownRooms) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the purger never ran")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := purger.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+	runs := atomic.LoadInt32(&db.knownRooms)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&db.knownRooms) != runs {
+		t.Errorf("the purger kept running after being stopped")
+	}
+}
@@ -16,27 +16,60 @@ package query
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type Queryer struct {
 	DB         storage.Database
 	Cache      caching.RoomServerCaches
 	ServerACLs *acls.ServerACLs
+	// The most rooms the server may know about, or 0 for no limit.
+	MaxRooms int
+	// The message retention options, used to work out which rooms have events purged.
+	Retention *config.MessageRetention
+	// The most events that QueryMissingEvents and the most members that
+	// QueryMembershipsForRoom return, or nil for no limit.
+	PageLimits *config.PageLimits
+	// Optional read replica, used instead of DB for lag-tolerant queries while
+	// it is healthy. See replica.
+	ReadReplica   storage.Database
+	ReplicaHealth *sqlutil.ReadReplica
+}
+
+// replica returns the database that lag-tolerant queries should be run
+// against: the read replica if there is one and it is healthy, otherwise
+// the primary. The replica may be missing the most recent events, so it
+// must only be used by read-only queries for which a slightly out-of-date
+// answer is harmless, like directory listings and relations. Anything
+// used for auth, membership or history visibility, or which callers use
+// to build new events, must use DB.
+func (r *Queryer) replica() storage.Database {
+	if r.ReadReplica != nil && r.ReplicaHealth.Healthy() {
+		return r.ReadReplica
+	}
+	return r.DB
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -255,9 +288,31 @@ func (r *Queryer) QueryMembershipsForRoom(
 	response.HasBeenInRoom = true
 	response.JoinEvents = []gomatrixserverlib.ClientEvent{}
 
+	var atEvent *types.StateAtEvent
+	if request.AtEventID != "" {
+		var atStates []types.StateAtEvent
+		atStates, err = r.DB.StateAtEventIDs(ctx, []string{request.AtEventID})
+		if err != nil {
+			return err
+		}
+		// If the user has since left the room then they can't see the
+		// memberships from after they left, so use the state at their
+		// leave event instead.
+		if stillInRoom || atStates[0].EventNID < membershipEventNID {
+			atEvent = &atStates[0]
+		}
+	}
+
 	var events []types.Event
 	var stateEntries []types.StateEntry
-	if stillInRoom {
+	if atEvent != nil {
+		roomState := state.NewStateResolution(r.DB, *info)
+		stateEntries, err = roomState.LoadCombinedStateAfterEvents(ctx, []types.StateAtEvent{*atEvent})
+		if err != nil {
+			return err
+		}
+		events, err = helpers.GetMembershipsAtState(ctx, r.DB, stateEntries, request.JoinedOnly)
+	} else if stillInRoom {
 		var eventNIDs []types.EventNID
 		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, request.JoinedOnly, false)
 		if err != nil {
@@ -278,11 +333,77 @@ func (r *Queryer) QueryMembershipsForRoom(
 		return err
 	}
 
+	limit := request.Limit
+	if r.PageLimits != nil && (limit <= 0 || limit > r.PageLimits.Members) {
+		limit = r.PageLimits.Members
+	}
 	for _, event := range events {
+		if request.Membership != "" || request.NotMembership != "" {
+			membership, merr := event.Membership()
+			if merr != nil {
+				return merr
+			}
+			if request.Membership != "" && membership != request.Membership {
+				continue
+			}
+			if request.NotMembership != "" && membership == request.NotMembership {
+				continue
+			}
+		}
 		clientEvent := gomatrixserverlib.ToClientEvent(event.Event, gomatrixserverlib.FormatAll)
 		response.JoinEvents = append(response.JoinEvents, clientEvent)
+		if limit > 0 && len(response.JoinEvents) == limit {
+			break
+		}
+	}
+
+	return nil
+}
+
+// QueryJoinedMembers implements api.RoomserverInternalAPI. The joined members
+// are read from the membership table, so unlike QueryMembershipsForRoom there
+// is no need to work out the room state.
+func (r *Queryer) QueryJoinedMembers(
+	ctx context.Context,
+	request *api.QueryJoinedMembersRequest,
+	response *api.QueryJoinedMembersResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+
+	_, response.IsJoined, err = r.DB.GetMembership(ctx, info.RoomNID, request.UserID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetMembership: %w", err)
+	}
+	if !response.IsJoined {
+		return nil
+	}
+
+	eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
 	}
 
+	response.Members = make(map[string]api.JoinedMember, len(events))
+	for _, event := range events {
+		if event.StateKey() == nil {
+			continue
+		}
+		content := gjson.ParseBytes(event.Content())
+		response.Members[*event.StateKey()] = api.JoinedMember{
+			DisplayName: content.Get("displayname").Str,
+			AvatarURL:   content.Get("avatar_url").Str,
+		}
+	}
 	return nil
 }
 
@@ -367,6 +488,146 @@ func (r *Queryer) QueryServerAllowedToSeeEvent(
 	return
 }
 
+// QueryEventsVisibleToUser implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventsVisibleToUser(
+	ctx context.Context,
+	request *api.QueryEventsVisibleToUserRequest,
+	response *api.QueryEventsVisibleToUserResponse,
+) error {
+	response.VisibleEventIDs = make(map[string]bool, len(request.EventIDs))
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	eventsByRoom := make(map[string][]types.Event)
+	for _, event := range events {
+		eventsByRoom[event.RoomID()] = append(eventsByRoom[event.RoomID()], event)
+	}
+	for roomID, roomEvents := range eventsByRoom {
+		if err = r.eventsVisibleToUser(ctx, roomID, request.UserID, roomEvents, response.VisibleEventIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventsVisibleToUser marks which of the events, all of which must be in the
+// given room, the user is allowed to see.
+func (r *Queryer) eventsVisibleToUser(
+	ctx context.Context, roomID, userID string, events []types.Event, visible map[string]bool,
+) error {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	membershipEventNID, _, err := r.DB.GetMembership(ctx, info.RoomNID, userID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetMembership: %w", err)
+	}
+	userNIDs, err := r.DB.EventStateKeyNIDs(ctx, []string{userID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventStateKeyNIDs: %w", err)
+	}
+	userNID, hasUserNID := userNIDs[userID]
+
+	eventNIDs := make([]types.EventNID, len(events))
+	for i := range events {
+		eventNIDs[i] = events[i].EventNID
+	}
+	snapshotNIDs, err := r.DB.SnapshotNIDsFromEventNIDs(ctx, eventNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.SnapshotNIDsFromEventNIDs: %w", err)
+	}
+
+	roomState := state.NewStateResolution(r.DB, *info)
+	latestJoinDepth := int64(-1)
+	if hasUserNID {
+		latestJoinDepth, err = r.latestJoinDepth(ctx, roomState, userNID, membershipEventNID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Many events share the same state snapshot, so only work out the relevant
+	// state for each snapshot once.
+	stateBySnapshot := make(map[types.StateSnapshotNID][]gomatrixserverlib.Event)
+	for _, event := range events {
+		snapshotNID := snapshotNIDs[event.EventNID]
+		if snapshotNID == 0 {
+			// We don't know the state before outliers, so we can't say
+			// whether the user is allowed to see them.
+			continue
+		}
+		stateBefore, ok := stateBySnapshot[snapshotNID]
+		if !ok {
+			entries, err := roomState.LoadStateAtSnapshot(ctx, snapshotNID)
+			if err != nil {
+				return fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+			}
+			var wanted []types.StateEntry
+			for _, entry := range entries {
+				switch {
+				case entry.EventTypeNID == types.MRoomHistoryVisibilityNID && entry.EventStateKeyNID == types.EmptyStateKeyNID:
+					wanted = append(wanted, entry)
+				case entry.EventTypeNID == types.MRoomMemberNID && hasUserNID && entry.EventStateKeyNID == userNID:
+					wanted = append(wanted, entry)
+				}
+			}
+			if stateBefore, err = helpers.LoadStateEvents(ctx, r.DB, wanted); err != nil {
+				return fmt.Errorf("helpers.LoadStateEvents: %w", err)
+			}
+			stateBySnapshot[snapshotNID] = stateBefore
+		}
+		joinedAfterEvent := latestJoinDepth > event.Depth()
+		if auth.IsUserAllowed(userID, joinedAfterEvent, event.Event, stateBefore) {
+			visible[event.EventID()] = true
+		}
+	}
+	return nil
+}
+
+// latestJoinDepth returns the depth of the most recent event which joined the
+// user to the room, or -1 if the user has never joined it. It follows the
+// user's membership events back from their current membership, looking up
+// the previous membership in the state before each one, until it finds a join.
+func (r *Queryer) latestJoinDepth(
+	ctx context.Context, roomState state.StateResolution, userNID types.EventStateKeyNID, membershipEventNID types.EventNID,
+) (int64, error) {
+	for eventNID := membershipEventNID; eventNID != 0; {
+		events, err := r.DB.Events(ctx, []types.EventNID{eventNID})
+		if err != nil {
+			return 0, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		if membership, err := events[0].Membership(); err == nil && membership == gomatrixserverlib.Join {
+			return events[0].Depth(), nil
+		}
+		snapshotNIDs, err := r.DB.SnapshotNIDsFromEventNIDs(ctx, []types.EventNID{eventNID})
+		if err != nil {
+			return 0, fmt.Errorf("r.DB.SnapshotNIDsFromEventNIDs: %w", err)
+		}
+		if snapshotNIDs[eventNID] == 0 {
+			break
+		}
+		entries, err := roomState.LoadStateAtSnapshot(ctx, snapshotNIDs[eventNID])
+		if err != nil {
+			return 0, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+		}
+		eventNID = 0
+		for _, entry := range entries {
+			if entry.EventTypeNID == types.MRoomMemberNID && entry.EventStateKeyNID == userNID {
+				eventNID = entry.EventNID
+			}
+		}
+	}
+	return -1, nil
+}
+
 // QueryMissingEvents implements api.RoomserverInternalAPI
 // nolint:gocyclo
 func (r *Queryer) QueryMissingEvents(
@@ -374,6 +635,9 @@ func (r *Queryer) QueryMissingEvents(
 	request *api.QueryMissingEventsRequest,
 	response *api.QueryMissingEventsResponse,
 ) error {
+	if r.PageLimits != nil && request.Limit > r.PageLimits.Messages {
+		request.Limit = r.PageLimits.Messages
+	}
 	var front []string
 	eventsToFilter := make(map[string]bool, len(request.LatestEvents))
 	visited := make(map[string]bool, request.Limit) // request.Limit acts as a hint to size.
@@ -443,9 +707,21 @@ func (r *Queryer) QueryStateAndAuthChain(
 	response.RoomExists = true
 	response.RoomVersion = info.RoomVersion
 
-	stateEvents, err := r.loadStateAtEventIDs(ctx, *info, request.PrevEventIDs)
-	if err != nil {
-		return err
+	var stateEvents []gomatrixserverlib.Event
+	if request.StateBeforeEventID != "" {
+		var known bool
+		stateEvents, known, err = r.loadStateBeforeEventID(ctx, *info, request.StateBeforeEventID)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return nil
+		}
+	} else {
+		stateEvents, err = r.loadStateAtEventIDs(ctx, *info, request.PrevEventIDs)
+		if err != nil {
+			return err
+		}
 	}
 	response.PrevEventsExist = true
 
@@ -481,6 +757,34 @@ func (r *Queryer) QueryStateAndAuthChain(
 	return err
 }
 
+// QueryAuthChain implements api.RoomserverInternalAPI
+func (r *Queryer) QueryAuthChain(
+	ctx context.Context,
+	request *api.QueryAuthChainRequest,
+	response *api.QueryAuthChainResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	response.RoomExists = true
+
+	authEvents, err := getAuthChain(ctx, r.DB.EventsFromIDs, request.EventIDs)
+	if err != nil {
+		return fmt.Errorf("getAuthChain: %w", err)
+	}
+	for _, event := range authEvents {
+		if event.RoomID() != request.RoomID {
+			continue
+		}
+		response.AuthChain = append(response.AuthChain, event.Headered(info.RoomVersion))
+	}
+	return nil
+}
+
 func (r *Queryer) loadStateAtEventIDs(ctx context.Context, roomInfo types.RoomInfo, eventIDs []string) ([]gomatrixserverlib.Event, error) {
 	roomState := state.NewStateResolution(r.DB, roomInfo)
 	prevStates, err := r.DB.StateAtEventIDs(ctx, eventIDs)
@@ -504,6 +808,24 @@ func (r *Queryer) loadStateAtEventIDs(ctx context.Context, roomInfo types.RoomIn
 	return helpers.LoadStateEvents(ctx, r.DB, stateEntries)
 }
 
+// loadStateBeforeEventID loads the state before the given event. Returns false
+// if the state before the event isn't known, e.g. because it is an outlier.
+func (r *Queryer) loadStateBeforeEventID(ctx context.Context, roomInfo types.RoomInfo, eventID string) ([]gomatrixserverlib.Event, bool, error) {
+	snapshotNID, err := r.DB.SnapshotNIDFromEventID(ctx, eventID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("r.DB.SnapshotNIDFromEventID: %w", err)
+	}
+	if snapshotNID == 0 {
+		return nil, false, nil
+	}
+	stateEntries, err := state.NewStateResolution(r.DB, roomInfo).LoadStateAtSnapshot(ctx, snapshotNID)
+	if err != nil {
+		return nil, false, err
+	}
+	stateEvents, err := helpers.LoadStateEvents(ctx, r.DB, stateEntries)
+	return stateEvents, true, err
+}
+
 type eventsFromIDs func(context.Context, []string) ([]types.Event, error)
 
 // getAuthChain fetches the auth chain for the given auth events. An auth chain
@@ -611,11 +933,47 @@ func (r *Queryer) QueryPublishedRooms(
 	req *api.QueryPublishedRoomsRequest,
 	res *api.QueryPublishedRoomsResponse,
 ) error {
-	rooms, err := r.DB.GetPublishedRooms(ctx)
+	var rooms []string
+	var err error
+	if req.NetworkID != "" {
+		rooms, err = r.replica().GetPublishedNetworkRooms(ctx, req.NetworkID)
+	} else {
+		rooms, err = r.replica().GetPublishedRooms(ctx)
+	}
 	if err != nil {
 		return err
 	}
+	if req.NetworkID == "" && req.IncludeAllNetworks {
+		networkRooms, err := r.replica().GetPublishedNetworkRooms(ctx, "")
+		if err != nil {
+			return err
+		}
+		published := make(map[string]bool, len(rooms))
+		for _, roomID := range rooms {
+			published[roomID] = true
+		}
+		for _, roomID := range networkRooms {
+			if !published[roomID] {
+				published[roomID] = true
+				rooms = append(rooms, roomID)
+			}
+		}
+	}
 	res.RoomIDs = rooms
+	if req.IncludePublications {
+		publications, err := r.replica().GetPublications(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range publications {
+			res.Publications = append(res.Publications, api.Publication{
+				RoomID:      p.RoomID,
+				NetworkID:   p.NetworkID,
+				UserID:      p.UserID,
+				PublishedTS: p.PublishedTS,
+			})
+		}
+	}
 	return nil
 }
 
@@ -642,8 +1000,155 @@ func (r *Queryer) QueryRoomsForUser(ctx context.Context, req *api.QueryRoomsForU
 	return nil
 }
 
+// QueryRoomCounts returns how many rooms a user is joined to and how many
+// rooms the server knows about.
+func (r *Queryer) QueryRoomCounts(ctx context.Context, req *api.QueryRoomCountsRequest, res *api.QueryRoomCountsResponse) (err error) {
+	if req.UserID != "" {
+		if res.JoinedRoomCount, err = r.DB.GetJoinedRoomCount(ctx, req.UserID); err != nil {
+			return fmt.Errorf("r.DB.GetJoinedRoomCount: %w", err)
+		}
+	}
+	if res.RoomCount, err = r.DB.GetRoomCount(ctx); err != nil {
+		return fmt.Errorf("r.DB.GetRoomCount: %w", err)
+	}
+	res.AtMaxRooms = r.MaxRooms > 0 && res.RoomCount >= r.MaxRooms
+	return nil
+}
+
+// QueryRetentionRooms returns the rooms whose events are purged once they are
+// older than a max lifetime, either because of the room's retention policy or
+// the server's default.
+func (r *Queryer) QueryRetentionRooms(ctx context.Context, req *api.QueryRetentionRoomsRequest, res *api.QueryRetentionRoomsResponse) error {
+	res.Rooms = []api.RoomRetention{}
+	if r.Retention == nil {
+		return nil
+	}
+	roomIDs, err := r.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetKnownRooms: %w", err)
+	}
+	for _, roomID := range roomIDs {
+		info, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if info == nil || info.IsStub {
+			continue
+		}
+		lifetime, hasPolicy, err := helpers.RoomMaxLifetime(ctx, r.DB, r.Retention, roomID)
+		if err != nil {
+			return fmt.Errorf("helpers.RoomMaxLifetime: %w", err)
+		}
+		if lifetime == 0 {
+			continue
+		}
+		res.Rooms = append(res.Rooms, api.RoomRetention{
+			RoomID:        roomID,
+			MaxLifetimeMS: lifetime.Milliseconds(),
+			HasPolicy:     hasPolicy,
+		})
+	}
+	res.PurgeEnabled = r.Retention.PurgeInterval > 0
+	return nil
+}
+
+// QueryInsertionEvent looks up the MSC2716 insertion event in a room which
+// accepts the given batch ID, so that a batch of history can be connected to
+// it.
+func (r *Queryer) QueryInsertionEvent(ctx context.Context, req *api.QueryInsertionEventRequest, res *api.QueryInsertionEventResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil {
+		return nil
+	}
+	eventNID, err := r.DB.InsertionEventNID(ctx, info.RoomNID, req.BatchID)
+	if err != nil || eventNID == 0 {
+		return err
+	}
+	eventIDs, err := r.DB.EventIDs(ctx, []types.EventNID{eventNID})
+	if err != nil {
+		return fmt.Errorf("r.DB.EventIDs: %w", err)
+	}
+	res.EventID = eventIDs[eventNID]
+	return nil
+}
+
+// maxRoomSummaryHeroes is the number of heroes in a room summary, as given
+// in the spec.
+const maxRoomSummaryHeroes = 5
+
+// QueryRoomSummary returns what clients need to show a room in their room
+// list. The member counts and heroes come from the membership table, so the
+// membership events of the room don't need to be loaded.
+func (r *Queryer) QueryRoomSummary(ctx context.Context, req *api.QueryRoomSummaryRequest, res *api.QueryRoomSummaryResponse) (err error) {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil
+	}
+	res.RoomExists = true
+	if _, res.IsJoined, err = r.DB.GetMembership(ctx, info.RoomNID, req.UserID); err != nil {
+		return fmt.Errorf("r.DB.GetMembership: %w", err)
+	}
+	if !res.IsJoined {
+		return nil
+	}
+
+	res.RoomVersion = info.RoomVersion
+	if res.JoinedMemberCount, res.InvitedMemberCount, err = r.DB.GetMembershipCounts(ctx, info.RoomNID); err != nil {
+		return fmt.Errorf("r.DB.GetMembershipCounts: %w", err)
+	}
+	for _, tuple := range []struct {
+		eventType string
+		path      string
+		value     *string
+	}{
+		{gomatrixserverlib.MRoomName, "name", &res.Name},
+		{gomatrixserverlib.MRoomCanonicalAlias, "alias", &res.CanonicalAlias},
+		{"m.room.avatar", "url", &res.AvatarURL},
+		{gomatrixserverlib.MRoomJoinRules, "join_rule", &res.JoinRule},
+	} {
+		ev, err := r.DB.GetStateEvent(ctx, req.RoomID, tuple.eventType, "")
+		if err != nil {
+			return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+		}
+		if ev != nil {
+			*tuple.value = gjson.GetBytes(ev.Content(), tuple.path).Str
+		}
+	}
+	if res.Name == "" && res.CanonicalAlias == "" {
+		if res.Heroes, err = r.DB.GetHeroes(ctx, info.RoomNID, req.UserID, maxRoomSummaryHeroes); err != nil {
+			return fmt.Errorf("r.DB.GetHeroes: %w", err)
+		}
+	}
+
+	latestEvents, _, _, err := r.DB.LatestEventIDs(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	latestEventIDs := make([]string, 0, len(latestEvents))
+	for _, ref := range latestEvents {
+		latestEventIDs = append(latestEventIDs, ref.EventID)
+	}
+	events, err := r.DB.EventsFromIDs(ctx, latestEventIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+	}
+	for _, event := range events {
+		if res.LatestEvent == nil || event.Depth() > res.LatestEvent.Depth() {
+			headered := event.Headered(info.RoomVersion)
+			res.LatestEvent = &headered
+		}
+	}
+	return nil
+}
+
 func (r *Queryer) QueryKnownUsers(ctx context.Context, req *api.QueryKnownUsersRequest, res *api.QueryKnownUsersResponse) error {
-	users, err := r.DB.GetKnownUsers(ctx, req.UserID, req.SearchString, req.Limit)
+	users, err := r.replica().GetKnownUsers(ctx, req.UserID, req.SearchString, req.Limit)
 	if err != nil {
 		return err
 	}
@@ -712,3 +1217,295 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	res.Banned = r.ServerACLs.IsServerBannedFromRoom(req.ServerName, req.RoomID)
 	return nil
 }
+
+// QueryEventsBySenderMaxLimit is the maximum number of events that
+// QueryEventsBySender will return in a single request.
+const QueryEventsBySenderMaxLimit = 1000
+
+// QueryEventsBySender implements api.RoomserverInternalAPI
+func (r *Queryer) QueryEventsBySender(ctx context.Context, req *api.QueryEventsBySenderRequest, res *api.QueryEventsBySenderResponse) error {
+	info, err := r.replica().RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("QueryEventsBySender: unknown room %s", req.RoomID)
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > QueryEventsBySenderMaxLimit {
+		limit = QueryEventsBySenderMaxLimit
+	}
+	eventNIDs, err := r.replica().RoomEventNIDsBySender(ctx, info.RoomNID, req.Sender, types.EventNID(req.From), limit)
+	if err != nil {
+		return err
+	}
+	events, err := r.replica().Events(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+	res.Events = make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		res.Events = append(res.Events, event.Headered(info.RoomVersion))
+	}
+	if len(eventNIDs) == limit {
+		res.Next = int64(eventNIDs[len(eventNIDs)-1])
+	}
+	return nil
+}
+
+// QueryRelations implements api.RoomserverInternalAPI
+func (r *Queryer) QueryRelations(ctx context.Context, req *api.QueryRelationsRequest, res *api.QueryRelationsResponse) error {
+	info, err := r.replica().RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("QueryRelations: unknown room %s", req.RoomID)
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > api.QueryRelationsMaxLimit {
+		limit = api.QueryRelationsMaxLimit
+	}
+	before := types.EventNID(req.From)
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	eventNIDs, err := r.replica().Relations(ctx, info.RoomNID, req.EventID, req.RelType, req.EventType, before, limit)
+	if err != nil {
+		return err
+	}
+	events, err := r.replica().Events(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+	byNID := make(map[types.EventNID]types.Event, len(events))
+	for _, event := range events {
+		byNID[event.EventNID] = event
+	}
+	res.Events = []gomatrixserverlib.HeaderedEvent{}
+	for _, eventNID := range eventNIDs {
+		if event, ok := byNID[eventNID]; ok {
+			res.Events = append(res.Events, event.Headered(info.RoomVersion))
+		}
+	}
+	if len(eventNIDs) == limit {
+		res.NextBatch = int64(eventNIDs[len(eventNIDs)-1])
+	}
+	return nil
+}
+
+// QueryAggregations implements api.RoomserverInternalAPI
+func (r *Queryer) QueryAggregations(ctx context.Context, req *api.QueryAggregationsRequest, res *api.QueryAggregationsResponse) error {
+	ignored := make(map[string]bool, len(req.IgnoredUsers))
+	for _, userID := range req.IgnoredUsers {
+		ignored[userID] = true
+	}
+	events, err := r.replica().EventsFromIDs(ctx, req.EventIDs)
+	if err != nil {
+		return err
+	}
+	res.Aggregations = make(map[string]api.EventAggregations)
+	roomInfos := make(map[string]*types.RoomInfo)
+	for _, event := range events {
+		// Relations are only counted if they are in the same room as the
+		// event that they relate to.
+		info, ok := roomInfos[event.RoomID()]
+		if !ok {
+			if info, err = r.replica().RoomInfo(ctx, event.RoomID()); err != nil {
+				return err
+			}
+			roomInfos[event.RoomID()] = info
+		}
+		if info == nil {
+			continue
+		}
+		var aggregations api.EventAggregations
+		if aggregations.Annotations, err = r.aggregateAnnotations(ctx, info.RoomNID, event.EventID(), ignored); err != nil {
+			return err
+		}
+		if aggregations.Replace, err = r.latestReplacement(ctx, info.RoomNID, event.EventID(), event.Sender()); err != nil {
+			return err
+		}
+		if aggregations.Thread, err = r.threadSummary(ctx, info, event, req.UserID); err != nil {
+			return err
+		}
+		if len(aggregations.Annotations) > 0 || aggregations.Replace != nil || aggregations.Thread != nil {
+			res.Aggregations[event.EventID()] = aggregations
+		}
+	}
+	return nil
+}
+
+// aggregateAnnotations counts the users who annotated the given event with each
+// key, leaving out ignored users. Each user is only counted once per key.
+func (r *Queryer) aggregateAnnotations(
+	ctx context.Context, roomNID types.RoomNID, eventID string, ignored map[string]bool,
+) ([]api.Annotation, error) {
+	relations, err := r.replica().RelationsByType(ctx, roomNID, eventID, api.RelTypeAnnotation)
+	if err != nil {
+		return nil, err
+	}
+	type annotationKey struct{ eventType, key string }
+	senders := make(map[annotationKey]map[string]bool)
+	var order []annotationKey
+	for _, relation := range relations {
+		if ignored[relation.Sender] {
+			continue
+		}
+		k := annotationKey{relation.EventType, relation.Key}
+		if senders[k] == nil {
+			senders[k] = make(map[string]bool)
+			order = append(order, k)
+		}
+		senders[k][relation.Sender] = true
+	}
+	annotations := make([]api.Annotation, 0, len(order))
+	for _, k := range order {
+		annotations = append(annotations, api.Annotation{
+			Type:  k.eventType,
+			Key:   k.key,
+			Count: len(senders[k]),
+		})
+	}
+	// Most popular first, otherwise in the order that they were first used.
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Count > annotations[j].Count
+	})
+	return annotations, nil
+}
+
+// latestReplacement returns the most recent edit of the given event. Only edits
+// made by the original sender of the event count. Redacted edits no longer
+// relate to the event, so they are never returned.
+func (r *Queryer) latestReplacement(
+	ctx context.Context, roomNID types.RoomNID, eventID, sender string,
+) (*api.Replacement, error) {
+	eventNID, err := r.replica().LatestRelationBySender(ctx, roomNID, eventID, api.RelTypeReplace, sender)
+	if err != nil || eventNID == 0 {
+		return nil, err
+	}
+	events, err := r.replica().Events(ctx, []types.EventNID{eventNID})
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &api.Replacement{
+		EventID:        events[0].EventID(),
+		OriginServerTS: events[0].OriginServerTS(),
+		Sender:         events[0].Sender(),
+	}, nil
+}
+
+// threadSummary summarises the thread rooted at the given event, or returns
+// nil if the event isn't the root of a thread.
+func (r *Queryer) threadSummary(
+	ctx context.Context, info *types.RoomInfo, root types.Event, userID string,
+) (*api.ThreadSummary, error) {
+	relations, err := r.replica().RelationsByType(ctx, info.RoomNID, root.EventID(), api.RelTypeThread)
+	if err != nil {
+		return nil, err
+	}
+	if len(relations) == 0 {
+		return nil, nil
+	}
+	events, err := r.replica().Events(ctx, []types.EventNID{relations[len(relations)-1].EventNID})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return &api.ThreadSummary{
+		LatestEvent:             events[0].Headered(info.RoomVersion),
+		Count:                   len(relations),
+		CurrentUserParticipated: userID != "" && participatedInThread(root, relations, userID),
+	}, nil
+}
+
+// QueryThreads implements api.RoomserverInternalAPI
+func (r *Queryer) QueryThreads(ctx context.Context, req *api.QueryThreadsRequest, res *api.QueryThreadsResponse) error {
+	info, err := r.replica().RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("QueryThreads: unknown room %s", req.RoomID)
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > api.QueryRelationsMaxLimit {
+		limit = api.QueryRelationsMaxLimit
+	}
+	before := types.EventNID(req.From)
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	participatedOnly := req.Include == api.ThreadsIncludeParticipated
+
+	// When only listing threads that the user participated in, some of the
+	// roots in each page might be left out, so keep going until we have
+	// enough or run out of threads.
+	res.Events = []gomatrixserverlib.HeaderedEvent{}
+	for len(res.Events) < limit {
+		roots, err := r.replica().ThreadRoots(ctx, info.RoomNID, before, limit)
+		if err != nil {
+			return err
+		}
+		rootIDs := make([]string, 0, len(roots))
+		for _, root := range roots {
+			rootIDs = append(rootIDs, root.EventID)
+		}
+		events, err := r.replica().EventsFromIDs(ctx, rootIDs)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]types.Event, len(events))
+		for _, event := range events {
+			byID[event.EventID()] = event
+		}
+		for _, root := range roots {
+			before = root.LatestEventNID
+			event, ok := byID[root.EventID]
+			if !ok {
+				// We don't have the root event, e.g. because it's from
+				// before we joined the room.
+				continue
+			}
+			if event.RoomID() != req.RoomID {
+				// The thread events claim to relate to an event in another
+				// room, so this isn't a thread in this room at all.
+				continue
+			}
+			if participatedOnly {
+				relations, err := r.replica().RelationsByType(ctx, info.RoomNID, root.EventID, api.RelTypeThread)
+				if err != nil {
+					return err
+				}
+				if !participatedInThread(event, relations, req.UserID) {
+					continue
+				}
+			}
+			res.Events = append(res.Events, event.Headered(info.RoomVersion))
+			if len(res.Events) == limit {
+				res.NextBatch = int64(root.LatestEventNID)
+				return nil
+			}
+		}
+		if len(roots) < limit {
+			break
+		}
+	}
+	return nil
+}
+
+// participatedInThread returns true if the user sent the given thread root or
+// any of the events in its thread.
+func participatedInThread(root types.Event, relations []tables.RelationInfo, userID string) bool {
+	if root.Sender() == userID {
+		return true
+	}
+	for _, relation := range relations {
+		if relation.Sender == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -17,9 +17,12 @@ package query
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -155,3 +158,79 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+type testRoomSummaryDB struct {
+	storage.Database
+	joined map[string]bool
+	heroes []string
+	// Set when the member counts are looked up.
+	counted bool
+}
+
+func (d *testRoomSummaryDB) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	if roomID != "!room:kaer.morhen" {
+		return nil, nil
+	}
+	return &types.RoomInfo{RoomNID: 1, RoomVersion: gomatrixserverlib.RoomVersionV6}, nil
+}
+
+func (d *testRoomSummaryDB) GetMembership(ctx context.Context, roomNID types.RoomNID, userID string) (types.EventNID, bool, error) {
+	return 1, d.joined[userID], nil
+}
+
+func (d *testRoomSummaryDB) GetMembershipCounts(ctx context.Context, roomNID types.RoomNID) (int, int, error) {
+	d.counted = true
+	return len(d.joined), 1, nil
+}
+
+func (d *testRoomSummaryDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	return nil, nil
+}
+
+func (d *testRoomSummaryDB) GetHeroes(ctx context.Context, roomNID types.RoomNID, userID string, limit int) ([]string, error) {
+	return d.heroes, nil
+}
+
+func (d *testRoomSummaryDB) LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error) {
+	return nil, 0, 0, nil
+}
+
+func (d *testRoomSummaryDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	return nil, nil
+}
+
+func TestQueryRoomSummary(t *testing.T) {
+	db := &testRoomSummaryDB{
+		joined: map[string]bool{"@geralt:kaer.morhen": true, "@ciri:kaer.morhen": true},
+		heroes: []string{"@ciri:kaer.morhen"},
+	}
+	queryer := &Queryer{DB: db}
+	query := func(roomID, userID string) *api.QueryRoomSummaryResponse {
+		var res api.QueryRoomSummaryResponse
+		if err := queryer.QueryRoomSummary(context.Background(), &api.QueryRoomSummaryRequest{RoomID: roomID, UserID: userID}, &res); err != nil {
+			t.Fatalf("QueryRoomSummary failed: %s", err)
+		}
+		return &res
+	}
+
+	if res := query("!unknown:kaer.morhen", "@geralt:kaer.morhen"); res.RoomExists || res.IsJoined {
+		t.Errorf("unknown room: got %+v, want the room not to exist", res)
+	}
+
+	// Users who aren't joined learn nothing about the room.
+	res := query("!room:kaer.morhen", "@yennefer:kaer.morhen")
+	if !res.RoomExists || res.IsJoined || res.JoinedMemberCount != 0 || res.Heroes != nil || db.counted {
+		t.Errorf("non-member: got %+v, want only that the room exists", res)
+	}
+
+	res = query("!room:kaer.morhen", "@geralt:kaer.morhen")
+	if !res.IsJoined || res.JoinedMemberCount != 2 || res.InvitedMemberCount != 1 {
+		t.Errorf("member: got %+v, want 2 joined and 1 invited", res)
+	}
+	if !reflect.DeepEqual(res.Heroes, db.heroes) {
+		t.Errorf("got heroes %v, want %v", res.Heroes, db.heroes)
+	}
+	if res.RoomVersion != gomatrixserverlib.RoomVersionV6 {
+		t.Errorf("got room version %s, want %s", res.RoomVersion, gomatrixserverlib.RoomVersionV6)
+	}
+}
@@ -27,6 +27,7 @@ const (
 	// Perform operations
 	RoomserverPerformInvitePath   = "/roomserver/performInvite"
 	RoomserverPerformPeekPath     = "/roomserver/performPeek"
+	RoomserverPerformUnpeekPath   = "/roomserver/performUnpeek"
 	RoomserverPerformJoinPath     = "/roomserver/performJoin"
 	RoomserverPerformLeavePath    = "/roomserver/performLeave"
 	RoomserverPerformBackfillPath = "/roomserver/performBackfill"
@@ -39,10 +40,13 @@ const (
 	RoomserverQueryEventsByIDPath              = "/roomserver/queryEventsByID"
 	RoomserverQueryMembershipForUserPath       = "/roomserver/queryMembershipForUser"
 	RoomserverQueryMembershipsForRoomPath      = "/roomserver/queryMembershipsForRoom"
+	RoomserverQueryJoinedMembersPath           = "/roomserver/queryJoinedMembers"
 	RoomserverQueryServerJoinedToRoomPath      = "/roomserver/queryServerJoinedToRoomPath"
 	RoomserverQueryServerAllowedToSeeEventPath = "/roomserver/queryServerAllowedToSeeEvent"
+	RoomserverQueryEventsVisibleToUserPath     = "/roomserver/queryEventsVisibleToUser"
 	RoomserverQueryMissingEventsPath           = "/roomserver/queryMissingEvents"
 	RoomserverQueryStateAndAuthChainPath       = "/roomserver/queryStateAndAuthChain"
+	RoomserverQueryAuthChainPath               = "/roomserver/queryAuthChain"
 	RoomserverQueryRoomVersionCapabilitiesPath = "/roomserver/queryRoomVersionCapabilities"
 	RoomserverQueryRoomVersionForRoomPath      = "/roomserver/queryRoomVersionForRoom"
 	RoomserverQueryPublishedRoomsPath          = "/roomserver/queryPublishedRooms"
@@ -52,6 +56,14 @@ const (
 	RoomserverQuerySharedUsersPath             = "/roomserver/querySharedUsers"
 	RoomserverQueryKnownUsersPath              = "/roomserver/queryKnownUsers"
 	RoomserverQueryServerBannedFromRoomPath    = "/roomserver/queryServerBannedFromRoom"
+	RoomserverQueryEventsBySenderPath          = "/roomserver/queryEventsBySender"
+	RoomserverQueryRelationsPath               = "/roomserver/queryRelations"
+	RoomserverQueryAggregationsPath            = "/roomserver/queryAggregations"
+	RoomserverQueryThreadsPath                 = "/roomserver/queryThreads"
+	RoomserverQueryRoomCountsPath              = "/roomserver/queryRoomCounts"
+	RoomserverQueryRetentionRoomsPath          = "/roomserver/queryRetentionRooms"
+	RoomserverQueryRoomSummaryPath             = "/roomserver/queryRoomSummary"
+	RoomserverQueryInsertionEventPath          = "/roomserver/queryInsertionEvent"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -208,6 +220,23 @@ func (h *httpRoomserverInternalAPI) PerformPeek(
 	}
 }
 
+func (h *httpRoomserverInternalAPI) PerformUnpeek(
+	ctx context.Context,
+	request *api.PerformUnpeekRequest,
+	response *api.PerformUnpeekResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUnpeek")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUnpeekPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.PerformError{
+			Msg: fmt.Sprintf("failed to communicate with roomserver: %s", err),
+		}
+	}
+}
+
 func (h *httpRoomserverInternalAPI) PerformLeave(
 	ctx context.Context,
 	request *api.PerformLeaveRequest,
@@ -327,6 +356,19 @@ func (h *httpRoomserverInternalAPI) QueryMembershipsForRoom(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryJoinedMembers implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryJoinedMembers(
+	ctx context.Context,
+	request *api.QueryJoinedMembersRequest,
+	response *api.QueryJoinedMembersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryJoinedMembers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryJoinedMembersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipsForRoom implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryServerJoinedToRoom(
 	ctx context.Context,
@@ -353,6 +395,32 @@ func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryEventsVisibleToUser implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryEventsVisibleToUser(
+	ctx context.Context,
+	request *api.QueryEventsVisibleToUserRequest,
+	response *api.QueryEventsVisibleToUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsVisibleToUser")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsVisibleToUserPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryAuthChain implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryAuthChain(
+	ctx context.Context,
+	request *api.QueryAuthChainRequest,
+	response *api.QueryAuthChainResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAuthChain")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAuthChainPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -492,3 +560,83 @@ func (h *httpRoomserverInternalAPI) QueryServerBannedFromRoom(
 	apiURL := h.roomserverURL + RoomserverQueryServerBannedFromRoomPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
+
+func (h *httpRoomserverInternalAPI) QueryEventsBySender(
+	ctx context.Context, req *api.QueryEventsBySenderRequest, res *api.QueryEventsBySenderResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsBySender")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsBySenderPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRelations(
+	ctx context.Context, req *api.QueryRelationsRequest, res *api.QueryRelationsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRelations")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRelationsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryAggregations(
+	ctx context.Context, req *api.QueryAggregationsRequest, res *api.QueryAggregationsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAggregations")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryAggregationsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryThreads(
+	ctx context.Context, req *api.QueryThreadsRequest, res *api.QueryThreadsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryThreads")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryThreadsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomCounts(
+	ctx context.Context, req *api.QueryRoomCountsRequest, res *api.QueryRoomCountsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomCounts")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomCountsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRetentionRooms(
+	ctx context.Context, req *api.QueryRetentionRoomsRequest, res *api.QueryRetentionRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRetentionRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRetentionRoomsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryRoomSummary(
+	ctx context.Context, req *api.QueryRoomSummaryRequest, res *api.QueryRoomSummaryResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomSummary")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomSummaryPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpRoomserverInternalAPI) QueryInsertionEvent(
+	ctx context.Context, req *api.QueryInsertionEventRequest, res *api.QueryInsertionEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryInsertionEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryInsertionEventPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
@@ -20,9 +20,11 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/inthttp"
 	"github.com/matrix-org/gomatrixserverlib"
 
+	dendriteInternal "github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/setup"
 	"github.com/matrix-org/dendrite/internal/setup/kafka"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/internal"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/sirupsen/logrus"
@@ -54,8 +56,25 @@ func NewInternalAPI(
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
 
-	return internal.NewRoomserverAPI(
+	rsAPI := internal.NewRoomserverAPI(
 		cfg, roomserverDB, producer, string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
 		base.Caches, keyRing, perspectiveServerNames,
 	)
+	if rsAPI.Purger != nil {
+		base.Shutdown.Register(dendriteInternal.ShutdownStageBackground, "retention purger", rsAPI.Purger.Stop)
+	}
+	base.Shutdown.Register(dendriteInternal.ShutdownStageQueues, "roomserver input", rsAPI.Inputer.Stop)
+
+	if replica := cfg.Database.ReadReplica(); replica != nil {
+		rsAPI.Queryer.ReadReplica, err = storage.Open(replica, base.Caches)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to room server read replica")
+		}
+		rsAPI.Queryer.ReplicaHealth, err = sqlutil.NewReadReplica(replica)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to room server read replica")
+		}
+	}
+
+	return rsAPI
 }
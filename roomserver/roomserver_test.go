@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 const (
@@ -39,6 +40,8 @@ var (
 type dummyProducer struct {
 	topic            string
 	producedMessages []*api.OutputEvent
+	// The number of times that SendMessages was called.
+	sendMessagesCalls int
 }
 
 // SendMessage produces a given message, and returns only when it either has
@@ -65,6 +68,7 @@ func (p *dummyProducer) SendMessage(msg *sarama.ProducerMessage) (partition int3
 // can succeed and fail individually; if some succeed and some fail,
 // SendMessages will return an error.
 func (p *dummyProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.sendMessagesCalls++
 	for _, m := range msgs {
 		p.SendMessage(m)
 	}
@@ -157,7 +161,7 @@ func mustLoadRawEvents(t *testing.T, ver gomatrixserverlib.RoomVersion, events [
 	return hs
 }
 
-func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyProducer) {
+func mustCreateRoomserverAPI(t *testing.T, configure ...func(cfg *config.RoomServer)) (api.RoomserverInternalAPI, *dummyProducer) {
 	t.Helper()
 	cfg := &config.Dendrite{}
 	cfg.Defaults()
@@ -166,6 +170,9 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 	cfg.RoomServer.Database = config.DatabaseOptions{
 		ConnectionString: roomserverDBFileURI,
 	}
+	for _, f := range configure {
+		f(&cfg.RoomServer)
+	}
 	dp := &dummyProducer{
 		topic: cfg.Global.Kafka.TopicFor(config.TopicOutputRoomEvent),
 	}
@@ -407,3 +414,488 @@ func TestOutputRewritesState(t *testing.T) {
 		t.Errorf("Output event did not overwrite room state")
 	}
 }
+
+func TestQueryEventsBySender(t *testing.T) {
+	roomID := "!senders:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyKey, Content: map[string]interface{}{"join_rule": "public"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "one"}},
+		{RoomID: roomID, Sender: bob, Type: "m.room.message", Content: map[string]interface{}{"body": "two"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "three"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+
+	// Page through each user's events two at a time.
+	eventsBySender := func(sender string) (pages [][]string) {
+		var from int64
+		for {
+			var res api.QueryEventsBySenderResponse
+			if err := rsAPI.QueryEventsBySender(context.Background(), &api.QueryEventsBySenderRequest{
+				RoomID: roomID,
+				Sender: sender,
+				From:   from,
+				Limit:  2,
+			}, &res); err != nil {
+				t.Fatalf("QueryEventsBySender: %s", err)
+			}
+			var page []string
+			for _, ev := range res.Events {
+				if ev.Sender() != sender {
+					t.Fatalf("QueryEventsBySender returned event %s sent by %s, want %s", ev.EventID(), ev.Sender(), sender)
+				}
+				page = append(page, ev.EventID())
+			}
+			pages = append(pages, page)
+			if res.Next == 0 {
+				return pages
+			}
+			from = res.Next
+		}
+	}
+	wantAlice := [][]string{
+		{events[0].EventID(), events[1].EventID()},
+		{events[2].EventID(), events[4].EventID()},
+		{events[6].EventID()},
+	}
+	if got := eventsBySender(alice); !reflect.DeepEqual(got, wantAlice) {
+		t.Errorf("wrong events for alice: got %v want %v", got, wantAlice)
+	}
+	// Bob's events fill a whole page, so there is an empty page at the end.
+	wantBob := [][]string{
+		{events[3].EventID(), events[5].EventID()},
+		nil,
+	}
+	if got := eventsBySender(bob); !reflect.DeepEqual(got, wantBob) {
+		t.Errorf("wrong events for bob: got %v want %v", got, wantBob)
+	}
+}
+
+func TestQueryMembershipsForRoomFilterAndLimit(t *testing.T) {
+	roomID := "!members:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	charlie := "@charlie:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyKey, Content: map[string]interface{}{"join_rule": "public"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: charlie, Type: gomatrixserverlib.MRoomMember, StateKey: &charlie, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: charlie, Type: gomatrixserverlib.MRoomMember, StateKey: &charlie, Content: map[string]interface{}{"membership": "leave"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t, func(cfg *config.RoomServer) {
+		cfg.PageLimits.Members = 2
+	})
+	defer deleteDatabase()
+	if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+
+	memberships := func(req api.QueryMembershipsForRoomRequest) (got []string) {
+		req.RoomID = roomID
+		req.Sender = alice
+		var res api.QueryMembershipsForRoomResponse
+		if err := rsAPI.QueryMembershipsForRoom(context.Background(), &req, &res); err != nil {
+			t.Fatalf("QueryMembershipsForRoom: %s", err)
+		}
+		for _, ev := range res.JoinEvents {
+			got = append(got, gjson.GetBytes(ev.Content, "membership").Str)
+		}
+		return got
+	}
+	if got := memberships(api.QueryMembershipsForRoomRequest{}); len(got) != 2 {
+		t.Errorf("expected the configured limit of 2 members, got %v", got)
+	}
+	if got := memberships(api.QueryMembershipsForRoomRequest{Limit: 100}); len(got) != 2 {
+		t.Errorf("expected a limit over the configured limit to be clamped to 2 members, got %v", got)
+	}
+	if got := memberships(api.QueryMembershipsForRoomRequest{Limit: 1}); len(got) != 1 {
+		t.Errorf("expected 1 member, got %v", got)
+	}
+	if got := memberships(api.QueryMembershipsForRoomRequest{Membership: "leave"}); !reflect.DeepEqual(got, []string{"leave"}) {
+		t.Errorf("expected only the leave membership, got %v", got)
+	}
+	if got := memberships(api.QueryMembershipsForRoomRequest{NotMembership: "join"}); !reflect.DeepEqual(got, []string{"leave"}) {
+		t.Errorf("expected only the leave membership, got %v", got)
+	}
+}
+
+// mustSendOutlierBatch sends the events to the roomserver as a batch of
+// outliers, and returns whether each of them was rejected.
+func mustSendOutlierBatch(t *testing.T, rsAPI api.RoomserverInternalAPI, events []gomatrixserverlib.HeaderedEvent) []bool {
+	t.Helper()
+	ires := make([]api.InputRoomEvent, len(events))
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		ires[i] = api.InputRoomEvent{
+			Kind:         api.KindOutlier,
+			Event:        events[i],
+			AuthEventIDs: events[i].AuthEventIDs(),
+		}
+		eventIDs[i] = events[i].EventID()
+	}
+	if err := api.SendInputRoomEventsBatch(context.Background(), rsAPI, ires); err != nil {
+		t.Fatalf("failed to send batch: %s", err)
+	}
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: roomserverDBFileURI}, cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	states, err := db.StateAtEventIDs(context.Background(), eventIDs)
+	if err != nil {
+		t.Fatalf("StateAtEventIDs: %s", err)
+	}
+	rejected := make([]bool, len(states))
+	for i := range states {
+		rejected[i] = states[i].IsRejected
+	}
+	return rejected
+}
+
+func TestBatchedOutliersAuthedAgainstEarlierEvents(t *testing.T) {
+	roomID := "!batch:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	emptyKey := ""
+	// Every event after the create event is authed by events which are
+	// only earlier in the batch, and not yet in the database.
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyKey, Content: map[string]interface{}{"join_rule": "public"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: bob, Type: "m.room.message", Content: map[string]interface{}{"body": "hello"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+
+	rejected := mustSendOutlierBatch(t, rsAPI, events)
+	for i := range events {
+		if rejected[i] {
+			t.Errorf("event %d (%s) was rejected", i, events[i].Type())
+		}
+	}
+}
+
+func TestBatchedOutliersRejectDependents(t *testing.T) {
+	roomID := "!batch:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	emptyKey := ""
+	// The room is invite only, so bob's join is rejected, and so is his
+	// message which is authed by it. Alice's message is still accepted.
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: bob, Type: "m.room.message", Content: map[string]interface{}{"body": "let me in"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "no"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+
+	rejected := mustSendOutlierBatch(t, rsAPI, events)
+	want := []bool{false, false, true, true, false}
+	if !reflect.DeepEqual(rejected, want) {
+		t.Errorf("wrong rejections: got %v want %v", rejected, want)
+	}
+}
+
+func TestBatchedInvalidEventRejectedAlone(t *testing.T) {
+	roomID := "!batch:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	// The third event is too large to be stored, which must not stop the
+	// rest of the batch from being stored.
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": string(bytes.Repeat([]byte("a"), 70000))}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "hello"}},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+
+	ires := make([]api.InputRoomEvent, len(events))
+	for i := range events {
+		ires[i] = api.InputRoomEvent{
+			Kind:         api.KindOutlier,
+			Event:        events[i],
+			AuthEventIDs: events[i].AuthEventIDs(),
+		}
+	}
+	request := api.InputRoomEventsRequest{InputRoomEvents: ires, Batch: true}
+	var response api.InputRoomEventsResponse
+	rsAPI.InputRoomEvents(context.Background(), &request, &response)
+	if err := response.Err(); err != nil {
+		t.Fatalf("batch failed: %s", err)
+	}
+	want := []string{events[0].EventID(), events[1].EventID(), "", events[3].EventID()}
+	if !reflect.DeepEqual(response.EventIDs, want) {
+		t.Errorf("wrong event IDs: got %v want %v", response.EventIDs, want)
+	}
+}
+
+func TestBatchedOutlierRedaction(t *testing.T) {
+	roomID := "!batch:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "oops"}},
+	})
+	deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     alice,
+		Depth:      events[2].Depth() + 1,
+		Type:       gomatrixserverlib.MRoomRedaction,
+		RoomID:     roomID,
+		Redacts:    events[2].EventID(),
+		PrevEvents: []string{events[2].EventID()},
+		AuthEvents: []string{events[0].EventID(), events[1].EventID()},
+	}
+	if err := eb.SetContent(map[string]interface{}{}); err != nil {
+		t.Fatalf("failed to set redaction content: %s", err)
+	}
+	redactionEvent, err := eb.Build(time.Now(), testOrigin, "ed25519:test", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build redaction: %s", err)
+	}
+	redaction := redactionEvent.Headered(gomatrixserverlib.RoomVersionV6)
+
+	// Storing the redaction as part of a batch must tell downstream
+	// components to redact the message that they already have.
+	if rejected := mustSendOutlierBatch(t, rsAPI, []gomatrixserverlib.HeaderedEvent{redaction}); rejected[0] {
+		t.Fatalf("redaction was rejected")
+	}
+	var redacted []*api.OutputRedactedEvent
+	for _, msg := range producer.producedMessages {
+		if msg.Type == api.OutputTypeRedactedEvent {
+			redacted = append(redacted, msg.RedactedEvent)
+		}
+	}
+	if len(redacted) != 1 {
+		t.Fatalf("got %d redacted events, want 1", len(redacted))
+	}
+	if redacted[0].RedactedEventID != events[2].EventID() || redacted[0].RedactedBecause.EventID() != redaction.EventID() {
+		t.Errorf("wrong redaction output: got %s redacted by %s", redacted[0].RedactedEventID, redacted[0].RedactedBecause.EventID())
+	}
+}
+
+func TestBatchedNewEventsMatchUnbatched(t *testing.T) {
+	roomID := "!newbatch:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	carol := "@carol:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomJoinRules, StateKey: &emptyKey, Content: map[string]interface{}{"join_rule": "public"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "hello"}},
+		{RoomID: roomID, Sender: carol, Type: "m.room.message", Content: map[string]interface{}{"body": "not in the room"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.name", StateKey: &emptyKey, Content: map[string]interface{}{"name": "Batched"}},
+		{RoomID: roomID, Sender: bob, Type: gomatrixserverlib.MRoomMember, StateKey: &bob, Content: map[string]interface{}{"membership": "leave"}},
+		{RoomID: roomID, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "goodbye"}},
+	})
+
+	type newRoomEvent struct {
+		EventID         string
+		LatestEventIDs  []string
+		AddsState       []string
+		RemovesState    []string
+		LastSentEventID string
+	}
+	sendEvents := func(configure ...func(cfg *config.RoomServer)) (outputs []newRoomEvent, writes int) {
+		deleteDatabase()
+		defer deleteDatabase()
+		rsAPI, producer := mustCreateRoomserverAPI(t, configure...)
+		// Carol isn't in the room, so her message is rejected.
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err == nil {
+			t.Fatalf("expected carol's message to be rejected")
+		}
+		for _, msg := range producer.producedMessages {
+			if msg.Type != api.OutputTypeNewRoomEvent {
+				continue
+			}
+			outputs = append(outputs, newRoomEvent{
+				EventID:         msg.NewRoomEvent.Event.EventID(),
+				LatestEventIDs:  msg.NewRoomEvent.LatestEventIDs,
+				AddsState:       msg.NewRoomEvent.AddsStateEventIDs,
+				RemovesState:    msg.NewRoomEvent.RemovesStateEventIDs,
+				LastSentEventID: msg.NewRoomEvent.LastSentEventID,
+			})
+		}
+		return outputs, producer.sendMessagesCalls
+	}
+
+	want, unbatchedWrites := sendEvents()
+	if len(want) != len(events)-1 {
+		t.Fatalf("expected %d new room events without batching, got %d", len(events)-1, len(want))
+	}
+	got, batchedWrites := sendEvents(func(cfg *config.RoomServer) {
+		cfg.WriteBatchWindow = time.Second
+		cfg.MaxBatchSize = len(events)
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("batched output doesn't match unbatched output:\ngot  %+v\nwant %+v", got, want)
+	}
+	// The output events of a batch are written together once it has been
+	// committed, rather than once per event.
+	if batchedWrites >= unbatchedWrites {
+		t.Errorf("expected fewer output writes with batching, got %d batched and %d unbatched", batchedWrites, unbatchedWrites)
+	}
+}
+
+func TestAggregationsIgnoreRelationsFromOtherRooms(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	roomEvents := func(roomID string, extra ...fledglingEvent) []gomatrixserverlib.HeaderedEvent {
+		return mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, append([]fledglingEvent{
+			{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+			{RoomID: roomID, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		}, extra...))
+	}
+	roomA := "!a:" + string(testOrigin)
+	roomB := "!b:" + string(testOrigin)
+	eventsA := roomEvents(roomA, fledglingEvent{
+		RoomID: roomA, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "hello"},
+	})
+	target := eventsA[2].EventID()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     alice,
+		Depth:      eventsA[2].Depth() + 1,
+		Type:       "m.reaction",
+		RoomID:     roomA,
+		PrevEvents: []string{target},
+		AuthEvents: []string{eventsA[0].EventID(), eventsA[1].EventID()},
+	}
+	if err := eb.SetContent(map[string]interface{}{
+		"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": "👍"},
+	}); err != nil {
+		t.Fatalf("failed to set reaction content: %s", err)
+	}
+	reaction, err := eb.Build(time.Now(), testOrigin, "ed25519:test", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)), gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build reaction: %s", err)
+	}
+	eventsA = append(eventsA, reaction.Headered(gomatrixserverlib.RoomVersionV6))
+	// Room B contains relations to the message in room A, which must not be
+	// counted towards its aggregations.
+	eventsB := roomEvents(roomB,
+		fledglingEvent{RoomID: roomB, Sender: alice, Type: "m.reaction", Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": target, "key": "👎"},
+		}},
+		fledglingEvent{RoomID: roomB, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{
+			"body":          "* edited",
+			"m.new_content": map[string]interface{}{"body": "edited"},
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": target},
+		}},
+	)
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	for _, events := range [][]gomatrixserverlib.HeaderedEvent{eventsA, eventsB} {
+		if err = api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+			t.Fatalf("failed to send events: %s", err)
+		}
+	}
+
+	var res api.QueryAggregationsResponse
+	if err = rsAPI.QueryAggregations(context.Background(), &api.QueryAggregationsRequest{
+		EventIDs: []string{target},
+	}, &res); err != nil {
+		t.Fatalf("QueryAggregations: %s", err)
+	}
+	aggregations := res.Aggregations[target]
+	if len(aggregations.Annotations) != 1 || aggregations.Annotations[0].Key != "👍" {
+		t.Errorf("wrong annotations: %+v", aggregations.Annotations)
+	}
+	if aggregations.Replace != nil {
+		t.Errorf("edit from another room was used: %+v", aggregations.Replace)
+	}
+}
+
+func TestThreadsIgnoreRootsFromOtherRooms(t *testing.T) {
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	roomA := "!a:" + string(testOrigin)
+	roomB := "!b:" + string(testOrigin)
+	eventsA := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomA, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomA, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomA, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{"body": "root"}},
+	})
+	root := eventsA[2].EventID()
+	// The reply is in room B, but claims to be in a thread rooted in room A.
+	eventsB := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{RoomID: roomB, Sender: alice, Type: gomatrixserverlib.MRoomCreate, StateKey: &emptyKey, Content: map[string]interface{}{"creator": alice, "room_version": "6"}},
+		{RoomID: roomB, Sender: alice, Type: gomatrixserverlib.MRoomMember, StateKey: &alice, Content: map[string]interface{}{"membership": "join"}},
+		{RoomID: roomB, Sender: alice, Type: "m.room.message", Content: map[string]interface{}{
+			"body":         "reply",
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": root},
+		}},
+	})
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	for _, events := range [][]gomatrixserverlib.HeaderedEvent{eventsA, eventsB} {
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+			t.Fatalf("failed to send events: %s", err)
+		}
+	}
+
+	for _, roomID := range []string{roomA, roomB} {
+		var res api.QueryThreadsResponse
+		if err := rsAPI.QueryThreads(context.Background(), &api.QueryThreadsRequest{
+			RoomID:  roomID,
+			UserID:  alice,
+			Include: api.ThreadsIncludeAll,
+		}, &res); err != nil {
+			t.Fatalf("QueryThreads: %s", err)
+		}
+		if len(res.Events) != 0 {
+			t.Errorf("expected no threads in %s, got %d", roomID, len(res.Events))
+		}
+	}
+
+	var aggRes api.QueryAggregationsResponse
+	if err := rsAPI.QueryAggregations(context.Background(), &api.QueryAggregationsRequest{
+		EventIDs: []string{root},
+		UserID:   alice,
+	}, &aggRes); err != nil {
+		t.Fatalf("QueryAggregations: %s", err)
+	}
+	if thread := aggRes.Aggregations[root].Thread; thread != nil {
+		t.Errorf("reply from another room was counted in the thread summary: %+v", thread)
+	}
+}
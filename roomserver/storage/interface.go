@@ -65,13 +65,51 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up up to limit event NIDs in the room after the given event NID, in
+	// ascending order, for paginating through all events in a room.
+	RoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// Look up up to limit event NIDs in the room sent by the given user after the given event NID, in
+	// ascending order.
+	RoomEventNIDsBySender(ctx context.Context, roomNID types.RoomNID, sender string, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// PurgeEvents replaces the stored JSON of the given events with their redacted form, wiping their
+	// content while keeping them in the room DAG. It is used to enforce message retention policies.
+	PurgeEvents(ctx context.Context, events []types.Event) error
+	// Relations returns the numeric IDs of events in the given room which relate to the given event, newest
+	// first, with event NIDs lower than before. Empty relType or eventType values match anything.
+	Relations(ctx context.Context, roomNID types.RoomNID, eventID, relType, eventType string, before types.EventNID, limit int) ([]types.EventNID, error)
+	// RelationsByType returns all relations in the given room of the given type to the given event, oldest first.
+	RelationsByType(ctx context.Context, roomNID types.RoomNID, eventID, relType string) ([]tables.RelationInfo, error)
+	// ThreadRoots returns the roots of threads in the given room, most recently active first, whose
+	// latest event has a NID lower than before.
+	ThreadRoots(ctx context.Context, roomNID types.RoomNID, before types.EventNID, limit int) ([]tables.ThreadRoot, error)
+	// LatestRelationBySender returns the numeric ID of the most recent relation in the given room of the given
+	// type to the given event sent by the given user, or 0 if there isn't one.
+	LatestRelationBySender(ctx context.Context, roomNID types.RoomNID, eventID, relType, sender string) (types.EventNID, error)
+	// InsertionEventNID returns the numeric ID of the MSC2716 insertion event in the given room which accepts
+	// the given batch ID, or 0 if there isn't one.
+	InsertionEventNID(ctx context.Context, roomNID types.RoomNID, nextBatchID string) (types.EventNID, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
+	// Look up the snapshot NIDs for the state before each of the given events. The snapshot NID is 0 for events
+	// whose state isn't known, such as outliers.
+	SnapshotNIDsFromEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
 	StoreEvent(
 		ctx context.Context, event gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
 		isRejected bool,
 	) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+	// Stores a matrix room event like StoreEvent, but without recording its references to its prev
+	// events. The caller must store those with LatestEventsUpdater.StoreDeferredPreviousEvents.
+	StoreEventWithoutPreviousEvents(
+		ctx context.Context, event gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
+		isRejected bool,
+	) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+	// Stores a batch of matrix room events in a single transaction, in order. The auth event IDs
+	// may refer to events earlier in the batch. If any event fails to store then none are stored.
+	// Returns any redactions which were completed by storing the batch.
+	StoreEvents(
+		ctx context.Context, events []gomatrixserverlib.Event, authEventIDs [][]string, isRejected []bool,
+	) ([]types.StateAtEvent, []types.Redaction, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// Returns a types.MissingEventError if the event IDs aren't in the database.
@@ -136,10 +174,16 @@ type Database interface {
 	// not found.
 	// Returns an error if the retrieval went wrong.
 	EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error)
-	// Publish or unpublish a room from the room directory.
-	PublishRoom(ctx context.Context, roomID string, publish bool) error
+	// Publish or unpublish a room from the room directory, or from the directory of a
+	// third party network if networkID is not empty, recording which user published it.
+	PublishRoom(ctx context.Context, roomID, networkID, userID string, publish bool) error
 	// Returns a list of room IDs for rooms which are published.
 	GetPublishedRooms(ctx context.Context) ([]string, error)
+	// Returns who published which rooms in which room directories, most recent first.
+	GetPublications(ctx context.Context) ([]tables.PublicationInfo, error)
+	// Returns a list of room IDs for rooms which are published in the given third
+	// party network, or in any third party network if networkID is empty.
+	GetPublishedNetworkRooms(ctx context.Context, networkID string) ([]string, error)
 
 	// TODO: factor out - from currentstateserver
 
@@ -149,6 +193,15 @@ type Database interface {
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
 	// GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
 	GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// GetJoinedRoomCount returns the number of rooms that the user is joined to.
+	GetJoinedRoomCount(ctx context.Context, userID string) (int, error)
+	// GetRoomCount returns the number of rooms known to the roomserver.
+	GetRoomCount(ctx context.Context) (int, error)
+	// GetMembershipCounts returns the number of joined and invited users in the room.
+	GetMembershipCounts(ctx context.Context, roomNID types.RoomNID) (joined, invited int, err error)
+	// GetHeroes returns up to limit users to name the room after for the given user, picking joined and invited
+	// users first and then users who have left, in order of user ID.
+	GetHeroes(ctx context.Context, roomNID types.RoomNID, userID string, limit int) ([]string, error)
 	// GetBulkStateContent returns all state events which match a given room ID and a given state key tuple. Both must be satisfied for a match.
 	// If a tuple has the StateKey of '*' and allowWildcards=true then all state events with the EventType should be returned.
 	GetBulkStateContent(ctx context.Context, roomIDs []string, tuples []gomatrixserverlib.StateKeyTuple, allowWildcards bool) ([]tables.StrippedEvent, error)
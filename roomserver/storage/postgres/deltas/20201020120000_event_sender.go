@@ -0,0 +1,36 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadEventSender(m *sqlutil.Migrations) {
+	m.AddMigration(UpEventSender, DownEventSender)
+}
+
+// UpEventSender adds the sender of each event to the events table, so that
+// the events sent by a user can be found without loading every event.
+func UpEventSender(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT '';
+UPDATE roomserver_events SET sender = COALESCE(roomserver_event_json.event_json::json->>'sender', '')
+	FROM roomserver_event_json WHERE roomserver_events.event_nid = roomserver_event_json.event_nid;
+CREATE INDEX IF NOT EXISTS roomserver_events_sender_idx ON roomserver_events(room_nid, sender, event_nid);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownEventSender(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX IF EXISTS roomserver_events_sender_idx;
+ALTER TABLE roomserver_events DROP COLUMN sender;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadRelations(m *sqlutil.Migrations) {
+	m.AddMigration(UpRelations, DownRelations)
+}
+
+// UpRelations creates the relations table and fills it in from the events
+// that were stored before it existed, so that aggregations and threads also
+// cover older events. State events never carry relations.
+func UpRelations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS roomserver_relations (
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    room_nid BIGINT NOT NULL,
+    relates_to TEXT NOT NULL,
+    rel_type TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    aggregation_key TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS roomserver_relations_relates_to_idx ON roomserver_relations(relates_to, rel_type);
+CREATE INDEX IF NOT EXISTS roomserver_relations_room_nid_idx ON roomserver_relations(room_nid, rel_type);
+INSERT INTO roomserver_relations (event_nid, room_nid, relates_to, rel_type, event_type, sender, aggregation_key)
+	SELECT event_nid, room_nid, relates_to, rel_type, event_type, sender, aggregation_key FROM (
+		SELECT e.event_nid, e.room_nid,
+			COALESCE(j.event_json::json->'content'->'m.relates_to'->>'event_id', '') AS relates_to,
+			COALESCE(j.event_json::json->'content'->'m.relates_to'->>'rel_type', '') AS rel_type,
+			COALESCE(j.event_json::json->>'type', '') AS event_type,
+			COALESCE(j.event_json::json->>'sender', '') AS sender,
+			COALESCE(j.event_json::json->'content'->'m.relates_to'->>'key', '') AS aggregation_key
+		FROM roomserver_events e JOIN roomserver_event_json j ON e.event_nid = j.event_nid
+		WHERE j.event_json::json->'state_key' IS NULL
+	) AS relations WHERE relates_to != '' AND rel_type != ''
+	ON CONFLICT (event_nid) DO NOTHING;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownRelations(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS roomserver_relations;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
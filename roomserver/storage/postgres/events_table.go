@@ -22,7 +22,9 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -71,8 +73,8 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, sender)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -123,6 +125,14 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDForEventNIDSQL = "" +
 	"SELECT room_nid FROM roomserver_events WHERE event_nid = $1"
 
+const selectRoomEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND event_nid > $2" +
+	" ORDER BY event_nid ASC LIMIT $3"
+
+const selectRoomEventNIDsBySenderSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND sender = $2 AND event_nid > $3" +
+	" ORDER BY event_nid ASC LIMIT $4"
+
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
 	selectEventStmt                        *sql.Stmt
@@ -138,14 +148,30 @@ type eventStatements struct {
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
 	selectRoomNIDForEventNIDStmt           *sql.Stmt
+	selectRoomEventNIDsStmt                *sql.Stmt
+	selectRoomEventNIDsBySenderStmt        *sql.Stmt
+}
+
+// Migrations returns the schema migrations of the roomserver database.
+func Migrations() *sqlutil.Migrations {
+	m := sqlutil.NewMigrations("roomserver")
+	deltas.LoadEventSender(m)
+	deltas.LoadRelations(m)
+	return m
 }
 
-func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
+func NewPostgresEventsTable(db *sql.DB, dbProperties *config.DatabaseOptions) (tables.Events, error) {
 	s := &eventStatements{}
 	_, err := db.Exec(eventsSchema)
 	if err != nil {
 		return nil, err
 	}
+	// The sender column is added by a migration, so it has to run before
+	// the statements using it are prepared. The relations migration also
+	// runs here so that all roomserver migrations share one version.
+	if err = Migrations().RunDeltas(db, dbProperties); err != nil {
+		return nil, err
+	}
 
 	return s, shared.StatementList{
 		{&s.insertEventStmt, insertEventSQL},
@@ -162,6 +188,8 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
+		{&s.selectRoomEventNIDsStmt, selectRoomEventNIDsSQL},
+		{&s.selectRoomEventNIDsBySenderStmt, selectRoomEventNIDsBySenderSQL},
 	}.Prepare(db)
 }
 
@@ -176,13 +204,14 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	sender string,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
 		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
-		isRejected,
+		isRejected, sender,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -439,6 +468,44 @@ func (s *eventStatements) SelectRoomNIDForEventNID(
 	return
 }
 
+func (s *eventStatements) SelectRoomEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRoomEventNIDsStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDs: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomEventNIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, sender string, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRoomEventNIDsBySenderStmt.QueryContext(ctx, int64(roomNID), sender, int64(afterEventNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomEventNIDsBySender: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
@@ -0,0 +1,146 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const publicationsSchema = `
+-- Stores who published which rooms in which room directories, so that
+-- publications can be audited. Rows are deleted when a room is unpublished.
+CREATE TABLE IF NOT EXISTS roomserver_publications (
+    -- The room ID of the published room
+    room_id TEXT NOT NULL,
+    -- The third party network ID, or empty for the server's own directory
+    network_id TEXT NOT NULL DEFAULT '',
+    -- The user who published the room, or empty for a server admin
+    user_id TEXT NOT NULL DEFAULT '',
+    -- When the room was published
+    published_ts BIGINT NOT NULL,
+    PRIMARY KEY (room_id, network_id)
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_publications_network_id_idx ON roomserver_publications(network_id);
+`
+
+const upsertPublicationSQL = "" +
+	"INSERT INTO roomserver_publications (room_id, network_id, user_id, published_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (room_id, network_id) DO UPDATE SET user_id = $3, published_ts = $4"
+
+const deletePublicationSQL = "" +
+	"DELETE FROM roomserver_publications WHERE room_id = $1 AND network_id = $2"
+
+const selectAllPublicationsSQL = "" +
+	"SELECT room_id, network_id, user_id, published_ts FROM roomserver_publications" +
+	" ORDER BY published_ts DESC"
+
+const selectNetworkRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM roomserver_publications WHERE network_id = $1"
+
+const selectAllNetworksRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM roomserver_publications WHERE network_id != ''"
+
+type publicationsStatements struct {
+	upsertPublicationStmt        *sql.Stmt
+	deletePublicationStmt        *sql.Stmt
+	selectAllPublicationsStmt    *sql.Stmt
+	selectNetworkRoomIDsStmt     *sql.Stmt
+	selectAllNetworksRoomIDsStmt *sql.Stmt
+}
+
+func NewPostgresPublicationsTable(db *sql.DB) (tables.Publications, error) {
+	s := &publicationsStatements{}
+	_, err := db.Exec(publicationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.upsertPublicationStmt, upsertPublicationSQL},
+		{&s.deletePublicationStmt, deletePublicationSQL},
+		{&s.selectAllPublicationsStmt, selectAllPublicationsSQL},
+		{&s.selectNetworkRoomIDsStmt, selectNetworkRoomIDsSQL},
+		{&s.selectAllNetworksRoomIDsStmt, selectAllNetworksRoomIDsSQL},
+	}.Prepare(db)
+}
+
+func (s *publicationsStatements) UpsertPublication(
+	ctx context.Context, txn *sql.Tx, info tables.PublicationInfo,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertPublicationStmt)
+	_, err := stmt.ExecContext(ctx, info.RoomID, info.NetworkID, info.UserID, info.PublishedTS)
+	return err
+}
+
+func (s *publicationsStatements) DeletePublication(
+	ctx context.Context, txn *sql.Tx, roomID, networkID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePublicationStmt)
+	_, err := stmt.ExecContext(ctx, roomID, networkID)
+	return err
+}
+
+func (s *publicationsStatements) SelectAllPublications(
+	ctx context.Context,
+) ([]tables.PublicationInfo, error) {
+	rows, err := s.selectAllPublicationsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAllPublicationsStmt: rows.close() failed")
+
+	var publications []tables.PublicationInfo
+	for rows.Next() {
+		var info tables.PublicationInfo
+		if err = rows.Scan(&info.RoomID, &info.NetworkID, &info.UserID, &info.PublishedTS); err != nil {
+			return nil, err
+		}
+		publications = append(publications, info)
+	}
+	return publications, rows.Err()
+}
+
+func (s *publicationsStatements) SelectNetworkRoomIDs(
+	ctx context.Context, networkID string,
+) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if networkID == "" {
+		rows, err = s.selectAllNetworksRoomIDsStmt.QueryContext(ctx)
+	} else {
+		rows, err = s.selectNetworkRoomIDsStmt.QueryContext(ctx, networkID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectNetworkRoomIDsStmt: rows.close() failed")
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const relationsSchema = `
+-- Stores which events relate to which other events through m.relates_to.
+CREATE TABLE IF NOT EXISTS roomserver_relations (
+    -- The numeric ID of the relating event
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The numeric ID of the room
+    room_nid BIGINT NOT NULL,
+    -- The ID of the event being related to
+    relates_to TEXT NOT NULL,
+    -- The relation type, e.g. m.annotation
+    rel_type TEXT NOT NULL,
+    -- The type of the relating event, e.g. m.reaction
+    event_type TEXT NOT NULL,
+    -- The sender of the relating event
+    sender TEXT NOT NULL,
+    -- The aggregation key for annotations
+    aggregation_key TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_relations_relates_to_idx ON roomserver_relations(relates_to, rel_type);
+CREATE INDEX IF NOT EXISTS roomserver_relations_room_nid_idx ON roomserver_relations(room_nid, rel_type);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO roomserver_relations (event_nid, room_nid, relates_to, rel_type, event_type, sender, aggregation_key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (event_nid) DO NOTHING"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM roomserver_relations WHERE event_nid = $1"
+
+const selectRelationsSQL = "" +
+	"SELECT event_nid FROM roomserver_relations" +
+	" WHERE room_nid = $1 AND relates_to = $2 AND ($3 = '' OR rel_type = $3) AND ($4 = '' OR event_type = $4)" +
+	" AND event_nid < $5 ORDER BY event_nid DESC LIMIT $6"
+
+const selectRelationsByTypeSQL = "" +
+	"SELECT event_nid, relates_to, rel_type, event_type, sender, aggregation_key FROM roomserver_relations" +
+	" WHERE room_nid = $1 AND relates_to = $2 AND rel_type = $3 ORDER BY event_nid ASC"
+
+const selectLatestRelationBySenderSQL = "" +
+	"SELECT event_nid FROM roomserver_relations" +
+	" WHERE room_nid = $1 AND relates_to = $2 AND rel_type = $3 AND sender = $4" +
+	" ORDER BY event_nid DESC LIMIT 1"
+
+// Thread roots are ordered by their most recent reply, so that the most
+// active threads come first.
+const selectThreadRootsSQL = "" +
+	"SELECT relates_to, MAX(event_nid) AS latest_nid FROM roomserver_relations" +
+	" WHERE room_nid = $1 AND rel_type = 'm.thread'" +
+	" GROUP BY relates_to HAVING MAX(event_nid) < $2 ORDER BY latest_nid DESC LIMIT $3"
+
+type relationsStatements struct {
+	insertRelationStmt        *sql.Stmt
+	deleteRelationStmt        *sql.Stmt
+	selectRelationsStmt       *sql.Stmt
+	selectRelationsByTypeStmt *sql.Stmt
+	selectThreadRootsStmt     *sql.Stmt
+	selectLatestBySenderStmt  *sql.Stmt
+}
+
+func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
+	s := &relationsStatements{}
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertRelationStmt, insertRelationSQL},
+		{&s.deleteRelationStmt, deleteRelationSQL},
+		{&s.selectRelationsStmt, selectRelationsSQL},
+		{&s.selectRelationsByTypeStmt, selectRelationsByTypeSQL},
+		{&s.selectThreadRootsStmt, selectThreadRootsSQL},
+		{&s.selectLatestBySenderStmt, selectLatestRelationBySenderSQL},
+	}.Prepare(db)
+}
+
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, info tables.RelationInfo,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRelationStmt)
+	_, err := stmt.ExecContext(
+		ctx, info.EventNID, roomNID, info.RelatesTo, info.RelType, info.EventType, info.Sender, info.Key,
+	)
+	return err
+}
+
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRelationStmt)
+	_, err := stmt.ExecContext(ctx, eventNID)
+	return err
+}
+
+func (s *relationsStatements) SelectRelations(
+	ctx context.Context, roomNID types.RoomNID, relatesTo, relType, eventType string,
+	before types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := s.selectRelationsStmt.QueryContext(ctx, roomNID, relatesTo, relType, eventType, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsStmt: rows.close() failed")
+
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID types.EventNID
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *relationsStatements) SelectRelationsByType(
+	ctx context.Context, roomNID types.RoomNID, relatesTo, relType string,
+) ([]tables.RelationInfo, error) {
+	rows, err := s.selectRelationsByTypeStmt.QueryContext(ctx, roomNID, relatesTo, relType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsByTypeStmt: rows.close() failed")
+
+	var relations []tables.RelationInfo
+	for rows.Next() {
+		var info tables.RelationInfo
+		if err = rows.Scan(
+			&info.EventNID, &info.RelatesTo, &info.RelType, &info.EventType, &info.Sender, &info.Key,
+		); err != nil {
+			return nil, err
+		}
+		relations = append(relations, info)
+	}
+	return relations, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreadRoots(
+	ctx context.Context, roomNID types.RoomNID, before types.EventNID, limit int,
+) ([]tables.ThreadRoot, error) {
+	rows, err := s.selectThreadRootsStmt.QueryContext(ctx, roomNID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreadRootsStmt: rows.close() failed")
+
+	var roots []tables.ThreadRoot
+	for rows.Next() {
+		var root tables.ThreadRoot
+		if err = rows.Scan(&root.EventID, &root.LatestEventNID); err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, rows.Err()
+}
+
+func (s *relationsStatements) SelectLatestRelationBySender(
+	ctx context.Context, roomNID types.RoomNID, relatesTo, relType, sender string,
+) (types.EventNID, error) {
+	var eventNID types.EventNID
+	err := s.selectLatestBySenderStmt.QueryRowContext(ctx, roomNID, relatesTo, relType, sender).Scan(&eventNID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return eventNID, err
+}
@@ -78,6 +78,9 @@ const selectRoomInfoSQL = "" +
 const selectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms"
 
+const selectRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_rooms"
+
 const bulkSelectRoomIDsSQL = "" +
 	"SELECT room_id FROM roomserver_rooms WHERE room_nid = ANY($1)"
 
@@ -92,6 +95,7 @@ type roomStatements struct {
 	updateLatestEventNIDsStmt          *sql.Stmt
 	selectRoomVersionForRoomNIDStmt    *sql.Stmt
 	selectRoomInfoStmt                 *sql.Stmt
+	selectRoomCountStmt                *sql.Stmt
 	selectRoomIDsStmt                  *sql.Stmt
 	bulkSelectRoomIDsStmt              *sql.Stmt
 	bulkSelectRoomNIDsStmt             *sql.Stmt
@@ -112,11 +116,17 @@ func NewPostgresRoomsTable(db *sql.DB) (tables.Rooms, error) {
 		{&s.selectRoomVersionForRoomNIDStmt, selectRoomVersionForRoomNIDSQL},
 		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
 		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+		{&s.selectRoomCountStmt, selectRoomCountSQL},
 		{&s.bulkSelectRoomIDsStmt, bulkSelectRoomIDsSQL},
 		{&s.bulkSelectRoomNIDsStmt, bulkSelectRoomNIDsSQL},
 	}.Prepare(db)
 }
 
+func (s *roomStatements) SelectRoomCount(ctx context.Context) (count int, err error) {
+	err = s.selectRoomCountStmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
 func (s *roomStatements) SelectRoomIDs(ctx context.Context) ([]string, error) {
 	rows, err := s.selectRoomIDsStmt.QueryContext(ctx)
 	if err != nil {
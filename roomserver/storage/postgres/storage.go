@@ -38,7 +38,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	var d Database
 	var db *sql.DB
 	var err error
-	if db, err = sqlutil.Open(dbProperties); err != nil {
+	if db, err = sqlutil.OpenNamed("roomserver", dbProperties); err != nil {
 		return nil, err
 	}
 	eventStateKeys, err := NewPostgresEventStateKeysTable(db)
@@ -53,7 +53,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err != nil {
 		return nil, err
 	}
-	events, err := NewPostgresEventsTable(db)
+	events, err := NewPostgresEventsTable(db, dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -97,24 +97,39 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err != nil {
 		return nil, err
 	}
+	publications, err := NewPostgresPublicationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := NewPostgresRelationsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	insertionEvents, err := NewPostgresInsertionEventsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
-		DB:                  db,
-		Cache:               cache,
-		Writer:              sqlutil.NewDummyWriter(),
-		EventTypesTable:     eventTypes,
-		EventStateKeysTable: eventStateKeys,
-		EventJSONTable:      eventJSON,
-		EventsTable:         events,
-		RoomsTable:          rooms,
-		TransactionsTable:   transactions,
-		StateBlockTable:     stateBlock,
-		StateSnapshotTable:  stateSnapshot,
-		PrevEventsTable:     prevEvents,
-		RoomAliasesTable:    roomAliases,
-		InvitesTable:        invites,
-		MembershipTable:     membership,
-		PublishedTable:      published,
-		RedactionsTable:     redactions,
+		DB:                   db,
+		Cache:                cache,
+		Writer:               sqlutil.NewDummyWriter(),
+		EventTypesTable:      eventTypes,
+		EventStateKeysTable:  eventStateKeys,
+		EventJSONTable:       eventJSON,
+		EventsTable:          events,
+		RoomsTable:           rooms,
+		TransactionsTable:    transactions,
+		StateBlockTable:      stateBlock,
+		StateSnapshotTable:   stateSnapshot,
+		PrevEventsTable:      prevEvents,
+		RoomAliasesTable:     roomAliases,
+		InvitesTable:         invites,
+		MembershipTable:      membership,
+		PublishedTable:       published,
+		PublicationsTable:    publications,
+		RedactionsTable:      redactions,
+		RelationsTable:       relations,
+		InsertionEventsTable: insertionEvents,
 	}
 	return &d, nil
 }
@@ -80,6 +80,20 @@ func (u *LatestEventsUpdater) StorePreviousEvents(eventNID types.EventNID, previ
 	return nil
 }
 
+// StoreDeferredPreviousEvents records that an event stored with
+// StoreEventWithoutPreviousEvents references its prev events, as part of
+// this transaction.
+func (u *LatestEventsUpdater) StoreDeferredPreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
+	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+		for _, ref := range previousEventReferences {
+			if err := u.d.PrevEventsTable.InsertPreviousEvent(u.ctx, txn, ref.EventID, ref.EventSHA256, eventNID); err != nil {
+				return fmt.Errorf("u.d.PrevEventsTable.InsertPreviousEvent: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
 // IsReferenced implements types.RoomRecentEventsUpdater
 func (u *LatestEventsUpdater) IsReferenced(eventReference gomatrixserverlib.EventReference) (bool, error) {
 	err := u.d.PrevEventsTable.SelectPreviousEventExists(u.ctx, u.txn, eventReference.EventID, eventReference.EventSHA256)
@@ -101,12 +115,25 @@ func (u *LatestEventsUpdater) SetLatestEvents(
 	for i := range latest {
 		eventNIDs[i] = latest[i].EventNID
 	}
-	return u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
+	err := u.d.Writer.Do(u.d.DB, u.txn, func(txn *sql.Tx) error {
 		if err := u.d.RoomsTable.UpdateLatestEventNIDs(u.ctx, txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID); err != nil {
 			return fmt.Errorf("u.d.RoomsTable.updateLatestEventNIDs: %w", err)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	// Keep track of the changes so that the updater can be used to update
+	// the latest events for more than one event in the same transaction.
+	if lastEventNIDSent != 0 {
+		if u.lastEventIDSent, err = u.d.EventsTable.SelectEventID(u.ctx, u.txn, lastEventNIDSent); err != nil {
+			return fmt.Errorf("u.d.EventsTable.SelectEventID: %w", err)
+		}
+	}
+	u.latestEvents = latest
+	u.currentStateSnapshotNID = currentStateSnapshotNID
+	return nil
 }
 
 // HasEventBeenSent implements types.RoomRecentEventsUpdater
@@ -3,15 +3,16 @@ package shared
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/tidwall/gjson"
@@ -27,23 +28,26 @@ import (
 const redactionsArePermanent = true
 
 type Database struct {
-	DB                  *sql.DB
-	Cache               caching.RoomServerCaches
-	Writer              sqlutil.Writer
-	EventsTable         tables.Events
-	EventJSONTable      tables.EventJSON
-	EventTypesTable     tables.EventTypes
-	EventStateKeysTable tables.EventStateKeys
-	RoomsTable          tables.Rooms
-	TransactionsTable   tables.Transactions
-	StateSnapshotTable  tables.StateSnapshot
-	StateBlockTable     tables.StateBlock
-	RoomAliasesTable    tables.RoomAliases
-	PrevEventsTable     tables.PreviousEvents
-	InvitesTable        tables.Invites
-	MembershipTable     tables.Membership
-	PublishedTable      tables.Published
-	RedactionsTable     tables.Redactions
+	DB                   *sql.DB
+	Cache                caching.RoomServerCaches
+	Writer               sqlutil.Writer
+	EventsTable          tables.Events
+	EventJSONTable       tables.EventJSON
+	EventTypesTable      tables.EventTypes
+	EventStateKeysTable  tables.EventStateKeys
+	RoomsTable           tables.Rooms
+	TransactionsTable    tables.Transactions
+	StateSnapshotTable   tables.StateSnapshot
+	StateBlockTable      tables.StateBlock
+	RoomAliasesTable     tables.RoomAliases
+	PrevEventsTable      tables.PreviousEvents
+	InvitesTable         tables.Invites
+	MembershipTable      tables.Membership
+	PublishedTable       tables.Published
+	RedactionsTable      tables.Redactions
+	RelationsTable       tables.Relations
+	InsertionEventsTable tables.InsertionEvents
+	PublicationsTable    tables.Publications
 }
 
 func (d *Database) SupportsConcurrentRoomInputs() bool {
@@ -180,6 +184,20 @@ func (d *Database) SnapshotNIDFromEventID(
 	return stateNID, err
 }
 
+func (d *Database) SnapshotNIDsFromEventNIDs(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]types.StateSnapshotNID, error) {
+	states, err := d.EventsTable.BulkSelectStateAtEventAndReference(ctx, nil, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.EventNID]types.StateSnapshotNID, len(states))
+	for _, state := range states {
+		result[state.EventNID] = state.BeforeStateSnapshotNID
+	}
+	return result, nil
+}
+
 func (d *Database) EventIDs(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) (map[types.EventNID]string, error) {
@@ -303,6 +321,67 @@ func (d *Database) GetInvitesForUser(
 	return d.InvitesTable.SelectInviteActiveForUserInRoom(ctx, targetUserNID, roomNID)
 }
 
+func (d *Database) RoomEventNIDs(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDs(ctx, roomNID, afterEventNID, limit)
+}
+
+func (d *Database) RoomEventNIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, sender string, afterEventNID types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDsBySender(ctx, roomNID, sender, afterEventNID, limit)
+}
+
+func (d *Database) PurgeEvents(
+	ctx context.Context, events []types.Event,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, event := range events {
+			redacted := event.Redact()
+			if err := d.EventJSONTable.InsertEventJSON(ctx, txn, event.EventNID, redacted.JSON()); err != nil {
+				return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+			}
+			// a purged event no longer relates to anything, so stop aggregating it
+			if err := d.RelationsTable.DeleteRelation(ctx, txn, event.EventNID); err != nil {
+				return fmt.Errorf("d.RelationsTable.DeleteRelation: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) Relations(
+	ctx context.Context, roomNID types.RoomNID, eventID, relType, eventType string,
+	before types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	return d.RelationsTable.SelectRelations(ctx, roomNID, eventID, relType, eventType, before, limit)
+}
+
+func (d *Database) RelationsByType(
+	ctx context.Context, roomNID types.RoomNID, eventID, relType string,
+) ([]tables.RelationInfo, error) {
+	return d.RelationsTable.SelectRelationsByType(ctx, roomNID, eventID, relType)
+}
+
+func (d *Database) ThreadRoots(
+	ctx context.Context, roomNID types.RoomNID, before types.EventNID, limit int,
+) ([]tables.ThreadRoot, error) {
+	return d.RelationsTable.SelectThreadRoots(ctx, roomNID, before, limit)
+}
+
+func (d *Database) LatestRelationBySender(
+	ctx context.Context, roomNID types.RoomNID, eventID, relType, sender string,
+) (types.EventNID, error) {
+	return d.RelationsTable.SelectLatestRelationBySender(ctx, roomNID, eventID, relType, sender)
+}
+
+func (d *Database) InsertionEventNID(
+	ctx context.Context, roomNID types.RoomNID, nextBatchID string,
+) (types.EventNID, error) {
+	return d.InsertionEventsTable.SelectInsertionEventNID(ctx, roomNID, nextBatchID)
+}
+
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) ([]types.Event, error) {
@@ -384,11 +463,143 @@ func (d *Database) GetLatestEventsForUpdate(
 	return updater, err
 }
 
-// nolint:gocyclo
 func (d *Database) StoreEvent(
 	ctx context.Context, event gomatrixserverlib.Event,
 	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
 ) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	stored, err := d.storeSingleEvent(ctx, event, txnAndSessionID, authEventNIDs, isRejected)
+	if err != nil {
+		return 0, types.StateAtEvent{}, nil, "", err
+	}
+
+	if err = d.storePreviousEvents(ctx, event.RoomID(), []storedEvent{stored}); err != nil {
+		return 0, types.StateAtEvent{}, nil, "", err
+	}
+
+	return stored.roomNID, stored.stateAtEvent, stored.redactionEvent, stored.redactedEventID, nil
+}
+
+// StoreEventWithoutPreviousEvents stores the event like StoreEvent, but
+// doesn't record that the event references its prev events. The caller must
+// do that with LatestEventsUpdater.StoreDeferredPreviousEvents, so that the
+// event doesn't stop earlier events from becoming forward extremities before
+// the latest events have been updated for them.
+func (d *Database) StoreEventWithoutPreviousEvents(
+	ctx context.Context, event gomatrixserverlib.Event,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
+) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	stored, err := d.storeSingleEvent(ctx, event, txnAndSessionID, authEventNIDs, isRejected)
+	if err != nil {
+		return 0, types.StateAtEvent{}, nil, "", err
+	}
+	return stored.roomNID, stored.stateAtEvent, stored.redactionEvent, stored.redactedEventID, nil
+}
+
+func (d *Database) storeSingleEvent(
+	ctx context.Context, event gomatrixserverlib.Event,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
+) (storedEvent, error) {
+	var stored storedEvent
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		var err error
+		stored, err = d.storeEvent(ctx, txn, event, txnAndSessionID, authEventNIDs, isRejected)
+		return err
+	})
+	if err != nil {
+		return storedEvent{}, fmt.Errorf("d.Writer.Do: %w", err)
+	}
+	return stored, nil
+}
+
+// StoreEvents stores a batch of events in a single transaction, in the
+// order given. Auth event IDs are resolved to numeric IDs, including
+// against events earlier in the same batch. If any event in the batch
+// fails to be stored then the transaction is rolled back and none of
+// the events are stored. Returns any redactions which were completed by
+// storing the batch.
+func (d *Database) StoreEvents(
+	ctx context.Context, events []gomatrixserverlib.Event, authEventIDs [][]string, isRejected []bool,
+) ([]types.StateAtEvent, []types.Redaction, error) {
+	if len(events) != len(authEventIDs) || len(events) != len(isRejected) {
+		return nil, nil, fmt.Errorf("mismatched batch lengths")
+	}
+	// Look up the numeric IDs for any auth events which we already have
+	// before starting the transaction.
+	var lookup []string
+	for _, ids := range authEventIDs {
+		lookup = append(lookup, ids...)
+	}
+	eventNIDs, err := d.EventsTable.BulkSelectEventNID(ctx, lookup)
+	if err != nil {
+		return nil, nil, fmt.Errorf("d.EventsTable.BulkSelectEventNID: %w", err)
+	}
+
+	stored := make([]storedEvent, len(events))
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for i := range events {
+			authEventNIDs := make([]types.EventNID, 0, len(authEventIDs[i]))
+			for _, authEventID := range authEventIDs[i] {
+				nid, ok := eventNIDs[authEventID]
+				if !ok {
+					return types.MissingEventError(
+						fmt.Sprintf("missing auth event %q for event %q", authEventID, events[i].EventID()),
+					)
+				}
+				authEventNIDs = append(authEventNIDs, nid)
+			}
+			var serr error
+			stored[i], serr = d.storeEvent(ctx, txn, events[i], nil, authEventNIDs, isRejected[i])
+			if serr != nil {
+				return fmt.Errorf("d.storeEvent (%s): %w", events[i].EventID(), serr)
+			}
+			eventNIDs[events[i].EventID()] = stored[i].stateAtEvent.EventNID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("d.Writer.Do: %w", err)
+	}
+
+	// Store the prev events for each room using a single updater per room.
+	byRoom := make(map[string][]storedEvent)
+	for i := range events {
+		byRoom[events[i].RoomID()] = append(byRoom[events[i].RoomID()], stored[i])
+	}
+	for roomID, roomEvents := range byRoom {
+		if err = d.storePreviousEvents(ctx, roomID, roomEvents); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	result := make([]types.StateAtEvent, len(stored))
+	var redactions []types.Redaction
+	for i := range stored {
+		result[i] = stored[i].stateAtEvent
+		if stored[i].redactedEventID != "" {
+			redactions = append(redactions, types.Redaction{
+				RedactionEvent:  stored[i].redactionEvent,
+				RedactedEventID: stored[i].redactedEventID,
+			})
+		}
+	}
+	return result, redactions, nil
+}
+
+// storedEvent contains the outcome of storing a single event.
+type storedEvent struct {
+	event           gomatrixserverlib.Event
+	roomNID         types.RoomNID
+	stateAtEvent    types.StateAtEvent
+	redactionEvent  *gomatrixserverlib.Event
+	redactedEventID string
+}
+
+// storeEvent stores a single event using the given transaction.
+// nolint:gocyclo
+func (d *Database) storeEvent(
+	ctx context.Context, txn *sql.Tx, event gomatrixserverlib.Event,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
+) (storedEvent, error) {
 	var (
 		roomNID          types.RoomNID
 		eventTypeNID     types.EventTypeNID
@@ -400,142 +611,191 @@ func (d *Database) StoreEvent(
 		err              error
 	)
 
-	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if txnAndSessionID != nil {
-			if err = d.TransactionsTable.InsertTransaction(
-				ctx, txn, txnAndSessionID.TransactionID,
-				txnAndSessionID.SessionID, event.Sender(), event.EventID(),
-			); err != nil {
-				return fmt.Errorf("d.TransactionsTable.InsertTransaction: %w", err)
-			}
+	if txnAndSessionID != nil {
+		if err = d.TransactionsTable.InsertTransaction(
+			ctx, txn, txnAndSessionID.TransactionID,
+			txnAndSessionID.SessionID, event.Sender(), event.EventID(),
+		); err != nil {
+			return storedEvent{}, fmt.Errorf("d.TransactionsTable.InsertTransaction: %w", err)
 		}
+	}
 
-		// TODO: Here we should aim to have two different code paths for new rooms
-		// vs existing ones.
+	// TODO: Here we should aim to have two different code paths for new rooms
+	// vs existing ones.
 
-		// Get the default room version. If the client doesn't supply a room_version
-		// then we will use our configured default to create the room.
-		// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
-		// Note that the below logic depends on the m.room.create event being the
-		// first event that is persisted to the database when creating or joining a
-		// room.
-		var roomVersion gomatrixserverlib.RoomVersion
-		if roomVersion, err = extractRoomVersionFromCreateEvent(event); err != nil {
-			return fmt.Errorf("extractRoomVersionFromCreateEvent: %w", err)
+	// Get the default room version. If the client doesn't supply a room_version
+	// then we will use our configured default to create the room.
+	// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-createroom
+	// Note that the below logic depends on the m.room.create event being the
+	// first event that is persisted to the database when creating or joining a
+	// room.
+	var roomVersion gomatrixserverlib.RoomVersion
+	if event.Type() == gomatrixserverlib.MRoomCreate {
+		if roomVersion, err = version.CreateEventRoomVersion(&event); err != nil {
+			return storedEvent{}, fmt.Errorf("version.CreateEventRoomVersion: %w", err)
 		}
+	}
 
-		if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
-			return fmt.Errorf("d.assignRoomNID: %w", err)
-		}
+	if roomNID, err = d.assignRoomNID(ctx, txn, event.RoomID(), roomVersion); err != nil {
+		return storedEvent{}, fmt.Errorf("d.assignRoomNID: %w", err)
+	}
+
+	if eventTypeNID, err = d.assignEventTypeNID(ctx, txn, event.Type()); err != nil {
+		return storedEvent{}, fmt.Errorf("d.assignEventTypeNID: %w", err)
+	}
 
-		if eventTypeNID, err = d.assignEventTypeNID(ctx, txn, event.Type()); err != nil {
-			return fmt.Errorf("d.assignEventTypeNID: %w", err)
+	eventStateKey := event.StateKey()
+	// Assigned a numeric ID for the state_key if there is one present.
+	// Otherwise set the numeric ID for the state_key to 0.
+	if eventStateKey != nil {
+		if eventStateKeyNID, err = d.assignStateKeyNID(ctx, txn, *eventStateKey); err != nil {
+			return storedEvent{}, fmt.Errorf("d.assignStateKeyNID: %w", err)
 		}
+	}
 
-		eventStateKey := event.StateKey()
-		// Assigned a numeric ID for the state_key if there is one present.
-		// Otherwise set the numeric ID for the state_key to 0.
-		if eventStateKey != nil {
-			if eventStateKeyNID, err = d.assignStateKeyNID(ctx, txn, *eventStateKey); err != nil {
-				return fmt.Errorf("d.assignStateKeyNID: %w", err)
-			}
+	if eventNID, stateNID, err = d.EventsTable.InsertEvent(
+		ctx,
+		txn,
+		roomNID,
+		eventTypeNID,
+		eventStateKeyNID,
+		event.EventID(),
+		event.EventReference().EventSHA256,
+		authEventNIDs,
+		event.Depth(),
+		isRejected,
+		event.Sender(),
+	); err != nil {
+		if err == sql.ErrNoRows {
+			// We've already inserted the event so select the numeric event ID
+			eventNID, stateNID, err = d.EventsTable.SelectEvent(ctx, txn, event.EventID())
+		}
+		if err != nil {
+			return storedEvent{}, fmt.Errorf("d.EventsTable.SelectEvent: %w", err)
 		}
+	}
 
-		if eventNID, stateNID, err = d.EventsTable.InsertEvent(
-			ctx,
-			txn,
-			roomNID,
-			eventTypeNID,
-			eventStateKeyNID,
-			event.EventID(),
-			event.EventReference().EventSHA256,
-			authEventNIDs,
-			event.Depth(),
-			isRejected,
-		); err != nil {
-			if err == sql.ErrNoRows {
-				// We've already inserted the event so select the numeric event ID
-				eventNID, stateNID, err = d.EventsTable.SelectEvent(ctx, txn, event.EventID())
+	if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+		return storedEvent{}, fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+	}
+	if !isRejected { // ignore rejected redaction events
+		redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
+		if err != nil {
+			return storedEvent{}, fmt.Errorf("d.handleRedactions: %w", err)
+		}
+		if relation := extractRelation(eventNID, event); relation != nil {
+			if err = d.RelationsTable.InsertRelation(ctx, txn, roomNID, *relation); err != nil {
+				return storedEvent{}, fmt.Errorf("d.RelationsTable.InsertRelation: %w", err)
 			}
-			if err != nil {
-				return fmt.Errorf("d.EventsTable.SelectEvent: %w", err)
+		}
+		if nextBatchID := extractNextBatchID(event); nextBatchID != "" {
+			if err = d.InsertionEventsTable.InsertInsertionEvent(ctx, txn, roomNID, eventNID, nextBatchID); err != nil {
+				return storedEvent{}, fmt.Errorf("d.InsertionEventsTable.InsertInsertionEvent: %w", err)
 			}
 		}
+	}
 
-		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
-			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
-		}
-		if !isRejected { // ignore rejected redaction events
-			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
-			if err != nil {
-				return fmt.Errorf("d.handleRedactions: %w", err)
-			}
+	return storedEvent{
+		event:   event,
+		roomNID: roomNID,
+		stateAtEvent: types.StateAtEvent{
+			BeforeStateSnapshotNID: stateNID,
+			StateEntry: types.StateEntry{
+				StateKeyTuple: types.StateKeyTuple{
+					EventTypeNID:     eventTypeNID,
+					EventStateKeyNID: eventStateKeyNID,
+				},
+				EventNID: eventNID,
+			},
+		},
+		redactionEvent:  redactionEvent,
+		redactedEventID: redactedEventID,
+	}, nil
+}
+
+// storePreviousEvents updates the previous events table with any references
+// that the given events, which must all be in the same room, make.
+func (d *Database) storePreviousEvents(
+	ctx context.Context, roomID string, events []storedEvent,
+) error {
+	hasPrevEvents := false
+	for _, e := range events {
+		if len(e.event.PrevEvents()) > 0 {
+			hasPrevEvents = true
+			break
 		}
+	}
+	if !hasPrevEvents {
 		return nil
-	})
-	if err != nil {
-		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.Writer.Do: %w", err)
 	}
 
 	// We should attempt to update the previous events table with any
-	// references that this new event makes. We do this using a latest
+	// references that these new events make. We do this using a latest
 	// events updater because it somewhat works as a mutex, ensuring
 	// that there's a row-level lock on the latest room events (well,
 	// on Postgres at least).
-	var roomInfo *types.RoomInfo
-	var updater *LatestEventsUpdater
-	if prevEvents := event.PrevEvents(); len(prevEvents) > 0 {
-		roomInfo, err = d.RoomInfo(ctx, event.RoomID())
-		if err != nil {
-			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.RoomInfo: %w", err)
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return fmt.Errorf("expected room %q to exist", roomID)
+	}
+	// Create an updater - NB: on sqlite this WILL create a txn as we are directly calling the shared DB form of
+	// GetLatestEventsForUpdate - not via the SQLiteDatabase form which has `nil` txns. This
+	// function only does SELECTs though so the created txn (at this point) is just a read txn like
+	// any other so this is fine. If we ever update GetLatestEventsForUpdate or NewLatestEventsUpdater
+	// to do writes however then this will need to go inside `Writer.Do`.
+	updater, err := d.GetLatestEventsForUpdate(ctx, *roomInfo)
+	if err != nil {
+		return fmt.Errorf("NewLatestEventsUpdater: %w", err)
+	}
+	// Ensure that we atomically store prev events AND commit them. If we don't wrap StorePreviousEvents
+	// and EndTransaction in a writer then it's possible for a new write txn to be made between the two
+	// function calls which will then fail with 'database is locked'. This new write txn would HAVE to be
+	// something like SetRoomAlias/RemoveRoomAlias as normal input events are already done sequentially due to
+	// SupportsConcurrentRoomInputs() == false on sqlite, though this does not apply to setting room aliases
+	// as they don't go via InputRoomEvents
+	return d.Writer.Do(d.DB, updater.txn, func(txn *sql.Tx) (err error) {
+		succeeded := false
+		defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+		for _, e := range events {
+			if prevEvents := e.event.PrevEvents(); len(prevEvents) > 0 {
+				if err = updater.StorePreviousEvents(e.stateAtEvent.EventNID, prevEvents); err != nil {
+					return fmt.Errorf("updater.StorePreviousEvents: %w", err)
+				}
+			}
 		}
-		if roomInfo == nil && len(prevEvents) > 0 {
-			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("expected room %q to exist", event.RoomID())
+		succeeded = true
+		return nil
+	})
+}
+
+func (d *Database) PublishRoom(ctx context.Context, roomID, networkID, userID string, publish bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if networkID == "" {
+			if err := d.PublishedTable.UpsertRoomPublished(ctx, txn, roomID, publish); err != nil {
+				return err
+			}
 		}
-		// Create an updater - NB: on sqlite this WILL create a txn as we are directly calling the shared DB form of
-		// GetLatestEventsForUpdate - not via the SQLiteDatabase form which has `nil` txns. This
-		// function only does SELECTs though so the created txn (at this point) is just a read txn like
-		// any other so this is fine. If we ever update GetLatestEventsForUpdate or NewLatestEventsUpdater
-		// to do writes however then this will need to go inside `Writer.Do`.
-		updater, err = d.GetLatestEventsForUpdate(ctx, *roomInfo)
-		if err != nil {
-			return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("NewLatestEventsUpdater: %w", err)
+		if !publish {
+			return d.PublicationsTable.DeletePublication(ctx, txn, roomID, networkID)
 		}
-		// Ensure that we atomically store prev events AND commit them. If we don't wrap StorePreviousEvents
-		// and EndTransaction in a writer then it's possible for a new write txn to be made between the two
-		// function calls which will then fail with 'database is locked'. This new write txn would HAVE to be
-		// something like SetRoomAlias/RemoveRoomAlias as normal input events are already done sequentially due to
-		// SupportsConcurrentRoomInputs() == false on sqlite, though this does not apply to setting room aliases
-		// as they don't go via InputRoomEvents
-		err = d.Writer.Do(d.DB, updater.txn, func(txn *sql.Tx) error {
-			if err = updater.StorePreviousEvents(eventNID, prevEvents); err != nil {
-				return fmt.Errorf("updater.StorePreviousEvents: %w", err)
-			}
-			succeeded := true
-			err = sqlutil.EndTransaction(updater, &succeeded)
-			return err
+		return d.PublicationsTable.UpsertPublication(ctx, txn, tables.PublicationInfo{
+			RoomID:      roomID,
+			NetworkID:   networkID,
+			UserID:      userID,
+			PublishedTS: gomatrixserverlib.AsTimestamp(time.Now()),
 		})
-		if err != nil {
-			return 0, types.StateAtEvent{}, nil, "", err
-		}
-	}
+	})
+}
 
-	return roomNID, types.StateAtEvent{
-		BeforeStateSnapshotNID: stateNID,
-		StateEntry: types.StateEntry{
-			StateKeyTuple: types.StateKeyTuple{
-				EventTypeNID:     eventTypeNID,
-				EventStateKeyNID: eventStateKeyNID,
-			},
-			EventNID: eventNID,
-		},
-	}, redactionEvent, redactedEventID, err
+func (d *Database) GetPublications(ctx context.Context) ([]tables.PublicationInfo, error) {
+	return d.PublicationsTable.SelectAllPublications(ctx)
 }
 
-func (d *Database) PublishRoom(ctx context.Context, roomID string, publish bool) error {
-	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.PublishedTable.UpsertRoomPublished(ctx, txn, roomID, publish)
-	})
+func (d *Database) GetPublishedNetworkRooms(ctx context.Context, networkID string) ([]string, error) {
+	return d.PublicationsTable.SelectNetworkRoomIDs(ctx, networkID)
 }
 
 func (d *Database) GetPublishedRooms(ctx context.Context) ([]string, error) {
@@ -609,29 +869,6 @@ func (d *Database) assignStateKeyNID(
 	return eventStateKeyNID, err
 }
 
-func extractRoomVersionFromCreateEvent(event gomatrixserverlib.Event) (
-	gomatrixserverlib.RoomVersion, error,
-) {
-	var err error
-	var roomVersion gomatrixserverlib.RoomVersion
-	// Look for m.room.create events.
-	if event.Type() != gomatrixserverlib.MRoomCreate {
-		return gomatrixserverlib.RoomVersion(""), nil
-	}
-	roomVersion = gomatrixserverlib.RoomVersionV1
-	var createContent gomatrixserverlib.CreateContent
-	// The m.room.create event contains an optional "room_version" key in
-	// the event content, so we need to unmarshal that first.
-	if err = json.Unmarshal(event.Content(), &createContent); err != nil {
-		return gomatrixserverlib.RoomVersion(""), err
-	}
-	// A room version was specified in the event content?
-	if createContent.RoomVersion != nil {
-		roomVersion = gomatrixserverlib.RoomVersion(*createContent.RoomVersion)
-	}
-	return roomVersion, err
-}
-
 // handleRedactions manages the redacted status of events. There's two cases to consider in order to comply with the spec:
 // "servers should not apply or send redactions to clients until both the redaction event and original event have been seen, and are valid."
 // https://matrix.org/docs/spec/rooms/v3#authorization-rules-for-events
@@ -695,6 +932,10 @@ func (d *Database) handleRedactions(
 	if err != nil {
 		return nil, "", fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
 	}
+	// a redacted event no longer relates to anything, so stop aggregating it
+	if err = d.RelationsTable.DeleteRelation(ctx, txn, redactedEvent.EventNID); err != nil {
+		return nil, "", fmt.Errorf("d.RelationsTable.DeleteRelation: %w", err)
+	}
 
 	err = d.RedactionsTable.MarkRedactionValidated(ctx, txn, redactionEvent.EventID(), true)
 	if err != nil {
@@ -704,6 +945,33 @@ func (d *Database) handleRedactions(
 	return &redactionEvent.Event, redactedEvent.EventID(), err
 }
 
+// extractRelation returns the relation described by the "m.relates_to" content
+// of the given event, or nil if the event doesn't relate to another event.
+func extractRelation(eventNID types.EventNID, event gomatrixserverlib.Event) *tables.RelationInfo {
+	relatesTo := gjson.GetBytes(event.Content(), `m\.relates_to`)
+	relType, relatesToID := relatesTo.Get("rel_type").Str, relatesTo.Get("event_id").Str
+	if relType == "" || relatesToID == "" || event.StateKey() != nil {
+		return nil
+	}
+	return &tables.RelationInfo{
+		EventNID:  eventNID,
+		RelatesTo: relatesToID,
+		RelType:   relType,
+		EventType: event.Type(),
+		Sender:    event.Sender(),
+		Key:       relatesTo.Get("key").Str,
+	}
+}
+
+// extractNextBatchID returns the batch ID which the event accepts if it is an
+// MSC2716 insertion event, or an empty string otherwise.
+func extractNextBatchID(event gomatrixserverlib.Event) string {
+	if event.Type() != "org.matrix.msc2716.insertion" || event.StateKey() != nil {
+		return ""
+	}
+	return gjson.GetBytes(event.Content(), `org\.matrix\.msc2716\.next_batch_id`).Str
+}
+
 // loadRedactionPair returns both the redaction event and the redacted event, else nil.
 func (d *Database) loadRedactionPair(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, event gomatrixserverlib.Event,
@@ -820,6 +1088,39 @@ func (d *Database) GetStateEvent(ctx context.Context, roomID, evType, stateKey s
 	return nil, nil
 }
 
+// GetJoinedRoomCount returns the number of rooms that the user is joined to.
+func (d *Database) GetJoinedRoomCount(ctx context.Context, userID string) (int, error) {
+	stateKeyNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("GetJoinedRoomCount: cannot map user ID to state key NID: %w", err)
+	}
+	return d.MembershipTable.SelectJoinedRoomCount(ctx, stateKeyNID)
+}
+
+// GetRoomCount returns the number of rooms known to the roomserver.
+func (d *Database) GetRoomCount(ctx context.Context) (int, error) {
+	return d.RoomsTable.SelectRoomCount(ctx)
+}
+
+// GetMembershipCounts returns the number of joined and invited users in the room.
+func (d *Database) GetMembershipCounts(ctx context.Context, roomNID types.RoomNID) (joined, invited int, err error) {
+	return d.MembershipTable.SelectMembershipCounts(ctx, roomNID)
+}
+
+// GetHeroes returns up to limit users to name the room after for the given
+// user. Joined and invited users are picked first, and users who have left
+// only if there are none.
+func (d *Database) GetHeroes(ctx context.Context, roomNID types.RoomNID, userID string, limit int) ([]string, error) {
+	heroes, err := d.MembershipTable.SelectHeroes(ctx, roomNID, userID, tables.MembershipStateInvite, limit)
+	if err != nil || len(heroes) > 0 {
+		return heroes, err
+	}
+	return d.MembershipTable.SelectHeroes(ctx, roomNID, userID, tables.MembershipStateLeaveOrBan, limit)
+}
+
 // GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
 func (d *Database) GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error) {
 	var membershipState tables.MembershipState
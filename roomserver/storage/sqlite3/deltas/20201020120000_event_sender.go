@@ -0,0 +1,100 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+// eventSenderBatchSize is the number of existing events whose sender is
+// filled in at a time.
+const eventSenderBatchSize = 1000
+
+func LoadEventSender(m *sqlutil.Migrations) {
+	m.AddMigration(UpEventSender, DownEventSender)
+}
+
+// UpEventSender adds the sender of each event to the events table, so that
+// the events sent by a user can be found without loading every event. The
+// sender of existing events is read from their JSON.
+func UpEventSender(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE roomserver_events ADD COLUMN sender TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS roomserver_events_sender_idx ON roomserver_events(room_nid, sender, event_nid);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	for after := int64(0); ; {
+		senders, err := selectEventSenders(tx, after)
+		if err != nil {
+			return fmt.Errorf("failed to select event senders: %w", err)
+		}
+		if len(senders) == 0 {
+			return nil
+		}
+		for eventNID, sender := range senders {
+			if _, err = tx.Exec("UPDATE roomserver_events SET sender = $1 WHERE event_nid = $2", sender, eventNID); err != nil {
+				return fmt.Errorf("failed to update event sender: %w", err)
+			}
+			if eventNID > after {
+				after = eventNID
+			}
+		}
+	}
+}
+
+func selectEventSenders(tx *sql.Tx, after int64) (map[int64]string, error) {
+	rows, err := tx.Query(
+		"SELECT event_nid, event_json FROM roomserver_event_json WHERE event_nid > $1 ORDER BY event_nid ASC LIMIT $2",
+		after, eventSenderBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	senders := make(map[int64]string, eventSenderBatchSize)
+	for rows.Next() {
+		var eventNID int64
+		var eventJSON []byte
+		if err = rows.Scan(&eventNID, &eventJSON); err != nil {
+			return nil, err
+		}
+		senders[eventNID] = gjson.GetBytes(eventJSON, "sender").Str
+	}
+	return senders, rows.Err()
+}
+
+func DownEventSender(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX IF EXISTS roomserver_events_sender_idx;
+ALTER TABLE roomserver_events RENAME TO roomserver_events_tmp;
+CREATE TABLE roomserver_events (
+    event_nid INTEGER PRIMARY KEY AUTOINCREMENT,
+    room_nid INTEGER NOT NULL,
+    event_type_nid INTEGER NOT NULL,
+    event_state_key_nid INTEGER NOT NULL,
+    sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
+    state_snapshot_nid INTEGER NOT NULL DEFAULT 0,
+    depth INTEGER NOT NULL,
+    event_id TEXT NOT NULL UNIQUE,
+    reference_sha256 BLOB NOT NULL,
+    auth_event_nids TEXT NOT NULL DEFAULT '[]',
+    is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+);
+INSERT
+    INTO roomserver_events (
+      event_nid, room_nid, event_type_nid, event_state_key_nid, sent_to_output, state_snapshot_nid,
+      depth, event_id, reference_sha256, auth_event_nids, is_rejected
+    ) SELECT
+      event_nid, room_nid, event_type_nid, event_state_key_nid, sent_to_output, state_snapshot_nid,
+      depth, event_id, reference_sha256, auth_event_nids, is_rejected
+    FROM roomserver_events_tmp
+;
+DROP TABLE roomserver_events_tmp;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
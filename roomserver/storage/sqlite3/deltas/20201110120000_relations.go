@@ -0,0 +1,108 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+// relationsBatchSize is the number of existing events that are checked for
+// relations at a time.
+const relationsBatchSize = 1000
+
+func LoadRelations(m *sqlutil.Migrations) {
+	m.AddMigration(UpRelations, DownRelations)
+}
+
+// UpRelations creates the relations table and fills it in from the events
+// that were stored before it existed, so that aggregations and threads also
+// cover older events. The relations of existing events are read from their
+// JSON. State events never carry relations.
+func UpRelations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE IF NOT EXISTS roomserver_relations (
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    room_nid BIGINT NOT NULL,
+    relates_to TEXT NOT NULL,
+    rel_type TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    sender TEXT NOT NULL,
+    aggregation_key TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS roomserver_relations_relates_to_idx ON roomserver_relations(relates_to, rel_type);
+CREATE INDEX IF NOT EXISTS roomserver_relations_room_nid_idx ON roomserver_relations(room_nid, rel_type);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	for after := int64(0); ; {
+		last, err := backfillRelations(tx, after)
+		if err != nil {
+			return fmt.Errorf("failed to backfill relations: %w", err)
+		}
+		if last == after {
+			return nil
+		}
+		after = last
+	}
+}
+
+// backfillRelations inserts the relations of the next batch of events after
+// the given event NID, returning the last event NID that was checked.
+func backfillRelations(tx *sql.Tx, after int64) (int64, error) {
+	rows, err := tx.Query(
+		"SELECT e.event_nid, e.room_nid, j.event_json FROM roomserver_events e"+
+			" JOIN roomserver_event_json j ON e.event_nid = j.event_nid"+
+			" WHERE e.event_nid > $1 ORDER BY e.event_nid ASC LIMIT $2",
+		after, relationsBatchSize,
+	)
+	if err != nil {
+		return after, err
+	}
+	type relation struct {
+		eventNID, roomNID int64
+		eventJSON         []byte
+	}
+	var relations []relation
+	for rows.Next() {
+		var r relation
+		if err = rows.Scan(&r.eventNID, &r.roomNID, &r.eventJSON); err != nil {
+			rows.Close() // nolint: errcheck
+			return after, err
+		}
+		after = r.eventNID
+		relations = append(relations, r)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close() // nolint: errcheck
+		return after, err
+	}
+	rows.Close() // nolint: errcheck
+	for _, r := range relations {
+		event := gjson.ParseBytes(r.eventJSON)
+		relatesTo := event.Get(`content.m\.relates_to`)
+		relType, relatesToID := relatesTo.Get("rel_type").Str, relatesTo.Get("event_id").Str
+		if relType == "" || relatesToID == "" || event.Get("state_key").Exists() {
+			continue
+		}
+		_, err = tx.Exec(
+			"INSERT INTO roomserver_relations (event_nid, room_nid, relates_to, rel_type, event_type, sender, aggregation_key)"+
+				" VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (event_nid) DO NOTHING",
+			r.eventNID, r.roomNID, relatesToID, relType,
+			event.Get("type").Str, event.Get("sender").Str, relatesTo.Get("key").Str,
+		)
+		if err != nil {
+			return after, err
+		}
+	}
+	return after, nil
+}
+
+func DownRelations(tx *sql.Tx) error {
+	_, err := tx.Exec(`DROP TABLE IF EXISTS roomserver_relations;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
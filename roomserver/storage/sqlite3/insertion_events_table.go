@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const insertionEventsSchema = `
+-- Stores the MSC2716 insertion events of each room by the batch ID that they
+-- accept, so that imported history can be connected to them.
+CREATE TABLE IF NOT EXISTS roomserver_insertion_events (
+    -- The numeric ID of the insertion event
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The numeric ID of the room
+    room_nid BIGINT NOT NULL,
+    -- The org.matrix.msc2716.next_batch_id of the insertion event
+    next_batch_id TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_insertion_events_next_batch_id_idx ON roomserver_insertion_events(room_nid, next_batch_id);
+`
+
+const insertInsertionEventSQL = "" +
+	"INSERT INTO roomserver_insertion_events (event_nid, room_nid, next_batch_id)" +
+	" VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+
+const selectInsertionEventNIDSQL = "" +
+	"SELECT event_nid FROM roomserver_insertion_events" +
+	" WHERE room_nid = $1 AND next_batch_id = $2 ORDER BY event_nid ASC LIMIT 1"
+
+type insertionEventsStatements struct {
+	insertInsertionEventStmt    *sql.Stmt
+	selectInsertionEventNIDStmt *sql.Stmt
+}
+
+func NewSqliteInsertionEventsTable(db *sql.DB) (tables.InsertionEvents, error) {
+	s := &insertionEventsStatements{}
+	_, err := db.Exec(insertionEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, shared.StatementList{
+		{&s.insertInsertionEventStmt, insertInsertionEventSQL},
+		{&s.selectInsertionEventNIDStmt, selectInsertionEventNIDSQL},
+	}.Prepare(db)
+}
+
+func (s *insertionEventsStatements) InsertInsertionEvent(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, nextBatchID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertInsertionEventStmt)
+	_, err := stmt.ExecContext(ctx, eventNID, roomNID, nextBatchID)
+	return err
+}
+
+func (s *insertionEventsStatements) SelectInsertionEventNID(
+	ctx context.Context, roomNID types.RoomNID, nextBatchID string,
+) (types.EventNID, error) {
+	var eventNID types.EventNID
+	err := s.selectInsertionEventNIDStmt.QueryRowContext(ctx, roomNID, nextBatchID).Scan(&eventNID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return eventNID, err
+}
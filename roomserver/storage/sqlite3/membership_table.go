@@ -84,6 +84,9 @@ const updateMembershipSQL = "" +
 const selectRoomsWithMembershipSQL = "" +
 	"SELECT room_nid FROM roomserver_membership WHERE membership_nid = $1 AND target_nid = $2"
 
+const selectJoinedRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_membership WHERE membership_nid = $1 AND target_nid = $2"
+
 // selectKnownUsersSQL uses a sub-select statement here to find rooms that the user is
 // joined to. Since this information is used to populate the user directory, we will
 // only return users that the user would ordinarily be able to see anyway.
@@ -94,6 +97,20 @@ var selectKnownUsersSQL = "" +
 	"  SELECT DISTINCT room_nid FROM roomserver_membership WHERE target_nid=$1 AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) +
 	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND event_state_key LIKE $2 LIMIT $3"
 
+const selectMembershipCountsSQL = "" +
+	"SELECT membership_nid, COUNT(*) FROM roomserver_membership" +
+	" WHERE room_nid = $1 GROUP BY membership_nid"
+
+// selectHeroesSQL relies on joined and invited memberships being ordered
+// after leaves and bans, so that heroes can be picked from the joined and
+// invited users first, falling back to those who have left. Heroes are in
+// stream order of their current membership events, as the spec asks for.
+const selectHeroesSQL = "" +
+	"SELECT event_state_key FROM roomserver_membership INNER JOIN roomserver_event_state_keys ON " +
+	"roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
+	" WHERE room_nid = $1 AND membership_nid >= $2 AND event_state_key != $3" +
+	" ORDER BY event_nid ASC LIMIT $4"
+
 type membershipStatements struct {
 	db                                              *sql.DB
 	insertMembershipStmt                            *sql.Stmt
@@ -103,9 +120,12 @@ type membershipStatements struct {
 	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt                   *sql.Stmt
 	selectLocalMembershipsFromRoomStmt              *sql.Stmt
+	selectJoinedRoomCountStmt                       *sql.Stmt
 	selectRoomsWithMembershipStmt                   *sql.Stmt
 	updateMembershipStmt                            *sql.Stmt
 	selectKnownUsersStmt                            *sql.Stmt
+	selectMembershipCountsStmt                      *sql.Stmt
+	selectHeroesStmt                                *sql.Stmt
 }
 
 func NewSqliteMembershipTable(db *sql.DB) (tables.Membership, error) {
@@ -127,7 +147,10 @@ func NewSqliteMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
+		{&s.selectJoinedRoomCountStmt, selectJoinedRoomCountSQL},
 		{&s.selectKnownUsersStmt, selectKnownUsersSQL},
+		{&s.selectMembershipCountsStmt, selectMembershipCountsSQL},
+		{&s.selectHeroesStmt, selectHeroesSQL},
 	}.Prepare(db)
 }
 
@@ -246,6 +269,13 @@ func (s *membershipStatements) SelectRoomsWithMembership(
 	return roomNIDs, nil
 }
 
+func (s *membershipStatements) SelectJoinedRoomCount(
+	ctx context.Context, userID types.EventStateKeyNID,
+) (count int, err error) {
+	err = s.selectJoinedRoomCountStmt.QueryRowContext(ctx, tables.MembershipStateJoin, userID).Scan(&count)
+	return
+}
+
 func (s *membershipStatements) SelectJoinedUsersSetForRooms(ctx context.Context, roomNIDs []types.RoomNID) (map[types.EventStateKeyNID]int, error) {
 	iRoomNIDs := make([]interface{}, len(roomNIDs))
 	for i, v := range roomNIDs {
@@ -285,3 +315,46 @@ func (s *membershipStatements) SelectKnownUsers(ctx context.Context, userID type
 	}
 	return result, rows.Err()
 }
+
+func (s *membershipStatements) SelectMembershipCounts(
+	ctx context.Context, roomNID types.RoomNID,
+) (joined, invited int, err error) {
+	rows, err := s.selectMembershipCountsStmt.QueryContext(ctx, roomNID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMembershipCounts: rows.close() failed")
+	for rows.Next() {
+		var membership tables.MembershipState
+		var count int
+		if err = rows.Scan(&membership, &count); err != nil {
+			return 0, 0, err
+		}
+		switch membership {
+		case tables.MembershipStateJoin:
+			joined = count
+		case tables.MembershipStateInvite:
+			invited = count
+		}
+	}
+	return joined, invited, rows.Err()
+}
+
+func (s *membershipStatements) SelectHeroes(
+	ctx context.Context, roomNID types.RoomNID, excludeUserID string, atLeast tables.MembershipState, limit int,
+) ([]string, error) {
+	rows, err := s.selectHeroesStmt.QueryContext(ctx, roomNID, atLeast, excludeUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectHeroes: rows.close() failed")
+	var heroes []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		heroes = append(heroes, userID)
+	}
+	return heroes, rows.Err()
+}
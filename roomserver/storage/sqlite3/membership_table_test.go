@@ -0,0 +1,150 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+type testMembership struct {
+	userID     string
+	membership tables.MembershipState
+	eventNID   types.EventNID
+}
+
+func mustCreateMembershipDatabase(t *testing.T, roomNID types.RoomNID, memberships []testMembership) (*shared.Database, func()) {
+	t.Helper()
+	tmpfile, err := ioutil.TempFile("", "roomserver_membership_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	clean := func() {
+		os.Remove(tmpfile.Name())
+	}
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		clean()
+		t.Fatalf("failed to open database: %s", err)
+	}
+	eventStateKeys, err := NewSqliteEventStateKeysTable(db)
+	if err != nil {
+		clean()
+		t.Fatalf("failed to create event state keys table: %s", err)
+	}
+	membership, err := NewSqliteMembershipTable(db)
+	if err != nil {
+		clean()
+		t.Fatalf("failed to create membership table: %s", err)
+	}
+
+	ctx := context.Background()
+	for _, m := range memberships {
+		targetNID, err := eventStateKeys.InsertEventStateKeyNID(ctx, nil, m.userID)
+		if err != nil {
+			clean()
+			t.Fatalf("failed to insert event state key: %s", err)
+		}
+		if err = membership.InsertMembership(ctx, nil, roomNID, targetNID, true); err != nil {
+			clean()
+			t.Fatalf("failed to insert membership: %s", err)
+		}
+		if err = membership.UpdateMembership(ctx, nil, roomNID, targetNID, targetNID, m.membership, m.eventNID); err != nil {
+			clean()
+			t.Fatalf("failed to update membership: %s", err)
+		}
+	}
+	return &shared.Database{
+		EventStateKeysTable: eventStateKeys,
+		MembershipTable:     membership,
+	}, clean
+}
+
+func TestGetMembershipCounts(t *testing.T) {
+	db, clean := mustCreateMembershipDatabase(t, 1, []testMembership{
+		{"@geralt:kaer.morhen", tables.MembershipStateJoin, 1},
+		{"@ciri:kaer.morhen", tables.MembershipStateJoin, 2},
+		{"@yennefer:kaer.morhen", tables.MembershipStateInvite, 3},
+		{"@vesemir:kaer.morhen", tables.MembershipStateLeaveOrBan, 4},
+	})
+	defer clean()
+
+	joined, invited, err := db.GetMembershipCounts(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("GetMembershipCounts failed: %s", err)
+	}
+	if joined != 2 || invited != 1 {
+		t.Errorf("got %d joined and %d invited, want 2 joined and 1 invited", joined, invited)
+	}
+	if joined, invited, err = db.GetMembershipCounts(context.Background(), 2); err != nil || joined != 0 || invited != 0 {
+		t.Errorf("unknown room: got %d joined, %d invited and error %v, want none", joined, invited, err)
+	}
+}
+
+func TestGetHeroes(t *testing.T) {
+	db, clean := mustCreateMembershipDatabase(t, 1, []testMembership{
+		{"@geralt:kaer.morhen", tables.MembershipStateJoin, 1},
+		{"@yennefer:kaer.morhen", tables.MembershipStateJoin, 2},
+		{"@vesemir:kaer.morhen", tables.MembershipStateLeaveOrBan, 3},
+		{"@ciri:kaer.morhen", tables.MembershipStateInvite, 4},
+		{"@lambert:kaer.morhen", tables.MembershipStateJoin, 5},
+	})
+	defer clean()
+	ctx := context.Background()
+
+	// Joined and invited users other than the requester, in stream order
+	// rather than by user ID.
+	heroes, err := db.GetHeroes(ctx, 1, "@geralt:kaer.morhen", 5)
+	if err != nil {
+		t.Fatalf("GetHeroes failed: %s", err)
+	}
+	want := []string{"@yennefer:kaer.morhen", "@ciri:kaer.morhen", "@lambert:kaer.morhen"}
+	if !reflect.DeepEqual(heroes, want) {
+		t.Errorf("got heroes %v, want %v", heroes, want)
+	}
+	if heroes, err = db.GetHeroes(ctx, 1, "@geralt:kaer.morhen", 2); err != nil || !reflect.DeepEqual(heroes, want[:2]) {
+		t.Errorf("with a limit of 2: got heroes %v and error %v, want %v", heroes, err, want[:2])
+	}
+}
+
+func TestGetHeroesFallsBackToLeftUsers(t *testing.T) {
+	db, clean := mustCreateMembershipDatabase(t, 1, []testMembership{
+		{"@geralt:kaer.morhen", tables.MembershipStateJoin, 1},
+		{"@yennefer:kaer.morhen", tables.MembershipStateLeaveOrBan, 2},
+		{"@ciri:kaer.morhen", tables.MembershipStateLeaveOrBan, 3},
+	})
+	defer clean()
+
+	heroes, err := db.GetHeroes(context.Background(), 1, "@geralt:kaer.morhen", 5)
+	if err != nil {
+		t.Fatalf("GetHeroes failed: %s", err)
+	}
+	want := []string{"@yennefer:kaer.morhen", "@ciri:kaer.morhen"}
+	if !reflect.DeepEqual(heroes, want) {
+		t.Errorf("got heroes %v, want the users who left %v", heroes, want)
+	}
+}
@@ -50,7 +50,7 @@ type Database struct {
 func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
 	var d Database
 	var err error
-	if d.db, err = sqlutil.Open(dbProperties); err != nil {
+	if d.db, err = sqlutil.OpenNamed("roomserver", dbProperties); err != nil {
 		return nil, err
 	}
 	d.writer = sqlutil.NewExclusiveWriter()
@@ -75,7 +75,7 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err != nil {
 		return nil, err
 	}
-	d.events, err = NewSqliteEventsTable(d.db)
+	d.events, err = NewSqliteEventsTable(d.db, dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -119,24 +119,39 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 	if err != nil {
 		return nil, err
 	}
+	publications, err := NewSqlitePublicationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := NewSqliteRelationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	insertionEvents, err := NewSqliteInsertionEventsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
-		DB:                  d.db,
-		Cache:               cache,
-		Writer:              d.writer,
-		EventsTable:         d.events,
-		EventTypesTable:     d.eventTypes,
-		EventStateKeysTable: d.eventStateKeys,
-		EventJSONTable:      d.eventJSON,
-		RoomsTable:          d.rooms,
-		TransactionsTable:   d.transactions,
-		StateBlockTable:     stateBlock,
-		StateSnapshotTable:  stateSnapshot,
-		PrevEventsTable:     d.prevEvents,
-		RoomAliasesTable:    roomAliases,
-		InvitesTable:        d.invites,
-		MembershipTable:     d.membership,
-		PublishedTable:      published,
-		RedactionsTable:     redactions,
+		DB:                   d.db,
+		Cache:                cache,
+		Writer:               d.writer,
+		EventsTable:          d.events,
+		EventTypesTable:      d.eventTypes,
+		EventStateKeysTable:  d.eventStateKeys,
+		EventJSONTable:       d.eventJSON,
+		RoomsTable:           d.rooms,
+		TransactionsTable:    d.transactions,
+		StateBlockTable:      stateBlock,
+		StateSnapshotTable:   stateSnapshot,
+		PrevEventsTable:      d.prevEvents,
+		RoomAliasesTable:     roomAliases,
+		InvitesTable:         d.invites,
+		MembershipTable:      d.membership,
+		PublishedTable:       published,
+		PublicationsTable:    publications,
+		RedactionsTable:      redactions,
+		RelationsTable:       relations,
+		InsertionEventsTable: insertionEvents,
 	}
 	return &d, nil
 }
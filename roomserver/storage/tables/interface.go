@@ -36,7 +36,7 @@ type EventStateKeys interface {
 type Events interface {
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string,
-		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool, sender string,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
@@ -59,6 +59,12 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDForEventNID(ctx context.Context, eventNID types.EventNID) (roomNID types.RoomNID, err error)
+	// SelectRoomEventNIDs returns up to limit event NIDs in the room which are
+	// greater than afterEventNID, in ascending order.
+	SelectRoomEventNIDs(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
+	// SelectRoomEventNIDsBySender returns up to limit event NIDs in the room which were sent by the
+	// given user and are greater than afterEventNID, in ascending order.
+	SelectRoomEventNIDsBySender(ctx context.Context, roomNID types.RoomNID, sender string, afterEventNID types.EventNID, limit int) ([]types.EventNID, error)
 }
 
 type Rooms interface {
@@ -70,6 +76,8 @@ type Rooms interface {
 	SelectRoomVersionForRoomNID(ctx context.Context, roomNID types.RoomNID) (gomatrixserverlib.RoomVersion, error)
 	SelectRoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error)
 	SelectRoomIDs(ctx context.Context) ([]string, error)
+	// SelectRoomCount returns the number of rooms known to the roomserver.
+	SelectRoomCount(ctx context.Context) (int, error)
 	BulkSelectRoomIDs(ctx context.Context, roomNIDs []types.RoomNID) ([]string, error)
 	BulkSelectRoomNIDs(ctx context.Context, roomIDs []string) ([]types.RoomNID, error)
 }
@@ -128,10 +136,17 @@ type Membership interface {
 	SelectMembershipsFromRoomAndMembership(ctx context.Context, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID) error
 	SelectRoomsWithMembership(ctx context.Context, userID types.EventStateKeyNID, membershipState MembershipState) ([]types.RoomNID, error)
+	// SelectJoinedRoomCount returns the number of rooms that the user is joined to.
+	SelectJoinedRoomCount(ctx context.Context, userID types.EventStateKeyNID) (int, error)
 	// SelectJoinedUsersSetForRooms returns the set of all users in the rooms who are joined to any of these rooms, along with the
 	// counts of how many rooms they are joined.
 	SelectJoinedUsersSetForRooms(ctx context.Context, roomNIDs []types.RoomNID) (map[types.EventStateKeyNID]int, error)
 	SelectKnownUsers(ctx context.Context, userID types.EventStateKeyNID, searchString string, limit int) ([]string, error)
+	// SelectMembershipCounts returns the number of joined and invited users in the room.
+	SelectMembershipCounts(ctx context.Context, roomNID types.RoomNID) (joined, invited int, err error)
+	// SelectHeroes returns up to limit user IDs, in order, of the users in the room with at least the given
+	// membership, other than the given user.
+	SelectHeroes(ctx context.Context, roomNID types.RoomNID, excludeUserID string, atLeast MembershipState, limit int) ([]string, error)
 }
 
 type Published interface {
@@ -140,6 +155,30 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, published bool) ([]string, error)
 }
 
+// PublicationInfo describes the publication of a room in a room directory.
+type PublicationInfo struct {
+	// the room ID of the published room
+	RoomID string
+	// the third party network that the room is published in, or empty for
+	// the server's own room directory
+	NetworkID string
+	// the user who published the room, or empty if it was published by a
+	// server admin
+	UserID string
+	// when the room was published
+	PublishedTS gomatrixserverlib.Timestamp
+}
+
+type Publications interface {
+	UpsertPublication(ctx context.Context, txn *sql.Tx, info PublicationInfo) error
+	DeletePublication(ctx context.Context, txn *sql.Tx, roomID, networkID string) error
+	// SelectAllPublications returns all current publications, most recent first.
+	SelectAllPublications(ctx context.Context) ([]PublicationInfo, error)
+	// SelectNetworkRoomIDs returns the rooms published in the given third
+	// party network, or in any third party network if networkID is empty.
+	SelectNetworkRoomIDs(ctx context.Context, networkID string) ([]string, error)
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
@@ -160,6 +199,58 @@ type Redactions interface {
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
 
+// RelationInfo describes an event which relates to another event through
+// its "m.relates_to" content.
+type RelationInfo struct {
+	// the numeric ID of the relating event
+	EventNID types.EventNID
+	// the ID of the event being related to
+	RelatesTo string
+	// the relation type, e.g. m.annotation
+	RelType string
+	// the type of the relating event, e.g. m.reaction
+	EventType string
+	// the sender of the relating event
+	Sender string
+	// the aggregation key of an annotation, e.g. the emoji of a reaction
+	Key string
+}
+
+// ThreadRoot describes the root event of a thread.
+type ThreadRoot struct {
+	// the ID of the thread root event
+	EventID string
+	// the numeric ID of the most recent event in the thread
+	LatestEventNID types.EventNID
+}
+
+type Relations interface {
+	InsertRelation(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, info RelationInfo) error
+	DeleteRelation(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
+	// SelectRelations returns the numeric IDs of events relating to the given event, newest first, with
+	// event NIDs lower than before. Empty relType or eventType values match any relation or event type.
+	SelectRelations(
+		ctx context.Context, roomNID types.RoomNID, relatesTo, relType, eventType string,
+		before types.EventNID, limit int,
+	) ([]types.EventNID, error)
+	// SelectRelationsByType returns all relations in the given room of the given type to the given event,
+	// oldest first.
+	SelectRelationsByType(ctx context.Context, roomNID types.RoomNID, relatesTo, relType string) ([]RelationInfo, error)
+	// SelectThreadRoots returns the roots of threads in the given room, ordered by their most recent
+	// event, newest first, where that event has a NID lower than before.
+	SelectThreadRoots(ctx context.Context, roomNID types.RoomNID, before types.EventNID, limit int) ([]ThreadRoot, error)
+	// SelectLatestRelationBySender returns the numeric ID of the most recent relation in the given room of the
+	// given type to the given event sent by the given user, or 0 if there isn't one.
+	SelectLatestRelationBySender(ctx context.Context, roomNID types.RoomNID, relatesTo, relType, sender string) (types.EventNID, error)
+}
+
+type InsertionEvents interface {
+	InsertInsertionEvent(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNID types.EventNID, nextBatchID string) error
+	// SelectInsertionEventNID returns the numeric ID of the insertion event in the given room which accepts
+	// the given batch ID, or 0 if there isn't one.
+	SelectInsertionEventNID(ctx context.Context, roomNID types.RoomNID, nextBatchID string) (types.EventNID, error)
+}
+
 // StrippedEvent represents a stripped event for returning extracted content values.
 type StrippedEvent struct {
 	RoomID       string
@@ -122,6 +122,14 @@ type StateAtEventAndReference struct {
 	gomatrixserverlib.EventReference
 }
 
+// A Redaction is a redaction event along with the ID of the event that it
+// redacted. It is returned when storing a batch of events completes a
+// redaction, so that downstream components can be told about it.
+type Redaction struct {
+	RedactionEvent  *gomatrixserverlib.Event
+	RedactedEventID string
+}
+
 // An Event is a gomatrixserverlib.Event with the numeric event ID attached.
 // It is when performing bulk event lookup in the database.
 type Event struct {
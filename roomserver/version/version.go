@@ -15,6 +15,7 @@
 package version
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -63,6 +64,38 @@ func SupportedRoomVersion(version gomatrixserverlib.RoomVersion) (gomatrixserver
 	return result, nil
 }
 
+// CreateEventRoomVersion returns the room version that an m.room.create
+// event sets, which is version 1 if the event doesn't specify one.
+func CreateEventRoomVersion(event *gomatrixserverlib.Event) (gomatrixserverlib.RoomVersion, error) {
+	var createContent gomatrixserverlib.CreateContent
+	if err := json.Unmarshal(event.Content(), &createContent); err != nil {
+		return "", err
+	}
+	if createContent.RoomVersion == nil {
+		return gomatrixserverlib.RoomVersionV1, nil
+	}
+	return gomatrixserverlib.RoomVersion(*createContent.RoomVersion), nil
+}
+
+// CheckEventRoomVersion returns a MismatchedVersionError if the event was
+// parsed with the rules of a different version to the one its room uses,
+// since it would then have the wrong event ID, redaction algorithm and
+// canonical JSON and signature checks. roomVersion is the version of the
+// room, or empty if the room isn't known yet. Create events are checked
+// against the version that they set instead.
+func CheckEventRoomVersion(event *gomatrixserverlib.HeaderedEvent, roomVersion gomatrixserverlib.RoomVersion) error {
+	if event.Type() == gomatrixserverlib.MRoomCreate && event.StateKeyEquals("") {
+		var err error
+		if roomVersion, err = CreateEventRoomVersion(&event.Event); err != nil {
+			return fmt.Errorf("CreateEventRoomVersion: %w", err)
+		}
+	}
+	if roomVersion != "" && event.RoomVersion != roomVersion {
+		return MismatchedVersionError{event.EventID(), event.RoomVersion, roomVersion}
+	}
+	return nil
+}
+
 // UnknownVersionError is caused when the room version is not known.
 type UnknownVersionError struct {
 	Version gomatrixserverlib.RoomVersion
@@ -81,3 +114,15 @@ type UnsupportedVersionError struct {
 func (e UnsupportedVersionError) Error() string {
 	return fmt.Sprintf("room version '%s' is marked as unsupported", e.Version)
 }
+
+// MismatchedVersionError is caused when an event was parsed as a different
+// room version to the room that it belongs to.
+type MismatchedVersionError struct {
+	EventID      string
+	EventVersion gomatrixserverlib.RoomVersion
+	RoomVersion  gomatrixserverlib.RoomVersion
+}
+
+func (e MismatchedVersionError) Error() string {
+	return fmt.Sprintf("event %s was parsed as room version '%s' but its room is version '%s'", e.EventID, e.EventVersion, e.RoomVersion)
+}
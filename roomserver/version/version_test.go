@@ -0,0 +1,151 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testOrigin = gomatrixserverlib.ServerName("kaer.morhen")
+
+// roomVersionTests describes how events are handled in each room version.
+var roomVersionTests = []struct {
+	version gomatrixserverlib.RoomVersion
+	// how event IDs are formed, as "domain" for random IDs with the server
+	// name, or the base64 encoding of the reference hash
+	eventIDFormat string
+	// whether PDUs which aren't canonical JSON are rejected
+	strictJSON bool
+}{
+	{gomatrixserverlib.RoomVersionV1, "domain", false},
+	{gomatrixserverlib.RoomVersionV2, "domain", false},
+	{gomatrixserverlib.RoomVersionV3, "base64", false},
+	{gomatrixserverlib.RoomVersionV4, "urlsafe", false},
+	{gomatrixserverlib.RoomVersionV5, "urlsafe", false},
+	{gomatrixserverlib.RoomVersionV6, "urlsafe", true},
+}
+
+func mustBuildEvent(t *testing.T, roomVersion gomatrixserverlib.RoomVersion, eventType string, stateKey *string, content interface{}) gomatrixserverlib.Event {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   "@geralt:kaer.morhen",
+		RoomID:   "!room:kaer.morhen",
+		Type:     eventType,
+		StateKey: stateKey,
+		Depth:    1,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	ev, err := eb.Build(time.Now(), testOrigin, "ed25519:test", key, roomVersion)
+	if err != nil {
+		t.Fatalf("failed to build %s event: %s", roomVersion, err)
+	}
+	return ev
+}
+
+func TestEventHandlingPerRoomVersion(t *testing.T) {
+	stateKey := ""
+	for _, tt := range roomVersionTests {
+		if _, err := SupportedRoomVersion(tt.version); err != nil {
+			t.Errorf("room version %s: %s", tt.version, err)
+			continue
+		}
+		ev := mustBuildEvent(t, tt.version, gomatrixserverlib.MRoomCreate, &stateKey, map[string]interface{}{
+			"creator":      "@geralt:kaer.morhen",
+			"room_version": tt.version,
+		})
+
+		hash := ev.EventReference().EventSHA256
+		var wantID string
+		switch tt.eventIDFormat {
+		case "base64":
+			wantID = "$" + base64.RawStdEncoding.EncodeToString(hash)
+		case "urlsafe":
+			wantID = "$" + base64.RawURLEncoding.EncodeToString(hash)
+		}
+		if wantID == "" {
+			if !strings.HasPrefix(ev.EventID(), "$") || !strings.HasSuffix(ev.EventID(), ":"+string(testOrigin)) {
+				t.Errorf("room version %s: got event ID %q, want one with the server name", tt.version, ev.EventID())
+			}
+		} else if ev.EventID() != wantID {
+			t.Errorf("room version %s: got event ID %q, want %q", tt.version, ev.EventID(), wantID)
+		}
+
+		// Event IDs are calculated from the redacted event, so redacting an
+		// event must not change its ID in any room version.
+		if redacted := ev.Redact(); redacted.EventID() != ev.EventID() {
+			t.Errorf("room version %s: redacting changed the event ID from %q to %q", tt.version, ev.EventID(), redacted.EventID())
+		}
+
+		headered := ev.Headered(tt.version)
+		if err := CheckEventRoomVersion(&headered, ""); err != nil {
+			t.Errorf("room version %s: create event rejected: %s", tt.version, err)
+		}
+	}
+}
+
+func TestCanonicalJSONPerRoomVersion(t *testing.T) {
+	for _, tt := range roomVersionTests {
+		pdu := `{"type":"m.room.message","room_id":"!room:kaer.morhen","sender":"@geralt:kaer.morhen",` +
+			`"origin":"kaer.morhen","origin_server_ts":1,"depth":1,"prev_events":[],"auth_events":[],` +
+			`"content":{"body":"hi","n":1.5},"hashes":{"sha256":"AAAA"},"signatures":{}`
+		if tt.eventIDFormat == "domain" {
+			pdu += `,"event_id":"$event:kaer.morhen"`
+		}
+		pdu += "}"
+		_, err := gomatrixserverlib.NewEventFromUntrustedJSON([]byte(pdu), tt.version)
+		_, badJSON := err.(gomatrixserverlib.BadJSONError)
+		if badJSON != tt.strictJSON {
+			t.Errorf("room version %s: got error %v for a float in the content, want bad JSON error %v", tt.version, err, tt.strictJSON)
+		}
+	}
+}
+
+func TestCheckEventRoomVersion(t *testing.T) {
+	stateKey := ""
+	create := mustBuildEvent(t, gomatrixserverlib.RoomVersionV6, gomatrixserverlib.MRoomCreate, &stateKey, map[string]interface{}{
+		"creator":      "@geralt:kaer.morhen",
+		"room_version": gomatrixserverlib.RoomVersionV6,
+	})
+	message := mustBuildEvent(t, gomatrixserverlib.RoomVersionV6, "m.room.message", nil, map[string]interface{}{
+		"body": "hello",
+	})
+
+	for _, tt := range []struct {
+		name        string
+		event       gomatrixserverlib.HeaderedEvent
+		roomVersion gomatrixserverlib.RoomVersion
+		wantErr     bool
+	}{
+		{"message in a room of the same version", message.Headered(gomatrixserverlib.RoomVersionV6), gomatrixserverlib.RoomVersionV6, false},
+		{"message in an unknown room", message.Headered(gomatrixserverlib.RoomVersionV6), "", false},
+		{"message in a room of another version", message.Headered(gomatrixserverlib.RoomVersionV6), gomatrixserverlib.RoomVersionV5, true},
+		{"create event of the version it sets", create.Headered(gomatrixserverlib.RoomVersionV6), "", false},
+		{"create event parsed as another version", create.Headered(gomatrixserverlib.RoomVersionV1), "", true},
+	} {
+		err := CheckEventRoomVersion(&tt.event, tt.roomVersion)
+		if _, mismatched := err.(MismatchedVersionError); mismatched != tt.wantErr {
+			t.Errorf("%s: got error %v, want mismatched version error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
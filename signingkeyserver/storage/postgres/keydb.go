@@ -29,6 +29,14 @@ import (
 // the public keys for other matrix servers.
 type Database struct {
 	statements serverKeyStatements
+	queries    sqlutil.QueryTimer
+}
+
+// Migrations returns the schema migrations of the key database. There are
+// none yet, but recording the schema version now means that a future release
+// can refuse to run against it.
+func Migrations() *sqlutil.Migrations {
+	return sqlutil.NewMigrations("keydb")
 }
 
 // NewDatabase prepares a new key database.
@@ -41,15 +49,23 @@ func NewDatabase(
 	serverKey ed25519.PublicKey,
 	serverKeyID gomatrixserverlib.KeyID,
 ) (*Database, error) {
-	db, err := sqlutil.Open(dbProperties)
+	db, err := sqlutil.OpenNamed("keydb", dbProperties)
 	if err != nil {
 		return nil, err
 	}
-	d := &Database{}
+	d := &Database{
+		queries: sqlutil.QueryTimer{
+			Database: "keydb",
+			Timeout:  dbProperties.QueryTimeout(),
+		},
+	}
 	err = d.statements.prepare(db)
 	if err != nil {
 		return nil, err
 	}
+	if err = Migrations().RunDeltas(db, dbProperties); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
@@ -63,6 +79,8 @@ func (d *Database) FetchKeys(
 	ctx context.Context,
 	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
 ) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	ctx, done := d.queries.Start(ctx, "FetchKeys")
+	defer done()
 	return d.statements.bulkSelectServerKeys(ctx, requests)
 }
 
@@ -71,6 +89,8 @@ func (d *Database) StoreKeys(
 	ctx context.Context,
 	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) error {
+	ctx, done := d.queries.Start(ctx, "StoreKeys")
+	defer done()
 	// TODO: Inserting all the keys within a single transaction may
 	// be more efficient since the transaction overhead can be quite
 	// high for a single insert statement.
@@ -18,7 +18,6 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -30,7 +29,9 @@ import (
 
 // OutputClientDataConsumer consumes events that originated in the client API server.
 type OutputClientDataConsumer struct {
-	clientAPIConsumer *internal.ContinualConsumer
+	cfg               *config.SyncAPI
+	bus               internal.MessageBus
+	clientAPIConsumer internal.Subscriber
 	db                storage.Database
 	notifier          *sync.Notifier
 }
@@ -38,36 +39,33 @@ type OutputClientDataConsumer struct {
 // NewOutputClientDataConsumer creates a new OutputClientData consumer. Call Start() to begin consuming from room servers.
 func NewOutputClientDataConsumer(
 	cfg *config.SyncAPI,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	n *sync.Notifier,
 	store storage.Database,
 ) *OutputClientDataConsumer {
-
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "syncapi/clientapi",
-		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputClientData)),
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
-	}
-	s := &OutputClientDataConsumer{
-		clientAPIConsumer: &consumer,
-		db:                store,
-		notifier:          n,
+	return &OutputClientDataConsumer{
+		cfg:      cfg,
+		bus:      bus,
+		db:       store,
+		notifier: n,
 	}
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from room servers
-func (s *OutputClientDataConsumer) Start() error {
-	return s.clientAPIConsumer.Start()
+func (s *OutputClientDataConsumer) Start() (err error) {
+	s.clientAPIConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "syncapi/clientapi",
+		Topic:          string(s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputClientData)),
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+	})
+	return err
 }
 
 // onMessage is called when the sync server receives a new event from the client API server output log.
 // It is not safe for this function to be called from multiple goroutines, or else the
 // sync stream position may race and be incorrectly calculated.
-func (s *OutputClientDataConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputClientDataConsumer) onMessage(msg *internal.Message) error {
 	// Parse out the event JSON
 	var output eventutil.AccountData
 	if err := json.Unmarshal(msg.Value, &output); err != nil {
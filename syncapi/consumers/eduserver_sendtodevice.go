@@ -18,7 +18,6 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -32,7 +31,9 @@ import (
 
 // OutputSendToDeviceEventConsumer consumes events that originated in the EDU server.
 type OutputSendToDeviceEventConsumer struct {
-	sendToDeviceConsumer *internal.ContinualConsumer
+	cfg                  *config.SyncAPI
+	bus                  internal.MessageBus
+	sendToDeviceConsumer internal.Subscriber
 	db                   storage.Database
 	serverName           gomatrixserverlib.ServerName // our server name
 	notifier             *sync.Notifier
@@ -42,36 +43,31 @@ type OutputSendToDeviceEventConsumer struct {
 // Call Start() to begin consuming from the EDU server.
 func NewOutputSendToDeviceEventConsumer(
 	cfg *config.SyncAPI,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	n *sync.Notifier,
 	store storage.Database,
 ) *OutputSendToDeviceEventConsumer {
-
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "syncapi/eduserver/sendtodevice",
-		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent)),
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
-	}
-
-	s := &OutputSendToDeviceEventConsumer{
-		sendToDeviceConsumer: &consumer,
-		db:                   store,
-		serverName:           cfg.Matrix.ServerName,
-		notifier:             n,
+	return &OutputSendToDeviceEventConsumer{
+		cfg:        cfg,
+		bus:        bus,
+		db:         store,
+		serverName: cfg.Matrix.ServerName,
+		notifier:   n,
 	}
-
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from EDU api
-func (s *OutputSendToDeviceEventConsumer) Start() error {
-	return s.sendToDeviceConsumer.Start()
+func (s *OutputSendToDeviceEventConsumer) Start() (err error) {
+	s.sendToDeviceConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "syncapi/eduserver/sendtodevice",
+		Topic:          string(s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent)),
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+	})
+	return err
 }
 
-func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputSendToDeviceEventConsumer) onMessage(msg *internal.Message) error {
 	var output api.OutputSendToDeviceEvent
 	if err := json.Unmarshal(msg.Value, &output); err != nil {
 		// If the message was invalid, log it and move on to the next message in the stream
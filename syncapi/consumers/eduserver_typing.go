@@ -17,7 +17,6 @@ package consumers
 import (
 	"encoding/json"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -29,7 +28,9 @@ import (
 
 // OutputTypingEventConsumer consumes events that originated in the EDU server.
 type OutputTypingEventConsumer struct {
-	typingConsumer *internal.ContinualConsumer
+	cfg            *config.SyncAPI
+	bus            internal.MessageBus
+	typingConsumer internal.Subscriber
 	db             storage.Database
 	notifier       *sync.Notifier
 }
@@ -38,31 +39,20 @@ type OutputTypingEventConsumer struct {
 // Call Start() to begin consuming from the EDU server.
 func NewOutputTypingEventConsumer(
 	cfg *config.SyncAPI,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	n *sync.Notifier,
 	store storage.Database,
 ) *OutputTypingEventConsumer {
-
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "syncapi/eduserver/typing",
-		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent)),
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
-	}
-
-	s := &OutputTypingEventConsumer{
-		typingConsumer: &consumer,
-		db:             store,
-		notifier:       n,
+	return &OutputTypingEventConsumer{
+		cfg:      cfg,
+		bus:      bus,
+		db:       store,
+		notifier: n,
 	}
-
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from EDU api
-func (s *OutputTypingEventConsumer) Start() error {
+func (s *OutputTypingEventConsumer) Start() (err error) {
 	s.db.SetTypingTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
 		s.notifier.OnNewEvent(
 			nil, roomID, nil,
@@ -70,10 +60,16 @@ func (s *OutputTypingEventConsumer) Start() error {
 		)
 	})
 
-	return s.typingConsumer.Start()
+	s.typingConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "syncapi/eduserver/typing",
+		Topic:          string(s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputTypingEvent)),
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+	})
+	return err
 }
 
-func (s *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputTypingEventConsumer) onMessage(msg *internal.Message) error {
 	var output api.OutputTypingEvent
 	if err := json.Unmarshal(msg.Value, &output); err != nil {
 		// If the message was invalid, log it and move on to the next message in the stream
@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"sync"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -33,7 +32,9 @@ import (
 
 // OutputKeyChangeEventConsumer consumes events that originated in the key server.
 type OutputKeyChangeEventConsumer struct {
-	keyChangeConsumer   *internal.ContinualConsumer
+	bus                 internal.MessageBus
+	topic               string
+	keyChangeConsumer   internal.Subscriber
 	db                  storage.Database
 	serverName          gomatrixserverlib.ServerName // our server name
 	rsAPI               roomserverAPI.RoomserverInternalAPI
@@ -48,22 +49,15 @@ type OutputKeyChangeEventConsumer struct {
 func NewOutputKeyChangeEventConsumer(
 	serverName gomatrixserverlib.ServerName,
 	topic string,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	n *syncapi.Notifier,
 	keyAPI api.KeyInternalAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 	store storage.Database,
 ) *OutputKeyChangeEventConsumer {
-
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "syncapi/keychange",
-		Topic:          topic,
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
-	}
-
-	s := &OutputKeyChangeEventConsumer{
-		keyChangeConsumer:   &consumer,
+	return &OutputKeyChangeEventConsumer{
+		bus:                 bus,
+		topic:               topic,
 		db:                  store,
 		serverName:          serverName,
 		keyAPI:              keyAPI,
@@ -72,30 +66,35 @@ func NewOutputKeyChangeEventConsumer(
 		partitionToOffsetMu: sync.Mutex{},
 		notifier:            n,
 	}
-
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from the key server
-func (s *OutputKeyChangeEventConsumer) Start() error {
-	offsets, err := s.keyChangeConsumer.StartOffsets()
+func (s *OutputKeyChangeEventConsumer) Start() (err error) {
+	offsets, err := s.db.PartitionOffsets(context.TODO(), s.topic)
+	if err != nil {
+		return err
+	}
 	s.partitionToOffsetMu.Lock()
 	for _, o := range offsets {
 		s.partitionToOffset[o.Partition] = o.Offset
 	}
 	s.partitionToOffsetMu.Unlock()
+	s.keyChangeConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "syncapi/keychange",
+		Topic:          s.topic,
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+	})
 	return err
 }
 
-func (s *OutputKeyChangeEventConsumer) updateOffset(msg *sarama.ConsumerMessage) {
+func (s *OutputKeyChangeEventConsumer) updateOffset(msg *internal.Message) {
 	s.partitionToOffsetMu.Lock()
 	defer s.partitionToOffsetMu.Unlock()
 	s.partitionToOffset[msg.Partition] = msg.Offset
 }
 
-func (s *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputKeyChangeEventConsumer) onMessage(msg *internal.Message) error {
 	defer s.updateOffset(msg)
 
 	var output api.DeviceMessage
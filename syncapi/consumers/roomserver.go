@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"fmt"
 
-	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -35,7 +34,8 @@ import (
 type OutputRoomEventConsumer struct {
 	cfg        *config.SyncAPI
 	rsAPI      api.RoomserverInternalAPI
-	rsConsumer *internal.ContinualConsumer
+	bus        internal.MessageBus
+	rsConsumer internal.Subscriber
 	db         storage.Database
 	notifier   *sync.Notifier
 }
@@ -43,39 +43,42 @@ type OutputRoomEventConsumer struct {
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
 func NewOutputRoomEventConsumer(
 	cfg *config.SyncAPI,
-	kafkaConsumer sarama.Consumer,
+	bus internal.MessageBus,
 	n *sync.Notifier,
 	store storage.Database,
 	rsAPI api.RoomserverInternalAPI,
 ) *OutputRoomEventConsumer {
-
-	consumer := internal.ContinualConsumer{
-		ComponentName:  "syncapi/roomserver",
-		Topic:          string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
-		Consumer:       kafkaConsumer,
-		PartitionStore: store,
+	return &OutputRoomEventConsumer{
+		cfg:      cfg,
+		bus:      bus,
+		db:       store,
+		notifier: n,
+		rsAPI:    rsAPI,
 	}
-	s := &OutputRoomEventConsumer{
-		cfg:        cfg,
-		rsConsumer: &consumer,
-		db:         store,
-		notifier:   n,
-		rsAPI:      rsAPI,
-	}
-	consumer.ProcessMessage = s.onMessage
-
-	return s
 }
 
 // Start consuming from room servers
-func (s *OutputRoomEventConsumer) Start() error {
-	return s.rsConsumer.Start()
+func (s *OutputRoomEventConsumer) Start() (err error) {
+	s.rsConsumer, err = s.bus.Subscribe(internal.Subscription{
+		ComponentName:  "syncapi/roomserver",
+		Topic:          string(s.cfg.Matrix.Kafka.TopicFor(config.TopicOutputRoomEvent)),
+		PartitionStore: s.db,
+		Process:        s.onMessage,
+		ResetCallback:  s.db.DeleteRoomserverData,
+	})
+	return err
+}
+
+// Reset deletes everything that was built from the room server output and
+// consumes the output again from the beginning to rebuild it.
+func (s *OutputRoomEventConsumer) Reset() error {
+	return s.rsConsumer.Reset()
 }
 
 // onMessage is called when the sync server receives a new event from the room server output log.
 // It is not safe for this function to be called from multiple goroutines, or else the
 // sync stream position may race and be incorrectly calculated.
-func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+func (s *OutputRoomEventConsumer) onMessage(msg *internal.Message) error {
 	// Parse out the event JSON
 	var output api.OutputEvent
 	if err := json.Unmarshal(msg.Value, &output); err != nil {
@@ -105,8 +108,12 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
 	case api.OutputTypeNewPeek:
 		return s.onNewPeek(context.TODO(), *output.NewPeek)
+	case api.OutputTypeRetirePeek:
+		return s.onRetirePeek(context.TODO(), *output.RetirePeek)
 	case api.OutputTypeRedactedEvent:
 		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypePurgedEvents:
+		return s.onPurgedEvents(context.TODO(), *output.PurgedEvents)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -130,6 +137,16 @@ func (s *OutputRoomEventConsumer) onRedactEvent(
 	})
 }
 
+func (s *OutputRoomEventConsumer) onPurgedEvents(
+	ctx context.Context, msg api.OutputPurgedEvents,
+) error {
+	if err := s.db.PurgeEvents(ctx, msg.EventIDs); err != nil {
+		log.WithError(err).WithField("room_id", msg.RoomID).Error("PurgeEvents error'd")
+		return err
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	ctx context.Context, msg api.OutputNewRoomEvent,
 ) error {
@@ -173,6 +190,7 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write new event failure")
 		return nil
 	}
+	s.db.UpdateRoomStateSnapshot(ev.RoomID(), msg.StateSnapshotNID, pduPos)
 
 	if pduPos, err = s.notifyJoinedPeeks(ctx, &ev, pduPos); err != nil {
 		logrus.WithError(err).Errorf("Failed to notifyJoinedPeeks for PDU pos %d", pduPos)
@@ -303,6 +321,25 @@ func (s *OutputRoomEventConsumer) onNewPeek(
 	return nil
 }
 
+func (s *OutputRoomEventConsumer) onRetirePeek(
+	ctx context.Context, msg api.OutputRetirePeek,
+) error {
+	sp, err := s.db.DeletePeek(ctx, msg.RoomID, msg.UserID, msg.DeviceID)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: delete peek failure")
+		return nil
+	}
+	// tell the notifier about the retired peek so it stops waking up the device
+	s.notifier.OnRetirePeek(msg.RoomID, msg.UserID, msg.DeviceID)
+
+	// wake up the user so that the room disappears from their peeked rooms
+	s.notifier.OnNewEvent(nil, "", []string{msg.UserID}, types.NewStreamToken(sp, 0, nil))
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) updateStateEvent(event gomatrixserverlib.HeaderedEvent) (gomatrixserverlib.HeaderedEvent, error) {
 	if event.StateKey() == nil {
 		return event, nil
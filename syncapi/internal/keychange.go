@@ -139,6 +139,34 @@ func DeviceListCatchup(
 	return hasNew, nil
 }
 
+// DeviceListResync adds every user who shares a room with the given user to device_lists.changed in the
+// /sync response. This is used instead of DeviceListCatchup when the key changes since the client's sync
+// token may have been trimmed, so the client refetches all of the device lists it is tracking.
+func DeviceListResync(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, userID string, res *types.Response,
+) error {
+	var queryRes roomserverAPI.QuerySharedUsersResponse
+	err := rsAPI.QuerySharedUsers(ctx, &roomserverAPI.QuerySharedUsersRequest{
+		UserID: userID,
+	}, &queryRes)
+	if err != nil {
+		return err
+	}
+	// We should always be told about our own device updates, see filterSharedUsers.
+	queryRes.UserIDsToCount[userID] = 1
+	userSet := make(map[string]bool)
+	for _, userID := range res.DeviceLists.Changed {
+		userSet[userID] = true
+	}
+	for userID := range queryRes.UserIDsToCount {
+		if !userSet[userID] {
+			res.DeviceLists.Changed = append(res.DeviceLists.Changed, userID)
+			userSet[userID] = true
+		}
+	}
+	return nil
+}
+
 // TrackChangedUsers calculates the values of device_lists.changed|left in the /sync response.
 // nolint:gocyclo
 func TrackChangedUsers(
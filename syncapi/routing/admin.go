@@ -0,0 +1,69 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/util"
+)
+
+// A ConsumerResetter deletes everything that a consumer has built from its
+// topic and consumes the topic again from the beginning.
+type ConsumerResetter interface {
+	Reset() error
+}
+
+type resetConsumerResponse struct {
+	Reset bool `json:"reset"`
+}
+
+// SetupAdmin registers the SyncAPI admin HTTP handlers with the given admin
+// router. These require the admin token.
+func SetupAdmin(adminMux *mux.Router, cfg *config.SyncAPI, roomConsumer ConsumerResetter) {
+	v1mux := adminMux.PathPrefix("/v1").Subrouter()
+
+	v1mux.Handle("/syncapi/roomserver/reset",
+		httputil.MakeAdminAPI("admin_syncapi_reset_roomserver", cfg.Matrix.AdminToken, func(req *http.Request) util.JSONResponse {
+			return ResetConsumer(req, roomConsumer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+}
+
+// ResetConsumer implements POST /_dendrite/admin/v1/syncapi/roomserver/reset,
+// which deletes everything that the sync API has built from the roomserver
+// output stream and replays the whole stream to rebuild it.
+func ResetConsumer(req *http.Request, consumer ConsumerResetter) util.JSONResponse {
+	if err := consumer.Reset(); err == internal.ErrResetConsumerGroup {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("consumer.Reset failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resetConsumerResponse{
+			Reset: true,
+		},
+	}
+}
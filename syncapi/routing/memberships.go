@@ -0,0 +1,110 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type getMembershipResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+// GetMemberships implements GET /rooms/{roomId}/members
+//
+// The optional "at" parameter is a sync token, in which case the memberships
+// are returned as they were at that point in the room's history. The
+// "membership" and "not_membership" parameters filter the returned events by
+// their membership, which applies to the requesting user's own membership too.
+// The "limit" parameter caps the number of events returned. However many
+// events are asked for, no more than client_api.page_limits.members are.
+func GetMemberships(
+	req *http.Request, device *userapi.Device, roomID string,
+	syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	cfg *config.SyncAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	membership := query.Get("membership")
+	notMembership := query.Get("not_membership")
+	limit := cfg.PageLimits.Members
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > cfg.PageLimits.Members {
+			limit = cfg.PageLimits.Members
+		}
+	}
+
+	queryReq := api.QueryMembershipsForRoomRequest{
+		RoomID:        roomID,
+		Sender:        device.UserID,
+		Membership:    membership,
+		NotMembership: notMembership,
+		Limit:         limit,
+	}
+	if at := query.Get("at"); at != "" {
+		atToken, err := types.NewStreamTokenFromString(at)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("at must be a valid sync token"),
+			}
+		}
+		// Find the most recent event in the room at that position, so that we
+		// can ask the roomserver for the memberships after it.
+		zeroToken := types.NewStreamToken(0, 0, nil)
+		events, err := syncDB.GetEventsInStreamingRange(req.Context(), &atToken, &zeroToken, roomID, 1, true)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("syncDB.GetEventsInStreamingRange failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(events) > 0 {
+			queryReq.AtEventID = events[0].EventID()
+		}
+	}
+
+	var queryRes api.QueryMembershipsForRoomResponse
+	if err := rsAPI.QueryMembershipsForRoom(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if !queryRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: getMembershipResponse{queryRes.JoinEvents},
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type relationsResp struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// OnIncomingRelationsRequest implements
+// GET /rooms/{roomID}/relations/{eventID}[/{relType}[/{eventType}]]
+func OnIncomingRelationsRequest(
+	req *http.Request, device *userapi.Device, roomID, eventID, relType, eventType string,
+	rsAPI api.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	from, limit, resErr := parsePaginationParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+
+	if resErr = checkHasBeenInRoom(req, rsAPI, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	var relationsRes api.QueryRelationsResponse
+	if err := rsAPI.QueryRelations(req.Context(), &api.QueryRelationsRequest{
+		RoomID:    roomID,
+		EventID:   eventID,
+		RelType:   relType,
+		EventType: eventType,
+		From:      from,
+		Limit:     limit,
+	}, &relationsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRelations failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Apply the same history visibility rules as /messages, since the user
+	// might not be allowed to see all of the relations in a room they were once in.
+	events, err := api.FilterVisibleEvents(req.Context(), rsAPI, device.UserID, relationsRes.Events)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("api.FilterVisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResp{
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+	}
+	if relationsRes.NextBatch > 0 {
+		res.NextBatch = strconv.FormatInt(relationsRes.NextBatch, 10)
+	}
+	if resErr = bundleAggregations(req, rsAPI, userAPI, device.UserID, res.Chunk); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// parsePaginationParams parses the "from" and "limit" query parameters used to
+// page through relations and threads.
+func parsePaginationParams(req *http.Request) (from int64, limit int, resErr *util.JSONResponse) {
+	var err error
+	if s := req.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil || from < 0 {
+			return 0, 0, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from must be a valid pagination token"),
+			}
+		}
+	}
+	limit = api.QueryRelationsMaxLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	return from, limit, nil
+}
+
+// checkHasBeenInRoom returns an error response unless the user is or has been
+// in the room.
+func checkHasBeenInRoom(
+	req *http.Request, rsAPI api.RoomserverInternalAPI, roomID, userID string,
+) *util.JSONResponse {
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(req.Context(), &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: userID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !membershipRes.HasBeenInRoom {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
+		}
+	}
+	return nil
+}
+
+// bundleAggregations adds the aggregated relations of the events to their
+// unsigned data, as seen by the given user.
+func bundleAggregations(
+	req *http.Request, rsAPI api.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+	userID string, events []gomatrixserverlib.ClientEvent,
+) *util.JSONResponse {
+	ignoredUsers, err := eventutil.IgnoredUsers(req.Context(), userAPI, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eventutil.IgnoredUsers failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if err = eventutil.BundleAggregations(req.Context(), rsAPI, userID, ignoredUsers, events); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eventutil.BundleAggregations failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
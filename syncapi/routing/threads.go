@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// OnIncomingThreadsRequest implements GET /rooms/{roomID}/threads. Thread
+// roots are returned most recently active first, each with its thread summary
+// bundled into its unsigned data.
+func OnIncomingThreadsRequest(
+	req *http.Request, device *userapi.Device, roomID string,
+	rsAPI api.RoomserverInternalAPI, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	from, limit, resErr := parsePaginationParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+	include := req.URL.Query().Get("include")
+	switch include {
+	case "":
+		include = api.ThreadsIncludeAll
+	case api.ThreadsIncludeAll, api.ThreadsIncludeParticipated:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("include must be one of 'all' or 'participated'"),
+		}
+	}
+
+	if resErr = checkHasBeenInRoom(req, rsAPI, roomID, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	var threadsRes api.QueryThreadsResponse
+	if err := rsAPI.QueryThreads(req.Context(), &api.QueryThreadsRequest{
+		RoomID:  roomID,
+		UserID:  device.UserID,
+		Include: include,
+		From:    from,
+		Limit:   limit,
+	}, &threadsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryThreads failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Apply the same history visibility rules as /messages, since the user
+	// might not be allowed to see all of the threads in a room they were once in.
+	events, err := api.FilterVisibleEvents(req.Context(), rsAPI, device.UserID, threadsRes.Events)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("api.FilterVisibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResp{
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+	}
+	if threadsRes.NextBatch > 0 {
+		res.NextBatch = strconv.FormatInt(threadsRes.NextBatch, 10)
+	}
+	if resErr = bundleAggregations(req, rsAPI, userAPI, device.UserID, res.Chunk); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
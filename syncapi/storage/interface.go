@@ -46,6 +46,13 @@ type Database interface {
 	// PurgeRoom completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoom(ctx context.Context, roomID string) error
+	// UpdateRoomStateSnapshot records that the event at the given stream position
+	// moved the room to the given roomserver state snapshot, so that the current
+	// state of the room can be cached until it changes again.
+	UpdateRoomStateSnapshot(roomID string, snapshotNID int64, pos types.StreamPosition)
+	// DeleteRoomserverData deletes everything that was built from the roomserver
+	// output, so that it can be rebuilt by consuming the output from the beginning.
+	DeleteRoomserverData(ctx context.Context) error
 	// GetStateEvent returns the Matrix state event of a given type for a given room with a given state key
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
@@ -89,7 +96,10 @@ type Database interface {
 	// AddPeek adds a new peek to our DB for a given room by a given user's device.
 	// Returns an error if there was a problem communicating with the database.
 	AddPeek(ctx context.Context, RoomID, UserID, DeviceID string) (types.StreamPosition, error)
-	// DeletePeek deletes all peeks for a given room by a given user
+	// DeletePeek deletes a peek for a given room by a given user's device.
+	// Returns an error if there was a problem communicating with the database.
+	DeletePeek(ctx context.Context, RoomID, UserID, DeviceID string) (types.StreamPosition, error)
+	// DeletePeeks deletes all peeks for a given room by a given user
 	// Returns an error if there was a problem communicating with the database.
 	DeletePeeks(ctx context.Context, RoomID, UserID string) (types.StreamPosition, error)
 	// SetTypingTimeoutCallback sets a callback function that is called right after
@@ -147,4 +157,16 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
+	// PurgeEvents wipes the content of events which have expired under their room's message retention policy.
+	// Events which aren't in the database are ignored.
+	PurgeEvents(ctx context.Context, eventIDs []string) error
+	// UpdateDeviceListPosition records that the device is syncing from the given device list position.
+	// Returns when the device last synced, or the zero time if it hasn't been seen before.
+	UpdateDeviceListPosition(ctx context.Context, userID, deviceID string, pos types.LogPosition) (lastSync time.Time, err error)
+	// OldestDeviceListPositions returns the lowest device list offset in each partition that a device
+	// which has synced since activeSince is syncing from.
+	OldestDeviceListPositions(ctx context.Context, activeSince time.Time) (map[int32]int64, error)
+	// DeleteInactiveDeviceListPositions forgets the device list positions of devices which haven't
+	// synced since activeSince.
+	DeleteInactiveDeviceListPositions(ctx context.Context, activeSince time.Time) error
 }
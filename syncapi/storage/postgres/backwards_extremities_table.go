@@ -50,11 +50,15 @@ const deleteBackwardExtremitySQL = "" +
 const deleteBackwardExtremitiesForRoomSQL = "" +
 	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
 
+const deleteAllBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities"
+
 type backwardExtremitiesStatements struct {
 	insertBackwardExtremityStmt          *sql.Stmt
 	selectBackwardExtremitiesForRoomStmt *sql.Stmt
 	deleteBackwardExtremityStmt          *sql.Stmt
 	deleteBackwardExtremitiesForRoomStmt *sql.Stmt
+	deleteAllBackwardExtremitiesStmt     *sql.Stmt
 }
 
 func NewPostgresBackwardsExtremitiesTable(db *sql.DB) (tables.BackwardsExtremities, error) {
@@ -75,6 +79,9 @@ func NewPostgresBackwardsExtremitiesTable(db *sql.DB) (tables.BackwardsExtremiti
 	if s.deleteBackwardExtremitiesForRoomStmt, err = db.Prepare(deleteBackwardExtremitiesForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllBackwardExtremitiesStmt, err = db.Prepare(deleteAllBackwardExtremitiesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -120,3 +127,11 @@ func (s *backwardExtremitiesStatements) DeleteBackwardExtremitiesForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteBackwardExtremitiesForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *backwardExtremitiesStatements) DeleteAllBackwardExtremities(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllBackwardExtremitiesStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -98,6 +98,9 @@ const selectEventsWithEventIDsSQL = "" +
 	"SELECT added_at, headered_event_json, 0 AS session_id, false AS exclude_from_sync, '' AS transaction_id" +
 	" FROM syncapi_current_room_state WHERE event_id = ANY($1)"
 
+const deleteAllRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state"
+
 type currentRoomStateStatements struct {
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
@@ -107,6 +110,7 @@ type currentRoomStateStatements struct {
 	selectJoinedUsersStmt           *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	deleteAllRoomStateStmt          *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -139,6 +143,9 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllRoomStateStmt, err = db.Prepare(deleteAllRoomStateSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -310,3 +317,11 @@ func (s *currentRoomStateStatements) SelectStateEvent(
 	}
 	return &ev, err
 }
+
+func (s *currentRoomStateStatements) DeleteAllRoomState(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllRoomStateStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -75,6 +75,9 @@ const selectMaxPositionInTopologySQL = "" +
 const deleteTopologyForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteAllTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt       *sql.Stmt
 	selectEventIDsInRangeASCStmt    *sql.Stmt
@@ -82,6 +85,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 	deleteTopologyForRoomStmt       *sql.Stmt
+	deleteAllTopologyStmt           *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -108,6 +112,9 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.deleteTopologyForRoomStmt, err = db.Prepare(deleteTopologyForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllTopologyStmt, err = db.Prepare(deleteAllTopologySQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -182,3 +189,11 @@ func (s *outputRoomEventsTopologyStatements) DeleteTopologyForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteTopologyForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteAllTopology(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllTopologyStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -82,6 +82,18 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	deviceListPositions, err := NewPostgresDeviceListPositionsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	stateCache, err := shared.NewStateCache(shared.StateCacheMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	timelineCache, err := shared.NewTimelineCache(shared.TimelineCacheMaxEntries)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -94,7 +106,25 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		BackwardExtremities: backwardExtremities,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
+		DeviceListPositions: deviceListPositions,
 		EDUCache:            cache.New(),
+		StateCache:          stateCache,
+		TimelineCache:       timelineCache,
 	}
 	return &d, nil
 }
+
+// NewReadReplica creates a sync server database which reads from a replica
+// of the primary database. The in-memory EDU and state caches are shared with
+// the primary, since the replica never sees EDUs and would otherwise duplicate
+// the cached room state.
+func NewReadReplica(primary *SyncServerDatasource, dbProperties *config.DatabaseOptions) (*SyncServerDatasource, error) {
+	d, err := NewDatabase(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	d.EDUCache = primary.EDUCache
+	d.StateCache = primary.StateCache
+	d.TimelineCache = primary.TimelineCache
+	return d, nil
+}
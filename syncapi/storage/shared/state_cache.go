@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StateCacheMaxEntries is the number of room/filter combinations for which
+// we will hold the current state in memory, and the number of rooms whose
+// current state snapshot we remember.
+const StateCacheMaxEntries = 1024
+
+var stateCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "state_cache_lookups_total",
+		Help:      "Number of current room state cache lookups, by outcome (hit or miss)",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(stateCacheLookups)
+}
+
+// StateCache holds the current state of rooms, as seen by the sync API, so
+// that we don't have to reload and unmarshal the entire room state for every
+// sync request. Entries are keyed on the roomserver state snapshot that they
+// were built from, so a room's entries are only used while the room is still
+// at that snapshot. Rooms whose snapshot we don't know yet, e.g. straight
+// after starting up, aren't cached until their state next changes.
+type StateCache struct {
+	lru       *lru.Cache
+	snapshots *lru.Cache // room ID -> roomSnapshot
+}
+
+// roomSnapshot is the roomserver state snapshot that a room is at, and the
+// stream position of the event that moved the room to that snapshot.
+type roomSnapshot struct {
+	snapshotNID int64
+	pos         types.StreamPosition
+}
+
+// NewStateCache creates a new state cache holding up to maxEntries entries.
+func NewStateCache(maxEntries int) (*StateCache, error) {
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &StateCache{
+		lru:       cache,
+		snapshots: snapshots,
+	}, nil
+}
+
+func stateCacheKey(roomID string, snapshotNID int64, stateFilter *gomatrixserverlib.StateFilter) string {
+	filter, _ := json.Marshal(stateFilter)
+	return roomID + "\x1f" + strconv.FormatInt(snapshotNID, 10) + "\x1f" + string(filter)
+}
+
+// SetRoomSnapshot records that the event at the given stream position moved
+// the room to the given state snapshot. A snapshot NID of 0 means that the
+// snapshot isn't known.
+func (c *StateCache) SetRoomSnapshot(roomID string, snapshotNID int64, pos types.StreamPosition) {
+	if c == nil {
+		return
+	}
+	if snapshotNID == 0 {
+		c.snapshots.Remove(roomID)
+		return
+	}
+	c.snapshots.Add(roomID, roomSnapshot{snapshotNID, pos})
+}
+
+// key returns the cache key for the room's current state snapshot. The key
+// is only returned if the caller, which has seen events up to maxPos, can see
+// the state of that snapshot.
+func (c *StateCache) key(
+	roomID string, stateFilter *gomatrixserverlib.StateFilter, maxPos types.StreamPosition,
+) (string, bool) {
+	val, ok := c.snapshots.Get(roomID)
+	if !ok {
+		return "", false
+	}
+	snapshot := val.(roomSnapshot)
+	if maxPos < snapshot.pos {
+		return "", false
+	}
+	return stateCacheKey(roomID, snapshot.snapshotNID, stateFilter), true
+}
+
+// Get returns the cached state for the room at its current state snapshot.
+// maxPos is the latest stream position that the caller can see.
+func (c *StateCache) Get(
+	roomID string, stateFilter *gomatrixserverlib.StateFilter, maxPos types.StreamPosition,
+) ([]types.StreamEvent, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key, ok := c.key(roomID, stateFilter, maxPos)
+	if !ok {
+		stateCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	val, ok := c.lru.Get(key)
+	if !ok {
+		stateCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	stateCacheLookups.WithLabelValues("hit").Inc()
+	return val.([]types.StreamEvent), true
+}
+
+// Set stores the state for the room at its current state snapshot. maxPos is
+// the latest stream position that the caller loaded the state at.
+func (c *StateCache) Set(
+	roomID string, stateFilter *gomatrixserverlib.StateFilter, maxPos types.StreamPosition,
+	events []types.StreamEvent,
+) {
+	if c == nil {
+		return
+	}
+	if key, ok := c.key(roomID, stateFilter, maxPos); ok {
+		c.lru.Add(key, events)
+	}
+}
+
+// Purge removes all cached state.
+func (c *StateCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.lru.Purge()
+	c.snapshots.Purge()
+}
+
+// InvalidateRoom removes all cached state for the given room, regardless
+// of the snapshot or filter that was used to build it.
+func (c *StateCache) InvalidateRoom(roomID string) {
+	if c == nil {
+		return
+	}
+	prefix := roomID + "\x1f"
+	for _, key := range c.lru.Keys() {
+		if strings.HasPrefix(key.(string), prefix) {
+			c.lru.Remove(key)
+		}
+	}
+}
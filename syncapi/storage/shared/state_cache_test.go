@@ -0,0 +1,56 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestStateCache(t *testing.T) {
+	cache, err := NewStateCache(10)
+	if err != nil {
+		t.Fatalf("NewStateCache: %s", err)
+	}
+	filter := gomatrixserverlib.DefaultStateFilter()
+	state := []types.StreamEvent{{StreamPosition: 1}}
+
+	// Rooms aren't cached until we know which snapshot they are at.
+	cache.Set("!room:test", &filter, 5, state)
+	if _, ok := cache.Get("!room:test", &filter, 5); ok {
+		t.Fatalf("expected miss for a room with no known snapshot")
+	}
+
+	cache.SetRoomSnapshot("!room:test", 100, 5)
+	if _, ok := cache.Get("!room:test", &filter, 5); ok {
+		t.Fatalf("expected miss on empty cache")
+	}
+	cache.Set("!room:test", &filter, 5, state)
+	if got, ok := cache.Get("!room:test", &filter, 7); !ok || len(got) != 1 {
+		t.Fatalf("expected hit at the same snapshot")
+	}
+	if _, ok := cache.Get("!room:test", &filter, 4); ok {
+		t.Fatalf("expected miss for a caller that can't see the snapshot yet")
+	}
+
+	cache.SetRoomSnapshot("!room:test", 101, 8)
+	if _, ok := cache.Get("!room:test", &filter, 8); ok {
+		t.Fatalf("expected miss at a new snapshot")
+	}
+	// A caller still reading from before the new snapshot mustn't store
+	// its older state under the new snapshot.
+	cache.Set("!room:test", &filter, 7, state)
+	if _, ok := cache.Get("!room:test", &filter, 8); ok {
+		t.Fatalf("expected older state not to be stored for the new snapshot")
+	}
+
+	// Going back to an earlier snapshot finds the state cached for it.
+	cache.SetRoomSnapshot("!room:test", 100, 9)
+	if _, ok := cache.Get("!room:test", &filter, 9); !ok {
+		t.Fatalf("expected hit when returning to an earlier snapshot")
+	}
+	cache.InvalidateRoom("!room:test")
+	if _, ok := cache.Get("!room:test", &filter, 9); ok {
+		t.Fatalf("expected miss after invalidation")
+	}
+}
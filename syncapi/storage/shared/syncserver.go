@@ -47,7 +47,10 @@ type Database struct {
 	BackwardExtremities tables.BackwardsExtremities
 	SendToDevice        tables.SendToDevice
 	Filter              tables.Filter
+	DeviceListPositions tables.DeviceListPositions
 	EDUCache            *cache.EDUCache
+	StateCache          *StateCache
+	TimelineCache       *TimelineCache
 }
 
 // Events lookups a list of event by their event ID.
@@ -176,6 +179,23 @@ func (d *Database) AddPeek(
 	return
 }
 
+// DeletePeek tracks the fact that a user has stopped peeking from the specified
+// device. If the peek was successfully deleted this returns the stream ID it was
+// stored at. Returns an error if there was a problem communicating with the database.
+func (d *Database) DeletePeek(
+	ctx context.Context, roomID, userID, deviceID string,
+) (sp types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		sp, err = d.Peeks.DeletePeek(ctx, txn, roomID, userID, deviceID)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		sp = 0
+		err = nil
+	}
+	return
+}
+
 // DeletePeeks tracks the fact that a user has stopped peeking from all devices
 // If the peeks was successfully deleted this returns the stream ID it was stored at.
 // Returns an error if there was a problem communicating with the database.
@@ -295,8 +315,46 @@ func (d *Database) PurgeRoom(
 		if err := d.BackwardExtremities.DeleteBackwardExtremitiesForRoom(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("d.BackwardExtremities.DeleteBackwardExtremitiesForRoom: %w", err)
 		}
+		d.StateCache.InvalidateRoom(roomID)
+		d.TimelineCache.InvalidateRoom(roomID)
+		return nil
+	})
+}
+
+// UpdateRoomStateSnapshot records that the event at the given stream position
+// moved the room to the given roomserver state snapshot.
+func (d *Database) UpdateRoomStateSnapshot(roomID string, snapshotNID int64, pos types.StreamPosition) {
+	d.StateCache.SetRoomSnapshot(roomID, snapshotNID, pos)
+}
+
+// DeleteRoomserverData deletes everything that was built from the roomserver
+// output, so that it can be rebuilt by consuming the output from the
+// beginning. Account data, send-to-device messages and filters are kept.
+func (d *Database) DeleteRoomserverData(ctx context.Context) error {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.OutputEvents.DeleteAllEvents(ctx, txn); err != nil {
+			return fmt.Errorf("d.OutputEvents.DeleteAllEvents: %w", err)
+		}
+		if err := d.Topology.DeleteAllTopology(ctx, txn); err != nil {
+			return fmt.Errorf("d.Topology.DeleteAllTopology: %w", err)
+		}
+		if err := d.CurrentRoomState.DeleteAllRoomState(ctx, txn); err != nil {
+			return fmt.Errorf("d.CurrentRoomState.DeleteAllRoomState: %w", err)
+		}
+		if err := d.BackwardExtremities.DeleteAllBackwardExtremities(ctx, txn); err != nil {
+			return fmt.Errorf("d.BackwardExtremities.DeleteAllBackwardExtremities: %w", err)
+		}
+		if err := d.Invites.DeleteAllInvites(ctx, txn); err != nil {
+			return fmt.Errorf("d.Invites.DeleteAllInvites: %w", err)
+		}
+		if err := d.Peeks.DeleteAllPeeks(ctx, txn); err != nil {
+			return fmt.Errorf("d.Peeks.DeleteAllPeeks: %w", err)
+		}
 		return nil
 	})
+	d.StateCache.Purge()
+	d.TimelineCache.Purge()
+	return err
 }
 
 func (d *Database) WriteEvent(
@@ -598,6 +656,36 @@ func (d *Database) PutFilter(
 	return filterID, err
 }
 
+func (d *Database) UpdateDeviceListPosition(
+	ctx context.Context, userID, deviceID string, pos types.LogPosition,
+) (lastSync time.Time, err error) {
+	lastSyncTS, err := d.DeviceListPositions.SelectLastSyncTS(ctx, nil, userID, deviceID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if lastSyncTS != 0 {
+		lastSync = lastSyncTS.Time()
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DeviceListPositions.UpsertDeviceListPosition(ctx, txn, userID, deviceID, pos, gomatrixserverlib.AsTimestamp(time.Now()))
+	})
+	return lastSync, err
+}
+
+func (d *Database) OldestDeviceListPositions(
+	ctx context.Context, activeSince time.Time,
+) (map[int32]int64, error) {
+	return d.DeviceListPositions.SelectOldestPositions(ctx, nil, gomatrixserverlib.AsTimestamp(activeSince))
+}
+
+func (d *Database) DeleteInactiveDeviceListPositions(
+	ctx context.Context, activeSince time.Time,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DeviceListPositions.DeleteInactiveDevices(ctx, txn, gomatrixserverlib.AsTimestamp(activeSince))
+	})
+}
+
 func (d *Database) IncrementalSync(
 	ctx context.Context, res *types.Response,
 	device userapi.Device,
@@ -662,6 +750,32 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
 		return d.OutputEvents.UpdateEventJSON(ctx, &newEvent)
 	})
+	d.StateCache.InvalidateRoom(newEvent.RoomID())
+	d.TimelineCache.InvalidateRoom(newEvent.RoomID())
+	return err
+}
+
+func (d *Database) PurgeEvents(ctx context.Context, eventIDs []string) error {
+	purgedEvents, err := d.Events(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	rooms := make(map[string]struct{})
+	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		for i := range purgedEvents {
+			ev := purgedEvents[i].Redact()
+			newEvent := ev.Headered(purgedEvents[i].RoomVersion)
+			if err = d.OutputEvents.UpdateEventJSON(ctx, &newEvent); err != nil {
+				return err
+			}
+			rooms[newEvent.RoomID()] = struct{}{}
+		}
+		return nil
+	})
+	for roomID := range rooms {
+		d.StateCache.InvalidateRoom(roomID)
+		d.TimelineCache.InvalidateRoom(roomID)
+	}
 	return err
 }
 
@@ -762,39 +876,15 @@ func (d *Database) getJoinResponseForCompleteSync(
 	//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
 	var recentStreamEvents []types.StreamEvent
 	var limited bool
-	recentStreamEvents, limited, err = d.OutputEvents.SelectRecentEvents(
-		ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
+	recentStreamEvents, limited, err = d.recentSyncEvents(
+		ctx, txn, roomID, r, numRecentEventsPerRoom,
 	)
 	if err != nil {
 		return
 	}
 
-	// TODO FIXME: We don't fully implement history visibility yet. To avoid leaking events which the
-	// user shouldn't see, we check the recent events and remove any prior to the join event of the user
-	// which is equiv to history_visibility: joined
-	joinEventIndex := -1
-	for i := len(recentStreamEvents) - 1; i >= 0; i-- {
-		ev := recentStreamEvents[i]
-		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(device.UserID) {
-			membership, _ := ev.Membership()
-			if membership == "join" {
-				joinEventIndex = i
-				if i > 0 {
-					// the create event happens before the first join, so we should cut it at that point instead
-					if recentStreamEvents[i-1].Type() == gomatrixserverlib.MRoomCreate && recentStreamEvents[i-1].StateKeyEquals("") {
-						joinEventIndex = i - 1
-						break
-					}
-				}
-				break
-			}
-		}
-	}
-	if joinEventIndex != -1 {
-		// cut all events earlier than the join (but not the join itself)
-		recentStreamEvents = recentStreamEvents[joinEventIndex:]
-		limited = false // so clients know not to try to backpaginate
-	}
+	// Events which the user isn't allowed to see because of the history
+	// visibility of the room are removed by the request pool.
 
 	// Retrieve the backward topology position, i.e. the position of the
 	// oldest event in the room's topology.
@@ -901,6 +991,19 @@ func (d *Database) getBackwardTopologyPos(
 	return tok, nil
 }
 
+// recentSyncEvents returns the most recent events in the room within the
+// range which should be sent down /sync, oldest first. The results are shared
+// through the timeline cache between all of the sync requests which wake up
+// for the same change to the room.
+func (d *Database) recentSyncEvents(
+	ctx context.Context, txn *sql.Tx,
+	roomID string, r types.Range, limit int,
+) ([]types.StreamEvent, bool, error) {
+	return d.TimelineCache.RecentEvents(roomID, r, limit, func(r types.Range, limit int) ([]types.StreamEvent, bool, error) {
+		return d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, r, limit, true, true)
+	})
+}
+
 // addRoomDeltaToResponse adds a room state delta to a sync response
 func (d *Database) addRoomDeltaToResponse(
 	ctx context.Context,
@@ -912,17 +1015,12 @@ func (d *Database) addRoomDeltaToResponse(
 	res *types.Response,
 ) error {
 	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
-		// make sure we don't leak recent events after the leave event.
-		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
-		// TODO: This doesn't work for join -> leave in a single /sync request (see events prior to join).
-		// TODO: This will fail on join -> leave -> sensitive msg -> join -> leave
-		//       in a single /sync request
-		// This is all "okay" assuming history_visibility == "shared" which it is by default.
+		// make sure we don't leak recent events after the leave event. The
+		// remaining events are filtered by history visibility in the request pool.
 		r.To = delta.membershipPos
 	}
-	recentStreamEvents, limited, err := d.OutputEvents.SelectRecentEvents(
-		ctx, txn, delta.roomID, r,
-		numRecentEventsPerRoom, true, true,
+	recentStreamEvents, limited, err := d.recentSyncEvents(
+		ctx, txn, delta.roomID, r, numRecentEventsPerRoom,
 	)
 	if err != nil {
 		return err
@@ -1256,6 +1354,18 @@ func (d *Database) currentStateStreamEventsForRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	stateFilter *gomatrixserverlib.StateFilter,
 ) ([]types.StreamEvent, error) {
+	// If we already have the state for the room's current state snapshot
+	// cached then there's no need to go back to the database for the entire
+	// room state. The cache needs to know how far through the stream this
+	// transaction can see, so that it doesn't give us a snapshot newer than
+	// the rest of the sync response.
+	maxPos, err := d.OutputEvents.SelectMaxEventID(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := d.StateCache.Get(roomID, stateFilter, types.StreamPosition(maxPos)); ok {
+		return s, nil
+	}
 	allState, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, stateFilter)
 	if err != nil {
 		return nil, err
@@ -1264,6 +1374,7 @@ func (d *Database) currentStateStreamEventsForRoom(
 	for i := 0; i < len(s); i++ {
 		s[i] = types.StreamEvent{HeaderedEvent: allState[i], StreamPosition: 0}
 	}
+	d.StateCache.Set(roomID, stateFilter, types.StreamPosition(maxPos), s)
 	return s, nil
 }
 
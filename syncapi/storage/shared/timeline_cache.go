@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TimelineCacheMaxEntries is the number of room timelines which we will
+// hold in memory.
+const TimelineCacheMaxEntries = 4096
+
+var timelineCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "timeline_cache_lookups_total",
+		Help:      "Number of room timeline cache lookups, by outcome (hit, shared or miss)",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(timelineCacheLookups)
+}
+
+// TimelineLoader loads the most recent events in a room within the given
+// range, as returned by OutputRoomEvents.SelectRecentEvents in chronological
+// order.
+type TimelineLoader func(r types.Range, limit int) ([]types.StreamEvent, bool, error)
+
+// TimelineCache holds the most recent events in rooms, as seen by the sync
+// API at a given stream position. When an event is sent into a room, every
+// request waiting on that room wakes up at the same position: the cache
+// makes sure that the room's timeline is only loaded once for all of them,
+// regardless of the position that each request is syncing from.
+//
+// Events at or below a stream position never change, other than by being
+// redacted or purged, so entries only need invalidating in those cases.
+type TimelineCache struct {
+	lru         *lru.Cache
+	mu          sync.Mutex
+	loading     map[string]*timelineLoad
+	invalidated uint64 // incremented every time a room is invalidated
+}
+
+// timelineCacheEntry holds the most recent limit+1 events in the room at
+// or below the stream position, oldest first. If there are fewer than
+// limit+1 events then these are all of the events in the room.
+type timelineCacheEntry struct {
+	events []types.StreamEvent
+}
+
+type timelineLoad struct {
+	done  chan struct{}
+	entry *timelineCacheEntry
+	err   error
+}
+
+// NewTimelineCache creates a new timeline cache holding up to maxEntries
+// entries.
+func NewTimelineCache(maxEntries int) (*TimelineCache, error) {
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &TimelineCache{
+		lru:     cache,
+		loading: make(map[string]*timelineLoad),
+	}, nil
+}
+
+func timelineCacheKey(roomID string, to types.StreamPosition, limit int) string {
+	return fmt.Sprintf("%s\x1f%d\x1f%d", roomID, to, limit)
+}
+
+// RecentEvents returns the same results as calling load with the given
+// range and limit. Forward ranges are served from the cache: if the room's
+// timeline at r.To isn't cached yet then it is loaded once, and any other
+// requests for the same room and position wait for that load rather than
+// hitting the database themselves.
+func (c *TimelineCache) RecentEvents(
+	roomID string, r types.Range, limit int, load TimelineLoader,
+) ([]types.StreamEvent, bool, error) {
+	if c == nil || r.Backwards || limit <= 0 {
+		return load(r, limit)
+	}
+	key := timelineCacheKey(roomID, r.To, limit)
+
+	c.mu.Lock()
+	if val, ok := c.lru.Get(key); ok {
+		c.mu.Unlock()
+		timelineCacheLookups.WithLabelValues("hit").Inc()
+		events, limited := val.(*timelineCacheEntry).since(r.From, limit)
+		return events, limited, nil
+	}
+	if l, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		<-l.done
+		if l.err != nil {
+			// The load failed, possibly because of the transaction or
+			// context it was running in, so try again ourselves.
+			return load(r, limit)
+		}
+		timelineCacheLookups.WithLabelValues("shared").Inc()
+		events, limited := l.entry.since(r.From, limit)
+		return events, limited, nil
+	}
+	l := &timelineLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	invalidated := c.invalidated
+	c.mu.Unlock()
+	timelineCacheLookups.WithLabelValues("miss").Inc()
+
+	// Load one more event than we need, so that we can work out whether
+	// the timeline is limited for any position that we are syncing from.
+	var events []types.StreamEvent
+	events, _, l.err = load(types.Range{From: 0, To: r.To}, limit+1)
+	if l.err == nil {
+		l.entry = &timelineCacheEntry{events: events}
+	}
+
+	c.mu.Lock()
+	delete(c.loading, key)
+	if l.err == nil && c.invalidated == invalidated {
+		c.lru.Add(key, l.entry)
+	}
+	c.mu.Unlock()
+	close(l.done)
+
+	if l.err != nil {
+		return nil, false, l.err
+	}
+	events, limited := l.entry.since(r.From, limit)
+	return events, limited, nil
+}
+
+// since returns up to limit of the most recent events after the given
+// position, and whether there were more events than that.
+func (e *timelineCacheEntry) since(from types.StreamPosition, limit int) ([]types.StreamEvent, bool) {
+	start := len(e.events)
+	for start > 0 && e.events[start-1].StreamPosition > from {
+		start--
+	}
+	limited := false
+	if len(e.events)-start > limit {
+		limited = true
+		start = len(e.events) - limit
+	}
+	// Return a copy so that callers can't modify the cached entry.
+	events := make([]types.StreamEvent, len(e.events)-start)
+	copy(events, e.events[start:])
+	return events, limited
+}
+
+// InvalidateRoom removes all cached timelines for the given room. Any loads
+// which are in progress when the room is invalidated will not be cached.
+func (c *TimelineCache) InvalidateRoom(roomID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidated++
+	prefix := roomID + "\x1f"
+	for _, key := range c.lru.Keys() {
+		if strings.HasPrefix(key.(string), prefix) {
+			c.lru.Remove(key)
+		}
+	}
+}
+
+// Purge removes all cached timelines. Any loads which are in progress will
+// not be cached.
+func (c *TimelineCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidated++
+	c.lru.Purge()
+}
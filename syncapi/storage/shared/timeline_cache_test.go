@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// fakeTimeline behaves like SelectRecentEvents in chronological order over
+// a room containing one event at each of the given positions.
+func fakeTimeline(positions ...types.StreamPosition) (TimelineLoader, *int32) {
+	var calls int32
+	return func(r types.Range, limit int) ([]types.StreamEvent, bool, error) {
+		atomic.AddInt32(&calls, 1)
+		var events []types.StreamEvent
+		for _, pos := range positions {
+			if pos > r.Low() && pos <= r.High() {
+				events = append(events, types.StreamEvent{StreamPosition: pos})
+			}
+		}
+		if len(events) > limit {
+			return events[len(events)-limit:], true, nil
+		}
+		return events, false, nil
+	}, &calls
+}
+
+func TestTimelineCacheMatchesDatabase(t *testing.T) {
+	load, _ := fakeTimeline(2, 3, 5, 8, 9, 12)
+	for limit := 1; limit <= 7; limit++ {
+		for from := types.StreamPosition(0); from <= 12; from++ {
+			cache, err := NewTimelineCache(10)
+			if err != nil {
+				t.Fatalf("NewTimelineCache: %s", err)
+			}
+			r := types.Range{From: from, To: 12}
+			wantEvents, wantLimited, _ := load(r, limit)
+			gotEvents, gotLimited, err := cache.RecentEvents("!room:test", r, limit, load)
+			if err != nil {
+				t.Fatalf("RecentEvents: %s", err)
+			}
+			if fmt.Sprint(gotEvents) != fmt.Sprint(wantEvents) || gotLimited != wantLimited {
+				t.Errorf("from %d limit %d: got %v (limited %v), want %v (limited %v)", from, limit, gotEvents, gotLimited, wantEvents, wantLimited)
+			}
+		}
+	}
+}
+
+func TestTimelineCacheSharesLoads(t *testing.T) {
+	cache, err := NewTimelineCache(10)
+	if err != nil {
+		t.Fatalf("NewTimelineCache: %s", err)
+	}
+	inner, calls := fakeTimeline(1, 2, 3, 4)
+	release := make(chan struct{})
+	load := func(r types.Range, limit int) ([]types.StreamEvent, bool, error) {
+		<-release
+		return inner(r, limit)
+	}
+
+	// Lots of requests syncing from different positions all wake up for
+	// the same change to the room.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(from types.StreamPosition) {
+			defer wg.Done()
+			events, _, err := cache.RecentEvents("!room:test", types.Range{From: from, To: 4}, 10, load)
+			if err != nil {
+				t.Errorf("RecentEvents: %s", err)
+				return
+			}
+			if want := 4 - int(from); len(events) != want {
+				t.Errorf("from %d: got %d events, want %d", from, len(events), want)
+			}
+		}(types.StreamPosition(i % 4))
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("expected the timeline to be loaded once, loaded %d times", n)
+	}
+}
+
+func TestTimelineCacheInvalidateRoom(t *testing.T) {
+	cache, err := NewTimelineCache(10)
+	if err != nil {
+		t.Fatalf("NewTimelineCache: %s", err)
+	}
+	load, calls := fakeTimeline(1, 2, 3)
+	r := types.Range{From: 0, To: 3}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err = cache.RecentEvents("!room:test", r, 10, load); err != nil {
+			t.Fatalf("RecentEvents: %s", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("expected 1 load before invalidation, got %d", n)
+	}
+	cache.InvalidateRoom("!room:test")
+	if _, _, err = cache.RecentEvents("!room:test", r, 10, load); err != nil {
+		t.Fatalf("RecentEvents: %s", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Fatalf("expected 2 loads after invalidation, got %d", n)
+	}
+
+	// A redaction which happens while the timeline is being loaded must
+	// stop the possibly stale result from being cached.
+	cache.InvalidateRoom("!room:test")
+	racing := func(r types.Range, limit int) ([]types.StreamEvent, bool, error) {
+		cache.InvalidateRoom("!room:test")
+		return load(r, limit)
+	}
+	if _, _, err = cache.RecentEvents("!room:test", r, 10, racing); err != nil {
+		t.Fatalf("RecentEvents: %s", err)
+	}
+	if _, _, err = cache.RecentEvents("!room:test", r, 10, load); err != nil {
+		t.Fatalf("RecentEvents: %s", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 4 {
+		t.Fatalf("expected 4 loads after racing invalidation, got %d", n)
+	}
+}
@@ -50,12 +50,16 @@ const deleteBackwardExtremitySQL = "" +
 const deleteBackwardExtremitiesForRoomSQL = "" +
 	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
 
+const deleteAllBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities"
+
 type backwardExtremitiesStatements struct {
 	db                                   *sql.DB
 	insertBackwardExtremityStmt          *sql.Stmt
 	selectBackwardExtremitiesForRoomStmt *sql.Stmt
 	deleteBackwardExtremityStmt          *sql.Stmt
 	deleteBackwardExtremitiesForRoomStmt *sql.Stmt
+	deleteAllBackwardExtremitiesStmt     *sql.Stmt
 }
 
 func NewSqliteBackwardsExtremitiesTable(db *sql.DB) (tables.BackwardsExtremities, error) {
@@ -78,6 +82,9 @@ func NewSqliteBackwardsExtremitiesTable(db *sql.DB) (tables.BackwardsExtremities
 	if s.deleteBackwardExtremitiesForRoomStmt, err = db.Prepare(deleteBackwardExtremitiesForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllBackwardExtremitiesStmt, err = db.Prepare(deleteAllBackwardExtremitiesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -123,3 +130,11 @@ func (s *backwardExtremitiesStatements) DeleteBackwardExtremitiesForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteBackwardExtremitiesForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *backwardExtremitiesStatements) DeleteAllBackwardExtremities(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllBackwardExtremitiesStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -86,6 +86,9 @@ const selectEventsWithEventIDsSQL = "" +
 	"SELECT added_at, headered_event_json, 0 AS session_id, false AS exclude_from_sync, '' AS transaction_id" +
 	" FROM syncapi_current_room_state WHERE event_id IN ($1)"
 
+const deleteAllRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state"
+
 type currentRoomStateStatements struct {
 	db                              *sql.DB
 	streamIDStatements              *streamIDStatements
@@ -96,6 +99,7 @@ type currentRoomStateStatements struct {
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	deleteAllRoomStateStmt          *sql.Stmt
 }
 
 func NewSqliteCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (tables.CurrentRoomState, error) {
@@ -128,6 +132,9 @@ func NewSqliteCurrentRoomStateTable(db *sql.DB, streamID *streamIDStatements) (t
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllRoomStateStmt, err = db.Prepare(deleteAllRoomStateSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -321,3 +328,11 @@ func (s *currentRoomStateStatements) SelectStateEvent(
 	}
 	return &ev, err
 }
+
+func (s *currentRoomStateStatements) DeleteAllRoomState(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllRoomStateStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const deviceListPositionsSchema = `
+-- Stores the device list position that each device last synced from.
+CREATE TABLE IF NOT EXISTS syncapi_device_list_positions (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	partition INTEGER NOT NULL,
+	log_offset INTEGER NOT NULL,
+	-- When the device last synced in UNIX epoch ms.
+	last_sync_ts INTEGER NOT NULL,
+	UNIQUE (user_id, device_id)
+);
+`
+
+const upsertDeviceListPositionSQL = "" +
+	"INSERT INTO syncapi_device_list_positions (user_id, device_id, partition, log_offset, last_sync_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id, device_id)" +
+	" DO UPDATE SET partition = $3, log_offset = $4, last_sync_ts = $5"
+
+const selectLastSyncTSSQL = "" +
+	"SELECT last_sync_ts FROM syncapi_device_list_positions WHERE user_id = $1 AND device_id = $2"
+
+const selectOldestPositionsSQL = "" +
+	"SELECT partition, MIN(log_offset) FROM syncapi_device_list_positions WHERE last_sync_ts >= $1 GROUP BY partition"
+
+const deleteInactiveDevicesSQL = "" +
+	"DELETE FROM syncapi_device_list_positions WHERE last_sync_ts < $1"
+
+type deviceListPositionsStatements struct {
+	upsertDeviceListPositionStmt *sql.Stmt
+	selectLastSyncTSStmt         *sql.Stmt
+	selectOldestPositionsStmt    *sql.Stmt
+	deleteInactiveDevicesStmt    *sql.Stmt
+}
+
+func NewSqliteDeviceListPositionsTable(db *sql.DB) (tables.DeviceListPositions, error) {
+	s := &deviceListPositionsStatements{}
+	_, err := db.Exec(deviceListPositionsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertDeviceListPositionStmt, err = db.Prepare(upsertDeviceListPositionSQL); err != nil {
+		return nil, err
+	}
+	if s.selectLastSyncTSStmt, err = db.Prepare(selectLastSyncTSSQL); err != nil {
+		return nil, err
+	}
+	if s.selectOldestPositionsStmt, err = db.Prepare(selectOldestPositionsSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteInactiveDevicesStmt, err = db.Prepare(deleteInactiveDevicesSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *deviceListPositionsStatements) UpsertDeviceListPosition(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, pos types.LogPosition, lastSyncTS gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertDeviceListPositionStmt).ExecContext(ctx, userID, deviceID, pos.Partition, pos.Offset, lastSyncTS)
+	return err
+}
+
+func (s *deviceListPositionsStatements) SelectLastSyncTS(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string,
+) (gomatrixserverlib.Timestamp, error) {
+	var lastSyncTS gomatrixserverlib.Timestamp
+	err := sqlutil.TxStmt(txn, s.selectLastSyncTSStmt).QueryRowContext(ctx, userID, deviceID).Scan(&lastSyncTS)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return lastSyncTS, err
+}
+
+func (s *deviceListPositionsStatements) SelectOldestPositions(
+	ctx context.Context, txn *sql.Tx, activeSince gomatrixserverlib.Timestamp,
+) (map[int32]int64, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectOldestPositionsStmt).QueryContext(ctx, activeSince)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectOldestPositions: rows.close() failed")
+	positions := make(map[int32]int64)
+	for rows.Next() {
+		var partition int32
+		var offset int64
+		if err = rows.Scan(&partition, &offset); err != nil {
+			return nil, err
+		}
+		positions[partition] = offset
+	}
+	return positions, rows.Err()
+}
+
+func (s *deviceListPositionsStatements) DeleteInactiveDevices(
+	ctx context.Context, txn *sql.Tx, activeSince gomatrixserverlib.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteInactiveDevicesStmt).ExecContext(ctx, activeSince)
+	return err
+}
@@ -64,6 +64,9 @@ const selectPeekingDevicesSQL = "" +
 const selectMaxPeekIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_peeks"
 
+const deleteAllPeeksSQL = "" +
+	"DELETE FROM syncapi_peeks"
+
 type peekStatements struct {
 	db                       *sql.DB
 	streamIDStatements       *streamIDStatements
@@ -73,6 +76,7 @@ type peekStatements struct {
 	selectPeeksInRangeStmt   *sql.Stmt
 	selectPeekingDevicesStmt *sql.Stmt
 	selectMaxPeekIDStmt      *sql.Stmt
+	deleteAllPeeksStmt       *sql.Stmt
 }
 
 func NewSqlitePeeksTable(db *sql.DB, streamID *streamIDStatements) (tables.Peeks, error) {
@@ -102,6 +106,9 @@ func NewSqlitePeeksTable(db *sql.DB, streamID *streamIDStatements) (tables.Peeks
 	if s.selectMaxPeekIDStmt, err = db.Prepare(selectMaxPeekIDSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllPeeksStmt, err = db.Prepare(deleteAllPeeksSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -204,3 +211,11 @@ func (s *peekStatements) SelectMaxPeekID(
 	}
 	return
 }
+
+func (s *peekStatements) DeleteAllPeeks(
+	ctx context.Context, txn *sql.Tx,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteAllPeeksStmt)
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
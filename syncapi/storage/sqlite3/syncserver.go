@@ -95,6 +95,18 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	deviceListPositions, err := NewSqliteDeviceListPositionsTable(d.db)
+	if err != nil {
+		return err
+	}
+	stateCache, err := shared.NewStateCache(shared.StateCacheMaxEntries)
+	if err != nil {
+		return err
+	}
+	timelineCache, err := shared.NewTimelineCache(shared.TimelineCacheMaxEntries)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Writer:              d.writer,
@@ -107,7 +119,10 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		Topology:            topology,
 		Filter:              filter,
 		SendToDevice:        sendToDevice,
+		DeviceListPositions: deviceListPositions,
 		EDUCache:            cache.New(),
+		StateCache:          stateCache,
+		TimelineCache:       timelineCache,
 	}
 	return nil
 }
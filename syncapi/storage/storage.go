@@ -35,3 +35,13 @@ func NewSyncServerDatasource(dbProperties *config.DatabaseOptions) (Database, er
 		return nil, fmt.Errorf("unexpected database type")
 	}
 }
+
+// NewSyncServerReadReplica opens a connection to a read replica of the given
+// primary sync server database.
+func NewSyncServerReadReplica(primary Database, dbProperties *config.DatabaseOptions) (Database, error) {
+	pg, ok := primary.(*postgres.SyncServerDatasource)
+	if !ok {
+		return nil, fmt.Errorf("read replicas are only supported with Postgres")
+	}
+	return postgres.NewReadReplica(pg, dbProperties)
+}
@@ -142,6 +142,52 @@ func TestWriteEvents(t *testing.T) {
 	MustWriteEvents(t, db, events)
 }
 
+func TestDeleteRoomserverData(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+
+	if err := db.DeleteRoomserverData(ctx); err != nil {
+		t.Fatalf("DeleteRoomserverData failed: %s", err)
+	}
+	found, err := db.Events(ctx, []string{events[0].EventID(), events[len(events)-1].EventID()})
+	if err != nil {
+		t.Fatalf("Events failed: %s", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("expected the events to be deleted, found %d", len(found))
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	state, err := db.GetStateEventsForRoom(ctx, testRoomID, &stateFilter)
+	if err != nil {
+		t.Fatalf("GetStateEventsForRoom failed: %s", err)
+	}
+	if len(state) != 0 {
+		t.Errorf("expected the room state to be deleted, found %d events", len(state))
+	}
+	joined, err := db.AllJoinedUsersInRooms(ctx)
+	if err != nil {
+		t.Fatalf("AllJoinedUsersInRooms failed: %s", err)
+	}
+	if len(joined) != 0 {
+		t.Errorf("expected no joined users, got %v", joined)
+	}
+
+	// Replaying the events rebuilds the room, without reusing stream positions.
+	replayed := MustWriteEvents(t, db, events)
+	if replayed[0] <= positions[len(positions)-1] {
+		t.Errorf("replayed event has stream position %d, want more than %d", replayed[0], positions[len(positions)-1])
+	}
+	state, err = db.GetStateEventsForRoom(ctx, testRoomID, &stateFilter)
+	if err != nil {
+		t.Fatalf("GetStateEventsForRoom failed: %s", err)
+	}
+	if len(state) != 3 {
+		t.Errorf("expected 3 state events after replaying, got %d", len(state))
+	}
+}
+
 // These tests assert basic functionality of the IncrementalSync and CompleteSync functions.
 func TestSyncResponse(t *testing.T) {
 	t.Parallel()
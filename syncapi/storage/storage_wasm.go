@@ -32,3 +32,9 @@ func NewSyncServerDatasource(dbProperties *config.DatabaseOptions) (Database, er
 		return nil, fmt.Errorf("unexpected database type")
 	}
 }
+
+// NewSyncServerReadReplica opens a connection to a read replica of the given
+// primary sync server database.
+func NewSyncServerReadReplica(primary Database, dbProperties *config.DatabaseOptions) (Database, error) {
+	return nil, fmt.Errorf("can't use Postgres implementation")
+}
@@ -33,6 +33,8 @@ type AccountData interface {
 type Invites interface {
 	InsertInviteEvent(ctx context.Context, txn *sql.Tx, inviteEvent gomatrixserverlib.HeaderedEvent) (streamPos types.StreamPosition, err error)
 	DeleteInviteEvent(ctx context.Context, txn *sql.Tx, inviteEventID string) (types.StreamPosition, error)
+	// DeleteAllInvites removes all invites. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllInvites(ctx context.Context, txn *sql.Tx) (err error)
 	// SelectInviteEventsInRange returns a map of room ID to invite events. If multiple invite/retired invites exist in the given range, return the latest value
 	// for the room.
 	SelectInviteEventsInRange(ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range) (invites map[string]gomatrixserverlib.HeaderedEvent, retired map[string]gomatrixserverlib.HeaderedEvent, err error)
@@ -43,6 +45,8 @@ type Peeks interface {
 	InsertPeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) (streamPos types.StreamPosition, err error)
 	DeletePeek(ctx context.Context, txn *sql.Tx, roomID, userID, deviceID string) (streamPos types.StreamPosition, err error)
 	DeletePeeks(ctx context.Context, txn *sql.Tx, roomID, userID string) (streamPos types.StreamPosition, err error)
+	// DeleteAllPeeks removes all peeks. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllPeeks(ctx context.Context, txn *sql.Tx) (err error)
 	SelectPeeksInRange(ctxt context.Context, txn *sql.Tx, userID, deviceID string, r types.Range) (peeks []types.Peek, err error)
 	SelectPeekingDevices(ctxt context.Context) (peekingDevices map[string][]types.PeekingDevice, err error)
 	SelectMaxPeekID(ctx context.Context, txn *sql.Tx) (id int64, err error)
@@ -62,6 +66,8 @@ type Events interface {
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
 	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteAllEvents removes all events. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllEvents(ctx context.Context, txn *sql.Tx) (err error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -81,6 +87,8 @@ type Topology interface {
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
 	// DeleteTopologyForRoom removes all topological information for a room. This should only be done when removing the room entirely.
 	DeleteTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteAllTopology removes all topological information. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllTopology(ctx context.Context, txn *sql.Tx) (err error)
 }
 
 type CurrentRoomState interface {
@@ -89,6 +97,8 @@ type CurrentRoomState interface {
 	UpsertRoomState(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition) error
 	DeleteRoomStateByEventID(ctx context.Context, txn *sql.Tx, eventID string) error
 	DeleteRoomStateForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// DeleteAllRoomState removes the state of all rooms. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllRoomState(ctx context.Context, txn *sql.Tx) (err error)
 	// SelectCurrentState returns all the current state events for the given room.
 	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter) ([]gomatrixserverlib.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
@@ -125,6 +135,8 @@ type BackwardsExtremities interface {
 	DeleteBackwardExtremity(ctx context.Context, txn *sql.Tx, roomID, knownEventID string) (err error)
 	// DeleteBackwardExtremitiesFoorRoomID removes all backward extremities for a room. This should only be done when removing the room entirely.
 	DeleteBackwardExtremitiesForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteAllBackwardExtremities removes all backward extremities. This should only be done when rebuilding the table from the roomserver output.
+	DeleteAllBackwardExtremities(ctx context.Context, txn *sql.Tx) (err error)
 }
 
 // SendToDevice tracks send-to-device messages which are sent to individual
@@ -152,6 +164,19 @@ type SendToDevice interface {
 	CountSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string) (count int, err error)
 }
 
+// DeviceListPositions records the device list position that each device last
+// synced from, so that device list changes can be trimmed once every active
+// device has synced past them.
+type DeviceListPositions interface {
+	UpsertDeviceListPosition(ctx context.Context, txn *sql.Tx, userID, deviceID string, pos types.LogPosition, lastSyncTS gomatrixserverlib.Timestamp) error
+	// SelectLastSyncTS returns when the device last synced, or 0 if it isn't known.
+	SelectLastSyncTS(ctx context.Context, txn *sql.Tx, userID, deviceID string) (gomatrixserverlib.Timestamp, error)
+	// SelectOldestPositions returns the lowest offset in each partition that a device which has synced since activeSince is at.
+	SelectOldestPositions(ctx context.Context, txn *sql.Tx, activeSince gomatrixserverlib.Timestamp) (map[int32]int64, error)
+	// DeleteInactiveDevices removes the positions of devices which haven't synced since activeSince.
+	DeleteInactiveDevices(ctx context.Context, txn *sql.Tx, activeSince gomatrixserverlib.Timestamp) error
+}
+
 type Filter interface {
 	SelectFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
 	InsertFilter(ctx context.Context, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
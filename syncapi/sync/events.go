@@ -0,0 +1,163 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// defaultEventsLimit is the maximum number of events returned from a single
+// /events request.
+const defaultEventsLimit = 100
+
+type eventsResponse struct {
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+// OnIncomingEventsRequest implements GET /events?room_id=..., which streams the
+// new events in a single room to a device. If the user isn't joined to the room
+// then the device starts peeking into it, which is only allowed for
+// world-readable rooms. The global form of /events without a room_id is not
+// supported; clients should use /sync instead.
+func (rp *RequestPool) OnIncomingEventsRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	rp.markSeen(device)
+
+	roomID := req.URL.Query().Get("room_id")
+	if roomID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("room_id is required, use /sync for all rooms"),
+		}
+	}
+	from := rp.notifier.CurrentPosition()
+	if s := req.URL.Query().Get("from"); s != "" {
+		var err error
+		if from, err = types.NewStreamTokenFromString(s); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("bad 'from' value"),
+			}
+		}
+	}
+	var timeout time.Duration
+	if s := req.URL.Query().Get("timeout"); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("bad 'timeout' value"),
+			}
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		if rp.cfg.MaxSyncTimeout > 0 && timeout > rp.cfg.MaxSyncTimeout {
+			timeout = rp.cfg.MaxSyncTimeout
+		}
+	}
+
+	// Make sure that the device will be woken up for new events in the room.
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := rp.rsAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		var peekRes roomserverAPI.PerformPeekResponse
+		rp.rsAPI.PerformPeek(req.Context(), &roomserverAPI.PerformPeekRequest{
+			RoomIDOrAlias: roomID,
+			UserID:        device.UserID,
+			DeviceID:      device.ID,
+		}, &peekRes)
+		if peekRes.Error != nil {
+			return peekRes.Error.JSONResponse()
+		}
+	}
+
+	syncReq := syncRequest{
+		ctx:     req.Context(),
+		device:  *device,
+		limit:   defaultEventsLimit,
+		timeout: timeout,
+		since:   &from,
+		log:     util.GetLogger(req.Context()),
+	}
+	listener := rp.notifier.GetListener(syncReq)
+	defer listener.Close()
+
+	start := from
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		events, end, err := rp.eventsInRange(syncReq, roomID, from, rp.notifier.CurrentPosition())
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rp.eventsInRange failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(events) > 0 || timeout == 0 {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{
+					Start: start.String(),
+					End:   end.String(),
+					Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+				},
+			}
+		}
+		// Nothing that the user can see has happened yet, so wait for more.
+		from = end
+		select {
+		case <-listener.GetNotifyChannel(end):
+		case <-timer.C:
+			// Respond with no events, but with an end token so that the
+			// client can carry on from here.
+			timeout = 0
+		case <-req.Context().Done():
+			return jsonerror.InternalServerError()
+		}
+	}
+}
+
+// eventsInRange returns the events in the room between the two positions
+// which the user is allowed to see, along with the position that the next
+// request should start from.
+func (rp *RequestPool) eventsInRange(
+	req syncRequest, roomID string, from, to types.StreamingToken,
+) ([]gomatrixserverlib.HeaderedEvent, types.StreamingToken, error) {
+	streamEvents, err := rp.db.GetEventsInStreamingRange(req.ctx, &from, &to, roomID, req.limit, false)
+	if err != nil {
+		return nil, to, err
+	}
+	end := to
+	if len(streamEvents) == req.limit {
+		// There may be more events, so carry on from the last one returned.
+		end = types.NewStreamToken(streamEvents[len(streamEvents)-1].StreamPosition, from.EDUPosition(), nil)
+	}
+	events := rp.db.StreamEventsToEvents(&req.device, streamEvents)
+	events, err = roomserverAPI.FilterVisibleEvents(req.ctx, rp.rsAPI, req.device.UserID, events)
+	return events, end, err
+}
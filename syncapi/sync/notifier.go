@@ -137,6 +137,18 @@ func (n *Notifier) OnNewPeek(
 	// by calling OnNewEvent.
 }
 
+func (n *Notifier) OnRetirePeek(
+	roomID, userID, deviceID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.removePeekingDevice(roomID, userID, deviceID)
+
+	// we don't wake up devices here given the roomserver consumer will do this shortly afterwards
+	// by calling OnNewEvent.
+}
+
 func (n *Notifier) OnNewSendToDevice(
 	userID string, deviceIDs []string,
 	posUpdate types.StreamingToken,
@@ -168,8 +180,8 @@ func (n *Notifier) GetListener(req syncRequest) UserDeviceStreamListener {
 	// - Incoming events wake requests for a matching room ID
 	// - Incoming events wake requests for a matching user ID (needed for invites)
 
-	// TODO: v1 /events 'peeking' has an 'explicit room ID' which is also tracked,
-	//       but given we don't do /events, let's pretend it doesn't exist.
+	// - /events for a room that the user isn't joined to peeks into the room,
+	//   so incoming events wake the device up as a peeking device
 
 	n.streamLock.Lock()
 	defer n.streamLock.Unlock()
@@ -339,7 +351,6 @@ func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
 }
 
 // Not thread-safe: must be called on the OnNewEvent goroutine only
-// nolint:unused
 func (n *Notifier) removePeekingDevice(roomID, userID, deviceID string) {
 	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
 		n.roomIDToPeekingDevices[roomID] = make(peekingDeviceSet)
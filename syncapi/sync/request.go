@@ -30,6 +30,11 @@ import (
 )
 
 const defaultSyncTimeout = time.Duration(0)
+
+// minSyncTimeout is the shortest time that we will hold a /sync long-poll
+// open for, if the client asked us to wait at all. This stops clients that
+// send tiny timeouts from busy-looping against the server.
+const minSyncTimeout = time.Second
 const DefaultTimelineLimit = 20
 
 type filter struct {
@@ -49,10 +54,13 @@ type syncRequest struct {
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
 	log           *log.Entry
+	// Set if the device list changes since the token may have been trimmed,
+	// in which case the client is sent a full device list resync.
+	resyncDeviceLists bool
 }
 
-func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database) (*syncRequest, error) {
-	timeout := getTimeout(req.URL.Query().Get("timeout"))
+func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Database, maxTimeout time.Duration) (*syncRequest, error) {
+	timeout := getTimeout(req.URL.Query().Get("timeout"), maxTimeout)
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
 	var since *types.StreamingToken
@@ -104,13 +112,23 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 	}, nil
 }
 
-func getTimeout(timeoutMS string) time.Duration {
+// getTimeout parses the requested timeout, clamping it to between
+// minSyncTimeout and maxTimeout. A timeout of 0 is left alone since
+// that asks for the sync to return immediately.
+func getTimeout(timeoutMS string, maxTimeout time.Duration) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
 	}
 	i, err := strconv.Atoi(timeoutMS)
-	if err != nil {
+	if err != nil || i <= 0 {
 		return defaultSyncTimeout
 	}
-	return time.Duration(i) * time.Millisecond
+	timeout := time.Duration(i) * time.Millisecond
+	switch {
+	case timeout < minSyncTimeout:
+		return minSyncTimeout
+	case maxTimeout > 0 && timeout > maxTimeout:
+		return maxTimeout
+	}
+	return timeout
 }
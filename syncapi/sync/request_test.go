@@ -0,0 +1,27 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetTimeout(t *testing.T) {
+	maxTimeout := time.Minute
+	tests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{"", defaultSyncTimeout},
+		{"not a number", defaultSyncTimeout},
+		{"0", defaultSyncTimeout},
+		{"-5", defaultSyncTimeout},
+		{"1", minSyncTimeout},
+		{"30000", 30 * time.Second},
+		{"3600000", maxTimeout},
+	}
+	for _, test := range tests {
+		if got := getTimeout(test.input, maxTimeout); got != test.want {
+			t.Errorf("getTimeout(%q): got %s, want %s", test.input, got, test.want)
+		}
+	}
+}
@@ -20,9 +20,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/internal"
@@ -31,6 +35,7 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -41,14 +46,326 @@ type RequestPool struct {
 	notifier *Notifier
 	keyAPI   keyapi.KeyInternalAPI
 	rsAPI    roomserverAPI.RoomserverInternalAPI
+	cfg      *config.SyncAPI
+	builders chan struct{} // limits concurrent sync builds, nil if unlimited
+	// Optional read replica, used for building sync responses while it is
+	// healthy and has caught up with the position being synced to.
+	replica       storage.Database
+	replicaHealth *sqlutil.ReadReplica
+	// The last time that each peeking device was seen syncing, keyed by
+	// types.PeekingDevice. Devices which haven't been seen since startup are
+	// treated as having been seen at startup.
+	lastSeen  sync.Map
+	startTime time.Time
+	// Closed when shutting down, to make long-polls respond straight away.
+	draining  chan struct{}
+	drainOnce sync.Once
+	// The background tasks run until ctx is cancelled by Stop.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
 }
 
+// peekExpiry is how long a device can go without syncing before its peeks
+// are cancelled.
+const peekExpiry = 15 * time.Minute
+
+// peekExpiryInterval is how often stale peeks are looked for.
+var peekExpiryInterval = time.Minute
+
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
-	db storage.Database, n *Notifier, userAPI userapi.UserInternalAPI, keyAPI keyapi.KeyInternalAPI,
+	db storage.Database, cfg *config.SyncAPI, n *Notifier, userAPI userapi.UserInternalAPI, keyAPI keyapi.KeyInternalAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI,
 ) *RequestPool {
-	return &RequestPool{db, userAPI, n, keyAPI, rsAPI}
+	rp := &RequestPool{
+		db:        db,
+		userAPI:   userAPI,
+		notifier:  n,
+		keyAPI:    keyAPI,
+		rsAPI:     rsAPI,
+		cfg:       cfg,
+		startTime: time.Now(),
+		draining:  make(chan struct{}),
+	}
+	rp.ctx, rp.cancel = context.WithCancel(context.Background())
+	if cfg.MaxConcurrentSyncs > 0 {
+		rp.builders = make(chan struct{}, cfg.MaxConcurrentSyncs)
+	}
+	rp.workers.Add(1)
+	go rp.expirePeeks()
+	if cfg.StreamRetention.Interval > 0 {
+		rp.workers.Add(1)
+		go rp.trimDeviceListChanges()
+	}
+	return rp
+}
+
+// Drain makes every /sync long-poll, including any that start from now on,
+// respond straight away with whatever there is to send, so that the HTTP
+// server can shut down without waiting for the long-polls to time out.
+func (rp *RequestPool) Drain(ctx context.Context) error {
+	rp.drainOnce.Do(func() {
+		close(rp.draining)
+	})
+	return nil
+}
+
+// Stop stops the background tasks of the request pool, waiting for any work
+// they are doing to finish or for the context to be done.
+func (rp *RequestPool) Stop(ctx context.Context) error {
+	rp.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		rp.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// markSeen records that the device is still syncing, so that its peeks are
+// kept alive.
+func (rp *RequestPool) markSeen(device *userapi.Device) {
+	rp.lastSeen.Store(types.PeekingDevice{UserID: device.UserID, DeviceID: device.ID}, time.Now())
+}
+
+// expirePeeks periodically cancels the peeks of devices which have stopped
+// syncing, as they are no longer interested in the peeked rooms.
+func (rp *RequestPool) expirePeeks() {
+	defer rp.workers.Done()
+	ticker := time.NewTicker(peekExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx := rp.ctx
+		peekingDevices, err := rp.db.AllPeekingDevicesInRooms(ctx)
+		if err != nil {
+			log.WithError(err).Error("Failed to get peeking devices")
+			continue
+		}
+		expireBefore := time.Now().Add(-peekExpiry)
+		for roomID, devices := range peekingDevices {
+			for _, device := range devices {
+				lastSeen := rp.startTime
+				if t, ok := rp.lastSeen.Load(device); ok {
+					lastSeen = t.(time.Time)
+				}
+				if lastSeen.After(expireBefore) {
+					continue
+				}
+				var res roomserverAPI.PerformUnpeekResponse
+				rp.rsAPI.PerformUnpeek(ctx, &roomserverAPI.PerformUnpeekRequest{
+					RoomID:   roomID,
+					UserID:   device.UserID,
+					DeviceID: device.DeviceID,
+				}, &res)
+				if res.Error != nil {
+					log.WithError(res.Error).WithField("room_id", roomID).Error("Failed to expire peek")
+					continue
+				}
+				rp.lastSeen.Delete(device)
+			}
+		}
+	}
+}
+
+// SetReadReplica configures a read replica of the sync database that will be
+// used to build sync responses when possible.
+func (rp *RequestPool) SetReadReplica(replica storage.Database, health *sqlutil.ReadReplica) {
+	rp.replica = replica
+	rp.replicaHealth = health
+}
+
+// readDB returns the database that a sync response up to latestPos should be
+// built from. The read replica is only used if it is healthy and has already
+// replicated all events up to latestPos, so that responses are never missing
+// events that the notifier has woken us up for.
+func (rp *RequestPool) readDB(ctx context.Context, latestPos types.StreamingToken) storage.Database {
+	if rp.replica == nil || !rp.replicaHealth.Healthy() {
+		return rp.db
+	}
+	replicaPos, err := rp.replica.SyncPosition(ctx)
+	if err != nil || replicaPos.PDUPosition() < latestPos.PDUPosition() {
+		return rp.db
+	}
+	return rp.replica
+}
+
+// acquireBuilder waits for a free sync builder slot. It returns false if the
+// request was cancelled before a slot became free. When true is returned, the
+// caller must call releaseBuilder once the sync response has been built.
+func (rp *RequestPool) acquireBuilder(ctx context.Context) bool {
+	if rp.builders == nil {
+		return true
+	}
+	select {
+	case rp.builders <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (rp *RequestPool) releaseBuilder() {
+	if rp.builders != nil {
+		<-rp.builders
+	}
+}
+
+// buildSync builds the sync response for the request once a sync builder
+// slot is available, so that a burst of wakeups doesn't hit the database all
+// at once. If getPos is not nil, the position is fetched only once the slot
+// has been acquired, so that any changes which arrived while queueing are
+// coalesced into a single sync response.
+func (rp *RequestPool) buildSync(
+	req syncRequest, pos types.StreamingToken, getPos func() types.StreamingToken,
+) (*types.Response, types.StreamingToken, error) {
+	if !rp.acquireBuilder(req.ctx) {
+		return nil, pos, req.ctx.Err()
+	}
+	defer rp.releaseBuilder()
+	if getPos != nil {
+		pos = getPos()
+	}
+	res, err := rp.currentSyncForUser(req, pos)
+	if err != nil {
+		return res, pos, err
+	}
+	if err = rp.filterHistoryVisible(req, res); err != nil {
+		return res, pos, err
+	}
+	err = rp.bundleAggregations(req, res)
+	return res, pos, err
+}
+
+// filterHistoryVisible removes the timeline events which the user isn't
+// allowed to see because of the history visibility of the room from the sync
+// response, using the same rules as /messages. All rooms are handled in a
+// single request to the roomserver, which works out the visibility of all of
+// the events in each room in one go.
+func (rp *RequestPool) filterHistoryVisible(req syncRequest, res *types.Response) error {
+	var eventIDs []string
+	for _, room := range res.Rooms.Join {
+		for _, ev := range room.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	for _, room := range res.Rooms.Peek {
+		for _, ev := range room.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	for _, room := range res.Rooms.Leave {
+		for _, ev := range room.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	var visibleRes roomserverAPI.QueryEventsVisibleToUserResponse
+	if err := rp.rsAPI.QueryEventsVisibleToUser(req.ctx, &roomserverAPI.QueryEventsVisibleToUserRequest{
+		UserID:   req.device.UserID,
+		EventIDs: eventIDs,
+	}, &visibleRes); err != nil {
+		return err
+	}
+	// filter removes the events which the user isn't allowed to see from a
+	// timeline. If any are removed then the timeline is limited, and the
+	// prev_batch token is moved to just before the oldest remaining event.
+	filter := func(
+		events []gomatrixserverlib.ClientEvent, limited bool, prevBatch string,
+	) ([]gomatrixserverlib.ClientEvent, bool, string, error) {
+		visible := events[:0]
+		for _, ev := range events {
+			if visibleRes.VisibleEventIDs[ev.EventID] {
+				visible = append(visible, ev)
+			}
+		}
+		if len(visible) == len(events) {
+			return visible, limited, prevBatch, nil
+		}
+		if len(visible) > 0 {
+			tok, err := rp.db.EventPositionInTopology(req.ctx, visible[0].EventID)
+			if err != nil {
+				return nil, false, "", fmt.Errorf("rp.db.EventPositionInTopology: %w", err)
+			}
+			tok.Decrement()
+			prevBatch = tok.String()
+		}
+		return visible, true, prevBatch, nil
+	}
+	var err error
+	for roomID, room := range res.Rooms.Join {
+		if room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch, err = filter(
+			room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch,
+		); err != nil {
+			return err
+		}
+		res.Rooms.Join[roomID] = room
+	}
+	for roomID, room := range res.Rooms.Peek {
+		if room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch, err = filter(
+			room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch,
+		); err != nil {
+			return err
+		}
+		res.Rooms.Peek[roomID] = room
+	}
+	for roomID, room := range res.Rooms.Leave {
+		if room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch, err = filter(
+			room.Timeline.Events, room.Timeline.Limited, room.Timeline.PrevBatch,
+		); err != nil {
+			return err
+		}
+		res.Rooms.Leave[roomID] = room
+	}
+	return nil
+}
+
+// bundleAggregations adds the aggregated relations of all of the timeline
+// events in the sync response to their unsigned data. All rooms are handled
+// in a single request to the roomserver.
+func (rp *RequestPool) bundleAggregations(req syncRequest, res *types.Response) error {
+	var timelines [][]gomatrixserverlib.ClientEvent
+	for _, room := range res.Rooms.Join {
+		timelines = append(timelines, room.Timeline.Events)
+	}
+	for _, room := range res.Rooms.Peek {
+		timelines = append(timelines, room.Timeline.Events)
+	}
+	for _, room := range res.Rooms.Leave {
+		timelines = append(timelines, room.Timeline.Events)
+	}
+	var events []gomatrixserverlib.ClientEvent
+	for _, timeline := range timelines {
+		events = append(events, timeline...)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	ignoredUsers, err := eventutil.IgnoredUsers(req.ctx, rp.userAPI, req.device.UserID)
+	if err != nil {
+		return err
+	}
+	if err = eventutil.BundleAggregations(req.ctx, rp.rsAPI, req.device.UserID, ignoredUsers, events); err != nil {
+		return err
+	}
+	// The timelines share their backing arrays with the response, so copying
+	// the bundled events back updates the response in place.
+	for _, timeline := range timelines {
+		events = events[copy(timeline, events):]
+	}
+	return nil
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -56,15 +373,17 @@ func NewRequestPool(
 // until a response is ready, or it times out.
 func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	var syncData *types.Response
+	rp.markSeen(device)
 
 	// Extract values from request
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.cfg.MaxSyncTimeout)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown(err.Error()),
 		}
 	}
+	syncReq.resyncDeviceLists = rp.updateDeviceListPosition(syncReq)
 
 	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
 		"user_id":   device.UserID,
@@ -77,7 +396,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	currPos := rp.notifier.CurrentPosition()
 
 	if rp.shouldReturnImmediately(syncReq) {
-		syncData, err = rp.currentSyncForUser(*syncReq, currPos)
+		syncData, _, err = rp.buildSync(*syncReq, currPos, nil)
 		if err != nil {
 			logger.WithError(err).Error("rp.currentSyncForUser failed")
 			return jsonerror.InternalServerError()
@@ -104,13 +423,13 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 	// respond with, so we skip the return an go back to waiting for content to
 	// be sent down or the request timing out.
 	var hasTimedOut bool
+	var getPos func() types.StreamingToken
 	sincePos := *syncReq.since
 	for {
 		select {
 		// Wait for notifier to wake us up
 		case <-userStreamListener.GetNotifyChannel(sincePos):
-			currPos = userStreamListener.GetSyncPosition()
-			sincePos = currPos
+			getPos = userStreamListener.GetSyncPosition
 		// Or for timeout to expire
 		case <-timer.C:
 			// We just need to ensure we get out of the select after reaching the
@@ -118,6 +437,9 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			// apart from that, so we do nothing except stating we're timing out
 			// and need to respond.
 			hasTimedOut = true
+		// Or for the server to shut down, which is treated as a timeout
+		case <-rp.draining:
+			hasTimedOut = true
 		// Or for the request to be cancelled
 		case <-req.Context().Done():
 			logger.WithError(err).Error("request cancelled")
@@ -127,8 +449,10 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		// Note that we don't time out during calculation of sync
 		// response. This ensures that we don't waste the hard work
 		// of calculating the sync only to get timed out before we
-		// can respond
-		syncData, err = rp.currentSyncForUser(*syncReq, currPos)
+		// can respond. We do, however, queue for a sync builder slot,
+		// picking up any further updates that arrive while we wait.
+		syncData, currPos, err = rp.buildSync(*syncReq, currPos, getPos)
+		sincePos = currPos
 		if err != nil {
 			logger.WithError(err).Error("rp.currentSyncForUser failed")
 			return jsonerror.InternalServerError()
@@ -193,10 +517,33 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 	}
 }
 
+var syncBuildDurations = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "sync_build_duration_seconds",
+		Help:      "How long it takes to build a sync response",
+	},
+	// The type label is either "complete" for initial syncs or "incremental".
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(syncBuildDurations)
+}
+
 // nolint:gocyclo
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.StreamingToken) (*types.Response, error) {
 	res := types.NewResponse()
 
+	syncType := "incremental"
+	if req.since.PDUPosition() == 0 && req.since.EDUPosition() == 0 {
+		syncType = "complete"
+	}
+	defer func(start time.Time) {
+		syncBuildDurations.WithLabelValues(syncType).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	// See if we have any new tasks to do for the send-to-device messaging.
 	events, updates, deletions, err := rp.db.SendToDeviceUpdatesForSync(req.ctx, req.device.UserID, req.device.ID, *req.since)
 	if err != nil {
@@ -204,13 +551,14 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	}
 
 	// TODO: handle ignored users
+	db := rp.readDB(req.ctx, latestPos)
 	if req.since.PDUPosition() == 0 && req.since.EDUPosition() == 0 {
-		res, err = rp.db.CompleteSync(req.ctx, res, req.device, req.limit)
+		res, err = db.CompleteSync(req.ctx, res, req.device, req.limit)
 		if err != nil {
 			return res, fmt.Errorf("rp.db.CompleteSync: %w", err)
 		}
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, req.limit, req.wantFullState)
+		res, err = db.IncrementalSync(req.ctx, res, req.device, *req.since, latestPos, req.limit, req.wantFullState)
 		if err != nil {
 			return res, fmt.Errorf("rp.db.IncrementalSync: %w", err)
 		}
@@ -225,6 +573,11 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.Strea
 	if err != nil {
 		return res, fmt.Errorf("rp.appendDeviceLists: %w", err)
 	}
+	if req.resyncDeviceLists {
+		if err = internal.DeviceListResync(req.ctx, rp.rsAPI, req.device.UserID, res); err != nil {
+			return res, fmt.Errorf("internal.DeviceListResync: %w", err)
+		}
+	}
 	err = internal.DeviceOTKCounts(req.ctx, rp.keyAPI, req.device.UserID, req.device.ID, res)
 	if err != nil {
 		return res, fmt.Errorf("internal.DeviceOTKCounts: %w", err)
@@ -0,0 +1,165 @@
+package sync
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type visibilityRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	visible  map[string]bool
+	requests int
+}
+
+func (r *visibilityRoomserverAPI) QueryEventsVisibleToUser(
+	ctx context.Context, req *roomserverAPI.QueryEventsVisibleToUserRequest, res *roomserverAPI.QueryEventsVisibleToUserResponse,
+) error {
+	r.requests++
+	res.VisibleEventIDs = make(map[string]bool)
+	for _, eventID := range req.EventIDs {
+		res.VisibleEventIDs[eventID] = r.visible[eventID]
+	}
+	return nil
+}
+
+type topologyDatabase struct {
+	storage.Database
+	positions map[string]types.TopologyToken
+}
+
+func (d *topologyDatabase) EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error) {
+	return d.positions[eventID], nil
+}
+
+func TestFilterHistoryVisible(t *testing.T) {
+	rsAPI := &visibilityRoomserverAPI{
+		visible: map[string]bool{
+			"$visible1:test": true,
+			"$visible2:test": true,
+			"$visible3:test": true,
+		},
+	}
+	db := &topologyDatabase{
+		positions: map[string]types.TopologyToken{
+			"$visible2:test": types.NewTopologyToken(5, 10),
+			"$visible3:test": types.NewTopologyToken(3, 7),
+		},
+	}
+	rp := &RequestPool{db: db, rsAPI: rsAPI}
+
+	timeline := func(eventIDs ...string) []gomatrixserverlib.ClientEvent {
+		events := make([]gomatrixserverlib.ClientEvent, len(eventIDs))
+		for i := range eventIDs {
+			events[i].EventID = eventIDs[i]
+		}
+		return events
+	}
+	res := types.NewResponse()
+	allVisible := *types.NewJoinResponse()
+	allVisible.Timeline.Events = timeline("$visible1:test")
+	allVisible.Timeline.PrevBatch = "unchanged"
+	res.Rooms.Join["!all:test"] = allVisible
+	someHidden := *types.NewJoinResponse()
+	someHidden.Timeline.Events = timeline("$hidden1:test", "$visible2:test", "$hidden2:test")
+	someHidden.Timeline.PrevBatch = "before-hidden"
+	res.Rooms.Join["!some:test"] = someHidden
+	left := *types.NewLeaveResponse()
+	left.Timeline.Events = timeline("$hidden3:test", "$visible3:test")
+	res.Rooms.Leave["!left:test"] = left
+
+	req := syncRequest{
+		ctx:    context.Background(),
+		device: userapi.Device{UserID: "@alice:test"},
+	}
+	if err := rp.filterHistoryVisible(req, res); err != nil {
+		t.Fatalf("filterHistoryVisible: %s", err)
+	}
+	if rsAPI.requests != 1 {
+		t.Fatalf("expected a single roomserver request for all rooms, got %d", rsAPI.requests)
+	}
+
+	got := res.Rooms.Join["!all:test"].Timeline
+	if len(got.Events) != 1 || got.Limited || got.PrevBatch != "unchanged" {
+		t.Errorf("timeline with no hidden events was changed: %+v", got)
+	}
+
+	got = res.Rooms.Join["!some:test"].Timeline
+	if len(got.Events) != 1 || got.Events[0].EventID != "$visible2:test" {
+		t.Errorf("expected only the visible event, got %+v", got.Events)
+	}
+	wantPrevBatch := types.NewTopologyToken(5, 10)
+	wantPrevBatch.Decrement()
+	if !got.Limited || got.PrevBatch != wantPrevBatch.String() {
+		t.Errorf("expected limited timeline with prev_batch %s, got limited %v prev_batch %s", wantPrevBatch.String(), got.Limited, got.PrevBatch)
+	}
+
+	gotLeave := res.Rooms.Leave["!left:test"].Timeline
+	wantPrevBatch = types.NewTopologyToken(3, 7)
+	wantPrevBatch.Decrement()
+	if len(gotLeave.Events) != 1 || !gotLeave.Limited || gotLeave.PrevBatch != wantPrevBatch.String() {
+		t.Errorf("expected filtered leave timeline, got %+v", gotLeave)
+	}
+}
+
+type peekingDatabase struct {
+	storage.Database
+	calls int32
+	trims int32
+}
+
+func (d *peekingDatabase) AllPeekingDevicesInRooms(ctx context.Context) (map[string][]types.PeekingDevice, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return nil, nil
+}
+
+func (d *peekingDatabase) OldestDeviceListPositions(ctx context.Context, activeSince time.Time) (map[int32]int64, error) {
+	atomic.AddInt32(&d.trims, 1)
+	return nil, nil
+}
+
+func (d *peekingDatabase) DeleteInactiveDeviceListPositions(ctx context.Context, activeSince time.Time) error {
+	return nil
+}
+
+func TestStopEndsBackgroundTasks(t *testing.T) {
+	defer func(interval time.Duration) {
+		peekExpiryInterval = interval
+	}(peekExpiryInterval)
+	peekExpiryInterval = time.Millisecond
+
+	db := &peekingDatabase{}
+	cfg := &config.SyncAPI{
+		StreamRetention: config.StreamRetention{Interval: time.Millisecond},
+	}
+	rp := NewRequestPool(db, cfg, nil, nil, nil, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rp.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	if atomic.LoadInt32(&db.calls) == 0 {
+		t.Fatalf("expected stale peeks to have been looked for before stopping")
+	}
+	if atomic.LoadInt32(&db.trims) == 0 {
+		t.Fatalf("expected device list changes to have been trimmed before stopping")
+	}
+	calls, trims := atomic.LoadInt32(&db.calls), atomic.LoadInt32(&db.trims)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&db.calls); got != calls {
+		t.Errorf("expected no more work after stopping, got %d more calls", got-calls)
+	}
+	if got := atomic.LoadInt32(&db.trims); got != trims {
+		t.Errorf("expected no more trimming after stopping, got %d more trims", got-trims)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"time"
+
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	log "github.com/sirupsen/logrus"
+)
+
+// retentionGrace is subtracted from the inactive device timeout when deciding
+// whether a syncing device needs a full device list resync. It covers the gap
+// between a device's last sync time being read and the trimming job deciding
+// which devices are active.
+const retentionGrace = time.Minute
+
+// updateDeviceListPosition records the device list position that the device
+// is syncing from, so that trimming doesn't remove changes which it still
+// needs. Returns true if the device hasn't synced recently enough for the
+// changes since its token to be guaranteed to still exist.
+func (rp *RequestPool) updateDeviceListPosition(req *syncRequest) bool {
+	retention := rp.cfg.StreamRetention
+	if retention.Interval == 0 {
+		return false
+	}
+	if req.since.PDUPosition() == 0 && req.since.EDUPosition() == 0 {
+		// Complete syncs don't need to catch up on device list changes.
+		return false
+	}
+	pos := req.since.Log(internal.DeviceListLogName)
+	if pos == nil {
+		return true
+	}
+	lastSync, err := rp.db.UpdateDeviceListPosition(req.ctx, req.device.UserID, req.device.ID, *pos)
+	if err != nil {
+		req.log.WithError(err).Error("Failed to update device list position")
+		return true
+	}
+	return lastSync.Before(time.Now().Add(-retention.InactiveDeviceTimeout + retentionGrace))
+}
+
+// trimDeviceListChanges periodically removes the device list changes that
+// every active device has already synced past. Devices which haven't synced
+// within the inactive device timeout don't hold back trimming, as they will
+// be sent a full resync when they return.
+func (rp *RequestPool) trimDeviceListChanges() {
+	defer rp.workers.Done()
+	retention := rp.cfg.StreamRetention
+	ticker := time.NewTicker(retention.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx := rp.ctx
+		activeSince := time.Now().Add(-retention.InactiveDeviceTimeout)
+		positions, err := rp.db.OldestDeviceListPositions(ctx, activeSince)
+		if err != nil {
+			log.WithError(err).Error("Failed to get oldest device list positions")
+			continue
+		}
+		for partition, offset := range positions {
+			var res keyapi.PerformTrimKeyChangesResponse
+			rp.keyAPI.PerformTrimKeyChanges(ctx, &keyapi.PerformTrimKeyChangesRequest{
+				Partition: partition,
+				ToOffset:  offset,
+			}, &res)
+			if res.Error != nil {
+				log.WithError(res.Error).WithField("partition", partition).Error("Failed to trim device list changes")
+				continue
+			}
+			log.WithFields(log.Fields{
+				"partition": partition,
+				"offset":    offset,
+			}).Debug("Trimmed device list changes")
+		}
+		if err = rp.db.DeleteInactiveDeviceListPositions(ctx, activeSince); err != nil {
+			log.WithError(err).Error("Failed to delete inactive device list positions")
+		}
+	}
+}
@@ -20,8 +20,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
-	"github.com/matrix-org/dendrite/internal/setup/kafka"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -34,17 +35,17 @@ import (
 )
 
 // AddPublicRoutes sets up and registers HTTP handlers for the SyncAPI
-// component.
+// component, including its admin handlers on the admin router.
 func AddPublicRoutes(
-	router *mux.Router,
+	router, adminRouter *mux.Router,
 	userAPI userapi.UserInternalAPI,
 	rsAPI api.RoomserverInternalAPI,
 	keyAPI keyapi.KeyInternalAPI,
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.SyncAPI,
+	bus internal.MessageBus,
+	shutdown *internal.ShutdownCoordinator,
 ) {
-	consumer, _ := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
-
 	syncDB, err := storage.NewSyncServerDatasource(&cfg.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to sync db")
@@ -61,43 +62,58 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, userAPI, keyAPI, rsAPI)
+	requestPool := sync.NewRequestPool(syncDB, cfg, notifier, userAPI, keyAPI, rsAPI)
+	shutdown.Register(internal.ShutdownStageSync, "sync long-polls", requestPool.Drain)
+	shutdown.Register(internal.ShutdownStageBackground, "sync background tasks", requestPool.Stop)
+
+	if replica := cfg.Database.ReadReplica(); replica != nil {
+		replicaDB, rerr := storage.NewSyncServerReadReplica(syncDB, replica)
+		if rerr != nil {
+			logrus.WithError(rerr).Panicf("failed to connect to sync db read replica")
+		}
+		replicaHealth, rerr := sqlutil.NewReadReplica(replica)
+		if rerr != nil {
+			logrus.WithError(rerr).Panicf("failed to connect to sync db read replica")
+		}
+		requestPool.SetReadReplica(replicaDB, replicaHealth)
+	}
 
 	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
 		cfg.Matrix.ServerName, string(cfg.Matrix.Kafka.TopicFor(config.TopicOutputKeyChangeEvent)),
-		consumer, notifier, keyAPI, rsAPI, syncDB,
+		bus, notifier, keyAPI, rsAPI, syncDB,
 	)
 	if err = keyChangeConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start key change consumer")
 	}
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		cfg, consumer, notifier, syncDB, rsAPI,
+		cfg, bus, notifier, syncDB, rsAPI,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
 	}
 
 	clientConsumer := consumers.NewOutputClientDataConsumer(
-		cfg, consumer, notifier, syncDB,
+		cfg, bus, notifier, syncDB,
 	)
 	if err = clientConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start client data consumer")
 	}
 
 	typingConsumer := consumers.NewOutputTypingEventConsumer(
-		cfg, consumer, notifier, syncDB,
+		cfg, bus, notifier, syncDB,
 	)
 	if err = typingConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start typing consumer")
 	}
 
 	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
-		cfg, consumer, notifier, syncDB,
+		cfg, bus, notifier, syncDB,
 	)
 	if err = sendToDeviceConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start send-to-device consumer")
 	}
 
 	routing.Setup(router, requestPool, syncDB, userAPI, federation, rsAPI, cfg)
+	routing.SetupAdmin(adminRouter, cfg, roomConsumer)
 }
@@ -478,8 +478,15 @@ func NewInviteResponse(event gomatrixserverlib.HeaderedEvent) *InviteResponse {
 	// First see if there's invite_room_state in the unsigned key of the invite.
 	// If there is then unmarshal it into the response. This will contain the
 	// partial room state such as join rules, room name etc.
-	if inviteRoomState := gjson.GetBytes(event.Unsigned(), "invite_room_state"); inviteRoomState.Exists() {
-		_ = json.Unmarshal([]byte(inviteRoomState.Raw), &res.InviteState.Events)
+	// The invited user's own membership is left out, as the invite event
+	// itself is added below.
+	if inviteRoomState := gjson.GetBytes(event.Unsigned(), "invite_room_state"); inviteRoomState.IsArray() {
+		for _, stripped := range inviteRoomState.Array() {
+			if stripped.Get("type").Str == gomatrixserverlib.MRoomMember && event.StateKeyEquals(stripped.Get("state_key").Str) {
+				continue
+			}
+			res.InviteState.Events = append(res.InviteState.Events, json.RawMessage(stripped.Raw))
+		}
 	}
 
 	// Then we'll see if we can create a partial of the invite event itself.
@@ -31,6 +31,7 @@ type UserInternalAPI interface {
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
@@ -69,6 +70,10 @@ type PerformDeviceDeletionRequest struct {
 	// so that a password change doesn't cause that client to be logged
 	// out. Only specify when DeviceIDs is empty.
 	ExceptDeviceID string
+	// If true, only the access tokens of the devices are revoked. The devices
+	// and their keys are kept, so that the clients can log in again to the
+	// same devices without losing their end-to-end encryption keys.
+	SoftLogout bool
 }
 
 type PerformDeviceDeletionResponse struct {
@@ -99,6 +104,9 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    error // e.g ErrorForbidden
+	// True if the access token belongs to a device which has been soft
+	// logged out. Device is nil if so.
+	SoftLogout bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -196,12 +204,47 @@ type PerformDeviceCreationRequest struct {
 	IPAddr string
 	// Useragent for this device
 	UserAgent string
+	// optional: the refresh token for getting a new access token once it expires.
+	RefreshToken string
+	// optional: when the access and refresh tokens expire, as unix timestamps
+	// (ms resolution). 0 means that the token never expires.
+	AccessTokenExpiresTS  int64
+	RefreshTokenExpiresTS int64
+	// optional: the maximum number of devices the user can have, or 0 for no
+	// limit. The user's device limit override, if any, takes precedence.
+	MaxDevices int
+	// If true then the least recently used devices are removed to make room
+	// for the new device once the user has MaxDevices devices, otherwise the
+	// device isn't created.
+	EvictDevicesOverLimit bool
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	// True if the device wasn't created because the user already has the
+	// maximum number of devices.
+	TooManyDevices bool
+}
+
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	// The refresh token given by the client, which can't be used again afterwards.
+	RefreshToken string
+	// The new tokens for the device, and when they expire as unix timestamps
+	// (ms resolution). 0 means that the token never expires.
+	NewAccessToken        string
+	NewRefreshToken       string
+	AccessTokenExpiresTS  int64
+	RefreshTokenExpiresTS int64
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The device with its new access token, or nil if the refresh token is
+	// unknown or has expired.
+	Device *Device
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
@@ -214,6 +257,60 @@ type PerformAccountDeactivationResponse struct {
 	AccountDeactivated bool
 }
 
+// AdminAuditEntry is a record of a single action taken through the admin API.
+// The actor is the user ID of the server admin who took the action, or
+// AdminAuditActorToken if the admin token was used.
+type AdminAuditEntry struct {
+	ID        int64                       `json:"id"`
+	Actor     string                      `json:"actor"`
+	DeviceID  string                      `json:"device_id,omitempty"`
+	IP        string                      `json:"ip,omitempty"`
+	Action    string                      `json:"action"`
+	Target    string                      `json:"target,omitempty"`
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+	Params    json.RawMessage             `json:"params,omitempty"`
+}
+
+// AdminAuditActorToken is the actor of admin actions taken using the admin
+// token rather than by a server admin.
+const AdminAuditActorToken = "admin_token"
+
+// RateLimitOverride replaces the default client API rate limits for a user.
+type RateLimitOverride struct {
+	// If true then the user isn't rate limited at all.
+	Exempt bool `json:"exempt"`
+	// How many requests the user can make before being rate limited.
+	Threshold int64 `json:"threshold,omitempty"`
+	// The cooloff period in milliseconds after a request before it no longer
+	// counts towards the threshold.
+	CooloffMS int64 `json:"cooloff_ms,omitempty"`
+}
+
+// Presence is the presence state that a local user has set.
+type Presence struct {
+	// One of "online", "offline" or "unavailable".
+	Presence string `json:"presence"`
+	// An optional message to go with the presence state.
+	StatusMsg string `json:"status_msg,omitempty"`
+	// When the presence was last set, as a unix timestamp (ms resolution).
+	LastActiveTS int64 `json:"last_active_ts"`
+}
+
+// DeviceLimitOverride replaces the default maximum number of devices for a user.
+type DeviceLimitOverride struct {
+	// The maximum number of devices the user can have, or 0 for no limit.
+	MaxDevices int `json:"max_devices"`
+}
+
+// UIASession is the progress of a user-interactive auth session.
+type UIASession struct {
+	ID string
+	// The auth stages that have been completed.
+	Completed []string
+	// When the session was started, as a unix timestamp (ms resolution).
+	CreatedTS int64
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -229,6 +326,11 @@ type Device struct {
 	LastSeenTS  int64
 	LastSeenIP  string
 	UserAgent   string
+	// True if the access token has been revoked but the device has been kept.
+	SoftLoggedOut bool
+	// When the access token expires, as a unix timestamp (ms resolution), or
+	// 0 if it doesn't.
+	AccessTokenExpiresTS int64
 }
 
 // Account represents a Matrix account on this home server.
@@ -237,7 +339,10 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	// Whether this is a guest account.
+	IsGuest bool
+	// Whether the user is a server admin.
+	IsAdmin bool
 	// TODO: Associations (e.g. with application services)
 }
 
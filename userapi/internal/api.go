@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
@@ -113,16 +114,59 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
-	dev, err := a.DeviceDB.CreateDevice(ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
+	maxDevices, err := a.deviceLimit(ctx, req.Localpart, req.MaxDevices)
 	if err != nil {
 		return err
 	}
+	dev, evicted, err := a.DeviceDB.CreateDeviceWithLimit(
+		ctx, req.Localpart, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent,
+		maxDevices, req.EvictDevicesOverLimit,
+	)
+	if err != nil {
+		return err
+	}
+	if dev == nil {
+		res.TooManyDevices = true
+		return nil
+	}
+	if len(evicted) > 0 {
+		// Removing the devices revokes their access tokens, and the device
+		// list update tells the sync API and other servers they are gone.
+		evictedIDs := make([]string, len(evicted))
+		for i, d := range evicted {
+			evictedIDs[i] = d.ID
+		}
+		util.GetLogger(ctx).WithField("devices", evictedIDs).Info("Evicted least recently used devices")
+		if err = a.deviceListUpdate(dev.UserID, evictedIDs); err != nil {
+			return err
+		}
+	}
+	if req.RefreshToken != "" {
+		err = a.DeviceDB.SetDeviceRefreshToken(ctx, req.Localpart, dev.ID, req.RefreshToken, req.AccessTokenExpiresTS, req.RefreshTokenExpiresTS)
+		if err != nil {
+			return err
+		}
+		dev.AccessTokenExpiresTS = req.AccessTokenExpiresTS
+	}
 	res.DeviceCreated = true
 	res.Device = dev
 	// create empty device keys and upload them to trigger device list changes
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
 
+// deviceLimit returns the maximum number of devices the user can have, taking
+// any override for the user into account. 0 means there is no limit.
+func (a *UserInternalAPI) deviceLimit(ctx context.Context, localpart string, maxDevices int) (int, error) {
+	override, err := a.AccountDB.GetDeviceLimitOverride(ctx, localpart)
+	if err != nil {
+		return 0, err
+	}
+	if override != nil {
+		return override.MaxDevices, nil
+	}
+	return maxDevices, nil
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -132,6 +176,10 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	if domain != a.ServerName {
 		return fmt.Errorf("cannot PerformDeviceDeletion of remote users: got %s want %s", domain, a.ServerName)
 	}
+	if req.SoftLogout {
+		// The devices are kept, so there are no device list changes to send.
+		return a.DeviceDB.SoftLogoutDevices(ctx, local, req.DeviceIDs, req.ExceptDeviceID)
+	}
 	deletedDeviceIDs := req.DeviceIDs
 	if len(req.DeviceIDs) == 0 {
 		var devices []api.Device
@@ -149,6 +197,20 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(req.UserID, deletedDeviceIDs)
 }
 
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	dev, err := a.DeviceDB.RefreshDeviceTokens(
+		ctx, req.RefreshToken, req.NewAccessToken, req.NewRefreshToken,
+		req.AccessTokenExpiresTS, req.RefreshTokenExpiresTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Device = dev
+	return nil
+}
+
 func (a *UserInternalAPI) deviceListUpdate(userID string, deviceIDs []string) error {
 	deviceKeys := make([]keyapi.DeviceKeys, len(deviceIDs))
 	for i, did := range deviceIDs {
@@ -340,6 +402,12 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	// Expired access tokens are treated like soft logouts, so that the client
+	// knows to use its refresh token rather than logging in again.
+	if device.SoftLoggedOut || (device.AccessTokenExpiresTS != 0 && device.AccessTokenExpiresTS <= time.Now().UnixNano()/1000000) {
+		res.SoftLogout = true
+		return nil
+	}
 	res.Device = device
 	return nil
 }
@@ -34,6 +34,7 @@ const (
 	PerformDeviceDeletionPath      = "/userapi/performDeviceDeletion"
 	PerformDeviceUpdatePath        = "/userapi/performDeviceUpdate"
 	PerformAccountDeactivationPath = "/userapi/performAccountDeactivation"
+	PerformTokenRefreshPath        = "/userapi/performTokenRefresh"
 
 	QueryProfilePath        = "/userapi/queryProfile"
 	QueryAccessTokenPath    = "/userapi/queryAccessToken"
@@ -119,6 +120,18 @@ func (h *httpUserInternalAPI) PerformDeviceDeletion(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformTokenRefresh(
+	ctx context.Context,
+	request *api.PerformTokenRefreshRequest,
+	response *api.PerformTokenRefreshResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformTokenRefresh")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformTokenRefreshPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeviceUpdate")
 	defer span.Finish()
@@ -52,6 +52,54 @@ type Database interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
+	// SetAccountAdmin sets whether the user is a server admin.
+	SetAccountAdmin(ctx context.Context, localpart string, isAdmin bool) error
+	// InsertAdminAuditEntry appends an entry to the admin audit log. Entries
+	// can never be updated or removed once they have been written.
+	InsertAdminAuditEntry(ctx context.Context, entry *api.AdminAuditEntry) error
+	// GetAdminAuditEntries returns up to limit admin audit entries with an ID
+	// lower than before, newest first. If before is 0 then the newest entries
+	// are returned.
+	GetAdminAuditEntries(ctx context.Context, before int64, limit int) ([]api.AdminAuditEntry, error)
+	// GetRateLimitOverride returns the rate limit override for the given
+	// localpart, or nil if the user has no override.
+	GetRateLimitOverride(ctx context.Context, localpart string) (*api.RateLimitOverride, error)
+	// SetRateLimitOverride sets the rate limit override for the given
+	// localpart, replacing any existing override.
+	SetRateLimitOverride(ctx context.Context, localpart string, override *api.RateLimitOverride) error
+	// RemoveRateLimitOverride removes the rate limit override for the given
+	// localpart, if there is one, so that the default rate limits apply.
+	RemoveRateLimitOverride(ctx context.Context, localpart string) error
+	// GetDeviceLimitOverride returns the device limit override for the given
+	// localpart, or nil if the user has no override.
+	GetDeviceLimitOverride(ctx context.Context, localpart string) (*api.DeviceLimitOverride, error)
+	// SetDeviceLimitOverride sets the device limit override for the given
+	// localpart, replacing any existing override.
+	SetDeviceLimitOverride(ctx context.Context, localpart string, override *api.DeviceLimitOverride) error
+	// RemoveDeviceLimitOverride removes the device limit override for the given
+	// localpart, if there is one, so that the default limit applies.
+	RemoveDeviceLimitOverride(ctx context.Context, localpart string) error
+	// GetUIASession returns the user-interactive auth session with the given
+	// ID, or nil if there is no such session.
+	GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error)
+	// SaveUIASession stores a user-interactive auth session. The creation
+	// time of an existing session isn't changed.
+	SaveUIASession(ctx context.Context, session *api.UIASession) error
+	// RemoveUIASessionsBefore removes the user-interactive auth sessions that
+	// were started before the given time.
+	RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error
+	// GetAcceptedPolicies returns the version of each policy, e.g. terms of
+	// service, which the user has accepted, keyed by policy ID.
+	GetAcceptedPolicies(ctx context.Context, localpart string) (map[string]string, error)
+	// SetAcceptedPolicies records that the user accepted the given versions
+	// of policies, keyed by policy ID, at the given time.
+	SetAcceptedPolicies(ctx context.Context, localpart string, versions map[string]string, acceptedTS int64) error
+	// GetPresence returns the presence that the user has set, or nil if they
+	// have never set it.
+	GetPresence(ctx context.Context, localpart string) (*api.Presence, error)
+	// SetPresence sets the presence of the user, replacing any existing
+	// presence.
+	SetPresence(ctx context.Context, localpart string, presence *api.Presence) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
@@ -0,0 +1,95 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const acceptedPoliciesSchema = `
+-- Stores the versions of the server's policies, e.g. terms of service, which
+-- each user has accepted.
+CREATE TABLE IF NOT EXISTS account_accepted_policies (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL,
+	-- The ID of the policy
+	policy_id TEXT NOT NULL,
+	-- The version of the policy which the user accepted
+	version TEXT NOT NULL,
+	-- When the user accepted this version, as a unix timestamp (ms resolution)
+	accepted_ts BIGINT NOT NULL,
+	PRIMARY KEY (localpart, policy_id)
+);
+`
+
+const upsertAcceptedPolicySQL = "" +
+	"INSERT INTO account_accepted_policies (localpart, policy_id, version, accepted_ts) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart, policy_id) DO UPDATE SET version = $3, accepted_ts = $4"
+
+const selectAcceptedPoliciesSQL = "" +
+	"SELECT policy_id, version FROM account_accepted_policies WHERE localpart = $1"
+
+type acceptedPoliciesStatements struct {
+	upsertAcceptedPolicyStmt   *sql.Stmt
+	selectAcceptedPoliciesStmt *sql.Stmt
+}
+
+func (s *acceptedPoliciesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(acceptedPoliciesSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertAcceptedPolicyStmt, err = db.Prepare(upsertAcceptedPolicySQL); err != nil {
+		return
+	}
+	if s.selectAcceptedPoliciesStmt, err = db.Prepare(selectAcceptedPoliciesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *acceptedPoliciesStatements) upsertAcceptedPolicy(
+	ctx context.Context, txn *sql.Tx, localpart, policyID, version string, acceptedTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertAcceptedPolicyStmt)
+	_, err := stmt.ExecContext(ctx, localpart, policyID, version, acceptedTS)
+	return err
+}
+
+// selectAcceptedPolicies returns the version of each policy which the user
+// has accepted, keyed by policy ID.
+func (s *acceptedPoliciesStatements) selectAcceptedPolicies(
+	ctx context.Context, localpart string,
+) (map[string]string, error) {
+	rows, err := s.selectAcceptedPoliciesStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAcceptedPolicies: rows.close() failed")
+
+	versions := make(map[string]string)
+	for rows.Next() {
+		var policyID, version string
+		if err = rows.Scan(&policyID, &version); err != nil {
+			return nil, err
+		}
+		versions[policyID] = version
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,32 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadAccountFlags(m *sqlutil.Migrations) {
+	m.AddMigration(UpAccountFlags, DownAccountFlags)
+}
+
+func UpAccountFlags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_guest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAccountFlags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE account_accounts DROP COLUMN is_guest;
+ALTER TABLE account_accounts DROP COLUMN is_admin;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const rateLimitOverridesSchema = `
+-- Stores the users whose client API rate limits differ from the defaults.
+CREATE TABLE IF NOT EXISTS account_ratelimit_overrides (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- Whether the user is exempt from rate limiting altogether
+	exempt BOOLEAN NOT NULL DEFAULT FALSE,
+	-- How many requests the user can make before being rate limited
+	threshold BIGINT NOT NULL DEFAULT 0,
+	-- The cooloff period in milliseconds after each request
+	cooloff_ms BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const upsertRateLimitOverrideSQL = "" +
+	"INSERT INTO account_ratelimit_overrides (localpart, exempt, threshold, cooloff_ms) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart) DO UPDATE SET exempt = $2, threshold = $3, cooloff_ms = $4"
+
+const selectRateLimitOverrideSQL = "" +
+	"SELECT exempt, threshold, cooloff_ms FROM account_ratelimit_overrides WHERE localpart = $1"
+
+const deleteRateLimitOverrideSQL = "" +
+	"DELETE FROM account_ratelimit_overrides WHERE localpart = $1"
+
+type rateLimitOverridesStatements struct {
+	upsertRateLimitOverrideStmt *sql.Stmt
+	selectRateLimitOverrideStmt *sql.Stmt
+	deleteRateLimitOverrideStmt *sql.Stmt
+}
+
+func (s *rateLimitOverridesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(rateLimitOverridesSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertRateLimitOverrideStmt, err = db.Prepare(upsertRateLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.selectRateLimitOverrideStmt, err = db.Prepare(selectRateLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.deleteRateLimitOverrideStmt, err = db.Prepare(deleteRateLimitOverrideSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *rateLimitOverridesStatements) upsertRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, override *api.RateLimitOverride,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertRateLimitOverrideStmt)
+	_, err = stmt.ExecContext(ctx, localpart, override.Exempt, override.Threshold, override.CooloffMS)
+	return
+}
+
+// selectRateLimitOverride returns the override for the given localpart, or
+// nil if there isn't one.
+func (s *rateLimitOverridesStatements) selectRateLimitOverride(
+	ctx context.Context, localpart string,
+) (*api.RateLimitOverride, error) {
+	var override api.RateLimitOverride
+	err := s.selectRateLimitOverrideStmt.QueryRowContext(ctx, localpart).Scan(
+		&override.Exempt, &override.Threshold, &override.CooloffMS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func (s *rateLimitOverridesStatements) deleteRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteRateLimitOverrideStmt)
+	_, err = stmt.ExecContext(ctx, localpart)
+	return
+}
@@ -43,12 +43,27 @@ type Database struct {
 	profiles     profilesStatements
 	accountDatas accountDataStatements
 	threepids    threepidStatements
+	adminAudit   adminAuditStatements
+	rateLimits   rateLimitOverridesStatements
+	deviceLimits deviceLimitOverridesStatements
+	uiaSessions  uiaSessionsStatements
+	policies     acceptedPoliciesStatements
+	presence     presenceStatements
 	serverName   gomatrixserverlib.ServerName
+	queries      sqlutil.QueryTimer
+}
+
+// Migrations returns the schema migrations of the accounts database.
+func Migrations() *sqlutil.Migrations {
+	m := sqlutil.NewMigrations("accounts")
+	deltas.LoadIsActive(m)
+	deltas.LoadAccountFlags(m)
+	return m
 }
 
 // NewDatabase creates a new accounts and profiles database
 func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (*Database, error) {
-	db, err := sqlutil.Open(dbProperties)
+	db, err := sqlutil.OpenNamed("accounts", dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +71,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 		serverName: serverName,
 		db:         db,
 		writer:     sqlutil.NewDummyWriter(),
+		queries: sqlutil.QueryTimer{
+			Database: "accounts",
+			Timeout:  dbProperties.QueryTimeout(),
+		},
 	}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
@@ -63,9 +82,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.accounts.execSchema(db); err != nil {
 		return nil, err
 	}
-	m := sqlutil.NewMigrations()
-	deltas.LoadIsActive(m)
-	if err = m.RunDeltas(db, dbProperties); err != nil {
+	if err = Migrations().RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
 
@@ -84,6 +101,24 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.threepids.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.adminAudit.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.rateLimits.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.deviceLimits.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.uiaSessions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.policies.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.presence.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -93,6 +128,8 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 func (d *Database) GetAccountByPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) (*api.Account, error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountByPassword")
+	defer done()
 	hash, err := d.accounts.selectPasswordHash(ctx, localpart)
 	if err != nil {
 		return nil, err
@@ -108,6 +145,8 @@ func (d *Database) GetAccountByPassword(
 func (d *Database) GetProfileByLocalpart(
 	ctx context.Context, localpart string,
 ) (*authtypes.Profile, error) {
+	ctx, done := d.queries.Start(ctx, "GetProfileByLocalpart")
+	defer done()
 	return d.profiles.selectProfileByLocalpart(ctx, localpart)
 }
 
@@ -116,6 +155,8 @@ func (d *Database) GetProfileByLocalpart(
 func (d *Database) SetAvatarURL(
 	ctx context.Context, localpart string, avatarURL string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetAvatarURL")
+	defer done()
 	return d.profiles.setAvatarURL(ctx, localpart, avatarURL)
 }
 
@@ -124,6 +165,8 @@ func (d *Database) SetAvatarURL(
 func (d *Database) SetDisplayName(
 	ctx context.Context, localpart string, displayName string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetDisplayName")
+	defer done()
 	return d.profiles.setDisplayName(ctx, localpart, displayName)
 }
 
@@ -131,6 +174,8 @@ func (d *Database) SetDisplayName(
 func (d *Database) SetPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetPassword")
+	defer done()
 	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
@@ -141,6 +186,8 @@ func (d *Database) SetPassword(
 // CreateGuestAccount makes a new guest account and creates an empty profile
 // for this account.
 func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, err error) {
+	ctx, done := d.queries.Start(ctx, "CreateGuestAccount")
+	defer done()
 	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
 		var numLocalpart int64
 		numLocalpart, err = d.accounts.selectNewNumericLocalpart(ctx, txn)
@@ -148,7 +195,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", true)
 		return err
 	})
 	return acc, err
@@ -160,15 +207,17 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 func (d *Database) CreateAccount(
 	ctx context.Context, localpart, plaintextPassword, appserviceID string,
 ) (acc *api.Account, err error) {
+	ctx, done := d.queries.Start(ctx, "CreateAccount")
+	defer done()
 	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, false)
 		return err
 	})
 	return
 }
 
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, isGuest bool,
 ) (*api.Account, error) {
 	var err error
 
@@ -198,7 +247,7 @@ func (d *Database) createAccount(
 	}`)); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, isGuest)
 }
 
 // SaveAccountData saves new account data for a given user and a given room.
@@ -209,6 +258,8 @@ func (d *Database) createAccount(
 func (d *Database) SaveAccountData(
 	ctx context.Context, localpart, roomID, dataType string, content json.RawMessage,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SaveAccountData")
+	defer done()
 	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
 		return d.accountDatas.insertAccountData(ctx, txn, localpart, roomID, dataType, content)
 	})
@@ -222,6 +273,8 @@ func (d *Database) GetAccountData(ctx context.Context, localpart string) (
 	rooms map[string]map[string]json.RawMessage,
 	err error,
 ) {
+	ctx, done := d.queries.Start(ctx, "GetAccountData")
+	defer done()
 	return d.accountDatas.selectAccountData(ctx, localpart)
 }
 
@@ -232,6 +285,8 @@ func (d *Database) GetAccountData(ctx context.Context, localpart string) (
 func (d *Database) GetAccountDataByType(
 	ctx context.Context, localpart, roomID, dataType string,
 ) (data json.RawMessage, err error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountDataByType")
+	defer done()
 	return d.accountDatas.selectAccountDataByType(
 		ctx, localpart, roomID, dataType,
 	)
@@ -241,6 +296,8 @@ func (d *Database) GetAccountDataByType(
 func (d *Database) GetNewNumericLocalpart(
 	ctx context.Context,
 ) (int64, error) {
+	ctx, done := d.queries.Start(ctx, "GetNewNumericLocalpart")
+	defer done()
 	return d.accounts.selectNewNumericLocalpart(ctx, nil)
 }
 
@@ -260,6 +317,8 @@ var Err3PIDInUse = errors.New("This third-party identifier is already in use")
 func (d *Database) SaveThreePIDAssociation(
 	ctx context.Context, threepid, localpart, medium string,
 ) (err error) {
+	ctx, done := d.queries.Start(ctx, "SaveThreePIDAssociation")
+	defer done()
 	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
 		user, err := d.threepids.selectLocalpartForThreePID(
 			ctx, txn, threepid, medium,
@@ -283,6 +342,8 @@ func (d *Database) SaveThreePIDAssociation(
 func (d *Database) RemoveThreePIDAssociation(
 	ctx context.Context, threepid string, medium string,
 ) (err error) {
+	ctx, done := d.queries.Start(ctx, "RemoveThreePIDAssociation")
+	defer done()
 	return d.threepids.deleteThreePID(ctx, threepid, medium)
 }
 
@@ -294,6 +355,8 @@ func (d *Database) RemoveThreePIDAssociation(
 func (d *Database) GetLocalpartForThreePID(
 	ctx context.Context, threepid string, medium string,
 ) (localpart string, err error) {
+	ctx, done := d.queries.Start(ctx, "GetLocalpartForThreePID")
+	defer done()
 	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
 }
 
@@ -304,6 +367,8 @@ func (d *Database) GetLocalpartForThreePID(
 func (d *Database) GetThreePIDsForLocalpart(
 	ctx context.Context, localpart string,
 ) (threepids []authtypes.ThreePID, err error) {
+	ctx, done := d.queries.Start(ctx, "GetThreePIDsForLocalpart")
+	defer done()
 	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
 }
 
@@ -311,6 +376,8 @@ func (d *Database) GetThreePIDsForLocalpart(
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
 func (d *Database) CheckAccountAvailability(ctx context.Context, localpart string) (bool, error) {
+	ctx, done := d.queries.Start(ctx, "CheckAccountAvailability")
+	defer done()
 	_, err := d.accounts.selectAccountByLocalpart(ctx, localpart)
 	if err == sql.ErrNoRows {
 		return true, nil
@@ -323,6 +390,8 @@ func (d *Database) CheckAccountAvailability(ctx context.Context, localpart strin
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
 func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*api.Account, error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountByLocalpart")
+	defer done()
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
@@ -330,10 +399,144 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
 ) ([]authtypes.Profile, error) {
+	ctx, done := d.queries.Start(ctx, "SearchProfiles")
+	defer done()
 	return d.profiles.selectProfilesBySearch(ctx, searchString, limit)
 }
 
 // DeactivateAccount deactivates the user's account, removing all ability for the user to login again.
 func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err error) {
+	ctx, done := d.queries.Start(ctx, "DeactivateAccount")
+	defer done()
 	return d.accounts.deactivateAccount(ctx, localpart)
 }
+
+// SetAccountAdmin sets whether the user is a server admin.
+func (d *Database) SetAccountAdmin(ctx context.Context, localpart string, isAdmin bool) error {
+	ctx, done := d.queries.Start(ctx, "SetAccountAdmin")
+	defer done()
+	return d.accounts.updateIsAdmin(ctx, nil, localpart, isAdmin)
+}
+
+// InsertAdminAuditEntry appends an entry to the admin audit log.
+func (d *Database) InsertAdminAuditEntry(ctx context.Context, entry *api.AdminAuditEntry) error {
+	ctx, done := d.queries.Start(ctx, "InsertAdminAuditEntry")
+	defer done()
+	return d.adminAudit.insertAdminAudit(ctx, nil, entry)
+}
+
+// GetAdminAuditEntries returns up to limit admin audit entries older than the
+// entry with the given ID, newest first.
+func (d *Database) GetAdminAuditEntries(ctx context.Context, before int64, limit int) ([]api.AdminAuditEntry, error) {
+	ctx, done := d.queries.Start(ctx, "GetAdminAuditEntries")
+	defer done()
+	return d.adminAudit.selectAdminAudit(ctx, before, limit)
+}
+
+// GetRateLimitOverride returns the rate limit override for the given localpart,
+// or nil if the user has no override.
+func (d *Database) GetRateLimitOverride(ctx context.Context, localpart string) (*api.RateLimitOverride, error) {
+	ctx, done := d.queries.Start(ctx, "GetRateLimitOverride")
+	defer done()
+	return d.rateLimits.selectRateLimitOverride(ctx, localpart)
+}
+
+// SetRateLimitOverride sets the rate limit override for the given localpart.
+func (d *Database) SetRateLimitOverride(ctx context.Context, localpart string, override *api.RateLimitOverride) error {
+	ctx, done := d.queries.Start(ctx, "SetRateLimitOverride")
+	defer done()
+	return d.rateLimits.upsertRateLimitOverride(ctx, nil, localpart, override)
+}
+
+// RemoveRateLimitOverride removes the rate limit override for the given
+// localpart, if there is one.
+func (d *Database) RemoveRateLimitOverride(ctx context.Context, localpart string) error {
+	ctx, done := d.queries.Start(ctx, "RemoveRateLimitOverride")
+	defer done()
+	return d.rateLimits.deleteRateLimitOverride(ctx, nil, localpart)
+}
+
+// GetDeviceLimitOverride returns the device limit override for the given
+// localpart, or nil if the user has no override.
+func (d *Database) GetDeviceLimitOverride(ctx context.Context, localpart string) (*api.DeviceLimitOverride, error) {
+	ctx, done := d.queries.Start(ctx, "GetDeviceLimitOverride")
+	defer done()
+	return d.deviceLimits.selectDeviceLimitOverride(ctx, localpart)
+}
+
+// SetDeviceLimitOverride sets the device limit override for the given localpart.
+func (d *Database) SetDeviceLimitOverride(ctx context.Context, localpart string, override *api.DeviceLimitOverride) error {
+	ctx, done := d.queries.Start(ctx, "SetDeviceLimitOverride")
+	defer done()
+	return d.deviceLimits.upsertDeviceLimitOverride(ctx, nil, localpart, override)
+}
+
+// RemoveDeviceLimitOverride removes the device limit override for the given
+// localpart, if there is one.
+func (d *Database) RemoveDeviceLimitOverride(ctx context.Context, localpart string) error {
+	ctx, done := d.queries.Start(ctx, "RemoveDeviceLimitOverride")
+	defer done()
+	return d.deviceLimits.deleteDeviceLimitOverride(ctx, nil, localpart)
+}
+
+// GetUIASession returns the user-interactive auth session with the given ID,
+// or nil if there is no such session.
+func (d *Database) GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	ctx, done := d.queries.Start(ctx, "GetUIASession")
+	defer done()
+	return d.uiaSessions.selectUIASession(ctx, sessionID)
+}
+
+// SaveUIASession stores a user-interactive auth session, replacing the
+// completed stages of an existing session with the same ID.
+func (d *Database) SaveUIASession(ctx context.Context, session *api.UIASession) error {
+	ctx, done := d.queries.Start(ctx, "SaveUIASession")
+	defer done()
+	return d.uiaSessions.upsertUIASession(ctx, nil, session)
+}
+
+// RemoveUIASessionsBefore removes the user-interactive auth sessions that
+// were started before the given time.
+func (d *Database) RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error {
+	ctx, done := d.queries.Start(ctx, "RemoveUIASessionsBefore")
+	defer done()
+	return d.uiaSessions.deleteUIASessionsBefore(ctx, nil, createdTS)
+}
+
+// GetAcceptedPolicies returns the version of each policy which the user has
+// accepted, keyed by policy ID.
+func (d *Database) GetAcceptedPolicies(ctx context.Context, localpart string) (map[string]string, error) {
+	ctx, done := d.queries.Start(ctx, "GetAcceptedPolicies")
+	defer done()
+	return d.policies.selectAcceptedPolicies(ctx, localpart)
+}
+
+// SetAcceptedPolicies records that the user accepted the given versions of
+// policies, keyed by policy ID, at the given time.
+func (d *Database) SetAcceptedPolicies(ctx context.Context, localpart string, versions map[string]string, acceptedTS int64) error {
+	ctx, done := d.queries.Start(ctx, "SetAcceptedPolicies")
+	defer done()
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for policyID, version := range versions {
+			if err := d.policies.upsertAcceptedPolicy(ctx, txn, localpart, policyID, version, acceptedTS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPresence returns the presence that the user has set, or nil if they have
+// never set it.
+func (d *Database) GetPresence(ctx context.Context, localpart string) (*api.Presence, error) {
+	ctx, done := d.queries.Start(ctx, "GetPresence")
+	defer done()
+	return d.presence.selectPresence(ctx, localpart)
+}
+
+// SetPresence sets the presence of the user, replacing any existing presence.
+func (d *Database) SetPresence(ctx context.Context, localpart string, presence *api.Presence) error {
+	ctx, done := d.queries.Start(ctx, "SetPresence")
+	defer done()
+	return d.presence.upsertPresence(ctx, nil, localpart, presence)
+}
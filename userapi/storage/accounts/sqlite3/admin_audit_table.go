@@ -0,0 +1,111 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const adminAuditSchema = `
+-- Stores an append-only log of actions taken through the admin API.
+CREATE TABLE IF NOT EXISTS account_admin_audit (
+	-- The ID of the audit entry, increasing with every entry
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The user ID of the server admin who performed the action, or admin_token
+	actor TEXT NOT NULL,
+	-- The device of the server admin who performed the action, if any
+	device_id TEXT NOT NULL DEFAULT '',
+	-- The IP address that the action was requested from
+	ip TEXT NOT NULL DEFAULT '',
+	-- The action that was performed
+	action TEXT NOT NULL,
+	-- The user, room or other entity the action was performed on, if any
+	target TEXT NOT NULL DEFAULT '',
+	-- When the action was performed, in milliseconds since the epoch
+	ts BIGINT NOT NULL,
+	-- The parameters of the action, as JSON
+	params TEXT NOT NULL DEFAULT ''
+);
+`
+
+const insertAdminAuditSQL = "" +
+	"INSERT INTO account_admin_audit (actor, device_id, ip, action, target, ts, params) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+const selectAdminAuditSQL = "" +
+	"SELECT id, actor, device_id, ip, action, target, ts, params FROM account_admin_audit WHERE id < $1 ORDER BY id DESC LIMIT $2"
+
+type adminAuditStatements struct {
+	insertAdminAuditStmt *sql.Stmt
+	selectAdminAuditStmt *sql.Stmt
+}
+
+func (s *adminAuditStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(adminAuditSchema)
+	if err != nil {
+		return
+	}
+	if s.insertAdminAuditStmt, err = db.Prepare(insertAdminAuditSQL); err != nil {
+		return
+	}
+	if s.selectAdminAuditStmt, err = db.Prepare(selectAdminAuditSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *adminAuditStatements) insertAdminAudit(
+	ctx context.Context, txn *sql.Tx, entry *api.AdminAuditEntry,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertAdminAuditStmt)
+	_, err = stmt.ExecContext(
+		ctx, entry.Actor, entry.DeviceID, entry.IP, entry.Action, entry.Target, entry.Timestamp, string(entry.Params),
+	)
+	return
+}
+
+func (s *adminAuditStatements) selectAdminAudit(
+	ctx context.Context, before int64, limit int,
+) ([]api.AdminAuditEntry, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := s.selectAdminAuditStmt.QueryContext(ctx, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAdminAudit: rows.close() failed")
+
+	entries := []api.AdminAuditEntry{}
+	for rows.Next() {
+		var entry api.AdminAuditEntry
+		var params string
+		if err = rows.Scan(
+			&entry.ID, &entry.Actor, &entry.DeviceID, &entry.IP, &entry.Action, &entry.Target, &entry.Timestamp, &params,
+		); err != nil {
+			return nil, err
+		}
+		if params != "" {
+			entry.Params = []byte(params)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const deviceLimitOverridesSchema = `
+-- Stores the users whose maximum number of devices differs from the default.
+CREATE TABLE IF NOT EXISTS account_device_limit_overrides (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- The maximum number of devices the user can have, or 0 for no limit
+	max_devices BIGINT NOT NULL
+);
+`
+
+const upsertDeviceLimitOverrideSQL = "" +
+	"INSERT INTO account_device_limit_overrides (localpart, max_devices) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO UPDATE SET max_devices = $2"
+
+const selectDeviceLimitOverrideSQL = "" +
+	"SELECT max_devices FROM account_device_limit_overrides WHERE localpart = $1"
+
+const deleteDeviceLimitOverrideSQL = "" +
+	"DELETE FROM account_device_limit_overrides WHERE localpart = $1"
+
+type deviceLimitOverridesStatements struct {
+	upsertDeviceLimitOverrideStmt *sql.Stmt
+	selectDeviceLimitOverrideStmt *sql.Stmt
+	deleteDeviceLimitOverrideStmt *sql.Stmt
+}
+
+func (s *deviceLimitOverridesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deviceLimitOverridesSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertDeviceLimitOverrideStmt, err = db.Prepare(upsertDeviceLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.selectDeviceLimitOverrideStmt, err = db.Prepare(selectDeviceLimitOverrideSQL); err != nil {
+		return
+	}
+	if s.deleteDeviceLimitOverrideStmt, err = db.Prepare(deleteDeviceLimitOverrideSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *deviceLimitOverridesStatements) upsertDeviceLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, override *api.DeviceLimitOverride,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertDeviceLimitOverrideStmt)
+	_, err = stmt.ExecContext(ctx, localpart, override.MaxDevices)
+	return
+}
+
+// selectDeviceLimitOverride returns the override for the given localpart, or
+// nil if there isn't one.
+func (s *deviceLimitOverridesStatements) selectDeviceLimitOverride(
+	ctx context.Context, localpart string,
+) (*api.DeviceLimitOverride, error) {
+	var override api.DeviceLimitOverride
+	err := s.selectDeviceLimitOverrideStmt.QueryRowContext(ctx, localpart).Scan(&override.MaxDevices)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+func (s *deviceLimitOverridesStatements) deleteDeviceLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteDeviceLimitOverrideStmt)
+	_, err = stmt.ExecContext(ctx, localpart)
+	return
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const presenceSchema = `
+-- Stores the presence state that each user has set.
+CREATE TABLE IF NOT EXISTS account_presence (
+	-- The Matrix user ID localpart for this account
+	localpart TEXT NOT NULL PRIMARY KEY,
+	-- One of "online", "offline" or "unavailable"
+	presence TEXT NOT NULL,
+	-- The status message that goes with the presence, if any
+	status_msg TEXT NOT NULL DEFAULT '',
+	-- When the presence was last set, as a unix timestamp (ms resolution)
+	last_active_ts BIGINT NOT NULL
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO account_presence (localpart, presence, status_msg, last_active_ts) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart) DO UPDATE SET presence = $2, status_msg = $3, last_active_ts = $4"
+
+const selectPresenceSQL = "" +
+	"SELECT presence, status_msg, last_active_ts FROM account_presence WHERE localpart = $1"
+
+type presenceStatements struct {
+	upsertPresenceStmt *sql.Stmt
+	selectPresenceStmt *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(presenceSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresenceStmt, err = db.Prepare(selectPresenceSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *presenceStatements) upsertPresence(
+	ctx context.Context, txn *sql.Tx, localpart string, presence *api.Presence,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+	_, err = stmt.ExecContext(ctx, localpart, presence.Presence, presence.StatusMsg, presence.LastActiveTS)
+	return
+}
+
+// selectPresence returns the presence for the given localpart, or nil if
+// the user has never set their presence.
+func (s *presenceStatements) selectPresence(
+	ctx context.Context, localpart string,
+) (*api.Presence, error) {
+	var presence api.Presence
+	err := s.selectPresenceStmt.QueryRowContext(ctx, localpart).Scan(
+		&presence.Presence, &presence.StatusMsg, &presence.LastActiveTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
@@ -42,7 +42,14 @@ type Database struct {
 	profiles     profilesStatements
 	accountDatas accountDataStatements
 	threepids    threepidStatements
+	adminAudit   adminAuditStatements
+	rateLimits   rateLimitOverridesStatements
+	deviceLimits deviceLimitOverridesStatements
+	uiaSessions  uiaSessionsStatements
+	policies     acceptedPoliciesStatements
+	presence     presenceStatements
 	serverName   gomatrixserverlib.ServerName
+	queries      sqlutil.QueryTimer
 
 	accountsMu     sync.Mutex
 	profilesMu     sync.Mutex
@@ -50,9 +57,17 @@ type Database struct {
 	threepidsMu    sync.Mutex
 }
 
+// Migrations returns the schema migrations of the accounts database.
+func Migrations() *sqlutil.Migrations {
+	m := sqlutil.NewMigrations("accounts")
+	deltas.LoadIsActive(m)
+	deltas.LoadAccountFlags(m)
+	return m
+}
+
 // NewDatabase creates a new accounts and profiles database
 func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (*Database, error) {
-	db, err := sqlutil.Open(dbProperties)
+	db, err := sqlutil.OpenNamed("accounts", dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +75,10 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 		serverName: serverName,
 		db:         db,
 		writer:     sqlutil.NewExclusiveWriter(),
+		queries: sqlutil.QueryTimer{
+			Database: "accounts",
+			Timeout:  dbProperties.QueryTimeout(),
+		},
 	}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
@@ -67,9 +86,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.accounts.execSchema(db); err != nil {
 		return nil, err
 	}
-	m := sqlutil.NewMigrations()
-	deltas.LoadIsActive(m)
-	if err = m.RunDeltas(db, dbProperties); err != nil {
+	if err = Migrations().RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
 
@@ -89,6 +106,24 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.threepids.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.adminAudit.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.rateLimits.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.deviceLimits.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.uiaSessions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.policies.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.presence.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -98,6 +133,8 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 func (d *Database) GetAccountByPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) (*api.Account, error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountByPassword")
+	defer done()
 	hash, err := d.accounts.selectPasswordHash(ctx, localpart)
 	if err != nil {
 		return nil, err
@@ -113,6 +150,8 @@ func (d *Database) GetAccountByPassword(
 func (d *Database) GetProfileByLocalpart(
 	ctx context.Context, localpart string,
 ) (*authtypes.Profile, error) {
+	ctx, done := d.queries.Start(ctx, "GetProfileByLocalpart")
+	defer done()
 	return d.profiles.selectProfileByLocalpart(ctx, localpart)
 }
 
@@ -121,6 +160,8 @@ func (d *Database) GetProfileByLocalpart(
 func (d *Database) SetAvatarURL(
 	ctx context.Context, localpart string, avatarURL string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetAvatarURL")
+	defer done()
 	d.profilesMu.Lock()
 	defer d.profilesMu.Unlock()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -133,6 +174,8 @@ func (d *Database) SetAvatarURL(
 func (d *Database) SetDisplayName(
 	ctx context.Context, localpart string, displayName string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetDisplayName")
+	defer done()
 	d.profilesMu.Lock()
 	defer d.profilesMu.Unlock()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -144,6 +187,8 @@ func (d *Database) SetDisplayName(
 func (d *Database) SetPassword(
 	ctx context.Context, localpart, plaintextPassword string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SetPassword")
+	defer done()
 	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
@@ -155,6 +200,8 @@ func (d *Database) SetPassword(
 // CreateGuestAccount makes a new guest account and creates an empty profile
 // for this account.
 func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, err error) {
+	ctx, done := d.queries.Start(ctx, "CreateGuestAccount")
+	defer done()
 	// We need to lock so we sequentially create numeric localparts. If we don't, two calls to
 	// this function will cause the same number to be selected and one will fail with 'database is locked'
 	// when the first txn upgrades to a write txn. We also need to lock the account creation else we can
@@ -173,7 +220,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", true)
 		return err
 	})
 	return acc, err
@@ -185,6 +232,8 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 func (d *Database) CreateAccount(
 	ctx context.Context, localpart, plaintextPassword, appserviceID string,
 ) (acc *api.Account, err error) {
+	ctx, done := d.queries.Start(ctx, "CreateAccount")
+	defer done()
 	// Create one account at a time else we can get 'database is locked'.
 	d.profilesMu.Lock()
 	d.accountDatasMu.Lock()
@@ -193,7 +242,7 @@ func (d *Database) CreateAccount(
 	defer d.accountDatasMu.Unlock()
 	defer d.accountsMu.Unlock()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, false)
 		return err
 	})
 	return
@@ -202,7 +251,7 @@ func (d *Database) CreateAccount(
 // WARNING! This function assumes that the relevant mutexes have already
 // been taken out by the caller (e.g. CreateAccount or CreateGuestAccount).
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, isGuest bool,
 ) (*api.Account, error) {
 	var err error
 	// Generate a password hash if this is not a password-less user
@@ -231,7 +280,7 @@ func (d *Database) createAccount(
 	}`)); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, isGuest)
 }
 
 // SaveAccountData saves new account data for a given user and a given room.
@@ -242,6 +291,8 @@ func (d *Database) createAccount(
 func (d *Database) SaveAccountData(
 	ctx context.Context, localpart, roomID, dataType string, content json.RawMessage,
 ) error {
+	ctx, done := d.queries.Start(ctx, "SaveAccountData")
+	defer done()
 	d.accountDatasMu.Lock()
 	defer d.accountDatasMu.Unlock()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -257,6 +308,8 @@ func (d *Database) GetAccountData(ctx context.Context, localpart string) (
 	rooms map[string]map[string]json.RawMessage,
 	err error,
 ) {
+	ctx, done := d.queries.Start(ctx, "GetAccountData")
+	defer done()
 	return d.accountDatas.selectAccountData(ctx, localpart)
 }
 
@@ -267,6 +320,8 @@ func (d *Database) GetAccountData(ctx context.Context, localpart string) (
 func (d *Database) GetAccountDataByType(
 	ctx context.Context, localpart, roomID, dataType string,
 ) (data json.RawMessage, err error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountDataByType")
+	defer done()
 	return d.accountDatas.selectAccountDataByType(
 		ctx, localpart, roomID, dataType,
 	)
@@ -276,6 +331,8 @@ func (d *Database) GetAccountDataByType(
 func (d *Database) GetNewNumericLocalpart(
 	ctx context.Context,
 ) (int64, error) {
+	ctx, done := d.queries.Start(ctx, "GetNewNumericLocalpart")
+	defer done()
 	return d.accounts.selectNewNumericLocalpart(ctx, nil)
 }
 
@@ -295,6 +352,8 @@ var Err3PIDInUse = errors.New("This third-party identifier is already in use")
 func (d *Database) SaveThreePIDAssociation(
 	ctx context.Context, threepid, localpart, medium string,
 ) (err error) {
+	ctx, done := d.queries.Start(ctx, "SaveThreePIDAssociation")
+	defer done()
 	d.threepidsMu.Lock()
 	defer d.threepidsMu.Unlock()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -320,6 +379,8 @@ func (d *Database) SaveThreePIDAssociation(
 func (d *Database) RemoveThreePIDAssociation(
 	ctx context.Context, threepid string, medium string,
 ) (err error) {
+	ctx, done := d.queries.Start(ctx, "RemoveThreePIDAssociation")
+	defer done()
 	d.threepidsMu.Lock()
 	defer d.threepidsMu.Unlock()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
@@ -335,6 +396,8 @@ func (d *Database) RemoveThreePIDAssociation(
 func (d *Database) GetLocalpartForThreePID(
 	ctx context.Context, threepid string, medium string,
 ) (localpart string, err error) {
+	ctx, done := d.queries.Start(ctx, "GetLocalpartForThreePID")
+	defer done()
 	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
 }
 
@@ -345,6 +408,8 @@ func (d *Database) GetLocalpartForThreePID(
 func (d *Database) GetThreePIDsForLocalpart(
 	ctx context.Context, localpart string,
 ) (threepids []authtypes.ThreePID, err error) {
+	ctx, done := d.queries.Start(ctx, "GetThreePIDsForLocalpart")
+	defer done()
 	return d.threepids.selectThreePIDsForLocalpart(ctx, localpart)
 }
 
@@ -352,6 +417,8 @@ func (d *Database) GetThreePIDsForLocalpart(
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
 func (d *Database) CheckAccountAvailability(ctx context.Context, localpart string) (bool, error) {
+	ctx, done := d.queries.Start(ctx, "CheckAccountAvailability")
+	defer done()
 	_, err := d.accounts.selectAccountByLocalpart(ctx, localpart)
 	if err == sql.ErrNoRows {
 		return true, nil
@@ -364,6 +431,8 @@ func (d *Database) CheckAccountAvailability(ctx context.Context, localpart strin
 // Returns sql.ErrNoRows if no account exists which matches the given localpart.
 func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*api.Account, error) {
+	ctx, done := d.queries.Start(ctx, "GetAccountByLocalpart")
+	defer done()
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
 
@@ -371,10 +440,162 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
 ) ([]authtypes.Profile, error) {
+	ctx, done := d.queries.Start(ctx, "SearchProfiles")
+	defer done()
 	return d.profiles.selectProfilesBySearch(ctx, searchString, limit)
 }
 
 // DeactivateAccount deactivates the user's account, removing all ability for the user to login again.
 func (d *Database) DeactivateAccount(ctx context.Context, localpart string) (err error) {
+	ctx, done := d.queries.Start(ctx, "DeactivateAccount")
+	defer done()
 	return d.accounts.deactivateAccount(ctx, localpart)
 }
+
+// SetAccountAdmin sets whether the user is a server admin.
+func (d *Database) SetAccountAdmin(ctx context.Context, localpart string, isAdmin bool) error {
+	ctx, done := d.queries.Start(ctx, "SetAccountAdmin")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.accounts.updateIsAdmin(ctx, txn, localpart, isAdmin)
+	})
+}
+
+// InsertAdminAuditEntry appends an entry to the admin audit log.
+func (d *Database) InsertAdminAuditEntry(ctx context.Context, entry *api.AdminAuditEntry) error {
+	ctx, done := d.queries.Start(ctx, "InsertAdminAuditEntry")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.adminAudit.insertAdminAudit(ctx, txn, entry)
+	})
+}
+
+// GetAdminAuditEntries returns up to limit admin audit entries older than the
+// entry with the given ID, newest first.
+func (d *Database) GetAdminAuditEntries(ctx context.Context, before int64, limit int) ([]api.AdminAuditEntry, error) {
+	ctx, done := d.queries.Start(ctx, "GetAdminAuditEntries")
+	defer done()
+	return d.adminAudit.selectAdminAudit(ctx, before, limit)
+}
+
+// GetRateLimitOverride returns the rate limit override for the given localpart,
+// or nil if the user has no override.
+func (d *Database) GetRateLimitOverride(ctx context.Context, localpart string) (*api.RateLimitOverride, error) {
+	ctx, done := d.queries.Start(ctx, "GetRateLimitOverride")
+	defer done()
+	return d.rateLimits.selectRateLimitOverride(ctx, localpart)
+}
+
+// SetRateLimitOverride sets the rate limit override for the given localpart.
+func (d *Database) SetRateLimitOverride(ctx context.Context, localpart string, override *api.RateLimitOverride) error {
+	ctx, done := d.queries.Start(ctx, "SetRateLimitOverride")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.rateLimits.upsertRateLimitOverride(ctx, txn, localpart, override)
+	})
+}
+
+// RemoveRateLimitOverride removes the rate limit override for the given
+// localpart, if there is one.
+func (d *Database) RemoveRateLimitOverride(ctx context.Context, localpart string) error {
+	ctx, done := d.queries.Start(ctx, "RemoveRateLimitOverride")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.rateLimits.deleteRateLimitOverride(ctx, txn, localpart)
+	})
+}
+
+// GetDeviceLimitOverride returns the device limit override for the given
+// localpart, or nil if the user has no override.
+func (d *Database) GetDeviceLimitOverride(ctx context.Context, localpart string) (*api.DeviceLimitOverride, error) {
+	ctx, done := d.queries.Start(ctx, "GetDeviceLimitOverride")
+	defer done()
+	return d.deviceLimits.selectDeviceLimitOverride(ctx, localpart)
+}
+
+// SetDeviceLimitOverride sets the device limit override for the given localpart.
+func (d *Database) SetDeviceLimitOverride(ctx context.Context, localpart string, override *api.DeviceLimitOverride) error {
+	ctx, done := d.queries.Start(ctx, "SetDeviceLimitOverride")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.deviceLimits.upsertDeviceLimitOverride(ctx, txn, localpart, override)
+	})
+}
+
+// RemoveDeviceLimitOverride removes the device limit override for the given
+// localpart, if there is one.
+func (d *Database) RemoveDeviceLimitOverride(ctx context.Context, localpart string) error {
+	ctx, done := d.queries.Start(ctx, "RemoveDeviceLimitOverride")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.deviceLimits.deleteDeviceLimitOverride(ctx, txn, localpart)
+	})
+}
+
+// GetUIASession returns the user-interactive auth session with the given ID,
+// or nil if there is no such session.
+func (d *Database) GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	ctx, done := d.queries.Start(ctx, "GetUIASession")
+	defer done()
+	return d.uiaSessions.selectUIASession(ctx, sessionID)
+}
+
+// SaveUIASession stores a user-interactive auth session, replacing the
+// completed stages of an existing session with the same ID.
+func (d *Database) SaveUIASession(ctx context.Context, session *api.UIASession) error {
+	ctx, done := d.queries.Start(ctx, "SaveUIASession")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.uiaSessions.upsertUIASession(ctx, txn, session)
+	})
+}
+
+// RemoveUIASessionsBefore removes the user-interactive auth sessions that
+// were started before the given time.
+func (d *Database) RemoveUIASessionsBefore(ctx context.Context, createdTS int64) error {
+	ctx, done := d.queries.Start(ctx, "RemoveUIASessionsBefore")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.uiaSessions.deleteUIASessionsBefore(ctx, txn, createdTS)
+	})
+}
+
+// GetAcceptedPolicies returns the version of each policy which the user has
+// accepted, keyed by policy ID.
+func (d *Database) GetAcceptedPolicies(ctx context.Context, localpart string) (map[string]string, error) {
+	ctx, done := d.queries.Start(ctx, "GetAcceptedPolicies")
+	defer done()
+	return d.policies.selectAcceptedPolicies(ctx, localpart)
+}
+
+// SetAcceptedPolicies records that the user accepted the given versions of
+// policies, keyed by policy ID, at the given time.
+func (d *Database) SetAcceptedPolicies(ctx context.Context, localpart string, versions map[string]string, acceptedTS int64) error {
+	ctx, done := d.queries.Start(ctx, "SetAcceptedPolicies")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		for policyID, version := range versions {
+			if err := d.policies.upsertAcceptedPolicy(ctx, txn, localpart, policyID, version, acceptedTS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetPresence returns the presence that the user has set, or nil if they have
+// never set it.
+func (d *Database) GetPresence(ctx context.Context, localpart string) (*api.Presence, error) {
+	ctx, done := d.queries.Start(ctx, "GetPresence")
+	defer done()
+	return d.presence.selectPresence(ctx, localpart)
+}
+
+// SetPresence sets the presence of the user, replacing any existing presence.
+func (d *Database) SetPresence(ctx context.Context, localpart string, presence *api.Presence) error {
+	ctx, done := d.queries.Start(ctx, "SetPresence")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.presence.upsertPresence(ctx, txn, localpart, presence)
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const uiaSessionsSchema = `
+-- Stores the progress of user-interactive auth sessions.
+CREATE TABLE IF NOT EXISTS account_uia_sessions (
+	-- The session ID given to the client
+	session_id TEXT NOT NULL PRIMARY KEY,
+	-- The auth stages that have been completed, as a JSON array
+	completed TEXT NOT NULL,
+	-- When the session was started, as a unix timestamp (ms resolution)
+	created_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_uia_sessions_created_ts_idx ON account_uia_sessions(created_ts);
+`
+
+const upsertUIASessionSQL = "" +
+	"INSERT INTO account_uia_sessions (session_id, completed, created_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (session_id) DO UPDATE SET completed = $2"
+
+const selectUIASessionSQL = "" +
+	"SELECT completed, created_ts FROM account_uia_sessions WHERE session_id = $1"
+
+const deleteUIASessionsBeforeSQL = "" +
+	"DELETE FROM account_uia_sessions WHERE created_ts < $1"
+
+type uiaSessionsStatements struct {
+	upsertUIASessionStmt        *sql.Stmt
+	selectUIASessionStmt        *sql.Stmt
+	deleteUIASessionsBeforeStmt *sql.Stmt
+}
+
+func (s *uiaSessionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(uiaSessionsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertUIASessionStmt, err = db.Prepare(upsertUIASessionSQL); err != nil {
+		return
+	}
+	if s.selectUIASessionStmt, err = db.Prepare(selectUIASessionSQL); err != nil {
+		return
+	}
+	if s.deleteUIASessionsBeforeStmt, err = db.Prepare(deleteUIASessionsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertUIASession stores the session. The creation time of an existing
+// session is never changed.
+func (s *uiaSessionsStatements) upsertUIASession(
+	ctx context.Context, txn *sql.Tx, session *api.UIASession,
+) error {
+	completed, err := json.Marshal(session.Completed)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertUIASessionStmt)
+	_, err = stmt.ExecContext(ctx, session.ID, string(completed), session.CreatedTS)
+	return err
+}
+
+// selectUIASession returns the session with the given ID, or nil if there
+// isn't one.
+func (s *uiaSessionsStatements) selectUIASession(
+	ctx context.Context, sessionID string,
+) (*api.UIASession, error) {
+	session := api.UIASession{ID: sessionID}
+	var completed string
+	err := s.selectUIASessionStmt.QueryRowContext(ctx, sessionID).Scan(&completed, &session.CreatedTS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(completed), &session.Completed); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *uiaSessionsStatements) deleteUIASessionsBefore(
+	ctx context.Context, txn *sql.Tx, createdTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteUIASessionsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, createdTS)
+	return err
+}
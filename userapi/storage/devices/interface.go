@@ -37,5 +37,19 @@ type Database interface {
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart, exceptDeviceID string) (devices []api.Device, err error)
+	// CreateDeviceWithLimit creates a device like CreateDevice, unless the user would then have more than
+	// maxDevices devices. In that case it either removes and returns their least recently used devices, if
+	// evict is true, or creates nothing and returns a nil device. The check and the creation happen in one
+	// transaction. A maxDevices of 0 means no limit.
+	CreateDeviceWithLimit(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string, maxDevices int, evict bool) (dev *api.Device, evicted []api.Device, returnErr error)
+	// SoftLogoutDevices revokes the access tokens of the given devices, or all
+	// devices except exceptDeviceID if none are given, but keeps the devices.
+	SoftLogoutDevices(ctx context.Context, localpart string, devices []string, exceptDeviceID string) error
+	// SetDeviceRefreshToken sets the refresh token of a device, and when its
+	// access and refresh tokens expire. An expiry of 0 means never.
+	SetDeviceRefreshToken(ctx context.Context, localpart, deviceID, refreshToken string, expiresTS, refreshExpiresTS int64) error
+	// RefreshDeviceTokens replaces the access and refresh tokens of the device with the given
+	// refresh token. Returns sql.ErrNoRows if the refresh token is unknown or has expired.
+	RefreshDeviceTokens(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, expiresTS, refreshExpiresTS int64) (*api.Device, error)
 	UpdateDeviceLastSeen(ctx context.Context, deviceID, ipAddr string) error
 }
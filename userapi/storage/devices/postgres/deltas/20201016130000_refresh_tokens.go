@@ -0,0 +1,36 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadRefreshTokens(m *sqlutil.Migrations) {
+	m.AddMigration(UpRefreshTokens, DownRefreshTokens)
+}
+
+func UpRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS refresh_token TEXT;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS expires_ts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS refresh_expires_ts BIGINT NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	DROP INDEX IF EXISTS device_refresh_token_idx;
+	ALTER TABLE device_devices DROP COLUMN refresh_token;
+	ALTER TABLE device_devices DROP COLUMN expires_ts;
+	ALTER TABLE device_devices DROP COLUMN refresh_expires_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/lib/pq"
@@ -57,7 +58,16 @@ CREATE TABLE IF NOT EXISTS device_devices (
 	-- The last seen IP address of this device
 	ip TEXT,
 	-- User agent of this device
-	user_agent TEXT
+	user_agent TEXT,
+	-- Whether the access token has been revoked without deleting the device, so
+	-- that the client can log in to the same device again.
+	soft_logout BOOLEAN NOT NULL DEFAULT FALSE,
+	-- The refresh token for getting a new access token, if the client asked for one.
+	refresh_token TEXT,
+	-- When the access token expires, as a unix timestamp (ms resolution), or 0 if it doesn't.
+	expires_ts BIGINT NOT NULL DEFAULT 0,
+	-- When the refresh token expires, as a unix timestamp (ms resolution), or 0 if it doesn't.
+	refresh_expires_ts BIGINT NOT NULL DEFAULT 0
                                           
     -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
 );
@@ -71,7 +81,7 @@ const insertDeviceSQL = "" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, soft_logout, expires_ts FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -79,6 +89,17 @@ const selectDeviceByIDSQL = "" +
 const selectDevicesByLocalpartSQL = "" +
 	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1 AND device_id != $2"
 
+// Held until the end of the transaction, so that the devices of a user are
+// counted and created by one transaction at a time.
+const lockDevicesByLocalpartSQL = "" +
+	"SELECT pg_advisory_xact_lock(hashtext('device_devices:' || $1))"
+
+// The devices other than the given one, except for the most recently used,
+// which are kept when evicting devices.
+const selectEvictableDevicesSQL = "" +
+	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1 AND device_id != $2" +
+	" ORDER BY last_seen_ts DESC OFFSET $3"
+
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
@@ -94,21 +115,46 @@ const deleteDevicesSQL = "" +
 const selectDevicesByIDSQL = "" +
 	"SELECT device_id, localpart, display_name FROM device_devices WHERE device_id = ANY($1)"
 
+const softLogoutDevicesSQL = "" +
+	"UPDATE device_devices SET soft_logout = TRUE WHERE localpart = $1 AND device_id = ANY($2)"
+
+const softLogoutDevicesByLocalpartSQL = "" +
+	"UPDATE device_devices SET soft_logout = TRUE WHERE localpart = $1 AND device_id != $2"
+
+const updateRefreshTokenSQL = "" +
+	"UPDATE device_devices SET refresh_token = $1, expires_ts = $2, refresh_expires_ts = $3 WHERE localpart = $4 AND device_id = $5"
+
+const selectDeviceByRefreshTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, soft_logout, refresh_expires_ts FROM device_devices WHERE refresh_token = $1"
+
+// Only a refresh token which hasn't expired, on a device which hasn't been
+// soft logged out, can be swapped for new tokens.
+const updateTokensByRefreshTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, expires_ts = $3, refresh_expires_ts = $4" +
+	" WHERE refresh_token = $5 AND soft_logout = FALSE AND (refresh_expires_ts = 0 OR refresh_expires_ts > $6)"
+
 const updateDeviceLastSeen = "" +
 	"UPDATE device_devices SET last_seen_ts = $1, ip = $2 WHERE device_id = $3"
 
 type devicesStatements struct {
-	insertDeviceStmt             *sql.Stmt
-	selectDeviceByTokenStmt      *sql.Stmt
-	selectDeviceByIDStmt         *sql.Stmt
-	selectDevicesByLocalpartStmt *sql.Stmt
-	selectDevicesByIDStmt        *sql.Stmt
-	updateDeviceNameStmt         *sql.Stmt
-	updateDeviceLastSeenStmt     *sql.Stmt
-	deleteDeviceStmt             *sql.Stmt
-	deleteDevicesByLocalpartStmt *sql.Stmt
-	deleteDevicesStmt            *sql.Stmt
-	serverName                   gomatrixserverlib.ServerName
+	insertDeviceStmt                 *sql.Stmt
+	selectDeviceByTokenStmt          *sql.Stmt
+	selectDeviceByIDStmt             *sql.Stmt
+	selectDevicesByLocalpartStmt     *sql.Stmt
+	selectEvictableDevicesStmt       *sql.Stmt
+	lockDevicesByLocalpartStmt       *sql.Stmt
+	selectDevicesByIDStmt            *sql.Stmt
+	updateDeviceNameStmt             *sql.Stmt
+	updateDeviceLastSeenStmt         *sql.Stmt
+	deleteDeviceStmt                 *sql.Stmt
+	deleteDevicesByLocalpartStmt     *sql.Stmt
+	deleteDevicesStmt                *sql.Stmt
+	softLogoutDevicesStmt            *sql.Stmt
+	softLogoutDevicesByLocalpartStmt *sql.Stmt
+	updateRefreshTokenStmt           *sql.Stmt
+	selectDeviceByRefreshTokenStmt   *sql.Stmt
+	updateTokensByRefreshTokenStmt   *sql.Stmt
+	serverName                       gomatrixserverlib.ServerName
 }
 
 func (s *devicesStatements) execSchema(db *sql.DB) error {
@@ -129,6 +175,12 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.selectDevicesByLocalpartStmt, err = db.Prepare(selectDevicesByLocalpartSQL); err != nil {
 		return
 	}
+	if s.selectEvictableDevicesStmt, err = db.Prepare(selectEvictableDevicesSQL); err != nil {
+		return
+	}
+	if s.lockDevicesByLocalpartStmt, err = db.Prepare(lockDevicesByLocalpartSQL); err != nil {
+		return
+	}
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
@@ -147,6 +199,21 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceLastSeenStmt, err = db.Prepare(updateDeviceLastSeen); err != nil {
 		return
 	}
+	if s.softLogoutDevicesStmt, err = db.Prepare(softLogoutDevicesSQL); err != nil {
+		return
+	}
+	if s.softLogoutDevicesByLocalpartStmt, err = db.Prepare(softLogoutDevicesByLocalpartSQL); err != nil {
+		return
+	}
+	if s.updateRefreshTokenStmt, err = db.Prepare(updateRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.selectDeviceByRefreshTokenStmt, err = db.Prepare(selectDeviceByRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateTokensByRefreshTokenStmt, err = db.Prepare(updateTokensByRefreshTokenSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -204,6 +271,26 @@ func (s *devicesStatements) deleteDevicesByLocalpart(
 	return err
 }
 
+// softLogoutDevices revokes the access tokens of the given devices without
+// removing the devices.
+func (s *devicesStatements) softLogoutDevices(
+	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.softLogoutDevicesStmt)
+	_, err := stmt.ExecContext(ctx, localpart, pq.Array(devices))
+	return err
+}
+
+// softLogoutDevicesByLocalpart revokes the access tokens of all devices for
+// the given user localpart without removing the devices.
+func (s *devicesStatements) softLogoutDevicesByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.softLogoutDevicesByLocalpartStmt)
+	_, err := stmt.ExecContext(ctx, localpart, exceptDeviceID)
+	return err
+}
+
 func (s *devicesStatements) updateDeviceName(
 	ctx context.Context, txn *sql.Tx, localpart, deviceID string, displayName *string,
 ) error {
@@ -218,7 +305,7 @@ func (s *devicesStatements) selectDeviceByToken(
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.SoftLoggedOut, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -271,18 +358,42 @@ func (s *devicesStatements) selectDevicesByID(ctx context.Context, deviceIDs []s
 func (s *devicesStatements) selectDevicesByLocalpart(
 	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
 ) ([]api.Device, error) {
-	devices := []api.Device{}
 	rows, err := sqlutil.TxStmt(txn, s.selectDevicesByLocalpartStmt).QueryContext(ctx, localpart, exceptDeviceID)
-
 	if err != nil {
-		return devices, err
+		return []api.Device{}, err
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectDevicesByLocalpart: rows.close() failed")
+	return s.scanDevices(localpart, rows)
+}
+
+// selectEvictableDevices returns the devices of the user other than
+// exceptDeviceID, leaving out the keep most recently used ones.
+func (s *devicesStatements) selectEvictableDevices(
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string, keep int,
+) ([]api.Device, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEvictableDevicesStmt).QueryContext(ctx, localpart, exceptDeviceID, keep)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEvictableDevices: rows.close() failed")
+	return s.scanDevices(localpart, rows)
+}
 
+// lockDevicesByLocalpart stops other transactions from counting or creating
+// the user's devices until this transaction ends.
+func (s *devicesStatements) lockDevicesByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.lockDevicesByLocalpartStmt).ExecContext(ctx, localpart)
+	return err
+}
+
+func (s *devicesStatements) scanDevices(localpart string, rows *sql.Rows) ([]api.Device, error) {
+	devices := []api.Device{}
 	for rows.Next() {
 		var dev api.Device
 		var id, displayname sql.NullString
-		err = rows.Scan(&id, &displayname)
+		err := rows.Scan(&id, &displayname)
 		if err != nil {
 			return devices, err
 		}
@@ -305,3 +416,56 @@ func (s *devicesStatements) updateDeviceLastSeen(ctx context.Context, txn *sql.T
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, deviceID)
 	return err
 }
+
+// updateRefreshToken sets the refresh token of a device and the expiry of its
+// access and refresh tokens.
+func (s *devicesStatements) updateRefreshToken(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, refreshToken string,
+	expiresTS, refreshExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, expiresTS, refreshExpiresTS, localpart, deviceID)
+	return err
+}
+
+// selectDeviceByRefreshToken retrieves the device with the given refresh token
+// and when the refresh token expires.
+func (s *devicesStatements) selectDeviceByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (dev *api.Device, refreshExpiresTS int64, err error) {
+	dev = &api.Device{}
+	var localpart string
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceByRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.SoftLoggedOut, &refreshExpiresTS)
+	if err == nil {
+		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+	}
+	return
+}
+
+// updateTokensByRefreshToken replaces the access and refresh tokens of the
+// device with the given refresh token, unless the refresh token expired before
+// nowTS or the device has been soft logged out. Returns sql.ErrNoRows if no
+// device was updated.
+func (s *devicesStatements) updateTokensByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, newAccessToken, newRefreshToken string,
+	expiresTS, refreshExpiresTS, nowTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateTokensByRefreshTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, newRefreshToken, expiresTS, refreshExpiresTS, refreshToken, nowTS)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	switch affected {
+	case 0:
+		return sql.ErrNoRows
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("refresh token matched %d devices", affected)
+	}
+}
@@ -0,0 +1,75 @@
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func LoadRefreshTokens(m *sqlutil.Migrations) {
+	m.AddMigration(UpRefreshTokens, DownRefreshTokens)
+}
+
+func UpRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+    ALTER TABLE device_devices RENAME TO device_devices_tmp;
+    CREATE TABLE device_devices (
+        access_token TEXT PRIMARY KEY,
+        session_id INTEGER,
+        device_id TEXT ,
+        localpart TEXT ,
+        created_ts BIGINT,
+        display_name TEXT,
+        last_seen_ts BIGINT,
+        ip TEXT,
+        user_agent TEXT,
+        soft_logout BOOLEAN NOT NULL DEFAULT FALSE,
+        refresh_token TEXT,
+        expires_ts BIGINT NOT NULL DEFAULT 0,
+        refresh_expires_ts BIGINT NOT NULL DEFAULT 0,
+        UNIQUE (localpart, device_id)
+    );
+    INSERT
+    INTO device_devices (
+        access_token, session_id, device_id, localpart, created_ts, display_name, last_seen_ts, ip, user_agent, soft_logout
+    )  SELECT
+           access_token, session_id, device_id, localpart, created_ts, display_name, last_seen_ts, ip, user_agent, soft_logout
+    FROM device_devices_tmp;
+    DROP TABLE device_devices_tmp;
+    CREATE UNIQUE INDEX IF NOT EXISTS device_refresh_token_idx ON device_devices(refresh_token);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DROP INDEX IF EXISTS device_refresh_token_idx;
+ALTER TABLE device_devices RENAME TO device_devices_tmp;
+CREATE TABLE device_devices (
+    access_token TEXT PRIMARY KEY,
+    session_id INTEGER,
+    device_id TEXT ,
+    localpart TEXT ,
+    created_ts BIGINT,
+    display_name TEXT,
+    last_seen_ts BIGINT,
+    ip TEXT,
+    user_agent TEXT,
+    soft_logout BOOLEAN NOT NULL DEFAULT FALSE,
+    UNIQUE (localpart, device_id)
+);
+INSERT
+INTO device_devices (
+    access_token, session_id, device_id, localpart, created_ts, display_name, last_seen_ts, ip, user_agent, soft_logout
+) SELECT
+       access_token, session_id, device_id, localpart, created_ts, display_name, last_seen_ts, ip, user_agent, soft_logout
+FROM device_devices_tmp;
+DROP TABLE device_devices_tmp;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
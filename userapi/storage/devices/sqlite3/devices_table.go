@@ -17,6 +17,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 	"time"
 
@@ -43,6 +44,10 @@ CREATE TABLE IF NOT EXISTS device_devices (
     last_seen_ts BIGINT,
     ip TEXT,
     user_agent TEXT,
+    soft_logout BOOLEAN NOT NULL DEFAULT FALSE,
+    refresh_token TEXT,
+    expires_ts BIGINT NOT NULL DEFAULT 0,
+    refresh_expires_ts BIGINT NOT NULL DEFAULT 0,
 
 		UNIQUE (localpart, device_id)
 );
@@ -56,7 +61,7 @@ const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM device_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, soft_logout, expires_ts FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -64,6 +69,12 @@ const selectDeviceByIDSQL = "" +
 const selectDevicesByLocalpartSQL = "" +
 	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1 AND device_id != $2"
 
+// The devices other than the given one, except for the most recently used,
+// which are kept when evicting devices.
+const selectEvictableDevicesSQL = "" +
+	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1 AND device_id != $2" +
+	" ORDER BY last_seen_ts DESC LIMIT -1 OFFSET $3"
+
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
@@ -79,23 +90,47 @@ const deleteDevicesSQL = "" +
 const selectDevicesByIDSQL = "" +
 	"SELECT device_id, localpart, display_name FROM device_devices WHERE device_id IN ($1)"
 
+const softLogoutDevicesSQL = "" +
+	"UPDATE device_devices SET soft_logout = TRUE WHERE localpart = $1 AND device_id IN ($2)"
+
+const softLogoutDevicesByLocalpartSQL = "" +
+	"UPDATE device_devices SET soft_logout = TRUE WHERE localpart = $1 AND device_id != $2"
+
+const updateRefreshTokenSQL = "" +
+	"UPDATE device_devices SET refresh_token = $1, expires_ts = $2, refresh_expires_ts = $3 WHERE localpart = $4 AND device_id = $5"
+
+const selectDeviceByRefreshTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, soft_logout, refresh_expires_ts FROM device_devices WHERE refresh_token = $1"
+
+// Only a refresh token which hasn't expired, on a device which hasn't been
+// soft logged out, can be swapped for new tokens.
+const updateTokensByRefreshTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1, refresh_token = $2, expires_ts = $3, refresh_expires_ts = $4" +
+	" WHERE refresh_token = $5 AND soft_logout = FALSE AND (refresh_expires_ts = 0 OR refresh_expires_ts > $6)"
+
 const updateDeviceLastSeen = "" +
 	"UPDATE device_devices SET last_seen_ts = $1, ip = $2 WHERE device_id = $3"
 
 type devicesStatements struct {
-	db                           *sql.DB
-	writer                       sqlutil.Writer
-	insertDeviceStmt             *sql.Stmt
-	selectDevicesCountStmt       *sql.Stmt
-	selectDeviceByTokenStmt      *sql.Stmt
-	selectDeviceByIDStmt         *sql.Stmt
-	selectDevicesByIDStmt        *sql.Stmt
-	selectDevicesByLocalpartStmt *sql.Stmt
-	updateDeviceNameStmt         *sql.Stmt
-	updateDeviceLastSeenStmt     *sql.Stmt
-	deleteDeviceStmt             *sql.Stmt
-	deleteDevicesByLocalpartStmt *sql.Stmt
-	serverName                   gomatrixserverlib.ServerName
+	db                               *sql.DB
+	writer                           sqlutil.Writer
+	variadicStmts                    *sqlutil.StatementCache
+	insertDeviceStmt                 *sql.Stmt
+	selectDevicesCountStmt           *sql.Stmt
+	selectDeviceByTokenStmt          *sql.Stmt
+	selectDeviceByIDStmt             *sql.Stmt
+	selectDevicesByIDStmt            *sql.Stmt
+	selectDevicesByLocalpartStmt     *sql.Stmt
+	selectEvictableDevicesStmt       *sql.Stmt
+	updateDeviceNameStmt             *sql.Stmt
+	updateDeviceLastSeenStmt         *sql.Stmt
+	deleteDeviceStmt                 *sql.Stmt
+	deleteDevicesByLocalpartStmt     *sql.Stmt
+	softLogoutDevicesByLocalpartStmt *sql.Stmt
+	updateRefreshTokenStmt           *sql.Stmt
+	selectDeviceByRefreshTokenStmt   *sql.Stmt
+	updateTokensByRefreshTokenStmt   *sql.Stmt
+	serverName                       gomatrixserverlib.ServerName
 }
 
 func (s *devicesStatements) execSchema(db *sql.DB) error {
@@ -106,6 +141,7 @@ func (s *devicesStatements) execSchema(db *sql.DB) error {
 func (s *devicesStatements) prepare(db *sql.DB, writer sqlutil.Writer, server gomatrixserverlib.ServerName) (err error) {
 	s.db = db
 	s.writer = writer
+	s.variadicStmts = sqlutil.NewStatementCache(db)
 	if s.insertDeviceStmt, err = db.Prepare(insertDeviceSQL); err != nil {
 		return
 	}
@@ -121,6 +157,9 @@ func (s *devicesStatements) prepare(db *sql.DB, writer sqlutil.Writer, server go
 	if s.selectDevicesByLocalpartStmt, err = db.Prepare(selectDevicesByLocalpartSQL); err != nil {
 		return
 	}
+	if s.selectEvictableDevicesStmt, err = db.Prepare(selectEvictableDevicesSQL); err != nil {
+		return
+	}
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
@@ -136,6 +175,18 @@ func (s *devicesStatements) prepare(db *sql.DB, writer sqlutil.Writer, server go
 	if s.updateDeviceLastSeenStmt, err = db.Prepare(updateDeviceLastSeen); err != nil {
 		return
 	}
+	if s.softLogoutDevicesByLocalpartStmt, err = db.Prepare(softLogoutDevicesByLocalpartSQL); err != nil {
+		return
+	}
+	if s.updateRefreshTokenStmt, err = db.Prepare(updateRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.selectDeviceByRefreshTokenStmt, err = db.Prepare(selectDeviceByRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.updateTokensByRefreshTokenStmt, err = db.Prepare(updateTokensByRefreshTokenSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -181,7 +232,7 @@ func (s *devicesStatements) deleteDevices(
 	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
 ) error {
 	orig := strings.Replace(deleteDevicesSQL, "($2)", sqlutil.QueryVariadicOffset(len(devices), 1), 1)
-	prep, err := s.db.Prepare(orig)
+	prep, err := s.variadicStmts.Prepare(orig)
 	if err != nil {
 		return err
 	}
@@ -195,6 +246,32 @@ func (s *devicesStatements) deleteDevices(
 	return err
 }
 
+func (s *devicesStatements) softLogoutDevices(
+	ctx context.Context, txn *sql.Tx, localpart string, devices []string,
+) error {
+	orig := strings.Replace(softLogoutDevicesSQL, "($2)", sqlutil.QueryVariadicOffset(len(devices), 1), 1)
+	prep, err := s.variadicStmts.Prepare(orig)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, prep)
+	params := make([]interface{}, len(devices)+1)
+	params[0] = localpart
+	for i, v := range devices {
+		params[i+1] = v
+	}
+	_, err = stmt.ExecContext(ctx, params...)
+	return err
+}
+
+func (s *devicesStatements) softLogoutDevicesByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.softLogoutDevicesByLocalpartStmt)
+	_, err := stmt.ExecContext(ctx, localpart, exceptDeviceID)
+	return err
+}
+
 func (s *devicesStatements) deleteDevicesByLocalpart(
 	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
 ) error {
@@ -217,7 +294,7 @@ func (s *devicesStatements) selectDeviceByToken(
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.SoftLoggedOut, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -247,17 +324,33 @@ func (s *devicesStatements) selectDeviceByID(
 func (s *devicesStatements) selectDevicesByLocalpart(
 	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
 ) ([]api.Device, error) {
-	devices := []api.Device{}
 	rows, err := sqlutil.TxStmt(txn, s.selectDevicesByLocalpartStmt).QueryContext(ctx, localpart, exceptDeviceID)
+	if err != nil {
+		return []api.Device{}, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDevicesByLocalpart: rows.close() failed")
+	return s.scanDevices(localpart, rows)
+}
 
+// selectEvictableDevices returns the devices of the user other than
+// exceptDeviceID, leaving out the keep most recently used ones.
+func (s *devicesStatements) selectEvictableDevices(
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string, keep int,
+) ([]api.Device, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEvictableDevicesStmt).QueryContext(ctx, localpart, exceptDeviceID, keep)
 	if err != nil {
-		return devices, err
+		return nil, err
 	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEvictableDevices: rows.close() failed")
+	return s.scanDevices(localpart, rows)
+}
 
+func (s *devicesStatements) scanDevices(localpart string, rows *sql.Rows) ([]api.Device, error) {
+	devices := []api.Device{}
 	for rows.Next() {
 		var dev api.Device
 		var id, displayname sql.NullString
-		err = rows.Scan(&id, &displayname)
+		err := rows.Scan(&id, &displayname)
 		if err != nil {
 			return devices, err
 		}
@@ -281,7 +374,11 @@ func (s *devicesStatements) selectDevicesByID(ctx context.Context, deviceIDs []s
 		iDeviceIDs[i] = deviceIDs[i]
 	}
 
-	rows, err := s.db.QueryContext(ctx, sqlQuery, iDeviceIDs...)
+	stmt, err := s.variadicStmts.Prepare(sqlQuery)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, iDeviceIDs...)
 	if err != nil {
 		return nil, err
 	}
@@ -309,3 +406,56 @@ func (s *devicesStatements) updateDeviceLastSeen(ctx context.Context, txn *sql.T
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, deviceID)
 	return err
 }
+
+// updateRefreshToken sets the refresh token of a device and the expiry of its
+// access and refresh tokens.
+func (s *devicesStatements) updateRefreshToken(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, refreshToken string,
+	expiresTS, refreshExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, expiresTS, refreshExpiresTS, localpart, deviceID)
+	return err
+}
+
+// selectDeviceByRefreshToken retrieves the device with the given refresh token
+// and when the refresh token expires.
+func (s *devicesStatements) selectDeviceByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (dev *api.Device, refreshExpiresTS int64, err error) {
+	dev = &api.Device{}
+	var localpart string
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceByRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.SoftLoggedOut, &refreshExpiresTS)
+	if err == nil {
+		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+	}
+	return
+}
+
+// updateTokensByRefreshToken replaces the access and refresh tokens of the
+// device with the given refresh token, unless the refresh token expired before
+// nowTS or the device has been soft logged out. Returns sql.ErrNoRows if no
+// device was updated.
+func (s *devicesStatements) updateTokensByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, newAccessToken, newRefreshToken string,
+	expiresTS, refreshExpiresTS, nowTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateTokensByRefreshTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, newRefreshToken, expiresTS, refreshExpiresTS, refreshToken, nowTS)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	switch affected {
+	case 0:
+		return sql.ErrNoRows
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("refresh token matched %d devices", affected)
+	}
+}
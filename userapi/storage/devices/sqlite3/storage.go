@@ -19,6 +19,7 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -37,11 +38,21 @@ type Database struct {
 	db      *sql.DB
 	writer  sqlutil.Writer
 	devices devicesStatements
+	queries sqlutil.QueryTimer
+}
+
+// Migrations returns the schema migrations of the devices database.
+func Migrations() *sqlutil.Migrations {
+	m := sqlutil.NewMigrations("devices")
+	deltas.LoadLastSeenTSIP(m)
+	deltas.LoadSoftLogout(m)
+	deltas.LoadRefreshTokens(m)
+	return m
 }
 
 // NewDatabase creates a new device database
 func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName) (*Database, error) {
-	db, err := sqlutil.Open(dbProperties)
+	db, err := sqlutil.OpenNamed("devices", dbProperties)
 	if err != nil {
 		return nil, err
 	}
@@ -53,15 +64,16 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.execSchema(db); err != nil {
 		return nil, err
 	}
-	m := sqlutil.NewMigrations()
-	deltas.LoadLastSeenTSIP(m)
-	if err = m.RunDeltas(db, dbProperties); err != nil {
+	if err = Migrations().RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
 	if err = d.prepare(db, writer, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, writer, d}, nil
+	return &Database{db, writer, d, sqlutil.QueryTimer{
+		Database: "devices",
+		Timeout:  dbProperties.QueryTimeout(),
+	}}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -69,6 +81,8 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 func (d *Database) GetDeviceByAccessToken(
 	ctx context.Context, token string,
 ) (*api.Device, error) {
+	ctx, done := d.queries.Start(ctx, "GetDeviceByAccessToken")
+	defer done()
 	return d.devices.selectDeviceByToken(ctx, token)
 }
 
@@ -77,6 +91,8 @@ func (d *Database) GetDeviceByAccessToken(
 func (d *Database) GetDeviceByID(
 	ctx context.Context, localpart, deviceID string,
 ) (*api.Device, error) {
+	ctx, done := d.queries.Start(ctx, "GetDeviceByID")
+	defer done()
 	return d.devices.selectDeviceByID(ctx, localpart, deviceID)
 }
 
@@ -84,10 +100,14 @@ func (d *Database) GetDeviceByID(
 func (d *Database) GetDevicesByLocalpart(
 	ctx context.Context, localpart string,
 ) ([]api.Device, error) {
+	ctx, done := d.queries.Start(ctx, "GetDevicesByLocalpart")
+	defer done()
 	return d.devices.selectDevicesByLocalpart(ctx, nil, localpart, "")
 }
 
 func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error) {
+	ctx, done := d.queries.Start(ctx, "GetDevicesByID")
+	defer done()
 	return d.devices.selectDevicesByID(ctx, deviceIDs)
 }
 
@@ -101,6 +121,8 @@ func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, deviceID *string, accessToken string,
 	displayName *string, ipAddr, userAgent string,
 ) (dev *api.Device, returnErr error) {
+	ctx, done := d.queries.Start(ctx, "CreateDevice")
+	defer done()
 	if deviceID != nil {
 		returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 			var err error
@@ -152,6 +174,8 @@ func generateDeviceID() (string, error) {
 func (d *Database) UpdateDevice(
 	ctx context.Context, localpart, deviceID string, displayName *string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "UpdateDevice")
+	defer done()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 		return d.devices.updateDeviceName(ctx, txn, localpart, deviceID, displayName)
 	})
@@ -164,6 +188,8 @@ func (d *Database) UpdateDevice(
 func (d *Database) RemoveDevice(
 	ctx context.Context, deviceID, localpart string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "RemoveDevice")
+	defer done()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != sql.ErrNoRows {
 			return err
@@ -179,6 +205,8 @@ func (d *Database) RemoveDevice(
 func (d *Database) RemoveDevices(
 	ctx context.Context, localpart string, devices []string,
 ) error {
+	ctx, done := d.queries.Start(ctx, "RemoveDevices")
+	defer done()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != sql.ErrNoRows {
 			return err
@@ -193,6 +221,8 @@ func (d *Database) RemoveDevices(
 func (d *Database) RemoveAllDevices(
 	ctx context.Context, localpart, exceptDeviceID string,
 ) (devices []api.Device, err error) {
+	ctx, done := d.queries.Start(ctx, "RemoveAllDevices")
+	defer done()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 		devices, err = d.devices.selectDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID)
 		if err != nil {
@@ -206,8 +236,147 @@ func (d *Database) RemoveAllDevices(
 	return
 }
 
+// CreateDeviceWithLimit creates a device like CreateDevice, as long as the
+// user then has no more than maxDevices devices, which is checked in the same
+// transaction. If they would have more, their least recently used devices are
+// removed to make room and returned if evict is true, or otherwise no device
+// is created and a nil device is returned. Logging in again to an existing
+// device doesn't count as a new device. A maxDevices of 0 means no limit.
+func (d *Database) CreateDeviceWithLimit(
+	ctx context.Context, localpart string, deviceID *string, accessToken string,
+	displayName *string, ipAddr, userAgent string, maxDevices int, evict bool,
+) (dev *api.Device, evicted []api.Device, returnErr error) {
+	ctx, done := d.queries.Start(ctx, "CreateDeviceWithLimit")
+	defer done()
+	// Generated device IDs are retried in case they are already taken, as
+	// in CreateDevice.
+	for i := 1; i <= 5; i++ {
+		newDeviceID := ""
+		if deviceID != nil {
+			newDeviceID = *deviceID
+		} else if newDeviceID, returnErr = generateDeviceID(); returnErr != nil {
+			return
+		}
+		returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+			var err error
+			dev, evicted, err = d.createDeviceWithLimit(
+				ctx, txn, localpart, newDeviceID, deviceID != nil, accessToken,
+				displayName, ipAddr, userAgent, maxDevices, evict,
+			)
+			return err
+		})
+		if returnErr == nil || deviceID != nil {
+			return
+		}
+	}
+	return
+}
+
+func (d *Database) createDeviceWithLimit(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID string, replace bool,
+	accessToken string, displayName *string, ipAddr, userAgent string,
+	maxDevices int, evict bool,
+) (dev *api.Device, evicted []api.Device, err error) {
+	overLimit := false
+	if maxDevices > 0 {
+		var others []api.Device
+		if others, err = d.devices.selectDevicesByLocalpart(ctx, txn, localpart, deviceID); err != nil {
+			return nil, nil, err
+		}
+		overLimit = len(others) >= maxDevices
+		if overLimit && !evict {
+			return nil, nil, nil
+		}
+	}
+	if replace {
+		// Revoke existing tokens for this device
+		if err = d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != nil {
+			return nil, nil, err
+		}
+	}
+	if dev, err = d.devices.insertDevice(ctx, txn, deviceID, localpart, accessToken, displayName, ipAddr, userAgent); err != nil {
+		return nil, nil, err
+	}
+	if !overLimit {
+		return dev, nil, nil
+	}
+	evicted, err = d.devices.selectEvictableDevices(ctx, txn, localpart, dev.ID, maxDevices-1)
+	if err != nil || len(evicted) == 0 {
+		return dev, nil, err
+	}
+	deviceIDs := make([]string, len(evicted))
+	for i, evictedDev := range evicted {
+		deviceIDs[i] = evictedDev.ID
+	}
+	return dev, evicted, d.devices.deleteDevices(ctx, txn, localpart, deviceIDs)
+}
+
+// SoftLogoutDevices revokes the access tokens of the given devices, or of all
+// of the user's devices except exceptDeviceID if none are given, without
+// removing the devices or their keys. The clients will be told that they have
+// been soft logged out, so that they can log in again to the same devices.
+func (d *Database) SoftLogoutDevices(
+	ctx context.Context, localpart string, devices []string, exceptDeviceID string,
+) error {
+	ctx, done := d.queries.Start(ctx, "SoftLogoutDevices")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if len(devices) == 0 {
+			return d.devices.softLogoutDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID)
+		}
+		return d.devices.softLogoutDevices(ctx, txn, localpart, devices)
+	})
+}
+
+// SetDeviceRefreshToken sets the refresh token of a device, and when its
+// access and refresh tokens expire. An expiry of 0 means that the token never
+// expires.
+func (d *Database) SetDeviceRefreshToken(
+	ctx context.Context, localpart, deviceID, refreshToken string,
+	expiresTS, refreshExpiresTS int64,
+) error {
+	ctx, done := d.queries.Start(ctx, "SetDeviceRefreshToken")
+	defer done()
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.devices.updateRefreshToken(ctx, txn, localpart, deviceID, refreshToken, expiresTS, refreshExpiresTS)
+	})
+}
+
+// RefreshDeviceTokens replaces the access and refresh tokens of the device
+// with the given refresh token, which can't be used again afterwards.
+// Returns sql.ErrNoRows if no device has the refresh token, or if it has
+// expired or the device has been soft logged out.
+func (d *Database) RefreshDeviceTokens(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string,
+	expiresTS, refreshExpiresTS int64,
+) (dev *api.Device, err error) {
+	ctx, done := d.queries.Start(ctx, "RefreshDeviceTokens")
+	defer done()
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		// Check and swap the refresh token in one statement, so that it can
+		// only be used once even when refreshes race.
+		nowTS := time.Now().UnixNano() / 1000000
+		if err = d.devices.updateTokensByRefreshToken(ctx, txn, refreshToken, newAccessToken, newRefreshToken, expiresTS, refreshExpiresTS, nowTS); err != nil {
+			return err
+		}
+		dev, _, err = d.devices.selectDeviceByRefreshToken(ctx, txn, newRefreshToken)
+		if err != nil {
+			return err
+		}
+		dev.AccessToken = newAccessToken
+		dev.AccessTokenExpiresTS = expiresTS
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
 // UpdateDeviceLastSeen updates a the last seen timestamp and the ip address
 func (d *Database) UpdateDeviceLastSeen(ctx context.Context, deviceID, ipAddr string) error {
+	ctx, done := d.queries.Start(ctx, "UpdateDeviceLastSeen")
+	defer done()
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 		return d.devices.updateDeviceLastSeen(ctx, txn, deviceID, ipAddr)
 	})
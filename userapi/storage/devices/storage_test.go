@@ -0,0 +1,202 @@
+package devices
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+var ctx = context.Background()
+
+func mustCreateDatabase(t *testing.T) (Database, func()) {
+	tmpfile, err := ioutil.TempFile("", "devices_storage_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	db, err := NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	}, "kaer.morhen")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return db, func() {
+		os.Remove(tmpfile.Name())
+	}
+}
+
+func mustCreateDeviceWithRefreshToken(t *testing.T, db Database, deviceID, accessToken, refreshToken string, refreshExpiresTS int64) {
+	t.Helper()
+	if _, err := db.CreateDevice(ctx, "ciri", &deviceID, accessToken, nil, "", ""); err != nil {
+		t.Fatalf("failed to create device: %s", err)
+	}
+	if err := db.SetDeviceRefreshToken(ctx, "ciri", deviceID, refreshToken, 0, refreshExpiresTS); err != nil {
+		t.Fatalf("failed to set refresh token: %s", err)
+	}
+}
+
+func TestRefreshDeviceTokens(t *testing.T) {
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+	mustCreateDeviceWithRefreshToken(t, db, "CIRI", "access1", "refresh1", 0)
+
+	expiresTS := time.Now().Add(time.Hour).UnixNano() / 1000000
+	dev, err := db.RefreshDeviceTokens(ctx, "refresh1", "access2", "refresh2", expiresTS, 0)
+	if err != nil {
+		t.Fatalf("RefreshDeviceTokens failed: %s", err)
+	}
+	if dev.ID != "CIRI" || dev.UserID != "@ciri:kaer.morhen" || dev.AccessToken != "access2" || dev.AccessTokenExpiresTS != expiresTS {
+		t.Errorf("got device %+v, want CIRI with the new access token", dev)
+	}
+	if _, err = db.GetDeviceByAccessToken(ctx, "access1"); err != sql.ErrNoRows {
+		t.Errorf("old access token: got error %v, want %v", err, sql.ErrNoRows)
+	}
+	if dev, err = db.GetDeviceByAccessToken(ctx, "access2"); err != nil || dev.ID != "CIRI" {
+		t.Errorf("new access token: got device %+v and error %v, want CIRI", dev, err)
+	}
+
+	// The old refresh token can't be used again.
+	if _, err = db.RefreshDeviceTokens(ctx, "refresh1", "access3", "refresh3", 0, 0); err != sql.ErrNoRows {
+		t.Errorf("reusing a refresh token: got error %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestRefreshDeviceTokensRejectsExpiredAndSoftLoggedOut(t *testing.T) {
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+	mustCreateDeviceWithRefreshToken(t, db, "EXPIRED", "access1", "refresh1", time.Now().Add(-time.Minute).UnixNano()/1000000)
+	mustCreateDeviceWithRefreshToken(t, db, "SOFT", "access2", "refresh2", 0)
+	if err := db.SoftLogoutDevices(ctx, "ciri", []string{"SOFT"}, ""); err != nil {
+		t.Fatalf("failed to soft logout device: %s", err)
+	}
+
+	for _, refreshToken := range []string{"refresh1", "refresh2", "unknown"} {
+		if _, err := db.RefreshDeviceTokens(ctx, refreshToken, "new-"+refreshToken, "new-"+refreshToken, 0, 0); err != sql.ErrNoRows {
+			t.Errorf("%s: got error %v, want %v", refreshToken, err, sql.ErrNoRows)
+		}
+	}
+	if _, err := db.GetDeviceByAccessToken(ctx, "access1"); err != nil {
+		t.Errorf("a failed refresh replaced the access token: %s", err)
+	}
+}
+
+func TestRefreshDeviceTokensOnlyOnce(t *testing.T) {
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+	mustCreateDeviceWithRefreshToken(t, db, "CIRI", "access", "refresh", 0)
+
+	const refreshes = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, refreshes)
+	for i := 0; i < refreshes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := fmt.Sprintf("token%d", i)
+			_, err := db.RefreshDeviceTokens(ctx, "refresh", token, token, 0, 0)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+		case sql.ErrNoRows:
+		default:
+			t.Errorf("RefreshDeviceTokens failed: %s", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("got %d successful refreshes with the same token, want 1", succeeded)
+	}
+}
+
+func TestCreateDeviceWithLimit(t *testing.T) {
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+	for _, deviceID := range []string{"OLD", "NEW"} {
+		deviceID := deviceID
+		if _, err := db.CreateDevice(ctx, "ciri", &deviceID, "access-"+deviceID, nil, "", ""); err != nil {
+			t.Fatalf("failed to create device: %s", err)
+		}
+		time.Sleep(2 * time.Millisecond) // so that the devices are last seen at different times
+	}
+
+	third := "THIRD"
+	dev, evicted, err := db.CreateDeviceWithLimit(ctx, "ciri", &third, "access-THIRD", nil, "", "", 2, false)
+	if err != nil {
+		t.Fatalf("CreateDeviceWithLimit failed: %s", err)
+	}
+	if dev != nil || len(evicted) != 0 {
+		t.Fatalf("over the limit: got device %+v and evicted %+v, want neither", dev, evicted)
+	}
+
+	// Logging in again to an existing device doesn't count as a new device.
+	existing := "NEW"
+	if dev, _, err = db.CreateDeviceWithLimit(ctx, "ciri", &existing, "access-NEW2", nil, "", "", 2, false); err != nil || dev == nil {
+		t.Fatalf("logging in to an existing device: got device %+v and error %v", dev, err)
+	}
+
+	if dev, evicted, err = db.CreateDeviceWithLimit(ctx, "ciri", &third, "access-THIRD", nil, "", "", 2, true); err != nil || dev == nil {
+		t.Fatalf("evicting: got device %+v and error %v", dev, err)
+	}
+	if len(evicted) != 1 || evicted[0].ID != "OLD" {
+		t.Errorf("got evicted devices %+v, want the least recently used OLD", evicted)
+	}
+	devices, err := db.GetDevicesByLocalpart(ctx, "ciri")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart failed: %s", err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("got %d devices after evicting, want 2", len(devices))
+	}
+	if _, err = db.GetDeviceByAccessToken(ctx, "access-OLD"); err != sql.ErrNoRows {
+		t.Errorf("evicted device's access token: got error %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestCreateDeviceWithLimitConcurrently(t *testing.T) {
+	db, clean := mustCreateDatabase(t)
+	defer clean()
+
+	const logins, maxDevices = 10, 3
+	var wg sync.WaitGroup
+	created := make(chan bool, logins)
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dev, _, err := db.CreateDeviceWithLimit(ctx, "ciri", nil, fmt.Sprintf("access%d", i), nil, "", "", maxDevices, false)
+			if err != nil {
+				t.Errorf("CreateDeviceWithLimit failed: %s", err)
+			}
+			created <- dev != nil
+		}(i)
+	}
+	wg.Wait()
+	close(created)
+
+	succeeded := 0
+	for ok := range created {
+		if ok {
+			succeeded++
+		}
+	}
+	devices, err := db.GetDevicesByLocalpart(ctx, "ciri")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart failed: %s", err)
+	}
+	if succeeded != maxDevices || len(devices) != maxDevices {
+		t.Errorf("got %d devices created and %d stored, want %d", succeeded, len(devices), maxDevices)
+	}
+}